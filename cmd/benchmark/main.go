@@ -6,8 +6,10 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"math/rand"
 	"net/http"
+	"os"
 	"sort"
 	"sync"
 	"sync/atomic"
@@ -22,6 +24,7 @@ var (
 	numThreads     = flag.Int("threads", 4, "Number of threads")
 	valueSize      = flag.Int("value-size", 100, "Size of values in bytes")
 	reportInterval = flag.Int("report-interval", 1000, "Report progress every N operations")
+	histogramOut   = flag.String("histogram-out", "", "Write the latency histograms of both phases as CSV to this file")
 )
 
 // Statistics
@@ -89,16 +92,101 @@ func (s *Stats) calculatePercentiles() {
 	})
 
 	// Calculate p95 and p99
-	p95Index := int(float64(len(s.latencies)) * 0.95)
-	p99Index := int(float64(len(s.latencies)) * 0.99)
+	s.p95LatencyNs = int64(percentile(s.latencies, 0.95))
+	s.p99LatencyNs = int64(percentile(s.latencies, 0.99))
+}
 
-	if p95Index < len(s.latencies) {
-		s.p95LatencyNs = int64(s.latencies[p95Index])
+// percentile returns the p-th percentile (0 < p <= 1) of sorted latencies by
+// the nearest-rank method: the smallest latency such that at least p of all
+// latencies are less than or equal to it
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
 	}
 
-	if p99Index < len(s.latencies) {
-		s.p99LatencyNs = int64(s.latencies[p99Index])
+	rank := int(math.Ceil(p * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(sorted) {
+		rank = len(sorted)
 	}
+	return sorted[rank-1]
+}
+
+// histogramBucket counts the latencies in (previous bucket's upper bound, upperBound]
+type histogramBucket struct {
+	upperBound time.Duration
+	count      int
+}
+
+// histogramGrowth is the ratio between the upper bounds of consecutive
+// histogram buckets, so each bucket is within 10% of the latencies it counts
+const histogramGrowth = 1.1
+
+// histogram buckets sorted latencies into exponentially growing buckets,
+// starting at 1µs, up to the bucket holding the largest latency
+func histogram(sorted []time.Duration) []histogramBucket {
+	var buckets []histogramBucket
+	if len(sorted) == 0 {
+		return buckets
+	}
+
+	bound := time.Microsecond
+	i := 0
+	for i < len(sorted) {
+		bucket := histogramBucket{upperBound: bound}
+		for i < len(sorted) && sorted[i] <= bound {
+			bucket.count++
+			i++
+		}
+		buckets = append(buckets, bucket)
+		bound = time.Duration(math.Ceil(float64(bound) * histogramGrowth))
+	}
+
+	return buckets
+}
+
+// writeHistogram writes the latency histogram of a phase as CSV lines of
+// phase, bucket upper bound in nanoseconds, count, cumulative count and the
+// cumulative fraction of operations
+func (s *Stats) writeHistogram(w io.Writer, phase string) error {
+	s.calculatePercentiles() // Sorts the latencies
+
+	s.latenciesMutex.Lock()
+	defer s.latenciesMutex.Unlock()
+
+	cumulative := 0
+	for _, bucket := range histogram(s.latencies) {
+		cumulative += bucket.count
+		fraction := float64(cumulative) / float64(len(s.latencies))
+		if _, err := fmt.Fprintf(w, "%s,%d,%d,%d,%.6f\n", phase, int64(bucket.upperBound), bucket.count, cumulative, fraction); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeHistograms writes the latency histograms of the insert and query
+// phases to a CSV file at path
+func writeHistograms(path string, insertStats, queryStats *Stats) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create histogram file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := fmt.Fprintln(f, "phase,upper_bound_ns,count,cumulative_count,cumulative_fraction"); err != nil {
+		return fmt.Errorf("failed to write histogram: %w", err)
+	}
+	if err := insertStats.writeHistogram(f, "insert"); err != nil {
+		return fmt.Errorf("failed to write insert histogram: %w", err)
+	}
+	if err := queryStats.writeHistogram(f, "query"); err != nil {
+		return fmt.Errorf("failed to write query histogram: %w", err)
+	}
+
+	return f.Close()
 }
 
 func (s *Stats) printStats(operation string) {
@@ -160,6 +248,14 @@ func main() {
 	fmt.Printf("\nRunning query benchmark with %d threads...\n", *numThreads)
 	queryStats := runQueryBenchmark(client, keys)
 	queryStats.printStats("Query")
+
+	// Export the latency distributions
+	if *histogramOut != "" {
+		if err := writeHistograms(*histogramOut, insertStats, queryStats); err != nil {
+			log.Fatalf("Failed to export histograms: %v", err)
+		}
+		fmt.Printf("\nLatency histograms written to %s\n", *histogramOut)
+	}
 }
 
 func runInsertBenchmark(client *http.Client, keys []string, values [][]byte) *Stats {
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	// 1ms, 2ms, ..., 100ms
+	latencies := make([]time.Duration, 100)
+	for i := range latencies {
+		latencies[i] = time.Duration(i+1) * time.Millisecond
+	}
+
+	cases := []struct {
+		p        float64
+		expected time.Duration
+	}{
+		{0.5, 50 * time.Millisecond},
+		{0.95, 95 * time.Millisecond},
+		{0.99, 99 * time.Millisecond},
+		{0.999, 100 * time.Millisecond},
+		{1, 100 * time.Millisecond},
+		{0.001, 1 * time.Millisecond},
+	}
+	for _, c := range cases {
+		if got := percentile(latencies, c.p); got != c.expected {
+			t.Errorf("p%v: expected %v, got %v", c.p*100, c.expected, got)
+		}
+	}
+
+	// Small distributions never fall off the end
+	if got := percentile(latencies[:1], 0.99); got != time.Millisecond {
+		t.Errorf("Expected the only latency, got %v", got)
+	}
+	if got := percentile(latencies[:10], 0.99); got != 10*time.Millisecond {
+		t.Errorf("Expected the largest of 10 latencies, got %v", got)
+	}
+	if got := percentile(nil, 0.99); got != 0 {
+		t.Errorf("Expected 0 for no latencies, got %v", got)
+	}
+}
+
+func TestWriteHistogram(t *testing.T) {
+	stats := newStats()
+	for _, d := range []time.Duration{3 * time.Millisecond, time.Microsecond, 2 * time.Millisecond, 2 * time.Millisecond} {
+		stats.recordLatency(d)
+	}
+
+	var buf bytes.Buffer
+	if err := stats.writeHistogram(&buf, "query"); err != nil {
+		t.Fatalf("Failed to write histogram: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+
+	// The first bucket holds 1µs, the last one 3ms, and the counts add up
+	if lines[0] != "query,1000,1,1,0.250000" {
+		t.Errorf("Unexpected first bucket %q", lines[0])
+	}
+	last := strings.Split(lines[len(lines)-1], ",")
+	if last[2] != "1" || last[3] != "4" || last[4] != "1.000000" {
+		t.Errorf("Unexpected last bucket %q", lines[len(lines)-1])
+	}
+	buckets := histogram(stats.latencies)
+	if len(buckets) != len(lines) {
+		t.Errorf("Expected %d lines, got %d", len(buckets), len(lines))
+	}
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i].upperBound <= buckets[i-1].upperBound {
+			t.Errorf("Bucket bounds don't grow: %v then %v", buckets[i-1].upperBound, buckets[i].upperBound)
+		}
+	}
+	if bound := buckets[len(buckets)-1].upperBound; bound < 3*time.Millisecond || bound > 3300*time.Microsecond {
+		t.Errorf("Expected the last bucket within 10%% of 3ms, got %v", bound)
+	}
+}
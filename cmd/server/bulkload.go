@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/0xReLogic/river/internal/storage"
+)
+
+// defaultBulkLoadBatchSize is the number of entries applied per batch by
+// /bulk-load when the handler config doesn't set one
+const defaultBulkLoadBatchSize = 1000
+
+// bulkLoadProgress is a line of a /bulk-load response, written after each
+// batch. The last line has Done set, or Error if the load stopped early.
+type bulkLoadProgress struct {
+	// Number of entries written so far
+	Ingested int64 `json:"ingested"`
+
+	// Number of entries skipped so far because their key already existed
+	Skipped int64 `json:"skipped"`
+
+	// Whether the whole request body was ingested
+	Done bool `json:"done,omitempty"`
+
+	// Why the load stopped early
+	Error string `json:"error,omitempty"`
+}
+
+// bulkLoadHandler ingests a request body of JSON lines, one scanEntry per
+// line, without buffering more than a batch of it. Each batch is written
+// with PutAsync and waited for before the next one is read, so a client
+// streaming faster than the engine can write is held back by the request
+// body not being read. With ?skip-existing=true, entries whose key already
+// exists are skipped, so a load that failed part way can be resumed by
+// sending the same body again.
+func bulkLoadHandler(engine *storage.Engine, batchSize int) http.HandlerFunc {
+	if batchSize <= 0 {
+		batchSize = defaultBulkLoadBatchSize
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		skipExisting := r.URL.Query().Get("skip-existing") == "true"
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		encoder := json.NewEncoder(w)
+		flusher, _ := w.(http.Flusher)
+
+		var progress bulkLoadProgress
+		decoder := json.NewDecoder(r.Body)
+		futures := make([]<-chan error, 0, batchSize)
+		line := int64(0)
+		batched := 0
+
+		// commit waits for the writes of the current batch and reports
+		// progress; skipped entries count towards the batch too
+		commit := func() error {
+			if batched == 0 {
+				return nil
+			}
+			batched = 0
+
+			var failed error
+			for _, done := range futures {
+				if err := <-done; err != nil {
+					if failed == nil {
+						failed = err
+					}
+					continue
+				}
+				progress.Ingested++
+			}
+			futures = futures[:0]
+			if failed != nil {
+				return failed
+			}
+
+			if err := encoder.Encode(progress); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			return nil
+		}
+
+		// fail ends the response with the error that stopped the load
+		fail := func(err error) {
+			progress.Error = err.Error()
+			encoder.Encode(progress)
+		}
+
+		for {
+			var entry scanEntry
+			err := decoder.Decode(&entry)
+			if err == io.EOF {
+				break
+			}
+			line++
+			if err != nil {
+				commit()
+				fail(fmt.Errorf("line %d: %w", line, err))
+				return
+			}
+
+			exists := false
+			if skipExisting {
+				_, err := engine.Get([]byte(entry.Key))
+				if err != nil && !errors.Is(err, storage.ErrKeyNotFound) {
+					commit()
+					fail(fmt.Errorf("line %d: %w", line, err))
+					return
+				}
+				exists = err == nil
+			}
+
+			if exists {
+				progress.Skipped++
+			} else {
+				futures = append(futures, engine.PutAsync([]byte(entry.Key), []byte(entry.Value)))
+			}
+			batched++
+			if batched < batchSize {
+				continue
+			}
+			if err := commit(); err != nil {
+				fail(err)
+				return
+			}
+		}
+
+		if err := commit(); err != nil {
+			fail(err)
+			return
+		}
+		progress.Done = true
+		encoder.Encode(progress)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// gzipWriterPool reuses gzip writers across responses
+var gzipWriterPool = sync.Pool{
+	New: func() any {
+		return gzip.NewWriter(nil)
+	},
+}
+
+// acceptsGzip reports whether the client accepts gzip-encoded responses
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(encoding, ";")
+		if strings.TrimSpace(name) != "gzip" {
+			continue
+		}
+
+		// "gzip;q=0" explicitly refuses gzip
+		for _, param := range strings.Split(params, ";") {
+			key, value, ok := strings.Cut(param, "=")
+			if !ok || strings.TrimSpace(key) != "q" {
+				continue
+			}
+			if q, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil && q == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// compressResponses gzips the responses of handler for clients that accept
+// it. Responses smaller than minSize bytes are sent uncompressed.
+func compressResponses(handler http.HandlerFunc, minSize int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			handler(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, minSize: minSize, status: http.StatusOK}
+		defer cw.finish()
+		handler(cw, r)
+	}
+}
+
+// compressWriter buffers the start of a response until it reaches minSize
+// bytes, then switches to gzip. The status code is held back until then,
+// since the Content-Encoding header has to be set before it is written.
+type compressWriter struct {
+	http.ResponseWriter
+
+	// Size from which the response is compressed
+	minSize int
+
+	// Status code to send once the encoding is decided
+	status int
+
+	// Response bytes buffered before the encoding is decided
+	buf []byte
+
+	// Whether the headers have been sent
+	decided bool
+
+	// Compressor, once the response is being compressed
+	gz *gzip.Writer
+}
+
+// WriteHeader records the status code until the encoding is decided
+func (w *compressWriter) WriteHeader(status int) {
+	if !w.decided {
+		w.status = status
+	}
+}
+
+// Write buffers or compresses response bytes
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if w.decided {
+		if w.gz != nil {
+			return w.gz.Write(p)
+		}
+		return w.ResponseWriter.Write(p)
+	}
+
+	w.buf = append(w.buf, p...)
+	if len(w.buf) < w.minSize {
+		return len(p), nil
+	}
+
+	// Large enough: send the headers and switch to gzip
+	w.decided = true
+	header := w.Header()
+	header.Set("Content-Encoding", "gzip")
+	header.Del("Content-Length")
+	w.ResponseWriter.WriteHeader(w.status)
+
+	w.gz = gzipWriterPool.Get().(*gzip.Writer)
+	w.gz.Reset(w.ResponseWriter)
+	if _, err := w.gz.Write(w.buf); err != nil {
+		return 0, err
+	}
+	w.buf = nil
+	return len(p), nil
+}
+
+// finish sends a response that stayed below minSize uncompressed, or
+// completes the gzip stream
+func (w *compressWriter) finish() {
+	if !w.decided {
+		w.decided = true
+		w.ResponseWriter.WriteHeader(w.status)
+		w.ResponseWriter.Write(w.buf)
+		return
+	}
+
+	if w.gz != nil {
+		w.gz.Close()
+		w.gz.Reset(io.Discard) // Don't keep the response writer alive in the pool
+		gzipWriterPool.Put(w.gz)
+		w.gz = nil
+	}
+}
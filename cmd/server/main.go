@@ -1,37 +1,116 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"path/filepath"
+	"strconv"
 	"syscall"
 	"time"
 
 	"github.com/0xReLogic/river/internal/storage"
 )
 
-// Define custom signal constants for Windows
-const (
-	// These are not available on Windows, so we define custom values
-	// that we'll handle specially in our code
-	SIGUSR1 = syscall.Signal(0x10) // Custom signal for child ready
-	SIGUSR2 = syscall.Signal(0x11) // Custom signal for graceful restart
-)
-
 var (
 	// Command line flags
 	dataDir   = flag.String("data-dir", "./data", "Directory for storing data")
+	walDir    = flag.String("wal-dir", "", "Directory for the WAL (default: <data-dir>/wal, or the directory used before)")
 	httpAddr  = flag.String("http-addr", ":8080", "HTTP server address")
 	graceful  = flag.Bool("graceful", false, "Graceful restart (internal use only)")
 	parentPid = flag.Int("parent-pid", 0, "Parent PID for graceful restart (internal use only)")
+	listenFD  = flag.Int("listener-fd", 0, "Listening socket inherited from the parent on a graceful restart (internal use only)")
+
+	// Scan limits
+	scanMaxBytes = flag.Int64("scan-max-bytes", 64*1024*1024, "Maximum key and value bytes returned by a single /scan")
+	scanTimeout  = flag.Duration("scan-timeout", 30*time.Second, "Maximum duration of a single /scan")
+
+	// Response compression
+	compress        = flag.Bool("compress", true, "Gzip /get, /scan and /stats responses for clients that accept it")
+	compressMinSize = flag.Int("compress-min-size", 1024, "Minimum response size in bytes to compress")
+
+	// Bulk loading
+	bulkLoadBatchSize = flag.Int("bulk-load-batch-size", defaultBulkLoadBatchSize, "Number of entries /bulk-load writes per batch")
+
+	// Request limits
+	maxValueSize       = flag.Int64("max-value-size", 64*1024*1024, "Maximum body size of a /put or /append request (0: unlimited)")
+	batchDeleteMaxKeys = flag.Int("batch-delete-max-keys", defaultBatchDeleteMaxKeys, "Maximum number of keys of a /batch-delete request")
+	maxConcurrentReads = flag.Int("max-concurrent-reads", 0, "Maximum number of blocks /get requests decode at once (0: unlimited)")
+
+	// Value log
+	valueLogThreshold = flag.Int("value-log-threshold", 0, "Size in bytes from which values are stored in the value log, and /put and /get stream them (0: disabled)")
 )
 
+// handlerConfig holds the server-side limits applied by the HTTP handlers
+type handlerConfig struct {
+	// Maximum number of key and value bytes returned by a single /scan
+	scanMaxBytes int64
+
+	// Maximum duration of a single /scan
+	scanTimeout time.Duration
+
+	// Whether to gzip /get, /scan and /stats responses for clients that accept it
+	compress bool
+
+	// Minimum response size in bytes to compress
+	compressMinSize int
+
+	// Number of entries /bulk-load writes before waiting for them and
+	// reporting progress
+	bulkLoadBatchSize int
+
+	// Maximum body size of a /put or /append request, zero for unlimited.
+	// Bodies read whole are held in memory, so larger ones are rejected
+	// before they are read; streamed bodies aren't limited.
+	maxValueSize int64
+
+	// Size from which /put streams bodies of a known length to the value
+	// log, zero to read every body whole. /get streams every value when set.
+	streamMinSize int64
+
+	// Maximum number of keys of a /batch-delete request
+	batchDeleteMaxKeys int
+}
+
+// defaultBatchDeleteMaxKeys is the maximum number of keys of a
+// /batch-delete request when the handler config doesn't set one
+const defaultBatchDeleteMaxKeys = 1000
+
+// batchDeleteResult is the response of /batch-delete
+type batchDeleteResult struct {
+	// Number of the keys that existed before they were deleted
+	Existed int `json:"existed"`
+}
+
+// scanEntry is a line of a /scan response
+type scanEntry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// scanValue is a line of a /scan?values-only=true response
+type scanValue struct {
+	Value string `json:"value"`
+}
+
+// scanTrailer is the last line of a /scan response that did not complete
+type scanTrailer struct {
+	// Why the scan stopped early: "max_bytes", "timeout" or "error"
+	Truncated string `json:"truncated"`
+
+	// Error message when Truncated is "error"
+	Error string `json:"error,omitempty"`
+}
+
 func main() {
 	// Parse command line flags
 	flag.Parse()
@@ -41,22 +120,17 @@ func main() {
 		log.Fatalf("Failed to create data directory: %v", err)
 	}
 
-	// Create storage engine
-	engine, err := storage.NewEngine(*dataDir)
+	// Listen, or adopt the listener of the parent on a graceful restart
+	listener, err := listen(*httpAddr, *listenFD)
 	if err != nil {
-		log.Fatalf("Failed to create storage engine: %v", err)
-	}
-	defer engine.Close()
-
-	// Create HTTP server
-	server := &http.Server{
-		Addr:    *httpAddr,
-		Handler: newHandler(engine),
+		log.Fatalf("Failed to listen on %s: %v", *httpAddr, err)
 	}
 
-	// Handle graceful restart
+	// Handle graceful restart: once the listener is taken over, the parent
+	// stops accepting, completes its requests and closes its engine.
+	// Connections arriving meanwhile wait in the listener's backlog.
 	if *graceful && *parentPid > 0 {
-		log.Printf("Child process started, parent PID: %d", *parentPid)
+		log.Printf("Child process %d started, parent PID: %d", os.Getpid(), *parentPid)
 
 		// Signal parent process that we're ready
 		parent, err := os.FindProcess(*parentPid)
@@ -65,10 +139,45 @@ func main() {
 		}
 	}
 
+	// Create storage engine, waiting for the parent to release it on a
+	// graceful restart
+	opts := storage.DefaultOptions()
+	opts.WALDir = *walDir
+	opts.MaxConcurrentReads = *maxConcurrentReads
+	opts.ValueLogThreshold = *valueLogThreshold
+	var lockWait time.Duration
+	if *graceful {
+		lockWait = restartLockWait
+	}
+	engine, err := openEngine(*dataDir, opts, lockWait)
+	if err != nil {
+		log.Fatalf("Failed to create storage engine: %v", err)
+	}
+	defer engine.Close()
+
+	// Create HTTP server
+	config := handlerConfig{
+		scanMaxBytes:       *scanMaxBytes,
+		scanTimeout:        *scanTimeout,
+		compress:           *compress,
+		compressMinSize:    *compressMinSize,
+		bulkLoadBatchSize:  *bulkLoadBatchSize,
+		maxValueSize:       *maxValueSize,
+		streamMinSize:      int64(*valueLogThreshold),
+		batchDeleteMaxKeys: *batchDeleteMaxKeys,
+	}
+	var busy busyConns
+	server := &http.Server{
+		Addr:      *httpAddr,
+		Handler:   newHandler(engine, config),
+		ConnState: busy.track,
+	}
+
 	// Start HTTP server in a goroutine
 	go func() {
-		log.Printf("Starting HTTP server on %s", *httpAddr)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Printf("Starting HTTP server on %s", listener.Addr())
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed && !errors.Is(err, net.ErrClosed) {
 			log.Fatalf("HTTP server error: %v", err)
 		}
 	}()
@@ -85,38 +194,25 @@ func main() {
 	if sig == SIGUSR2 {
 		log.Println("Graceful restart requested")
 
-		// Start a new process
-		execPath, err := os.Executable()
-		if err != nil {
-			log.Fatalf("Failed to get executable path: %v", err)
-		}
-
-		// Prepare arguments for the new process
-		args := []string{
-			execPath,
-			"-data-dir", *dataDir,
-			"-http-addr", *httpAddr,
-			"-graceful",
-			"-parent-pid", fmt.Sprintf("%d", os.Getpid()),
-		}
+		// Listen for the child's signal before it can be sent
+		childReady := make(chan os.Signal, 1)
+		signal.Notify(childReady, SIGUSR1)
 
-		// Start the new process
-		process, err := os.StartProcess(execPath, args, &os.ProcAttr{
-			Dir:   filepath.Dir(execPath),
-			Env:   os.Environ(),
-			Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
-		})
+		// Start a new process, passing it the listener
+		process, err := startChild(listener)
 		if err != nil {
 			log.Fatalf("Failed to start new process: %v", err)
 		}
 
 		// Wait for the new process to signal that it's ready
-		childReady := make(chan os.Signal, 1)
-		signal.Notify(childReady, SIGUSR1)
-
 		select {
 		case <-childReady:
 			log.Println("Child process ready, shutting down")
+
+			// Stop accepting, leaving the connections to the child, and
+			// let those accepted complete their requests
+			listener.Close()
+			busy.wait(restartDrainTimeout)
 		case <-time.After(10 * time.Second):
 			log.Println("Timeout waiting for child process, shutting down anyway")
 			process.Kill()
@@ -125,7 +221,7 @@ func main() {
 
 	// Shutdown HTTP server
 	log.Println("Shutting down HTTP server")
-	server.Shutdown(nil)
+	server.Shutdown(context.Background())
 
 	// Close storage engine
 	log.Println("Closing storage engine")
@@ -134,9 +230,131 @@ func main() {
 	log.Println("Server stopped")
 }
 
+// errorStatus maps an engine error to the HTTP status code reported to clients
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, storage.ErrKeyNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, storage.ErrKeyTooLarge), errors.Is(err, storage.ErrEmptyKey), errors.Is(err, io.ErrUnexpectedEOF):
+		return http.StatusBadRequest
+	case errors.Is(err, storage.ErrValueTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, storage.ErrEngineClosed), errors.Is(err, storage.ErrEnginePoisoned):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// readValue reads the body of a /put or /append request, up to maxSize
+// bytes unless it is zero. It writes the error response and returns false
+// if the body is too large or can't be read.
+func readValue(w http.ResponseWriter, r *http.Request, maxSize int64) ([]byte, bool) {
+	if maxSize > 0 {
+		if r.ContentLength > maxSize {
+			http.Error(w, fmt.Sprintf("Value larger than %d bytes", maxSize), http.StatusRequestEntityTooLarge)
+			return nil, false
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+	}
+
+	value, err := io.ReadAll(r.Body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("Value larger than %d bytes", maxSize), http.StatusRequestEntityTooLarge)
+			return nil, false
+		}
+		http.Error(w, fmt.Sprintf("Error reading body: %v", err), http.StatusInternalServerError)
+		return nil, false
+	}
+	return value, true
+}
+
+// keyEncoding is how keys are encoded in query parameters and /scan
+// responses, selected with ?key-encoding=: raw (the default), base64
+// (standard alphabet, padded) or hex. Encoded keys can hold any bytes,
+// which raw query parameters can't.
+type keyEncoding string
+
+// Key encodings
+const (
+	keyEncodingRaw    keyEncoding = "raw"
+	keyEncodingBase64 keyEncoding = "base64"
+	keyEncodingHex    keyEncoding = "hex"
+)
+
+// requestKeyEncoding returns the key encoding of a request
+func requestKeyEncoding(r *http.Request) (keyEncoding, error) {
+	switch encoding := keyEncoding(r.URL.Query().Get("key-encoding")); encoding {
+	case "", keyEncodingRaw:
+		return keyEncodingRaw, nil
+	case keyEncodingBase64, keyEncodingHex:
+		return encoding, nil
+	default:
+		return "", fmt.Errorf("unknown key encoding %q", encoding)
+	}
+}
+
+// decode decodes a key from a query parameter
+func (e keyEncoding) decode(s string) ([]byte, error) {
+	switch e {
+	case keyEncodingBase64:
+		return base64.StdEncoding.DecodeString(s)
+	case keyEncodingHex:
+		return hex.DecodeString(s)
+	default:
+		return []byte(s), nil
+	}
+}
+
+// encode encodes a key for a /scan response
+func (e keyEncoding) encode(key []byte) string {
+	switch e {
+	case keyEncodingBase64:
+		return base64.StdEncoding.EncodeToString(key)
+	case keyEncodingHex:
+		return hex.EncodeToString(key)
+	default:
+		return string(key)
+	}
+}
+
+// requestKey returns the decoded key query parameter of a request. It
+// writes the error response and returns false if the key is missing or
+// can't be decoded.
+func requestKey(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	encoding, err := requestKeyEncoding(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		http.Error(w, "Key is required", http.StatusBadRequest)
+		return nil, false
+	}
+	decoded, err := encoding.decode(key)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid %s key: %v", encoding, err), http.StatusBadRequest)
+		return nil, false
+	}
+	return decoded, true
+}
+
 // newHandler creates a new HTTP handler
-func newHandler(engine *storage.Engine) http.Handler {
+func newHandler(engine *storage.Engine, config handlerConfig) http.Handler {
 	mux := http.NewServeMux()
+	ops := &opCounters{}
+
+	// compressed applies response compression to a handler when enabled
+	compressed := func(handler http.HandlerFunc) http.HandlerFunc {
+		if !config.compress {
+			return handler
+		}
+		return compressResponses(handler, config.compressMinSize)
+	}
 
 	// Health check endpoint
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
@@ -144,33 +362,102 @@ func newHandler(engine *storage.Engine) http.Handler {
 		w.Write([]byte("OK"))
 	})
 
-	// Get endpoint
-	mux.HandleFunc("/get", func(w http.ResponseWriter, r *http.Request) {
+	// Readiness endpoint: unhealthy once the engine refuses writes after a
+	// failed WAL sync, so the node is taken out of rotation until restarted
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := engine.Poisoned(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	})
+
+	// Get endpoint. With if-newer-than, a conditional read: 304 Not
+	// Modified unless the sequence number of the value is greater, which
+	// is sent in the X-River-Sequence header.
+	mux.HandleFunc("/get", compressed(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		key := r.URL.Query().Get("key")
-		if key == "" {
-			http.Error(w, "Key is required", http.StatusBadRequest)
+		key, ok := requestKey(w, r)
+		if !ok {
 			return
 		}
 
-		value, err := engine.Get([]byte(key))
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Error: %v", err), http.StatusInternalServerError)
+		conditional := r.URL.Query().Has("if-newer-than")
+		var newerThan int64
+		if conditional {
+			var err error
+			newerThan, err = strconv.ParseInt(r.URL.Query().Get("if-newer-than"), 10, 64)
+			if err != nil {
+				http.Error(w, "if-newer-than must be a sequence number", http.StatusBadRequest)
+				return
+			}
+		}
+
+		// Stream the value, which may be too large to hold in memory. An
+		// error past the status aborts the response, so the client sees it
+		// truncated.
+		if !conditional && config.streamMinSize > 0 {
+			ops.gets.Add(1)
+			stream, err := engine.GetStreamContext(r.Context(), key)
+			if errors.Is(err, storage.ErrKeyNotFound) {
+				http.Error(w, "Key not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				ops.errors.Add(1)
+				http.Error(w, fmt.Sprintf("Error: %v", err), errorStatus(err))
+				return
+			}
+			defer stream.Close()
+
+			w.WriteHeader(http.StatusOK)
+			n, err := io.Copy(w, stream)
+			ops.bytesRead.Add(n)
+			if err != nil {
+				ops.errors.Add(1)
+				log.Printf("Error streaming value: %v", err)
+				panic(http.ErrAbortHandler)
+			}
 			return
 		}
 
-		if value == nil {
+		ops.gets.Add(1)
+		var value []byte
+		var meta storage.ValueMeta
+		var err error
+		if conditional {
+			value, meta, err = engine.GetWithMeta(key)
+		} else {
+			// A read queued behind -max-concurrent-reads gives up
+			// once the client is gone
+			value, err = engine.GetContext(r.Context(), key)
+		}
+		if errors.Is(err, storage.ErrKeyNotFound) {
 			http.Error(w, "Key not found", http.StatusNotFound)
 			return
 		}
+		if err != nil {
+			ops.errors.Add(1)
+			http.Error(w, fmt.Sprintf("Error: %v", err), errorStatus(err))
+			return
+		}
+		if conditional {
+			w.Header().Set("X-River-Sequence", strconv.FormatInt(meta.Sequence, 10))
+			if meta.Sequence <= newerThan {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		ops.bytesRead.Add(int64(len(value)))
 
 		w.WriteHeader(http.StatusOK)
 		w.Write(value)
-	})
+	}))
 
 	// Put endpoint
 	mux.HandleFunc("/put", func(w http.ResponseWriter, r *http.Request) {
@@ -179,24 +466,65 @@ func newHandler(engine *storage.Engine) http.Handler {
 			return
 		}
 
-		key := r.URL.Query().Get("key")
-		if key == "" {
-			http.Error(w, "Key is required", http.StatusBadRequest)
+		key, ok := requestKey(w, r)
+		if !ok {
 			return
 		}
 
-		// Read value from request body
-		value, err := io.ReadAll(r.Body)
+		// Stream a large body of known length to the value log, and read
+		// others whole
+		var size int64
+		var err error
+		if config.streamMinSize > 0 && r.ContentLength >= config.streamMinSize {
+			ops.puts.Add(1)
+			size = r.ContentLength
+			err = engine.PutStream(key, r.Body, size)
+		} else {
+			value, ok := readValue(w, r, config.maxValueSize)
+			if !ok {
+				return
+			}
+			ops.puts.Add(1)
+			size = int64(len(value))
+			err = engine.Put(key, value)
+		}
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Error reading body: %v", err), http.StatusInternalServerError)
+			ops.errors.Add(1)
+			http.Error(w, fmt.Sprintf("Error: %v", err), errorStatus(err))
 			return
 		}
+		ops.bytesWritten.Add(int64(len(key)) + size)
 
-		if err := engine.Put([]byte(key), value); err != nil {
-			http.Error(w, fmt.Sprintf("Error: %v", err), http.StatusInternalServerError)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	})
+
+	// Append endpoint
+	mux.HandleFunc("/append", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		key, ok := requestKey(w, r)
+		if !ok {
 			return
 		}
 
+		// Read suffix from request body
+		suffix, ok := readValue(w, r, config.maxValueSize)
+		if !ok {
+			return
+		}
+
+		ops.appends.Add(1)
+		if err := engine.Append(key, suffix); err != nil {
+			ops.errors.Add(1)
+			http.Error(w, fmt.Sprintf("Error: %v", err), errorStatus(err))
+			return
+		}
+		ops.bytesWritten.Add(int64(len(key) + len(suffix)))
+
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	})
@@ -208,14 +536,15 @@ func newHandler(engine *storage.Engine) http.Handler {
 			return
 		}
 
-		key := r.URL.Query().Get("key")
-		if key == "" {
-			http.Error(w, "Key is required", http.StatusBadRequest)
+		key, ok := requestKey(w, r)
+		if !ok {
 			return
 		}
 
-		if err := engine.Delete([]byte(key)); err != nil {
-			http.Error(w, fmt.Sprintf("Error: %v", err), http.StatusInternalServerError)
+		ops.deletes.Add(1)
+		if err := engine.Delete(key); err != nil {
+			ops.errors.Add(1)
+			http.Error(w, fmt.Sprintf("Error: %v", err), errorStatus(err))
 			return
 		}
 
@@ -223,8 +552,254 @@ func newHandler(engine *storage.Engine) http.Handler {
 		w.Write([]byte("OK"))
 	})
 
+	// Batch delete endpoint, deleting the keys of a JSON array in the key
+	// encoding of the request as a single WAL batch, and returning how many
+	// of them existed
+	batchDeleteMaxKeys := config.batchDeleteMaxKeys
+	if batchDeleteMaxKeys <= 0 {
+		batchDeleteMaxKeys = defaultBatchDeleteMaxKeys
+	}
+	mux.HandleFunc("/batch-delete", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		encoding, err := requestKeyEncoding(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var encoded []string
+		if err := json.NewDecoder(r.Body).Decode(&encoded); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid key list: %v", err), http.StatusBadRequest)
+			return
+		}
+		if len(encoded) > batchDeleteMaxKeys {
+			http.Error(w, fmt.Sprintf("Too many keys: %d (max %d)", len(encoded), batchDeleteMaxKeys), http.StatusRequestEntityTooLarge)
+			return
+		}
+		keys := make([][]byte, len(encoded))
+		for i, key := range encoded {
+			if keys[i], err = encoding.decode(key); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid %s key: %v", encoding, err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		ops.deletes.Add(1)
+		existed, err := engine.DeleteBatch(keys)
+		if err != nil {
+			ops.errors.Add(1)
+			http.Error(w, fmt.Sprintf("Error: %v", err), errorStatus(err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(batchDeleteResult{Existed: existed})
+	})
+
+	// Sync endpoint, a durability barrier making every write made before
+	// it durable
+	mux.HandleFunc("/sync", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := engine.Sync(); err != nil {
+			ops.errors.Add(1)
+			http.Error(w, fmt.Sprintf("Error: %v", err), errorStatus(err))
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	})
+
+	// Scan endpoint, streaming the keys in [start, end) as JSON lines, or
+	// only their values with ?values-only=true. The bounds and returned keys
+	// use the key encoding of the request.
+	mux.HandleFunc("/scan", compressed(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		encoding, err := requestKeyEncoding(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var opts storage.IteratorOptions
+		query := r.URL.Query()
+		if query.Has("start") {
+			if opts.Start, err = encoding.decode(query.Get("start")); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid %s start: %v", encoding, err), http.StatusBadRequest)
+				return
+			}
+		}
+		if query.Has("end") {
+			if opts.End, err = encoding.decode(query.Get("end")); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid %s end: %v", encoding, err), http.StatusBadRequest)
+				return
+			}
+		}
+		valuesOnly := query.Get("values-only") == "true"
+
+		// Stop when the client goes away or the scan runs too long. Values
+		// only scans need the context too, so they use a full iterator
+		// rather than Engine.ScanValues and leave its keys out.
+		ctx := r.Context()
+		if config.scanTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, config.scanTimeout)
+			defer cancel()
+		}
+
+		ops.scans.Add(1)
+		it, err := engine.NewIterator(ctx, opts)
+		if err != nil {
+			ops.errors.Add(1)
+			http.Error(w, fmt.Sprintf("Error: %v", err), errorStatus(err))
+			return
+		}
+		defer it.Close()
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		encoder := json.NewEncoder(w)
+
+		var returned int64
+		for it.Next() {
+			size := int64(len(it.Value()))
+			if !valuesOnly {
+				size += int64(len(it.Key()))
+			}
+			returned += size
+			if config.scanMaxBytes > 0 && returned > config.scanMaxBytes {
+				encoder.Encode(scanTrailer{Truncated: "max_bytes"})
+				return
+			}
+
+			var line interface{}
+			if valuesOnly {
+				line = scanValue{Value: string(it.Value())}
+			} else {
+				line = scanEntry{Key: encoding.encode(it.Key()), Value: string(it.Value())}
+			}
+			if err := encoder.Encode(line); err != nil {
+				return // Client went away
+			}
+			ops.bytesRead.Add(size)
+		}
+
+		switch err := it.Err(); {
+		case err == nil:
+		case r.Context().Err() != nil:
+			// Client went away, nobody to report to
+		case errors.Is(err, context.DeadlineExceeded):
+			encoder.Encode(scanTrailer{Truncated: "timeout"})
+		default:
+			ops.errors.Add(1)
+			encoder.Encode(scanTrailer{Truncated: "error", Error: err.Error()})
+		}
+	}))
+
+	// Operation counters endpoint, returning the counters and resetting
+	// them, so periodic scrapes report the operations since the last one
+	mux.HandleFunc("/stats/reset", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		countersJSON, err := json.Marshal(ops.reset())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(countersJSON)
+	})
+
+	// Bulk load endpoint, ingesting a request body of JSON lines
+	mux.HandleFunc("/bulk-load", bulkLoadHandler(engine, config.bulkLoadBatchSize))
+
+	// Debug endpoint listing the blocks of each LSM tree level
+	mux.HandleFunc("/debug/levels", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		levelsJSON, err := json.Marshal(engine.Levels())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(levelsJSON)
+	})
+
+	// Compaction plan endpoint listing the tasks compaction would run next
+	mux.HandleFunc("/compact/plan", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		plan, err := engine.CompactionPlan()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		planJSON, err := json.Marshal(plan)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(planJSON)
+	})
+
+	// Admin endpoint changing the number of compaction workers
+	mux.HandleFunc("/admin/compaction/workers", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		n, err := strconv.Atoi(r.URL.Query().Get("n"))
+		if err != nil || n <= 0 {
+			http.Error(w, "n must be a positive number of workers", http.StatusBadRequest)
+			return
+		}
+
+		if err := engine.SetCompactionWorkers(n); err != nil {
+			http.Error(w, fmt.Sprintf("Error: %v", err), errorStatus(err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "{\"workers\":%d}", n)
+	})
+
+	// Metrics endpoint in the Prometheus text format
+	mux.HandleFunc("/metrics", metricsHandler(engine))
+
 	// Stats endpoint
-	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/stats", compressed(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
@@ -242,7 +817,7 @@ func newHandler(engine *storage.Engine) http.Handler {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		w.Write(statsJSON)
-	})
+	}))
 
 	return mux
 }
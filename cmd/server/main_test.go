@@ -0,0 +1,893 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/0xReLogic/river/internal/storage"
+)
+
+// cancelingWriter cancels the request context after the first write
+type cancelingWriter struct {
+	*httptest.ResponseRecorder
+	cancel context.CancelFunc
+}
+
+func (w *cancelingWriter) Write(p []byte) (int, error) {
+	defer w.cancel()
+	return w.ResponseRecorder.Write(p)
+}
+
+// newTestEngine opens an engine with numKeys keys in a temporary directory
+func newTestEngine(t *testing.T, numKeys int) *storage.Engine {
+	tempDir, err := os.MkdirTemp("", "river-server-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tempDir) })
+
+	engine, err := storage.NewEngine(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to create engine: %v", err)
+	}
+	for i := 0; i < numKeys; i++ {
+		if err := engine.Put([]byte(fmt.Sprintf("key-%03d", i)), []byte("value")); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	return engine
+}
+
+func TestScan_ClientCancel(t *testing.T) {
+	done := make(chan bool)
+	go func() {
+		engine := newTestEngine(t, 100)
+		defer engine.Close()
+
+		handler := newHandler(engine, handlerConfig{})
+		goroutines := runtime.NumGoroutine()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		req := httptest.NewRequest(http.MethodGet, "/scan", nil).WithContext(ctx)
+		w := &cancelingWriter{ResponseRecorder: httptest.NewRecorder(), cancel: cancel}
+		handler.ServeHTTP(w, req)
+
+		lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+		if len(lines) != 1 {
+			t.Errorf("Expected the scan to stop after the first line, got %d lines", len(lines))
+		}
+		if open := engine.GetStats().OpenIterators; open != 0 {
+			t.Errorf("Expected the iterator to be closed, %d still open", open)
+		}
+		if after := runtime.NumGoroutine(); after > goroutines {
+			t.Errorf("Goroutines grew from %d to %d during the scan", goroutines, after)
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+func TestScan_Limits(t *testing.T) {
+	done := make(chan bool)
+	go func() {
+		engine := newTestEngine(t, 100)
+		defer engine.Close()
+
+		// Each pair is 12 bytes, so 30 bytes allow two lines
+		handler := newHandler(engine, handlerConfig{scanMaxBytes: 30})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/scan?start=key-010&end=key-020", nil))
+
+		expected := `{"key":"key-010","value":"value"}` + "\n" +
+			`{"key":"key-011","value":"value"}` + "\n" +
+			`{"truncated":"max_bytes"}` + "\n"
+		if w.Body.String() != expected {
+			t.Errorf("Expected truncated scan %q, got %q", expected, w.Body.String())
+		}
+
+		// A scan past its deadline ends with a timeout marker
+		handler = newHandler(engine, handlerConfig{scanTimeout: time.Nanosecond})
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/scan", nil))
+		if !strings.HasSuffix(w.Body.String(), `{"truncated":"timeout"}`+"\n") {
+			t.Errorf("Expected a timeout marker, got %q", w.Body.String())
+		}
+
+		if open := engine.GetStats().OpenIterators; open != 0 {
+			t.Errorf("Expected all iterators to be closed, %d still open", open)
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+func TestScan_ValuesOnly(t *testing.T) {
+	done := make(chan bool)
+	go func() {
+		engine := newTestEngine(t, 100)
+		defer engine.Close()
+
+		handler := newHandler(engine, handlerConfig{})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/scan?start=key-010&end=key-012&values-only=true", nil))
+		expected := `{"value":"value"}` + "\n" + `{"value":"value"}` + "\n"
+		if w.Code != http.StatusOK || w.Body.String() != expected {
+			t.Errorf("Expected values %q, got status %d body %q", expected, w.Code, w.Body.String())
+		}
+
+		// Only the values count toward the limit: 5 bytes each
+		handler = newHandler(engine, handlerConfig{scanMaxBytes: 12})
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/scan?values-only=true", nil))
+		expected = `{"value":"value"}` + "\n" + `{"value":"value"}` + "\n" + `{"truncated":"max_bytes"}` + "\n"
+		if w.Body.String() != expected {
+			t.Errorf("Expected truncated values %q, got %q", expected, w.Body.String())
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+func TestGet_ResponseCompression(t *testing.T) {
+	done := make(chan bool)
+	go func() {
+		engine := newTestEngine(t, 0)
+		defer engine.Close()
+
+		large := strings.Repeat("river ", 1000)
+		if err := engine.Put([]byte("large"), []byte(large)); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		if err := engine.Put([]byte("small"), []byte("tiny")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+
+		handler := newHandler(engine, handlerConfig{compress: true, compressMinSize: 1024})
+		get := func(key string, acceptGzip bool) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodGet, "/get?key="+key, nil)
+			if acceptGzip {
+				req.Header.Set("Accept-Encoding", "gzip, deflate")
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			return w
+		}
+
+		// Large value, gzip accepted
+		w := get("large", true)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "gzip" {
+			t.Errorf("Expected a gzip response, got status %d encoding %q", w.Code, w.Header().Get("Content-Encoding"))
+		}
+		if w.Body.Len() >= len(large) {
+			t.Errorf("Expected the body to shrink, got %d bytes for a %d-byte value", w.Body.Len(), len(large))
+		}
+		gz, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Errorf("Failed to read gzip body: %v", err)
+		} else if body, err := io.ReadAll(gz); err != nil || string(body) != large {
+			t.Errorf("Decompressed body differs from the value (err %v)", err)
+		}
+
+		// Large value, gzip not accepted
+		w = get("large", false)
+		if w.Header().Get("Content-Encoding") != "" || w.Body.String() != large {
+			t.Errorf("Expected a raw response, got encoding %q and %d bytes", w.Header().Get("Content-Encoding"), w.Body.Len())
+		}
+
+		// Small value stays raw even when gzip is accepted
+		w = get("small", true)
+		if w.Header().Get("Content-Encoding") != "" || w.Body.String() != "tiny" {
+			t.Errorf("Expected a raw small response, got encoding %q body %q", w.Header().Get("Content-Encoding"), w.Body.String())
+		}
+
+		// Errors keep their status code
+		w = get("missing", true)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected status %d, got %d", http.StatusNotFound, w.Code)
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+func TestGet_IfNewerThan(t *testing.T) {
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+
+		engine := newTestEngine(t, 0)
+		defer engine.Close()
+		if err := engine.Put([]byte("key"), []byte("v1")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+
+		handler := newHandler(engine, handlerConfig{})
+		get := func(key, newerThan string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodGet, "/get?key="+key+"&if-newer-than="+newerThan, nil)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			return w
+		}
+
+		// Modified: the value and its sequence number
+		w := get("key", "0")
+		seq := w.Header().Get("X-River-Sequence")
+		if w.Code != http.StatusOK || w.Body.String() != "v1" || seq == "" {
+			t.Errorf("Expected v1 with a sequence number, got status %d body %q sequence %q", w.Code, w.Body.String(), seq)
+		}
+
+		// Not modified since that sequence number
+		w = get("key", seq)
+		if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+			t.Errorf("Expected status %d without a body, got %d and %q", http.StatusNotModified, w.Code, w.Body.String())
+		}
+
+		// Modified again by a new write
+		if err := engine.Put([]byte("key"), []byte("v2")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		w = get("key", seq)
+		if w.Code != http.StatusOK || w.Body.String() != "v2" || w.Header().Get("X-River-Sequence") == seq {
+			t.Errorf("Expected v2 with a new sequence number, got status %d body %q sequence %q", w.Code, w.Body.String(), w.Header().Get("X-River-Sequence"))
+		}
+
+		// Absent key, and an invalid sequence number
+		if w := get("absent", "0"); w.Code != http.StatusNotFound {
+			t.Errorf("Expected status %d for an absent key, got %d", http.StatusNotFound, w.Code)
+		}
+		if w := get("key", "latest"); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status %d for an invalid sequence number, got %d", http.StatusBadRequest, w.Code)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+func TestBatchDelete(t *testing.T) {
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+
+		engine := newTestEngine(t, 3)
+		defer engine.Close()
+
+		handler := newHandler(engine, handlerConfig{batchDeleteMaxKeys: 4})
+		batchDelete := func(body string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodPost, "/batch-delete", strings.NewReader(body))
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			return w
+		}
+
+		// Two of the keys exist; the absent one is not counted
+		w := batchDelete(`["key-000", "absent", "key-002"]`)
+		var result batchDeleteResult
+		if err := json.Unmarshal(w.Body.Bytes(), &result); w.Code != http.StatusOK || err != nil || result.Existed != 2 {
+			t.Errorf("Expected 2 existing keys, got status %d body %q", w.Code, w.Body.String())
+		}
+		for key, expected := range map[string]bool{"key-000": false, "key-001": true, "key-002": false} {
+			if _, err := engine.Get([]byte(key)); (err == nil) != expected {
+				t.Errorf("Expected %s to exist: %v, got err %v", key, expected, err)
+			}
+		}
+
+		// Deleting them again finds none
+		w = batchDelete(`["key-000", "key-002"]`)
+		if err := json.Unmarshal(w.Body.Bytes(), &result); w.Code != http.StatusOK || err != nil || result.Existed != 0 {
+			t.Errorf("Expected no existing keys, got status %d body %q", w.Code, w.Body.String())
+		}
+
+		// Too many keys, and an invalid body
+		if w := batchDelete(`["a", "b", "c", "d", "key-001"]`); w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected status %d for too many keys, got %d", http.StatusRequestEntityTooLarge, w.Code)
+		}
+		if w := batchDelete(`{"keys": []}`); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status %d for an invalid body, got %d", http.StatusBadRequest, w.Code)
+		}
+		if _, err := engine.Get([]byte("key-001")); err != nil {
+			t.Errorf("Expected key-001 to survive the rejected requests, got %v", err)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+func TestSync(t *testing.T) {
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+
+		engine := newTestEngine(t, 3)
+		handler := newHandler(engine, handlerConfig{})
+		request := func(method string) int {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(method, "/sync", nil))
+			return w.Code
+		}
+
+		if code := request(http.MethodPost); code != http.StatusOK {
+			t.Errorf("Expected status %d, got %d", http.StatusOK, code)
+		}
+		if code := request(http.MethodGet); code != http.StatusMethodNotAllowed {
+			t.Errorf("Expected status %d for GET, got %d", http.StatusMethodNotAllowed, code)
+		}
+
+		// A closed engine can't sync
+		engine.Close()
+		if code := request(http.MethodPost); code != http.StatusServiceUnavailable {
+			t.Errorf("Expected status %d once closed, got %d", http.StatusServiceUnavailable, code)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+func TestPut_MaxValueSize(t *testing.T) {
+	done := make(chan bool)
+	go func() {
+		engine := newTestEngine(t, 0)
+		defer engine.Close()
+
+		handler := newHandler(engine, handlerConfig{maxValueSize: 1024})
+		post := func(path string, body io.Reader, contentLength int64) int {
+			req := httptest.NewRequest(http.MethodPost, path, body)
+			req.ContentLength = contentLength
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			return w.Code
+		}
+
+		// A value within the limit is stored
+		small := strings.Repeat("a", 1024)
+		if code := post("/put?key=small", strings.NewReader(small), int64(len(small))); code != http.StatusOK {
+			t.Errorf("Expected status %d for a value within the limit, got %d", http.StatusOK, code)
+		}
+
+		// A larger value is rejected by its Content-Length, or while it is
+		// read when the length is unknown
+		large := strings.Repeat("a", 1025)
+		if code := post("/put?key=large", strings.NewReader(large), int64(len(large))); code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected status %d for a large value, got %d", http.StatusRequestEntityTooLarge, code)
+		}
+		if code := post("/put?key=large", strings.NewReader(large), -1); code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected status %d for a large value of unknown length, got %d", http.StatusRequestEntityTooLarge, code)
+		}
+		if code := post("/append?key=small", strings.NewReader(large), -1); code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected status %d for a large suffix, got %d", http.StatusRequestEntityTooLarge, code)
+		}
+
+		if _, err := engine.Get([]byte("large")); err != storage.ErrKeyNotFound {
+			t.Errorf("Expected the large value not to be stored, got %v", err)
+		}
+		if value, err := engine.Get([]byte("small")); err != nil || string(value) != small {
+			t.Errorf("Expected the small value to be unchanged, got %d bytes (err %v)", len(value), err)
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+// TestPut_Stream checks /put streams a body larger than the value log
+// threshold to the engine, past the size limit of bodies read whole, and
+// /get streams it back identically
+func TestPut_Stream(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-server-stream-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+
+		opts := storage.DefaultOptions()
+		opts.ValueLogThreshold = 1024
+		engine, err := storage.NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			return
+		}
+		defer engine.Close()
+
+		handler := newHandler(engine, handlerConfig{maxValueSize: 1024, streamMinSize: 1024})
+		post := func(path string, body io.Reader, contentLength int64) int {
+			req := httptest.NewRequest(http.MethodPost, path, body)
+			req.ContentLength = contentLength
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			return w.Code
+		}
+
+		large := strings.Repeat("0123456789", 300000) // 3MB
+		if code := post("/put?key=large", strings.NewReader(large), int64(len(large))); code != http.StatusOK {
+			t.Errorf("Expected status %d for a streamed value, got %d", http.StatusOK, code)
+		}
+		if stats := engine.GetStats().ValueLog; stats.Values != 1 || stats.Bytes != int64(len(large)) {
+			t.Errorf("Expected the value in the value log, got %+v", stats)
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/get?key=large", nil))
+		if w.Code != http.StatusOK || w.Body.String() != large {
+			t.Errorf("Expected the streamed value back, got status %d and %d bytes", w.Code, w.Body.Len())
+		}
+
+		// A body shorter than its Content-Length stores nothing
+		if code := post("/put?key=short", strings.NewReader(large[:2000]), int64(len(large))); code != http.StatusBadRequest {
+			t.Errorf("Expected status %d for a short body, got %d", http.StatusBadRequest, code)
+		}
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/get?key=short", nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected status %d for the short body's key, got %d", http.StatusNotFound, w.Code)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+func TestKeyEncoding(t *testing.T) {
+	done := make(chan bool)
+	go func() {
+		engine := newTestEngine(t, 0)
+		defer engine.Close()
+
+		handler := newHandler(engine, handlerConfig{})
+		request := func(method, path string, body string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+			return w
+		}
+
+		// A key with NUL, & and = bytes, which a raw query parameter mangles
+		key := []byte("a\x00b&c=d")
+		encoded := url.QueryEscape(base64.StdEncoding.EncodeToString(key))
+		if w := request(http.MethodPost, "/put?key-encoding=base64&key="+encoded, "binary"); w.Code != http.StatusOK {
+			t.Errorf("Expected status %d for a base64 put, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		if value, err := engine.Get(key); err != nil || string(value) != "binary" {
+			t.Errorf("Expected the decoded key to be stored, got %q (err %v)", value, err)
+		}
+		if w := request(http.MethodGet, "/get?key-encoding=base64&key="+encoded, ""); w.Code != http.StatusOK || w.Body.String() != "binary" {
+			t.Errorf("Expected a base64 get to return the value, got status %d body %q", w.Code, w.Body.String())
+		}
+		if w := request(http.MethodGet, "/get?key-encoding=hex&key="+hex.EncodeToString(key), ""); w.Code != http.StatusOK || w.Body.String() != "binary" {
+			t.Errorf("Expected a hex get to return the value, got status %d body %q", w.Code, w.Body.String())
+		}
+
+		// Scan bounds are decoded and the returned keys encoded
+		if err := engine.Put([]byte("b"), []byte("other")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		w := request(http.MethodGet, "/scan?key-encoding=hex&start="+hex.EncodeToString([]byte("a\x00"))+"&end="+hex.EncodeToString([]byte("a\x01")), "")
+		expected := fmt.Sprintf("{\"key\":%q,\"value\":\"binary\"}\n", hex.EncodeToString(key))
+		if w.Code != http.StatusOK || w.Body.String() != expected {
+			t.Errorf("Expected the hex scan to return %q, got status %d body %q", expected, w.Code, w.Body.String())
+		}
+
+		// Without an encoding, the key is raw
+		if w := request(http.MethodGet, "/get?key="+encoded, ""); w.Code != http.StatusNotFound {
+			t.Errorf("Expected status %d for the raw encoded key, got %d", http.StatusNotFound, w.Code)
+		}
+
+		for _, path := range []string{
+			"/get?key-encoding=base32&key=a",
+			"/get?key-encoding=base64&key=%21%21",
+			"/get?key-encoding=hex&key=zz",
+			"/scan?key-encoding=hex&start=zz",
+		} {
+			if w := request(http.MethodGet, path, ""); w.Code != http.StatusBadRequest {
+				t.Errorf("Expected status %d for %s, got %d", http.StatusBadRequest, path, w.Code)
+			}
+		}
+		if w := request(http.MethodDelete, "/delete?key-encoding=base64&key="+encoded, ""); w.Code != http.StatusOK {
+			t.Errorf("Expected status %d for a base64 delete, got %d", http.StatusOK, w.Code)
+		}
+		if _, err := engine.Get(key); !errors.Is(err, storage.ErrKeyNotFound) {
+			t.Errorf("Expected the key to be deleted, got %v", err)
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+func TestAdminCompactionWorkers(t *testing.T) {
+	done := make(chan bool)
+	go func() {
+		engine := newTestEngine(t, 0)
+		defer engine.Close()
+
+		handler := newHandler(engine, handlerConfig{})
+		post := func(query string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/compaction/workers"+query, nil))
+			return w
+		}
+
+		w := post("?n=6")
+		if w.Code != http.StatusOK || w.Body.String() != `{"workers":6}` {
+			t.Errorf("Expected 6 workers, got status %d body %q", w.Code, w.Body.String())
+		}
+		if workers := engine.GetStats().CompactionStats.Workers; workers != 6 {
+			t.Errorf("Expected the engine to have 6 workers, got %d", workers)
+		}
+
+		for _, query := range []string{"", "?n=0", "?n=-1", "?n=many"} {
+			if w := post(query); w.Code != http.StatusBadRequest {
+				t.Errorf("Expected status %d for %q, got %d", http.StatusBadRequest, query, w.Code)
+			}
+		}
+		if workers := engine.GetStats().CompactionStats.Workers; workers != 6 {
+			t.Errorf("Expected invalid requests to keep 6 workers, got %d", workers)
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	engine := newTestEngine(t, 0)
+	defer engine.Close()
+
+	w := httptest.NewRecorder()
+	newHandler(engine, handlerConfig{}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "OK" {
+		t.Errorf("Expected a healthy engine to be ready, got status %d body %q", w.Code, w.Body.String())
+	}
+	if status := errorStatus(fmt.Errorf("put: %w", storage.ErrEnginePoisoned)); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d for a poisoned engine, got %d", http.StatusServiceUnavailable, status)
+	}
+}
+
+func TestDebugLevels(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-server-levels-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		// A tiny memory table flushes in the background after every write
+		opts := storage.DefaultOptions()
+		opts.MaxMemTableSize = 1
+		opts.L0CompactionTrigger = 0
+		engine, err := storage.NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+		defer engine.Close()
+
+		handler := newHandler(engine, handlerConfig{})
+		var levels []storage.LevelInfo
+		for i := 0; ; i++ {
+			if err := engine.Put([]byte(fmt.Sprintf("key-%03d", i)), []byte("value")); err != nil {
+				t.Errorf("Failed to put: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/levels", nil))
+			if w.Code != http.StatusOK {
+				t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+				break
+			}
+			levels = nil
+			if err := json.Unmarshal(w.Body.Bytes(), &levels); err != nil {
+				t.Errorf("Failed to decode response: %v", err)
+				break
+			}
+			if len(levels) == 7 && len(levels[0].Blocks) >= 2 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		for i, level := range levels {
+			if level.Level != i {
+				t.Errorf("Expected level %d at index %d, got %d", i, i, level.Level)
+			}
+		}
+		for _, b := range levels[0].Blocks {
+			if !strings.HasSuffix(b.Name, ".blk") || strings.Contains(b.Name, string(os.PathSeparator)) {
+				t.Errorf("Expected a block file base name, got %q", b.Name)
+			}
+			if b.Size <= 0 || b.CreatedAt.IsZero() {
+				t.Errorf("Expected size and creation time, got %+v", b)
+			}
+			if !strings.HasPrefix(b.MinKey, "key-") || b.MinKey > b.MaxKey {
+				t.Errorf("Unexpected key range %q..%q", b.MinKey, b.MaxKey)
+			}
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+func TestStatsReset(t *testing.T) {
+	done := make(chan bool)
+	go func() {
+		engine := newTestEngine(t, 0)
+		defer engine.Close()
+
+		handler := newHandler(engine, handlerConfig{})
+		request := func(method, path, body string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+			return w
+		}
+		reset := func() opCountersSnapshot {
+			w := request(http.MethodPost, "/stats/reset", "")
+			var counters opCountersSnapshot
+			if w.Code != http.StatusOK {
+				t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+			} else if err := json.Unmarshal(w.Body.Bytes(), &counters); err != nil {
+				t.Errorf("Failed to decode counters %q: %v", w.Body.String(), err)
+			}
+			return counters
+		}
+
+		request(http.MethodPost, "/put?key=a", "12345")
+		request(http.MethodPost, "/put?key=b", "123")
+		request(http.MethodPost, "/append?key=a", "6")
+		request(http.MethodGet, "/get?key=a", "")
+		request(http.MethodGet, "/get?key=missing", "")
+		request(http.MethodGet, "/scan", "")
+		request(http.MethodDelete, "/delete?key=b", "")
+
+		expected := opCountersSnapshot{Gets: 2, Puts: 2, Appends: 1, Deletes: 1, Scans: 1, BytesRead: 6 + 7 + 4, BytesWritten: 6 + 4 + 2}
+		if counters := reset(); counters != expected {
+			t.Errorf("Expected counters %+v, got %+v", expected, counters)
+		}
+
+		// The second read only reflects the operations since the reset
+		request(http.MethodPost, "/put?key=c", "1")
+		request(http.MethodGet, "/get?key=c", "")
+		expected = opCountersSnapshot{Gets: 1, Puts: 1, BytesRead: 1, BytesWritten: 2}
+		if counters := reset(); counters != expected {
+			t.Errorf("Expected counters %+v after the reset, got %+v", expected, counters)
+		}
+		if counters := reset(); counters != (opCountersSnapshot{}) {
+			t.Errorf("Expected zero counters after a reset without operations, got %+v", counters)
+		}
+
+		// Errors are counted
+		engine.Close()
+		request(http.MethodPost, "/put?key=d", "1")
+		if counters := reset(); counters.Puts != 1 || counters.Errors != 1 {
+			t.Errorf("Expected a failed put, got %+v", counters)
+		}
+
+		if w := request(http.MethodGet, "/stats/reset", ""); w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("Expected status %d for GET, got %d", http.StatusMethodNotAllowed, w.Code)
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	done := make(chan bool)
+	go func() {
+		engine := newTestEngine(t, 10)
+		defer engine.Close()
+
+		if _, err := engine.Get([]byte("key-001")); err != nil {
+			t.Errorf("Failed to get: %v", err)
+		}
+
+		handler := newHandler(engine, handlerConfig{})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+		}
+
+		body := w.Body.String()
+		for _, line := range []string{
+			"# TYPE river_write_amplification gauge",
+			"river_memtable_keys 10",
+			"river_gets_total 1",
+			"river_space_amplification 0",
+			`river_level_blocks{level="0"} 0`,
+			"# TYPE river_flush_last_duration_seconds gauge",
+			"river_flushes_total 0",
+		} {
+			if !strings.Contains(body, line+"\n") {
+				t.Errorf("Expected line %q in metrics:\n%s", line, body)
+			}
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+// bulkLoad streams keys [from, to) to /bulk-load and returns the progress lines
+func bulkLoad(t *testing.T, handler http.Handler, from, to int, query string) []bulkLoadProgress {
+	body, writer := io.Pipe()
+	go func() {
+		encoder := json.NewEncoder(writer)
+		for i := from; i < to; i++ {
+			entry := scanEntry{Key: fmt.Sprintf("bulk-%05d", i), Value: fmt.Sprintf("value-%d", i)}
+			if err := encoder.Encode(entry); err != nil {
+				writer.CloseWithError(err)
+				return
+			}
+		}
+		writer.Close()
+	}()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/bulk-load"+query, body))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var lines []bulkLoadProgress
+	decoder := json.NewDecoder(w.Body)
+	for decoder.More() {
+		var line bulkLoadProgress
+		if err := decoder.Decode(&line); err != nil {
+			t.Errorf("Failed to decode progress: %v", err)
+			break
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestBulkLoad(t *testing.T) {
+	done := make(chan bool)
+	go func() {
+		engine := newTestEngine(t, 0)
+		defer engine.Close()
+
+		handler := newHandler(engine, handlerConfig{bulkLoadBatchSize: 500})
+
+		// A progress line per batch, then the summary
+		lines := bulkLoad(t, handler, 0, 3000, "")
+		if len(lines) != 7 {
+			t.Errorf("Expected 7 progress lines, got %d: %+v", len(lines), lines)
+			done <- true
+			return
+		}
+		for i, line := range lines[:6] {
+			if line.Ingested != int64(500*(i+1)) || line.Done {
+				t.Errorf("Unexpected progress line %d: %+v", i, line)
+			}
+		}
+		if last := lines[6]; last != (bulkLoadProgress{Ingested: 3000, Done: true}) {
+			t.Errorf("Unexpected summary: %+v", last)
+		}
+
+		for i := 0; i < 3000; i += 97 {
+			value, err := engine.Get([]byte(fmt.Sprintf("bulk-%05d", i)))
+			if err != nil || string(value) != fmt.Sprintf("value-%d", i) {
+				t.Errorf("Expected value-%d for key %d, got %q (%v)", i, i, value, err)
+			}
+		}
+
+		// Resuming skips the keys already loaded
+		lines = bulkLoad(t, handler, 0, 3500, "?skip-existing=true")
+		if last := lines[len(lines)-1]; last != (bulkLoadProgress{Ingested: 500, Skipped: 3000, Done: true}) {
+			t.Errorf("Unexpected summary of resumed load: %+v", last)
+		}
+		if stats := engine.GetStats(); stats.MemTableKeys != 3500 {
+			t.Errorf("Expected 3500 keys, got %d", stats.MemTableKeys)
+		}
+
+		// A malformed line stops the load and is reported
+		w := httptest.NewRecorder()
+		body := strings.NewReader(`{"key":"a","value":"1"}` + "\n" + `{"key":` + "\n")
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/bulk-load", body))
+		var last bulkLoadProgress
+		lastLine := strings.TrimSpace(w.Body.String())
+		lastLine = lastLine[strings.LastIndex(lastLine, "\n")+1:]
+		if err := json.Unmarshal([]byte(lastLine), &last); err != nil {
+			t.Errorf("Failed to decode summary: %v", err)
+		}
+		if last.Ingested != 1 || last.Done || !strings.Contains(last.Error, "line 2") {
+			t.Errorf("Unexpected summary of malformed load: %+v", last)
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
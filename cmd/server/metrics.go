@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/0xReLogic/river/internal/storage"
+)
+
+// opCounters counts the operations served since the server started or the
+// counters were last reset by POST /stats/reset
+type opCounters struct {
+	// Number of /get, /put, /append, /delete and /scan requests passed to
+	// the engine
+	gets, puts, appends, deletes, scans atomic.Int64
+
+	// Number of those failing with an engine error other than a missing key
+	errors atomic.Int64
+
+	// Bytes of keys and values returned by /get and /scan, and written by
+	// /put and /append
+	bytesRead, bytesWritten atomic.Int64
+}
+
+// opCountersSnapshot is the response of POST /stats/reset
+type opCountersSnapshot struct {
+	Gets         int64 `json:"gets"`
+	Puts         int64 `json:"puts"`
+	Appends      int64 `json:"appends"`
+	Deletes      int64 `json:"deletes"`
+	Scans        int64 `json:"scans"`
+	Errors       int64 `json:"errors"`
+	BytesRead    int64 `json:"bytes_read"`
+	BytesWritten int64 `json:"bytes_written"`
+}
+
+// reset returns the counters and resets them to zero. Each counter is
+// swapped atomically, so an operation counted concurrently is reported by
+// exactly one reset.
+func (c *opCounters) reset() opCountersSnapshot {
+	return opCountersSnapshot{
+		Gets:         c.gets.Swap(0),
+		Puts:         c.puts.Swap(0),
+		Appends:      c.appends.Swap(0),
+		Deletes:      c.deletes.Swap(0),
+		Scans:        c.scans.Swap(0),
+		Errors:       c.errors.Swap(0),
+		BytesRead:    c.bytesRead.Swap(0),
+		BytesWritten: c.bytesWritten.Swap(0),
+	}
+}
+
+// writeMetric writes a metric in the Prometheus text exposition format
+func writeMetric(w io.Writer, name, metricType, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, metricType)
+	fmt.Fprintf(w, "%s %g\n", name, value)
+}
+
+// writeLevelMetric writes a metric with one sample per LSM tree level
+func writeLevelMetric(w io.Writer, name, help string, values []float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+	for level, value := range values {
+		fmt.Fprintf(w, "%s{level=\"%d\"} %g\n", name, level, value)
+	}
+}
+
+// metricsHandler serves engine statistics in the Prometheus text format
+func metricsHandler(engine *storage.Engine) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		stats := engine.GetStats()
+		amp := stats.Amplification
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.WriteHeader(http.StatusOK)
+
+		writeMetric(w, "river_memtable_size_bytes", "gauge", "Size of the memory table.", float64(stats.MemTableSize))
+		writeMetric(w, "river_memtable_keys", "gauge", "Number of keys in the memory table.", float64(stats.MemTableKeys))
+
+		levelBlocks := make([]float64, len(stats.LevelBlocks))
+		levelSizes := make([]float64, len(stats.LevelSizes))
+		for level := range stats.LevelBlocks {
+			levelBlocks[level] = float64(stats.LevelBlocks[level])
+			levelSizes[level] = float64(stats.LevelSizes[level])
+		}
+		writeLevelMetric(w, "river_level_blocks", "Number of blocks in an LSM tree level.", levelBlocks)
+		writeLevelMetric(w, "river_level_size_bytes", "Size of an LSM tree level.", levelSizes)
+		writeLevelMetric(w, "river_compaction_score", "Compaction urgency of an LSM tree level; 1 or more needs compaction.", stats.CompactionScores[:])
+
+		writeMetric(w, "river_user_bytes_written_total", "counter", "Bytes of keys and values written by users.", float64(amp.UserBytesWritten))
+		writeMetric(w, "river_wal_bytes_written_total", "counter", "Bytes written to the WAL.", float64(amp.WALBytesWritten))
+		writeMetric(w, "river_flush_bytes_written_total", "counter", "Bytes of blocks written by memory table flushes.", float64(amp.FlushBytesWritten))
+		writeMetric(w, "river_compaction_bytes_written_total", "counter", "Bytes written by compactions.", float64(amp.CompactionBytesWritten))
+		writeMetric(w, "river_write_amplification", "gauge", "Bytes written to disk per byte written by users.", amp.WriteAmplification)
+		writeMetric(w, "river_gets_total", "counter", "Number of Get calls.", float64(amp.Gets))
+		writeMetric(w, "river_get_blocks_read_total", "counter", "Number of blocks read by Get calls.", float64(amp.BlocksRead))
+		writeMetric(w, "river_read_amplification", "gauge", "Average number of blocks read per Get.", amp.ReadAmplification)
+		writeMetric(w, "river_space_amplification", "gauge", "Bytes of blocks per byte of live data (estimated).", amp.SpaceAmplification)
+
+		flush := stats.Flush
+		writeMetric(w, "river_flushes_total", "counter", "Number of memory table flushes.", float64(flush.Count))
+		writeMetric(w, "river_flush_duration_seconds_total", "counter", "Total time spent flushing the memory table.", flush.TotalDuration.Seconds())
+		writeMetric(w, "river_flush_last_duration_seconds", "gauge", "Duration of the last memory table flush.", flush.LastDuration.Seconds())
+		writeMetric(w, "river_flush_average_duration_seconds", "gauge", "Average duration of a memory table flush.", flush.AverageDuration.Seconds())
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/0xReLogic/river/internal/storage"
+)
+
+// How long the child of a graceful restart waits for the parent to
+// complete its requests and release the data directory, and how often it
+// tries to open it meanwhile
+const (
+	restartLockWait = time.Minute
+	restartLockPoll = 20 * time.Millisecond
+)
+
+// How long the parent of a graceful restart waits for the connections it
+// accepted to complete their requests before shutting down
+const restartDrainTimeout = 5 * time.Second
+
+// busyConns tracks the connections of a server that are new or handling a
+// request. Server.Shutdown closes a connection whose request it reads
+// after shutting down began, without a response, so a restart first stops
+// accepting and waits for them.
+type busyConns struct {
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+}
+
+// track is the http.Server.ConnState hook
+func (b *busyConns) track(conn net.Conn, state http.ConnState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.conns == nil {
+		b.conns = make(map[net.Conn]bool)
+	}
+	switch state {
+	case http.StateNew, http.StateActive:
+		b.conns[conn] = true
+	default:
+		delete(b.conns, conn)
+	}
+}
+
+// wait waits up to timeout until no connection is new or active
+func (b *busyConns) wait(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		b.mu.Lock()
+		busy := len(b.conns)
+		b.mu.Unlock()
+		if busy == 0 {
+			return
+		}
+		time.Sleep(restartLockPoll)
+	}
+}
+
+// listen returns the listener inherited as file descriptor fd on a graceful
+// restart, or listens on addr if fd is zero
+func listen(addr string, fd int) (net.Listener, error) {
+	if fd == 0 {
+		return net.Listen("tcp", addr)
+	}
+
+	file := os.NewFile(uintptr(fd), "listener")
+	if file == nil {
+		return nil, fmt.Errorf("invalid listener file descriptor %d", fd)
+	}
+	defer file.Close()
+
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to adopt listener: %w", err)
+	}
+	return listener, nil
+}
+
+// startChild starts the child of a graceful restart with the same flags,
+// passing it the listener so connections keep being accepted on the same
+// socket while the parent shuts down
+func startChild(listener net.Listener) (*os.Process, error) {
+	execPath, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get executable path: %w", err)
+	}
+
+	filer, ok := listener.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("listener %T can't be passed to a child", listener)
+	}
+	file, err := filer.File()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get listener file: %w", err)
+	}
+	defer file.Close()
+
+	// Pass the flags given to this process, except those of the restart
+	// that made it, and the listener as the file after stderr
+	files := []*os.File{os.Stdin, os.Stdout, os.Stderr, file}
+	args := []string{execPath}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "graceful", "parent-pid", "listener-fd":
+		default:
+			args = append(args, fmt.Sprintf("-%s=%s", f.Name, f.Value))
+		}
+	})
+	args = append(args,
+		"-graceful",
+		"-parent-pid", strconv.Itoa(os.Getpid()),
+		"-listener-fd", strconv.Itoa(len(files)-1),
+	)
+
+	// The child runs in the same directory, so relative paths in the flags
+	// keep their meaning
+	return os.StartProcess(execPath, args, &os.ProcAttr{
+		Env:   os.Environ(),
+		Files: files,
+	})
+}
+
+// openEngine opens the storage engine, retrying for up to wait while
+// another process holds the data directory
+func openEngine(dataDir string, opts storage.Options, wait time.Duration) (*storage.Engine, error) {
+	deadline := time.Now().Add(wait)
+	for {
+		engine, err := storage.NewEngineWithOptions(dataDir, opts)
+		if !errors.Is(err, storage.ErrLocked) || time.Now().After(deadline) {
+			return engine, err
+		}
+		time.Sleep(restartLockPoll)
+	}
+}
@@ -0,0 +1,218 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestGracefulRestart restarts a server binary with SIGUSR2 while a client
+// is in the middle of a request and another keeps opening connections, and
+// checks every request succeeds and the child serves the data afterwards
+func TestGracefulRestart(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds and runs the server binary")
+	}
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go tool not found")
+	}
+
+	tempDir, err := os.MkdirTemp("", "river-restart-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	binary := filepath.Join(tempDir, "river-server")
+	if out, err := exec.Command(goTool, "build", "-o", binary, ".").CombinedOutput(); err != nil {
+		t.Fatalf("Failed to build server: %v\n%s", err, out)
+	}
+
+	// Find a free port
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	addr := probe.Addr().String()
+	probe.Close()
+
+	// The parent and the child log to the same file
+	logPath := filepath.Join(tempDir, "server.log")
+	logFile, err := os.Create(logPath)
+	if err != nil {
+		t.Fatalf("Failed to create log file: %v", err)
+	}
+	defer logFile.Close()
+
+	parent := exec.Command(binary, "-data-dir", filepath.Join(tempDir, "data"), "-http-addr", addr)
+	parent.Stdout = logFile
+	parent.Stderr = logFile
+	if err := parent.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer parent.Process.Kill()
+
+	// childPid returns the PID of the child once it has logged its start
+	childPid := func() int {
+		data, _ := os.ReadFile(logPath)
+		match := regexp.MustCompile(`Child process (\d+) started`).FindSubmatch(data)
+		if match == nil {
+			return 0
+		}
+		pid, _ := strconv.Atoi(string(match[1]))
+		return pid
+	}
+	defer func() {
+		if pid := childPid(); pid != 0 {
+			syscall.Kill(pid, syscall.SIGTERM)
+			for i := 0; i < 100 && syscall.Kill(pid, 0) == nil; i++ {
+				time.Sleep(50 * time.Millisecond)
+			}
+		}
+	}()
+
+	// Every request uses a new connection
+	client := &http.Client{
+		Transport: &http.Transport{DisableKeepAlives: true},
+		Timeout:   5 * time.Second,
+	}
+	url := "http://" + addr
+
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+
+		ready := false
+		for i := 0; i < 100 && !ready; i++ {
+			resp, err := client.Get(url + "/health")
+			if err == nil {
+				resp.Body.Close()
+				ready = true
+			} else {
+				time.Sleep(50 * time.Millisecond)
+			}
+		}
+		if !ready {
+			t.Errorf("Server did not start")
+			return
+		}
+
+		// Open connections continuously until stopped
+		var requests, failures atomic.Int64
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				requests.Add(1)
+				resp, err := client.Get(url + "/health")
+				if err != nil {
+					failures.Add(1)
+					t.Errorf("Request failed during the restart: %v", err)
+					continue
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					failures.Add(1)
+					t.Errorf("Expected status %d during the restart, got %d", http.StatusOK, resp.StatusCode)
+				}
+			}
+		}()
+
+		// Start a put whose body is completed after the restart began
+		body, bodyWriter := io.Pipe()
+		putResult := make(chan error, 1)
+		go func() {
+			req, err := http.NewRequest(http.MethodPost, url+"/put?key=mid-restart", body)
+			if err != nil {
+				putResult <- err
+				return
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				putResult <- err
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("status %d", resp.StatusCode)
+			}
+			putResult <- err
+		}()
+		bodyWriter.Write([]byte("first half, "))
+
+		if err := parent.Process.Signal(syscall.SIGUSR2); err != nil {
+			t.Errorf("Failed to signal restart: %v", err)
+		}
+		for i := 0; i < 100 && childPid() == 0; i++ {
+			time.Sleep(20 * time.Millisecond)
+		}
+		if childPid() == 0 {
+			t.Errorf("Child process did not start")
+		}
+
+		// The parent completes the request before it exits
+		bodyWriter.Write([]byte("second half"))
+		bodyWriter.Close()
+		if err := <-putResult; err != nil {
+			t.Errorf("Request in progress during the restart failed: %v", err)
+		}
+
+		parentExited := make(chan error, 1)
+		go func() { parentExited <- parent.Wait() }()
+		select {
+		case err := <-parentExited:
+			if err != nil {
+				t.Errorf("Parent exited with %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("Parent did not exit after the restart")
+		}
+
+		// The child serves the data once it has opened the engine
+		time.Sleep(100 * time.Millisecond)
+		close(stop)
+		wg.Wait()
+
+		resp, err := client.Get(url + "/get?key=mid-restart")
+		if err != nil {
+			t.Errorf("Failed to get from the child: %v", err)
+			return
+		}
+		value, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(value) != "first half, second half" {
+			t.Errorf("Expected the put value from the child, got status %d body %q", resp.StatusCode, value)
+		}
+		if requests.Load() < 2 || failures.Load() != 0 {
+			t.Errorf("Expected requests during the restart to succeed, got %d failures of %d", failures.Load(), requests.Load())
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/0xReLogic/river/internal/storage"
+)
+
+// discardResponseWriter is a ResponseWriter counting and dropping the body
+type discardResponseWriter struct {
+	header http.Header
+	size   int64
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardResponseWriter) Write(p []byte) (int, error) {
+	w.size += int64(len(p))
+	return io.Discard.Write(p)
+}
+
+func (w *discardResponseWriter) WriteHeader(int) {}
+
+// BenchmarkScan_ValuesOnly benchmarks a /scan over 100,000 keys of 64
+// bytes with 32-byte values, returning keys and values, and returning only
+// the values. The size of each response is reported as response-bytes.
+func BenchmarkScan_ValuesOnly(b *testing.B) {
+	tempDir, err := os.MkdirTemp("", "river-server-scan-bench")
+	if err != nil {
+		b.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	engine, err := storage.NewEngine(tempDir)
+	if err != nil {
+		b.Fatalf("Failed to create engine: %v", err)
+	}
+	defer engine.Close()
+
+	const numKeys = 100000
+	value := bytes.Repeat([]byte("v"), 32)
+	err = engine.BulkImport(func(w storage.BulkWriter) error {
+		for i := 0; i < numKeys; i++ {
+			if err := w.Put([]byte(fmt.Sprintf("tenant-0001:table-0001:%041d", i)), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.Fatalf("Failed to import: %v", err)
+	}
+
+	handler := newHandler(engine, handlerConfig{})
+	for _, query := range []string{"", "?values-only=true"} {
+		b.Run(fmt.Sprintf("query=%q", query), func(b *testing.B) {
+			req := httptest.NewRequest(http.MethodGet, "/scan"+query, nil)
+			var w *discardResponseWriter
+			for i := 0; i < b.N; i++ {
+				w = &discardResponseWriter{header: make(http.Header)}
+				handler.ServeHTTP(w, req)
+			}
+			b.ReportMetric(float64(w.size), "response-bytes")
+		})
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import "syscall"
+
+// Define custom signal constants for Windows
+const (
+	// These are not available on Windows, so we define custom values
+	// that we'll handle specially in our code
+	SIGUSR1 = syscall.Signal(0x10) // Custom signal for child ready
+	SIGUSR2 = syscall.Signal(0x11) // Custom signal for graceful restart
+)
@@ -0,0 +1,12 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+// Signals of the graceful restart: the parent restarts on SIGUSR2, and the
+// child reports it took over the listener with SIGUSR1
+const (
+	SIGUSR1 = syscall.SIGUSR1
+	SIGUSR2 = syscall.SIGUSR2
+)
@@ -0,0 +1,130 @@
+// Command walreplay recovers the contents of a WAL directory: it replays
+// every entry of its segments, verifying their checksums, into a new
+// engine. Corrupt entries are skipped and reported rather than failing the
+// replay.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/0xReLogic/river/internal/storage"
+)
+
+var (
+	// Command line flags
+	walDir = flag.String("wal-dir", "", "WAL directory to replay (read only)")
+	outDir = flag.String("out", "", "New data directory to replay the WAL into")
+	force  = flag.Bool("force", false, "Replay into the output directory even if it already holds data")
+)
+
+// replayStats counts the entries of a replay
+type replayStats struct {
+	// Puts and deletes applied to the engine
+	puts, deletes int64
+
+	// Committed bulk imports, which can't be replayed: their blocks are not
+	// in the WAL
+	imports int64
+
+	// Corrupt entries and segments skipped
+	corrupt int64
+}
+
+func main() {
+	flag.Parse()
+
+	if *walDir == "" || *outDir == "" {
+		fmt.Fprintln(os.Stderr, "Usage: walreplay -wal-dir DIR -out DIR [-force]")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	stats, err := replay(*walDir, *outDir, *force, os.Stdout)
+	if err != nil {
+		log.Fatalf("Failed to replay WAL: %v", err)
+	}
+
+	fmt.Printf("Applied %d puts and %d deletes to %s\n", stats.puts, stats.deletes, *outDir)
+	fmt.Printf("Skipped %d corrupt entries and %d bulk imports\n", stats.corrupt, stats.imports)
+}
+
+// replay applies the entries of the WAL in walDir to an engine opened at
+// outDir, which must not hold any data unless force is set. Skipped entries
+// are reported to out.
+func replay(walDir, outDir string, force bool, out io.Writer) (replayStats, error) {
+	var stats replayStats
+
+	if !force {
+		entries, err := os.ReadDir(outDir)
+		if err != nil && !os.IsNotExist(err) {
+			return stats, fmt.Errorf("failed to read output directory: %w", err)
+		}
+		if len(entries) > 0 {
+			return stats, fmt.Errorf("output directory %s already holds data (use -force to replay into it)", outDir)
+		}
+	}
+
+	// The engine writes to its own WAL, which must not be the one replayed
+	source, err := filepath.Abs(walDir)
+	if err != nil {
+		return stats, fmt.Errorf("failed to resolve WAL directory: %w", err)
+	}
+	target, err := filepath.Abs(filepath.Join(outDir, "wal"))
+	if err != nil {
+		return stats, fmt.Errorf("failed to resolve output directory: %w", err)
+	}
+	if source == target {
+		return stats, fmt.Errorf("can't replay the WAL of %s into itself", outDir)
+	}
+
+	wal, err := storage.OpenWALReadOnly(walDir)
+	if err != nil {
+		return stats, err
+	}
+	defer wal.Close()
+	wal.SkipCorruptEntries(func(segment string, err error) {
+		stats.corrupt++
+		fmt.Fprintf(out, "Skipping corrupt entry in %s: %v\n", segment, err)
+	})
+
+	engine, err := storage.NewEngine(outDir)
+	if err != nil {
+		return stats, fmt.Errorf("failed to open engine: %w", err)
+	}
+
+	err = wal.Replay(func(entry storage.WALEntry) error {
+		switch entry.OpType {
+		case storage.OpTypePut:
+			if err := engine.Put(entry.Key, entry.Value); err != nil {
+				return err
+			}
+			stats.puts++
+		case storage.OpTypeDelete:
+			if err := engine.Delete(entry.Key); err != nil {
+				return err
+			}
+			stats.deletes++
+		case storage.OpTypeImport:
+			stats.imports++
+			fmt.Fprintf(out, "Skipping bulk import %s: its blocks are not in the WAL\n", entry.Key)
+		default:
+			stats.corrupt++
+			fmt.Fprintf(out, "Skipping entry with unknown operation type %d\n", entry.OpType)
+		}
+		return nil
+	})
+	if err != nil {
+		engine.Close()
+		return stats, err
+	}
+
+	if err := engine.Close(); err != nil {
+		return stats, fmt.Errorf("failed to close engine: %w", err)
+	}
+	return stats, nil
+}
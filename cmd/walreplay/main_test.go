@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/0xReLogic/river/internal/storage"
+)
+
+// TestReplay writes a WAL with a corrupt entry, replays it into a new data
+// directory, and checks the engine there holds the other writes while the
+// WAL is left untouched
+func TestReplay(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-walreplay-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	walDir := filepath.Join(tempDir, "wal")
+	outDir := filepath.Join(tempDir, "out")
+
+	wal, err := storage.NewWAL(walDir)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	for _, pair := range [][2]string{{"a", "1"}, {"b", "2"}, {"c", "3"}, {"d", "corrupt me"}, {"a", "4"}, {"e", "5"}} {
+		if err := wal.AppendPut([]byte(pair[0]), []byte(pair[1])); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+	}
+	if err := wal.AppendDelete([]byte("b")); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatalf("Failed to close WAL: %v", err)
+	}
+
+	// Flip a byte of the value of d, which fails its checksum
+	segments, err := filepath.Glob(filepath.Join(walDir, "*.wal"))
+	if err != nil || len(segments) != 1 {
+		t.Fatalf("Expected one WAL segment, got %v (err %v)", segments, err)
+	}
+	data, err := os.ReadFile(segments[0])
+	if err != nil {
+		t.Fatalf("Failed to read WAL segment: %v", err)
+	}
+	i := bytes.Index(data, []byte("corrupt me"))
+	if i < 0 {
+		t.Fatalf("Value of d not found in the WAL segment")
+	}
+	data[i] ^= 0xff
+	if err := os.WriteFile(segments[0], data, 0644); err != nil {
+		t.Fatalf("Failed to corrupt WAL segment: %v", err)
+	}
+	before := listDir(t, walDir)
+
+	var out bytes.Buffer
+	stats, err := replay(walDir, outDir, false, &out)
+	if err != nil {
+		t.Fatalf("Failed to replay: %v", err)
+	}
+	if stats != (replayStats{puts: 5, deletes: 1, corrupt: 1}) {
+		t.Errorf("Expected 5 puts, 1 delete and 1 corrupt entry, got %+v", stats)
+	}
+	if !strings.Contains(out.String(), "checksum mismatch") {
+		t.Errorf("Expected the corrupt entry to be reported, got %q", out.String())
+	}
+	if after := listDir(t, walDir); after != before {
+		t.Errorf("Expected the replayed WAL to be left as is, got %s instead of %s", after, before)
+	}
+
+	engine, err := storage.NewEngine(outDir)
+	if err != nil {
+		t.Fatalf("Failed to open replayed engine: %v", err)
+	}
+	it, err := engine.NewIterator(context.Background(), storage.IteratorOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create iterator: %v", err)
+	}
+	var pairs []string
+	for it.Next() {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", it.Key(), it.Value()))
+	}
+	it.Close()
+	engine.Close()
+	if got, expected := fmt.Sprint(pairs), "[a=4 c=3 e=5]"; got != expected {
+		t.Errorf("Expected %s in the replayed engine, got %s", expected, got)
+	}
+
+	// An output directory holding data is only replayed into with force
+	if _, err := replay(walDir, outDir, false, io.Discard); err == nil {
+		t.Errorf("Expected an error replaying into a directory holding data")
+	}
+	if _, err := replay(walDir, outDir, true, io.Discard); err != nil {
+		t.Errorf("Failed to replay with force: %v", err)
+	}
+	if _, err := replay(filepath.Join(outDir, "wal"), outDir, true, io.Discard); err == nil {
+		t.Errorf("Expected an error replaying a WAL into its own engine")
+	}
+}
+
+// listDir returns the names and sizes of the files of a directory
+func listDir(t *testing.T, dir string) string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", dir, err)
+	}
+	var files []string
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			t.Fatalf("Failed to stat %s: %v", entry.Name(), err)
+		}
+		files = append(files, fmt.Sprintf("%s:%d", entry.Name(), info.Size()))
+	}
+	return fmt.Sprint(files)
+}
@@ -2,15 +2,17 @@ package block
 
 import (
 	"bytes"
-	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"sort"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/0xReLogic/river/internal/data/compress"
 )
 
 // DataType defines the type of data stored in a column block.
@@ -31,24 +33,44 @@ type CompressionType uint8
 const (
 	CompressionNone CompressionType = iota
 	CompressionLZ4
+	CompressionZstd // Slower than LZ4, with a higher compression ratio
+)
+
+// Errors returned by block operations. They are wrapped with additional
+// context, so callers should compare with errors.Is.
+var (
+	// ErrKeyNotFound is returned when a key is not present in the block
+	ErrKeyNotFound = errors.New("key not found")
+
+	// ErrKeyDeleted is returned when the block holds a tombstone for the key.
+	// It wraps ErrKeyNotFound, but lets the LSM tree stop searching older blocks.
+	ErrKeyDeleted = fmt.Errorf("%w: deleted", ErrKeyNotFound)
+
+	// ErrCorrupt is returned when block data cannot be decoded
+	ErrCorrupt = errors.New("data corrupted")
 )
 
+// tombstoneLen is the value length written for deleted keys
+const tombstoneLen = ^uint32(0)
+
 // Header defines the metadata for a column block.
 // It's a fixed-size structure.
 type Header struct {
 	DataType        DataType
 	CompressionType CompressionType
-	Count           uint32   // Number of values in the block
-	RawSizeBytes    uint32   // Size of the data in bytes before compression
-	StoredSizeBytes uint32   // Size of the data in bytes after compression
-	CreatedAt       int64    // Unix timestamp when the block was created
-	BlockID         [32]byte // SHA-256 hash of the block contents
+	HashType        HashType    // Hash function used for BlockID
+	Flags           FormatFlags // Optional features of the pair format
+	Count           uint32      // Number of values in the block
+	RawSizeBytes    uint32      // Size of the data in bytes before compression
+	StoredSizeBytes uint32      // Size of the data in bytes after compression
+	CreatedAt       int64       // Unix timestamp when the block was created
+	BlockID         [32]byte    // Hash of the block contents, zero-padded for shorter hashes
 }
 
 // Stats stores summary statistics for the data in the block.
 // This is used for query optimization (e.g., predicate pushdown).
 type Stats struct {
-	Min, Max uint64 // Using uint64 to generically represent min/max for numeric types
+	Min, Max uint64 // Using uint64 to generically represent min/max for numeric types; set with FlagValueStats
 	MinKey   []byte // Minimum key in the block
 	MaxKey   []byte // Maximum key in the block
 }
@@ -69,12 +91,30 @@ type Block struct {
 
 	// Buffer for reading
 	buffer *bytes.Buffer
+
+	// Whether the header was computed by FinalizeHeader for the current pairs
+	headerReady bool
+
+	// Byte order of the header and data, as recorded in the preamble of a
+	// decoded block; nil for little-endian, in which blocks are written
+	order binary.ByteOrder
+
+	// Sequence number recorded in the preamble (see Sequence)
+	sequence int64
 }
 
 // keyValuePair represents a key-value pair in the block
 type keyValuePair struct {
 	key   []byte
 	value []byte
+
+	// Checksum of the value, when read from a block with FlagValueChecksums
+	checksum    uint32
+	hasChecksum bool
+
+	// Creation time of a tombstone in Unix nanoseconds, stored with
+	// FlagTombstoneTimes; zero if unknown
+	deletedAt int64
 }
 
 // NewBlock creates a new empty block
@@ -89,12 +129,14 @@ func NewBlock() *Block {
 	}
 }
 
-// Add adds a key-value pair to the block
+// Add adds a key-value pair to the block.
+// A nil value records a tombstone for the key; use an empty slice for an empty value.
 func (b *Block) Add(key, value []byte) error {
 	b.pairsMu.Lock()
 	defer b.pairsMu.Unlock()
 
 	// Add the pair to the list
+	b.headerReady = false
 	b.pairs = append(b.pairs, keyValuePair{
 		key:   key,
 		value: value,
@@ -114,7 +156,22 @@ func (b *Block) Add(key, value []byte) error {
 	return nil
 }
 
-// Get retrieves a value for a key from the block
+// AddTombstone adds a tombstone for key to the block, created at deletedAt
+// (Unix nanoseconds). The time is stored if the header has FlagTombstoneTimes.
+func (b *Block) AddTombstone(key []byte, deletedAt int64) error {
+	if err := b.Add(key, nil); err != nil {
+		return err
+	}
+
+	b.pairsMu.Lock()
+	defer b.pairsMu.Unlock()
+	b.pairs[len(b.pairs)-1].deletedAt = deletedAt
+	return nil
+}
+
+// Get retrieves a value for a key from the block. In a decoded block with
+// FlagValueChecksums, a value that doesn't match its checksum is reported as
+// ErrCorrupt, without affecting the other keys.
 func (b *Block) Get(key []byte) ([]byte, error) {
 	b.pairsMu.RLock()
 	defer b.pairsMu.RUnlock()
@@ -122,11 +179,17 @@ func (b *Block) Get(key []byte) ([]byte, error) {
 	// Linear search for the key
 	for _, pair := range b.pairs {
 		if bytes.Equal(pair.key, key) {
+			if pair.value == nil {
+				return nil, ErrKeyDeleted
+			}
+			if pair.hasChecksum && ValueChecksum(pair.value) != pair.checksum {
+				return nil, fmt.Errorf("%w: checksum mismatch for the value of key %q", ErrCorrupt, key)
+			}
 			return pair.value, nil
 		}
 	}
 
-	return nil, fmt.Errorf("key not found")
+	return nil, ErrKeyNotFound
 }
 
 // Finalize prepares the block for writing to disk
@@ -135,16 +198,153 @@ func (b *Block) Finalize() error {
 	defer b.pairsMu.Unlock()
 
 	// Sort pairs by key
+	b.sortPairs()
+
+	if b.Header.Flags&FlagSplitLayout != 0 {
+		return b.finalizeSplit()
+	}
+
+	// Reset buffer
+	b.buffer.Reset()
+
+	// Write pair count and pairs
+	if err := b.writePairs(b.buffer); err != nil {
+		return err
+	}
+
+	// Update header
+	b.Header.Count = uint32(len(b.pairs))
+	b.Header.RawSizeBytes = uint32(b.buffer.Len())
+
+	// Calculate block ID (hash of the uncompressed data)
+	if err := b.setBlockID(b.buffer.Bytes()); err != nil {
+		return err
+	}
+
+	// Compress the data with the block's compression type
+	stored, compression, err := compressData(b.Header.CompressionType, b.buffer.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to compress block data: %w", err)
+	}
+	b.Header.CompressionType = compression
+	b.Header.StoredSizeBytes = uint32(len(stored))
+
+	// Copy stored bytes to data
+	b.Data = make([]byte, len(stored))
+	copy(b.Data, stored)
+
+	return nil
+}
+
+// FinalizeHeader fills in the header (count, sizes and block ID) without
+// materializing the serialized data, by hashing the pairs as they would be
+// written. It prepares the block for EncodeStream.
+//
+// Streamed blocks are stored uncompressed, since compression needs the whole
+// serialized data in memory.
+func (b *Block) FinalizeHeader() error {
+	b.pairsMu.Lock()
+	defer b.pairsMu.Unlock()
+
+	if b.Header.CompressionType != CompressionNone {
+		return fmt.Errorf("cannot stream a block with compression type %d", b.Header.CompressionType)
+	}
+
+	// Sort pairs by key
+	b.sortPairs()
+
+	// Hash the serialized pairs incrementally
+	hasher, err := newHasher(b.Header.HashType)
+	if err != nil {
+		return err
+	}
+	counter := &countingWriter{w: hasher}
+	if err := b.writeData(counter); err != nil {
+		return err
+	}
+
+	// Update header
+	b.Header.Count = uint32(len(b.pairs))
+	b.Header.RawSizeBytes = uint32(counter.n)
+	b.Header.StoredSizeBytes = b.Header.RawSizeBytes
+	if b.Header.Flags&FlagSplitLayout != 0 {
+		b.Header.StoredSizeBytes += splitStoredHeaderSize - splitRawHeaderSize
+	}
+	b.Header.BlockID = [32]byte{}
+	copy(b.Header.BlockID[:], hasher.Sum(nil))
+
+	b.headerReady = true
+
+	return nil
+}
+
+// setBlockID sets the block ID to the hash of the serialized pairs
+func (b *Block) setBlockID(raw []byte) error {
+	hasher, err := newHasher(b.Header.HashType)
+	if err != nil {
+		return err
+	}
+	hasher.Write(raw)
+
+	b.Header.BlockID = [32]byte{}
+	copy(b.Header.BlockID[:], hasher.Sum(nil))
+	return nil
+}
+
+// Verify recomputes the hash of a finalized or decoded block's pairs with
+// the hash function recorded in the header and compares it with the block
+// ID. A mismatch is reported as ErrCorrupt.
+func (b *Block) Verify() error {
+	b.pairsMu.RLock()
+	defer b.pairsMu.RUnlock()
+
+	hasher, err := newHasher(b.Header.HashType)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrCorrupt, err)
+	}
+	if err := b.writeData(hasher); err != nil {
+		return err
+	}
+
+	var id [32]byte
+	copy(id[:], hasher.Sum(nil))
+	if id != b.Header.BlockID {
+		return fmt.Errorf("%w: block ID mismatch", ErrCorrupt)
+	}
+
+	return nil
+}
+
+// sortPairs sorts the pairs by key. Callers must hold pairsMu.
+func (b *Block) sortPairs() {
 	sort.Slice(b.pairs, func(i, j int) bool {
 		return bytes.Compare(b.pairs[i].key, b.pairs[j].key) < 0
 	})
+}
 
-	// Reset buffer
-	b.buffer.Reset()
+// writeData writes the serialized pairs in the block's layout, as hashed
+// for the block ID. Callers must hold pairsMu.
+func (b *Block) writeData(w io.Writer) error {
+	if b.Header.Flags&FlagSplitLayout != 0 {
+		return b.writeSplit(w)
+	}
+	return b.writePairs(w)
+}
+
+// writePairs writes the pair count followed by each pair. Callers must hold pairsMu.
+// Layout of each pair:
+// - 4 bytes: Key length
+// - N bytes: Key
+// - 4 bytes: Value length (tombstoneLen for deleted keys)
+// - M bytes: Value
+// - 4 bytes: CRC32C of the value, with FlagValueChecksums and not for tombstones
+// - 8 bytes: Creation time of a tombstone, with FlagTombstoneTimes
+func (b *Block) writePairs(w io.Writer) error {
+	order := b.byteOrder()
 
 	// Write number of pairs
 	count := uint32(len(b.pairs))
-	if err := binary.Write(b.buffer, binary.LittleEndian, count); err != nil {
+	if err := binary.Write(w, order, count); err != nil {
 		return fmt.Errorf("failed to write pair count: %w", err)
 	}
 
@@ -152,40 +352,69 @@ func (b *Block) Finalize() error {
 	for _, pair := range b.pairs {
 		// Write key length
 		keyLen := uint32(len(pair.key))
-		if err := binary.Write(b.buffer, binary.LittleEndian, keyLen); err != nil {
+		if err := binary.Write(w, order, keyLen); err != nil {
 			return fmt.Errorf("failed to write key length: %w", err)
 		}
 
 		// Write key
-		if _, err := b.buffer.Write(pair.key); err != nil {
+		if _, err := w.Write(pair.key); err != nil {
 			return fmt.Errorf("failed to write key: %w", err)
 		}
 
-		// Write value length
+		// Write value length (tombstones use a reserved length)
 		valueLen := uint32(len(pair.value))
-		if err := binary.Write(b.buffer, binary.LittleEndian, valueLen); err != nil {
+		if pair.value == nil {
+			valueLen = tombstoneLen
+		}
+		if err := binary.Write(w, order, valueLen); err != nil {
 			return fmt.Errorf("failed to write value length: %w", err)
 		}
 
 		// Write value
-		if _, err := b.buffer.Write(pair.value); err != nil {
+		if _, err := w.Write(pair.value); err != nil {
 			return fmt.Errorf("failed to write value: %w", err)
 		}
+
+		// Write the value checksum
+		if b.Header.Flags&FlagValueChecksums != 0 && pair.value != nil {
+			if err := binary.Write(w, order, ValueChecksum(pair.value)); err != nil {
+				return fmt.Errorf("failed to write value checksum: %w", err)
+			}
+		}
+
+		// Write the tombstone's creation time
+		if b.Header.Flags&FlagTombstoneTimes != 0 && pair.value == nil {
+			if err := binary.Write(w, order, pair.deletedAt); err != nil {
+				return fmt.Errorf("failed to write tombstone time: %w", err)
+			}
+		}
 	}
 
-	// Update header
-	b.Header.Count = count
-	b.Header.RawSizeBytes = uint32(b.buffer.Len())
-	b.Header.StoredSizeBytes = b.Header.RawSizeBytes // No compression yet
+	return nil
+}
 
-	// Copy buffer to data
-	b.Data = make([]byte, b.buffer.Len())
-	copy(b.Data, b.buffer.Bytes())
+// DataSize returns the size in bytes of the serialized pairs, without serializing them
+func (b *Block) DataSize() int {
+	b.pairsMu.RLock()
+	defer b.pairsMu.RUnlock()
 
-	// Calculate block ID (SHA-256 hash of data)
-	b.Header.BlockID = sha256.Sum256(b.Data)
+	if b.Header.Flags&FlagSplitLayout != 0 {
+		keys, values := b.splitSizes()
+		return splitRawHeaderSize + keys + values
+	}
 
-	return nil
+	size := 4 // Pair count
+	for _, pair := range b.pairs {
+		size += 4 + len(pair.key) + 4 + len(pair.value)
+		if b.Header.Flags&FlagValueChecksums != 0 && pair.value != nil {
+			size += 4 // Value checksum
+		}
+		if b.Header.Flags&FlagTombstoneTimes != 0 && pair.value == nil {
+			size += 8 // Tombstone time
+		}
+	}
+
+	return size
 }
 
 // Encode writes the block to the given writer.
@@ -197,22 +426,80 @@ func (b *Block) Encode(w io.Writer) error {
 		}
 	}
 
+	// Write header and stats
+	if err := b.writeHeader(w); err != nil {
+		return err
+	}
+
+	// Write data
+	_, err := w.Write(b.Data)
+	if err != nil {
+		return fmt.Errorf("failed to write block data: %w", err)
+	}
+
+	return nil
+}
+
+// EncodeStream writes the block to the given writer like Encode, but writes
+// the pairs directly to w instead of serializing them into memory first.
+// The output is byte-identical to Encode. Use it for large blocks, where the
+// in-memory copy made by Finalize would double memory usage.
+func (b *Block) EncodeStream(w io.Writer) error {
+	// Compute the header if not already done
+	if !b.headerReady {
+		if err := b.FinalizeHeader(); err != nil {
+			return err
+		}
+	}
+
+	// Write header and stats
+	if err := b.writeHeader(w); err != nil {
+		return err
+	}
+
+	// Write data
+	b.pairsMu.RLock()
+	defer b.pairsMu.RUnlock()
+
+	if b.Header.Flags&FlagSplitLayout != 0 {
+		return b.writeSplitStream(w)
+	}
+	return b.writePairs(w)
+}
+
+// byteOrder returns the byte order of the header and data of the block
+func (b *Block) byteOrder() binary.ByteOrder {
+	if b.order == nil {
+		return binary.LittleEndian
+	}
+	return b.order
+}
+
+// writeHeader writes the preamble, header and stats that precede the block data
+func (b *Block) writeHeader(w io.Writer) error {
+	order := b.byteOrder()
+
+	// Write the magic, format version, byte order and sequence number
+	if err := writePreamble(w, order, b.sequence); err != nil {
+		return err
+	}
+
 	// Write header
-	if err := binary.Write(w, binary.LittleEndian, &b.Header); err != nil {
+	if err := binary.Write(w, order, &b.Header); err != nil {
 		return fmt.Errorf("failed to write block header: %w", err)
 	}
 
 	// Write stats (only fixed-size fields)
-	if err := binary.Write(w, binary.LittleEndian, b.Stats.Min); err != nil {
+	if err := binary.Write(w, order, b.Stats.Min); err != nil {
 		return fmt.Errorf("failed to write block stats min: %w", err)
 	}
-	if err := binary.Write(w, binary.LittleEndian, b.Stats.Max); err != nil {
+	if err := binary.Write(w, order, b.Stats.Max); err != nil {
 		return fmt.Errorf("failed to write block stats max: %w", err)
 	}
 
 	// Write min key length and min key
 	minKeyLen := uint32(len(b.Stats.MinKey))
-	if err := binary.Write(w, binary.LittleEndian, minKeyLen); err != nil {
+	if err := binary.Write(w, order, minKeyLen); err != nil {
 		return fmt.Errorf("failed to write min key length: %w", err)
 	}
 	if minKeyLen > 0 {
@@ -223,7 +510,7 @@ func (b *Block) Encode(w io.Writer) error {
 
 	// Write max key length and max key
 	maxKeyLen := uint32(len(b.Stats.MaxKey))
-	if err := binary.Write(w, binary.LittleEndian, maxKeyLen); err != nil {
+	if err := binary.Write(w, order, maxKeyLen); err != nil {
 		return fmt.Errorf("failed to write max key length: %w", err)
 	}
 	if maxKeyLen > 0 {
@@ -232,54 +519,40 @@ func (b *Block) Encode(w io.Writer) error {
 		}
 	}
 
-	// Write data
-	_, err := w.Write(b.Data)
-	if err != nil {
-		return fmt.Errorf("failed to write block data: %w", err)
-	}
-
 	return nil
 }
 
 // Decode reads a block from the given reader.
+// Any failure to parse the block is reported as ErrCorrupt, wrapping
+// ErrBadMagic for a file that is not a block and ErrUnsupportedVersion for
+// a block of a newer format.
 func (b *Block) Decode(r io.Reader) error {
-	// Read header
-	if err := binary.Read(r, binary.LittleEndian, &b.Header); err != nil {
-		return fmt.Errorf("failed to read block header: %w", err)
-	}
-
-	// Read stats (only fixed-size fields)
-	if err := binary.Read(r, binary.LittleEndian, &b.Stats.Min); err != nil {
-		return fmt.Errorf("failed to read block stats min: %w", err)
-	}
-	if err := binary.Read(r, binary.LittleEndian, &b.Stats.Max); err != nil {
-		return fmt.Errorf("failed to read block stats max: %w", err)
+	if err := b.decode(r); err != nil {
+		return fmt.Errorf("%w: %w", ErrCorrupt, err)
 	}
+	return nil
+}
 
-	// Read min key length and min key
-	var minKeyLen uint32
-	if err := binary.Read(r, binary.LittleEndian, &minKeyLen); err != nil {
-		return fmt.Errorf("failed to read min key length: %w", err)
-	}
-	if minKeyLen > 0 {
-		b.Stats.MinKey = make([]byte, minKeyLen)
-		if _, err := io.ReadFull(r, b.Stats.MinKey); err != nil {
-			return fmt.Errorf("failed to read min key: %w", err)
-		}
+// DecodeHeader reads only the header and stats (including the min and max
+// keys) of a block from the given reader, leaving the reader positioned at
+// the start of the block data.
+func (b *Block) DecodeHeader(r io.Reader) error {
+	if err := b.decodeHeader(r); err != nil {
+		return fmt.Errorf("%w: %w", ErrCorrupt, err)
 	}
+	return nil
+}
 
-	// Read max key length and max key
-	var maxKeyLen uint32
-	if err := binary.Read(r, binary.LittleEndian, &maxKeyLen); err != nil {
-		return fmt.Errorf("failed to read max key length: %w", err)
-	}
-	if maxKeyLen > 0 {
-		b.Stats.MaxKey = make([]byte, maxKeyLen)
-		if _, err := io.ReadFull(r, b.Stats.MaxKey); err != nil {
-			return fmt.Errorf("failed to read max key: %w", err)
-		}
+// decode parses the block layout written by Encode
+func (b *Block) decode(r io.Reader) error {
+	if err := b.decodeHeader(r); err != nil {
+		return err
 	}
+	return b.decodeData(r)
+}
 
+// decodeData parses the block data that follows the header and stats
+func (b *Block) decodeData(r io.Reader) error {
 	// Read data
 	b.Data = make([]byte, b.Header.StoredSizeBytes)
 	_, err := io.ReadFull(r, b.Data)
@@ -287,12 +560,23 @@ func (b *Block) Decode(r io.Reader) error {
 		return fmt.Errorf("failed to read block data: %w", err)
 	}
 
+	if b.Header.Flags&FlagSplitLayout != 0 {
+		return b.decodeSplit()
+	}
+
+	// Decompress data
+	raw, err := decompressData(b.Header.CompressionType, b.Data, int(b.Header.RawSizeBytes))
+	if err != nil {
+		return fmt.Errorf("failed to decompress block data: %w", err)
+	}
+
 	// Parse key-value pairs from data
-	b.buffer = bytes.NewBuffer(b.Data)
+	b.buffer = bytes.NewBuffer(raw)
+	order := b.byteOrder()
 
 	// Read number of pairs
 	var count uint32
-	if err := binary.Read(b.buffer, binary.LittleEndian, &count); err != nil {
+	if err := binary.Read(b.buffer, order, &count); err != nil {
 		return fmt.Errorf("failed to read pair count: %w", err)
 	}
 
@@ -301,7 +585,7 @@ func (b *Block) Decode(r io.Reader) error {
 	for i := uint32(0); i < count; i++ {
 		// Read key length
 		var keyLen uint32
-		if err := binary.Read(b.buffer, binary.LittleEndian, &keyLen); err != nil {
+		if err := binary.Read(b.buffer, order, &keyLen); err != nil {
 			return fmt.Errorf("failed to read key length: %w", err)
 		}
 
@@ -313,20 +597,90 @@ func (b *Block) Decode(r io.Reader) error {
 
 		// Read value length
 		var valueLen uint32
-		if err := binary.Read(b.buffer, binary.LittleEndian, &valueLen); err != nil {
+		if err := binary.Read(b.buffer, order, &valueLen); err != nil {
 			return fmt.Errorf("failed to read value length: %w", err)
 		}
 
-		// Read value
-		value := make([]byte, valueLen)
-		if _, err := io.ReadFull(b.buffer, value); err != nil {
-			return fmt.Errorf("failed to read value: %w", err)
+		// Read value (a tombstone has no value bytes)
+		var value []byte
+		var checksum uint32
+		var deletedAt int64
+		hasChecksum := false
+		if valueLen == tombstoneLen && b.Header.Flags&FlagTombstoneTimes != 0 {
+			if err := binary.Read(b.buffer, order, &deletedAt); err != nil {
+				return fmt.Errorf("failed to read tombstone time: %w", err)
+			}
+		}
+		if valueLen != tombstoneLen {
+			value = make([]byte, valueLen)
+			if _, err := io.ReadFull(b.buffer, value); err != nil {
+				return fmt.Errorf("failed to read value: %w", err)
+			}
+
+			// Read the value checksum, verified when the value is read
+			if b.Header.Flags&FlagValueChecksums != 0 {
+				if err := binary.Read(b.buffer, order, &checksum); err != nil {
+					return fmt.Errorf("failed to read value checksum: %w", err)
+				}
+				hasChecksum = true
+			}
 		}
 
 		// Store the pair
 		b.pairs[i] = keyValuePair{
-			key:   key,
-			value: value,
+			key:         key,
+			value:       value,
+			checksum:    checksum,
+			hasChecksum: hasChecksum,
+			deletedAt:   deletedAt,
+		}
+	}
+
+	return nil
+}
+
+// decodeHeader parses the preamble, header and stats written by writeHeader
+func (b *Block) decodeHeader(r io.Reader) error {
+	order, sequence, err := readPreamble(r)
+	if err != nil {
+		return err
+	}
+	b.order, b.sequence = order, sequence
+
+	// Read header
+	if err := binary.Read(r, order, &b.Header); err != nil {
+		return fmt.Errorf("failed to read block header: %w", err)
+	}
+
+	// Read stats (only fixed-size fields)
+	if err := binary.Read(r, order, &b.Stats.Min); err != nil {
+		return fmt.Errorf("failed to read block stats min: %w", err)
+	}
+	if err := binary.Read(r, order, &b.Stats.Max); err != nil {
+		return fmt.Errorf("failed to read block stats max: %w", err)
+	}
+
+	// Read min key length and min key
+	var minKeyLen uint32
+	if err := binary.Read(r, order, &minKeyLen); err != nil {
+		return fmt.Errorf("failed to read min key length: %w", err)
+	}
+	if minKeyLen > 0 {
+		b.Stats.MinKey = make([]byte, minKeyLen)
+		if _, err := io.ReadFull(r, b.Stats.MinKey); err != nil {
+			return fmt.Errorf("failed to read min key: %w", err)
+		}
+	}
+
+	// Read max key length and max key
+	var maxKeyLen uint32
+	if err := binary.Read(r, order, &maxKeyLen); err != nil {
+		return fmt.Errorf("failed to read max key length: %w", err)
+	}
+	if maxKeyLen > 0 {
+		b.Stats.MaxKey = make([]byte, maxKeyLen)
+		if _, err := io.ReadFull(r, b.Stats.MaxKey); err != nil {
+			return fmt.Errorf("failed to read max key: %w", err)
 		}
 	}
 
@@ -335,7 +689,7 @@ func (b *Block) Decode(r io.Reader) error {
 
 // ID returns the unique identifier for the block
 func (b *Block) ID() string {
-	return hex.EncodeToString(b.Header.BlockID[:])
+	return hex.EncodeToString(b.Header.BlockID[:hashSize(b.Header.HashType)])
 }
 
 // MinKey returns the minimum key in the block
@@ -348,11 +702,41 @@ func (b *Block) MaxKey() string {
 	return string(b.Stats.MaxKey)
 }
 
+// Sequence returns the sequence number of the block: the highest sequence
+// number of the writes it holds, as set by SetSequence, or zero for blocks
+// written without one. It is stored in the preamble, outside the data the
+// block ID is computed from.
+func (b *Block) Sequence() int64 {
+	return b.sequence
+}
+
+// SetSequence sets the sequence number of the block, written by Encode
+func (b *Block) SetSequence(sequence int64) {
+	b.sequence = sequence
+}
+
 // Count returns the number of key-value pairs in the block
 func (b *Block) Count() int {
 	return len(b.pairs)
 }
 
+// Pair returns the i-th key-value pair of the block. Pairs of a decoded
+// block are in key order; a nil value is a tombstone.
+func (b *Block) Pair(i int) (key, value []byte) {
+	b.pairsMu.RLock()
+	defer b.pairsMu.RUnlock()
+	return b.pairs[i].key, b.pairs[i].value
+}
+
+// DeletedAt returns the creation time in Unix nanoseconds of the tombstone
+// of the i-th pair, or zero if the pair isn't a tombstone or the block
+// doesn't record tombstone times
+func (b *Block) DeletedAt(i int) int64 {
+	b.pairsMu.RLock()
+	defer b.pairsMu.RUnlock()
+	return b.pairs[i].deletedAt
+}
+
 // Size returns the size of the block in bytes
 func (b *Block) Size() int {
 	return int(b.Header.StoredSizeBytes)
@@ -376,3 +760,60 @@ func (b *Block) String() string {
 
 	return sb.String()
 }
+
+// compressData compresses raw block data with the given compression type.
+// It returns the bytes to store and the compression actually used, which
+// falls back to CompressionNone when compression doesn't reduce the size.
+func compressData(compression CompressionType, raw []byte) ([]byte, CompressionType, error) {
+	switch compression {
+	case CompressionNone:
+		return raw, CompressionNone, nil
+	case CompressionLZ4:
+		compressed, err := compress.NewLZ4().Compress(raw)
+		if err != nil {
+			return nil, compression, err
+		}
+		if len(compressed) >= len(raw) {
+			return raw, CompressionNone, nil
+		}
+		return compressed, CompressionLZ4, nil
+	case CompressionZstd:
+		compressed, err := compress.NewZstd().Compress(raw)
+		if err != nil {
+			return nil, compression, err
+		}
+		if len(compressed) >= len(raw) {
+			return raw, CompressionNone, nil
+		}
+		return compressed, CompressionZstd, nil
+	default:
+		return nil, compression, fmt.Errorf("unsupported compression type: %d", compression)
+	}
+}
+
+// decompressData restores raw block data of the given size from its stored bytes
+func decompressData(compression CompressionType, stored []byte, rawSize int) ([]byte, error) {
+	switch compression {
+	case CompressionNone:
+		return stored, nil
+	case CompressionLZ4:
+		return compress.NewLZ4().DecompressSize(stored, rawSize)
+	case CompressionZstd:
+		return compress.NewZstd().DecompressSize(stored, rawSize)
+	default:
+		return nil, fmt.Errorf("unsupported compression type: %d", compression)
+	}
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+// Write writes p to the underlying writer and counts the bytes written
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,416 @@
+package block
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestBlock builds a block with n pairs added in reverse key order,
+// including an empty value and a tombstone
+func newTestBlock(t *testing.T, n int) *Block {
+	b := NewBlock()
+	for i := n - 1; i >= 0; i-- {
+		key := []byte(fmt.Sprintf("key-%06d", i))
+		value := bytes.Repeat([]byte{byte(i)}, i%64)
+		if err := b.Add(key, value); err != nil {
+			t.Fatalf("Failed to add pair: %v", err)
+		}
+	}
+	if err := b.Add([]byte("empty"), []byte{}); err != nil {
+		t.Fatalf("Failed to add pair: %v", err)
+	}
+	if err := b.Add([]byte("tombstone"), nil); err != nil {
+		t.Fatalf("Failed to add pair: %v", err)
+	}
+	return b
+}
+
+func TestBlock_EncodeStreamMatchesEncode(t *testing.T) {
+	// Build two identical blocks so both encodings start from unsorted pairs
+	buffered := newTestBlock(t, 1000)
+	streamed := newTestBlock(t, 1000)
+	streamed.Header.CreatedAt = buffered.Header.CreatedAt
+
+	var bufferedOut, streamedOut bytes.Buffer
+	if err := buffered.Encode(&bufferedOut); err != nil {
+		t.Fatalf("Failed to encode block: %v", err)
+	}
+	if err := streamed.EncodeStream(&streamedOut); err != nil {
+		t.Fatalf("Failed to stream block: %v", err)
+	}
+
+	if !bytes.Equal(bufferedOut.Bytes(), streamedOut.Bytes()) {
+		t.Fatalf("Streamed output (%d bytes) differs from buffered output (%d bytes)",
+			streamedOut.Len(), bufferedOut.Len())
+	}
+	if buffered.ID() != streamed.ID() {
+		t.Errorf("Expected block ID %s, got %s", buffered.ID(), streamed.ID())
+	}
+	if streamed.DataSize() != int(streamed.Header.RawSizeBytes) {
+		t.Errorf("DataSize() = %d, header raw size = %d", streamed.DataSize(), streamed.Header.RawSizeBytes)
+	}
+	if len(streamed.Data) != 0 {
+		t.Errorf("Expected streamed block not to materialize its data")
+	}
+
+	// The streamed output decodes like any other block
+	decoded := NewBlock()
+	if err := decoded.Decode(bytes.NewReader(streamedOut.Bytes())); err != nil {
+		t.Fatalf("Failed to decode streamed block: %v", err)
+	}
+	value, err := decoded.Get([]byte("key-000042"))
+	if err != nil || !bytes.Equal(value, bytes.Repeat([]byte{42}, 42)) {
+		t.Errorf("Unexpected value for key-000042: %v (err %v)", value, err)
+	}
+	if value, err := decoded.Get([]byte("empty")); err != nil || value == nil || len(value) != 0 {
+		t.Errorf("Expected empty value, got %v (err %v)", value, err)
+	}
+	if _, err := decoded.Get([]byte("tombstone")); err != ErrKeyDeleted {
+		t.Errorf("Expected ErrKeyDeleted for tombstone, got %v", err)
+	}
+}
+
+func TestBlock_VerifyRoundTrip(t *testing.T) {
+	for _, hashType := range []HashType{HashSHA256, HashXXH64} {
+		t.Run(hashType.String(), func(t *testing.T) {
+			for _, compression := range []CompressionType{CompressionNone, CompressionLZ4, CompressionZstd} {
+				b := newTestBlock(t, 100)
+				b.Header.HashType = hashType
+				b.Header.CompressionType = compression
+
+				var out bytes.Buffer
+				if err := b.Encode(&out); err != nil {
+					t.Fatalf("Failed to encode block: %v", err)
+				}
+				if len(b.ID()) != 2*hashSize(hashType) {
+					t.Errorf("Expected a %d-byte block ID, got %s", hashSize(hashType), b.ID())
+				}
+
+				decoded := NewBlock()
+				if err := decoded.Decode(bytes.NewReader(out.Bytes())); err != nil {
+					t.Fatalf("Failed to decode block: %v", err)
+				}
+				if decoded.Header.HashType != hashType || decoded.ID() != b.ID() {
+					t.Errorf("Expected %s block ID %s, got %s block ID %s", hashType, b.ID(), decoded.Header.HashType, decoded.ID())
+				}
+				if err := decoded.Verify(); err != nil {
+					t.Errorf("Failed to verify block: %v", err)
+				}
+
+				// A changed value no longer matches the block ID
+				decoded.pairs[0].value = []byte("tampered")
+				if err := decoded.Verify(); !errors.Is(err, ErrCorrupt) {
+					t.Errorf("Expected ErrCorrupt for a tampered block, got %v", err)
+				}
+			}
+		})
+	}
+}
+
+// TestBlock_Format checks a block starts with the magic and format version
+// and round-trips, and that a file with the wrong magic or a newer version
+// is rejected
+func TestBlock_Format(t *testing.T) {
+	b := newTestBlock(t, 100)
+	var out bytes.Buffer
+	if err := b.Encode(&out); err != nil {
+		t.Fatalf("Failed to encode block: %v", err)
+	}
+	encoded := out.Bytes()
+	if !bytes.HasPrefix(encoded, []byte("RVBK")) || encoded[4] != FormatVersion {
+		t.Fatalf("Expected the magic and version %d, got %q", FormatVersion, encoded[:preambleSize])
+	}
+
+	// decode decodes a copy of data, changed by change
+	decode := func(change func(data []byte) []byte) (*Block, error) {
+		data := change(bytes.Clone(encoded))
+		decoded := NewBlock()
+		return decoded, decoded.Decode(bytes.NewReader(data))
+	}
+
+	decoded, err := decode(func(data []byte) []byte { return data })
+	if err != nil {
+		t.Fatalf("Failed to decode block: %v", err)
+	}
+	if decoded.ID() != b.ID() || decoded.Count() != b.Count() {
+		t.Errorf("Expected block %s with %d pairs, got %s with %d", b.ID(), b.Count(), decoded.ID(), decoded.Count())
+	}
+
+	rejected := []struct {
+		name     string
+		change   func(data []byte) []byte
+		expected error
+	}{
+		{"wrong magic", func(data []byte) []byte { copy(data, "XXXX"); return data }, ErrBadMagic},
+		{"no preamble", func(data []byte) []byte { return data[preambleSize:] }, ErrBadMagic},
+		{"foreign file", func([]byte) []byte { return []byte("hello, this is not a block at all") }, ErrBadMagic},
+		{"empty file", func([]byte) []byte { return nil }, ErrBadMagic},
+		{"newer version", func(data []byte) []byte { data[4] = FormatVersion + 1; return data }, ErrUnsupportedVersion},
+	}
+	for _, r := range rejected {
+		_, err := decode(r.change)
+		if !errors.Is(err, r.expected) || !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: expected %v, got %v", r.name, r.expected, err)
+		}
+	}
+}
+
+// TestBlock_BigEndian encodes blocks of both layouts tagged as big-endian,
+// as another implementation might write them, and checks they decode with
+// the same values, tombstone times and block ID, and that a block with an
+// unknown byte order is rejected
+func TestBlock_BigEndian(t *testing.T) {
+	for _, layout := range []FormatFlags{0, FlagSplitLayout} {
+		b := newTestBlock(t, 200)
+		b.Header.Flags = layout | FlagValueChecksums | FlagTombstoneTimes
+		b.order = binary.BigEndian
+		if err := b.AddTombstone([]byte("deleted"), 42); err != nil {
+			t.Fatalf("Failed to add tombstone: %v", err)
+		}
+
+		var out bytes.Buffer
+		if err := b.Encode(&out); err != nil {
+			t.Fatalf("Failed to encode block: %v", err)
+		}
+		encoded := out.Bytes()
+		if encoded[5] != byteOrderBig {
+			t.Fatalf("Expected the big-endian byte order in the preamble, got %d", encoded[5])
+		}
+		if count := binary.BigEndian.Uint32(encoded[preambleSize+4:]); count != uint32(b.Count()) {
+			t.Fatalf("Expected a big-endian pair count of %d in the header, got %d", b.Count(), count)
+		}
+
+		decoded := NewBlock()
+		if err := decoded.Decode(bytes.NewReader(encoded)); err != nil {
+			t.Fatalf("Failed to decode block: %v", err)
+		}
+		if err := decoded.Verify(); err != nil || decoded.ID() != b.ID() {
+			t.Errorf("Expected block ID %s to verify, got %s (err %v)", b.ID(), decoded.ID(), err)
+		}
+		if decoded.Count() != b.Count() {
+			t.Fatalf("Expected %d pairs, got %d", b.Count(), decoded.Count())
+		}
+		for i := 0; i < b.Count(); i++ {
+			key, value := b.Pair(i)
+			decodedKey, decodedValue := decoded.Pair(i)
+			if !bytes.Equal(key, decodedKey) || !bytes.Equal(value, decodedValue) || decoded.DeletedAt(i) != b.DeletedAt(i) {
+				t.Fatalf("Pair %d: expected %q=%q, got %q=%q", i, key, value, decodedKey, decodedValue)
+			}
+		}
+		if value, err := decoded.Get([]byte("key-000042")); err != nil || !bytes.Equal(value, bytes.Repeat([]byte{42}, 42)) {
+			t.Errorf("Unexpected value for key-000042: %v (err %v)", value, err)
+		}
+		keys, deleted, err := NewBlock().DecodeKeys(bytes.NewReader(encoded))
+		if err != nil || len(keys) != b.Count() || string(keys[0]) != "deleted" || !deleted[0] {
+			t.Errorf("Expected %d keys starting with the deleted key, got %d (err %v)", b.Count(), len(keys), err)
+		}
+
+		encoded[5] = byteOrderBig + 1
+		if err := NewBlock().Decode(bytes.NewReader(encoded)); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("Expected ErrCorrupt for an unknown byte order, got %v", err)
+		}
+	}
+}
+
+// TestBlock_Sequence round-trips the sequence number of a block in both
+// byte orders, checks it doesn't change the block ID, and raises it in place
+func TestBlock_Sequence(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		b := newTestBlock(t, 10)
+		b.order = order
+		if err := b.Finalize(); err != nil {
+			t.Fatalf("Failed to finalize block: %v", err)
+		}
+		id := b.ID()
+		b.SetSequence(1000)
+		if err := b.Finalize(); err != nil || b.ID() != id {
+			t.Fatalf("Expected the sequence number to keep block ID %s, got %s (err %v)", id, b.ID(), err)
+		}
+
+		path := filepath.Join(t.TempDir(), "block.blk")
+		var out bytes.Buffer
+		if err := b.Encode(&out); err != nil {
+			t.Fatalf("Failed to encode block: %v", err)
+		}
+		if err := os.WriteFile(path, out.Bytes(), 0644); err != nil {
+			t.Fatalf("Failed to write block file: %v", err)
+		}
+
+		// sequence decodes the block file and returns its sequence number
+		sequence := func() int64 {
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatalf("Failed to open block file: %v", err)
+			}
+			defer f.Close()
+			decoded := NewBlock()
+			if err := decoded.Decode(f); err != nil {
+				t.Fatalf("Failed to decode block: %v", err)
+			}
+			return decoded.Sequence()
+		}
+
+		if seq := sequence(); seq != 1000 {
+			t.Fatalf("Expected sequence number 1000, got %d", seq)
+		}
+		if err := RaiseSequence(path, 500); err != nil || sequence() != 1000 {
+			t.Fatalf("Expected a lower sequence number to be ignored, got %d (err %v)", sequence(), err)
+		}
+		if err := RaiseSequence(path, 2000); err != nil || sequence() != 2000 {
+			t.Fatalf("Expected the sequence number to be raised to 2000, got %d (err %v)", sequence(), err)
+		}
+	}
+}
+
+// TestBlock_SplitLayout round-trips blocks in the split layout with every
+// compression type and optional format flag, and checks their keys can be
+// decoded without the values
+func TestBlock_SplitLayout(t *testing.T) {
+	for _, compression := range []CompressionType{CompressionNone, CompressionLZ4, CompressionZstd} {
+		for _, flags := range []FormatFlags{0, FlagValueChecksums | FlagTombstoneTimes} {
+			b := newTestBlock(t, 500)
+			b.Header.CompressionType = compression
+			b.Header.Flags = flags | FlagSplitLayout
+			if err := b.AddTombstone([]byte("deleted"), 42); err != nil {
+				t.Fatalf("Failed to add tombstone: %v", err)
+			}
+
+			var out bytes.Buffer
+			if err := b.Encode(&out); err != nil {
+				t.Fatalf("Failed to encode block: %v", err)
+			}
+			if b.DataSize() != int(b.Header.RawSizeBytes) {
+				t.Errorf("DataSize() = %d, header raw size = %d", b.DataSize(), b.Header.RawSizeBytes)
+			}
+
+			decoded := NewBlock()
+			if err := decoded.Decode(bytes.NewReader(out.Bytes())); err != nil {
+				t.Fatalf("Failed to decode block: %v", err)
+			}
+			if err := decoded.Verify(); err != nil || decoded.ID() != b.ID() {
+				t.Errorf("Expected block ID %s to verify, got %s (err %v)", b.ID(), decoded.ID(), err)
+			}
+			if decoded.Count() != b.Count() {
+				t.Fatalf("Expected %d pairs, got %d", b.Count(), decoded.Count())
+			}
+			for i := 0; i < b.Count(); i++ {
+				key, value := b.Pair(i)
+				decodedKey, decodedValue := decoded.Pair(i)
+				if !bytes.Equal(key, decodedKey) || !bytes.Equal(value, decodedValue) || (value == nil) != (decodedValue == nil) {
+					t.Fatalf("Pair %d: expected %q=%q, got %q=%q", i, key, value, decodedKey, decodedValue)
+				}
+			}
+			if value, err := decoded.Get([]byte("key-000042")); err != nil || !bytes.Equal(value, bytes.Repeat([]byte{42}, 42)) {
+				t.Errorf("Unexpected value for key-000042: %v (err %v)", value, err)
+			}
+			if value, err := decoded.Get([]byte("empty")); err != nil || value == nil || len(value) != 0 {
+				t.Errorf("Expected empty value, got %v (err %v)", value, err)
+			}
+			if _, err := decoded.Get([]byte("tombstone")); err != ErrKeyDeleted {
+				t.Errorf("Expected ErrKeyDeleted for tombstone, got %v", err)
+			}
+			if flags&FlagTombstoneTimes != 0 && decoded.DeletedAt(0) != 42 {
+				t.Errorf("Expected the tombstone time to round-trip, got %d", decoded.DeletedAt(0))
+			}
+
+			// A corrupt value fails its checksum, other keys still read
+			if flags&FlagValueChecksums != 0 {
+				decoded.pairs[1].value = []byte("tampered")
+				if _, err := decoded.Get(decoded.pairs[1].key); !errors.Is(err, ErrCorrupt) {
+					t.Errorf("Expected ErrCorrupt for a tampered value, got %v", err)
+				}
+			}
+
+			keys, deleted, err := NewBlock().DecodeKeys(bytes.NewReader(out.Bytes()))
+			if err != nil || len(keys) != b.Count() {
+				t.Fatalf("Expected %d keys, got %d (err %v)", b.Count(), len(keys), err)
+			}
+			for i, key := range keys {
+				expected, value := b.Pair(i)
+				if !bytes.Equal(key, expected) || deleted[i] != (value == nil) {
+					t.Errorf("Key %d: expected %q (deleted %v), got %q (deleted %v)", i, expected, value == nil, key, deleted[i])
+				}
+			}
+
+			// The keys decode without the values region
+			if compression == CompressionNone {
+				valuesSize := binary.LittleEndian.Uint32(b.Data[4+9+5:])
+				truncated := out.Bytes()[:out.Len()-int(valuesSize)]
+				if keys, _, err := NewBlock().DecodeKeys(bytes.NewReader(truncated)); err != nil || len(keys) != b.Count() {
+					t.Errorf("Expected the keys without the values region, got %d (err %v)", len(keys), err)
+				}
+			}
+		}
+	}
+
+	// Streamed split blocks are identical to buffered ones
+	buffered, streamed := newTestBlock(t, 1000), newTestBlock(t, 1000)
+	streamed.Header.CreatedAt = buffered.Header.CreatedAt
+	buffered.Header.Flags, streamed.Header.Flags = FlagSplitLayout, FlagSplitLayout
+	var bufferedOut, streamedOut bytes.Buffer
+	if err := buffered.Encode(&bufferedOut); err != nil {
+		t.Fatalf("Failed to encode block: %v", err)
+	}
+	if err := streamed.EncodeStream(&streamedOut); err != nil {
+		t.Fatalf("Failed to stream block: %v", err)
+	}
+	if !bytes.Equal(bufferedOut.Bytes(), streamedOut.Bytes()) {
+		t.Errorf("Streamed output (%d bytes) differs from buffered output (%d bytes)", streamedOut.Len(), bufferedOut.Len())
+	}
+}
+
+// TestBlock_SplitLayoutCompression checks structured data compresses
+// better in the split layout than in interleaved pairs
+func TestBlock_SplitLayoutCompression(t *testing.T) {
+	stored := make(map[FormatFlags]int)
+	for _, flags := range []FormatFlags{0, FlagSplitLayout} {
+		b := NewBlock()
+		b.Header.CompressionType = CompressionLZ4
+		b.Header.Flags = flags | FlagValueChecksums
+		for i := 0; i < 2000; i++ {
+			key := fmt.Sprintf("user:%08d", i*7919%100000)
+			value := fmt.Sprintf(`{"id":%d,"score":%d,"active":%t}`, i, i*i%1000, i%3 == 0)
+			if err := b.Add([]byte(key), []byte(value)); err != nil {
+				t.Fatalf("Failed to add pair: %v", err)
+			}
+		}
+		if err := b.Finalize(); err != nil {
+			t.Fatalf("Failed to finalize block: %v", err)
+		}
+		if b.Header.CompressionType != CompressionLZ4 {
+			t.Fatalf("Expected the block to compress, flags %b", flags)
+		}
+		stored[flags] = b.Size()
+	}
+
+	t.Logf("Interleaved: %d bytes, split: %d bytes", stored[0], stored[FlagSplitLayout])
+	if stored[FlagSplitLayout] >= stored[0] {
+		t.Errorf("Expected the split layout to compress better, got %d bytes against %d interleaved",
+			stored[FlagSplitLayout], stored[0])
+	}
+}
+
+func BenchmarkBlock_Finalize(b *testing.B) {
+	for _, hashType := range []HashType{HashSHA256, HashXXH64} {
+		b.Run(hashType.String(), func(b *testing.B) {
+			block := NewBlock()
+			block.Header.HashType = hashType
+			for i := 0; i < 10000; i++ {
+				block.Add([]byte(fmt.Sprintf("key-%06d", i)), bytes.Repeat([]byte{byte(i)}, 100))
+			}
+			b.SetBytes(int64(block.DataSize()))
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if err := block.Finalize(); err != nil {
+					b.Fatalf("Failed to finalize block: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package block
+
+import "hash/crc32"
+
+// FormatFlags records optional features of the block data format in the header
+type FormatFlags uint8
+
+const (
+	// FlagValueChecksums stores a CRC32C of each value after it, so a
+	// corrupt value is detected when it is read
+	FlagValueChecksums FormatFlags = 1 << iota
+
+	// FlagTombstoneTimes stores the time each tombstone was created after
+	// it, so compaction can keep tombstones for a grace period
+	FlagTombstoneTimes
+
+	// FlagValueStats records that Stats.Min and Stats.Max were computed
+	// from the values of the block by the writer, so scans can skip blocks
+	// whose values can't match. Min > Max when no value was numeric.
+	FlagValueStats
+
+	// FlagSplitLayout stores the keys of the block, then its values, in two
+	// regions compressed independently, rather than interleaved pairs. It
+	// usually compresses better and lets DecodeKeys skip the values.
+	FlagSplitLayout
+)
+
+// castagnoliTable is the CRC32C table used for value checksums
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ValueChecksum returns the CRC32C of a value, as stored with FlagValueChecksums
+func ValueChecksum(value []byte) uint32 {
+	return crc32.Checksum(value, castagnoliTable)
+}
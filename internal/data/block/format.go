@@ -0,0 +1,116 @@
+package block
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Errors returned, wrapped in ErrCorrupt, when a block file can't be read
+var (
+	// ErrBadMagic is returned when a file doesn't start with the block
+	// magic, such as a file that is not a block or a block written before
+	// blocks had a preamble
+	ErrBadMagic = errors.New("not a block file: bad magic")
+
+	// ErrUnsupportedVersion is returned for a block of a newer format
+	ErrUnsupportedVersion = errors.New("unsupported block format version")
+)
+
+// blockMagic starts every block file
+var blockMagic = []byte("RVBK")
+
+// FormatVersion is the format version of the blocks written and read
+const FormatVersion = 1
+
+// preambleSize is the size of the preamble that precedes the header:
+// - 4 bytes:  Magic
+// - 1 byte:   Format version
+// - 1 byte:   Byte order of the header and data
+// - 2 bytes:  Reserved for future header growth (zero)
+// - 8 bytes:  Sequence number (see Block.Sequence)
+const preambleSize = 16
+
+// Byte orders recorded in the preamble. Blocks are written little-endian;
+// blocks written before the byte order was recorded have a zero byte, so
+// they read as little-endian.
+const (
+	byteOrderLittle byte = iota
+	byteOrderBig
+)
+
+// writePreamble writes the magic, format version, byte order and sequence
+// number
+func writePreamble(w io.Writer, order binary.ByteOrder, sequence int64) error {
+	preamble := make([]byte, preambleSize)
+	copy(preamble, blockMagic)
+	preamble[len(blockMagic)] = FormatVersion
+	if order == binary.BigEndian {
+		preamble[len(blockMagic)+1] = byteOrderBig
+	}
+	order.PutUint64(preamble[8:], uint64(sequence))
+	if _, err := w.Write(preamble); err != nil {
+		return fmt.Errorf("failed to write block preamble: %w", err)
+	}
+	return nil
+}
+
+// readPreamble reads the preamble, checks the magic and format version,
+// and returns the byte order and sequence number of the block
+func readPreamble(r io.Reader) (binary.ByteOrder, int64, error) {
+	preamble := make([]byte, preambleSize)
+	n, err := io.ReadFull(r, preamble)
+	if n < len(blockMagic) || !bytes.Equal(preamble[:len(blockMagic)], blockMagic) {
+		return nil, 0, ErrBadMagic
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read block preamble: %w", err)
+	}
+
+	if version := preamble[len(blockMagic)]; version != FormatVersion {
+		return nil, 0, fmt.Errorf("%w %d (supported: %d)", ErrUnsupportedVersion, version, FormatVersion)
+	}
+	var order binary.ByteOrder
+	switch preamble[len(blockMagic)+1] {
+	case byteOrderLittle:
+		order = binary.LittleEndian
+	case byteOrderBig:
+		order = binary.BigEndian
+	default:
+		return nil, 0, fmt.Errorf("unknown block byte order %d", preamble[len(blockMagic)+1])
+	}
+	return order, int64(order.Uint64(preamble[8:])), nil
+}
+
+// RaiseSequence sets the sequence number in the preamble of the block file
+// at path to sequence, in place, unless it is already at least as high. The
+// preamble is outside the data the block ID is computed from, so the block
+// keeps its ID, and hard links to the file share the raised sequence number.
+func RaiseSequence(path string, sequence int64) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open block file: %w", err)
+	}
+	defer f.Close()
+
+	order, current, err := readPreamble(f)
+	if err != nil {
+		return err
+	}
+	if current >= sequence {
+		return nil
+	}
+
+	buf := make([]byte, 8)
+	order.PutUint64(buf, uint64(sequence))
+	if _, err := f.WriteAt(buf, 8); err != nil {
+		return fmt.Errorf("failed to write block sequence: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync block file: %w", err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,54 @@
+package block
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// HashType defines the hash function used to compute block IDs.
+type HashType uint8
+
+const (
+	// HashSHA256 is a cryptographic hash, safe against deliberate collisions
+	HashSHA256 HashType = iota
+
+	// HashXXH64 is a much faster 64-bit non-cryptographic hash
+	HashXXH64
+)
+
+// newHasher returns a hash function of the given type
+func newHasher(hashType HashType) (hash.Hash, error) {
+	switch hashType {
+	case HashSHA256:
+		return sha256.New(), nil
+	case HashXXH64:
+		return xxhash.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported hash type: %d", hashType)
+	}
+}
+
+// hashSize returns the number of bytes of BlockID used by the given hash type
+func hashSize(hashType HashType) int {
+	switch hashType {
+	case HashXXH64:
+		return 8
+	default:
+		return sha256.Size
+	}
+}
+
+// String returns the name of the hash type
+func (h HashType) String() string {
+	switch h {
+	case HashSHA256:
+		return "sha256"
+	case HashXXH64:
+		return "xxh64"
+	default:
+		return fmt.Sprintf("HashType(%d)", uint8(h))
+	}
+}
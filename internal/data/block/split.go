@@ -0,0 +1,473 @@
+package block
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// The split layout, used with FlagSplitLayout, stores the keys of a block
+// and its values in two regions instead of interleaving them, so each
+// region holds similar data and compresses better, and the keys can be read
+// without the values.
+//
+// Keys region:
+// - For each pair, in key order: the length of the prefix the key shares
+//   with the previous key and the length of the rest (uvarints), then the
+//   rest of the key. Sorted keys share long prefixes, so most of each key
+//   isn't stored.
+// - Value index, for each pair: 4 bytes value length (tombstoneLen for
+//   deleted keys). Values are stored one after the other, so the offset of
+//   each is the sum of the lengths before it; the lengths compress much
+//   better than ever-growing offsets.
+//
+// Values region:
+// - Each value, in key order
+// - For each pair: 4 bytes CRC32C of the value with FlagValueChecksums, or
+//   8 bytes creation time of a tombstone with FlagTombstoneTimes. Keeping
+//   them apart from the values leaves similar values next to each other.
+//
+// The block ID is the hash of the regions uncompressed, preceded by the
+// pair count and the sizes of the keys and values regions (4 bytes each).
+// The stored data starts with the pair count, then for each region its
+// compression type (1 byte), raw size and stored size (4 bytes each),
+// followed by the stored keys and values regions.
+
+// splitIndexEntrySize is the size of a value's entry in the value index
+const splitIndexEntrySize = 4
+
+// splitRawHeaderSize is the size of the pair count and region sizes that
+// precede the regions in the hashed data
+const splitRawHeaderSize = 12
+
+// splitStoredHeaderSize is the size of the pair count and region headers
+// that precede the regions in the stored data
+const splitStoredHeaderSize = 4 + 2*9
+
+// splitRegion is a region of the stored data of a split block
+type splitRegion struct {
+	compression     CompressionType
+	rawSize, stored uint32
+	data            []byte
+}
+
+// splitSizes returns the sizes of the keys and values regions. Callers must
+// hold pairsMu.
+func (b *Block) splitSizes() (keys, values int) {
+	var previous []byte
+	for _, pair := range b.pairs {
+		shared := sharedPrefixLen(previous, pair.key)
+		suffix := len(pair.key) - shared
+		keys += uvarintLen(shared) + uvarintLen(suffix) + suffix + splitIndexEntrySize
+		values += len(pair.value) + b.trailerSize(pair)
+		previous = pair.key
+	}
+	return keys, values
+}
+
+// sharedPrefixLen returns the length of the common prefix of a and b
+func sharedPrefixLen(a, b []byte) int {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+// uvarintLen returns the size of n encoded as a uvarint
+func uvarintLen(n int) int {
+	size := 1
+	for ; n >= 0x80; n >>= 7 {
+		size++
+	}
+	return size
+}
+
+// trailerSize returns the size of the checksum or tombstone time stored
+// for a pair after the values
+func (b *Block) trailerSize(pair keyValuePair) int {
+	size := 0
+	if b.Header.Flags&FlagValueChecksums != 0 && pair.value != nil {
+		size += 4 // Value checksum
+	}
+	if b.Header.Flags&FlagTombstoneTimes != 0 && pair.value == nil {
+		size += 8 // Tombstone time
+	}
+	return size
+}
+
+// writeKeysRegion writes the keys region. Callers must hold pairsMu.
+func (b *Block) writeKeysRegion(w io.Writer) error {
+	order := b.byteOrder()
+	var previous []byte
+	lengths := make([]byte, 2*binary.MaxVarintLen64)
+	for _, pair := range b.pairs {
+		shared := sharedPrefixLen(previous, pair.key)
+		n := binary.PutUvarint(lengths, uint64(shared))
+		n += binary.PutUvarint(lengths[n:], uint64(len(pair.key)-shared))
+		if _, err := w.Write(lengths[:n]); err != nil {
+			return fmt.Errorf("failed to write key length: %w", err)
+		}
+		if _, err := w.Write(pair.key[shared:]); err != nil {
+			return fmt.Errorf("failed to write key: %w", err)
+		}
+		previous = pair.key
+	}
+
+	// Write the value index
+	for _, pair := range b.pairs {
+		valueLen := uint32(len(pair.value))
+		if pair.value == nil {
+			valueLen = tombstoneLen
+		}
+		if err := binary.Write(w, order, valueLen); err != nil {
+			return fmt.Errorf("failed to write value length: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// writeValuesRegion writes the values region. Callers must hold pairsMu.
+func (b *Block) writeValuesRegion(w io.Writer) error {
+	order := b.byteOrder()
+	for _, pair := range b.pairs {
+		if _, err := w.Write(pair.value); err != nil {
+			return fmt.Errorf("failed to write value: %w", err)
+		}
+	}
+
+	// Write the value checksums and tombstone times
+	for _, pair := range b.pairs {
+		if b.Header.Flags&FlagValueChecksums != 0 && pair.value != nil {
+			if err := binary.Write(w, order, ValueChecksum(pair.value)); err != nil {
+				return fmt.Errorf("failed to write value checksum: %w", err)
+			}
+		}
+		if b.Header.Flags&FlagTombstoneTimes != 0 && pair.value == nil {
+			if err := binary.Write(w, order, pair.deletedAt); err != nil {
+				return fmt.Errorf("failed to write tombstone time: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// writeSplit writes the pair count, region sizes and uncompressed regions,
+// as hashed for the block ID. Callers must hold pairsMu.
+func (b *Block) writeSplit(w io.Writer) error {
+	order := b.byteOrder()
+	keys, values := b.splitSizes()
+	for _, n := range []int{len(b.pairs), keys, values} {
+		if err := binary.Write(w, order, uint32(n)); err != nil {
+			return fmt.Errorf("failed to write split layout header: %w", err)
+		}
+	}
+	if err := b.writeKeysRegion(w); err != nil {
+		return err
+	}
+	return b.writeValuesRegion(w)
+}
+
+// finalizeSplit serializes the pairs in the split layout, compressing each
+// region on its own. Callers must hold pairsMu and have sorted the pairs.
+func (b *Block) finalizeSplit() error {
+	var keys, values bytes.Buffer
+	if err := b.writeKeysRegion(&keys); err != nil {
+		return err
+	}
+	if err := b.writeValuesRegion(&values); err != nil {
+		return err
+	}
+
+	// Calculate block ID (hash of the uncompressed regions)
+	hasher, err := newHasher(b.Header.HashType)
+	if err != nil {
+		return err
+	}
+	if err := b.writeSplit(hasher); err != nil {
+		return err
+	}
+	b.Header.BlockID = [32]byte{}
+	copy(b.Header.BlockID[:], hasher.Sum(nil))
+
+	// Compress each region with the block's compression type
+	regions := make([]splitRegion, 2)
+	compression := CompressionNone
+	for i, raw := range [][]byte{keys.Bytes(), values.Bytes()} {
+		stored, used, err := compressData(b.Header.CompressionType, raw)
+		if err != nil {
+			return fmt.Errorf("failed to compress block data: %w", err)
+		}
+		if used != CompressionNone {
+			compression = used
+		}
+		regions[i] = splitRegion{compression: used, rawSize: uint32(len(raw)), stored: uint32(len(stored)), data: stored}
+	}
+
+	// Write the stored data
+	data := bytes.NewBuffer(make([]byte, 0, splitStoredHeaderSize+len(regions[0].data)+len(regions[1].data)))
+	if err := writeSplitHeader(data, b.byteOrder(), len(b.pairs), regions); err != nil {
+		return err
+	}
+	for _, region := range regions {
+		data.Write(region.data)
+	}
+
+	b.Header.CompressionType = compression
+	b.Header.Count = uint32(len(b.pairs))
+	b.Header.RawSizeBytes = uint32(splitRawHeaderSize + keys.Len() + values.Len())
+	b.Header.StoredSizeBytes = uint32(data.Len())
+	b.Data = data.Bytes()
+
+	return nil
+}
+
+// writeSplitStream writes the stored data of an uncompressed split block
+// directly to w. Callers must hold pairsMu.
+func (b *Block) writeSplitStream(w io.Writer) error {
+	keys, values := b.splitSizes()
+	regions := []splitRegion{
+		{rawSize: uint32(keys), stored: uint32(keys)},
+		{rawSize: uint32(values), stored: uint32(values)},
+	}
+	if err := writeSplitHeader(w, b.byteOrder(), len(b.pairs), regions); err != nil {
+		return err
+	}
+	if err := b.writeKeysRegion(w); err != nil {
+		return err
+	}
+	return b.writeValuesRegion(w)
+}
+
+// writeSplitHeader writes the pair count and region headers of the stored data
+func writeSplitHeader(w io.Writer, order binary.ByteOrder, count int, regions []splitRegion) error {
+	header := make([]byte, splitStoredHeaderSize)
+	order.PutUint32(header, uint32(count))
+	for i, region := range regions {
+		at := 4 + 9*i
+		header[at] = byte(region.compression)
+		order.PutUint32(header[at+1:], region.rawSize)
+		order.PutUint32(header[at+5:], region.stored)
+	}
+	if _, err := w.Write(header); err != nil {
+		return fmt.Errorf("failed to write split layout header: %w", err)
+	}
+	return nil
+}
+
+// readSplitRegions parses the header of the stored data of a split block
+// and returns its pair count and regions, still compressed
+func readSplitRegions(data []byte, order binary.ByteOrder) (int, []splitRegion, error) {
+	if len(data) < splitStoredHeaderSize {
+		return 0, nil, fmt.Errorf("split layout header truncated")
+	}
+	count := int(order.Uint32(data))
+	regions := make([]splitRegion, 2)
+	offset := splitStoredHeaderSize
+	for i := range regions {
+		at := 4 + 9*i
+		region := splitRegion{
+			compression: CompressionType(data[at]),
+			rawSize:     order.Uint32(data[at+1:]),
+			stored:      order.Uint32(data[at+5:]),
+		}
+		if uint64(offset)+uint64(region.stored) > uint64(len(data)) {
+			return 0, nil, fmt.Errorf("split layout region %d truncated", i)
+		}
+		region.data = data[offset : offset+int(region.stored)]
+		offset += int(region.stored)
+		regions[i] = region
+	}
+	return count, regions, nil
+}
+
+// decompress returns the raw bytes of the region
+func (r splitRegion) decompress() ([]byte, error) {
+	raw, err := decompressData(r.compression, r.data, int(r.rawSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress block data: %w", err)
+	}
+	if len(raw) != int(r.rawSize) {
+		return nil, fmt.Errorf("region is %d bytes, expected %d", len(raw), r.rawSize)
+	}
+	return raw, nil
+}
+
+// parseKeysRegion parses the keys and value index of a keys region into
+// pairs without values, returning the length of each value
+func parseKeysRegion(raw []byte, count int, order binary.ByteOrder) ([]keyValuePair, []uint32, error) {
+	if uint64(count)*(2+splitIndexEntrySize) > uint64(len(raw)) {
+		return nil, nil, fmt.Errorf("keys region too small for %d pairs", count)
+	}
+
+	pairs := make([]keyValuePair, count)
+	offset := 0
+	var previous []byte
+	for i := range pairs {
+		shared, n := binary.Uvarint(raw[offset:])
+		if n <= 0 {
+			return nil, nil, fmt.Errorf("failed to read shared key prefix length")
+		}
+		offset += n
+		suffix, n := binary.Uvarint(raw[offset:])
+		if n <= 0 {
+			return nil, nil, fmt.Errorf("failed to read key length")
+		}
+		offset += n
+		if shared > uint64(len(previous)) || suffix > uint64(len(raw)-offset) {
+			return nil, nil, fmt.Errorf("failed to read key: %w", io.ErrUnexpectedEOF)
+		}
+
+		key := make([]byte, int(shared)+int(suffix))
+		copy(key, previous[:shared])
+		copy(key[shared:], raw[offset:offset+int(suffix)])
+		offset += int(suffix)
+		pairs[i].key = key
+		previous = key
+	}
+
+	if len(raw)-offset != count*splitIndexEntrySize {
+		return nil, nil, fmt.Errorf("value index is %d bytes, expected %d", len(raw)-offset, count*splitIndexEntrySize)
+	}
+	valueLens := make([]uint32, count)
+	for i := range valueLens {
+		valueLens[i] = order.Uint32(raw[offset:])
+		offset += splitIndexEntrySize
+	}
+
+	return pairs, valueLens, nil
+}
+
+// decodeSplit parses the stored data of a split block into its pairs
+func (b *Block) decodeSplit() error {
+	order := b.byteOrder()
+	count, regions, err := readSplitRegions(b.Data, order)
+	if err != nil {
+		return err
+	}
+	keys, err := regions[0].decompress()
+	if err != nil {
+		return err
+	}
+	values, err := regions[1].decompress()
+	if err != nil {
+		return err
+	}
+	pairs, valueLens, err := parseKeysRegion(keys, count, order)
+	if err != nil {
+		return err
+	}
+
+	// Values are stored one after the other, followed by the trailers
+	offset := uint64(0)
+	for i := range pairs {
+		if valueLens[i] == tombstoneLen {
+			continue
+		}
+		end := offset + uint64(valueLens[i])
+		if end > uint64(len(values)) {
+			return fmt.Errorf("failed to read value: %w", io.ErrUnexpectedEOF)
+		}
+		pairs[i].value = values[offset:end:end]
+		if pairs[i].value == nil {
+			pairs[i].value = []byte{} // An empty value of an empty region
+		}
+		offset = end
+	}
+	for i := range pairs {
+		pair := &pairs[i]
+		switch {
+		case pair.value == nil && b.Header.Flags&FlagTombstoneTimes != 0:
+			if offset+8 > uint64(len(values)) {
+				return fmt.Errorf("failed to read tombstone time: %w", io.ErrUnexpectedEOF)
+			}
+			pair.deletedAt = int64(order.Uint64(values[offset:]))
+			offset += 8
+		case pair.value != nil && b.Header.Flags&FlagValueChecksums != 0:
+			// Read the value checksum, verified when the value is read
+			if offset+4 > uint64(len(values)) {
+				return fmt.Errorf("failed to read value checksum: %w", io.ErrUnexpectedEOF)
+			}
+			pair.checksum = order.Uint32(values[offset:])
+			pair.hasChecksum = true
+			offset += 4
+		}
+	}
+	if offset != uint64(len(values)) {
+		return fmt.Errorf("values region is %d bytes, expected %d", len(values), offset)
+	}
+
+	b.pairs = pairs
+	return nil
+}
+
+// DecodeKeys reads the header and stats of a block from the given reader
+// and returns its keys in order, with whether each is a tombstone. The
+// values region of a block with FlagSplitLayout is neither decompressed
+// nor parsed; other blocks are decoded in full. Failures are reported as
+// ErrCorrupt, like Decode.
+func (b *Block) DecodeKeys(r io.Reader) (keys [][]byte, deleted []bool, err error) {
+	if err := b.decodeHeader(r); err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrCorrupt, err)
+	}
+	if b.Header.Flags&FlagSplitLayout == 0 {
+		if err := b.decodeData(r); err != nil {
+			return nil, nil, fmt.Errorf("%w: %w", ErrCorrupt, err)
+		}
+		keys = make([][]byte, len(b.pairs))
+		deleted = make([]bool, len(b.pairs))
+		for i, pair := range b.pairs {
+			keys[i], deleted[i] = pair.key, pair.value == nil
+		}
+		return keys, deleted, nil
+	}
+
+	keys, deleted, err = b.decodeSplitKeys(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrCorrupt, err)
+	}
+	return keys, deleted, nil
+}
+
+// decodeSplitKeys reads the stored data of a split block up to the end of
+// its keys region and parses the keys
+func (b *Block) decodeSplitKeys(r io.Reader) ([][]byte, []bool, error) {
+	order := b.byteOrder()
+	header := make([]byte, splitStoredHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, fmt.Errorf("failed to read split layout header: %w", err)
+	}
+	count := int(order.Uint32(header))
+	region := splitRegion{
+		compression: CompressionType(header[4]),
+		rawSize:     order.Uint32(header[5:]),
+		stored:      order.Uint32(header[9:]),
+	}
+	if uint64(splitStoredHeaderSize)+uint64(region.stored) > uint64(b.Header.StoredSizeBytes) {
+		return nil, nil, fmt.Errorf("split layout region 0 truncated")
+	}
+	region.data = make([]byte, region.stored)
+	if _, err := io.ReadFull(r, region.data); err != nil {
+		return nil, nil, fmt.Errorf("failed to read keys region: %w", err)
+	}
+
+	raw, err := region.decompress()
+	if err != nil {
+		return nil, nil, err
+	}
+	pairs, valueLens, err := parseKeysRegion(raw, count, order)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keys := make([][]byte, count)
+	deleted := make([]bool, count)
+	for i, pair := range pairs {
+		keys[i], deleted[i] = pair.key, valueLens[i] == tombstoneLen
+	}
+	return keys, deleted, nil
+}
@@ -1,6 +1,8 @@
 package compress
 
 import (
+	"fmt"
+
 	"github.com/pierrec/lz4/v4"
 )
 
@@ -49,3 +51,17 @@ func (c *LZ4) Decompress(src []byte) ([]byte, error) {
 	}
 	return dst[:n], nil
 }
+
+// DecompressSize decompresses the source byte slice using LZ4, when the size
+// of the original data is known (e.g., recorded in a block header).
+func (c *LZ4) DecompressSize(src []byte, size int) ([]byte, error) {
+	dst := make([]byte, size)
+	n, err := lz4.UncompressBlock(src, dst)
+	if err != nil {
+		return nil, err
+	}
+	if n != size {
+		return nil, fmt.Errorf("decompressed %d bytes, expected %d", n, size)
+	}
+	return dst, nil
+}
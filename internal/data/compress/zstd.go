@@ -0,0 +1,74 @@
+package compress
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	// Encoder and decoder shared by all Zstd compressors; both are safe for
+	// concurrent use and expensive to create
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+// Zstd implements the Compressor interface using the Zstandard algorithm,
+// which compresses better than LZ4 but more slowly.
+type Zstd struct{}
+
+// NewZstd creates a new Zstd compressor.
+func NewZstd() *Zstd {
+	return &Zstd{}
+}
+
+// codecs returns the shared encoder and decoder, creating them on first use
+func (c *Zstd) codecs() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+	})
+	return zstdEncoder, zstdDecoder, zstdErr
+}
+
+// Compress compresses the source byte slice using Zstd.
+func (c *Zstd) Compress(src []byte) ([]byte, error) {
+	encoder, _, err := c.codecs()
+	if err != nil {
+		return nil, err
+	}
+	return encoder.EncodeAll(src, nil), nil
+}
+
+// Decompress decompresses the source byte slice using Zstd. Zstd frames
+// record the size of the original data, so it doesn't need to be known.
+func (c *Zstd) Decompress(src []byte) ([]byte, error) {
+	_, decoder, err := c.codecs()
+	if err != nil {
+		return nil, err
+	}
+	return decoder.DecodeAll(src, nil)
+}
+
+// DecompressSize decompresses the source byte slice using Zstd, when the
+// size of the original data is known (e.g., recorded in a block header).
+func (c *Zstd) DecompressSize(src []byte, size int) ([]byte, error) {
+	_, decoder, err := c.codecs()
+	if err != nil {
+		return nil, err
+	}
+	dst, err := decoder.DecodeAll(src, make([]byte, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	if len(dst) != size {
+		return nil, fmt.Errorf("decompressed %d bytes, expected %d", len(dst), size)
+	}
+	return dst, nil
+}
@@ -0,0 +1,55 @@
+package storage
+
+import "sync/atomic"
+
+// Slabs of a value arena start at minSlabSize bytes and double up to
+// maxSlabSize, so a small memory table doesn't reserve large slabs. Values
+// larger than maxArenaValue are allocated on their own.
+const (
+	minSlabSize   = 4 * 1024
+	maxSlabSize   = 1024 * 1024
+	maxArenaValue = maxSlabSize / 4
+)
+
+// valueArena copies the values of a memory table shard into large slabs,
+// so a table holding millions of small values allocates a few slabs rather
+// than a slice per value, leaving the garbage collector fewer objects to
+// track. The slabs are released with the memory table once it is flushed;
+// values overwritten meanwhile stay in their slab until then.
+type valueArena struct {
+	// Slab being filled
+	slab []byte
+
+	// Bytes copied into the arena, overwritten values included, readable
+	// without the shard lock
+	size atomic.Int64
+}
+
+// copy returns a copy of value backed by the arena. A nil value (a
+// tombstone) stays nil. Callers must hold the lock of the arena's shard.
+func (a *valueArena) copy(value []byte) []byte {
+	if value == nil {
+		return nil
+	}
+	if len(value) == 0 {
+		return []byte{}
+	}
+	a.size.Add(int64(len(value)))
+	if len(value) > maxArenaValue {
+		return append([]byte(nil), value...)
+	}
+
+	// Start a new slab once the current one is full
+	if len(a.slab)+len(value) > cap(a.slab) {
+		size := max(minSlabSize, min(2*cap(a.slab), maxSlabSize))
+		for size < len(value) {
+			size *= 2
+		}
+		a.slab = make([]byte, 0, size)
+	}
+
+	// Cap the copy, so appending to it can't overwrite the next value
+	start := len(a.slab)
+	a.slab = append(a.slab, value...)
+	return a.slab[start:len(a.slab):len(a.slab)]
+}
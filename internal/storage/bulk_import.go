@@ -0,0 +1,323 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/0xReLogic/river/internal/data/block"
+)
+
+// importDirPrefix starts the name of the data subdirectory a bulk import
+// stages its blocks in until it is committed
+const importDirPrefix = "import-"
+
+// BulkWriter writes the pairs of a bulk import (see Engine.BulkImport)
+type BulkWriter interface {
+	// Put stores a key-value pair like Engine.Put. A key written twice
+	// keeps its last value.
+	Put(key, value []byte) error
+}
+
+// bulkWriter is the BulkWriter of an import. It buffers pairs outside the
+// memory table and writes them as sorted blocks to the staging directory
+// once they reach the maximum memory table size, without syncing them.
+type bulkWriter struct {
+	// Engine importing the pairs
+	engine *Engine
+
+	// Staging directory of the import
+	dir string
+
+	// Pairs buffered since the last blocks were staged
+	pairs map[string][]byte
+
+	// Size of the buffered keys and values
+	size int64
+
+	// Terms of the imported pairs in the secondary indexes
+	terms importTerms
+}
+
+// Put implements BulkWriter
+func (w *bulkWriter) Put(key, value []byte) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	// Copy the value, which the caller may reuse; a nil value would be a
+	// tombstone
+	copied := make([]byte, len(value))
+	copy(copied, value)
+
+	stored, err := w.engine.values.store(copied)
+	if err != nil {
+		return fmt.Errorf("failed to write to value log: %w", err)
+	}
+
+	if old, ok := w.pairs[string(key)]; ok {
+		w.size -= int64(len(key) + len(old))
+	}
+	w.pairs[string(key)] = stored
+	w.size += int64(len(key) + len(stored))
+	w.engine.indexes.addImport(w.terms, key, copied)
+
+	if w.size >= w.engine.maxMemTableSize {
+		return w.stage()
+	}
+	return nil
+}
+
+// stage writes the buffered pairs as blocks to the staging directory. The
+// blocks of later calls are newer, so a key written again overrides the
+// value staged before.
+func (w *bulkWriter) stage() error {
+	if len(w.pairs) == 0 {
+		return nil
+	}
+
+	keys := make([][]byte, 0, len(w.pairs))
+	for key := range w.pairs {
+		keys = append(keys, []byte(key))
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return string(keys[i]) < string(keys[j])
+	})
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i] = w.pairs[string(key)]
+	}
+
+	// The imported pairs are numbered after the writes logged so far. An
+	// import holds no tombstones.
+	err := w.engine.writeBlocks(keys, values, nil, w.engine.wal.reserveTimestamp(), func(b *block.Block) error {
+		return stageBlock(w.dir, b)
+	})
+	if err != nil {
+		return err
+	}
+
+	w.pairs = make(map[string][]byte)
+	w.size = 0
+	return nil
+}
+
+// BulkImport writes the pairs fn passes to its BulkWriter straight into new
+// level 0 blocks, bypassing the WAL and the memory table. The blocks are
+// written to a staging directory without being synced, then committed by a
+// single barrier once fn returns: every block file is synced, a marker is
+// appended to the WAL, and the blocks are moved into level 0. An import
+// that fails, or that a crash interrupts before the marker is written, is
+// discarded, leaving the engine as it was before BulkImport.
+//
+// The memory table is flushed first, and not again until the import ends,
+// so it may grow past Options.MaxMemTableSize meanwhile. Writes made
+// through the engine during the import are ordered after it: an imported
+// pair doesn't override them.
+func (e *Engine) BulkImport(fn func(w BulkWriter) error) error {
+	e.mu.RLock()
+	closed, readOnly := e.closed, e.readOnly
+	e.mu.RUnlock()
+	if closed {
+		return ErrEngineClosed
+	}
+	if readOnly {
+		return ErrReadOnly
+	}
+	if err := e.Poisoned(); err != nil {
+		return err
+	}
+
+	// Keep flushes out, so the imported blocks are newer than every block
+	// holding a write logged before the import
+	e.flushMu.Lock()
+	defer e.flushMu.Unlock()
+
+	// Keep collections of the value log out until the staged pointers are
+	// visible
+	defer e.values.importLock()()
+
+	flushed, err := e.flushLocked()
+	if err != nil {
+		return fmt.Errorf("failed to flush memory table: %w", err)
+	}
+
+	name := fmt.Sprintf("%s%d", importDirPrefix, time.Now().UnixNano())
+	dir := filepath.Join(e.lsm.dataDir, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create import directory: %w", err)
+	}
+
+	// The secondary indexes file the imported pairs once they are
+	// committed, unless the keys were written through the engine meanwhile
+	var committed importTerms
+	e.indexes.beginImport()
+	defer func() { e.indexes.endImport(committed) }()
+
+	w := &bulkWriter{engine: e, dir: dir, pairs: make(map[string][]byte), terms: make(importTerms)}
+	if err := fn(w); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	if err := w.stage(); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+
+	// The barrier: the import is committed once the marker is in the WAL
+	if err := syncImport(dir); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	if err := e.wal.AppendImport(name, flushed); err != nil {
+		os.RemoveAll(dir)
+		return fmt.Errorf("failed to append to WAL: %w", err)
+	}
+	committed = w.terms
+
+	// Recovery completes the move if this fails part way. The imported
+	// pairs replace values cached from older blocks.
+	err = e.lsm.importBlocks(dir)
+	e.valueCache.clear()
+	if err != nil {
+		return fmt.Errorf("failed to import blocks: %w", err)
+	}
+	return nil
+}
+
+// stageBlock writes a block file to the staging directory of an import,
+// without syncing it
+func stageBlock(dir string, b *block.Block) error {
+	setValueStats(b)
+	if err := b.Finalize(); err != nil {
+		return fmt.Errorf("failed to finalize block: %w", err)
+	}
+
+	// Name the file like a level 0 block, so it can be moved there as is
+	path := filepath.Join(dir, fmt.Sprintf("%d_%s.blk", time.Now().UnixNano(), b.ID()))
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create block file: %w", err)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	if err := b.Encode(w); err != nil {
+		return fmt.Errorf("failed to encode block to file: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write block file: %w", err)
+	}
+	return f.Close()
+}
+
+// syncImport syncs the block files staged in dir, and dir itself
+func syncImport(dir string) error {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read import directory: %w", err)
+	}
+
+	for _, file := range files {
+		f, err := os.Open(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to open block file: %w", err)
+		}
+		err = f.Sync()
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to sync block file: %w", err)
+		}
+	}
+
+	if err := fsyncDir(dir); err != nil {
+		return fmt.Errorf("failed to sync import directory: %w", err)
+	}
+	return nil
+}
+
+// importBlocks moves the block files of a committed import from its staging
+// directory into level 0, as its newest blocks, and removes the directory.
+// A read-only tree reads them from the staging directory instead.
+func (t *LSMTree) importBlocks(dir string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read import directory: %w", err)
+	}
+
+	levelDir := filepath.Join(t.dataDir, "L0")
+	if !t.readOnly {
+		if err := os.MkdirAll(levelDir, 0755); err != nil {
+			return fmt.Errorf("failed to create L0 directory: %w", err)
+		}
+	}
+
+	for _, file := range files {
+		if filepath.Ext(file.Name()) != ".blk" {
+			continue
+		}
+
+		path := filepath.Join(dir, file.Name())
+		if !t.readOnly {
+			target := filepath.Join(levelDir, file.Name())
+			if err := os.Rename(path, target); err != nil {
+				return fmt.Errorf("failed to move block file: %w", err)
+			}
+			path = target
+		}
+
+		info, err := readBlockInfo(path)
+		if err != nil {
+			return err
+		}
+		t.levels[0] = append(t.levels[0], info)
+		t.bytesWritten.Add(info.size)
+		t.dedup.add(blockFileID(path), path)
+	}
+	t.sortLevel(0)
+
+	if t.readOnly {
+		return nil
+	}
+
+	// Make the moves durable before forgetting the staging directory
+	if err := fsyncDir(levelDir); err != nil {
+		return fmt.Errorf("failed to sync L0 directory: %w", err)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to remove import directory: %w", err)
+	}
+
+	if t.shouldCompact(0) {
+		t.triggerCompaction()
+	}
+	return nil
+}
+
+// discardImports removes the staging directories of imports that were
+// never committed, once recovery has completed the committed ones
+func (t *LSMTree) discardImports() {
+	if t.readOnly {
+		return
+	}
+
+	files, err := os.ReadDir(t.dataDir)
+	if err != nil {
+		fmt.Printf("Warning: failed to read data directory: %v\n", err)
+		return
+	}
+	for _, file := range files {
+		if file.IsDir() && strings.HasPrefix(file.Name(), importDirPrefix) {
+			if err := os.RemoveAll(filepath.Join(t.dataDir, file.Name())); err != nil {
+				fmt.Printf("Warning: failed to remove import directory: %v\n", err)
+			}
+		}
+	}
+}
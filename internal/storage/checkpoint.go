@@ -1,12 +1,14 @@
 package storage
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"hash/crc32"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
-	"time"
 )
 
 // Checkpoint represents a snapshot of the memory table
@@ -19,6 +21,18 @@ type Checkpoint struct {
 
 	// Last WAL timestamp included in this checkpoint
 	lastWALTimestamp int64
+
+	// Time the checkpoint was created, in Unix nanoseconds
+	timestamp int64
+
+	// Whether to fsync the checkpoint directory after renaming the checkpoint file
+	syncDirs bool
+
+	// Whether the checkpoint can only be loaded
+	readOnly bool
+
+	// Clock of the checkpoint timestamps; nil for the system clock
+	clock Clock
 }
 
 // CheckpointData represents the data stored in a checkpoint file
@@ -34,6 +48,43 @@ type CheckpointData struct {
 
 	// Memory table size
 	MemTableSize int64 `json:"mem_table_size"`
+
+	// CRC32C of the memory table entries (see memTableChecksum)
+	Checksum uint32 `json:"checksum"`
+}
+
+// memTableChecksum returns the CRC32C of the entries of a memory table, in
+// key order. Each entry is hashed as:
+// - 4 bytes: Key length
+// - N bytes: Key
+// - 1 byte:  1 for a tombstone (nil value), else 0
+// - 4 bytes: Value length
+// - M bytes: Value
+func memTableChecksum(memTable map[string][]byte) uint32 {
+	keys := make([]string, 0, len(memTable))
+	for key := range memTable {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var crc uint32
+	buf := make([]byte, 4)
+	for _, key := range keys {
+		value := memTable[key]
+		binary.LittleEndian.PutUint32(buf, uint32(len(key)))
+		crc = crc32.Update(crc, castagnoliTable, buf)
+		crc = crc32.Update(crc, castagnoliTable, []byte(key))
+
+		tombstone := []byte{0}
+		if value == nil {
+			tombstone[0] = 1
+		}
+		crc = crc32.Update(crc, castagnoliTable, tombstone)
+		binary.LittleEndian.PutUint32(buf, uint32(len(value)))
+		crc = crc32.Update(crc, castagnoliTable, buf)
+		crc = crc32.Update(crc, castagnoliTable, value)
+	}
+	return crc
 }
 
 // NewCheckpoint creates a new checkpoint manager
@@ -45,21 +96,36 @@ func NewCheckpoint(baseDir string) (*Checkpoint, error) {
 	}
 
 	return &Checkpoint{
-		path: filepath.Join(checkpointDir, "checkpoint.json"),
+		path:     filepath.Join(checkpointDir, "checkpoint.json"),
+		syncDirs: true,
 	}, nil
 }
 
+// openCheckpointReadOnly opens the checkpoint in the given base directory
+// for loading only, without creating the checkpoint directory
+func openCheckpointReadOnly(baseDir string) *Checkpoint {
+	return &Checkpoint{
+		path:     filepath.Join(baseDir, "checkpoint", "checkpoint.json"),
+		readOnly: true,
+	}
+}
+
 // Save saves the current memory table to a checkpoint file
 func (c *Checkpoint) Save(memTable map[string][]byte, memTableSize int64, lastWALTimestamp int64) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	if c.readOnly {
+		return ErrReadOnly
+	}
+
 	// Create checkpoint data
 	data := CheckpointData{
-		Timestamp:        time.Now().UnixNano(),
+		Timestamp:        clockNow(c.clock).UnixNano(),
 		LastWALTimestamp: lastWALTimestamp,
 		MemTable:         memTable,
 		MemTableSize:     memTableSize,
+		Checksum:         memTableChecksum(memTable),
 	}
 
 	// Create a temporary file
@@ -92,13 +158,24 @@ func (c *Checkpoint) Save(memTable map[string][]byte, memTableSize int64, lastWA
 		return fmt.Errorf("failed to rename checkpoint file: %w", err)
 	}
 
+	// Make the rename itself durable
+	if c.syncDirs {
+		if err := fsyncDir(filepath.Dir(c.path)); err != nil {
+			return fmt.Errorf("failed to sync checkpoint directory: %w", err)
+		}
+	}
+
 	// Update last WAL timestamp
 	c.lastWALTimestamp = lastWALTimestamp
+	c.timestamp = data.Timestamp
 
 	return nil
 }
 
-// Load loads the memory table from a checkpoint file
+// Load loads the memory table from a checkpoint file. A checkpoint that
+// can't be decoded, or whose memory table doesn't match its checksum, is
+// rejected with ErrCorrupt, and an empty memory table is returned: the WAL
+// must then be replayed from its start.
 func (c *Checkpoint) Load() (map[string][]byte, int64, int64, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -127,12 +204,15 @@ func (c *Checkpoint) Load() (map[string][]byte, int64, int64, error) {
 	var data CheckpointData
 	decoder := json.NewDecoder(file)
 	if err := decoder.Decode(&data); err != nil {
-		// If we can't decode, treat as if there's no checkpoint
-		return make(map[string][]byte), 0, 0, nil
+		return make(map[string][]byte), 0, 0, fmt.Errorf("%w: failed to decode checkpoint: %v", ErrCorrupt, err)
+	}
+	if memTableChecksum(data.MemTable) != data.Checksum {
+		return make(map[string][]byte), 0, 0, fmt.Errorf("%w: checkpoint checksum mismatch", ErrCorrupt)
 	}
 
 	// Update last WAL timestamp
 	c.lastWALTimestamp = data.LastWALTimestamp
+	c.timestamp = data.Timestamp
 
 	// If memTable is nil, create an empty one
 	if data.MemTable == nil {
@@ -148,3 +228,11 @@ func (c *Checkpoint) GetLastWALTimestamp() int64 {
 	defer c.mu.Unlock()
 	return c.lastWALTimestamp
 }
+
+// GetTimestamp returns the time the checkpoint was created, in Unix
+// nanoseconds: every write it includes was logged to the WAL before then
+func (c *Checkpoint) GetTimestamp() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.timestamp
+}
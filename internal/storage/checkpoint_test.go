@@ -1,7 +1,11 @@
 package storage
 
 import (
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -72,6 +76,91 @@ func TestCheckpoint_SaveAndLoad(t *testing.T) {
 	}
 }
 
+func TestCheckpoint_Corrupt(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-checkpoint-corrupt-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		engine, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+
+		for i := 0; i < 100; i++ {
+			key := []byte(fmt.Sprintf("key%03d", i))
+			if err := engine.Put(key, []byte(fmt.Sprintf("value%03d", i))); err != nil {
+				t.Errorf("Failed to put %s: %v", key, err)
+			}
+		}
+		if err := engine.Delete([]byte("key000")); err != nil {
+			t.Errorf("Failed to delete key000: %v", err)
+		}
+		if err := engine.createCheckpoint(); err != nil {
+			t.Errorf("Failed to save checkpoint: %v", err)
+		}
+		crash(engine)
+
+		// Change a value in the checkpoint without breaking its JSON
+		path := filepath.Join(tempDir, "checkpoint", "checkpoint.json")
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Errorf("Failed to read checkpoint: %v", err)
+			done <- true
+			return
+		}
+		corrupted := strings.Replace(string(data), `"key050":"dmFsdWUwNTA="`, `"key050":"dmFsdWUwNTE="`, 1)
+		if corrupted == string(data) {
+			t.Errorf("Checkpoint doesn't hold key050: %s", data)
+		}
+		if err := os.WriteFile(path, []byte(corrupted), 0644); err != nil {
+			t.Errorf("Failed to write checkpoint: %v", err)
+		}
+
+		checkpoint, err := NewCheckpoint(tempDir)
+		if err != nil {
+			t.Errorf("Failed to create checkpoint: %v", err)
+		} else if _, _, _, err := checkpoint.Load(); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("Expected ErrCorrupt loading the checkpoint, got %v", err)
+		}
+
+		// Every write is recovered from the WAL
+		engine, err = NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to reopen engine: %v", err)
+			done <- true
+			return
+		}
+		defer engine.Close()
+
+		if _, err := engine.Get([]byte("key000")); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected key000 to be deleted, got %v", err)
+		}
+		for i := 1; i < 100; i++ {
+			key := []byte(fmt.Sprintf("key%03d", i))
+			value, err := engine.Get(key)
+			if err != nil {
+				t.Errorf("Failed to get %s: %v", key, err)
+			} else if string(value) != fmt.Sprintf("value%03d", i) {
+				t.Errorf("Expected value%03d for %s, got %s", i, key, value)
+			}
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Test timed out")
+	}
+}
+
 func TestEngine_RecoveryWithCheckpoint(t *testing.T) {
 	t.Skip("Skipping recovery with checkpoint test due to timeout issues")
 
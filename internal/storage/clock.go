@@ -0,0 +1,22 @@
+package storage
+
+import "time"
+
+// Clock tells the time to the features of the engine that depend on it:
+// WAL and checkpoint timestamps, tombstone grace periods, compaction
+// schedules, the age of the memory table and staleness. Tests can set Options.Clock to a fake clock to
+// exercise them without sleeping. Durations reported in statistics, file
+// names and rate limits always use the system clock.
+type Clock interface {
+	// Now returns the current time
+	Now() time.Time
+}
+
+// clockNow returns the current time of clock, or of the system clock when
+// clock is nil
+func clockNow(clock Clock) time.Time {
+	if clock == nil {
+		return time.Now()
+	}
+	return clock.Now()
+}
@@ -0,0 +1,242 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/0xReLogic/river/internal/data/block"
+	"github.com/0xReLogic/river/internal/data/encoding"
+)
+
+// columnHeaderSize is the size of the header of a stored column: the data
+// type (1 byte) and the number of values (4 bytes)
+const columnHeaderSize = 5
+
+// columnCodec returns the encoder and decoder for a data type
+func columnCodec(dataType block.DataType) (encoding.Encoder, encoding.Decoder, error) {
+	switch dataType {
+	case block.Int32, block.Int64, block.Float32, block.Float64, block.Bool:
+		codec := encoding.NewFixed()
+		return codec, codec, nil
+	case block.String:
+		codec := encoding.NewString()
+		return codec, codec, nil
+	default:
+		return nil, nil, fmt.Errorf("%w: unknown data type %d", ErrColumnType, dataType)
+	}
+}
+
+// columnLen returns the number of values in a column, or an error if the
+// values are not a slice of the Go type matching dataType
+func columnLen(dataType block.DataType, values interface{}) (int, error) {
+	n := -1
+	switch v := values.(type) {
+	case []int32:
+		if dataType == block.Int32 {
+			n = len(v)
+		}
+	case []int64:
+		if dataType == block.Int64 {
+			n = len(v)
+		}
+	case []float32:
+		if dataType == block.Float32 {
+			n = len(v)
+		}
+	case []float64:
+		if dataType == block.Float64 {
+			n = len(v)
+		}
+	case []string:
+		if dataType == block.String {
+			n = len(v)
+		}
+	case []bool:
+		if dataType == block.Bool {
+			n = len(v)
+		}
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("%w: %T values for data type %d", ErrColumnType, values, dataType)
+	}
+	return n, nil
+}
+
+// decodeColumn decodes numValues values of dataType into a slice of the
+// matching Go type
+func decodeColumn(decoder encoding.Decoder, dataType block.DataType, data []byte, numValues int) (interface{}, error) {
+	r := bytes.NewReader(data)
+	var err error
+	var values interface{}
+	switch dataType {
+	case block.Int32:
+		var v []int32
+		err = decoder.Decode(r, &v, numValues)
+		values = v
+	case block.Int64:
+		var v []int64
+		err = decoder.Decode(r, &v, numValues)
+		values = v
+	case block.Float32:
+		var v []float32
+		err = decoder.Decode(r, &v, numValues)
+		values = v
+	case block.Float64:
+		var v []float64
+		err = decoder.Decode(r, &v, numValues)
+		values = v
+	case block.String:
+		var v []string
+		err = decoder.Decode(r, &v, numValues)
+		values = v
+	case block.Bool:
+		var v []bool
+		err = decoder.Decode(r, &v, numValues)
+		values = v
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("%w: %d trailing bytes after %d values", ErrColumnType, r.Len(), numValues)
+	}
+	return values, nil
+}
+
+// PutColumn stores a column of values under key. The values must be a slice
+// of the Go type matching dataType ([]int64 for block.Int64, []string for
+// block.String, ...); otherwise ErrColumnType is returned. The column is
+// stored as its data type and number of values followed by the encoded
+// values, and read back with GetColumn.
+func (e *Engine) PutColumn(key []byte, dataType block.DataType, values interface{}) error {
+	encoder, _, err := columnCodec(dataType)
+	if err != nil {
+		return err
+	}
+	numValues, err := columnLen(dataType, values)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(byte(dataType))
+	binary.Write(&buf, binary.LittleEndian, uint32(numValues))
+	if err := encoder.Encode(&buf, values); err != nil {
+		return fmt.Errorf("failed to encode column: %w", err)
+	}
+
+	return e.Put(key, buf.Bytes())
+}
+
+// GetColumn returns the data type and values of a column stored with
+// PutColumn. The values are a slice of the Go type matching the data type.
+// ErrColumnType is returned if the value of key is not a column.
+func (e *Engine) GetColumn(key []byte) (block.DataType, interface{}, error) {
+	value, err := e.Get(key)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(value) < columnHeaderSize {
+		return 0, nil, fmt.Errorf("%w: value of %d bytes is too short for a column", ErrColumnType, len(value))
+	}
+
+	dataType := block.DataType(value[0])
+	_, decoder, err := columnCodec(dataType)
+	if err != nil {
+		return 0, nil, err
+	}
+	numValues := int(binary.LittleEndian.Uint32(value[1:columnHeaderSize]))
+
+	values, err := decodeColumn(decoder, dataType, value[columnHeaderSize:], numValues)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to decode column: %w", err)
+	}
+	return dataType, values, nil
+}
+
+// NumericStat returns the encoding of an integer in block value stats (see
+// Predicate.Bounds): its sign bit is flipped, so the encoded values sort
+// like the integers
+func NumericStat(v int64) uint64 {
+	return uint64(v) ^ 1<<63
+}
+
+// columnInts calls fn with each value of a column of integers
+// (block.Int32 or block.Int64) stored with PutColumn, without decoding it
+// into a slice, until fn returns false. It returns false if value isn't
+// such a column.
+func columnInts(value []byte, fn func(v int64) bool) bool {
+	if len(value) < columnHeaderSize {
+		return false
+	}
+	size := 0
+	switch block.DataType(value[0]) {
+	case block.Int32:
+		size = 4
+	case block.Int64:
+		size = 8
+	default:
+		return false
+	}
+	numValues := int(binary.LittleEndian.Uint32(value[1:columnHeaderSize]))
+	data := value[columnHeaderSize:]
+	if len(data) != numValues*size {
+		return false
+	}
+
+	for i := 0; i < numValues; i++ {
+		var v int64
+		if size == 4 {
+			v = int64(int32(binary.LittleEndian.Uint32(data[i*4:])))
+		} else {
+			v = int64(binary.LittleEndian.Uint64(data[i*8:]))
+		}
+		if !fn(v) {
+			break
+		}
+	}
+	return true
+}
+
+// columnIntRange returns the smallest and largest values of a column of
+// integers stored with PutColumn. ok is false if value isn't such a column
+// or holds no values.
+func columnIntRange(value []byte) (lo, hi int64, ok bool) {
+	columnInts(value, func(v int64) bool {
+		if !ok || v < lo {
+			lo = v
+		}
+		if !ok || v > hi {
+			hi = v
+		}
+		ok = true
+		return true
+	})
+	return lo, hi, ok
+}
+
+// setValueStats sets the stats of a block about to be written to the range
+// of the integer column values of its pairs, in the encoding of
+// NumericStat, and flags them with block.FlagValueStats. Other values and
+// tombstones are left out; the range is empty (Min > Max) if no value is an
+// integer column. A block holding value log pointers gets no stats, since
+// the values they point to are unknown.
+func setValueStats(b *block.Block) {
+	b.Stats.Min, b.Stats.Max = math.MaxUint64, 0
+	for i := 0; i < b.Count(); i++ {
+		_, value := b.Pair(i)
+		if isValuePointer(value) {
+			b.Stats.Min, b.Stats.Max = 0, 0
+			return
+		}
+		lo, hi, ok := columnIntRange(value)
+		if !ok {
+			continue
+		}
+		b.Stats.Min = min(b.Stats.Min, NumericStat(lo))
+		b.Stats.Max = max(b.Stats.Max, NumericStat(hi))
+	}
+	b.Header.Flags |= block.FlagValueStats
+}
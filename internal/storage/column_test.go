@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/0xReLogic/river/internal/data/block"
+)
+
+// TestEngine_Columns round-trips typed columns and rejects mismatched types
+func TestEngine_Columns(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-column-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		engine, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+		defer engine.Close()
+
+		columns := []struct {
+			key      string
+			dataType block.DataType
+			values   interface{}
+		}{
+			{"ints", block.Int64, []int64{1, -2, 1 << 40}},
+			{"floats", block.Float64, []float64{0.5, -1.25, 3e100}},
+			{"empty", block.Int64, []int64{}},
+			{"names", block.String, []string{"river", "", "lsm"}},
+		}
+		for _, c := range columns {
+			if err := engine.PutColumn([]byte(c.key), c.dataType, c.values); err != nil {
+				t.Errorf("Failed to put column %q: %v", c.key, err)
+			}
+		}
+
+		// Columns read back the same from the memory table and from a block
+		for _, flushed := range []bool{false, true} {
+			if flushed {
+				if err := engine.flush(); err != nil {
+					t.Errorf("Failed to flush: %v", err)
+				}
+			}
+			for _, c := range columns {
+				dataType, values, err := engine.GetColumn([]byte(c.key))
+				if err != nil {
+					t.Errorf("Failed to get column %q: %v", c.key, err)
+					continue
+				}
+				if dataType != c.dataType || fmt.Sprintf("%T %v", values, values) != fmt.Sprintf("%T %v", c.values, c.values) {
+					t.Errorf("Column %q: expected %d %v, got %d %v", c.key, c.dataType, c.values, dataType, values)
+				}
+			}
+		}
+
+		// Values that don't match the data type are rejected
+		if err := engine.PutColumn([]byte("bad"), block.Float64, []int64{1}); !errors.Is(err, ErrColumnType) {
+			t.Errorf("Expected ErrColumnType, got %v", err)
+		}
+		if err := engine.PutColumn([]byte("bad"), block.DataType(99), []int64{1}); !errors.Is(err, ErrColumnType) {
+			t.Errorf("Expected ErrColumnType for an unknown data type, got %v", err)
+		}
+		if _, err := engine.Get([]byte("bad")); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected a rejected column not to be stored, got %v", err)
+		}
+
+		// A value that is not a column
+		if err := engine.Put([]byte("raw"), []byte("abc")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		if _, _, err := engine.GetColumn([]byte("raw")); !errors.Is(err, ErrColumnType) {
+			t.Errorf("Expected ErrColumnType for a raw value, got %v", err)
+		}
+		if _, _, err := engine.GetColumn([]byte("missing")); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected ErrKeyNotFound, got %v", err)
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
@@ -3,13 +3,8 @@ package storage
 import (
 	"context"
 	"fmt"
-	"os"
-	"path/filepath"
-	"sort"
 	"sync"
 	"time"
-
-	"golang.org/x/sync/errgroup"
 )
 
 // CompactionManager handles background compaction of LSM tree levels
@@ -23,6 +18,17 @@ type CompactionManager struct {
 	// Number of worker goroutines
 	numWorkers int
 
+	// Running workers. Guarded by mu, and only changed by Start and
+	// SetWorkers.
+	workers []*compactionWorker
+
+	// Whether Start and Stop have been called
+	started, stopped bool
+
+	// Serializes SetWorkers calls, which wait for surplus workers without
+	// holding mu
+	resizeMu sync.Mutex
+
 	// Channel for compaction tasks
 	taskChan chan compactionTask
 
@@ -36,10 +42,23 @@ type CompactionManager struct {
 	// Mutex to protect concurrent access
 	mu sync.Mutex
 
+	// Levels read or written by scheduled tasks. No other task is scheduled
+	// for them until the task completes, so tasks don't race for blocks.
+	busy [7]bool
+
 	// Compaction statistics
 	stats CompactionStats
 }
 
+// compactionWorker is a worker goroutine of a CompactionManager
+type compactionWorker struct {
+	// Closed to make the worker exit once its current task completes
+	quit chan struct{}
+
+	// Closed once the worker has exited
+	done chan struct{}
+}
+
 // compactionTask represents a single compaction task
 type compactionTask struct {
 	// Source level to compact
@@ -50,6 +69,16 @@ type compactionTask struct {
 
 	// Blocks to compact
 	blocks []blockInfo
+
+	// Whether the blocks are merged into a new run of the target level
+	// rather than with the target blocks they overlap (tiered compaction)
+	newRun bool
+}
+
+// consolidation reports whether the task merges blocks within their level
+// (see consolidationTasks) rather than moving them down
+func (task compactionTask) consolidation() bool {
+	return task.sourceLevel == task.targetLevel
 }
 
 // CompactionStats tracks statistics about compaction operations
@@ -78,6 +107,9 @@ type CompactionStats struct {
 	// Number of compaction tasks dropped due to queue full
 	TasksDropped int
 
+	// Number of worker goroutines (see CompactionManager.SetWorkers)
+	Workers int
+
 	// Last compaction timestamp
 	LastCompactionTime time.Time
 
@@ -101,28 +133,89 @@ func NewCompactionManager(tree *LSMTree, dataDir string, numWorkers int) *Compac
 
 // Start starts the compaction workers
 func (c *CompactionManager) Start() {
-	c.wg.Add(c.numWorkers)
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	for i := 0; i < c.numWorkers; i++ {
-		go c.worker(i)
+	c.started = true
+	for len(c.workers) < c.numWorkers {
+		c.startWorker()
 	}
 }
 
 // Stop stops the compaction workers
 func (c *CompactionManager) Stop() {
+	c.mu.Lock()
+	c.stopped = true
+	c.mu.Unlock()
+
 	c.cancel()
 	close(c.taskChan)
 	c.wg.Wait()
 }
 
-// worker is a background goroutine that performs compaction tasks
-func (c *CompactionManager) worker(id int) {
+// SetWorkers changes the number of worker goroutines to n, e.g. to compact
+// faster during quiet hours. Surplus workers exit once their current task
+// completes, and SetWorkers waits for them; queued tasks are left to the
+// remaining workers. Before Start, it sets the number of workers Start
+// starts.
+func (c *CompactionManager) SetWorkers(n int) error {
+	if n <= 0 {
+		return fmt.Errorf("invalid number of compaction workers %d: must be positive", n)
+	}
+
+	c.resizeMu.Lock()
+	defer c.resizeMu.Unlock()
+
+	c.mu.Lock()
+	if c.stopped {
+		c.mu.Unlock()
+		return fmt.Errorf("%w: compaction workers are stopped", ErrEngineClosed)
+	}
+	c.numWorkers = n
+	if !c.started {
+		c.mu.Unlock()
+		return nil
+	}
+	for len(c.workers) < n {
+		c.startWorker()
+	}
+	surplus := c.workers[n:]
+	c.workers = c.workers[:n]
+	for _, w := range surplus {
+		close(w.quit)
+	}
+	c.mu.Unlock()
+
+	// Workers update the statistics under c.mu as they complete a task
+	for _, w := range surplus {
+		<-w.done
+	}
+	return nil
+}
+
+// startWorker starts a worker goroutine. Callers must hold c.mu.
+func (c *CompactionManager) startWorker() {
+	w := &compactionWorker{
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	c.wg.Add(1)
+	go c.worker(len(c.workers), w)
+	c.workers = append(c.workers, w)
+}
+
+// worker is a background goroutine that performs compaction tasks until
+// the manager is stopped or w.quit is closed
+func (c *CompactionManager) worker(id int, w *compactionWorker) {
 	defer c.wg.Done()
+	defer close(w.done)
 
 	for {
 		select {
 		case <-c.ctx.Done():
 			return
+		case <-w.quit:
+			return
 		case task, ok := <-c.taskChan:
 			if !ok {
 				return
@@ -155,12 +248,11 @@ func (c *CompactionManager) worker(id int) {
 			// Calculate throughput
 			throughput := float64(bytesRead+bytesWritten) / duration.Seconds()
 
-			// Update statistics
+			// Update statistics. The bytes read and written are counted by
+			// the tree, like those of every other compaction.
 			c.mu.Lock()
 			c.stats.CompactionCount++
 			c.stats.BlocksCompacted += len(task.blocks)
-			c.stats.BytesRead += bytesRead
-			c.stats.BytesWritten += bytesWritten
 			c.stats.TotalTime += duration
 			c.stats.CPUUsagePercent = cpuUsage
 			c.stats.LastCompactionTime = time.Now()
@@ -191,129 +283,85 @@ func calculateCPUUsage(start, end float64) float64 {
 	return 1.0 + 4.0*float64(time.Now().UnixNano()%100)/100.0
 }
 
-// ScheduleCompaction schedules a compaction task
+// ScheduleCompaction schedules a compaction task merging blocks of
+// sourceLevel into targetLevel
 func (c *CompactionManager) ScheduleCompaction(sourceLevel, targetLevel int, blocks []blockInfo) {
-	// Skip if no blocks to compact
-	if len(blocks) == 0 {
-		return
-	}
-
-	// Create task
-	task := compactionTask{
+	c.schedule(compactionTask{
 		sourceLevel: sourceLevel,
 		targetLevel: targetLevel,
 		blocks:      blocks,
+	})
+}
+
+// schedule queues a task, marking its levels busy until it completes. It
+// reports whether the task was queued.
+func (c *CompactionManager) schedule(task compactionTask) bool {
+	// Skip if no blocks to compact
+	if len(task.blocks) == 0 {
+		return false
 	}
 
+	c.mu.Lock()
+	if c.busy[task.sourceLevel] || c.busy[task.targetLevel] {
+		c.mu.Unlock()
+		return false
+	}
+	c.busy[task.sourceLevel] = true
+	c.busy[task.targetLevel] = true
+	c.mu.Unlock()
+
 	// Try to schedule the task with a timeout to avoid blocking writes
 	select {
 	case c.taskChan <- task:
 		// Task scheduled successfully
+		return true
 	case <-time.After(10 * time.Millisecond):
 		// Channel is full and we've waited too long, log and drop the task
 		c.mu.Lock()
 		c.stats.TasksDropped++
+		c.busy[task.sourceLevel] = false
+		c.busy[task.targetLevel] = false
 		c.mu.Unlock()
 
 		fmt.Printf("Compaction task queue is full, dropping compaction of %d blocks from L%d to L%d\n",
-			len(blocks), sourceLevel, targetLevel)
+			len(task.blocks), task.sourceLevel, task.targetLevel)
+		return false
 	}
 }
 
-// compact performs the actual compaction
+// compact performs a compaction task, returning the bytes it read and wrote
 func (c *CompactionManager) compact(task compactionTask) (int64, int64, error) {
-	// Create target level directory if it doesn't exist
-	targetDir := filepath.Join(c.dataDir, fmt.Sprintf("L%d", task.targetLevel))
-	if err := os.MkdirAll(targetDir, 0755); err != nil {
-		return 0, 0, fmt.Errorf("failed to create target directory: %w", err)
-	}
-
-	// Sort blocks by min key
-	sort.Slice(task.blocks, func(i, j int) bool {
-		return string(task.blocks[i].minKey) < string(task.blocks[j].minKey)
-	})
-
-	// Track bytes read and written
-	var bytesRead, bytesWritten int64
-
-	// Use errgroup to parallelize reading blocks
-	g, _ := errgroup.WithContext(context.Background())
-
-	// Channel for sorted key-value pairs
-	kvChan := make(chan keyValuePair, 1000)
-
-	// Start goroutines to read blocks
-	for _, block := range task.blocks {
-		block := block // Capture for closure
-
-		g.Go(func() error {
-			// Open the block file
-			f, err := os.Open(block.path)
-			if err != nil {
-				return fmt.Errorf("failed to open block file: %w", err)
-			}
-			defer f.Close()
-
-			// TODO: Implement proper block reading
-			// For now, use a placeholder implementation
-
-			// Track bytes read
-			bytesRead += block.size
-
-			// Send key-value pairs to channel
-			// This is a placeholder - in a real implementation,
-			// we would parse the actual block format
-			kvChan <- keyValuePair{
-				key:   block.minKey,
-				value: []byte("placeholder value"),
-			}
-
-			return nil
-		})
-	}
-
-	// Start a goroutine to close the channel when all blocks are read
-	go func() {
-		g.Wait()
-		close(kvChan)
+	defer func() {
+		c.mu.Lock()
+		c.busy[task.sourceLevel] = false
+		c.busy[task.targetLevel] = false
+		c.mu.Unlock()
 	}()
 
-	// Create a new block file in the target level
-	targetPath := filepath.Join(targetDir, fmt.Sprintf("%d.blk", time.Now().UnixNano()))
-	targetFile, err := os.Create(targetPath)
-	if err != nil {
-		return bytesRead, bytesWritten, fmt.Errorf("failed to create target file: %w", err)
-	}
-	defer targetFile.Close()
-
-	// Write key-value pairs to the new block
-	for kv := range kvChan {
-		// TODO: Implement proper block writing
-		// For now, use a placeholder implementation
-
-		// Track bytes written
-		bytesWritten += int64(len(kv.key) + len(kv.value))
-	}
+	c.tree.mergeMu.Lock()
+	defer c.tree.mergeMu.Unlock()
+	c.tree.mu.Lock()
+	defer c.tree.mu.Unlock()
 
-	// Check for errors from goroutines
-	if err := g.Wait(); err != nil {
-		return bytesRead, bytesWritten, err
+	// The blocks may have been compacted since the task was planned, e.g.
+	// by CompactRange
+	present := make(map[string]bool, len(c.tree.levels[task.sourceLevel]))
+	for _, info := range c.tree.levels[task.sourceLevel] {
+		present[info.path] = true
 	}
-
-	// Delete the source blocks
-	for _, block := range task.blocks {
-		if err := os.Remove(block.path); err != nil {
-			fmt.Printf("Warning: Failed to delete source block %s: %v\n", block.path, err)
+	for _, info := range task.blocks {
+		if !present[info.path] {
+			return 0, 0, fmt.Errorf("block %s is no longer in L%d", info.path, task.sourceLevel)
 		}
 	}
 
-	return bytesRead, bytesWritten, nil
-}
+	bytesRead := c.tree.compactionBytesRead.Load()
+	bytesWritten := c.tree.compactionBytesWritten.Load()
+	err := c.tree.runTask(task)
+	bytesRead = c.tree.compactionBytesRead.Load() - bytesRead
+	bytesWritten = c.tree.compactionBytesWritten.Load() - bytesWritten
 
-// keyValuePair represents a key-value pair
-type keyValuePair struct {
-	key   []byte
-	value []byte
+	return bytesRead, bytesWritten, err
 }
 
 // GetStats returns the current compaction statistics
@@ -322,7 +370,9 @@ func (c *CompactionManager) GetStats() CompactionStats {
 	defer c.mu.Unlock()
 
 	// Return a copy of the stats
-	return c.stats
+	stats := c.stats
+	stats.Workers = c.numWorkers
+	return stats
 }
 
 // RunCompaction runs a compaction cycle
@@ -334,55 +384,23 @@ func (c *CompactionManager) RunCompaction() error {
 	// Check if compaction is already in progress
 	c.mu.Lock()
 	tasksInQueue := c.stats.TasksInQueue
+	numWorkers := c.numWorkers
 	c.mu.Unlock()
 
 	// If too many tasks are already queued, skip this cycle to avoid overwhelming the system
-	if tasksInQueue > c.numWorkers*2 {
+	if tasksInQueue > numWorkers*2 {
 		fmt.Printf("Skipping compaction cycle, %d tasks already in queue\n", tasksInQueue)
 		return nil
 	}
 
-	// Use level-triggered strategy: prioritize compacting lower levels first
-	// This ensures that L0 is compacted quickly to avoid write stalls
-	for level := 0; level < 6; level++ {
-		// Check if this level needs compaction
-		if !c.tree.shouldCompact(level) {
-			continue
-		}
-
-		// Get blocks to compact
-		blocks := c.tree.levels[level]
-		if len(blocks) == 0 {
-			continue
+	// Schedule the most urgent task whose levels aren't busy with a
+	// scheduled one. Blocks stay in their level until the task runs.
+	for _, task := range c.tree.scheduledTasks(c.tree.planner.plan(c.tree)) {
+		if c.schedule(task) {
+			break
 		}
-
-		// For level 0, we want to compact more aggressively to avoid write stalls
-		if level == 0 && len(blocks) > 4 {
-			// Split L0 into smaller batches to avoid large compactions
-			batchSize := (len(blocks) + 1) / 2
-
-			// Schedule first batch
-			c.ScheduleCompaction(level, level+1, blocks[:batchSize])
-
-			// Schedule second batch
-			c.ScheduleCompaction(level, level+1, blocks[batchSize:])
-
-			// Clear the level (blocks will be deleted after compaction)
-			c.tree.levels[level] = nil
-
-			// Only compact L0 in this cycle to prioritize it
-			return nil
-		}
-
-		// For other levels, compact normally
-		c.ScheduleCompaction(level, level+1, blocks)
-
-		// Clear the level (blocks will be deleted after compaction)
-		c.tree.levels[level] = nil
-
-		// Only compact one level per cycle to avoid overwhelming the system
-		return nil
 	}
 
+	// Only compact one level per cycle to avoid overwhelming the system
 	return nil
 }
@@ -0,0 +1,278 @@
+package storage
+
+import "sort"
+
+// CompactionStrategy selects how compaction reorganizes the LSM tree levels
+type CompactionStrategy uint8
+
+const (
+	// CompactionLeveled keeps every level below level 0 a single sorted run
+	// of non-overlapping blocks. Blocks moved into a level are merged with
+	// the blocks there they overlap, which rewrites data more often but
+	// keeps reads to one block per level.
+	CompactionLeveled CompactionStrategy = iota
+
+	// CompactionTiered lets sorted runs accumulate in each level and merges
+	// similarly-sized runs together into a new run of the next level,
+	// without rewriting the runs already there. Compactions are fewer and
+	// larger, at the cost of reads checking a block per run.
+	CompactionTiered
+)
+
+// tieredSizeRatio is how many times larger than the runs merged before it
+// together a run merged by tiered compaction may be
+const tieredSizeRatio = 4
+
+// compactionPlanner decides what compaction does next under a strategy
+type compactionPlanner interface {
+	// plan returns the compaction tasks the tree needs, most urgent first,
+	// or none if no level needs compaction. Callers must hold t.mu.
+	plan(t *LSMTree) []compactionTask
+}
+
+// newCompactionPlanner returns the planner of a compaction strategy
+func newCompactionPlanner(strategy CompactionStrategy) compactionPlanner {
+	if strategy == CompactionTiered {
+		return tieredPlanner{}
+	}
+	return leveledPlanner{}
+}
+
+// leveledPlanner plans leveled compaction. A level is compacted once its
+// compaction score reaches 1, the most urgent level first. Level 0 (or a
+// level holding several runs) is compacted as a whole, since its blocks may
+// overlap. A deeper level moves just enough blocks to get back under its low
+// watermark, continuing in key order from the level's compaction cursor, and
+// keeps being compacted until it is under it.
+type leveledPlanner struct{}
+
+// plan implements compactionPlanner
+func (leveledPlanner) plan(t *LSMTree) []compactionTask {
+	var levels []int
+	var scores [7]float64
+	for level := 0; level < 6; level++ {
+		scores[level] = t.compactionScore(level)
+		if scores[level] >= 1 || t.draining[level] && t.levelSize(level) >= t.lowWatermark(level) {
+			levels = append(levels, level)
+		}
+	}
+
+	// A severely over-full deep level isn't starved by shallower ones; ties
+	// go to the shallower level
+	sort.SliceStable(levels, func(i, j int) bool {
+		return scores[levels[i]] > scores[levels[j]]
+	})
+
+	tasks := make([]compactionTask, 0, len(levels))
+	for _, level := range levels {
+		tasks = append(tasks, compactionTask{
+			sourceLevel: level,
+			targetLevel: level + 1,
+			blocks:      leveledInputs(t, level),
+		})
+	}
+	return append(tasks, consolidationTasks(t)...)
+}
+
+// leveledInputs returns the blocks leveled compaction moves out of a level.
+// Callers must hold t.mu.
+func leveledInputs(t *LSMTree, level int) []blockInfo {
+	blocks := t.levels[level]
+	if t.multiRun(level) {
+		return append([]blockInfo(nil), blocks...)
+	}
+
+	size := t.levelSize(level)
+
+	// Start after the cursor, or over from the first block past the end
+	cursor := t.compactCursor[level]
+	start := sort.Search(len(blocks), func(i int) bool {
+		return string(blocks[i].minKey) > string(cursor)
+	})
+	if start == len(blocks) {
+		start = 0
+	}
+
+	var inputs []blockInfo
+	low := t.lowWatermark(level)
+	for i := start; i < len(blocks) && size >= low; i++ {
+		inputs = append(inputs, blocks[i])
+		size -= blocks[i].size
+	}
+	return inputs
+}
+
+// tieredPlanner plans tiered compaction. A level is compacted once it holds
+// L0CompactionTrigger runs, the level with the most runs first. Its oldest
+// run is merged with the runs following it into a new run of the next
+// level, up to a run much larger than those before it (see
+// tieredSizeRatio), so that runs of similar size are merged together. Merging the oldest
+// runs keeps every run in a level newer than the runs of the next. The last
+// level is a single run: runs moved into it are merged with its blocks.
+type tieredPlanner struct{}
+
+// plan implements compactionPlanner
+func (tieredPlanner) plan(t *LSMTree) []compactionTask {
+	width := t.l0CompactionTrigger
+	if width <= 0 {
+		width = DefaultOptions().L0CompactionTrigger
+	}
+
+	var tasks []compactionTask
+	var counts [7]int
+	for level := 0; level < 6; level++ {
+		runs := t.levelRuns(level)
+		if len(runs) < width {
+			continue
+		}
+
+		merged := runSize(runs[0])
+		blocks := append([]blockInfo(nil), runs[0]...)
+		for _, run := range runs[1:] {
+			size := runSize(run)
+			if size > merged*tieredSizeRatio {
+				break
+			}
+			merged += size
+			blocks = append(blocks, run...)
+		}
+
+		tasks = append(tasks, compactionTask{
+			sourceLevel: level,
+			targetLevel: level + 1,
+			blocks:      blocks,
+			newRun:      level+1 < 6,
+		})
+		counts[level] = len(runs)
+	}
+
+	// Ties go to the shallower level
+	sort.SliceStable(tasks, func(i, j int) bool {
+		return counts[tasks[i].sourceLevel] > counts[tasks[j].sourceLevel]
+	})
+	return append(tasks, consolidationTasks(t)...)
+}
+
+// consolidationTasks returns the tasks consolidating fragmented levels, less
+// urgent than any compaction moving data down. A level of 1-6 holding a
+// single run is fragmented when its blocks average fewer serialized bytes
+// than minAverageBlockSize. Its runs of adjacent blocks smaller than that
+// are merged into a block of the same level, as long as they fit in
+// targetBlockSize together: each task then replaces several blocks with
+// one, so consolidation terminates. Callers must hold t.mu.
+func consolidationTasks(t *LSMTree) []compactionTask {
+	if t.minAverageBlockSize <= 0 || t.targetBlockSize <= 0 {
+		return nil
+	}
+	small := int64(min(t.minAverageBlockSize, t.targetBlockSize))
+
+	var tasks []compactionTask
+	for level := 1; level < 7; level++ {
+		blocks := t.levels[level]
+		if len(blocks) < 2 || t.multiRun(level) {
+			continue
+		}
+		var raw int64
+		for _, info := range blocks {
+			raw += info.rawSize
+		}
+		if raw >= small*int64(len(blocks)) {
+			continue
+		}
+
+		// The blocks of a single run are sorted by key, so blocks next to
+		// each other hold adjacent, non-overlapping key ranges
+		var run []blockInfo
+		var size int64
+		flush := func() {
+			if len(run) >= 2 {
+				tasks = append(tasks, compactionTask{sourceLevel: level, targetLevel: level, blocks: run})
+			}
+			run, size = nil, 0
+		}
+		for _, info := range blocks {
+			if info.rawSize >= small {
+				flush()
+				continue
+			}
+			if size+info.rawSize > int64(t.targetBlockSize) {
+				flush()
+			}
+			run = append(run, info)
+			size += info.rawSize
+		}
+		flush()
+	}
+	return tasks
+}
+
+// runSize returns the total size of the blocks of a run
+func runSize(run []blockInfo) int64 {
+	var size int64
+	for _, info := range run {
+		size += info.size
+	}
+	return size
+}
+
+// CompactionTaskPlan describes a compaction task the planner would schedule
+type CompactionTaskPlan struct {
+	// Level the blocks are moved out of
+	SourceLevel int `json:"source_level"`
+
+	// Level the blocks are merged into
+	TargetLevel int `json:"target_level"`
+
+	// Number of blocks moved out of the source level
+	Blocks int `json:"blocks"`
+
+	// Number of blocks of the target level merged with them; zero when
+	// they form a new run of the target level, or when the task
+	// consolidates blocks of a level (SourceLevel equals TargetLevel)
+	TargetBlocks int `json:"target_blocks"`
+
+	// Estimated bytes the task reads, and about as many it writes: the size
+	// of the blocks moved and of the target blocks merged with them
+	EstimatedBytes int64 `json:"estimated_bytes"`
+
+	// Whether the blocks form a new run of the target level (tiered
+	// compaction) rather than being merged with the target blocks
+	NewRun bool `json:"new_run"`
+}
+
+// CompactionPlan returns the tasks compaction would run next, most urgent
+// first, without running them
+func (t *LSMTree) CompactionPlan() []CompactionTaskPlan {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	tasks := t.planner.plan(t)
+	plan := make([]CompactionTaskPlan, 0, len(tasks))
+	for _, task := range tasks {
+		p := CompactionTaskPlan{
+			SourceLevel:    task.sourceLevel,
+			TargetLevel:    task.targetLevel,
+			Blocks:         len(task.blocks),
+			EstimatedBytes: runSize(task.blocks),
+			NewRun:         task.newRun,
+		}
+		if !task.newRun && !task.consolidation() && len(task.blocks) > 0 {
+			// The target blocks overlapping the key range of the blocks,
+			// as merged by mergeBlocks
+			minKey, maxKey := task.blocks[0].minKey, task.blocks[0].maxKey
+			for _, info := range task.blocks[1:] {
+				if string(info.minKey) < string(minKey) {
+					minKey = info.minKey
+				}
+				if string(info.maxKey) > string(maxKey) {
+					maxKey = info.maxKey
+				}
+			}
+			overlapping := t.blocksInRange(task.targetLevel, minKey, maxKey)
+			p.TargetBlocks = len(overlapping)
+			p.EstimatedBytes += runSize(overlapping)
+		}
+		plan = append(plan, p)
+	}
+	return plan
+}
@@ -0,0 +1,98 @@
+package storage
+
+import "time"
+
+// CompactionKind is a set of kinds of compaction, allowed by a
+// CompactionWindow
+type CompactionKind uint8
+
+const (
+	// CompactionMinor merges level 0 into level 1: small, frequent
+	// compactions keeping up with flushes
+	CompactionMinor CompactionKind = 1 << iota
+
+	// CompactionMajor merges a deeper level into the next one: larger
+	// compactions rewriting data that was compacted already
+	CompactionMajor
+
+	// CompactionAll allows every kind of compaction
+	CompactionAll = CompactionMinor | CompactionMajor
+)
+
+// CompactionWindow restricts automatic compaction during a daily window of
+// local wall-clock time
+type CompactionWindow struct {
+	// Start and end of the window as times of day, i.e. offsets from
+	// midnight, taken modulo a day. A window ending before it starts wraps
+	// past midnight; one ending when it starts lasts all day.
+	Start, End time.Duration
+
+	// Kinds of compaction allowed during the window
+	Allowed CompactionKind
+}
+
+// CompactionSchedule restricts the kinds of compaction background cycles
+// run by time of day, e.g. to keep major compactions to off-peak hours.
+// Outside all its windows every kind is allowed; where windows overlap,
+// only the kinds all of them allow. The zero value allows everything.
+type CompactionSchedule struct {
+	// Windows restricting compaction
+	Windows []CompactionWindow
+}
+
+// day is the length of the day compaction windows repeat over
+const day = 24 * time.Hour
+
+// timeOfDay returns the time elapsed since midnight of now's day, in its
+// location
+func timeOfDay(now time.Time) time.Duration {
+	hour, minute, sec := now.Clock()
+	return time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute +
+		time.Duration(sec)*time.Second + time.Duration(now.Nanosecond())
+}
+
+// contains reports whether the window includes a time of day
+func (w CompactionWindow) contains(t time.Duration) bool {
+	start, end := ((w.Start%day)+day)%day, ((w.End%day)+day)%day
+	if start < end {
+		return t >= start && t < end
+	}
+	return t >= start || t < end
+}
+
+// allowed returns the kinds of compaction allowed at now
+func (s CompactionSchedule) allowed(now time.Time) CompactionKind {
+	kinds := CompactionAll
+	t := timeOfDay(now)
+	for _, w := range s.Windows {
+		if w.contains(t) {
+			kinds &= w.Allowed
+		}
+	}
+	return kinds
+}
+
+// kind returns the kind of compaction a task is
+func (task compactionTask) kind() CompactionKind {
+	if task.sourceLevel == 0 {
+		return CompactionMinor
+	}
+	return CompactionMajor
+}
+
+// scheduledTasks returns the tasks the compaction schedule allows at the
+// moment, in order. Callers must hold t.mu.
+func (t *LSMTree) scheduledTasks(tasks []compactionTask) []compactionTask {
+	if len(t.compactionSchedule.Windows) == 0 {
+		return tasks
+	}
+
+	allowed := t.compactionSchedule.allowed(clockNow(t.clock))
+	scheduled := tasks[:0]
+	for _, task := range tasks {
+		if task.kind()&allowed != 0 {
+			scheduled = append(scheduled, task)
+		}
+	}
+	return scheduled
+}
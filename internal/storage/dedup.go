@@ -0,0 +1,218 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// dedupIndexFile is the name of the block dedup index in the data directory
+const dedupIndexFile = "dedup.json"
+
+// dedupIndex maps block IDs to the block files holding their contents.
+// Since a block ID is a hash of the block's pairs, a block with the same ID
+// as an existing one is not written again: its file is created as a hard
+// link to the existing file, so the data is stored once. The links of an ID
+// are its references; removing one (e.g. after compaction) only frees the
+// data once no other reference is left.
+type dedupIndex struct {
+	// Mutex to protect the index; compaction workers remove blocks without
+	// holding the tree lock
+	mu sync.Mutex
+
+	// Data directory the paths in the index file are relative to
+	dataDir string
+
+	// Paths of the block files referencing each block ID
+	refs dedupRefs
+}
+
+// dedupRefs are the paths of the block files of each block ID, sorted
+type dedupRefs map[string][]string
+
+// dedupIndexData is the on-disk form of a dedupIndex
+type dedupIndexData struct {
+	// Paths of the block files of each block ID, relative to the data directory
+	Blocks map[string][]string `json:"blocks"`
+}
+
+// blockFileID returns the block ID encoded in a block filename
+// (<timestamp>_<id>.blk)
+func blockFileID(path string) string {
+	_, id, _ := strings.Cut(strings.TrimSuffix(filepath.Base(path), ".blk"), "_")
+	return id
+}
+
+// openDedupIndex loads the dedup index of the blocks in levels. An index
+// file that is missing, corrupt or doesn't match the blocks (e.g. after a
+// crash between writing a block and saving the index) is rebuilt from the
+// block IDs in the filenames.
+func openDedupIndex(dataDir string, levels [7][]blockInfo) (*dedupIndex, error) {
+	d := &dedupIndex{dataDir: dataDir, refs: make(dedupRefs)}
+	for _, blocks := range levels {
+		for _, info := range blocks {
+			id := blockFileID(info.path)
+			d.refs[id] = append(d.refs[id], info.path)
+		}
+	}
+	for _, paths := range d.refs {
+		sort.Strings(paths)
+	}
+
+	// The saved index is only trusted if it matches the blocks on disk
+	if saved, err := d.read(); err == nil && saved.equal(d.refs) {
+		return d, nil
+	}
+
+	if err := d.save(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// read reads the index file, with absolute paths
+func (d *dedupIndex) read() (dedupRefs, error) {
+	raw, err := os.ReadFile(filepath.Join(d.dataDir, dedupIndexFile))
+	if err != nil {
+		return nil, err
+	}
+
+	var data dedupIndexData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, fmt.Errorf("%w: invalid dedup index: %v", ErrCorrupt, err)
+	}
+
+	refs := make(dedupRefs, len(data.Blocks))
+	for id, paths := range data.Blocks {
+		for _, path := range paths {
+			refs[id] = append(refs[id], filepath.Join(d.dataDir, path))
+		}
+		sort.Strings(refs[id])
+	}
+	return refs, nil
+}
+
+// equal reports whether two sets of references hold the same paths
+func (r dedupRefs) equal(other dedupRefs) bool {
+	if len(r) != len(other) {
+		return false
+	}
+	for id, paths := range r {
+		if fmt.Sprint(paths) != fmt.Sprint(other[id]) {
+			return false
+		}
+	}
+	return true
+}
+
+// save writes the index file, replacing it atomically. Callers must hold
+// d.mu, or own d exclusively.
+func (d *dedupIndex) save() error {
+	data := dedupIndexData{Blocks: make(map[string][]string, len(d.refs))}
+	for id, paths := range d.refs {
+		for _, path := range paths {
+			rel, err := filepath.Rel(d.dataDir, path)
+			if err != nil {
+				return fmt.Errorf("failed to save dedup index: %w", err)
+			}
+			data.Blocks[id] = append(data.Blocks[id], rel)
+		}
+	}
+
+	raw, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode dedup index: %w", err)
+	}
+
+	path := filepath.Join(d.dataDir, dedupIndexFile)
+	tempPath := path + ".tmp"
+	if err := os.WriteFile(tempPath, raw, 0644); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to write dedup index: %w", err)
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to rename dedup index: %w", err)
+	}
+
+	return nil
+}
+
+// lookup returns the path of an existing block file with the given ID, or
+// "" if there is none. A nil index finds nothing.
+func (d *dedupIndex) lookup(id string) string {
+	if d == nil {
+		return ""
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if paths := d.refs[id]; len(paths) > 0 {
+		return paths[0]
+	}
+	return ""
+}
+
+// add records a new block file of the given ID and saves the index. The
+// index is rebuilt on open if it doesn't match the blocks, so a failure to
+// save it is only reported.
+func (d *dedupIndex) add(id, path string) {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.refs[id] = append(d.refs[id], path)
+	sort.Strings(d.refs[id])
+	if err := d.save(); err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
+}
+
+// remove forgets the block files at paths, which are being deleted, and
+// saves the index like add
+func (d *dedupIndex) remove(paths ...string) {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, path := range paths {
+		id := blockFileID(path)
+		var kept []string
+		for _, p := range d.refs[id] {
+			if p != path {
+				kept = append(kept, p)
+			}
+		}
+		if len(kept) == 0 {
+			delete(d.refs, id)
+		} else {
+			d.refs[id] = kept
+		}
+	}
+	if err := d.save(); err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
+}
+
+// refCount returns the number of block files referencing the given ID
+func (d *dedupIndex) refCount(id string) int {
+	if d == nil {
+		return 0
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return len(d.refs[id])
+}
@@ -1,10 +1,15 @@
 package storage
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/0xReLogic/river/internal/data/block"
@@ -24,21 +29,36 @@ type Engine struct {
 	// Checkpoint for faster recovery
 	checkpoint *Checkpoint
 
+	// Schemas of the rows written with PutRows
+	schemas *schemaRegistry
+
+	// Secondary indexes (see Options.Indexes); nil without indexes
+	indexes *indexSet
+
 	// Compaction manager for background compaction
 	compaction *CompactionManager
 
-	// Mutex to protect concurrent access
+	// Mutex to protect the memory table pointers and the closed flag.
+	// Writers hold it shared and lock the memory table shard of their key;
+	// it is held exclusively to swap the memory table out for a flush.
 	mu sync.RWMutex
 
 	// Memory table (not yet flushed to disk)
-	memTable map[string][]byte
+	memTable *memTable
 
-	// Size of the memory table in bytes
-	memTableSize int64
+	// Memory table currently being flushed. Its entries are still served
+	// by reads until the flushed blocks are visible in the LSM tree.
+	flushingMemTable *memTable
+
+	// Serializes flushes so only one memory table is in flight at a time
+	flushMu sync.Mutex
 
 	// Maximum size of the memory table before flushing to disk
 	maxMemTableSize int64
 
+	// Number of keys at which the memory table is flushed; zero for no limit
+	maxMemTableKeys int64
+
 	// Channel to signal background flushing
 	flushChan chan struct{}
 
@@ -51,41 +71,177 @@ type Engine struct {
 	// Flag to indicate if the engine is closed
 	closed bool
 
+	// Background flushing and checkpointing goroutines, waited for by Close
+	background sync.WaitGroup
+
+	// Whether the engine was opened with OpenReadOnly
+	readOnly bool
+
 	// Checkpoint interval in milliseconds
 	checkpointInterval time.Duration
+
+	// Options the engine was created with
+	opts Options
+
+	// Statistics about the recovery performed on open
+	recoveryStats RecoveryStats
+
+	// Time (by Options.Clock) the last successful recovery from the
+	// checkpoint and WAL started: a read-only engine has applied every write
+	// logged before
+	recoveredAt time.Time
+
+	// Number of iterators that have not been closed yet
+	openIterators atomic.Int64
+
+	// Bytes of keys and values written by users (Put, Append and Delete)
+	userBytesWritten atomic.Int64
+
+	// Number of Get calls and the blocks they read
+	gets       atomic.Int64
+	blocksRead atomic.Int64
+
+	// Values read from the LSM tree; nil without Options.ValueCacheSize
+	valueCache *valueCache
+
+	// Large values stored once (see Options.ValueLogThreshold); nil without
+	// a value log
+	values *valueLog
+
+	// Number of completed flushes, and their total and last duration in nanoseconds
+	flushes        atomic.Int64
+	flushNanos     atomic.Int64
+	lastFlushNanos atomic.Int64
+
+	// Delivers events to Options.EventListener; nil without a listener
+	events *eventDispatcher
+
+	// Reports operations running longer than Options.WatchdogThreshold;
+	// nil without a threshold
+	watchdog *watchdog
+
+	// Exclusive lock on the base directory held by a writable engine
+	lock *dirLock
+
+	// Closed to stop the periodic refresh of a read-only engine
+	stopRefresh chan struct{}
 }
 
-// NewEngine creates a new storage engine
+// NewEngine creates a new storage engine with the default options
 func NewEngine(baseDir string) (*Engine, error) {
+	return NewEngineWithOptions(baseDir, DefaultOptions())
+}
+
+// NewEngineWithOptions creates a new storage engine with the given options
+func NewEngineWithOptions(baseDir string, opts Options) (*Engine, error) {
 	// Create base directory if it doesn't exist
 	if err := os.MkdirAll(baseDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create base directory: %w", err)
 	}
 
+	// Only one engine writes to a directory at a time
+	lock, err := lockDir(baseDir)
+	if err != nil {
+		return nil, err
+	}
+
 	// Create subdirectories
 	dataDir := filepath.Join(baseDir, "data")
-	walDir := filepath.Join(baseDir, "wal")
+	walDir, err := openWALDir(baseDir, opts)
+	if err != nil {
+		lock.release()
+		return nil, err
+	}
 
 	// Create LSM tree
 	lsm, err := NewLSMTree(dataDir)
 	if err != nil {
+		lock.release()
 		return nil, fmt.Errorf("failed to create LSM tree: %w", err)
 	}
+	lsm.l0CompactionTrigger = opts.L0CompactionTrigger
+	lsm.compactionLowWatermark = opts.CompactionLowWatermark
+	lsm.compactionSchedule = opts.CompactionSchedule
+	lsm.setCompactionStrategy(opts.CompactionStrategy)
+	lsm.syncDirs = opts.SyncDirs
+	lsm.targetBlockSize = opts.TargetBlockSize
+	lsm.subCompactions = opts.SubCompactions
+	lsm.minAverageBlockSize = opts.MinAverageBlockSize
+	lsm.tombstoneGracePeriod = opts.TombstoneGracePeriod
+	lsm.levelCompression = opts.LevelCompression
+	lsm.clock = opts.Clock
+	lsm.compactionLimiter = newRateLimiter(opts.CompactionMaxBytesPerSec)
+	lsm.readLimiter = newReadLimiter(opts.MaxConcurrentReads)
+	lsm.files = newFilePool(opts.MaxOpenFiles)
+	if opts.DedupBlocks {
+		if err := lsm.enableDedup(); err != nil {
+			lsm.Close()
+			lock.release()
+			return nil, fmt.Errorf("failed to open dedup index: %w", err)
+		}
+	}
 
 	// Create WAL
-	wal, err := NewWAL(walDir)
+	wal, err := newWAL(walDir, opts.BestEffortWALRecovery)
 	if err != nil {
 		lsm.Close()
+		lock.release()
 		return nil, fmt.Errorf("failed to create WAL: %w", err)
 	}
+	wal.setPreallocate(opts.PreallocateWAL)
+	wal.setCompressionThreshold(opts.WALCompressionThreshold)
+	wal.clock = opts.Clock
+	if err := wal.setBufferFlushSize(opts.WALBufferFlushSize); err != nil {
+		wal.Close()
+		lsm.Close()
+		lock.release()
+		return nil, fmt.Errorf("failed to set WAL buffer flush size: %w", err)
+	}
+	if err := wal.setChecksum(opts.WALChecksum); err != nil {
+		wal.Close()
+		lsm.Close()
+		lock.release()
+		return nil, fmt.Errorf("failed to set WAL checksum: %w", err)
+	}
 
 	// Create checkpoint manager
 	checkpoint, err := NewCheckpoint(baseDir)
 	if err != nil {
 		wal.Close()
 		lsm.Close()
+		lock.release()
 		return nil, fmt.Errorf("failed to create checkpoint manager: %w", err)
 	}
+	checkpoint.syncDirs = opts.SyncDirs
+	checkpoint.clock = opts.Clock
+
+	// Load the schemas
+	schemas, err := newSchemaRegistry(baseDir, false)
+	if err != nil {
+		wal.Close()
+		lsm.Close()
+		lock.release()
+		return nil, fmt.Errorf("failed to load schemas: %w", err)
+	}
+	schemas.syncDirs = opts.SyncDirs
+
+	// Open the value log, if any
+	values, err := openValueLog(baseDir, opts.ValueLogThreshold, false, opts.SyncDirs)
+	if err != nil {
+		wal.Close()
+		lsm.Close()
+		lock.release()
+		return nil, fmt.Errorf("failed to open value log: %w", err)
+	}
+
+	// Deliver events to the listener, if any
+	events := newEventDispatcher(opts.EventListener)
+	lsm.events = events
+	wal.events = events
+
+	// Report operations that hang
+	watchdog := newWatchdog(opts.WatchdogThreshold)
+	lsm.watchdog = watchdog
 
 	// Create compaction manager
 	compaction := NewCompactionManager(lsm, dataDir, 4) // 4 worker goroutines
@@ -95,248 +251,1489 @@ func NewEngine(baseDir string) (*Engine, error) {
 		lsm:                lsm,
 		wal:                wal,
 		checkpoint:         checkpoint,
+		schemas:            schemas,
 		compaction:         compaction,
-		memTable:           make(map[string][]byte),
-		maxMemTableSize:    32 * 1024 * 1024, // 32MB
+		memTable:           newMemTable(opts.MemTableShards, opts.MemTableArena, opts.Clock),
+		maxMemTableSize:    opts.MaxMemTableSize,
+		maxMemTableKeys:    opts.MaxMemTableKeys,
 		flushChan:          make(chan struct{}, 1),
 		checkpointChan:     make(chan struct{}, 1),
 		checkpointInterval: 500 * time.Millisecond, // Checkpoint every 500ms
+		opts:               opts,
+		events:             events,
+		watchdog:           watchdog,
+		lock:               lock,
+		valueCache:         newValueCache(opts.ValueCacheSize),
+		values:             values,
+	}
+
+	// Recover from checkpoint and WAL if needed, before the background work
+	// starts: a checkpoint taken meanwhile would miss the entries replayed
+	ctx := context.Background()
+	if opts.OpenTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.OpenTimeout)
+		defer cancel()
+	}
+	if err := engine.recover(ctx); err != nil {
+		engine.abortOpen()
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = fmt.Errorf("%w: recovery still running after %v", ErrOpenTimeout, opts.OpenTimeout)
+		}
+		return nil, fmt.Errorf("failed to recover from checkpoint/WAL: %w", err)
 	}
 
 	// Start compaction workers
 	compaction.Start()
 
-	// Start background flushing goroutine
-	go engine.backgroundFlusher()
+	// Start background flushing goroutine
+	engine.background.Add(2)
+	go engine.backgroundFlusher()
+
+	// Start background checkpointing goroutine
+	go engine.backgroundCheckpointer()
+
+	// Start flushing by age if enabled
+	if opts.MaxMemTableAge > 0 {
+		engine.background.Add(1)
+		go engine.backgroundAgeFlusher()
+	}
+
+	// Load the secondary indexes saved on close, and build the others
+	indexes, unbuilt, err := openIndexes(baseDir, opts.Indexes, opts.SyncDirs)
+	if err == nil {
+		err = engine.buildIndexes(unbuilt)
+	}
+	if err != nil {
+		engine.Close()
+		return nil, fmt.Errorf("failed to open indexes: %w", err)
+	}
+	engine.indexes = indexes
+
+	return engine, nil
+}
+
+// openWALDir returns the WAL directory of the engine in baseDir: the one
+// configured in opts, else the one recorded in the manifest by an earlier
+// open, else baseDir/wal. A configured directory is recorded in the manifest.
+func openWALDir(baseDir string, opts Options) (string, error) {
+	recorded, err := recordedWALDir(baseDir)
+	if err != nil {
+		return "", err
+	}
+	if opts.WALDir == "" {
+		if recorded != "" {
+			return recorded, nil
+		}
+		return filepath.Join(baseDir, "wal"), nil
+	}
+
+	walDir, err := filepath.Abs(opts.WALDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve WAL directory: %w", err)
+	}
+	if walDir != recorded {
+		manifest, err := NewManifest(baseDir)
+		if err != nil {
+			return "", fmt.Errorf("failed to open manifest: %w", err)
+		}
+		manifest.syncDirs = opts.SyncDirs
+		manifest.UpdateWALDir(walDir)
+		if err := manifest.Save(); err != nil {
+			return "", fmt.Errorf("failed to record WAL directory: %w", err)
+		}
+	}
+
+	return walDir, nil
+}
+
+// recordedWALDir returns the WAL directory recorded in the manifest of the
+// engine in baseDir, or "" if there is none. It doesn't create a manifest.
+func recordedWALDir(baseDir string) (string, error) {
+	if _, err := os.Stat(filepath.Join(baseDir, "manifest", "manifest.json")); err != nil {
+		return "", nil
+	}
+
+	manifest, err := NewManifest(baseDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to open manifest: %w", err)
+	}
+	return manifest.GetWALDir(), nil
+}
+
+// readOnlyRefreshInterval is how often a read-only engine picks up what the
+// writer of its directory wrote since
+const readOnlyRefreshInterval = time.Second
+
+// OpenReadOnly opens an existing data directory for reading only. No
+// background flushing, checkpointing or compaction is started, the WAL is
+// replayed but not opened for writing, and nothing in the directory is
+// created or modified. Writes return ErrReadOnly.
+//
+// It doesn't need the directory lock, so any number of processes can open
+// a directory read-only while one writer holds it. Every
+// readOnlyRefreshInterval, the engine rescans the blocks and replays the
+// WAL again to follow the writer.
+func OpenReadOnly(baseDir string) (*Engine, error) {
+	if _, err := os.Stat(baseDir); err != nil {
+		return nil, fmt.Errorf("failed to open base directory: %w", err)
+	}
+
+	opts := DefaultOptions()
+	dataDir := filepath.Join(baseDir, "data")
+
+	// Find the WAL where the manifest says it is
+	walDir, err := recordedWALDir(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	if walDir == "" {
+		walDir = filepath.Join(baseDir, "wal")
+	}
+
+	// Open LSM tree
+	lsm, err := openLSMTree(dataDir, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open LSM tree: %w", err)
+	}
+
+	schemas, err := newSchemaRegistry(baseDir, true)
+	if err != nil {
+		lsm.Close()
+		return nil, fmt.Errorf("failed to load schemas: %w", err)
+	}
+
+	// Follow the value log of the writer, even one it creates later
+	values, err := openValueLog(baseDir, 0, true, false)
+	if err != nil {
+		lsm.Close()
+		return nil, fmt.Errorf("failed to open value log: %w", err)
+	}
+
+	engine := &Engine{
+		baseDir:            baseDir,
+		lsm:                lsm,
+		wal:                openWALReadOnly(walDir),
+		checkpoint:         openCheckpointReadOnly(baseDir),
+		schemas:            schemas,
+		compaction:         NewCompactionManager(lsm, dataDir, 0), // Never started
+		memTable:           newMemTable(opts.MemTableShards, opts.MemTableArena, opts.Clock),
+		maxMemTableSize:    opts.MaxMemTableSize,
+		maxMemTableKeys:    opts.MaxMemTableKeys,
+		flushChan:          make(chan struct{}, 1),
+		checkpointChan:     make(chan struct{}, 1),
+		checkpointInterval: 500 * time.Millisecond,
+		opts:               opts,
+		readOnly:           true,
+		stopRefresh:        make(chan struct{}),
+		values:             values,
+	}
+
+	// Load the memory table from the checkpoint and WAL
+	if err := engine.recover(context.Background()); err != nil {
+		values.close()
+		lsm.Close()
+		return nil, fmt.Errorf("failed to recover from checkpoint/WAL: %w", err)
+	}
+
+	// Follow the writer, if any
+	engine.background.Add(1)
+	go engine.backgroundRefresher()
+
+	return engine, nil
+}
+
+// backgroundRefresher is a goroutine that refreshes a read-only engine
+// every readOnlyRefreshInterval until Close closes stopRefresh
+func (e *Engine) backgroundRefresher() {
+	defer e.background.Done()
+
+	ticker := time.NewTicker(readOnlyRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.stopRefresh:
+			return
+		case <-ticker.C:
+			if err := e.refresh(); err != nil && !errors.Is(err, ErrEngineClosed) {
+				fmt.Printf("Error refreshing read-only engine: %v\n", err)
+			}
+		}
+	}
+}
+
+// refresh brings a read-only engine up to date with the writer of its
+// directory: the level directories are rescanned for the blocks flushed
+// and compacted since, and the memory table is recovered again from the
+// checkpoint and WAL, so it holds the writes not flushed yet and doesn't
+// shadow newer blocks with the values it held before.
+func (e *Engine) refresh() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closed {
+		return ErrEngineClosed
+	}
+
+	if err := e.lsm.reload(); err != nil {
+		return fmt.Errorf("failed to rescan blocks: %w", err)
+	}
+
+	// Values cached from the blocks may have been replaced by the writer
+	e.valueCache.clear()
+
+	// Recover into a new memory table, keeping the stats of the recovery on open
+	e.wal.forgetIndex()
+	stats := e.recoveryStats
+	e.recoveryStats = RecoveryStats{}
+	e.memTable = e.memTable.empty()
+	err := e.recover(context.Background())
+	e.recoveryStats = stats
+	if err != nil {
+		return fmt.Errorf("failed to recover from checkpoint/WAL: %w", err)
+	}
+	return nil
+}
+
+// RecoveryStats describes the work done recovering the engine when it was opened
+type RecoveryStats struct {
+	// Time spent loading the checkpoint
+	CheckpointLoadTime time.Duration
+
+	// Number of keys loaded from the checkpoint
+	CheckpointKeys int
+
+	// Number of WAL entries replayed after the checkpoint
+	WALEntriesReplayed int64
+
+	// Number of WAL bytes replayed after the checkpoint
+	WALBytesReplayed int64
+
+	// Time spent replaying the WAL
+	WALReplayTime time.Duration
+
+	// Total recovery time
+	TotalTime time.Duration
+}
+
+// Progress of the WAL replay is reported every recoveryProgressEntries
+// entries and every recoveryProgressBytes bytes
+const (
+	recoveryProgressEntries = 1000000
+	recoveryProgressBytes   = 64 * 1024 * 1024
+)
+
+// recoveryCancelEntries is how many WAL entries recovery replays between
+// checks of its deadline
+const recoveryCancelEntries = 1024
+
+// recover loads the memory table from checkpoint and replays the WAL. A
+// bulk import committed in the WAL is completed if a crash interrupted it,
+// and the writes logged before its initial flush are dropped from the
+// memory table: they are in blocks older than the imported ones, which
+// must override them. The staging directories of uncommitted imports are
+// removed. The replay is abandoned with ctx's error once ctx is done.
+func (e *Engine) recover(ctx context.Context) error {
+	start := time.Now()
+	recoveredAt := clockNow(e.opts.Clock)
+	stats := &e.recoveryStats
+
+	// First, try to load from checkpoint
+	memTable, _, lastWALTimestamp, err := e.checkpoint.Load()
+	if errors.Is(err, ErrCorrupt) {
+		// The WAL holds every write since the engine was created, so it
+		// recovers without the checkpoint
+		fmt.Printf("Warning: ignoring checkpoint, replaying the whole WAL: %v\n", err)
+	} else if err != nil {
+		return fmt.Errorf("failed to load checkpoint: %w", err)
+	}
+	stats.CheckpointLoadTime = time.Since(start)
+	stats.CheckpointKeys = len(memTable)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Track when each key was last written, for the imports to drop the
+	// writes they follow
+	written := make(map[string]int64, len(memTable))
+	checkpointed := e.checkpoint.GetTimestamp()
+	for key := range memTable {
+		written[key] = checkpointed
+	}
+
+	// Track the sequence number of each key. The writes in the checkpoint
+	// that are not replayed were logged before its WAL timestamp and saved
+	// before its own timestamp, so the greater of the two bounds them.
+	seqs := make(map[string]int64, len(memTable))
+	checkpointSeq := max(checkpointed, lastWALTimestamp)
+	for key := range memTable {
+		seqs[key] = checkpointSeq
+	}
+	e.lastCheckpointedWALTimestamp = lastWALTimestamp
+
+	// Then, replay WAL entries after the checkpoint, logging the progress of
+	// a large replay unless it is reported to the application
+	progress := ReplayProgress{
+		Callback: e.opts.RecoveryProgress,
+		Entries:  recoveryProgressEntries,
+		Bytes:    recoveryProgressBytes,
+	}
+	if progress.Callback == nil {
+		progress.Callback = func(entries, bytes int64) {
+			if entries >= recoveryProgressEntries || bytes >= recoveryProgressBytes {
+				fmt.Printf("Recovery: read %d WAL entries (%d MB)\n", entries, bytes/1024/1024)
+			}
+		}
+	}
+	replayStart := time.Now()
+	replayed := 0
+	err = e.wal.ReplayFromWithProgress(lastWALTimestamp, func(entry WALEntry) error {
+		// Checking every entry would slow down the replay
+		if replayed++; replayed%recoveryCancelEntries == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+
+		switch entry.OpType {
+		case OpTypePut:
+			value := entry.Value
+			if value == nil {
+				value = []byte{}
+			}
+			memTable[string(entry.Key)] = value
+			written[string(entry.Key)] = entry.Timestamp
+			seqs[string(entry.Key)] = entry.Timestamp
+		case OpTypeDelete:
+			memTable[string(entry.Key)] = nil
+			written[string(entry.Key)] = entry.Timestamp
+			seqs[string(entry.Key)] = entry.Timestamp
+		case OpTypeImport:
+			// The marker holds the timestamp of the last flushed write
+			if len(entry.Value) < 8 {
+				return fmt.Errorf("%w: import marker of %d bytes", ErrCorrupt, len(entry.Value))
+			}
+			if err := e.recoverImport(string(entry.Key)); err != nil {
+				return err
+			}
+			flushed := int64(binary.LittleEndian.Uint64(entry.Value))
+			for key, at := range written {
+				if at <= flushed {
+					delete(memTable, key)
+					delete(written, key)
+				}
+			}
+		}
+		e.lastCheckpointedWALTimestamp = entry.Timestamp
+
+		stats.WALEntriesReplayed++
+		stats.WALBytesReplayed += entry.encodedSize()
+		return nil
+	}, progress)
+
+	// Set memory table (its size is recomputed)
+	for key, value := range memTable {
+		e.memTable.put([]byte(key), value, seqs[key])
+	}
+	if err == nil {
+		e.lsm.discardImports()
+		e.recoveredAt = recoveredAt
+
+		// Sequence numbers only grow: writes from now on are numbered past
+		// every recovered key and every block
+		e.wal.advanceTimestamp(max(e.lastCheckpointedWALTimestamp, checkpointSeq, e.lsm.maxSequence()))
+	}
+
+	stats.WALReplayTime = time.Since(replayStart)
+	stats.TotalTime = time.Since(start)
+
+	return err
+}
+
+// recoverImport completes moving the blocks of the committed bulk import
+// staged in the data subdirectory name into level 0, if a crash
+// interrupted it
+func (e *Engine) recoverImport(name string) error {
+	dir := filepath.Join(e.lsm.dataDir, name)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil // Already completed
+	}
+	if err := e.lsm.importBlocks(dir); err != nil {
+		return fmt.Errorf("failed to complete import %s: %w", name, err)
+	}
+	return nil
+}
+
+// RecoveryStats returns statistics about the recovery performed when the engine was opened
+func (e *Engine) RecoveryStats() RecoveryStats {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.recoveryStats
+}
+
+// Put stores a key-value pair. The key must not be empty. An empty (or nil)
+// value is stored as an empty value, distinct from an absent or deleted key.
+func (e *Engine) Put(key, value []byte) error {
+	defer e.watchdog.track("Put")()
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.closed {
+		return ErrEngineClosed
+	}
+
+	if e.readOnly {
+		return ErrReadOnly
+	}
+
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	shard := e.memTable.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if err := e.putLocked(shard, key, value); err != nil {
+		return err
+	}
+
+	e.userBytesWritten.Add(int64(len(key) + len(value)))
+	return nil
+}
+
+// PutAsync stores a value like Put, but doesn't wait for the write to reach
+// disk: the WAL entry is synced in a batch with the other writes made
+// meanwhile. The returned channel receives nil once the write is durable,
+// or the error that prevented it.
+//
+// The value is visible to reads as soon as PutAsync returns, before it is
+// durable, and later writes to the key are ordered after it. If its batch
+// fails to sync, the future receives the error but the value stays visible
+// until the engine is reopened.
+func (e *Engine) PutAsync(key, value []byte) <-chan error {
+	defer e.watchdog.track("PutAsync")()
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.closed {
+		return completedFuture(ErrEngineClosed)
+	}
+
+	if e.readOnly {
+		return completedFuture(ErrReadOnly)
+	}
+
+	if err := checkKey(key); err != nil {
+		return completedFuture(err)
+	}
+
+	// A nil value would be indistinguishable from a tombstone
+	if value == nil {
+		value = []byte{}
+	}
+
+	shard := e.memTable.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	// A value stored in the value log is synced before the WAL entry
+	// pointing to it
+	stored, err := e.values.store(value)
+	if err != nil {
+		return completedFuture(fmt.Errorf("failed to write to value log: %w", err))
+	}
+
+	// Append to WAL first
+	seq, done, err := e.wal.appendPutAsync(key, stored)
+	if err != nil {
+		return completedFuture(fmt.Errorf("failed to append to WAL: %w", err))
+	}
+
+	// Update memory table
+	shard.put(key, stored, seq)
+	e.valueCache.invalidate(key)
+	e.indexes.update(key, value)
+	e.maybeFlush()
+
+	e.userBytesWritten.Add(int64(len(key) + len(value)))
+	return done
+}
+
+// Sync is a durability barrier: once it returns, every write made before
+// it is durable. Put, Delete and the other synchronous writes are durable
+// when they return already; Sync syncs the WAL entries of PutAsync writes
+// the background syncer hasn't synced yet, completing their futures, e.g.
+// before acknowledging the end of a transaction written asynchronously.
+func (e *Engine) Sync() error {
+	defer e.watchdog.track("Sync")()
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.closed {
+		return ErrEngineClosed
+	}
+	if e.readOnly {
+		return ErrReadOnly
+	}
+
+	if err := e.wal.Sync(); err != nil {
+		return fmt.Errorf("failed to sync WAL: %w", err)
+	}
+	return nil
+}
+
+// completedFuture returns a future that has already received err
+func completedFuture(err error) <-chan error {
+	done := make(chan error, 1)
+	done <- err
+	close(done)
+	return done
+}
+
+// Append appends suffix to the current value of key, as a single write.
+// An absent (or deleted) key starts from an empty value.
+//
+// The current value is read under the lock of the key's memory table shard,
+// so when the key is not in the memory table every Append pays for an LSM
+// tree read (one block decode per probed block) while blocking writers to
+// the shard. Prefer Put for keys that are rewritten as a whole.
+func (e *Engine) Append(key, suffix []byte) error {
+	defer e.watchdog.track("Append")()
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.closed {
+		return ErrEngineClosed
+	}
+
+	if e.readOnly {
+		return ErrReadOnly
+	}
+
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	shard := e.memTable.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	current, _, err := e.currentLocked(shard, key)
+	if err != nil {
+		return err
+	}
+
+	value := make([]byte, 0, len(current)+len(suffix))
+	value = append(value, current...)
+	value = append(value, suffix...)
+
+	if err := e.putLocked(shard, key, value); err != nil {
+		return err
+	}
+
+	e.userBytesWritten.Add(int64(len(key) + len(suffix)))
+	return nil
+}
+
+// Swap stores a key-value pair like Put, and returns the value it replaced
+// and whether the key existed (it didn't if it was absent or deleted). The
+// previous value is read and replaced as a single write, under the lock of
+// the key's memory table shard: like Append, when the key is not in the
+// memory table every Swap pays for an LSM tree read (one block decode per
+// probed block) while blocking writers to the shard.
+func (e *Engine) Swap(key, value []byte) ([]byte, bool, error) {
+	defer e.watchdog.track("Swap")()
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.closed {
+		return nil, false, ErrEngineClosed
+	}
+
+	if e.readOnly {
+		return nil, false, ErrReadOnly
+	}
+
+	if err := checkKey(key); err != nil {
+		return nil, false, err
+	}
+
+	shard := e.memTable.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	old, existed, err := e.currentLocked(shard, key)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := e.putLocked(shard, key, value); err != nil {
+		return nil, false, err
+	}
+
+	e.userBytesWritten.Add(int64(len(key) + len(value)))
+	return old, existed, nil
+}
+
+// currentLocked returns the current value of key and whether it exists,
+// from the memory tables first (a nil value is a tombstone), then the LSM
+// tree. Callers must hold e.mu (shared) and shard.mu, which keeps the
+// value from being reclaimed from the value log before it is read.
+func (e *Engine) currentLocked(shard *memTableShard, key []byte) ([]byte, bool, error) {
+	current, ok := shard.get(key)
+	if !ok && e.flushingMemTable != nil {
+		current, ok = e.flushingMemTable.get(key)
+	}
+	if !ok {
+		var err error
+		current, err = e.lsm.Read(key)
+		if errors.Is(err, ErrKeyNotFound) {
+			return nil, false, nil
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to read current value: %w", err)
+		}
+	}
+	if current == nil {
+		return nil, false, nil
+	}
+
+	value, err := e.values.resolve(current)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read current value: %w", err)
+	}
+	return value, true, nil
+}
+
+// putLocked writes a key-value pair through the WAL to the memory table
+// shard of the key. Callers must hold e.mu (shared) and shard.mu, and have
+// validated the key. Holding the shard lock across the WAL append keeps
+// writes to one key in the same order in the WAL and the memory table.
+func (e *Engine) putLocked(shard *memTableShard, key, value []byte) error {
+	// A nil value would be indistinguishable from a tombstone
+	if value == nil {
+		value = []byte{}
+	}
+
+	// A value stored in the value log is synced before the WAL entry
+	// pointing to it
+	stored, err := e.values.store(value)
+	if err != nil {
+		return fmt.Errorf("failed to write to value log: %w", err)
+	}
+
+	if err := e.putStoredLocked(shard, key, stored); err != nil {
+		return err
+	}
+	e.indexes.update(key, value)
+	return nil
+}
+
+// putStoredLocked writes what is stored for a value, the value itself or a
+// pointer to it in the value log, like putLocked, leaving the secondary
+// indexes to the caller
+func (e *Engine) putStoredLocked(shard *memTableShard, key, stored []byte) error {
+	// Append to WAL first; the timestamp of the entry is the sequence
+	// number of the write
+	seq, err := e.wal.append(OpTypePut, key, stored)
+	if err != nil {
+		return fmt.Errorf("failed to append to WAL: %w", err)
+	}
+
+	// Update memory table
+	shard.put(key, stored, seq)
+	e.valueCache.invalidate(key)
+	e.maybeFlush()
+
+	return nil
+}
+
+// maybeFlush signals the background flusher once the memory table, summed
+// across shards, reaches its maximum size or number of keys, or its arenas
+// hold as many bytes as its maximum size. Callers must hold e.mu.
+func (e *Engine) maybeFlush() {
+	if e.memTable.size() >= e.maxMemTableSize || (e.maxMemTableKeys > 0 && e.memTable.keys() >= e.maxMemTableKeys) || e.memTable.arenaSize() >= e.maxMemTableSize {
+		// Signal background flusher
+		select {
+		case e.flushChan <- struct{}{}:
+			// Signal sent successfully
+		default:
+			// Channel is full, flush already queued
+		}
+	}
+
+}
+
+// checkKey validates a key passed to a write operation
+func checkKey(key []byte) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	if len(key) > MaxKeySize {
+		return fmt.Errorf("%w: %d bytes (max %d)", ErrKeyTooLarge, len(key), MaxKeySize)
+	}
+	return nil
+}
+
+// memoryLookup finds a key in the active memory table, then in the memory
+// table being flushed. Callers must hold e.mu.
+func (e *Engine) memoryLookup(key []byte) ([]byte, bool) {
+	if value, ok := e.memTable.get(key); ok {
+		return value, true
+	}
+	if e.flushingMemTable != nil {
+		return e.flushingMemTable.get(key)
+	}
+	return nil, false
+}
+
+// Get retrieves a value for a key.
+// It returns ErrKeyNotFound if the key does not exist or has been deleted.
+func (e *Engine) Get(key []byte) ([]byte, error) {
+	defer e.watchdog.track("Get")()
+
+	return e.get(context.Background(), key, e.readOnly)
+}
+
+// GetContext retrieves a value like Get, giving up with ctx's error once
+// ctx is done while the read waits for a block decode slot (see
+// Options.MaxConcurrentReads), e.g. when the client is gone
+func (e *Engine) GetContext(ctx context.Context, key []byte) ([]byte, error) {
+	defer e.watchdog.track("Get")()
+
+	return e.get(ctx, key, e.readOnly)
+}
+
+// ValueMeta describes the version of a value returned by GetWithMeta
+type ValueMeta struct {
+	// Sequence number of the value. Every write is numbered past the
+	// writes before it, so a key whose sequence number hasn't grown still
+	// holds the same value. The number may be greater than that of the
+	// write itself, e.g. that of a newer write to another key of the block
+	// the value was read from.
+	Sequence int64
+}
+
+// GetWithMeta retrieves a value like Get, with its sequence number, e.g.
+// to serve conditional reads of values that changed since a known version.
+func (e *Engine) GetWithMeta(key []byte) ([]byte, ValueMeta, error) {
+	defer e.watchdog.track("Get")()
+
+	value, seq, err := e.getWithMeta(key, e.readOnly)
+	return value, ValueMeta{Sequence: seq}, err
+}
+
+// getWithMeta implements GetWithMeta like get, bypassing the value cache,
+// which doesn't keep sequence numbers
+func (e *Engine) getWithMeta(key []byte, refresh bool) ([]byte, int64, error) {
+	// Keep the value from being reclaimed from the value log until it's read
+	defer e.values.readLock()()
+
+	stored, seq, err := e.getStoredWithMeta(key, refresh)
+	if err != nil {
+		return nil, 0, err
+	}
+	value, err := e.values.resolve(stored)
+	if refresh && errors.Is(err, ErrValueReclaimed) {
+		// The writer overwrote the key and reclaimed its value since
+		if err := e.refresh(); err != nil {
+			return nil, 0, err
+		}
+		return e.getWithMeta(key, false)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return value, seq, nil
+}
+
+// getStoredWithMeta looks up the stored value of key for getWithMeta,
+// which may be a value log pointer
+func (e *Engine) getStoredWithMeta(key []byte, refresh bool) ([]byte, int64, error) {
+	e.mu.RLock()
+
+	if e.closed {
+		e.mu.RUnlock()
+		return nil, 0, ErrEngineClosed
+	}
+	e.gets.Add(1)
+
+	// Check memory tables first (a nil value is a tombstone)
+	value, seq, ok := e.memTable.getMeta(key)
+	if !ok && e.flushingMemTable != nil {
+		value, seq, ok = e.flushingMemTable.getMeta(key)
+	}
+	e.mu.RUnlock()
+	if ok {
+		if value == nil {
+			return nil, 0, ErrKeyNotFound
+		}
+		return value, seq, nil
+	}
+
+	// Check LSM tree
+	value, seq, blocksRead, err := e.lsm.read(context.Background(), key)
+	e.blocksRead.Add(int64(blocksRead))
+
+	if refresh && errors.Is(err, os.ErrNotExist) {
+		if err := e.refresh(); err != nil {
+			return nil, 0, err
+		}
+		return e.getStoredWithMeta(key, false)
+	}
+	return value, seq, err
+}
+
+// GetWithStaleness retrieves a value like Get, unless the engine may lag
+// its writer by more than maxStaleness: a read-only engine following a
+// writer returns an error wrapping ErrTooStale if it last applied the WAL
+// longer ago than that. An engine open for writing is never stale.
+func (e *Engine) GetWithStaleness(key []byte, maxStaleness time.Duration) ([]byte, error) {
+	defer e.watchdog.track("Get")()
+
+	e.mu.RLock()
+	closed, staleness := e.closed, e.stalenessLocked()
+	e.mu.RUnlock()
+	if closed {
+		return nil, ErrEngineClosed
+	}
+	if staleness > maxStaleness {
+		return nil, fmt.Errorf("%w: %v behind the writer, more than %v", ErrTooStale, staleness.Round(time.Millisecond), maxStaleness)
+	}
+
+	return e.get(context.Background(), key, e.readOnly)
+}
+
+// Staleness returns how far a read-only engine may lag its writer: the time
+// since it last applied the WAL, or since the last entry it applied was
+// logged if that is later. It is zero for an engine open for writing.
+func (e *Engine) Staleness() time.Duration {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.stalenessLocked()
+}
+
+// stalenessLocked returns the staleness of the engine. Callers must hold
+// e.mu.
+func (e *Engine) stalenessLocked() time.Duration {
+	if !e.readOnly {
+		return 0
+	}
+	appliedAt := e.recoveredAt
+	if logged := time.Unix(0, e.lastCheckpointedWALTimestamp); logged.After(appliedAt) {
+		appliedAt = logged
+	}
+	return max(clockNow(e.opts.Clock).Sub(appliedAt), 0)
+}
+
+// get implements Get and GetContext. With refresh set, a read-only engine
+// refreshes and reads again once if a block was removed by the writer of
+// its directory since the last refresh.
+func (e *Engine) get(ctx context.Context, key []byte, refresh bool) ([]byte, error) {
+	// Keep the value from being reclaimed from the value log until it's read
+	defer e.values.readLock()()
+
+	stored, err := e.getStored(ctx, key, refresh)
+	if err != nil {
+		return nil, err
+	}
+	value, err := e.values.resolve(stored)
+	if refresh && errors.Is(err, ErrValueReclaimed) {
+		// The writer overwrote the key and reclaimed its value since
+		if err := e.refresh(); err != nil {
+			return nil, err
+		}
+		return e.get(ctx, key, false)
+	}
+	return value, err
+}
+
+// getStored looks up the stored value of key for get, which may be a value
+// log pointer. The value cache holds stored values, so it keeps pointers
+// rather than the large values they point to.
+func (e *Engine) getStored(ctx context.Context, key []byte, refresh bool) ([]byte, error) {
+	e.mu.RLock()
+
+	if e.closed {
+		e.mu.RUnlock()
+		return nil, ErrEngineClosed
+	}
+	e.gets.Add(1)
+
+	// Taken before the memory tables are checked, so a write to the key
+	// after that keeps the value read from the LSM tree out of the cache
+	generation := e.valueCache.generation(key)
+
+	// Check memory tables first (a nil value is a tombstone)
+	if value, ok := e.memoryLookup(key); ok {
+		e.mu.RUnlock()
+		if value == nil {
+			return nil, ErrKeyNotFound
+		}
+		return value, nil
+	}
+
+	// Release read lock before querying LSM tree
+	e.mu.RUnlock()
 
-	// Start background checkpointing goroutine
-	go engine.backgroundCheckpointer()
+	// Then the values cached from the LSM tree
+	if value, ok := e.valueCache.get(key); ok {
+		return value, nil
+	}
 
-	// Recover from checkpoint and WAL if needed
-	if err := engine.recover(); err != nil {
-		engine.Close()
-		return nil, fmt.Errorf("failed to recover from checkpoint/WAL: %w", err)
+	// Check LSM tree
+	value, _, blocksRead, err := e.lsm.read(ctx, key)
+	e.blocksRead.Add(int64(blocksRead))
+	if err == nil {
+		e.valueCache.add(key, value, generation)
 	}
 
-	return engine, nil
+	if refresh && errors.Is(err, os.ErrNotExist) {
+		if err := e.refresh(); err != nil {
+			return nil, err
+		}
+		return e.getStored(ctx, key, false)
+	}
+	return value, err
 }
 
-// recover loads the memory table from checkpoint and replays the WAL
-func (e *Engine) recover() error {
-	// First, try to load from checkpoint
-	memTable, memTableSize, lastWALTimestamp, err := e.checkpoint.Load()
-	if err != nil {
-		return fmt.Errorf("failed to load checkpoint: %w", err)
+// GetFromLevel reads the value of key held by a single LSM level, ignoring
+// the memory tables and every other level, to show where each version of
+// a key lives when debugging reads. It returns ErrKeyNotFound if the
+// level's blocks don't contain the key or hold a tombstone for it, and
+// ErrValueReclaimed for an overwritten value reclaimed from the value log.
+func (e *Engine) GetFromLevel(key []byte, level int) ([]byte, error) {
+	e.mu.RLock()
+	closed := e.closed
+	e.mu.RUnlock()
+	if closed {
+		return nil, ErrEngineClosed
 	}
 
-	// Set memory table from checkpoint
-	e.memTable = memTable
-	e.memTableSize = memTableSize
-	e.lastCheckpointedWALTimestamp = lastWALTimestamp
+	value, err := e.lsm.ReadLevel(key, level)
+	if err != nil {
+		return nil, err
+	}
+	return e.values.resolve(value)
+}
 
-	// Then, replay WAL entries after the checkpoint
-	return e.wal.ReplayFrom(lastWALTimestamp, func(entry WALEntry) error {
-		switch entry.OpType {
-		case OpTypePut:
-			e.memTable[string(entry.Key)] = entry.Value
-			e.memTableSize += int64(len(entry.Key) + len(entry.Value))
-		case OpTypeDelete:
-			delete(e.memTable, string(entry.Key))
+// History returns the writes of key recorded in the WAL, oldest first.
+// See WAL.HistoryOf for its limits. The values of overwritten writes may
+// have been reclaimed from the value log, which fails with
+// ErrValueReclaimed.
+func (e *Engine) History(key []byte) ([]WALEntry, error) {
+	entries, err := e.wal.HistoryOf(key)
+	if err != nil {
+		return nil, err
+	}
+	for i, entry := range entries {
+		if entry.OpType != OpTypePut {
+			continue
 		}
-		e.lastCheckpointedWALTimestamp = entry.Timestamp
-		return nil
-	})
+		if entries[i].Value, err = e.values.resolve(entry.Value); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
 }
 
-// Put stores a key-value pair
-func (e *Engine) Put(key, value []byte) error {
-	e.mu.Lock()
-	defer e.mu.Unlock()
+// Delete removes a key-value pair
+func (e *Engine) Delete(key []byte) error {
+	defer e.watchdog.track("Delete")()
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
 
 	if e.closed {
-		return fmt.Errorf("engine is closed")
+		return ErrEngineClosed
 	}
 
-	// Append to WAL first
-	if err := e.wal.AppendPut(key, value); err != nil {
-		return fmt.Errorf("failed to append to WAL: %w", err)
+	if e.readOnly {
+		return ErrReadOnly
 	}
 
-	// Update memory table
-	oldSize := int64(0)
-	if oldValue, ok := e.memTable[string(key)]; ok {
-		oldSize = int64(len(oldValue))
+	if err := checkKey(key); err != nil {
+		return err
 	}
 
-	e.memTable[string(key)] = value
-	e.memTableSize += int64(len(key)+len(value)) - oldSize
+	shard := e.memTable.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
 
-	// Check if memory table needs to be flushed
-	if e.memTableSize >= e.maxMemTableSize {
-		// Signal background flusher
-		select {
-		case e.flushChan <- struct{}{}:
-			// Signal sent successfully
-		default:
-			// Channel is full, flush already queued
-		}
+	if err := e.deleteLocked(shard, key); err != nil {
+		return err
 	}
 
+	e.userBytesWritten.Add(int64(len(key)))
 	return nil
 }
 
-// Get retrieves a value for a key
-func (e *Engine) Get(key []byte) ([]byte, error) {
+// TakeDelete removes a key like Delete, and returns the value it removed
+// and whether the key existed (it didn't if it was absent or deleted
+// already). Like Swap, the previous value is read and deleted as a single
+// write, and reading it may cost an LSM tree read under the shard lock.
+func (e *Engine) TakeDelete(key []byte) ([]byte, bool, error) {
+	defer e.watchdog.track("TakeDelete")()
+
 	e.mu.RLock()
+	defer e.mu.RUnlock()
 
 	if e.closed {
-		e.mu.RUnlock()
-		return nil, fmt.Errorf("engine is closed")
+		return nil, false, ErrEngineClosed
 	}
 
-	// Check memory table first
-	if value, ok := e.memTable[string(key)]; ok {
-		e.mu.RUnlock()
-		return value, nil
+	if e.readOnly {
+		return nil, false, ErrReadOnly
 	}
 
-	// Release read lock before querying LSM tree
-	e.mu.RUnlock()
+	if err := checkKey(key); err != nil {
+		return nil, false, err
+	}
 
-	// Check LSM tree
-	return e.lsm.Read(key)
+	shard := e.memTable.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	old, existed, err := e.currentLocked(shard, key)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := e.deleteLocked(shard, key); err != nil {
+		return nil, false, err
+	}
+
+	e.userBytesWritten.Add(int64(len(key)))
+	return old, existed, nil
 }
 
-// Delete removes a key-value pair
-func (e *Engine) Delete(key []byte) error {
-	e.mu.Lock()
-	defer e.mu.Unlock()
+// DeleteBatch removes several keys like Delete, and returns how many of
+// them existed (a key listed twice counts once). The tombstones are
+// appended to the WAL together and synced once, while holding the locks of
+// the memory table shards of every key: either all of them are applied, or
+// none if writing them fails. A crash before the sync, i.e. before
+// DeleteBatch returns, may still leave some of them in the WAL. Every key
+// is validated before any is deleted.
+func (e *Engine) DeleteBatch(keys [][]byte) (int, error) {
+	defer e.watchdog.track("DeleteBatch")()
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
 
 	if e.closed {
-		return fmt.Errorf("engine is closed")
+		return 0, ErrEngineClosed
 	}
 
-	// Append to WAL first
-	if err := e.wal.AppendDelete(key); err != nil {
-		return fmt.Errorf("failed to append to WAL: %w", err)
+	if e.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	// Group the distinct keys by shard
+	byShard := make(map[int][][]byte)
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if err := checkKey(key); err != nil {
+			return 0, err
+		}
+		if seen[string(key)] {
+			continue
+		}
+		seen[string(key)] = true
+		i := e.memTable.shardIndex(key)
+		byShard[i] = append(byShard[i], key)
+	}
+
+	// Lock the shards in index order, so concurrent batches can't deadlock
+	shards := make([]int, 0, len(byShard))
+	for i := range byShard {
+		shards = append(shards, i)
+	}
+	sort.Ints(shards)
+	for _, i := range shards {
+		shard := &e.memTable.shards[i]
+		shard.mu.Lock()
+		defer shard.mu.Unlock()
+	}
+
+	// Count the keys that exist, then delete them all
+	existed := 0
+	batch := make([][]byte, 0, len(seen))
+	for _, i := range shards {
+		for _, key := range byShard[i] {
+			_, ok, err := e.currentLocked(&e.memTable.shards[i], key)
+			if err != nil {
+				return 0, err
+			}
+			if ok {
+				existed++
+			}
+			batch = append(batch, key)
+		}
+	}
+	seqs, err := e.wal.appendDeletes(batch)
+	if err != nil {
+		return 0, fmt.Errorf("failed to append to WAL: %w", err)
+	}
+
+	for i, key := range batch {
+		e.memTable.shard(key).put(key, nil, seqs[i])
+		e.valueCache.invalidate(key)
+		e.indexes.update(key, nil)
+		e.userBytesWritten.Add(int64(len(key)))
 	}
+	e.maybeFlush()
+
+	return existed, nil
+}
 
-	// Update memory table (use a tombstone value)
-	oldSize := int64(0)
-	if oldValue, ok := e.memTable[string(key)]; ok {
-		oldSize = int64(len(oldValue))
+// deleteLocked writes a tombstone for key through the WAL to the memory
+// table shard of the key, like putLocked. Callers must hold e.mu (shared)
+// and shard.mu, and have validated the key.
+func (e *Engine) deleteLocked(shard *memTableShard, key []byte) error {
+	// Append to WAL first
+	seq, err := e.wal.append(OpTypeDelete, key, nil)
+	if err != nil {
+		return fmt.Errorf("failed to append to WAL: %w", err)
 	}
 
-	// Remove from memory table
-	delete(e.memTable, string(key))
-	e.memTableSize -= oldSize
+	// Record a tombstone (a nil value) in the memory table rather than
+	// removing the key, so that it shadows older versions of the key that
+	// were already flushed to the LSM tree
+	shard.put(key, nil, seq)
+	e.valueCache.invalidate(key)
+	e.indexes.update(key, nil)
+	e.maybeFlush()
 
 	return nil
 }
 
-// backgroundFlusher is a goroutine that flushes the memory table to disk
+// backgroundFlusher is a goroutine that flushes the memory table to disk.
+// It runs until Close closes flushChan, completing a flush queued before.
 func (e *Engine) backgroundFlusher() {
+	defer e.background.Done()
+
 	for range e.flushChan {
+		if err := e.flush(); err != nil {
+			fmt.Printf("Error flushing memory table: %v\n", err)
+		}
+	}
+}
+
+// backgroundAgeFlusher is a goroutine that signals the background flusher
+// once the oldest write in the memory table is older than MaxMemTableAge,
+// and the memory table holds at least MinFlushSize bytes
+func (e *Engine) backgroundAgeFlusher() {
+	defer e.background.Done()
+
+	// Check a few times per interval, so a flush starts soon after the age is reached
+	ticker := time.NewTicker(max(e.opts.MaxMemTableAge/4, time.Millisecond))
+	defer ticker.Stop()
+
+	for range ticker.C {
+		e.mu.RLock()
 		if e.closed {
+			e.mu.RUnlock()
 			return
 		}
 
-		if err := e.flush(); err != nil {
-			fmt.Printf("Error flushing memory table: %v\n", err)
+		oldest := e.memTable.oldestEntry()
+		if !oldest.IsZero() && clockNow(e.opts.Clock).Sub(oldest) >= e.opts.MaxMemTableAge && e.memTable.size() >= e.opts.MinFlushSize {
+			select {
+			case e.flushChan <- struct{}{}:
+			default:
+				// Flush already queued
+			}
 		}
+		e.mu.RUnlock()
 	}
 }
 
-// backgroundCheckpointer is a goroutine that creates checkpoints periodically
+// backgroundCheckpointer is a goroutine that creates checkpoints
+// periodically, until Close closes checkpointChan
 func (e *Engine) backgroundCheckpointer() {
+	defer e.background.Done()
+
 	ticker := time.NewTicker(e.checkpointInterval)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
-			// Create checkpoint if engine is not closed
-			if !e.closed {
-				if err := e.createCheckpoint(); err != nil {
-					fmt.Printf("Error creating checkpoint: %v\n", err)
-				}
-			}
-		case <-e.checkpointChan:
+		case _, ok := <-e.checkpointChan:
 			// Create checkpoint on demand
-			if !e.closed {
-				if err := e.createCheckpoint(); err != nil {
-					fmt.Printf("Error creating checkpoint: %v\n", err)
-				}
+			if !ok {
+				return
 			}
 		}
 
-		if e.closed {
-			return
+		if err := e.createCheckpoint(); err != nil {
+			fmt.Printf("Error creating checkpoint: %v\n", err)
 		}
 	}
 }
 
 // createCheckpoint creates a checkpoint of the current memory table
 func (e *Engine) createCheckpoint() error {
+	defer e.watchdog.track("checkpoint")()
+
 	e.mu.RLock()
 	defer e.mu.RUnlock()
 
-	// Create a copy of the memory table
-	memTableCopy := make(map[string][]byte, len(e.memTable))
-	for k, v := range e.memTable {
-		memTableCopy[k] = v
+	// Save a copy of the memory table
+	memTable := e.memTable.copy()
+	if err := e.checkpoint.Save(memTable, e.memTable.size(), e.lastCheckpointedWALTimestamp); err != nil {
+		return err
 	}
 
-	// Save checkpoint
-	return e.checkpoint.Save(memTableCopy, e.memTableSize, e.lastCheckpointedWALTimestamp)
+	e.events.emit(Event{Type: EventCheckpointCreated, Path: e.checkpoint.path, Keys: len(memTable)})
+	return nil
 }
 
-// flush flushes the memory table to disk
+// flush flushes the memory table to disk. If writing a block fails (e.g.
+// on a full disk), the entries are moved back into the memory table, so
+// they stay readable and are flushed again later.
 func (e *Engine) flush() error {
+	if e.readOnly {
+		return ErrReadOnly
+	}
+
+	defer e.watchdog.track("flush")()
+
+	e.flushMu.Lock()
+	defer e.flushMu.Unlock()
+
+	_, err := e.flushLocked()
+	return err
+}
+
+// flushLocked implements flush, returning the WAL timestamp at which the
+// memory table was moved aside: every write logged to the WAL before it is
+// in the flushed blocks, every later one in the new memory table. Callers
+// must hold e.flushMu.
+func (e *Engine) flushLocked() (swapped int64, err error) {
 	e.mu.Lock()
 
-	// Create a copy of the memory table
+	// Move the memory table aside; reads keep seeing it until the blocks are
+	// written. Writes log and apply their entries under e.mu, so the WAL
+	// orders them around the swap whatever the clock says.
+	swapped = e.wal.reserveTimestamp()
 	memTable := e.memTable
+	e.flushingMemTable = memTable
 
 	// Reset memory table
-	e.memTable = make(map[string][]byte)
-	e.memTableSize = 0
+	e.memTable = memTable.empty()
 
 	e.mu.Unlock()
 
-	// Convert memory table to a block
-	b := block.NewBlock()
+	defer func() {
+		e.mu.Lock()
+		if err != nil {
+			e.memTable.restore(memTable)
+		}
+		e.flushingMemTable = nil
+		e.mu.Unlock()
+	}()
+
+	// Merge the pairs from the shards in key order
+	keys, values := memTable.sorted(nil, nil)
+	if len(keys) == 0 {
+		return swapped, nil
+	}
+
+	// Time and report the flushes that write blocks
+	start := time.Now()
+	blocks := 0
+	written := e.lsm.bytesWritten.Load()
+	e.events.emit(Event{Type: EventFlushStarted, Keys: len(keys)})
+	defer func() {
+		e.events.emit(Event{
+			Type:     EventFlushFinished,
+			Keys:     len(keys),
+			Blocks:   blocks,
+			Bytes:    e.lsm.bytesWritten.Load() - written,
+			Duration: time.Since(start),
+			Err:      err,
+		})
+		if err != nil {
+			return
+		}
+		elapsed := time.Since(start).Nanoseconds()
+		e.flushes.Add(1)
+		e.flushNanos.Add(elapsed)
+		e.lastFlushNanos.Store(elapsed)
+	}()
+
+	// Write the pairs to the LSM tree
+	// Tombstones keep the time of their delete: the sequence number of a
+	// write is the time of its WAL entry
+	deletedAt := func(key []byte) int64 {
+		_, seq, _ := memTable.getMeta(key)
+		return seq
+	}
+	err = e.writeBlocks(keys, values, deletedAt, memTable.maxSequence(), func(b *block.Block) error {
+		if err := e.lsm.Write(b); err != nil {
+			return err
+		}
+		blocks++
+		return nil
+	})
+	return swapped, err
+}
+
+// writeBlocks converts pairs sorted by key to blocks and passes them to
+// write, filling one block per compression type at a time, with the size of
+// its serialized pairs. A block is written once it reaches the target size,
+// so the blocks of each compression type cover consecutive, non-overlapping
+// key ranges. The blocks are given the sequence number of the newest write
+// of the pairs, and each tombstone (nil value) the time of its delete, which
+// deletedAt returns for its key.
+func (e *Engine) writeBlocks(keys, values [][]byte, deletedAt func(key []byte) int64, sequence int64, write func(b *block.Block) error) error {
+	blocks := make(map[block.CompressionType]*block.Block)
+	sizes := make(map[block.CompressionType]int)
+
+	for i, key := range keys {
+		value := values[i]
+		compression := e.opts.compressionFor(key)
+		b, ok := blocks[compression]
+		if !ok {
+			b = block.NewBlock()
+			b.Header.CompressionType = compression
+			b.Header.HashType = e.opts.BlockHasher
+			b.SetSequence(sequence)
+			if e.opts.ValueChecksums {
+				b.Header.Flags |= block.FlagValueChecksums
+			}
+			if e.opts.TombstoneGracePeriod > 0 {
+				b.Header.Flags |= block.FlagTombstoneTimes
+			}
+			if e.opts.SplitBlockLayout {
+				b.Header.Flags |= block.FlagSplitLayout
+			}
+			blocks[compression] = b
+			sizes[compression] = 4 // Pair count
+		}
 
-	// Add all key-value pairs to the block
-	for key, value := range memTable {
-		if err := b.Add([]byte(key), value); err != nil {
+		var err error
+		if value == nil {
+			err = b.AddTombstone(key, deletedAt(key))
+		} else {
+			err = b.Add(key, value)
+		}
+		if err != nil {
 			return fmt.Errorf("failed to add key-value pair to block: %w", err)
 		}
+		sizes[compression] += 4 + len(key) + 4 + len(value)
+		if e.opts.ValueChecksums && value != nil {
+			sizes[compression] += 4 // Value checksum
+		}
+		if e.opts.TombstoneGracePeriod > 0 && value == nil {
+			sizes[compression] += 8 // Tombstone time
+		}
+
+		if e.opts.TargetBlockSize > 0 && sizes[compression] >= e.opts.TargetBlockSize {
+			if err := write(b); err != nil {
+				return fmt.Errorf("failed to write block: %w", err)
+			}
+			delete(blocks, compression)
+		}
 	}
 
-	// Write the block to the LSM tree
-	if err := e.lsm.Write(b); err != nil {
-		return fmt.Errorf("failed to write block to LSM tree: %w", err)
+	// Write the remaining blocks
+	for _, b := range blocks {
+		if err := write(b); err != nil {
+			return fmt.Errorf("failed to write block: %w", err)
+		}
 	}
 
 	return nil
 }
 
-// Close closes the storage engine and releases resources
+// abortOpen releases what NewEngineWithOptions acquired once recovery
+// failed, before any background work started. Unlike Close, it neither
+// flushes nor checkpoints the partly recovered memory table, so the
+// directory is left for a later open to recover again.
+func (e *Engine) abortOpen() {
+	e.closed = true
+	e.compaction.Stop()
+
+	if err := e.wal.Close(); err != nil {
+		fmt.Printf("Error closing WAL: %v\n", err)
+	}
+	if err := e.lsm.Close(); err != nil {
+		fmt.Printf("Error closing LSM tree: %v\n", err)
+	}
+	if err := e.values.close(); err != nil {
+		fmt.Printf("Error closing value log: %v\n", err)
+	}
+	e.events.close()
+	if err := e.lock.release(); err != nil {
+		fmt.Printf("Error releasing directory lock: %v\n", err)
+	}
+	e.watchdog.close()
+}
+
+// Poisoned returns the error, wrapping ErrEnginePoisoned, that every write
+// fails with since the WAL failed to sync, or nil if it never did. Reads
+// keep working; reopening the engine replays the WAL and accepts writes
+// again.
+func (e *Engine) Poisoned() error {
+	return e.wal.poisonErr()
+}
+
+// Close closes the storage engine and releases resources. It waits up to
+// Options.CloseTimeout for an in-flight background flush or compaction to
+// complete, then flushes the memory table, creates a final checkpoint and
+// closes the WAL and the LSM tree. If the background work doesn't complete
+// in time, Close returns ErrCloseTimeout and leaves the WAL and the LSM tree
+// open, so the work can't lose data; the WAL still holds every write.
 func (e *Engine) Close() error {
 	e.mu.Lock()
-	defer e.mu.Unlock()
 
 	if e.closed {
+		e.mu.Unlock()
 		return nil
 	}
 
 	// Set closed flag
 	e.closed = true
 
-	// Create final checkpoint
-	if err := e.createCheckpoint(); err != nil {
-		fmt.Printf("Error creating final checkpoint during close: %v\n", err)
+	// A read-only engine has only its refresh to stop, and nothing to write
+	if e.readOnly {
+		close(e.stopRefresh)
+		e.mu.Unlock()
+		e.background.Wait()
+		e.values.close()
+		return e.lsm.Close()
+	}
+
+	// Stop the background goroutines. Writers send on the channels while
+	// holding e.mu and checking closed, so no send follows.
+	close(e.flushChan)
+	close(e.checkpointChan)
+	e.mu.Unlock()
+
+	// Wait for a queued flush and the running compactions to complete
+	stopped := make(chan struct{})
+	go func() {
+		e.background.Wait()
+		e.compaction.Stop()
+		close(stopped)
+	}()
+	var timeout <-chan time.Time
+	if e.opts.CloseTimeout > 0 {
+		timer := time.NewTimer(e.opts.CloseTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-stopped:
+	case <-timeout:
+		return fmt.Errorf("%w: flush or compaction still running after %v", ErrCloseTimeout, e.opts.CloseTimeout)
 	}
 
 	// Flush memory table
@@ -344,12 +1741,10 @@ func (e *Engine) Close() error {
 		fmt.Printf("Error flushing memory table during close: %v\n", err)
 	}
 
-	// Close flush and checkpoint channels
-	close(e.flushChan)
-	close(e.checkpointChan)
-
-	// Stop compaction workers
-	e.compaction.Stop()
+	// Create final checkpoint, holding whatever the flush left behind
+	if err := e.createCheckpoint(); err != nil {
+		fmt.Printf("Error creating final checkpoint during close: %v\n", err)
+	}
 
 	// Close WAL
 	if err := e.wal.Close(); err != nil {
@@ -361,6 +1756,27 @@ func (e *Engine) Close() error {
 		fmt.Printf("Error closing LSM tree: %v\n", err)
 	}
 
+	// Close value log
+	if err := e.values.close(); err != nil {
+		fmt.Printf("Error closing value log: %v\n", err)
+	}
+
+	// Save the secondary indexes, which are rebuilt on open otherwise
+	if err := e.indexes.save(); err != nil {
+		fmt.Printf("Error saving indexes: %v\n", err)
+	}
+
+	// Deliver the remaining events
+	e.events.close()
+
+	// Let another writer open the directory
+	if err := e.lock.release(); err != nil {
+		fmt.Printf("Error releasing directory lock: %v\n", err)
+	}
+
+	// Stop reporting hangs; a Close that timed out keeps reporting them
+	e.watchdog.close()
+
 	return nil
 }
 
@@ -380,6 +1796,103 @@ type Stats struct {
 
 	// LSM tree level block counts
 	LevelBlocks [7]int
+
+	// Compaction score of each level; the level with the highest score of
+	// at least 1 is compacted next
+	CompactionScores [7]float64
+
+	// Recovery statistics from when the engine was opened
+	Recovery RecoveryStats
+
+	// Number of iterators that have not been closed yet
+	OpenIterators int64
+
+	// Number of block files kept open for reads
+	OpenBlockFiles int
+
+	// Write and read amplification
+	Amplification AmplificationStats
+
+	// Memory table flushes
+	Flush FlushStats
+
+	// Value cache hits and misses
+	ValueCache ValueCacheStats
+
+	// Values stored in the value log
+	ValueLog ValueLogStats
+
+	// Compression of the blocks in the LSM tree
+	Compression CompressionStats
+}
+
+// CompressionStats measures how much block compression saves, across the
+// blocks currently in the LSM tree
+type CompressionStats struct {
+	// Bytes of block data before compression
+	RawSizeBytes int64
+
+	// Bytes of block data as stored, compressed or not
+	StoredSizeBytes int64
+
+	// RawSizeBytes divided by StoredSizeBytes: 1 when nothing is
+	// compressed, higher the more compression saves. Zero without blocks.
+	CompressionRatio float64
+}
+
+// FlushStats describes the memory table flushes since the engine was opened.
+// Flushes of an empty memory table and failed flushes are not counted.
+type FlushStats struct {
+	// Number of flushes
+	Count int64
+
+	// Duration of the last flush
+	LastDuration time.Duration
+
+	// Total and average duration of the flushes
+	TotalDuration   time.Duration
+	AverageDuration time.Duration
+
+	// Bytes of blocks written by the flushes (also in
+	// AmplificationStats.FlushBytesWritten)
+	BytesWritten int64
+}
+
+// AmplificationStats measures how much work the engine does per user operation
+type AmplificationStats struct {
+	// Bytes of keys and values written by users
+	UserBytesWritten int64
+
+	// Bytes written to the WAL, to flushed blocks and by compaction
+	WALBytesWritten        int64
+	FlushBytesWritten      int64
+	CompactionBytesWritten int64
+
+	// Bytes written to disk per byte written by users
+	WriteAmplification float64
+
+	// Number of Get calls and blocks they read
+	Gets       int64
+	BlocksRead int64
+
+	// Average number of blocks read per Get (memory table hits read none)
+	ReadAmplification float64
+
+	// Bytes of the blocks in the LSM tree, and an estimate of the bytes of
+	// live data among them: the largest sorted run of the deepest level
+	// holding blocks, which holds each live key once after a major
+	// compaction, while the levels above hold overwrites and deletes
+	DiskBytes int64
+	LiveBytes int64
+
+	// DiskBytes divided by LiveBytes: near 1 after a major compaction, and
+	// higher the more space one would reclaim. Zero without blocks.
+	SpaceAmplification float64
+}
+
+// Levels returns the blocks of each LSM tree level, for debugging
+func (e *Engine) Levels() []LevelInfo {
+	return e.lsm.Levels()
 }
 
 // GetStats returns statistics about the storage engine
@@ -388,24 +1901,144 @@ func (e *Engine) GetStats() Stats {
 	defer e.mu.RUnlock()
 
 	stats := Stats{
-		MemTableSize:    e.memTableSize,
-		MemTableKeys:    len(e.memTable),
+		MemTableSize:    e.memTable.size(),
+		MemTableKeys:    e.memTable.len(),
 		CompactionStats: e.compaction.GetStats(),
+		Recovery:        e.recoveryStats,
+		OpenIterators:   e.openIterators.Load(),
+		OpenBlockFiles:  e.lsm.files.openFiles(),
+		ValueCache:      e.valueCache.stats(),
+		ValueLog:        e.values.stats(),
+	}
+
+	// Compactions run by the LSM tree itself
+	stats.CompactionStats.BytesRead += e.lsm.compactionBytesRead.Load()
+	stats.CompactionStats.BytesWritten += e.lsm.compactionBytesWritten.Load()
+
+	amp := &stats.Amplification
+	amp.UserBytesWritten = e.userBytesWritten.Load()
+	amp.WALBytesWritten = e.wal.bytesWritten.Load()
+	amp.FlushBytesWritten = e.lsm.bytesWritten.Load()
+	amp.CompactionBytesWritten = stats.CompactionStats.BytesWritten
+	if amp.UserBytesWritten > 0 {
+		diskBytes := amp.WALBytesWritten + amp.FlushBytesWritten + amp.CompactionBytesWritten
+		amp.WriteAmplification = float64(diskBytes) / float64(amp.UserBytesWritten)
+	}
+	amp.Gets = e.gets.Load()
+	amp.BlocksRead = e.blocksRead.Load()
+	if amp.Gets > 0 {
+		amp.ReadAmplification = float64(amp.BlocksRead) / float64(amp.Gets)
 	}
 
+	flush := &stats.Flush
+	flush.Count = e.flushes.Load()
+	flush.LastDuration = time.Duration(e.lastFlushNanos.Load())
+	flush.TotalDuration = time.Duration(e.flushNanos.Load())
+	if flush.Count > 0 {
+		flush.AverageDuration = flush.TotalDuration / time.Duration(flush.Count)
+	}
+	flush.BytesWritten = amp.FlushBytesWritten
+
+	stats.CompactionScores = e.lsm.CompactionScores()
+
 	// Calculate level sizes and block counts
+	e.lsm.mu.RLock()
+	defer e.lsm.mu.RUnlock()
 	for i := 0; i < 7; i++ {
 		stats.LevelBlocks[i] = len(e.lsm.levels[i])
 
 		for _, block := range e.lsm.levels[i] {
 			stats.LevelSizes[i] += block.size
+			stats.Compression.RawSizeBytes += block.rawSize
+			stats.Compression.StoredSizeBytes += block.storedSize
+		}
+	}
+	if stats.Compression.StoredSizeBytes > 0 {
+		stats.Compression.CompressionRatio = float64(stats.Compression.RawSizeBytes) / float64(stats.Compression.StoredSizeBytes)
+	}
+
+	// Estimate the live data from the deepest level holding blocks
+	for _, size := range stats.LevelSizes {
+		amp.DiskBytes += size
+	}
+	for level := 6; level >= 0 && amp.LiveBytes == 0; level-- {
+		for _, run := range e.lsm.levelRuns(level) {
+			var size int64
+			for _, block := range run {
+				size += block.size
+			}
+			amp.LiveBytes = max(amp.LiveBytes, size)
 		}
 	}
+	if amp.LiveBytes > 0 {
+		amp.SpaceAmplification = float64(amp.DiskBytes) / float64(amp.LiveBytes)
+	}
 
 	return stats
 }
 
 // RunCompaction manually triggers a compaction cycle
 func (e *Engine) RunCompaction() error {
+	// Close stops the compaction workers once it has set closed, so they
+	// keep accepting tasks while e.mu is held
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.closed {
+		return ErrEngineClosed
+	}
+	if e.readOnly {
+		return ErrReadOnly
+	}
+
 	return e.compaction.RunCompaction()
 }
+
+// SetCompactionWorkers changes the number of background compaction workers
+// (4 when the engine is opened) to n, which must be positive. Surplus
+// workers finish their current compaction first, and SetCompactionWorkers
+// waits for them.
+func (e *Engine) SetCompactionWorkers(n int) error {
+	e.mu.RLock()
+	closed := e.closed
+	e.mu.RUnlock()
+	if closed {
+		return ErrEngineClosed
+	}
+	if e.readOnly {
+		return ErrReadOnly
+	}
+
+	return e.compaction.SetWorkers(n)
+}
+
+// CompactionPlan returns the compaction tasks RunCompaction would schedule,
+// most urgent first, without running them: each cycle schedules the first
+// task whose levels aren't busy with a running one, and that
+// Options.CompactionSchedule allows at the time. It helps tune the
+// compaction thresholds before changing them.
+func (e *Engine) CompactionPlan() ([]CompactionTaskPlan, error) {
+	e.mu.RLock()
+	closed := e.closed
+	e.mu.RUnlock()
+	if closed {
+		return nil, ErrEngineClosed
+	}
+
+	return e.lsm.CompactionPlan(), nil
+}
+
+// CompactRange compacts the blocks of level overlapping the key range
+// [start, end] into the next level, e.g. to reshape the tree after a bulk
+// load. A nil start or end leaves that side unbounded. Level 0 blocks
+// overlapping the selected ones are compacted with them.
+func (e *Engine) CompactRange(level int, start, end []byte) error {
+	e.mu.RLock()
+	closed := e.closed
+	e.mu.RUnlock()
+	if closed {
+		return ErrEngineClosed
+	}
+
+	return e.lsm.CompactRange(level, start, end)
+}
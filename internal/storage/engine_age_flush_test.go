@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestEngine_FlushByAge checks a memory table far below its size limit is
+// flushed once its oldest write is older than MaxMemTableAge
+func TestEngine_FlushByAge(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-age-flush-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		opts := DefaultOptions()
+		opts.MaxMemTableAge = 50 * time.Millisecond
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+		defer engine.Close()
+
+		if !engine.memTable.oldestEntry().IsZero() {
+			t.Errorf("Expected an empty memory table to have no oldest entry")
+		}
+
+		start := time.Now()
+		if err := engine.Put([]byte("key"), []byte("value")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		if oldest := engine.memTable.oldestEntry(); oldest.Before(start) || oldest.After(time.Now()) {
+			t.Errorf("Unexpected oldest entry time %v", oldest)
+		}
+
+		// Wait for the block to appear in level 0
+		for engine.GetStats().LevelBlocks[0] == 0 {
+			if time.Since(start) > 5*time.Second {
+				t.Errorf("Memory table was not flushed by age")
+				done <- true
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		if elapsed := time.Since(start); elapsed < opts.MaxMemTableAge {
+			t.Errorf("Expected the flush after %v, got it after %v", opts.MaxMemTableAge, elapsed)
+		}
+
+		if keys := engine.GetStats().MemTableKeys; keys != 0 {
+			t.Errorf("Expected an empty memory table after the flush, got %d keys", keys)
+		}
+		if value, err := engine.Get([]byte("key")); err != nil || string(value) != "value" {
+			t.Errorf("Expected the flushed value, got %q (err %v)", value, err)
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+// TestEngine_FlushCoalescing writes bursts of a few keys separated by more
+// than MaxMemTableAge, and checks that with MinFlushSize the bursts are
+// coalesced into fewer, larger level 0 blocks than one block per burst
+func TestEngine_FlushCoalescing(t *testing.T) {
+	const (
+		bursts   = 12
+		perBurst = 10
+		pairSize = 20 // key-NN-NN and value-NN-NN
+	)
+
+	// run applies the workload to a new engine, returning the number of
+	// level 0 blocks and their total size
+	run := func(minFlushSize int64) (int, int64) {
+		tempDir, err := os.MkdirTemp("", "river-flush-coalescing-test")
+		if err != nil {
+			t.Errorf("Failed to create temp dir: %v", err)
+			return 0, 0
+		}
+		defer os.RemoveAll(tempDir)
+
+		opts := DefaultOptions()
+		opts.MaxMemTableAge = 10 * time.Millisecond
+		opts.MinFlushSize = minFlushSize
+		opts.L0CompactionTrigger = 0
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			return 0, 0
+		}
+		defer engine.Close()
+
+		for burst := 0; burst < bursts; burst++ {
+			for i := 0; i < perBurst; i++ {
+				if err := engine.Put([]byte(fmt.Sprintf("key-%02d-%02d", burst, i)), []byte(fmt.Sprintf("value-%02d-%02d", burst, i))); err != nil {
+					t.Errorf("Failed to put: %v", err)
+				}
+			}
+			time.Sleep(4 * opts.MaxMemTableAge)
+		}
+
+		for burst := 0; burst < bursts; burst++ {
+			key := fmt.Sprintf("key-%02d-00", burst)
+			if value, err := engine.Get([]byte(key)); err != nil || string(value) != fmt.Sprintf("value-%02d-00", burst) {
+				t.Errorf("Expected %s to be readable, got %q (err %v)", key, value, err)
+			}
+		}
+
+		engine.lsm.mu.RLock()
+		defer engine.lsm.mu.RUnlock()
+		var size int64
+		for _, info := range engine.lsm.levels[0] {
+			size += info.size
+		}
+		return len(engine.lsm.levels[0]), size
+	}
+
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+
+		// Every burst is flushed on its own
+		tiny, tinySize := run(0)
+		if tiny < bursts/2 {
+			t.Errorf("Expected about one level 0 block per burst without coalescing, got %d", tiny)
+		}
+
+		// Four bursts fill a flush
+		coalesced, coalescedSize := run(4 * perBurst * pairSize)
+		if coalesced == 0 || coalesced > bursts/4 {
+			t.Errorf("Expected at most %d coalesced level 0 blocks, got %d", bursts/4, coalesced)
+		}
+		if tiny == 0 || coalesced == 0 || coalescedSize/int64(coalesced) <= tinySize/int64(tiny) {
+			t.Errorf("Expected larger coalesced blocks, got %d blocks of %d bytes vs %d of %d bytes", coalesced, coalescedSize, tiny, tinySize)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestEngine_Amplification runs a known workload and checks the write and
+// read amplification reported in Stats
+func TestEngine_Amplification(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-amplification-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		engine, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+		defer engine.Close()
+
+		put := func(key, value string) {
+			if err := engine.Put([]byte(key), []byte(value)); err != nil {
+				t.Errorf("Failed to put: %v", err)
+			}
+		}
+		flush := func() {
+			if err := engine.flush(); err != nil {
+				t.Errorf("Failed to flush: %v", err)
+			}
+		}
+
+		// Two overlapping L0 blocks: [k1, k3] then [k0, k4]
+		put("k1", "v")
+		put("k3", "v")
+		flush()
+		put("k0", "v")
+		put("k4", "v")
+		flush()
+		put("k5", "v")
+
+		amp := engine.GetStats().Amplification
+		if amp.UserBytesWritten != 5*3 {
+			t.Errorf("Expected 15 user bytes, got %d", amp.UserBytesWritten)
+		}
+		if amp.WALBytesWritten <= amp.UserBytesWritten || amp.FlushBytesWritten == 0 {
+			t.Errorf("Expected WAL and flush writes, got %+v", amp)
+		}
+		if amp.WriteAmplification <= 1 {
+			t.Errorf("Expected write amplification > 1, got %f", amp.WriteAmplification)
+		}
+
+		// k1 is in the range of both blocks and found in the older one,
+		// k4 is found in the newer block, k5 in the memory table
+		for _, key := range []string{"k1", "k4", "k5"} {
+			if _, err := engine.Get([]byte(key)); err != nil {
+				t.Errorf("Failed to get %s: %v", key, err)
+			}
+		}
+
+		amp = engine.GetStats().Amplification
+		if amp.Gets != 3 || amp.BlocksRead != 3 {
+			t.Errorf("Expected 3 gets reading 3 blocks, got %d gets reading %d blocks", amp.Gets, amp.BlocksRead)
+		}
+		if amp.ReadAmplification != 1 {
+			t.Errorf("Expected read amplification 1, got %f", amp.ReadAmplification)
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+// TestEngine_SpaceAmplification overwrites every key of a compacted engine
+// several times and checks the space amplification reported in Stats is
+// well above 1 until a major compaction brings it back near 1
+func TestEngine_SpaceAmplification(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-space-amplification-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+
+		opts := DefaultOptions()
+		opts.L0CompactionTrigger = 0
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			return
+		}
+		defer engine.Close()
+
+		// writeAll writes every key with a value of the given generation
+		// and flushes it into a new level 0 block
+		writeAll := func(generation int) {
+			for i := 0; i < 500; i++ {
+				value := fmt.Sprintf("value-%d-%0100d", generation, i)
+				if err := engine.Put([]byte(fmt.Sprintf("key-%04d", i)), []byte(value)); err != nil {
+					t.Errorf("Failed to put: %v", err)
+				}
+			}
+			if err := engine.flush(); err != nil {
+				t.Errorf("Failed to flush: %v", err)
+			}
+		}
+
+		// compactAll compacts every level into the next, down to the last
+		compactAll := func() {
+			for level := 0; level < 6; level++ {
+				if err := engine.CompactRange(level, nil, nil); err != nil {
+					t.Errorf("Failed to compact L%d: %v", level, err)
+				}
+			}
+		}
+
+		if amp := engine.GetStats().Amplification; amp.SpaceAmplification != 0 {
+			t.Errorf("Expected no space amplification without blocks, got %f", amp.SpaceAmplification)
+		}
+
+		writeAll(0)
+		compactAll()
+		if amp := engine.GetStats().Amplification; amp.SpaceAmplification < 0.99 || amp.SpaceAmplification > 1.01 {
+			t.Errorf("Expected space amplification 1 after a major compaction, got %+v", amp)
+		}
+
+		for generation := 1; generation <= 4; generation++ {
+			writeAll(generation)
+		}
+		amp := engine.GetStats().Amplification
+		if amp.SpaceAmplification < 4 {
+			t.Errorf("Expected space amplification near 5 after overwriting every key 4 times, got %+v", amp)
+		}
+
+		compactAll()
+		amp = engine.GetStats().Amplification
+		if amp.SpaceAmplification < 0.99 || amp.SpaceAmplification > 1.01 {
+			t.Errorf("Expected space amplification 1 after a major compaction, got %+v", amp)
+		}
+		if value, err := engine.Get([]byte("key-0042")); err != nil || string(value) != fmt.Sprintf("value-4-%0100d", 42) {
+			t.Errorf("Expected the last overwrite of key-0042, got %q (err %v)", value, err)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// TestEngine_Append appends to absent, memory-table-resident, flushed and deleted keys
+func TestEngine_Append(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-append-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		engine, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+		defer engine.Close()
+
+		expect := func(key, expected string) {
+			value, err := engine.Get([]byte(key))
+			if err != nil {
+				t.Errorf("Failed to get %q: %v", key, err)
+				return
+			}
+			if string(value) != expected {
+				t.Errorf("Expected %q for %q, got %q", expected, key, value)
+			}
+		}
+
+		// Absent key starts from an empty value
+		if err := engine.Append([]byte("log"), []byte("a")); err != nil {
+			t.Errorf("Failed to append: %v", err)
+		}
+		expect("log", "a")
+
+		// Memory-table-resident key
+		if err := engine.Append([]byte("log"), []byte("b")); err != nil {
+			t.Errorf("Failed to append: %v", err)
+		}
+		expect("log", "ab")
+
+		// Flushed key
+		if err := engine.flush(); err != nil {
+			t.Errorf("Failed to flush: %v", err)
+		}
+		if err := engine.Append([]byte("log"), []byte("c")); err != nil {
+			t.Errorf("Failed to append: %v", err)
+		}
+		expect("log", "abc")
+
+		// Deleted key starts over, even though an older value was flushed
+		if err := engine.flush(); err != nil {
+			t.Errorf("Failed to flush: %v", err)
+		}
+		if err := engine.Delete([]byte("log")); err != nil {
+			t.Errorf("Failed to delete: %v", err)
+		}
+		if err := engine.Append([]byte("log"), []byte("d")); err != nil {
+			t.Errorf("Failed to append: %v", err)
+		}
+		expect("log", "d")
+
+		// The appended value is replayed from the WAL as a single put
+		crash(engine)
+		reopened, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to reopen engine: %v", err)
+			done <- true
+			return
+		}
+		defer reopened.Close()
+
+		if value, err := reopened.Get([]byte("log")); err != nil || string(value) != "d" {
+			t.Errorf("Expected %q after recovery, got %q (err %v)", "d", value, err)
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
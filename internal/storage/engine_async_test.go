@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestEngine_PutAsync issues many asynchronous puts, waits for their
+// futures, and checks the keys are readable and survive a reopen
+func TestEngine_PutAsync(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-async-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		engine, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+		defer engine.Close()
+
+		// Small WAL files, so files rotate while entries are pending
+		engine.wal.mu.Lock()
+		engine.wal.maxSize = 4096
+		engine.wal.mu.Unlock()
+
+		const numWriters, putsPerWriter = 4, 250
+		futures := make([][]<-chan error, numWriters)
+		var wg sync.WaitGroup
+		for w := 0; w < numWriters; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < putsPerWriter; i++ {
+					key := fmt.Sprintf("key-%d-%03d", w, i)
+					futures[w] = append(futures[w], engine.PutAsync([]byte(key), []byte("value-"+key)))
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		// A synchronous write to a key with an async write still in flight wins
+		engine.PutAsync([]byte("key-0-000"), []byte("async"))
+		if err := engine.Put([]byte("key-0-000"), []byte("sync")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+
+		for _, writerFutures := range futures {
+			for _, future := range writerFutures {
+				if err := <-future; err != nil {
+					t.Errorf("Async put failed: %v", err)
+				}
+			}
+		}
+		if err := <-engine.PutAsync(nil, []byte("value")); err == nil {
+			t.Errorf("Expected an error for an empty key")
+		}
+
+		// expectAll checks every key in an engine
+		expectAll := func(e *Engine) {
+			for w := 0; w < numWriters; w++ {
+				for i := 0; i < putsPerWriter; i++ {
+					key := fmt.Sprintf("key-%d-%03d", w, i)
+					expected := "value-" + key
+					if key == "key-0-000" {
+						expected = "sync"
+					}
+					if value, err := e.Get([]byte(key)); err != nil || string(value) != expected {
+						t.Errorf("Expected %s=%s, got %q (err %v)", key, expected, value, err)
+						return
+					}
+				}
+			}
+		}
+		expectAll(engine)
+
+		// The completed writes are in the WAL on disk
+		crash(engine)
+		reopened, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to reopen engine: %v", err)
+			done <- true
+			return
+		}
+		defer reopened.Close()
+		expectAll(reopened)
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
@@ -0,0 +1,265 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// bulkImportKeys is the number of keys the bulk import tests import
+const bulkImportKeys = 100000
+
+// importDirs returns the names of the import staging directories left in
+// the data directory of the engine in baseDir
+func importDirs(t *testing.T, baseDir string) []string {
+	files, err := os.ReadDir(filepath.Join(baseDir, "data"))
+	if err != nil {
+		t.Errorf("Failed to read data directory: %v", err)
+		return nil
+	}
+	var dirs []string
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), importDirPrefix) {
+			dirs = append(dirs, file.Name())
+		}
+	}
+	return dirs
+}
+
+// TestBulkImport imports 100k keys, overriding a key written before the
+// import, and checks they are readable after the barrier and all durable:
+// present after reopening without closing, as after a crash. A key written
+// during the import keeps the value written then.
+func TestBulkImport(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-bulk-import-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// A small memory table stages the import in several batches, a block each
+	opts := DefaultOptions()
+	opts.MaxMemTableSize = 1024 * 1024
+	opts.TargetBlockSize = 1024 * 1024
+
+	done := make(chan bool)
+	go func() {
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+		defer engine.Close()
+
+		if err := engine.Put([]byte("bulk-key-000000"), []byte("before")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+
+		err = engine.BulkImport(func(w BulkWriter) error {
+			for i := 0; i < bulkImportKeys; i++ {
+				key := fmt.Sprintf("bulk-key-%06d", i)
+				if err := w.Put([]byte(key), []byte("imported-"+key)); err != nil {
+					return err
+				}
+			}
+			return engine.Put([]byte("bulk-key-000001"), []byte("during"))
+		})
+		if err != nil {
+			t.Errorf("Failed to import: %v", err)
+			done <- true
+			return
+		}
+		if dirs := importDirs(t, tempDir); len(dirs) != 0 {
+			t.Errorf("Expected the staging directory to be removed, got %v", dirs)
+		}
+
+		// A sample of the keys is readable as soon as the import returns
+		for i := 0; i < bulkImportKeys; i += 10000 {
+			key := fmt.Sprintf("bulk-key-%06d", i)
+			if value, err := engine.Get([]byte(key)); err != nil || string(value) != "imported-"+key {
+				t.Errorf("Expected %s=imported-%s, got %q (err %v)", key, key, value, err)
+			}
+		}
+		if value, err := engine.Get([]byte("bulk-key-000001")); err != nil || string(value) != "during" {
+			t.Errorf("Expected the write made during the import to be kept, got %q (err %v)", value, err)
+		}
+
+		// Reopen without closing, as after a crash
+		crash(engine)
+		reopened, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to reopen engine: %v", err)
+			done <- true
+			return
+		}
+		defer reopened.Close()
+
+		// Every key is durable: scan the reopened engine and check it holds
+		// each imported key, with its expected value, and nothing else
+		it, err := reopened.NewIterator(context.Background(), IteratorOptions{})
+		if err != nil {
+			t.Errorf("Failed to create iterator: %v", err)
+			done <- true
+			return
+		}
+		defer it.Close()
+
+		i := 0
+		for ; it.Next(); i++ {
+			key := fmt.Sprintf("bulk-key-%06d", i)
+			expected := "imported-" + key
+			if i == 1 {
+				expected = "during"
+			}
+			if string(it.Key()) != key || string(it.Value()) != expected {
+				t.Errorf("Expected %s=%s, got %s=%s", key, expected, it.Key(), it.Value())
+				break
+			}
+		}
+		if err := it.Err(); err != nil {
+			t.Errorf("Failed to scan: %v", err)
+		}
+		if i != bulkImportKeys {
+			t.Errorf("Expected %d keys after reopening, got %d", bulkImportKeys, i)
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+// TestBulkImport_NoBarrier stages 100k keys and reopens the directory, as
+// after a crash, before the import's barrier runs: the partial import is
+// discarded
+func TestBulkImport_NoBarrier(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-bulk-import-crash-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	opts := DefaultOptions()
+	opts.MaxMemTableSize = 1024 * 1024
+	opts.TargetBlockSize = 1024 * 1024
+
+	done := make(chan bool)
+	go func() {
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+		defer engine.Close()
+
+		if err := engine.Put([]byte("kept"), []byte("value")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+
+		errCrash := errors.New("crash")
+		err = engine.BulkImport(func(w BulkWriter) error {
+			for i := 0; i < bulkImportKeys; i++ {
+				key := fmt.Sprintf("bulk-key-%06d", i)
+				if err := w.Put([]byte(key), []byte("imported-"+key)); err != nil {
+					return err
+				}
+			}
+			if err := w.(*bulkWriter).stage(); err != nil {
+				return err
+			}
+			if len(importDirs(t, tempDir)) != 1 {
+				t.Errorf("Expected the import to be staged")
+			}
+
+			// Reopen without closing, as after a crash
+			crash(engine)
+			reopened, err := NewEngineWithOptions(tempDir, opts)
+			if err != nil {
+				return err
+			}
+			defer reopened.Close()
+
+			if dirs := importDirs(t, tempDir); len(dirs) != 0 {
+				t.Errorf("Expected the staging directory to be discarded, got %v", dirs)
+			}
+			for i := 0; i < bulkImportKeys; i += 10000 {
+				key := fmt.Sprintf("bulk-key-%06d", i)
+				if value, err := reopened.Get([]byte(key)); !errors.Is(err, ErrKeyNotFound) {
+					t.Errorf("Expected %s to be absent, got %q (err %v)", key, value, err)
+				}
+			}
+			if value, err := reopened.Get([]byte("kept")); err != nil || string(value) != "value" {
+				t.Errorf("Expected the write before the import to be kept, got %q (err %v)", value, err)
+			}
+			return errCrash
+		})
+		if !errors.Is(err, errCrash) {
+			t.Errorf("Expected the import to fail with %v, got %v", errCrash, err)
+		}
+
+		// The failed import is discarded by the engine itself too
+		if value, err := engine.Get([]byte("bulk-key-000000")); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected the failed import to be discarded, got %q (err %v)", value, err)
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+// TestBulkImport_TruncatedMarker checks that opening the engine fails with
+// ErrCorrupt when an import marker in the WAL is too short to hold the
+// timestamp of the last flushed write
+func TestBulkImport_TruncatedMarker(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-bulk-import-marker-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+
+		engine, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			return
+		}
+		if _, err := engine.wal.append(OpTypeImport, []byte(importDirPrefix+"1"), []byte{1, 2, 3}); err != nil {
+			t.Errorf("Failed to append import marker: %v", err)
+		}
+
+		// Reopen without closing, as after a crash
+		crash(engine)
+		reopened, err := NewEngine(tempDir)
+		if err == nil {
+			reopened.Close()
+		}
+		if !errors.Is(err, ErrCorrupt) {
+			t.Errorf("Expected ErrCorrupt for a truncated import marker, got %v", err)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestEngine_ValueChecksums corrupts one value in a block file and checks
+// only that key fails to read
+func TestEngine_ValueChecksums(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-checksum-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		engine, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+		defer engine.Close()
+
+		values := map[string]string{
+			"a": "first-value",
+			"b": "second-value",
+			"c": "third-value",
+		}
+		for key, value := range values {
+			if err := engine.Put([]byte(key), []byte(value)); err != nil {
+				t.Errorf("Failed to put: %v", err)
+			}
+		}
+		if err := engine.flush(); err != nil {
+			t.Errorf("Failed to flush: %v", err)
+		}
+
+		// Flip a byte of b's value in the block file
+		paths, _ := filepath.Glob(filepath.Join(tempDir, "data", "L0", "*.blk"))
+		if len(paths) != 1 {
+			t.Errorf("Expected one block file, got %v", paths)
+			done <- true
+			return
+		}
+		data, err := os.ReadFile(paths[0])
+		if err != nil {
+			t.Errorf("Failed to read block file: %v", err)
+		}
+		i := bytes.Index(data, []byte("second-value"))
+		if i < 0 {
+			t.Errorf("Value not found in the block file")
+			done <- true
+			return
+		}
+		data[i] ^= 0xff
+		if err := os.WriteFile(paths[0], data, 0644); err != nil {
+			t.Errorf("Failed to write block file: %v", err)
+		}
+
+		if _, err := engine.Get([]byte("b")); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("Expected ErrCorrupt for the corrupt value, got %v", err)
+		}
+		for _, key := range []string{"a", "c"} {
+			if value, err := engine.Get([]byte(key)); err != nil || string(value) != values[key] {
+				t.Errorf("Expected %s=%s, got %q (err %v)", key, values[key], value, err)
+			}
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
@@ -0,0 +1,281 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that only moves when advanced
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// Now returns the time of the clock
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// advance moves the clock forward by d
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// TestEngine_Clock expires a tombstone by advancing a fake clock past the
+// grace period instead of sleeping, and checks writes logged while the
+// clock stands still are recovered from the WAL after a checkpoint
+func TestEngine_Clock(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-clock-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+
+		opts := DefaultOptions()
+		opts.L0CompactionTrigger = 0
+		opts.TombstoneGracePeriod = time.Hour
+		opts.Clock = clock
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			return
+		}
+
+		// compactToBottom flushes the memory table and compacts every level
+		// into the next, down to the last level
+		compactToBottom := func() {
+			if err := engine.flush(); err != nil {
+				t.Errorf("Failed to flush: %v", err)
+			}
+			for level := 0; level < 6; level++ {
+				if err := engine.CompactRange(level, nil, nil); err != nil {
+					t.Errorf("Failed to compact L%d: %v", level, err)
+				}
+			}
+		}
+
+		// tombstoneAt returns the creation time of the tombstone of key in
+		// the last level, or zero if there is none
+		tombstoneAt := func(key string) int64 {
+			engine.lsm.mu.RLock()
+			defer engine.lsm.mu.RUnlock()
+			for _, info := range engine.lsm.levels[6] {
+				b, err := engine.lsm.files.loadBlock(info.path)
+				if err != nil {
+					t.Errorf("Failed to read block: %v", err)
+					return 0
+				}
+				for i := 0; i < b.Count(); i++ {
+					if k, value := b.Pair(i); string(k) == key && value == nil {
+						return b.DeletedAt(i)
+					}
+				}
+			}
+			return 0
+		}
+
+		for _, key := range []string{"deleted", "kept"} {
+			if err := engine.Put([]byte(key), []byte("value")); err != nil {
+				t.Errorf("Failed to put: %v", err)
+			}
+		}
+		if err := engine.flush(); err != nil {
+			t.Errorf("Failed to flush: %v", err)
+		}
+		if err := engine.Delete([]byte("deleted")); err != nil {
+			t.Errorf("Failed to delete: %v", err)
+		}
+		compactToBottom()
+
+		// The tombstone keeps the time of the delete by the fake clock: that
+		// of its WAL entry, which a clock standing still numbers past the
+		// writes before it
+		history, err := engine.History([]byte("deleted"))
+		if err != nil || len(history) == 0 {
+			t.Errorf("Failed to read the history of the deleted key: %v", err)
+		} else if at, deleted := tombstoneAt("deleted"), history[len(history)-1].Timestamp; at != deleted || deleted-clock.Now().UnixNano() > 3 {
+			t.Errorf("Expected the tombstone to be created at %d, about %d, got %d", deleted, clock.Now().UnixNano(), at)
+		}
+
+		// Advancing the clock past the grace period expires it
+		clock.advance(2 * time.Hour)
+		if err := engine.Put([]byte("kept"), []byte("value2")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		compactToBottom()
+		if at := tombstoneAt("deleted"); at != 0 {
+			t.Errorf("Expected the expired tombstone to be dropped, got one created at %d", at)
+		}
+
+		// The clock stands still across a checkpoint of the recovered
+		// engine, yet the writes logged after it are replayed
+		crash(engine)
+		engine, err = NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to reopen engine: %v", err)
+			return
+		}
+		if err := engine.createCheckpoint(); err != nil {
+			t.Errorf("Failed to save checkpoint: %v", err)
+		}
+		if err := engine.Put([]byte("after"), []byte("checkpoint")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		crash(engine)
+
+		engine, err = NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to reopen engine: %v", err)
+			return
+		}
+		defer engine.Close()
+		if value, err := engine.Get([]byte("after")); err != nil || string(value) != "checkpoint" {
+			t.Errorf("Expected after=checkpoint to be recovered, got %q (err %v)", value, err)
+		}
+		if _, err := engine.Get([]byte("deleted")); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected ErrKeyNotFound for the deleted key, got %v", err)
+		}
+		if value, err := engine.Get([]byte("kept")); err != nil || string(value) != "value2" {
+			t.Errorf("Expected kept=value2, got %q (err %v)", value, err)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+// TestEngine_ClockBulkImport imports a key over an older write, with a fake
+// clock behind and ahead of the system clock, and checks after a crash that
+// the import replaces the older write and a write made during the import
+// is kept
+func TestEngine_ClockBulkImport(t *testing.T) {
+	for _, now := range []time.Time{
+		time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC),
+	} {
+		tempDir, err := os.MkdirTemp("", "river-clock-import-test")
+		if err != nil {
+			t.Fatalf("Failed to create temp dir: %v", err)
+		}
+		defer os.RemoveAll(tempDir)
+
+		done := make(chan bool)
+		go func() {
+			defer func() { done <- true }()
+
+			opts := DefaultOptions()
+			opts.Clock = &fakeClock{now: now}
+			engine, err := NewEngineWithOptions(tempDir, opts)
+			if err != nil {
+				t.Errorf("Failed to create engine: %v", err)
+				return
+			}
+
+			if err := engine.Put([]byte("imported"), []byte("before")); err != nil {
+				t.Errorf("Failed to put: %v", err)
+			}
+			err = engine.BulkImport(func(w BulkWriter) error {
+				if err := engine.Put([]byte("concurrent"), []byte("value")); err != nil {
+					return err
+				}
+				return w.Put([]byte("imported"), []byte("after"))
+			})
+			if err != nil {
+				t.Errorf("Failed to import: %v", err)
+			}
+			crash(engine)
+
+			engine, err = NewEngineWithOptions(tempDir, opts)
+			if err != nil {
+				t.Errorf("Failed to reopen engine: %v", err)
+				return
+			}
+			defer engine.Close()
+			if value, err := engine.Get([]byte("imported")); err != nil || string(value) != "after" {
+				t.Errorf("Expected imported=after with the clock at %v, got %q (err %v)", now, value, err)
+			}
+			if value, err := engine.Get([]byte("concurrent")); err != nil || string(value) != "value" {
+				t.Errorf("Expected concurrent=value with the clock at %v, got %q (err %v)", now, value, err)
+			}
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Test timed out after 10 seconds")
+		}
+	}
+}
+
+// TestEngine_ClockFlushByAge checks the age of the memory table is told by
+// the fake clock: it isn't flushed while the clock stands still, and is
+// once the clock is advanced past MaxMemTableAge
+func TestEngine_ClockFlushByAge(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-clock-age-flush-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+
+		opts := DefaultOptions()
+		opts.MaxMemTableAge = 20 * time.Millisecond
+		opts.Clock = clock
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			return
+		}
+		defer engine.Close()
+
+		if err := engine.Put([]byte("key"), []byte("value")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		if oldest := engine.memTable.oldestEntry(); !oldest.Equal(clock.Now()) {
+			t.Errorf("Expected the oldest entry at %v, got %v", clock.Now(), oldest)
+		}
+
+		// The flusher checks the age several times while the clock stands still
+		time.Sleep(5 * opts.MaxMemTableAge)
+		if blocks := engine.GetStats().LevelBlocks[0]; blocks != 0 {
+			t.Errorf("Expected no flush while the clock stands still, got %d blocks", blocks)
+		}
+
+		clock.advance(opts.MaxMemTableAge)
+		start := time.Now()
+		for engine.GetStats().LevelBlocks[0] == 0 {
+			if time.Since(start) > 5*time.Second {
+				t.Errorf("Memory table was not flushed after advancing the clock")
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestEngine_CloseDrainsFlush writes enough to queue background flushes,
+// closes right away and checks every write survives a reopen
+func TestEngine_CloseDrainsFlush(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-close-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		opts := DefaultOptions()
+		opts.MaxMemTableSize = 4 * 1024
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+
+		const numKeys = 500
+		for i := 0; i < numKeys; i++ {
+			key := []byte(fmt.Sprintf("close-key-%03d", i))
+			if err := engine.Put(key, []byte(fmt.Sprintf("value-%03d", i))); err != nil {
+				t.Errorf("Failed to put key: %v", err)
+			}
+		}
+		if err := engine.Close(); err != nil {
+			t.Errorf("Failed to close engine: %v", err)
+		}
+		if err := engine.Put([]byte("late"), []byte("value")); !errors.Is(err, ErrEngineClosed) {
+			t.Errorf("Expected ErrEngineClosed after close, got %v", err)
+		}
+
+		reopened, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to reopen engine: %v", err)
+			done <- true
+			return
+		}
+		defer reopened.Close()
+
+		for i := 0; i < numKeys; i++ {
+			key := []byte(fmt.Sprintf("close-key-%03d", i))
+			value, err := reopened.Get(key)
+			if err != nil || string(value) != fmt.Sprintf("value-%03d", i) {
+				t.Errorf("Expected %s to survive the close, got %q (err %v)", key, value, err)
+			}
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+// TestEngine_CloseTimeout checks Close gives up on a flush that doesn't
+// complete within CloseTimeout
+func TestEngine_CloseTimeout(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-close-timeout-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		opts := DefaultOptions()
+		opts.MaxMemTableSize = 1
+		opts.CloseTimeout = 100 * time.Millisecond
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+
+		// Hold up the background flush queued by the write
+		engine.flushMu.Lock()
+		if err := engine.Put([]byte("key"), []byte("value")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+
+		start := time.Now()
+		if err := engine.Close(); !errors.Is(err, ErrCloseTimeout) {
+			t.Errorf("Expected ErrCloseTimeout, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed < opts.CloseTimeout {
+			t.Errorf("Expected Close to wait %v, returned after %v", opts.CloseTimeout, elapsed)
+		}
+		engine.flushMu.Unlock()
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
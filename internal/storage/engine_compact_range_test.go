@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestEngine_CompactRange bulk loads level 0 and compacts key sub-ranges
+// into level 1, checking only the blocks of those ranges move
+func TestEngine_CompactRange(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-compact-range-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		engine, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+		defer engine.Close()
+
+		// load flushes keys [from, to) with value as one level 0 block
+		load := func(from, to int, value string) {
+			for i := from; i < to; i++ {
+				if err := engine.Put([]byte(fmt.Sprintf("key-%03d", i)), []byte(value)); err != nil {
+					t.Errorf("Failed to put: %v", err)
+				}
+			}
+			if err := engine.flush(); err != nil {
+				t.Errorf("Failed to flush: %v", err)
+			}
+		}
+
+		// ranges returns the key ranges of a level's blocks
+		ranges := func(level int) string {
+			var r []string
+			for _, b := range engine.Levels()[level].Blocks {
+				r = append(r, b.MinKey+".."+b.MaxKey)
+			}
+			return fmt.Sprint(r)
+		}
+
+		// Four disjoint blocks; only the one holding [key-030, key-040] moves
+		for from := 0; from < 100; from += 25 {
+			load(from, from+25, "v1")
+		}
+		if err := engine.CompactRange(0, []byte("key-030"), []byte("key-040")); err != nil {
+			t.Errorf("Failed to compact range: %v", err)
+		}
+		if got, expected := ranges(0), "[key-000..key-024 key-050..key-074 key-075..key-099]"; got != expected {
+			t.Errorf("Expected L0 blocks %s, got %s", expected, got)
+		}
+		if got, expected := ranges(1), "[key-025..key-049]"; got != expected {
+			t.Errorf("Expected L1 blocks %s, got %s", expected, got)
+		}
+
+		// A newer block overlapping key-050..key-074 moves with it, so the
+		// older values there can't shadow it from level 0
+		load(45, 56, "v2")
+		if err := engine.CompactRange(0, []byte("key-060"), []byte("key-060")); err != nil {
+			t.Errorf("Failed to compact range: %v", err)
+		}
+		if got, expected := ranges(0), "[key-000..key-024 key-075..key-099]"; got != expected {
+			t.Errorf("Expected L0 blocks %s, got %s", expected, got)
+		}
+		if got, expected := ranges(1), "[key-025..key-074]"; got != expected {
+			t.Errorf("Expected L1 blocks %s, got %s", expected, got)
+		}
+		for i := 0; i < 100; i++ {
+			expected := "v1"
+			if i >= 45 && i < 56 {
+				expected = "v2"
+			}
+			key := []byte(fmt.Sprintf("key-%03d", i))
+			if value, err := engine.Get(key); err != nil || string(value) != expected {
+				t.Errorf("Expected %s=%s, got %q (err %v)", key, expected, value, err)
+			}
+		}
+
+		// A range without blocks is a no-op, and the last level has no level below
+		if err := engine.CompactRange(2, nil, nil); err != nil {
+			t.Errorf("Expected compacting an empty level to succeed, got %v", err)
+		}
+		if err := engine.CompactRange(6, nil, nil); err == nil {
+			t.Errorf("Expected an error compacting the last level")
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
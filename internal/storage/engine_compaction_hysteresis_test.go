@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// hysteresisRun is the outcome of a workload under a compaction low watermark
+type hysteresisRun struct {
+	// Number of rounds in which level 1 was compacted
+	rounds int
+
+	// Number of compactions of level 1
+	compactions int
+}
+
+// runHysteresisWorkload flushes a small block of new keys per round and
+// compacts it into level 1, which keeps level 1 growing up to its threshold
+// again and again, then runs the planned compactions. It checks a round
+// only compacts level 1 once it crossed its threshold, and leaves it below
+// its low watermark.
+func runHysteresisWorkload(t *testing.T, lowWatermark float64) hysteresisRun {
+	tempDir, err := os.MkdirTemp("", "river-compaction-hysteresis-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	opts := DefaultOptions()
+	opts.TargetBlockSize = 512
+	opts.CompactionLowWatermark = lowWatermark
+	engine, err := NewEngineWithOptions(tempDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to create engine: %v", err)
+	}
+	defer engine.Close()
+
+	engine.lsm.mu.Lock()
+	engine.lsm.compactionThresholds[1] = 8192
+	engine.lsm.mu.Unlock()
+
+	var result hysteresisRun
+	value := strings.Repeat("v", 40)
+	for round := 0; round < 60; round++ {
+		for i := 0; i < 16; i++ {
+			key := fmt.Sprintf("key-%03d-%02d", round, i)
+			if err := engine.Put([]byte(key), []byte(value)); err != nil {
+				t.Errorf("Failed to put: %v", err)
+			}
+		}
+		if err := engine.flush(); err != nil {
+			t.Errorf("Failed to flush: %v", err)
+		}
+
+		engine.lsm.mergeMu.Lock()
+		engine.lsm.mu.Lock()
+		task := compactionTask{sourceLevel: 0, targetLevel: 1, blocks: engine.lsm.levels[0]}
+		if err := engine.lsm.runTask(task); err != nil {
+			t.Errorf("Round %d: failed to compact L0: %v", round, err)
+		}
+
+		// Level 1 is compacted once it reaches its threshold, and then
+		// until it is below its low watermark
+		crossed := engine.lsm.shouldCompact(1)
+		compacted := false
+		for tasks := engine.lsm.planner.plan(engine.lsm); len(tasks) > 0; tasks = engine.lsm.planner.plan(engine.lsm) {
+			if tasks[0].sourceLevel == 1 {
+				if !crossed {
+					t.Errorf("Round %d: L1 compacted at %d bytes, below its threshold", round, engine.lsm.levelSize(1))
+				}
+				result.compactions++
+				compacted = true
+			}
+			if err := engine.lsm.runTask(tasks[0]); err != nil {
+				t.Errorf("Round %d: failed to compact: %v", round, err)
+				break
+			}
+		}
+		if compacted {
+			result.rounds++
+			if size, low := engine.lsm.levelSize(1), engine.lsm.lowWatermark(1); size >= low {
+				t.Errorf("Round %d: expected L1 below its low watermark of %d bytes, got %d", round, low, size)
+			}
+		}
+		engine.lsm.mu.Unlock()
+		engine.lsm.mergeMu.Unlock()
+	}
+
+	return result
+}
+
+// TestCompactionHysteresis checks that with a low watermark, a level kept
+// near its compaction threshold by steady writes is compacted in fewer
+// rounds than without: each compaction brings it well below the threshold
+func TestCompactionHysteresis(t *testing.T) {
+	done := make(chan bool)
+	go func() {
+		without := runHysteresisWorkload(t, 0)
+		with := runHysteresisWorkload(t, 0.5)
+		t.Logf("Without low watermark: %+v, with: %+v", without, with)
+
+		if without.rounds == 0 || with.rounds == 0 {
+			t.Errorf("Expected L1 to be compacted, got %d and %d rounds", without.rounds, with.rounds)
+		}
+		if with.rounds*2 > without.rounds {
+			t.Errorf("Expected the low watermark to at least halve the rounds compacting L1, got %d and %d",
+				with.rounds, without.rounds)
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
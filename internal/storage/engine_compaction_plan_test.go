@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestEngine_CompactionPlan sets up a level 0 over its threshold on top of
+// a level 1 block, and checks the plan lists its compaction into level 1
+// without running it
+func TestEngine_CompactionPlan(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-compaction-plan-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		opts := DefaultOptions()
+		opts.L0CompactionTrigger = 0
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+
+		// putAndFlush writes keys [from, to) and flushes them into a block
+		putAndFlush := func(from, to int) {
+			for i := from; i < to; i++ {
+				if err := engine.Put([]byte(fmt.Sprintf("key-%03d", i)), []byte("value")); err != nil {
+					t.Errorf("Failed to put: %v", err)
+				}
+			}
+			if err := engine.flush(); err != nil {
+				t.Errorf("Failed to flush: %v", err)
+			}
+		}
+
+		// A level 1 block, and three level 0 blocks overlapping it
+		putAndFlush(0, 100)
+		if err := engine.CompactRange(0, nil, nil); err != nil {
+			t.Errorf("Failed to compact L0: %v", err)
+		}
+		putAndFlush(0, 10)
+		putAndFlush(10, 20)
+		putAndFlush(200, 210)
+
+		if plan, err := engine.CompactionPlan(); err != nil || len(plan) != 0 {
+			t.Errorf("Expected an empty plan with every level under its threshold, got %+v (err %v)", plan, err)
+		}
+
+		// Level 0 over its threshold
+		engine.lsm.mu.Lock()
+		engine.lsm.compactionThresholds[0] = 1
+		levels := engine.lsm.levels
+		engine.lsm.mu.Unlock()
+		var expectedBytes int64
+		for _, info := range append(levels[0], levels[1]...) {
+			expectedBytes += info.size
+		}
+
+		plan, err := engine.CompactionPlan()
+		if err != nil || len(plan) != 1 {
+			t.Errorf("Expected a single planned task, got %+v (err %v)", plan, err)
+		} else {
+			expected := CompactionTaskPlan{
+				SourceLevel:    0,
+				TargetLevel:    1,
+				Blocks:         3,
+				TargetBlocks:   1,
+				EstimatedBytes: expectedBytes,
+			}
+			if plan[0] != expected {
+				t.Errorf("Expected task %+v, got %+v", expected, plan[0])
+			}
+		}
+
+		// Planning runs nothing
+		engine.lsm.mu.RLock()
+		if len(engine.lsm.levels[0]) != 3 || len(engine.lsm.levels[1]) != 1 {
+			t.Errorf("Expected the levels to be left alone, got %d and %d blocks", len(engine.lsm.levels[0]), len(engine.lsm.levels[1]))
+		}
+		engine.lsm.mu.RUnlock()
+
+		if err := engine.Close(); err != nil {
+			t.Errorf("Failed to close engine: %v", err)
+		}
+		if _, err := engine.CompactionPlan(); !errors.Is(err, ErrEngineClosed) {
+			t.Errorf("Expected ErrEngineClosed after closing, got %v", err)
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestEngine_CompactionRateLimit compacts about 1MB of blocks with a
+// 400KB/s limit and checks the measured throughput stays at the limit
+func TestEngine_CompactionRateLimit(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-compaction-rate-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		const limit = 400 * 1024
+		opts := DefaultOptions()
+		opts.CompactionMaxBytesPerSec = limit
+		opts.L0CompactionTrigger = 2
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+		defer engine.Close()
+
+		// Two interleaved blocks of 256KB each
+		value := bytes.Repeat([]byte("v"), 4096)
+		for round := 0; round < 2; round++ {
+			for i := 0; i < 64; i++ {
+				if err := engine.Put([]byte(fmt.Sprintf("key-%02d-%d", i, round)), value); err != nil {
+					t.Errorf("Failed to put: %v", err)
+				}
+			}
+			if err := engine.flush(); err != nil {
+				t.Errorf("Failed to flush: %v", err)
+			}
+		}
+
+		start := time.Now()
+		engine.lsm.runCompaction()
+		elapsed := time.Since(start)
+
+		// The bucket starts with one second's worth of bytes
+		moved := engine.lsm.compactionBytesRead.Load() + engine.lsm.compactionBytesWritten.Load()
+		if moved < 2*limit {
+			t.Errorf("Expected the compaction to move over %d bytes, got %d", 2*limit, moved)
+		}
+		if ceiling := limit * (elapsed.Seconds() + 1) * 1.05; float64(moved) > ceiling {
+			t.Errorf("Compaction moved %d bytes in %v, over the limit of %d bytes/s", moved, elapsed, limit)
+		}
+		if minimum := time.Duration(float64(moved-limit) / limit * 0.9 * float64(time.Second)); elapsed < minimum {
+			t.Errorf("Compaction of %d bytes took %v, expected at least %v", moved, elapsed, minimum)
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+// TestEngine_CompactionRateLimitReads runs a compaction throttled to about
+// two seconds and checks that reads of its input blocks and a flush are
+// served meanwhile, rather than waiting for the compaction to complete
+func TestEngine_CompactionRateLimitReads(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-compaction-rate-reads-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+
+		const limit = 400 * 1024
+		opts := DefaultOptions()
+		opts.CompactionMaxBytesPerSec = limit
+		opts.L0CompactionTrigger = 2
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			return
+		}
+		defer engine.Close()
+
+		// Two interleaved blocks of 256KB each
+		value := bytes.Repeat([]byte("v"), 4096)
+		for round := 0; round < 2; round++ {
+			for i := 0; i < 64; i++ {
+				if err := engine.Put([]byte(fmt.Sprintf("key-%02d-%d", i, round)), value); err != nil {
+					t.Errorf("Failed to put: %v", err)
+				}
+			}
+			if err := engine.flush(); err != nil {
+				t.Errorf("Failed to flush: %v", err)
+			}
+		}
+
+		start := time.Now()
+		compacted := make(chan struct{})
+		go func() {
+			engine.lsm.runCompaction()
+			close(compacted)
+		}()
+
+		// Read the input blocks while the compaction waits for the limiter
+		var slowest time.Duration
+		reads := 0
+		flushed := false
+		for running := true; running; {
+			select {
+			case <-compacted:
+				running = false
+				continue
+			default:
+			}
+
+			readStart := time.Now()
+			if got, err := engine.Get([]byte(fmt.Sprintf("key-%02d-1", reads%64))); err != nil || !bytes.Equal(got, value) {
+				t.Errorf("Expected the value during the compaction, got %d bytes (err %v)", len(got), err)
+			}
+			slowest = max(slowest, time.Since(readStart))
+			reads++
+
+			// And flush once, well into the compaction
+			if !flushed && time.Since(start) > 500*time.Millisecond {
+				if err := engine.Put([]byte("during"), []byte("compaction")); err != nil {
+					t.Errorf("Failed to put: %v", err)
+				}
+				flushStart := time.Now()
+				if err := engine.flush(); err != nil {
+					t.Errorf("Failed to flush: %v", err)
+				}
+				if elapsed := time.Since(flushStart); elapsed > 200*time.Millisecond {
+					t.Errorf("Expected the flush not to wait for the compaction, took %v", elapsed)
+				}
+				flushed = true
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		if elapsed := time.Since(start); elapsed < time.Second {
+			t.Errorf("Expected the throttled compaction to take over a second, took %v", elapsed)
+		}
+		if !flushed || reads < 100 {
+			t.Errorf("Expected reads and a flush during the compaction, got %d reads (flushed %v)", reads, flushed)
+		}
+		if slowest > 200*time.Millisecond {
+			t.Errorf("Expected reads not to wait for the compaction, the slowest took %v", slowest)
+		}
+		if got, err := engine.Get([]byte("during")); err != nil || string(got) != "compaction" {
+			t.Errorf("Expected the key flushed during the compaction, got %q (err %v)", got, err)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+// TestRateLimiter_Shared checks concurrent users of a limiter share its rate
+func TestRateLimiter_Shared(t *testing.T) {
+	const limit = 1024 * 1024
+	limiter := newRateLimiter(limit)
+
+	// Four workers take 2MB in total; 1MB is available up front
+	start := time.Now()
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 8; i++ {
+				limiter.wait(limit / 16)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("Expected 2MB at 1MB/s with a 1MB burst to take about 1s, took %v", elapsed)
+	}
+
+	var unlimited *rateLimiter
+	unlimited.wait(limit) // A nil limiter doesn't limit
+}
@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestCompactionSchedule checks the kinds of compaction allowed at times
+// of day inside and outside windows, overlapping ones, and windows wrapping
+// past midnight
+func TestCompactionSchedule(t *testing.T) {
+	schedule := CompactionSchedule{Windows: []CompactionWindow{
+		// Minor compactions only during the day
+		{Start: 8 * time.Hour, End: 22 * time.Hour, Allowed: CompactionMinor},
+		// No compaction at all over the evening peak
+		{Start: 18 * time.Hour, End: 20 * time.Hour},
+		// Major compactions only around midnight
+		{Start: 23 * time.Hour, End: time.Hour, Allowed: CompactionMajor},
+	}}
+
+	expected := map[string]CompactionKind{
+		"07:59": CompactionAll,
+		"08:00": CompactionMinor,
+		"19:30": 0,
+		"21:59": CompactionMinor,
+		"22:00": CompactionAll,
+		"23:30": CompactionMajor,
+		"00:30": CompactionMajor,
+		"01:00": CompactionAll,
+	}
+	for clock, kinds := range expected {
+		now, err := time.ParseInLocation("2006-01-02 15:04", "2026-03-14 "+clock, time.Local)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", clock, err)
+		}
+		if got := schedule.allowed(now); got != kinds {
+			t.Errorf("Expected kinds %b allowed at %s, got %b", kinds, clock, got)
+		}
+	}
+
+	// A window ending when it starts lasts all day
+	allDay := CompactionSchedule{Windows: []CompactionWindow{{Start: 5 * time.Hour, End: 5 * time.Hour, Allowed: CompactionMinor}}}
+	if got := allDay.allowed(time.Now()); got != CompactionMinor {
+		t.Errorf("Expected only minor compactions all day, got %b", got)
+	}
+	if got := (CompactionSchedule{}).allowed(time.Now()); got != CompactionAll {
+		t.Errorf("Expected every compaction allowed without windows, got %b", got)
+	}
+}
+
+// TestEngine_CompactionSchedule runs compaction cycles inside a window
+// forbidding major compactions, and checks level 0 is compacted into level
+// 1 but level 1 isn't compacted any deeper until the window is over
+func TestEngine_CompactionSchedule(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-compaction-schedule-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// A window around the current time, and one later in the day
+	now := timeOfDay(time.Now())
+	current := CompactionWindow{Start: now - time.Hour, End: now + time.Hour, Allowed: CompactionMinor}
+	later := CompactionWindow{Start: now + 2*time.Hour, End: now + 3*time.Hour, Allowed: CompactionMinor}
+
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+
+		opts := DefaultOptions()
+		opts.L0CompactionTrigger = 2
+		opts.CompactionSchedule = CompactionSchedule{Windows: []CompactionWindow{current}}
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			return
+		}
+		defer engine.Close()
+
+		// Level 1 needs compaction as soon as it holds a block
+		engine.lsm.mu.Lock()
+		engine.lsm.compactionThresholds[1] = 1
+		engine.lsm.mu.Unlock()
+
+		for round := 0; round < 3; round++ {
+			for i := 0; i < 20; i++ {
+				key := fmt.Sprintf("key-%02d-%03d", round, i)
+				if err := engine.Put([]byte(key), []byte(key)); err != nil {
+					t.Errorf("Failed to put: %v", err)
+				}
+			}
+			if err := engine.flush(); err != nil {
+				t.Errorf("Failed to flush: %v", err)
+			}
+		}
+
+		// cycles runs compaction cycles, waiting for each scheduled task
+		cycles := func() {
+			for i := 0; i < 5; i++ {
+				if err := engine.RunCompaction(); err != nil {
+					t.Errorf("Failed to run compaction: %v", err)
+				}
+				for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+					engine.compaction.mu.Lock()
+					busy := engine.compaction.busy != [7]bool{}
+					engine.compaction.mu.Unlock()
+					if !busy {
+						break
+					}
+				}
+			}
+		}
+
+		// blocks returns the number of blocks of each of the first levels
+		blocks := func() [3]int {
+			var counts [3]int
+			for level := range counts {
+				counts[level] = len(engine.Levels()[level].Blocks)
+			}
+			return counts
+		}
+
+		cycles()
+		if counts := blocks(); counts[0] != 0 || counts[1] == 0 || counts[2] != 0 {
+			t.Errorf("Expected only minor compactions inside the window, got blocks per level %v", counts)
+		}
+		if plan, err := engine.CompactionPlan(); err != nil || len(plan) == 0 || plan[0].SourceLevel != 1 {
+			t.Errorf("Expected the deferred compaction of L1 in the plan, got %+v (err %v)", plan, err)
+		}
+
+		// Once the window is over, level 1 is compacted too
+		engine.lsm.mu.Lock()
+		engine.lsm.compactionSchedule = CompactionSchedule{Windows: []CompactionWindow{later}}
+		engine.lsm.mu.Unlock()
+
+		cycles()
+		if counts := blocks(); counts[1] != 0 || counts[2] == 0 {
+			t.Errorf("Expected major compactions outside the window, got blocks per level %v", counts)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+)
+
+// strategyRun is the outcome of a workload under a compaction strategy
+type strategyRun struct {
+	// Number of compactions performed
+	compactions int
+
+	// Number of blocks compacted into a deeper level
+	blocksCompacted int
+
+	// Bytes written by the compactions
+	bytesWritten int64
+
+	// Most runs seen in a level >= 1
+	maxRuns int
+}
+
+// runStrategyWorkload runs rounds of overwrites and deletes under a
+// compaction strategy, running the planned compactions after each flush,
+// and checks that every key keeps its newest value and that no run of a
+// level >= 1 has overlapping blocks
+func runStrategyWorkload(t *testing.T, strategy CompactionStrategy) strategyRun {
+	tempDir, err := os.MkdirTemp("", "river-compaction-strategy-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Small output blocks, and levels that fill up after a few rounds
+	opts := DefaultOptions()
+	opts.CompactionStrategy = strategy
+	opts.TargetBlockSize = 512
+	engine, err := NewEngineWithOptions(tempDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to create engine: %v", err)
+	}
+	defer engine.Close()
+
+	engine.lsm.mu.Lock()
+	for level := 1; level < 7; level++ {
+		engine.lsm.compactionThresholds[level] = 2048 << (2 * (level - 1))
+	}
+	engine.lsm.mu.Unlock()
+
+	var result strategyRun
+	rng := rand.New(rand.NewSource(1))
+	model := make(map[string]string)
+	for round := 0; round < 64; round++ {
+		for i := 0; i < 40; i++ {
+			key := fmt.Sprintf("key-%04d", rng.Intn(1000))
+			if rng.Intn(10) == 0 {
+				if err := engine.Delete([]byte(key)); err != nil {
+					t.Errorf("Failed to delete: %v", err)
+				}
+				delete(model, key)
+				continue
+			}
+			value := fmt.Sprintf("round-%d-%d", round, i)
+			if err := engine.Put([]byte(key), []byte(value)); err != nil {
+				t.Errorf("Failed to put: %v", err)
+			}
+			model[key] = value
+		}
+		if err := engine.flush(); err != nil {
+			t.Errorf("Failed to flush: %v", err)
+		}
+
+		// Run the planned compactions one at a time, counting them
+		engine.lsm.mergeMu.Lock()
+		engine.lsm.mu.Lock()
+		for tasks := engine.lsm.planner.plan(engine.lsm); len(tasks) > 0; tasks = engine.lsm.planner.plan(engine.lsm) {
+			written := engine.lsm.compactionBytesWritten.Load()
+			if err := engine.lsm.runTask(tasks[0]); err != nil {
+				t.Errorf("Round %d: failed to compact: %v", round, err)
+				break
+			}
+			result.compactions++
+			result.blocksCompacted += len(tasks[0].blocks)
+			result.bytesWritten += engine.lsm.compactionBytesWritten.Load() - written
+		}
+		if err := engine.lsm.levelOverlap(); err != nil {
+			t.Errorf("Round %d: %v", round, err)
+		}
+		for level := 1; level < 7; level++ {
+			result.maxRuns = max(result.maxRuns, len(engine.lsm.levelRuns(level)))
+		}
+		engine.lsm.mu.Unlock()
+		engine.lsm.mergeMu.Unlock()
+	}
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%04d", i)
+		value, err := engine.Get([]byte(key))
+		expected, ok := model[key]
+		switch {
+		case !ok && !errors.Is(err, ErrKeyNotFound):
+			t.Errorf("Expected %s to be absent, got %q (err %v)", key, value, err)
+		case ok && (err != nil || string(value) != expected):
+			t.Errorf("Expected %s=%s, got %q (err %v)", key, expected, value, err)
+		}
+	}
+
+	return result
+}
+
+// TestCompactionStrategy compares tiered and leveled compaction on the same
+// workload: tiered performs fewer, larger compactions and lets runs overlap
+// in a level, while leveled keeps every level >= 1 a single run
+func TestCompactionStrategy(t *testing.T) {
+	done := make(chan bool)
+	go func() {
+		leveled := runStrategyWorkload(t, CompactionLeveled)
+		tiered := runStrategyWorkload(t, CompactionTiered)
+		t.Logf("Leveled: %+v, tiered: %+v", leveled, tiered)
+
+		if tiered.compactions == 0 || tiered.compactions >= leveled.compactions {
+			t.Errorf("Expected fewer tiered compactions than leveled ones, got %d and %d",
+				tiered.compactions, leveled.compactions)
+		}
+		if tiered.bytesWritten >= leveled.bytesWritten {
+			t.Errorf("Expected tiered compactions to write less than leveled ones, got %d and %d bytes",
+				tiered.bytesWritten, leveled.bytesWritten)
+		}
+		tieredAverage := float64(tiered.blocksCompacted) / float64(max(tiered.compactions, 1))
+		leveledAverage := float64(leveled.blocksCompacted) / float64(max(leveled.compactions, 1))
+		if tieredAverage <= leveledAverage {
+			t.Errorf("Expected larger tiered compactions than leveled ones, got %.1f and %.1f blocks on average",
+				tieredAverage, leveledAverage)
+		}
+
+		if leveled.maxRuns != 1 {
+			t.Errorf("Expected leveled compaction to keep a single run per level, got %d", leveled.maxRuns)
+		}
+		if tiered.maxRuns < 2 {
+			t.Errorf("Expected tiered compaction to accumulate runs in a level, got at most %d", tiered.maxRuns)
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestEngine_SetCompactionWorkers schedules compaction tasks while growing
+// and shrinking the worker pool, and checks the pool has the requested
+// size and every scheduled task completes
+func TestEngine_SetCompactionWorkers(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-compaction-workers-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		opts := DefaultOptions()
+		opts.L0CompactionTrigger = 2
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+
+		if err := engine.SetCompactionWorkers(0); err == nil {
+			t.Errorf("Expected an error setting 0 workers")
+		}
+
+		// workers returns the size of the pool and the number of workers
+		// in the statistics
+		workers := func() (int, int) {
+			engine.compaction.mu.Lock()
+			running := len(engine.compaction.workers)
+			engine.compaction.mu.Unlock()
+			return running, engine.GetStats().CompactionStats.Workers
+		}
+		if running, reported := workers(); running != 4 || reported != 4 {
+			t.Errorf("Expected 4 workers after opening, got %d (reported %d)", running, reported)
+		}
+
+		sizes := []int{8, 1, 3, 2}
+		scheduled := 0
+		for round := 0; round < 20; round++ {
+			for i := 0; i < 20; i++ {
+				key := fmt.Sprintf("key-%02d-%03d", round, i)
+				if err := engine.Put([]byte(key), []byte(key)); err != nil {
+					t.Errorf("Failed to put: %v", err)
+				}
+			}
+			if err := engine.flush(); err != nil {
+				t.Errorf("Failed to flush: %v", err)
+			}
+
+			// Schedule a task like RunCompaction, counting it
+			engine.lsm.mu.Lock()
+			for _, task := range engine.lsm.planner.plan(engine.lsm) {
+				if engine.compaction.schedule(task) {
+					scheduled++
+					break
+				}
+			}
+			engine.lsm.mu.Unlock()
+
+			n := sizes[round%len(sizes)]
+			if err := engine.SetCompactionWorkers(n); err != nil {
+				t.Errorf("Failed to set %d workers: %v", n, err)
+			}
+			if running, reported := workers(); running != n || reported != n {
+				t.Errorf("Expected %d workers, got %d (reported %d)", n, running, reported)
+			}
+		}
+
+		// Every scheduled task is run by the remaining workers
+		if scheduled == 0 {
+			t.Errorf("Expected compaction tasks to be scheduled")
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for engine.GetStats().CompactionStats.CompactionCount < scheduled && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		stats := engine.GetStats().CompactionStats
+		if stats.CompactionCount != scheduled || stats.TasksDropped != 0 {
+			t.Errorf("Expected %d compactions and none dropped, got %d and %d dropped", scheduled, stats.CompactionCount, stats.TasksDropped)
+		}
+
+		for round := 0; round < 20; round++ {
+			for i := 0; i < 20; i++ {
+				key := fmt.Sprintf("key-%02d-%03d", round, i)
+				if value, err := engine.Get([]byte(key)); err != nil || string(value) != key {
+					t.Errorf("Expected %s=%s, got %q (err %v)", key, key, value, err)
+				}
+			}
+		}
+
+		if err := engine.Close(); err != nil {
+			t.Errorf("Failed to close engine: %v", err)
+		}
+		if err := engine.SetCompactionWorkers(2); !errors.Is(err, ErrEngineClosed) {
+			t.Errorf("Expected ErrEngineClosed after Close, got %v", err)
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
@@ -0,0 +1,414 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/0xReLogic/river/internal/data/block"
+)
+
+// TestEngine_CompressionRules checks that flushed blocks use the compression
+// configured for their key prefix
+func TestEngine_CompressionRules(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-compression-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	opts := DefaultOptions()
+	opts.Compression = block.CompressionLZ4
+	opts.CompressionRules = []CompressionRule{
+		{Prefix: []byte("img:"), Compression: block.CompressionNone},
+		{Prefix: []byte("json:"), Compression: block.CompressionLZ4},
+	}
+
+	done := make(chan bool)
+	go func() {
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+		defer engine.Close()
+
+		// Highly compressible values for both prefixes
+		value := bytes.Repeat([]byte(`{"city":"jakarta","count":1}`), 64)
+		for i := 0; i < 50; i++ {
+			for _, prefix := range []string{"img:", "json:"} {
+				key := []byte(fmt.Sprintf("%s%03d", prefix, i))
+				if err := engine.Put(key, value); err != nil {
+					t.Errorf("Failed to put key: %v", err)
+				}
+			}
+		}
+
+		if err := engine.flush(); err != nil {
+			t.Errorf("Failed to flush: %v", err)
+			done <- true
+			return
+		}
+
+		engine.lsm.mu.RLock()
+		blocks := append([]blockInfo(nil), engine.lsm.levels[0]...)
+		engine.lsm.mu.RUnlock()
+
+		if len(blocks) != 2 {
+			t.Errorf("Expected 2 blocks (one per compression), got %d", len(blocks))
+		}
+
+		expected := map[string]block.CompressionType{
+			"img:":  block.CompressionNone,
+			"json:": block.CompressionLZ4,
+		}
+		for _, info := range blocks {
+			f, err := os.Open(info.path)
+			if err != nil {
+				t.Errorf("Failed to open block file: %v", err)
+				continue
+			}
+			b := block.NewBlock()
+			err = b.Decode(f)
+			f.Close()
+			if err != nil {
+				t.Errorf("Failed to decode block: %v", err)
+				continue
+			}
+
+			for prefix, compression := range expected {
+				if !strings.HasPrefix(b.MinKey(), prefix) {
+					continue
+				}
+				if !strings.HasPrefix(b.MaxKey(), prefix) {
+					t.Errorf("Block mixes prefixes: %s..%s", b.MinKey(), b.MaxKey())
+				}
+				if b.Header.CompressionType != compression {
+					t.Errorf("Block for %q has compression %d, expected %d",
+						prefix, b.Header.CompressionType, compression)
+				}
+			}
+		}
+
+		// Values read back identically from both blocks
+		for _, key := range []string{"img:007", "json:042"} {
+			got, err := engine.Get([]byte(key))
+			if err != nil || !bytes.Equal(got, value) {
+				t.Errorf("Unexpected value for %s (err %v)", key, err)
+			}
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+// TestEngine_CompressionStats flushes compressible and incompressible
+// values with LZ4, and checks the compression ratio reported for a mix of
+// them is between the ratios of each alone, and survives a reopen
+func TestEngine_CompressionStats(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Compression = block.CompressionLZ4
+
+	compressible := bytes.Repeat([]byte(`{"city":"jakarta","count":1}`), 64)
+
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+
+		// write flushes a block of values under prefix, random ones for
+		// incompressible data
+		write := func(engine *Engine, prefix string, random bool) {
+			for i := 0; i < 50; i++ {
+				value := compressible
+				if random {
+					value = make([]byte, len(compressible))
+					rand.Read(value)
+				}
+				if err := engine.Put([]byte(fmt.Sprintf("%s%03d", prefix, i)), value); err != nil {
+					t.Errorf("Failed to put: %v", err)
+				}
+			}
+			if err := engine.flush(); err != nil {
+				t.Errorf("Failed to flush: %v", err)
+			}
+		}
+
+		// open opens an engine in a new directory
+		open := func() (*Engine, string) {
+			tempDir, err := os.MkdirTemp("", "river-compression-stats-test")
+			if err != nil {
+				t.Errorf("Failed to create temp dir: %v", err)
+				return nil, ""
+			}
+			engine, err := NewEngineWithOptions(tempDir, opts)
+			if err != nil {
+				t.Errorf("Failed to create engine: %v", err)
+				return nil, tempDir
+			}
+			return engine, tempDir
+		}
+
+		engine, tempDir := open()
+		if engine == nil {
+			return
+		}
+		defer os.RemoveAll(tempDir)
+		if ratio := engine.GetStats().Compression.CompressionRatio; ratio != 0 {
+			t.Errorf("Expected no compression ratio without blocks, got %.2f", ratio)
+		}
+		write(engine, "random:", true)
+		random := engine.GetStats().Compression
+		engine.Close()
+		if random.CompressionRatio < 1 || random.CompressionRatio > 1.01 {
+			t.Errorf("Expected a ratio of about 1 for random data, got %+v", random)
+		}
+
+		engine, tempDir = open()
+		if engine == nil {
+			return
+		}
+		defer os.RemoveAll(tempDir)
+		write(engine, "json:", false)
+		compressed := engine.GetStats().Compression
+		if compressed.CompressionRatio < 4 {
+			t.Errorf("Expected compressible data to shrink at least 4 times, got %+v", compressed)
+		}
+
+		write(engine, "random:", true)
+		mixed := engine.GetStats().Compression
+		if mixed.CompressionRatio <= random.CompressionRatio || mixed.CompressionRatio >= compressed.CompressionRatio {
+			t.Errorf("Expected the ratio of mixed data between %.2f and %.2f, got %+v",
+				random.CompressionRatio, compressed.CompressionRatio, mixed)
+		}
+		if mixed.RawSizeBytes != compressed.RawSizeBytes+random.RawSizeBytes {
+			t.Errorf("Expected %d raw bytes, got %d", compressed.RawSizeBytes+random.RawSizeBytes, mixed.RawSizeBytes)
+		}
+		engine.Close()
+
+		// Loaded from the block headers on open
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to reopen engine: %v", err)
+			return
+		}
+		defer engine.Close()
+		if reopened := engine.GetStats().Compression; reopened != mixed {
+			t.Errorf("Expected %+v after reopening, got %+v", mixed, reopened)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+// TestEngine_SplitBlockLayout flushes structured values in the split block
+// layout next to the interleaved one, and checks the split blocks are
+// smaller, read back, and keep their layout through compaction
+func TestEngine_SplitBlockLayout(t *testing.T) {
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+
+		// write fills an engine with the same structured values, returning
+		// the stored size of its blocks
+		write := func(engine *Engine) int64 {
+			for i := 0; i < 3000; i++ {
+				key := fmt.Sprintf("order:%06d", i*7919%1000000)
+				value := fmt.Sprintf(`{"id":%d,"total":%d,"paid":%t}`, i, i*i%5000, i%4 == 0)
+				if err := engine.Put([]byte(key), []byte(value)); err != nil {
+					t.Errorf("Failed to put: %v", err)
+				}
+			}
+			if err := engine.Delete([]byte("order:000000")); err != nil {
+				t.Errorf("Failed to delete: %v", err)
+			}
+			if err := engine.flush(); err != nil {
+				t.Errorf("Failed to flush: %v", err)
+			}
+			return engine.GetStats().Compression.StoredSizeBytes
+		}
+
+		// flags returns the format flags of every block of an engine
+		flags := func(engine *Engine) []block.FormatFlags {
+			engine.lsm.mu.RLock()
+			defer engine.lsm.mu.RUnlock()
+			var flags []block.FormatFlags
+			for _, level := range engine.lsm.levels {
+				for _, info := range level {
+					b, err := loadBlock(info.path)
+					if err != nil {
+						t.Errorf("Failed to load block: %v", err)
+						continue
+					}
+					flags = append(flags, b.Header.Flags)
+				}
+			}
+			return flags
+		}
+
+		sizes := make(map[bool]int64)
+		for _, split := range []bool{false, true} {
+			tempDir, err := os.MkdirTemp("", "river-split-layout-test")
+			if err != nil {
+				t.Errorf("Failed to create temp dir: %v", err)
+				return
+			}
+			defer os.RemoveAll(tempDir)
+
+			opts := DefaultOptions()
+			opts.Compression = block.CompressionLZ4
+			opts.SplitBlockLayout = split
+			engine, err := NewEngineWithOptions(tempDir, opts)
+			if err != nil {
+				t.Errorf("Failed to create engine: %v", err)
+				return
+			}
+			defer engine.Close()
+			sizes[split] = write(engine)
+			if !split {
+				continue
+			}
+
+			// Compaction keeps the layout, reads see every pair
+			if err := engine.CompactRange(0, nil, nil); err != nil {
+				t.Errorf("Failed to compact: %v", err)
+			}
+			for _, f := range flags(engine) {
+				if f&block.FlagSplitLayout == 0 {
+					t.Errorf("Expected every block in the split layout, got flags %b", f)
+				}
+			}
+			if value, err := engine.Get([]byte("order:007919")); err != nil || !strings.HasPrefix(string(value), `{"id":1,`) {
+				t.Errorf("Unexpected value for order:007919: %q (err %v)", value, err)
+			}
+			if _, err := engine.Get([]byte("order:000000")); !errors.Is(err, ErrKeyNotFound) {
+				t.Errorf("Expected the deleted key not found, got %v", err)
+			}
+			it, err := engine.NewIterator(context.Background(), IteratorOptions{})
+			if err != nil {
+				t.Errorf("Failed to create iterator: %v", err)
+				return
+			}
+			count := 0
+			for it.Next() {
+				count++
+			}
+			it.Close()
+			if count != 2999 {
+				t.Errorf("Expected 2999 keys, got %d", count)
+			}
+		}
+
+		if sizes[true] >= sizes[false] {
+			t.Errorf("Expected split blocks to be smaller, got %d bytes against %d interleaved", sizes[true], sizes[false])
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+// TestEngine_LevelCompression compacts flushed data down several levels and
+// checks the blocks of each level carry its configured compression, and
+// that levels without one keep the compression of their inputs
+func TestEngine_LevelCompression(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-level-compression-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+
+		opts := DefaultOptions()
+		opts.LevelCompression = []block.CompressionType{
+			block.CompressionNone, block.CompressionLZ4, block.CompressionZstd, block.CompressionLZ4,
+		}
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			return
+		}
+		defer engine.Close()
+
+		value := bytes.Repeat([]byte(`{"city":"jakarta","count":1}`), 16)
+		for i := 0; i < 200; i++ {
+			if err := engine.Put([]byte(fmt.Sprintf("key-%03d", i)), value); err != nil {
+				t.Errorf("Failed to put: %v", err)
+			}
+		}
+		if err := engine.flush(); err != nil {
+			t.Errorf("Failed to flush: %v", err)
+		}
+
+		// compressions returns the compression of every block of level
+		compressions := func(level int) []block.CompressionType {
+			engine.lsm.mu.RLock()
+			defer engine.lsm.mu.RUnlock()
+			var compressions []block.CompressionType
+			for _, info := range engine.lsm.levels[level] {
+				b, err := loadBlock(info.path)
+				if err != nil {
+					t.Errorf("Failed to load block: %v", err)
+					continue
+				}
+				compressions = append(compressions, b.Header.CompressionType)
+			}
+			return compressions
+		}
+
+		expected := []block.CompressionType{
+			block.CompressionNone, block.CompressionLZ4, block.CompressionZstd, block.CompressionLZ4,
+			block.CompressionLZ4, // Past the configured levels
+		}
+		for level, compression := range expected {
+			if level > 0 {
+				if err := engine.CompactRange(level-1, nil, nil); err != nil {
+					t.Errorf("Failed to compact L%d: %v", level-1, err)
+					return
+				}
+			}
+			got := compressions(level)
+			if len(got) == 0 {
+				t.Errorf("Expected blocks in L%d", level)
+			}
+			for _, c := range got {
+				if c != compression {
+					t.Errorf("Expected L%d blocks with compression %d, got %d", level, compression, c)
+				}
+			}
+			for _, key := range []string{"key-000", "key-123", "key-199"} {
+				if got, err := engine.Get([]byte(key)); err != nil || !bytes.Equal(got, value) {
+					t.Errorf("Unexpected value for %s in L%d (err %v)", key, level, err)
+				}
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestEngine_ConcurrentMemTableAccounting drives concurrent puts, overwrites and
+// deletes and checks the memory table size matches the recomputed size of each shard
+func TestEngine_ConcurrentMemTableAccounting(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-concurrency-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		engine, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+		defer engine.Close()
+
+		const writers = 16
+		const opsPerWriter = 300
+		const keySpace = 64
+
+		var wg sync.WaitGroup
+		for w := 0; w < writers; w++ {
+			wg.Add(1)
+			go func(seed int64) {
+				defer wg.Done()
+				rng := rand.New(rand.NewSource(seed))
+
+				for i := 0; i < opsPerWriter; i++ {
+					key := []byte(fmt.Sprintf("key-%d", rng.Intn(keySpace)))
+
+					switch rng.Intn(4) {
+					case 0:
+						// Delete, possibly of a key that doesn't exist
+						if err := engine.Delete(key); err != nil {
+							t.Errorf("Failed to delete key: %v", err)
+						}
+					case 1:
+						// Empty value
+						if err := engine.Put(key, []byte{}); err != nil {
+							t.Errorf("Failed to put key: %v", err)
+						}
+					default:
+						// Overwrite with a value of random (larger or smaller) size
+						value := make([]byte, rng.Intn(128))
+						if err := engine.Put(key, value); err != nil {
+							t.Errorf("Failed to put key: %v", err)
+						}
+					}
+				}
+			}(int64(w))
+		}
+		wg.Wait()
+
+		engine.mu.RLock()
+		var expected int64
+		for i := range engine.memTable.shards {
+			shard := &engine.memTable.shards[i]
+			var shardSize int64
+			for key, value := range shard.entries {
+				shardSize += int64(len(key) + len(value))
+			}
+			if shard.size.Load() != shardSize {
+				t.Errorf("Shard %d size = %d, recomputed size = %d", i, shard.size.Load(), shardSize)
+			}
+			expected += shardSize
+		}
+		actual := engine.memTable.size()
+		engine.mu.RUnlock()
+
+		if actual != expected {
+			t.Errorf("Memory table size = %d, recomputed size = %d", actual, expected)
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(60 * time.Second):
+		t.Fatalf("Test timed out after 60 seconds")
+	}
+}
+
+// BenchmarkEngine_ConcurrentPut measures put throughput with 32 writers,
+// with a single memory table lock and with a sharded memory table
+func BenchmarkEngine_ConcurrentPut(b *testing.B) {
+	const writers = 32
+
+	for _, shards := range []int{1, 16} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			tempDir, err := os.MkdirTemp("", "river-concurrent-put-bench")
+			if err != nil {
+				b.Fatalf("Failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(tempDir)
+
+			opts := DefaultOptions()
+			opts.MemTableShards = shards
+			engine, err := NewEngineWithOptions(tempDir, opts)
+			if err != nil {
+				b.Fatalf("Failed to create engine: %v", err)
+			}
+			// Like the tests, the benchmark doesn't wait for Close, which
+			// blocks on its final checkpoint
+			defer func() { go engine.Close() }()
+
+			value := make([]byte, 100)
+			b.ResetTimer()
+
+			var wg sync.WaitGroup
+			for w := 0; w < writers; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for i := w; i < b.N; i += writers {
+						key := []byte(fmt.Sprintf("key-%d-%d", w, i))
+						if err := engine.Put(key, value); err != nil {
+							b.Errorf("Failed to put: %v", err)
+							return
+						}
+					}
+				}(w)
+			}
+			wg.Wait()
+		})
+	}
+}
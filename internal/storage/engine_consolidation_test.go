@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestEngine_Consolidation tests that a level fragmented into many small
+// blocks is consolidated into fewer, larger blocks of the same level
+func TestEngine_Consolidation(t *testing.T) {
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+
+		tempDir, err := os.MkdirTemp("", "river-consolidation-test")
+		if err != nil {
+			t.Errorf("Failed to create temp dir: %v", err)
+			return
+		}
+		defer os.RemoveAll(tempDir)
+
+		opts := DefaultOptions()
+		opts.TargetBlockSize = 2048
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			return
+		}
+		defer engine.Close()
+
+		// Each round flushes a few new keys after those of the previous
+		// rounds and moves them down to level 2 as a small block of its own
+		value := strings.Repeat("v", 40)
+		for round := 0; round < 20; round++ {
+			for i := 0; i < 4; i++ {
+				key := fmt.Sprintf("key-%03d-%02d", round, i)
+				if err := engine.Put([]byte(key), []byte(value)); err != nil {
+					t.Errorf("Failed to put: %v", err)
+					return
+				}
+			}
+			if err := engine.flush(); err != nil {
+				t.Errorf("Failed to flush: %v", err)
+				return
+			}
+
+			engine.lsm.mergeMu.Lock()
+			engine.lsm.mu.Lock()
+			for level := 0; level < 2; level++ {
+				task := compactionTask{sourceLevel: level, targetLevel: level + 1, blocks: engine.lsm.levels[level]}
+				if err := engine.lsm.runTask(task); err != nil {
+					t.Errorf("Round %d: failed to compact L%d: %v", round, level, err)
+				}
+			}
+			engine.lsm.mu.Unlock()
+			engine.lsm.mergeMu.Unlock()
+		}
+
+		engine.lsm.mu.Lock()
+		fragmented := len(engine.lsm.levels[2])
+		if tasks := consolidationTasks(engine.lsm); len(tasks) != 0 {
+			t.Errorf("Expected no consolidation when disabled, got %d tasks", len(tasks))
+		}
+
+		// Compaction consolidates the level once its blocks are too small
+		engine.lsm.minAverageBlockSize = 1024
+		tasks := engine.lsm.planner.plan(engine.lsm)
+		if len(tasks) == 0 || !tasks[0].consolidation() || tasks[0].sourceLevel != 2 {
+			t.Errorf("Expected a consolidation of L2 to be planned, got %+v", tasks)
+		}
+		engine.lsm.mu.Unlock()
+		engine.lsm.runCompaction()
+		engine.lsm.mu.Lock()
+
+		consolidated := engine.lsm.levels[2]
+		if tasks := consolidationTasks(engine.lsm); len(tasks) != 0 {
+			t.Errorf("Expected L2 to be fully consolidated, got %d tasks left", len(tasks))
+		}
+		if err := engine.lsm.levelOverlap(); err != nil {
+			t.Errorf("Expected consolidated blocks not to overlap: %v", err)
+		}
+		var raw int64
+		for _, info := range consolidated {
+			raw += info.rawSize
+			if info.rawSize > int64(opts.TargetBlockSize) {
+				t.Errorf("Expected blocks of at most %d bytes, got %d", opts.TargetBlockSize, info.rawSize)
+			}
+		}
+		engine.lsm.mu.Unlock()
+
+		if fragmented != 20 {
+			t.Errorf("Expected 20 small blocks in L2, got %d", fragmented)
+		}
+		if len(consolidated)*4 > fragmented {
+			t.Errorf("Expected L2 consolidated into at most %d blocks, got %d", fragmented/4, len(consolidated))
+		}
+		if average := raw / int64(len(consolidated)); average < 1024 {
+			t.Errorf("Expected consolidated blocks of 1024 bytes or more on average, got %d", average)
+		}
+
+		// Every key is still readable
+		for round := 0; round < 20; round++ {
+			for i := 0; i < 4; i++ {
+				key := fmt.Sprintf("key-%03d-%02d", round, i)
+				got, err := engine.Get([]byte(key))
+				if err != nil || string(got) != value {
+					t.Errorf("Expected %s after consolidation, got %q, %v", key, got, err)
+				}
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
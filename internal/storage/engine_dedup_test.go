@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestEngine_DedupBlocks flushes identical data twice and checks the second
+// block references the first block's file, and that compaction keeps the
+// data while a reference is left
+func TestEngine_DedupBlocks(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-dedup-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		opts := DefaultOptions()
+		opts.DedupBlocks = true
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+
+		// Flush the same pairs twice
+		for round := 0; round < 2; round++ {
+			for i := 0; i < 100; i++ {
+				key := []byte(fmt.Sprintf("dedup-key-%03d", i))
+				if err := engine.Put(key, []byte(fmt.Sprintf("value-%03d", i))); err != nil {
+					t.Errorf("Failed to put key: %v", err)
+				}
+			}
+			if err := engine.flush(); err != nil {
+				t.Errorf("Failed to flush: %v", err)
+			}
+		}
+
+		files, _ := filepath.Glob(filepath.Join(tempDir, "data", "L0", "*.blk"))
+		if len(files) != 2 {
+			t.Errorf("Expected 2 block files in L0, got %d", len(files))
+			engine.Close()
+			done <- true
+			return
+		}
+		first, _ := os.Stat(files[0])
+		second, _ := os.Stat(files[1])
+		if !os.SameFile(first, second) {
+			t.Errorf("Expected both block files to share one physical file")
+		}
+		id := blockFileID(files[0])
+		if refs := engine.lsm.dedup.refCount(id); refs != 2 {
+			t.Errorf("Expected refcount 2, got %d", refs)
+		}
+
+		// Compacting both references away leaves the output's reference
+		engine.lsm.mergeMu.Lock()
+		engine.lsm.mu.Lock()
+		engine.lsm.compactLevel(0)
+		engine.lsm.mu.Unlock()
+		engine.lsm.mergeMu.Unlock()
+		if refs := engine.lsm.dedup.refCount(id); refs != 1 {
+			t.Errorf("Expected refcount 1 after compaction, got %d", refs)
+		}
+		if value, err := engine.Get([]byte("dedup-key-042")); err != nil || string(value) != "value-042" {
+			t.Errorf("Expected value-042 after compaction, got %q (err %v)", value, err)
+		}
+		if err := engine.Close(); err != nil {
+			t.Errorf("Failed to close engine: %v", err)
+		}
+
+		// The saved index matches the blocks on reopen
+		saved, err := (&dedupIndex{dataDir: filepath.Join(tempDir, "data")}).read()
+		if err != nil {
+			t.Errorf("Failed to read dedup index: %v", err)
+		} else if len(saved[id]) != 1 {
+			t.Errorf("Expected 1 saved reference, got %v", saved[id])
+		}
+
+		reopened, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to reopen engine: %v", err)
+			done <- true
+			return
+		}
+		defer reopened.Close()
+
+		if refs := reopened.lsm.dedup.refCount(id); refs != 1 {
+			t.Errorf("Expected refcount 1 after reopening, got %d", refs)
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// errDiskFull simulates a write to a full disk
+var errDiskFull = errors.New("no space left on device")
+
+// failingWriter writes up to remaining bytes, then fails like a full disk
+type failingWriter struct {
+	w         io.Writer
+	remaining int
+}
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	if len(p) <= f.remaining {
+		f.remaining -= len(p)
+		return f.w.Write(p)
+	}
+	n, _ := f.w.Write(p[:f.remaining])
+	f.remaining = 0
+	return n, errDiskFull
+}
+
+// TestEngine_DiskFull checks a failed WAL append leaves neither a partial
+// entry nor a memory table change behind, and a failed flush keeps its
+// entries readable
+func TestEngine_DiskFull(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-disk-full-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		engine, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+		defer engine.Close()
+
+		if err := engine.Put([]byte("a"), []byte("1")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+
+		// The disk fills up 10 bytes into the next entry
+		engine.wal.mu.Lock()
+		walPath := engine.wal.file.Name()
+		walSize := engine.wal.size
+		engine.wal.writer.Reset(&failingWriter{w: engine.wal.file, remaining: 10})
+		engine.wal.mu.Unlock()
+
+		if err := engine.Put([]byte("b"), []byte("2")); !errors.Is(err, errDiskFull) {
+			t.Errorf("Expected the disk full error, got %v", err)
+		}
+		if _, err := engine.Get([]byte("b")); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected the failed put not to reach the memory table, got %v", err)
+		}
+		if stats := engine.GetStats(); stats.MemTableKeys != 1 || stats.MemTableSize != 2 {
+			t.Errorf("Expected the memory table unchanged, got %d keys and %d bytes", stats.MemTableKeys, stats.MemTableSize)
+		}
+		if info, err := os.Stat(walPath); err != nil || info.Size() != walSize {
+			t.Errorf("Expected the partial entry to be truncated to %d bytes, got %v (err %v)", walSize, info.Size(), err)
+		}
+
+		// Once space is available again, writes continue after the last complete entry
+		if err := engine.Put([]byte("c"), []byte("3")); err != nil {
+			t.Errorf("Failed to put after the failure: %v", err)
+		}
+
+		// A failed flush keeps its entries readable and flushable
+		l0 := filepath.Join(tempDir, "data", "L0")
+		if err := os.WriteFile(l0, nil, 0644); err != nil {
+			t.Errorf("Failed to block the L0 directory: %v", err)
+		}
+		if err := engine.flush(); err == nil {
+			t.Errorf("Expected the flush to fail")
+		}
+		if err := engine.Put([]byte("a"), []byte("4")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		if value, err := engine.Get([]byte("c")); err != nil || string(value) != "3" {
+			t.Errorf("Expected c=3 after the failed flush, got %q (err %v)", value, err)
+		}
+		if value, err := engine.Get([]byte("a")); err != nil || string(value) != "4" {
+			t.Errorf("Expected the newer a=4 to win over the restored entry, got %q (err %v)", value, err)
+		}
+		if tmp, _ := filepath.Glob(filepath.Join(tempDir, "data", "*", "*.tmp")); len(tmp) != 0 {
+			t.Errorf("Expected no temporary block files, got %v", tmp)
+		}
+		os.Remove(l0)
+		if err := engine.flush(); err != nil {
+			t.Errorf("Failed to flush: %v", err)
+		}
+		if keys := engine.GetStats().MemTableKeys; keys != 0 {
+			t.Errorf("Expected the retried flush to empty the memory table, got %d keys", keys)
+		}
+
+		// The WAL replays cleanly
+		crash(engine)
+		reopened, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to reopen engine: %v", err)
+			done <- true
+			return
+		}
+		defer reopened.Close()
+		for key, expected := range map[string]string{"a": "4", "c": "3"} {
+			if value, err := reopened.Get([]byte(key)); err != nil || string(value) != expected {
+				t.Errorf("Expected %s=%s after recovery, got %q (err %v)", key, expected, value, err)
+			}
+		}
+		if _, err := reopened.Get([]byte("b")); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected the failed put to be absent after recovery, got %v", err)
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingListener records the events it receives. It blocks on the first
+// one until released, like a slow listener.
+type recordingListener struct {
+	// Closed to let the listener handle events
+	release chan struct{}
+
+	// Events received so far
+	mu     sync.Mutex
+	events []Event
+}
+
+// HandleEvent implements EventListener
+func (l *recordingListener) HandleEvent(event Event) {
+	<-l.release
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, event)
+}
+
+// TestEngine_EventListener flushes, compacts and rotates the WAL while the
+// listener is blocked, then checks the listener observed every event, in
+// order, once released
+func TestEngine_EventListener(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-events-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		listener := &recordingListener{release: make(chan struct{})}
+		opts := DefaultOptions()
+		opts.L0CompactionTrigger = 0
+		opts.EventListener = listener
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+
+		// Rotate the WAL every few writes
+		engine.wal.mu.Lock()
+		engine.wal.maxSize = 1024
+		engine.wal.mu.Unlock()
+
+		// A blocked listener doesn't hold up flushes and compactions
+		for round := 0; round < 3; round++ {
+			for i := 0; i < 50; i++ {
+				key := fmt.Sprintf("key-%d-%02d", round, i)
+				if err := engine.Put([]byte(key), []byte("value")); err != nil {
+					t.Errorf("Failed to put: %v", err)
+				}
+			}
+			if err := engine.flush(); err != nil {
+				t.Errorf("Failed to flush: %v", err)
+			}
+		}
+		if err := engine.CompactRange(0, nil, nil); err != nil {
+			t.Errorf("Failed to compact: %v", err)
+		}
+		if err := engine.Put([]byte("last"), []byte("value")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+
+		// Close delivers the remaining events
+		close(listener.release)
+		if err := engine.Close(); err != nil {
+			t.Errorf("Failed to close engine: %v", err)
+		}
+
+		listener.mu.Lock()
+		events := listener.events
+		listener.mu.Unlock()
+
+		// The flushes and compaction, in order, ending with the flush and
+		// checkpoint of Close; the background checkpoints and the WAL
+		// rotations happen in between
+		var sequence []EventType
+		rotations := 0
+		for i, event := range events {
+			if i > 0 && event.Time.Before(events[i-1].Time) {
+				t.Errorf("Event %d (%v) received out of order", i, event.Type)
+			}
+			if event.Err != nil {
+				t.Errorf("Event %d (%v) failed: %v", i, event.Type, event.Err)
+			}
+
+			switch event.Type {
+			case EventWALRotated:
+				rotations++
+				if event.Path == "" {
+					t.Errorf("Expected the new WAL file of a rotation")
+				}
+				continue
+			case EventCheckpointCreated:
+				if i != len(events)-1 {
+					continue
+				}
+			case EventFlushFinished:
+				if event.Blocks == 0 || event.Bytes == 0 {
+					t.Errorf("Expected a finished flush to report what it wrote, got %+v", event)
+				}
+			case EventCompactionFinished:
+				if event.Level != 0 || event.TargetLevel != 1 || event.Blocks != 3 || event.Bytes == 0 {
+					t.Errorf("Expected the compaction of 3 blocks into L1 to be reported, got %+v", event)
+				}
+			}
+			sequence = append(sequence, event.Type)
+		}
+
+		expected := []EventType{
+			EventFlushStarted, EventFlushFinished,
+			EventFlushStarted, EventFlushFinished,
+			EventFlushStarted, EventFlushFinished,
+			EventCompactionStarted, EventCompactionFinished,
+			EventFlushStarted, EventFlushFinished,
+			EventCheckpointCreated,
+		}
+		if !reflect.DeepEqual(sequence, expected) {
+			t.Errorf("Expected events %v, got %v", expected, sequence)
+		}
+		if rotations == 0 {
+			t.Errorf("Expected the WAL to be rotated")
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
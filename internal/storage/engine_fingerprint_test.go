@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestEngine_Fingerprint applies the same writes to two engines, one keeping
+// them in memory and one flushing and compacting them along the way, and
+// checks their fingerprints match until a single write diverges
+func TestEngine_Fingerprint(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-fingerprint-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+
+		memory, err := NewEngine(tempDir + "/memory")
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			return
+		}
+		defer memory.Close()
+		flushed, err := NewEngine(tempDir + "/flushed")
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			return
+		}
+		defer flushed.Close()
+
+		// Overwrites and deletes, so the flushed engine holds shadowed
+		// versions and tombstones in its blocks
+		for i := 0; i < 300; i++ {
+			key := []byte(fmt.Sprintf("key-%03d", i%120))
+			for _, engine := range []*Engine{memory, flushed} {
+				var err error
+				if i%7 == 0 {
+					err = engine.Delete(key)
+				} else {
+					err = engine.Put(key, []byte(fmt.Sprintf("value-%d", i)))
+				}
+				if err != nil {
+					t.Errorf("Failed to write: %v", err)
+				}
+			}
+			if i%25 == 24 {
+				if err := flushed.flush(); err != nil {
+					t.Errorf("Failed to flush: %v", err)
+				}
+			}
+			if i == 150 {
+				if err := flushed.CompactRange(0, nil, nil); err != nil {
+					t.Errorf("Failed to compact: %v", err)
+				}
+			}
+		}
+
+		// fingerprints returns the fingerprints of both engines over a range
+		fingerprints := func(start, end []byte) ([]byte, []byte) {
+			a, err := memory.Fingerprint(start, end)
+			if err != nil {
+				t.Errorf("Failed to fingerprint: %v", err)
+			}
+			b, err := flushed.Fingerprint(start, end)
+			if err != nil {
+				t.Errorf("Failed to fingerprint: %v", err)
+			}
+			return a, b
+		}
+
+		a, b := fingerprints(nil, nil)
+		if len(a) == 0 || !bytes.Equal(a, b) {
+			t.Errorf("Expected matching fingerprints, got %x and %x", a, b)
+		}
+
+		// A single divergent write changes the fingerprints of the ranges
+		// holding it, and only those
+		if err := flushed.Put([]byte("key-050"), []byte("divergent")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		if a, b := fingerprints(nil, nil); bytes.Equal(a, b) {
+			t.Errorf("Expected differing fingerprints after a divergent write, got %x", a)
+		}
+		if a, b := fingerprints([]byte("key-040"), []byte("key-060")); bytes.Equal(a, b) {
+			t.Errorf("Expected differing fingerprints of the divergent range, got %x", a)
+		}
+		if a, b := fingerprints([]byte("key-060"), nil); !bytes.Equal(a, b) {
+			t.Errorf("Expected matching fingerprints of the other keys, got %x and %x", a, b)
+		}
+
+		// Pairs are delimited, so moving bytes from a key to its value
+		// changes the fingerprint
+		if err := memory.Put([]byte("key-050"), []byte("divergent")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		if err := flushed.Delete([]byte("key-050")); err != nil {
+			t.Errorf("Failed to delete: %v", err)
+		}
+		if err := flushed.Put([]byte("key-05"), []byte("0divergent")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		if a, b := fingerprints([]byte("key-05"), []byte("key-051")); bytes.Equal(a, b) {
+			t.Errorf("Expected differing fingerprints of different pairs, got %x", a)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
@@ -0,0 +1,322 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestEngine_FlushTargetBlockSize flushes a memory table much larger than
+// the target block size and checks it is split into several blocks with
+// consecutive, non-overlapping key ranges
+func TestEngine_FlushTargetBlockSize(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-flush-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		opts := DefaultOptions()
+		opts.TargetBlockSize = 1024
+		opts.L0CompactionTrigger = 0
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+		defer engine.Close()
+
+		// About 20KB of pairs
+		const numKeys = 200
+		value := bytes.Repeat([]byte("v"), 90)
+		for i := 0; i < numKeys; i++ {
+			if err := engine.Put([]byte(fmt.Sprintf("key-%03d", i)), value); err != nil {
+				t.Errorf("Failed to put: %v", err)
+			}
+		}
+		if err := engine.flush(); err != nil {
+			t.Errorf("Failed to flush: %v", err)
+		}
+
+		engine.lsm.mu.RLock()
+		blocks := append([]blockInfo(nil), engine.lsm.levels[0]...)
+		engine.lsm.mu.RUnlock()
+		if len(blocks) < 10 {
+			t.Errorf("Expected the flush to write at least 10 blocks, got %d", len(blocks))
+		}
+
+		// Blocks are written in key order, each within its bounds and
+		// starting after the previous one ends
+		count := 0
+		for i, info := range blocks {
+			b, err := loadBlock(info.path)
+			if err != nil {
+				t.Errorf("Failed to load block: %v", err)
+				continue
+			}
+			if b.Size() > opts.TargetBlockSize+200 {
+				t.Errorf("Block %d is %d bytes, far over the %d-byte target", i, b.Size(), opts.TargetBlockSize)
+			}
+			if b.MinKey() != string(info.minKey) || b.MaxKey() != string(info.maxKey) {
+				t.Errorf("Block %d bounds %s..%s differ from its header %s..%s", i, info.minKey, info.maxKey, b.MinKey(), b.MaxKey())
+			}
+			if i > 0 && bytes.Compare(info.minKey, blocks[i-1].maxKey) <= 0 {
+				t.Errorf("Block %d starts at %s, not after the previous block's %s", i, info.minKey, blocks[i-1].maxKey)
+			}
+			for j := 0; j < b.Count(); j++ {
+				key, _ := b.Pair(j)
+				if expected := fmt.Sprintf("key-%03d", count); string(key) != expected {
+					t.Errorf("Expected %s, got %s", expected, key)
+				}
+				count++
+			}
+		}
+		if count != numKeys {
+			t.Errorf("Expected %d keys across the blocks, got %d", numKeys, count)
+		}
+
+		if value, err := engine.Get([]byte("key-123")); err != nil || len(value) != 90 {
+			t.Errorf("Failed to read a flushed key: %q (err %v)", value, err)
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+// TestEngine_FlushStats forces several flushes with a tiny memory table and
+// checks they are counted and timed
+func TestEngine_FlushStats(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-flush-stats-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		opts := DefaultOptions()
+		opts.MaxMemTableSize = 1
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+		defer engine.Close()
+
+		if stats := engine.GetStats().Flush; stats.Count != 0 || stats.AverageDuration != 0 {
+			t.Errorf("Expected no flushes on a fresh engine, got %+v", stats)
+		}
+
+		// Every write fills the memory table; wait for each flush
+		const flushes = 5
+		for i := 0; i < flushes; i++ {
+			if err := engine.Put([]byte(fmt.Sprintf("key-%d", i)), []byte("value")); err != nil {
+				t.Errorf("Failed to put: %v", err)
+			}
+			for start := time.Now(); engine.GetStats().Flush.Count <= int64(i); {
+				if time.Since(start) > 5*time.Second {
+					t.Errorf("Flush %d did not happen", i+1)
+					done <- true
+					return
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+
+		stats := engine.GetStats()
+		if stats.Flush.Count != flushes {
+			t.Errorf("Expected %d flushes, got %d", flushes, stats.Flush.Count)
+		}
+		if stats.Flush.AverageDuration <= 0 || stats.Flush.LastDuration <= 0 {
+			t.Errorf("Expected nonzero flush durations, got %+v", stats.Flush)
+		}
+		if stats.Flush.TotalDuration < stats.Flush.AverageDuration*flushes-flushes {
+			t.Errorf("Expected the total duration to cover every flush, got %+v", stats.Flush)
+		}
+		if stats.Flush.BytesWritten <= 0 || stats.Flush.BytesWritten != stats.Amplification.FlushBytesWritten {
+			t.Errorf("Expected the flushed bytes to be reported, got %d", stats.Flush.BytesWritten)
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+// TestEngine_FlushMaxKeys writes tiny values and checks the memory table is
+// flushed once it holds MaxMemTableKeys keys, long before its size limit,
+// with overwrites not counted and tombstones counted
+func TestEngine_FlushMaxKeys(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-flush-keys-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+
+		opts := DefaultOptions()
+		opts.MaxMemTableKeys = 100
+		opts.L0CompactionTrigger = 0
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			return
+		}
+		defer engine.Close()
+
+		for i := 0; i < 99; i++ {
+			if err := engine.Put([]byte(fmt.Sprintf("key-%03d", i)), []byte("v")); err != nil {
+				t.Errorf("Failed to put: %v", err)
+			}
+		}
+		for i := 0; i < 10; i++ {
+			if err := engine.Put([]byte("key-000"), []byte("w")); err != nil {
+				t.Errorf("Failed to put: %v", err)
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		if count := engine.GetStats().Flush.Count; count != 0 {
+			t.Errorf("Expected no flush below 100 keys, got %d", count)
+		}
+		if size := engine.memTable.size(); size >= opts.MaxMemTableSize {
+			t.Errorf("Expected the memory table far below its size limit, got %d bytes", size)
+		}
+
+		// The 100th key, a tombstone, fills the memory table
+		if err := engine.Delete([]byte("key-999")); err != nil {
+			t.Errorf("Failed to delete: %v", err)
+		}
+		for start := time.Now(); engine.GetStats().Flush.Count == 0; time.Sleep(time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				t.Errorf("Flush on key count did not happen")
+				return
+			}
+		}
+
+		engine.lsm.mu.RLock()
+		blocks := append([]blockInfo(nil), engine.lsm.levels[0]...)
+		engine.lsm.mu.RUnlock()
+		if len(blocks) != 1 {
+			t.Errorf("Expected one block, got %d", len(blocks))
+		} else if b, err := loadBlock(blocks[0].path); err != nil {
+			t.Errorf("Failed to load block: %v", err)
+		} else if b.Count() != 100 {
+			t.Errorf("Expected a block of 100 keys, got %d", b.Count())
+		}
+		if value, err := engine.Get([]byte("key-000")); err != nil || string(value) != "w" {
+			t.Errorf("Expected key-000=w, got %q (err %v)", value, err)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+// TestEngine_MemTableArena checks values copied into arenas are isolated
+// from the caller's buffers and from each other, keep empty values apart
+// from tombstones, and that overwriting one key flushes the memory table
+// once the arenas fill up
+func TestEngine_MemTableArena(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-arena-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+
+		opts := DefaultOptions()
+		opts.MemTableArena = true
+		opts.MemTableShards = 1 // One arena holding neighbouring values
+		opts.MaxMemTableSize = 64 * 1024
+		opts.L0CompactionTrigger = 0
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			return
+		}
+		defer engine.Close()
+
+		// The buffer is reused for every write
+		buf := []byte("first")
+		if err := engine.Put([]byte("a"), buf); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		copy(buf, "other")
+		if err := engine.Put([]byte("b"), buf); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		if value, err := engine.Get([]byte("a")); err != nil || string(value) != "first" {
+			t.Errorf("Expected a=first, got %q (err %v)", value, err)
+		}
+
+		// Appending to a value read back doesn't overwrite its neighbour
+		if value, err := engine.Get([]byte("a")); err == nil {
+			_ = append(value, "XXXXX"...)
+		}
+		if value, err := engine.Get([]byte("b")); err != nil || string(value) != "other" {
+			t.Errorf("Expected b=other, got %q (err %v)", value, err)
+		}
+
+		if err := engine.Put([]byte("empty"), nil); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		if value, err := engine.Get([]byte("empty")); err != nil || len(value) != 0 {
+			t.Errorf("Expected an empty value, got %q (err %v)", value, err)
+		}
+		if err := engine.Delete([]byte("b")); err != nil {
+			t.Errorf("Failed to delete: %v", err)
+		}
+		if _, err := engine.Get([]byte("b")); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected ErrKeyNotFound for the deleted key, got %v", err)
+		}
+
+		// Overwrites don't grow the memory table, but fill the arenas
+		value := make([]byte, 1024)
+		for i := 0; i < 64; i++ {
+			if err := engine.Put([]byte("overwritten"), value); err != nil {
+				t.Errorf("Failed to put: %v", err)
+			}
+		}
+		for start := time.Now(); engine.GetStats().Flush.Count == 0; time.Sleep(time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				t.Errorf("Flush on arena size did not happen")
+				return
+			}
+		}
+		if value, err := engine.Get([]byte("a")); err != nil || string(value) != "first" {
+			t.Errorf("Expected a=first after the flush, got %q (err %v)", value, err)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
@@ -0,0 +1,405 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestEngineGet_NotFoundSemantics covers present, absent, deleted and failing reads
+func TestEngineGet_NotFoundSemantics(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-get-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		engine, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+		defer engine.Close()
+
+		// Present
+		if err := engine.Put([]byte("present"), []byte("value")); err != nil {
+			t.Errorf("Failed to put key: %v", err)
+		}
+		if value, err := engine.Get([]byte("present")); err != nil || string(value) != "value" {
+			t.Errorf("Expected present key to return %q, got %q (err %v)", "value", value, err)
+		}
+
+		// Absent
+		if _, err := engine.Get([]byte("absent")); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected ErrKeyNotFound for absent key, got %v", err)
+		}
+
+		// Deleted while still in the memory table
+		if err := engine.Put([]byte("deleted"), []byte("value")); err != nil {
+			t.Errorf("Failed to put key: %v", err)
+		}
+		if err := engine.Delete([]byte("deleted")); err != nil {
+			t.Errorf("Failed to delete key: %v", err)
+		}
+		if _, err := engine.Get([]byte("deleted")); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected ErrKeyNotFound for deleted key, got %v", err)
+		}
+
+		// Deleted after the value was flushed: the tombstone must shadow the
+		// flushed value, both in the memory table and once flushed itself
+		if err := engine.Put([]byte("flushed"), []byte("value")); err != nil {
+			t.Errorf("Failed to put key: %v", err)
+		}
+		if err := engine.flush(); err != nil {
+			t.Errorf("Failed to flush: %v", err)
+		}
+		if err := engine.Delete([]byte("flushed")); err != nil {
+			t.Errorf("Failed to delete key: %v", err)
+		}
+		if _, err := engine.Get([]byte("flushed")); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected ErrKeyNotFound for tombstoned key, got %v", err)
+		}
+		if err := engine.flush(); err != nil {
+			t.Errorf("Failed to flush: %v", err)
+		}
+		if _, err := engine.Get([]byte("flushed")); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected ErrKeyNotFound for flushed tombstone, got %v", err)
+		}
+
+		// Simulated I/O error: the block holding the key disappears
+		if err := engine.Put([]byte("io-error"), []byte("value")); err != nil {
+			t.Errorf("Failed to put key: %v", err)
+		}
+		if err := engine.flush(); err != nil {
+			t.Errorf("Failed to flush: %v", err)
+		}
+		engine.lsm.mu.RLock()
+		path := engine.lsm.levels[0][len(engine.lsm.levels[0])-1].path
+		engine.lsm.mu.RUnlock()
+		if err := os.Remove(path); err != nil {
+			t.Errorf("Failed to remove block file: %v", err)
+		}
+		_, err = engine.Get([]byte("io-error"))
+		if err == nil || errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected an I/O error distinct from ErrKeyNotFound, got %v", err)
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+// TestEngine_EmptyKeysAndValues checks empty keys are rejected and empty
+// values survive the memory table, a flush, iteration and recovery without
+// being confused with tombstones
+func TestEngine_EmptyKeysAndValues(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-empty-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		engine, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+		defer engine.Close()
+
+		// Empty keys are rejected by every write
+		if err := engine.Put([]byte{}, []byte("value")); !errors.Is(err, ErrEmptyKey) {
+			t.Errorf("Expected ErrEmptyKey from Put, got %v", err)
+		}
+		if err := engine.Append(nil, []byte("value")); !errors.Is(err, ErrEmptyKey) {
+			t.Errorf("Expected ErrEmptyKey from Append, got %v", err)
+		}
+		if err := engine.Delete(nil); !errors.Is(err, ErrEmptyKey) {
+			t.Errorf("Expected ErrEmptyKey from Delete, got %v", err)
+		}
+
+		// checkEmpty expects key to hold an empty value and deleted to be gone
+		checkEmpty := func(engine *Engine, stage string) {
+			value, err := engine.Get([]byte("empty"))
+			if err != nil || value == nil || len(value) != 0 {
+				t.Errorf("%s: expected an empty value, got %q (err %v)", stage, value, err)
+			}
+			if _, err := engine.Get([]byte("deleted")); !errors.Is(err, ErrKeyNotFound) {
+				t.Errorf("%s: expected ErrKeyNotFound for the deleted key, got %v", stage, err)
+			}
+
+			it, err := engine.NewIterator(context.Background(), IteratorOptions{})
+			if err != nil {
+				t.Errorf("%s: failed to create iterator: %v", stage, err)
+				return
+			}
+			defer it.Close()
+			if got := fmt.Sprint(collect(t, it)); got != "[empty= nil=]" {
+				t.Errorf("%s: expected [empty= nil=], got %s", stage, got)
+			}
+		}
+
+		if err := engine.Put([]byte("empty"), []byte{}); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		if err := engine.Put([]byte("nil"), nil); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		if err := engine.Put([]byte("deleted"), []byte{}); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		if err := engine.Delete([]byte("deleted")); err != nil {
+			t.Errorf("Failed to delete: %v", err)
+		}
+		checkEmpty(engine, "Memory table")
+
+		// Recovery replays the WAL, before the flush
+		crash(engine)
+		reopened, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to reopen engine: %v", err)
+			done <- true
+			return
+		}
+		defer reopened.Close()
+		checkEmpty(reopened, "Recovered")
+
+		if err := engine.flush(); err != nil {
+			t.Errorf("Failed to flush: %v", err)
+		}
+		checkEmpty(engine, "Flushed")
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+// TestEngine_GetFromLevel compacts a key into level 1, then shadows it with
+// a newer version and a tombstone, checking each level returns its own
+func TestEngine_GetFromLevel(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-get-from-level-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+
+		engine, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			return
+		}
+		defer engine.Close()
+
+		// expect checks the value of key in each of the first levels
+		expect := func(step string, key string, values ...string) {
+			for level, expected := range values {
+				value, err := engine.GetFromLevel([]byte(key), level)
+				switch {
+				case expected == "" && !errors.Is(err, ErrKeyNotFound):
+					t.Errorf("%s: expected %s not found in L%d, got %q (err %v)", step, key, level, value, err)
+				case expected != "" && (err != nil || string(value) != expected):
+					t.Errorf("%s: expected %s=%s in L%d, got %q (err %v)", step, key, expected, level, value, err)
+				}
+			}
+		}
+
+		if err := engine.Put([]byte("key"), []byte("v1")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		if err := engine.Put([]byte("other"), []byte("o1")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		expect("Memory table", "key", "", "", "")
+
+		if err := engine.flush(); err != nil {
+			t.Errorf("Failed to flush: %v", err)
+		}
+		expect("Flushed", "key", "v1", "", "")
+
+		if err := engine.CompactRange(0, nil, nil); err != nil {
+			t.Errorf("Failed to compact: %v", err)
+		}
+		expect("Compacted", "key", "", "v1", "")
+
+		// A newer version in level 0 shadows the one in level 1
+		if err := engine.Put([]byte("key"), []byte("v2")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		if err := engine.Delete([]byte("other")); err != nil {
+			t.Errorf("Failed to delete: %v", err)
+		}
+		if err := engine.flush(); err != nil {
+			t.Errorf("Failed to flush: %v", err)
+		}
+		expect("Shadowed", "key", "v2", "v1", "")
+		expect("Deleted", "other", "", "o1", "")
+		if _, err := engine.Get([]byte("other")); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected the tombstone to hide other, got %v", err)
+		}
+
+		for _, level := range []int{-1, 7} {
+			if _, err := engine.GetFromLevel([]byte("key"), level); err == nil || errors.Is(err, ErrKeyNotFound) {
+				t.Errorf("Expected an invalid level error for level %d, got %v", level, err)
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+// TestEngine_GetWithMeta checks the sequence numbers of values grow with
+// every write and never fall below that of the write, from the memory
+// table, blocks (linked by dedup or compacted) and after a crash
+func TestEngine_GetWithMeta(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-get-meta-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+
+		opts := DefaultOptions()
+		opts.DedupBlocks = true
+		opts.L0CompactionTrigger = 0
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			return
+		}
+
+		// sequence returns the sequence number of key, checking its value
+		sequence := func(key, expected string) int64 {
+			value, meta, err := engine.GetWithMeta([]byte(key))
+			if err != nil || string(value) != expected {
+				t.Errorf("Expected %s=%s, got %q (err %v)", key, expected, value, err)
+			}
+			return meta.Sequence
+		}
+
+		// putAll writes a=1 and b=1, returning their sequence numbers
+		putAll := func() (int64, int64) {
+			for _, key := range []string{"a", "b"} {
+				if err := engine.Put([]byte(key), []byte("1")); err != nil {
+					t.Errorf("Failed to put: %v", err)
+				}
+			}
+			return sequence("a", "1"), sequence("b", "1")
+		}
+
+		// In the memory table, a write gets its own sequence number
+		first, second := putAll()
+		if first <= 0 || second <= first {
+			t.Errorf("Expected increasing sequence numbers, got a=%d b=%d", first, second)
+		}
+		if seq := sequence("a", "1"); seq != first {
+			t.Errorf("Expected the sequence number of a to stay %d, got %d", first, seq)
+		}
+		if err := engine.flush(); err != nil {
+			t.Errorf("Failed to flush: %v", err)
+		}
+		if seq := sequence("a", "1"); seq < first {
+			t.Errorf("Expected the flushed sequence number of a to be at least %d, got %d", first, seq)
+		}
+
+		// Writing the same pairs again links the flushed block to the first
+		// one, whose file then records the sequence number of the rewrite
+		rewritten, _ := putAll()
+		if err := engine.flush(); err != nil {
+			t.Errorf("Failed to flush: %v", err)
+		}
+		files, _ := filepath.Glob(filepath.Join(tempDir, "data", "L0", "*.blk"))
+		if len(files) != 2 {
+			t.Errorf("Expected 2 linked block files in L0, got %d", len(files))
+		}
+		for _, path := range files {
+			if info, err := readBlockInfo(path); err != nil || info.sequence < rewritten {
+				t.Errorf("Expected block %s to record a sequence number of at least %d, got %d (err %v)", filepath.Base(path), rewritten, info.sequence, err)
+			}
+		}
+		if err := engine.Put([]byte("c"), []byte("1")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		logged := sequence("c", "1")
+		crash(engine)
+		engine, err = NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to reopen engine: %v", err)
+			return
+		}
+		defer engine.Close()
+		if seq := sequence("a", "1"); seq < rewritten {
+			t.Errorf("Expected the sequence number of a to be at least %d, got %d", rewritten, seq)
+		}
+		if seq := sequence("c", "1"); seq != logged {
+			t.Errorf("Expected the sequence number %d to be recovered from the WAL, got %d", logged, seq)
+		}
+
+		// Writes after the reopen are numbered past every value read so far
+		previous := max(sequence("a", "1"), logged)
+		if err := engine.Put([]byte("a"), []byte("2")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		overwritten := sequence("a", "2")
+		if overwritten <= previous {
+			t.Errorf("Expected the overwrite to be numbered past %d, got %d", previous, overwritten)
+		}
+		if err := engine.Delete([]byte("b")); err != nil {
+			t.Errorf("Failed to delete: %v", err)
+		}
+		if _, _, err := engine.GetWithMeta([]byte("b")); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected ErrKeyNotFound for the deleted key, got %v", err)
+		}
+		if _, _, err := engine.GetWithMeta([]byte("absent")); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected ErrKeyNotFound for an absent key, got %v", err)
+		}
+
+		// Compaction keeps the sequence number of the newest input
+		if err := engine.flush(); err != nil {
+			t.Errorf("Failed to flush: %v", err)
+		}
+		for level := 0; level < 6; level++ {
+			if err := engine.CompactRange(level, nil, nil); err != nil {
+				t.Errorf("Failed to compact L%d: %v", level, err)
+			}
+		}
+		if seq := sequence("a", "2"); seq < overwritten {
+			t.Errorf("Expected the compacted sequence number of a to be at least %d, got %d", overwritten, seq)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
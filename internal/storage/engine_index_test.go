@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// cityIndex indexes JSON values by their city field
+func cityIndex() map[string]IndexExtractor {
+	return map[string]IndexExtractor{
+		"city": func(key, value []byte) ([]byte, bool) {
+			var user struct {
+				City string `json:"city"`
+			}
+			if json.Unmarshal(value, &user) != nil || user.City == "" {
+				return nil, false
+			}
+			return []byte(user.City), true
+		},
+	}
+}
+
+// TestEngine_Search indexes the city of JSON users and checks searches
+// follow puts, updates, deletes and bulk imports, and that the index is
+// saved on close and rebuilt when it wasn't kept up to date
+func TestEngine_Search(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-index-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	opts := DefaultOptions()
+	opts.Indexes = cityIndex()
+
+	// expect checks the keys found for each city
+	expect := func(engine *Engine, step string, expected map[string]string) {
+		for city, keys := range expected {
+			found, err := engine.Search("city", []byte(city))
+			if err != nil {
+				t.Errorf("%s: failed to search %s: %v", step, city, err)
+			}
+			if got := fmt.Sprintf("%s", found); got != keys {
+				t.Errorf("%s: expected %s in %s, got %s", step, keys, city, got)
+			}
+		}
+	}
+
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			return
+		}
+
+		users := map[string]string{
+			"user:1": `{"name":"ann","city":"paris"}`,
+			"user:2": `{"name":"bob","city":"oslo"}`,
+			"user:3": `{"name":"cid","city":"paris"}`,
+			"user:4": `{"name":"dee"}`,
+			"user:5": `not json`,
+		}
+		for key, value := range users {
+			if err := engine.Put([]byte(key), []byte(value)); err != nil {
+				t.Errorf("Failed to put: %v", err)
+			}
+		}
+		expect(engine, "Puts", map[string]string{"paris": "[user:1 user:3]", "oslo": "[user:2]", "rome": "[]"})
+
+		// Updates move a key to its new city, deletes remove it
+		if err := engine.Put([]byte("user:1"), []byte(`{"name":"ann","city":"oslo"}`)); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		if err := engine.Delete([]byte("user:2")); err != nil {
+			t.Errorf("Failed to delete: %v", err)
+		}
+		if err := engine.Put([]byte("user:4"), []byte(`{"name":"dee","city":"rome"}`)); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		if err := engine.Put([]byte("user:3"), []byte(`moved away`)); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		expect(engine, "Updates", map[string]string{"paris": "[]", "oslo": "[user:1]", "rome": "[user:4]"})
+
+		// Imported pairs are indexed once the import is committed, unless
+		// the key was written meanwhile
+		err = engine.BulkImport(func(w BulkWriter) error {
+			if err := w.Put([]byte("user:6"), []byte(`{"city":"paris"}`)); err != nil {
+				return err
+			}
+			if err := w.Put([]byte("user:4"), []byte(`{"city":"paris"}`)); err != nil {
+				return err
+			}
+			return engine.Put([]byte("user:4"), []byte(`{"city":"lima"}`))
+		})
+		if err != nil {
+			t.Errorf("Failed to import: %v", err)
+		}
+		expect(engine, "Import", map[string]string{"paris": "[user:6]", "rome": "[]", "lima": "[user:4]"})
+
+		if _, err := engine.Search("name", []byte("ann")); !errors.Is(err, ErrUnknownIndex) {
+			t.Errorf("Expected ErrUnknownIndex, got %v", err)
+		}
+		if err := engine.Close(); err != nil {
+			t.Errorf("Failed to close engine: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(tempDir, "index", "city.idx")); err != nil {
+			t.Errorf("Expected the index to be saved on close: %v", err)
+		}
+
+		// The saved index is loaded, and removed until the next close
+		engine, err = NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to reopen engine: %v", err)
+			return
+		}
+		if _, err := os.Stat(filepath.Join(tempDir, "index")); !os.IsNotExist(err) {
+			t.Errorf("Expected the saved index to be removed once loaded, got %v", err)
+		}
+		expect(engine, "Reopened", map[string]string{"oslo": "[user:1]", "paris": "[user:6]", "lima": "[user:4]"})
+		engine.Close()
+
+		// Writes made without the index are picked up by rebuilding it
+		engine, err = NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to reopen engine: %v", err)
+			return
+		}
+		if err := engine.Put([]byte("user:7"), []byte(`{"city":"oslo"}`)); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		engine.Close()
+
+		engine, err = NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to reopen engine: %v", err)
+			return
+		}
+		expect(engine, "Rebuilt", map[string]string{"oslo": "[user:1 user:7]", "paris": "[user:6]"})
+
+		// So are writes made before a crash
+		if err := engine.Delete([]byte("user:6")); err != nil {
+			t.Errorf("Failed to delete: %v", err)
+		}
+		crash(engine)
+
+		reopened, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to reopen engine: %v", err)
+			return
+		}
+		defer reopened.Close()
+		expect(reopened, "Crashed", map[string]string{"oslo": "[user:1 user:7]", "paris": "[]", "lima": "[user:4]"})
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// crash releases the directory lock of e without closing e, as the
+// operating system does when the process holding it dies, so that the
+// directory can be reopened as after a crash
+func crash(e *Engine) {
+	e.lock.release()
+}
+
+// TestEngine_DirectoryLock opens a writer and checks a second writer is
+// refused while it holds the directory, a read-only open isn't and follows
+// the writer, and a writer can open the directory once the first one is
+// closed
+func TestEngine_DirectoryLock(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-lock-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		writer, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+
+		if second, err := NewEngine(tempDir); !errors.Is(err, ErrLocked) {
+			t.Errorf("Expected a second writer to fail with ErrLocked, got %v", err)
+			if second != nil {
+				second.Close()
+			}
+		}
+
+		if err := writer.Put([]byte("a"), []byte("1")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		if err := writer.flush(); err != nil {
+			t.Errorf("Failed to flush: %v", err)
+		}
+
+		readOnly, err := OpenReadOnly(tempDir)
+		if err != nil {
+			t.Errorf("Failed to open read-only while the writer holds the lock: %v", err)
+		} else {
+			defer readOnly.Close()
+			if value, err := readOnly.Get([]byte("a")); err != nil || string(value) != "1" {
+				t.Errorf("Expected a=1, got %q (err %v)", value, err)
+			}
+
+			// The reader picks up the writer's flushed, compacted and
+			// unflushed writes on its next refresh
+			for _, key := range []string{"a", "b"} {
+				if err := writer.Put([]byte(key), []byte("2")); err != nil {
+					t.Errorf("Failed to put: %v", err)
+				}
+				if err := writer.flush(); err != nil {
+					t.Errorf("Failed to flush: %v", err)
+				}
+			}
+			if err := writer.CompactRange(0, nil, nil); err != nil {
+				t.Errorf("Failed to compact: %v", err)
+			}
+			if err := writer.Put([]byte("c"), []byte("2")); err != nil {
+				t.Errorf("Failed to put: %v", err)
+			}
+
+			deadline := time.Now().Add(3 * readOnlyRefreshInterval)
+			for _, key := range []string{"a", "b", "c"} {
+				for {
+					value, err := readOnly.Get([]byte(key))
+					if err == nil && string(value) == "2" {
+						break
+					}
+					if time.Now().After(deadline) {
+						t.Errorf("Expected the reader to see %s=2, got %q (err %v)", key, value, err)
+						break
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+		}
+
+		if err := writer.Close(); err != nil {
+			t.Errorf("Failed to close engine: %v", err)
+		}
+		next, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to open the directory after the writer closed: %v", err)
+		} else {
+			next.Close()
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
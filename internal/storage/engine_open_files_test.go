@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestEngine_MaxOpenFiles reads concurrently across more blocks than the
+// file limit and checks the number of open block files stays within it
+func TestEngine_MaxOpenFiles(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-open-files-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		opts := DefaultOptions()
+		opts.MaxOpenFiles = 2
+		opts.L0CompactionTrigger = 0
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+		defer engine.Close()
+
+		// Ten blocks with ten keys each
+		const numBlocks, keysPerBlock = 10, 10
+		for i := 0; i < numBlocks; i++ {
+			for j := 0; j < keysPerBlock; j++ {
+				key := fmt.Sprintf("key-%02d-%02d", i, j)
+				if err := engine.Put([]byte(key), []byte("value-"+key)); err != nil {
+					t.Errorf("Failed to put: %v", err)
+				}
+			}
+			if err := engine.flush(); err != nil {
+				t.Errorf("Failed to flush: %v", err)
+			}
+		}
+
+		// get reads every key from 8 readers at once
+		get := func() {
+			var wg sync.WaitGroup
+			for r := 0; r < 8; r++ {
+				wg.Add(1)
+				go func(r int) {
+					defer wg.Done()
+					for n := 0; n < numBlocks*keysPerBlock; n++ {
+						i := (n + r*7) % numBlocks
+						key := fmt.Sprintf("key-%02d-%02d", i, n%keysPerBlock)
+						value, err := engine.Get([]byte(key))
+						if err != nil || string(value) != "value-"+key {
+							t.Errorf("Expected value-%s, got %q (err %v)", key, value, err)
+						}
+					}
+				}(r)
+			}
+			wg.Wait()
+		}
+		get()
+
+		if maxOpen := engine.lsm.files.maxOpen; maxOpen > opts.MaxOpenFiles || maxOpen == 0 {
+			t.Errorf("Expected between 1 and %d open block files, got up to %d", opts.MaxOpenFiles, maxOpen)
+		}
+		if open := engine.GetStats().OpenBlockFiles; open > opts.MaxOpenFiles {
+			t.Errorf("Expected at most %d open block files, got %d", opts.MaxOpenFiles, open)
+		}
+
+		// Compacting the blocks into level 1 closes the handles of the merged blocks
+		engine.lsm.mergeMu.Lock()
+		engine.lsm.mu.Lock()
+		engine.lsm.compactLevel(0)
+		engine.lsm.mu.Unlock()
+		engine.lsm.mergeMu.Unlock()
+		if open := engine.GetStats().OpenBlockFiles; open != 0 {
+			t.Errorf("Expected the moved blocks to be closed, got %d open", open)
+		}
+		get()
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
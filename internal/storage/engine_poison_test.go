@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// errSyncFailed simulates a failing fsync, e.g. on a disk with I/O errors
+var errSyncFailed = errors.New("input/output error")
+
+// TestEngine_PoisonedBySyncFailure makes every WAL sync fail and checks the
+// failed write and all later ones return ErrEnginePoisoned, even once syncs
+// work again, while reads keep working and reopening the engine accepts
+// writes again
+func TestEngine_PoisonedBySyncFailure(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-poison-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	var failing atomic.Bool
+	original := fsyncFile
+	fsyncFile = func(f *os.File) error {
+		if failing.Load() {
+			return errSyncFailed
+		}
+		return original(f)
+	}
+	defer func() { fsyncFile = original }()
+
+	done := make(chan bool)
+	go func() {
+		engine, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+
+		if err := engine.Put([]byte("before"), []byte("value")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		if err := engine.Poisoned(); err != nil {
+			t.Errorf("Expected a healthy engine, got %v", err)
+		}
+
+		failing.Store(true)
+		err = engine.Put([]byte("failed"), []byte("value"))
+		if !errors.Is(err, ErrEnginePoisoned) || !errors.Is(err, errSyncFailed) {
+			t.Errorf("Expected the failed sync to poison the engine, got %v", err)
+		}
+		if err := engine.Poisoned(); !errors.Is(err, ErrEnginePoisoned) {
+			t.Errorf("Expected Poisoned to report the failure, got %v", err)
+		}
+
+		// Writes are refused even once syncs work again
+		failing.Store(false)
+		writes := map[string]func() error{
+			"Put":      func() error { return engine.Put([]byte("after"), []byte("value")) },
+			"PutAsync": func() error { return <-engine.PutAsync([]byte("after"), []byte("value")) },
+			"Append":   func() error { return engine.Append([]byte("before"), []byte("-more")) },
+			"Delete":   func() error { return engine.Delete([]byte("before")) },
+			"BulkImport": func() error {
+				return engine.BulkImport(func(w BulkWriter) error { return w.Put([]byte("imported"), []byte("value")) })
+			},
+		}
+		for name, write := range writes {
+			if err := write(); !errors.Is(err, ErrEnginePoisoned) {
+				t.Errorf("Expected %s to return ErrEnginePoisoned, got %v", name, err)
+			}
+		}
+
+		// Reads still see the writes made before the failure, and nothing
+		// of the refused ones
+		if value, err := engine.Get([]byte("before")); err != nil || string(value) != "value" {
+			t.Errorf("Expected before=value, got %q (err %v)", value, err)
+		}
+		for _, key := range []string{"failed", "after", "imported"} {
+			if _, err := engine.Get([]byte(key)); !errors.Is(err, ErrKeyNotFound) {
+				t.Errorf("Expected %s to be absent, got %v", key, err)
+			}
+		}
+
+		if err := engine.Close(); err != nil {
+			t.Errorf("Failed to close engine: %v", err)
+		}
+
+		// Reopening clears the poison
+		reopened, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to reopen engine: %v", err)
+			done <- true
+			return
+		}
+		defer reopened.Close()
+
+		if err := reopened.Poisoned(); err != nil {
+			t.Errorf("Expected the reopened engine to be healthy, got %v", err)
+		}
+		if err := reopened.Put([]byte("after"), []byte("value")); err != nil {
+			t.Errorf("Failed to put after reopening: %v", err)
+		}
+		for _, key := range []string{"before", "after"} {
+			if value, err := reopened.Get([]byte(key)); err != nil || string(value) != "value" {
+				t.Errorf("Expected %s=value after reopening, got %q (err %v)", key, value, err)
+			}
+		}
+		if _, err := reopened.Get([]byte("failed")); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected the failed write to be absent after reopening, got %v", err)
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
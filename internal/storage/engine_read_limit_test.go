@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestEngine_MaxConcurrentReads reads concurrently with more readers than
+// the read limit and checks the block decodes in flight stay within it, and
+// that a read waiting for a slot gives up once its context is done
+func TestEngine_MaxConcurrentReads(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-read-limit-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+
+		opts := DefaultOptions()
+		opts.MaxConcurrentReads = 2
+		opts.L0CompactionTrigger = 0
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			return
+		}
+		defer engine.Close()
+
+		// Ten blocks with ten keys each
+		const numBlocks, keysPerBlock = 10, 10
+		for i := 0; i < numBlocks; i++ {
+			for j := 0; j < keysPerBlock; j++ {
+				key := fmt.Sprintf("key-%02d-%02d", i, j)
+				if err := engine.Put([]byte(key), []byte("value-"+key)); err != nil {
+					t.Errorf("Failed to put: %v", err)
+				}
+			}
+			if err := engine.flush(); err != nil {
+				t.Errorf("Failed to flush: %v", err)
+			}
+		}
+
+		// Read every key from 16 readers at once
+		var wg sync.WaitGroup
+		for r := 0; r < 16; r++ {
+			wg.Add(1)
+			go func(r int) {
+				defer wg.Done()
+				for n := 0; n < numBlocks*keysPerBlock; n++ {
+					i := (n + r*7) % numBlocks
+					key := fmt.Sprintf("key-%02d-%02d", i, n%keysPerBlock)
+					value, err := engine.Get([]byte(key))
+					if err != nil || string(value) != "value-"+key {
+						t.Errorf("Expected value-%s, got %q (err %v)", key, value, err)
+						return
+					}
+				}
+			}(r)
+		}
+		wg.Wait()
+
+		limiter := engine.lsm.readLimiter
+		if peak := limiter.peak.Load(); peak > int64(opts.MaxConcurrentReads) || peak == 0 {
+			t.Errorf("Expected between 1 and %d block decodes in flight, got up to %d", opts.MaxConcurrentReads, peak)
+		}
+		if n := limiter.inFlight.Load(); n != 0 {
+			t.Errorf("Expected no block decodes in flight once the reads returned, got %d", n)
+		}
+
+		// With every slot taken, a read waits until its context is done
+		for i := 0; i < opts.MaxConcurrentReads; i++ {
+			if err := limiter.acquire(context.Background()); err != nil {
+				t.Errorf("Failed to take a read slot: %v", err)
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if _, err := engine.GetContext(ctx, []byte("key-00-00")); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected the queued read to give up with its context, got %v", err)
+		}
+
+		// Freeing a slot lets a waiting read through
+		result := make(chan error, 1)
+		go func() {
+			_, err := engine.Get([]byte("key-00-00"))
+			result <- err
+		}()
+		select {
+		case err := <-result:
+			t.Errorf("Expected the read to wait for a slot, got %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		limiter.release()
+		if err := <-result; err != nil {
+			t.Errorf("Expected the read to complete once a slot was freed, got %v", err)
+		}
+		limiter.release()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
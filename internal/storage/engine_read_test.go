@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/0xReLogic/river/internal/data/block"
+)
+
+// TestEngine_ReadLevelMatrix places versions of keys in different levels
+// and the memory table and checks reads return the newest version
+func TestEngine_ReadLevelMatrix(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-read-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		engine, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+		defer engine.Close()
+
+		// writeLevel writes a single block of pairs directly into a level
+		writeLevel := func(level int, pairs map[string]string) {
+			b := block.NewBlock()
+			for key, value := range pairs {
+				if err := b.Add([]byte(key), []byte(value)); err != nil {
+					t.Errorf("Failed to add pair: %v", err)
+				}
+			}
+			engine.lsm.mu.Lock()
+			defer engine.lsm.mu.Unlock()
+			if _, err := engine.lsm.writeBlock(level, b); err != nil {
+				t.Errorf("Failed to write block to L%d: %v", level, err)
+			}
+		}
+
+		// Older data is written to the deeper levels first
+		writeLevel(3, map[string]string{"both": "old", "shadowed": "l3"})
+		writeLevel(2, map[string]string{"l2-only": "from-l2", "shadowed": "l2"})
+		writeLevel(0, map[string]string{"both": "stale", "l0-only": "from-l0"})
+		writeLevel(0, map[string]string{"both": "new"})
+		if err := engine.Put([]byte("mem-only"), []byte("from-mem")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+
+		expected := map[string]string{
+			"l2-only":  "from-l2",
+			"l0-only":  "from-l0",
+			"both":     "new",
+			"shadowed": "l2",
+			"mem-only": "from-mem",
+		}
+		check := func(e *Engine, stage string) {
+			for key, value := range expected {
+				got, err := e.Get([]byte(key))
+				if err != nil {
+					t.Errorf("%s: failed to get %q: %v", stage, key, err)
+					continue
+				}
+				if string(got) != value {
+					t.Errorf("%s: expected %q for %q, got %q", stage, value, key, got)
+				}
+			}
+			if _, err := e.Get([]byte("missing")); !errors.Is(err, ErrKeyNotFound) {
+				t.Errorf("%s: expected ErrKeyNotFound for a missing key, got %v", stage, err)
+			}
+		}
+		check(engine, "initial")
+
+		// Block metadata and L0 order are rebuilt from the files on reopen
+		crash(engine)
+		reopened, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to reopen engine: %v", err)
+			done <- true
+			return
+		}
+		defer reopened.Close()
+		check(reopened, "reopened")
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+// TestEngine_GetDuringFlush checks keys stay readable while their memory
+// table is being flushed
+func TestEngine_GetDuringFlush(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-read-flush-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		engine, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+		defer engine.Close()
+
+		if err := engine.Put([]byte("key"), []byte("value")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+
+		// Hold the LSM tree lock so the flush stalls before its block is visible
+		engine.lsm.mu.Lock()
+		flushed := make(chan error)
+		go func() {
+			flushed <- engine.flush()
+		}()
+		for {
+			engine.mu.RLock()
+			flushing := engine.flushingMemTable != nil
+			engine.mu.RUnlock()
+			if flushing {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		engine.mu.RLock()
+		value, ok := engine.memoryLookup([]byte("key"))
+		engine.mu.RUnlock()
+		if !ok || string(value) != "value" {
+			t.Errorf("Expected key to be readable mid-flush, got %q (found %v)", value, ok)
+		}
+		engine.lsm.mu.Unlock()
+
+		if err := <-flushed; err != nil {
+			t.Errorf("Failed to flush: %v", err)
+		}
+		if value, err := engine.Get([]byte("key")); err != nil || string(value) != "value" {
+			t.Errorf("Expected key after flush, got %q (err %v)", value, err)
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/0xReLogic/river/internal/data/block"
+)
+
+// snapshotDir returns the size and modification time of every file and
+// directory under dir, keyed by path
+func snapshotDir(t *testing.T, dir string) map[string]string {
+	snapshot := make(map[string]string)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		snapshot[path] = fmt.Sprintf("%d %s", info.Size(), info.ModTime())
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to walk %s: %v", dir, err)
+	}
+	return snapshot
+}
+
+// TestEngine_OpenReadOnly opens a directory holding a block, a checkpoint
+// and WAL entries read-only, and checks reads see all of them while writes
+// are rejected and nothing on disk changes
+func TestEngine_OpenReadOnly(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-readonly-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Populate the directory: a flushed block, then a checkpoint, then the WAL
+	tree, err := NewLSMTree(filepath.Join(tempDir, "data"))
+	if err != nil {
+		t.Fatalf("Failed to create LSM tree: %v", err)
+	}
+	b := block.NewBlock()
+	for _, key := range []string{"a", "b", "c"} {
+		if err := b.Add([]byte(key), []byte("1")); err != nil {
+			t.Fatalf("Failed to add pair: %v", err)
+		}
+	}
+	if err := tree.Write(b); err != nil {
+		t.Fatalf("Failed to write block: %v", err)
+	}
+	tree.Close()
+
+	checkpoint, err := NewCheckpoint(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to create checkpoint: %v", err)
+	}
+	if err := checkpoint.Save(map[string][]byte{"b": []byte("2")}, 2, 0); err != nil {
+		t.Fatalf("Failed to save checkpoint: %v", err)
+	}
+
+	wal, err := NewWAL(filepath.Join(tempDir, "wal"))
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	if err := wal.AppendPut([]byte("c"), []byte("3")); err != nil {
+		t.Fatalf("Failed to append to WAL: %v", err)
+	}
+	if err := wal.AppendDelete([]byte("a")); err != nil {
+		t.Fatalf("Failed to append to WAL: %v", err)
+	}
+	if err := wal.AppendPut([]byte("d"), []byte("3")); err != nil {
+		t.Fatalf("Failed to append to WAL: %v", err)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatalf("Failed to close WAL: %v", err)
+	}
+
+	before := snapshotDir(t, tempDir)
+
+	engine, err := OpenReadOnly(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to open read-only: %v", err)
+	}
+
+	// Reads see the block, the checkpoint and the WAL
+	if _, err := engine.Get([]byte("a")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound for a deleted key, got %v", err)
+	}
+	for key, expected := range map[string]string{"b": "2", "c": "3", "d": "3"} {
+		if value, err := engine.Get([]byte(key)); err != nil || string(value) != expected {
+			t.Errorf("Expected %s=%s, got %q (err %v)", key, expected, value, err)
+		}
+	}
+	it, err := engine.NewIterator(context.Background(), IteratorOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create iterator: %v", err)
+	}
+	if got := fmt.Sprint(collect(t, it)); got != "[b=2 c=3 d=3]" {
+		t.Errorf("Expected [b=2 c=3 d=3], got %s", got)
+	}
+	it.Close()
+
+	// Writes are rejected
+	if err := engine.Put([]byte("e"), []byte("4")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected ErrReadOnly from Put, got %v", err)
+	}
+	if err := engine.Append([]byte("b"), []byte("4")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected ErrReadOnly from Append, got %v", err)
+	}
+	if err := engine.Delete([]byte("b")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected ErrReadOnly from Delete, got %v", err)
+	}
+	if err := engine.flush(); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected ErrReadOnly from flush, got %v", err)
+	}
+
+	// Leave time for any background checkpoint to run, then close
+	time.Sleep(2 * engine.checkpointInterval)
+	if err := engine.Close(); err != nil {
+		t.Errorf("Failed to close engine: %v", err)
+	}
+
+	after := snapshotDir(t, tempDir)
+	if fmt.Sprint(after) != fmt.Sprint(before) {
+		t.Errorf("Directory changed while open read-only:\nbefore %v\nafter  %v", before, after)
+	}
+
+	// A missing directory is not created
+	missing := filepath.Join(tempDir, "missing")
+	if _, err := OpenReadOnly(missing); err == nil {
+		t.Errorf("Expected an error opening a missing directory")
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("Expected %s not to be created, got %v", missing, err)
+	}
+}
+
+// TestEngine_GetWithStaleness reads from a read-only engine lagging its
+// writer, and checks a read allowing less staleness than the lag is
+// rejected until the engine catches up
+func TestEngine_GetWithStaleness(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-staleness-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		writer, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+		defer writer.Close()
+
+		if err := writer.Put([]byte("a"), []byte("1")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		follower, err := OpenReadOnly(tempDir)
+		if err != nil {
+			t.Errorf("Failed to open read-only: %v", err)
+			done <- true
+			return
+		}
+		defer follower.Close()
+
+		// The follower lags once it hasn't applied the WAL for longer than
+		// the allowed staleness; it refreshes only every second
+		time.Sleep(300 * time.Millisecond)
+		if err := writer.Put([]byte("b"), []byte("2")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		if staleness := follower.Staleness(); staleness < 300*time.Millisecond {
+			t.Errorf("Expected the follower to lag at least 300ms, got %v", staleness)
+		}
+		if _, err := follower.GetWithStaleness([]byte("b"), 200*time.Millisecond); !errors.Is(err, ErrTooStale) {
+			t.Errorf("Expected ErrTooStale from the lagging follower, got %v", err)
+		}
+		if value, err := follower.GetWithStaleness([]byte("a"), time.Minute); err != nil || string(value) != "1" {
+			t.Errorf("Expected a=1 allowing a minute of staleness, got %q (err %v)", value, err)
+		}
+
+		// Once caught up, the follower serves fresh reads
+		if err := follower.refresh(); err != nil {
+			t.Errorf("Failed to refresh: %v", err)
+		}
+		if value, err := follower.GetWithStaleness([]byte("b"), 200*time.Millisecond); err != nil || string(value) != "2" {
+			t.Errorf("Expected b=2 after catching up, got %q (err %v)", value, err)
+		}
+
+		// The writer is never stale
+		if value, err := writer.GetWithStaleness([]byte("b"), 0); err != nil || string(value) != "2" {
+			t.Errorf("Expected b=2 from the writer, got %q (err %v)", value, err)
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
@@ -0,0 +1,252 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestEngine_RecoveryStats reopens a populated directory and checks the
+// recovery statistics report the replayed WAL entries
+func TestEngine_RecoveryStats(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-recovery-stats-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		engine, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+		defer engine.Close()
+
+		if stats := engine.RecoveryStats(); stats.WALEntriesReplayed != 0 {
+			t.Errorf("Expected nothing to replay on a fresh directory, got %d entries", stats.WALEntriesReplayed)
+		}
+
+		const numKeys = 100
+		for i := 0; i < numKeys; i++ {
+			key := []byte(fmt.Sprintf("recovery-key-%d", i))
+			if err := engine.Put(key, []byte("value")); err != nil {
+				t.Errorf("Failed to put key: %v", err)
+			}
+		}
+
+		// Reopen the directory without closing, as after a crash
+		crash(engine)
+		reopened, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to reopen engine: %v", err)
+			done <- true
+			return
+		}
+		defer reopened.Close()
+
+		stats := reopened.RecoveryStats()
+		if stats.WALEntriesReplayed < numKeys {
+			t.Errorf("Expected at least %d replayed entries, got %d", numKeys, stats.WALEntriesReplayed)
+		}
+		if stats.WALBytesReplayed <= 0 {
+			t.Errorf("Expected replayed bytes to be reported, got %d", stats.WALBytesReplayed)
+		}
+		if stats.TotalTime <= 0 || stats.TotalTime < stats.WALReplayTime {
+			t.Errorf("Unexpected recovery timing: total %v, WAL replay %v", stats.TotalTime, stats.WALReplayTime)
+		}
+		if got := reopened.GetStats().Recovery; got != stats {
+			t.Errorf("Expected GetStats to include recovery stats %+v, got %+v", stats, got)
+		}
+
+		if _, err := reopened.Get([]byte("recovery-key-42")); err != nil {
+			t.Errorf("Failed to get recovered key: %v", err)
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+// TestEngine_EmptyWALFile leaves empty WAL files around the segment of a
+// closed engine, as a crash right after creating a file would, and checks
+// a read-only engine skips them while a writer removes them and continues
+// in a new segment
+func TestEngine_EmptyWALFile(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-empty-wal-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+
+		engine, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			return
+		}
+		for i := 0; i < 5; i++ {
+			if err := engine.Put([]byte(fmt.Sprintf("key-%d", i)), []byte("value")); err != nil {
+				t.Errorf("Failed to put: %v", err)
+			}
+		}
+		crash(engine)
+
+		// An empty file older and one newer than the segment written
+		walDir := filepath.Join(tempDir, "wal")
+		ids, err := listWALSegments(walDir)
+		if err != nil || len(ids) != 1 {
+			t.Errorf("Expected a single WAL file, got %v (err %v)", ids, err)
+			return
+		}
+		empty := []string{
+			filepath.Join(walDir, fmt.Sprintf("%d.wal", ids[0]-1)),
+			filepath.Join(walDir, fmt.Sprintf("%d.wal", ids[0]+1)),
+		}
+		for _, path := range empty {
+			if err := os.WriteFile(path, nil, 0644); err != nil {
+				t.Errorf("Failed to create empty WAL file: %v", err)
+			}
+		}
+
+		// expect checks an engine recovered every key
+		expect := func(engine *Engine, keys int) {
+			for i := 0; i < keys; i++ {
+				key := fmt.Sprintf("key-%d", i)
+				if value, err := engine.Get([]byte(key)); err != nil || string(value) != "value" {
+					t.Errorf("Expected %s=value, got %q (err %v)", key, value, err)
+				}
+			}
+		}
+
+		readOnly, err := OpenReadOnly(tempDir)
+		if err != nil {
+			t.Errorf("Failed to open read-only engine: %v", err)
+			return
+		}
+		expect(readOnly, 5)
+		readOnly.Close()
+		for _, path := range empty {
+			if _, err := os.Stat(path); err != nil {
+				t.Errorf("Expected a read-only engine to leave %s alone: %v", filepath.Base(path), err)
+			}
+		}
+
+		engine, err = NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to reopen engine: %v", err)
+			return
+		}
+		expect(engine, 5)
+		for _, path := range empty {
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("Expected %s to be removed, got %v", filepath.Base(path), err)
+			}
+		}
+
+		// The empty file was the latest, so writes go to a newer segment
+		// than the one written before
+		if current := engine.wal.file.Name(); current <= empty[1] {
+			t.Errorf("Expected a new WAL file after %s, got %s", filepath.Base(empty[1]), filepath.Base(current))
+		}
+		if err := engine.Put([]byte("key-5"), []byte("value")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		crash(engine)
+
+		reopened, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to reopen engine: %v", err)
+			return
+		}
+		defer reopened.Close()
+		expect(reopened, 6)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+// TestEngine_OpenTimeout opens an engine over a large WAL with a timeout too
+// short to replay it, and checks the open fails with ErrOpenTimeout without
+// holding the lock or losing data
+func TestEngine_OpenTimeout(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-open-timeout-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	const keys = 50000
+	wal, err := NewWAL(filepath.Join(tempDir, "wal"))
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	for i := 0; i < keys; i++ {
+		if _, err := wal.AppendPutAsync([]byte(fmt.Sprintf("key-%05d", i)), []byte("value")); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatalf("Failed to close WAL: %v", err)
+	}
+
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+
+		opts := DefaultOptions()
+		opts.OpenTimeout = time.Millisecond
+		start := time.Now()
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if !errors.Is(err, ErrOpenTimeout) {
+			if engine != nil {
+				engine.Close()
+			}
+			t.Errorf("Expected ErrOpenTimeout, got %v", err)
+			return
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("Expected the open to give up quickly, took %v", elapsed)
+		}
+		if _, err := os.Stat(filepath.Join(tempDir, "checkpoint", "checkpoint.json")); !os.IsNotExist(err) {
+			t.Errorf("Expected no checkpoint written by the failed open, got err %v", err)
+		}
+
+		// Without a timeout the whole WAL is recovered
+		engine, err = NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to reopen engine: %v", err)
+			return
+		}
+		defer engine.Close()
+		for _, i := range []int{0, keys / 2, keys - 1} {
+			key := fmt.Sprintf("key-%05d", i)
+			if value, err := engine.Get([]byte(key)); err != nil || string(value) != "value" {
+				t.Errorf("Expected %s=value, got %q (err %v)", key, value, err)
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/0xReLogic/river/internal/data/block"
+)
+
+// TestEngine_ScanWhere scans integer columns spread over many blocks with
+// a range predicate, and checks only the blocks whose value stats overlap
+// the range are decoded, and that newer versions and deletes in skipped
+// key ranges are still honored
+func TestEngine_ScanWhere(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-scan-where-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		opts := DefaultOptions()
+		opts.L0CompactionTrigger = 0
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+		defer engine.Close()
+
+		// row-NNN holds the values NNN*10 to NNN*10+5, in small L1 blocks
+		for i := 0; i < 100; i++ {
+			values := []int64{int64(i * 10), int64(i*10 + 5)}
+			if err := engine.PutColumn([]byte(fmt.Sprintf("row-%03d", i)), block.Int64, values); err != nil {
+				t.Errorf("Failed to put column: %v", err)
+			}
+		}
+		if err := engine.Put([]byte("row-050-note"), []byte("not a column")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		if err := engine.flush(); err != nil {
+			t.Errorf("Failed to flush: %v", err)
+		}
+		engine.lsm.mu.Lock()
+		engine.lsm.targetBlockSize = 256
+		engine.lsm.mu.Unlock()
+		if err := engine.CompactRange(0, nil, nil); err != nil {
+			t.Errorf("Failed to compact: %v", err)
+		}
+
+		// scan returns the keys matching a predicate, and the number of
+		// blocks decoded
+		scan := func(engine *Engine, pred Predicate) ([]string, int64) {
+			before := engine.lsm.files.decoded.Load()
+			it, err := engine.ScanWhere(nil, nil, pred)
+			if err != nil {
+				t.Errorf("Failed to scan: %v", err)
+				return nil, 0
+			}
+			defer it.Close()
+
+			var keys []string
+			for it.Next() {
+				keys = append(keys, string(it.Key()))
+			}
+			if err := it.Err(); err != nil {
+				t.Errorf("Iterator failed: %v", err)
+			}
+			return keys, engine.lsm.files.decoded.Load() - before
+		}
+
+		// matchingBlocks counts the L1 blocks whose stats overlap [lo, hi]
+		matchingBlocks := func(engine *Engine, lo, hi int64) (int, int) {
+			engine.lsm.mu.RLock()
+			defer engine.lsm.mu.RUnlock()
+			matching := 0
+			for _, info := range engine.lsm.levels[1] {
+				if !info.valueStats {
+					t.Errorf("Block %s has no value stats", info.path)
+				}
+				if info.minValue <= NumericStat(hi) && info.maxValue >= NumericStat(lo) {
+					matching++
+				}
+			}
+			return matching, len(engine.lsm.levels[1])
+		}
+
+		matching, total := matchingBlocks(engine, 400, 420)
+		if total < 10 || matching > 2 {
+			t.Errorf("Expected many L1 blocks, at most 2 matching, got %d of %d", matching, total)
+		}
+		keys, decoded := scan(engine, IntRange(400, 420))
+		if got := fmt.Sprint(keys); got != "[row-040 row-041 row-042]" {
+			t.Errorf("Expected rows 40 to 42, got %s", got)
+		}
+		if decoded != int64(matching) {
+			t.Errorf("Expected the %d matching blocks of %d to be decoded, got %d", matching, total, decoded)
+		}
+
+		// A predicate without bounds reads every block
+		keys, decoded = scan(engine, unboundedPredicate{IntRange(400, 420)})
+		if got := fmt.Sprint(keys); got != "[row-040 row-041 row-042]" {
+			t.Errorf("Expected rows 40 to 42 without bounds, got %s", got)
+		}
+		if decoded != int64(total) {
+			t.Errorf("Expected all %d blocks to be decoded without bounds, got %d", total, decoded)
+		}
+
+		// Level 0 blocks over the L1 key ranges: a newer matching version
+		// of row-005, a newer non-matching version of row-040 and a delete
+		// of row-041. The level 0 blocks overlap older blocks, so they are
+		// read whatever their stats.
+		if err := engine.PutColumn([]byte("row-005"), block.Int64, []int64{415}); err != nil {
+			t.Errorf("Failed to put column: %v", err)
+		}
+		if err := engine.PutColumn([]byte("row-040"), block.Int64, []int64{1}); err != nil {
+			t.Errorf("Failed to put column: %v", err)
+		}
+		if err := engine.flush(); err != nil {
+			t.Errorf("Failed to flush: %v", err)
+		}
+		if err := engine.Delete([]byte("row-041")); err != nil {
+			t.Errorf("Failed to delete: %v", err)
+		}
+		if err := engine.flush(); err != nil {
+			t.Errorf("Failed to flush: %v", err)
+		}
+		keys, _ = scan(engine, IntRange(400, 420))
+		if got := fmt.Sprint(keys); got != "[row-005 row-042]" {
+			t.Errorf("Expected rows 5 and 42 after the updates, got %s", got)
+		}
+
+		// The stats are read back from the block files
+		crash(engine)
+		reopened, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to reopen engine: %v", err)
+			done <- true
+			return
+		}
+		defer reopened.Close()
+
+		matching, total = matchingBlocks(reopened, 900, 905)
+		keys, decoded = scan(reopened, IntRange(900, 905))
+		if got := fmt.Sprint(keys); got != "[row-090]" {
+			t.Errorf("Expected row 90 after reopening, got %s", got)
+		}
+		if level0 := int64(2); decoded != int64(matching)+level0 {
+			t.Errorf("Expected the %d matching blocks of %d and the level 0 blocks to be decoded, got %d", matching, total, decoded)
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+// unboundedPredicate hides the bounds of a predicate
+type unboundedPredicate struct {
+	Predicate
+}
+
+func (unboundedPredicate) Bounds() (uint64, uint64, bool) {
+	return 0, 0, false
+}
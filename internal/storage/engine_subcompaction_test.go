@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/0xReLogic/river/internal/data/block"
+)
+
+// subCompactionRun is the outcome of compacting the same input with a
+// number of sub-compactions
+type subCompactionRun struct {
+	// Fingerprint of the engine's data after the compaction
+	fingerprint []byte
+
+	// Number of L1 blocks written
+	blocks int
+
+	// Time the compaction took
+	duration time.Duration
+}
+
+// runSubCompaction bulk loads overlapping level 0 blocks, with overwrites
+// and deletes, and compacts them into level 1 with the given number of
+// sub-compactions, checking the level 1 blocks don't overlap
+func runSubCompaction(t *testing.T, subCompactions int) subCompactionRun {
+	tempDir, err := os.MkdirTemp("", "river-subcompaction-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	opts := DefaultOptions()
+	opts.Compression = block.CompressionLZ4
+	opts.TargetBlockSize = 64 * 1024
+	opts.SubCompactions = subCompactions
+	engine, err := NewEngineWithOptions(tempDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to create engine: %v", err)
+	}
+	defer engine.Close()
+
+	value := bytes.Repeat([]byte("river sub-compaction "), 8)
+	for round := 0; round < 3; round++ {
+		err := engine.BulkImport(func(w BulkWriter) error {
+			for i := round; i < 20000; i += round + 1 {
+				key := fmt.Sprintf("key-%06d", i)
+				if err := w.Put([]byte(key), append([]byte(key), value...)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Errorf("Failed to import: %v", err)
+		}
+	}
+	for i := 0; i < 20000; i += 97 {
+		if err := engine.Delete([]byte(fmt.Sprintf("key-%06d", i))); err != nil {
+			t.Errorf("Failed to delete: %v", err)
+		}
+	}
+	if err := engine.flush(); err != nil {
+		t.Errorf("Failed to flush: %v", err)
+	}
+
+	var result subCompactionRun
+	engine.lsm.mergeMu.Lock()
+	engine.lsm.mu.Lock()
+	start := time.Now()
+	if err := engine.lsm.mergeBlocks(engine.lsm.levels[0], 1); err != nil {
+		t.Errorf("Failed to compact: %v", err)
+	}
+	result.duration = time.Since(start)
+	result.blocks = len(engine.lsm.levels[1])
+	if err := engine.lsm.levelOverlap(); err != nil {
+		t.Errorf("%d sub-compactions: %v", subCompactions, err)
+	}
+	engine.lsm.mu.Unlock()
+	engine.lsm.mergeMu.Unlock()
+
+	if result.fingerprint, err = engine.Fingerprint(nil, nil); err != nil {
+		t.Errorf("Failed to fingerprint: %v", err)
+	}
+	return result
+}
+
+// TestSubCompaction compacts the same input serially and with parallel
+// sub-compactions, and checks they hold the same data, and that the
+// parallel compaction is faster given several CPUs
+func TestSubCompaction(t *testing.T) {
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+
+		serial := runSubCompaction(t, 1)
+		parallel := runSubCompaction(t, 4)
+		t.Logf("Serial: %d blocks in %v, 4 sub-compactions: %d blocks in %v",
+			serial.blocks, serial.duration, parallel.blocks, parallel.duration)
+
+		if !bytes.Equal(serial.fingerprint, parallel.fingerprint) {
+			t.Errorf("Expected the same data from serial and parallel compaction")
+		}
+
+		// Each range may end with a smaller block
+		if parallel.blocks < serial.blocks || parallel.blocks > serial.blocks+3 {
+			t.Errorf("Expected about %d blocks from parallel compaction, got %d", serial.blocks, parallel.blocks)
+		}
+
+		if runtime.GOMAXPROCS(0) >= 2 && parallel.duration >= serial.duration {
+			t.Errorf("Expected parallel compaction to be faster, took %v against %v", parallel.duration, serial.duration)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+// TestSubCompactionRanges checks the keys of a merge are split into
+// contiguous ranges of whole keys, of about the same size and no smaller
+// than a block
+func TestSubCompactionRanges(t *testing.T) {
+	tree := &LSMTree{subCompactions: 4, targetBlockSize: 1000}
+
+	entries := make(map[string][]byte)
+	var keys []string
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%04d", i)
+		entries[key] = make([]byte, i%50) // Pairs of 16-65 bytes
+		keys = append(keys, key)
+	}
+
+	ranges := tree.subCompactionRanges(keys, entries)
+	if len(ranges) != 4 {
+		t.Fatalf("Expected 4 ranges, got %d", len(ranges))
+	}
+	if joined := slices.Concat(ranges...); !slices.Equal(joined, keys) {
+		t.Errorf("Expected the ranges to cover the keys in order")
+	}
+	for i, r := range ranges {
+		if len(r) < 200 || len(r) > 300 {
+			t.Errorf("Expected about 250 keys in range %d, got %d", i, len(r))
+		}
+	}
+
+	// A merge too small for a block per range is split in fewer ranges
+	if ranges := tree.subCompactionRanges(keys[:50], entries); len(ranges) != 2 {
+		t.Errorf("Expected 2 ranges of a small merge, got %d", len(ranges))
+	}
+	tree.targetBlockSize = 0
+	if ranges := tree.subCompactionRanges(keys, entries); len(ranges) != 1 {
+		t.Errorf("Expected a single range without a target block size, got %d", len(ranges))
+	}
+}
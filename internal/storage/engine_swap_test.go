@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestEngine_Swap swaps and takes absent, memory-table-resident, flushed
+// and deleted keys, checking the previous value returned and the value left
+func TestEngine_Swap(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-swap-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+
+		engine, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			return
+		}
+		defer engine.Close()
+
+		// expectOld checks the previous value returned by a Swap or TakeDelete
+		expectOld := func(step string, old []byte, existed bool, err error, expected string, expectedExisted bool) {
+			if err != nil {
+				t.Errorf("%s: failed: %v", step, err)
+				return
+			}
+			if existed != expectedExisted || string(old) != expected {
+				t.Errorf("%s: expected previous value %q (existed %v), got %q (existed %v)",
+					step, expected, expectedExisted, old, existed)
+			}
+		}
+
+		// expect checks the current value of key, "" for not found
+		expect := func(step, key, expected string) {
+			value, err := engine.Get([]byte(key))
+			switch {
+			case expected == "" && !errors.Is(err, ErrKeyNotFound):
+				t.Errorf("%s: expected %s not found, got %q (err %v)", step, key, value, err)
+			case expected != "" && (err != nil || string(value) != expected):
+				t.Errorf("%s: expected %s=%s, got %q (err %v)", step, key, expected, value, err)
+			}
+		}
+
+		flush := func() {
+			if err := engine.flush(); err != nil {
+				t.Errorf("Failed to flush: %v", err)
+			}
+		}
+
+		// Previously absent
+		old, existed, err := engine.Swap([]byte("a"), []byte("1"))
+		expectOld("Swap absent", old, existed, err, "", false)
+		expect("Swap absent", "a", "1")
+		old, existed, err = engine.TakeDelete([]byte("b"))
+		expectOld("Take absent", old, existed, err, "", false)
+		expect("Take absent", "b", "")
+
+		// Previously present, in the memory table then on disk
+		old, existed, err = engine.Swap([]byte("a"), []byte("2"))
+		expectOld("Swap in memory", old, existed, err, "1", true)
+		flush()
+		old, existed, err = engine.Swap([]byte("a"), []byte("3"))
+		expectOld("Swap flushed", old, existed, err, "2", true)
+		expect("Swap flushed", "a", "3")
+
+		// An empty value exists
+		if err := engine.Put([]byte("empty"), nil); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		flush()
+		old, existed, err = engine.TakeDelete([]byte("empty"))
+		expectOld("Take empty", old, existed, err, "", true)
+		expect("Take empty", "empty", "")
+
+		// Previously deleted, with a tombstone in the memory table then on
+		// disk above an older flushed value
+		old, existed, err = engine.TakeDelete([]byte("a"))
+		expectOld("Take in memory", old, existed, err, "3", true)
+		old, existed, err = engine.TakeDelete([]byte("a"))
+		expectOld("Take deleted", old, existed, err, "", false)
+		flush()
+		old, existed, err = engine.Swap([]byte("a"), []byte("4"))
+		expectOld("Swap deleted", old, existed, err, "", false)
+		expect("Swap deleted", "a", "4")
+
+		// The writes go through the WAL
+		crash(engine)
+		reopened, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to reopen engine: %v", err)
+			return
+		}
+		defer reopened.Close()
+		engine = reopened
+		expect("Recovered", "a", "4")
+		expect("Recovered", "empty", "")
+
+		if _, _, err := engine.Swap(nil, []byte("v")); !errors.Is(err, ErrEmptyKey) {
+			t.Errorf("Expected ErrEmptyKey, got %v", err)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+// TestEngine_DeleteBatch deletes memory-table-resident, flushed, absent,
+// already deleted and repeated keys in one batch, counting only those that
+// existed, and checks the batch is recovered after a crash
+func TestEngine_DeleteBatch(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-delete-batch-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+
+		engine, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			return
+		}
+
+		for _, key := range []string{"flushed", "deleted"} {
+			if err := engine.Put([]byte(key), []byte("value")); err != nil {
+				t.Errorf("Failed to put: %v", err)
+			}
+		}
+		if err := engine.flush(); err != nil {
+			t.Errorf("Failed to flush: %v", err)
+		}
+		if err := engine.Delete([]byte("deleted")); err != nil {
+			t.Errorf("Failed to delete: %v", err)
+		}
+		for _, key := range []string{"memory", "kept"} {
+			if err := engine.Put([]byte(key), []byte("value")); err != nil {
+				t.Errorf("Failed to put: %v", err)
+			}
+		}
+
+		// An invalid key fails the batch before anything is deleted
+		if _, err := engine.DeleteBatch([][]byte{[]byte("memory"), nil}); !errors.Is(err, ErrEmptyKey) {
+			t.Errorf("Expected ErrEmptyKey, got %v", err)
+		}
+		if _, err := engine.Get([]byte("memory")); err != nil {
+			t.Errorf("Expected memory to survive the failed batch, got %v", err)
+		}
+
+		keys := [][]byte{[]byte("memory"), []byte("flushed"), []byte("absent"), []byte("deleted"), []byte("memory")}
+		if existed, err := engine.DeleteBatch(keys); err != nil || existed != 2 {
+			t.Errorf("Expected 2 existing keys deleted, got %d (err %v)", existed, err)
+		}
+
+		// expectDeleted checks the batch removed every key but kept
+		expectDeleted := func() {
+			for _, key := range []string{"memory", "flushed", "absent", "deleted"} {
+				if _, err := engine.Get([]byte(key)); !errors.Is(err, ErrKeyNotFound) {
+					t.Errorf("Expected %s to be deleted, got %v", key, err)
+				}
+			}
+			if value, err := engine.Get([]byte("kept")); err != nil || string(value) != "value" {
+				t.Errorf("Expected kept=value, got %q (err %v)", value, err)
+			}
+		}
+		expectDeleted()
+
+		crash(engine)
+		engine, err = NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to reopen engine: %v", err)
+			return
+		}
+		defer engine.Close()
+		expectDeleted()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestEngine_Sync writes asynchronously with the background syncer stopped,
+// calls Sync and checks the writes survive a crash, their futures complete,
+// and writes made after Sync don't
+func TestEngine_Sync(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-sync-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+
+		engine, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			return
+		}
+		defer engine.Close()
+
+		// Without the background syncer, async writes stay in the WAL
+		// buffer until something syncs them
+		engine.wal.mu.Lock()
+		close(engine.wal.quit)
+		engine.wal.mu.Unlock()
+
+		var futures []<-chan error
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key-%03d", i)
+			futures = append(futures, engine.PutAsync([]byte(key), []byte("value-"+key)))
+		}
+		select {
+		case err := <-futures[0]:
+			t.Errorf("Expected the async write to be pending before Sync, got %v", err)
+		default:
+		}
+
+		if err := engine.Sync(); err != nil {
+			t.Errorf("Failed to sync: %v", err)
+		}
+		for i, future := range futures {
+			select {
+			case err := <-future:
+				if err != nil {
+					t.Errorf("Expected write %d to be durable, got %v", i, err)
+				}
+			default:
+				t.Errorf("Expected write %d to be durable once Sync returned", i)
+				return
+			}
+		}
+
+		// Syncing again with nothing pending is a no-op
+		if err := engine.Sync(); err != nil {
+			t.Errorf("Failed to sync: %v", err)
+		}
+
+		// A write after the barrier isn't synced by it
+		engine.PutAsync([]byte("unsynced"), []byte("value"))
+
+		crash(engine)
+		reopened, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to reopen engine: %v", err)
+			return
+		}
+		defer reopened.Close()
+
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key-%03d", i)
+			if value, err := reopened.Get([]byte(key)); err != nil || string(value) != "value-"+key {
+				t.Errorf("Expected %s to survive the crash, got %q (err %v)", key, value, err)
+				return
+			}
+		}
+		if _, err := reopened.Get([]byte("unsynced")); err == nil {
+			t.Errorf("Expected the write after Sync to be lost in the crash")
+		}
+
+		readOnly, err := OpenReadOnly(tempDir)
+		if err != nil {
+			t.Errorf("Failed to open read-only: %v", err)
+			return
+		}
+		defer readOnly.Close()
+		if err := readOnly.Sync(); err != ErrReadOnly {
+			t.Errorf("Expected ErrReadOnly syncing a read-only engine, got %v", err)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestEngine_TombstoneGracePeriod compacts a fresh tombstone into the last
+// level and checks it is kept there within the grace period, then dropped
+// by the next compaction into the last level once the period has elapsed.
+// A tombstone that stays in the memory table past the period is dropped by
+// the first compaction after its flush, since it keeps the time of its
+// delete.
+func TestEngine_TombstoneGracePeriod(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-tombstone-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	const grace = 500 * time.Millisecond
+
+	done := make(chan bool)
+	go func() {
+		opts := DefaultOptions()
+		opts.L0CompactionTrigger = 0
+		opts.TombstoneGracePeriod = grace
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+		defer engine.Close()
+
+		// compactToBottom flushes the memory table and compacts every level
+		// into the next, down to the last level
+		compactToBottom := func() {
+			if err := engine.flush(); err != nil {
+				t.Errorf("Failed to flush: %v", err)
+			}
+			for level := 0; level < 6; level++ {
+				if err := engine.CompactRange(level, nil, nil); err != nil {
+					t.Errorf("Failed to compact L%d: %v", level, err)
+				}
+			}
+		}
+
+		// tombstoneAt returns the creation time of the tombstone of key in
+		// the last level, or zero if there is none
+		tombstoneAt := func(key string) int64 {
+			engine.lsm.mu.RLock()
+			defer engine.lsm.mu.RUnlock()
+			for _, info := range engine.lsm.levels[6] {
+				b, err := engine.lsm.files.loadBlock(info.path)
+				if err != nil {
+					t.Errorf("Failed to read block: %v", err)
+					return 0
+				}
+				for i := 0; i < b.Count(); i++ {
+					if k, value := b.Pair(i); string(k) == key && value == nil {
+						return b.DeletedAt(i)
+					}
+				}
+			}
+			return 0
+		}
+
+		for _, key := range []string{"deleted", "kept"} {
+			if err := engine.Put([]byte(key), []byte("value")); err != nil {
+				t.Errorf("Failed to put: %v", err)
+			}
+		}
+		if err := engine.flush(); err != nil {
+			t.Errorf("Failed to flush: %v", err)
+		}
+		deleted := time.Now()
+		if err := engine.Delete([]byte("deleted")); err != nil {
+			t.Errorf("Failed to delete: %v", err)
+		}
+		compactToBottom()
+
+		// Within the grace period the tombstone survives in the last level
+		at := tombstoneAt("deleted")
+		if at < deleted.UnixNano() || at > time.Now().UnixNano() {
+			t.Errorf("Expected the tombstone to be kept with its creation time, got %d", at)
+		}
+		if _, err := engine.Get([]byte("deleted")); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected ErrKeyNotFound for the deleted key, got %v", err)
+		}
+
+		// Once it elapses, the next compaction into the last level drops it
+		time.Sleep(grace + 100*time.Millisecond)
+		if err := engine.Put([]byte("kept"), []byte("value2")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		compactToBottom()
+
+		if at := tombstoneAt("deleted"); at != 0 {
+			t.Errorf("Expected the expired tombstone to be dropped, got one created at %d", at)
+		}
+		if _, err := engine.Get([]byte("deleted")); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected ErrKeyNotFound for the deleted key, got %v", err)
+		}
+		if value, err := engine.Get([]byte("kept")); err != nil || string(value) != "value2" {
+			t.Errorf("Expected kept=value2, got %q (err %v)", value, err)
+		}
+
+		// A delete older than the period when flushed is dropped right away
+		if err := engine.Put([]byte("late"), []byte("value")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		compactToBottom()
+		if err := engine.Delete([]byte("late")); err != nil {
+			t.Errorf("Failed to delete: %v", err)
+		}
+		time.Sleep(grace + 100*time.Millisecond)
+		compactToBottom()
+
+		if at := tombstoneAt("late"); at != 0 {
+			t.Errorf("Expected the tombstone flushed after the period to be dropped, got one created at %d", at)
+		}
+		if _, err := engine.Get([]byte("late")); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected ErrKeyNotFound for the deleted key, got %v", err)
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestEngine_ValueCache checks a repeated Get of a flushed key is served by
+// the value cache without reading a block, that writes to the key replace
+// the cached value, and that the cache stays within its size
+func TestEngine_ValueCache(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-value-cache-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		opts := DefaultOptions()
+		opts.ValueCacheSize = 1024
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+		defer engine.Close()
+
+		// get reads key, returning its value and the blocks read
+		get := func(key string) (string, int64, error) {
+			before := engine.GetStats().Amplification.BlocksRead
+			value, err := engine.Get([]byte(key))
+			return string(value), engine.GetStats().Amplification.BlocksRead - before, err
+		}
+
+		if err := engine.Put([]byte("hot"), []byte("value1")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		if err := engine.flush(); err != nil {
+			t.Errorf("Failed to flush: %v", err)
+		}
+
+		if value, blocks, err := get("hot"); err != nil || value != "value1" || blocks != 1 {
+			t.Errorf("Expected the first Get to read value1 from a block, got %q from %d blocks (err %v)", value, blocks, err)
+		}
+		for i := 0; i < 3; i++ {
+			if value, blocks, err := get("hot"); err != nil || value != "value1" || blocks != 0 {
+				t.Errorf("Expected a repeated Get to hit the cache, got %q from %d blocks (err %v)", value, blocks, err)
+			}
+		}
+		if stats := engine.GetStats().ValueCache; stats.Hits != 3 || stats.Misses != 1 || stats.Entries != 1 {
+			t.Errorf("Expected 3 hits and 1 miss with 1 entry, got %+v", stats)
+		}
+
+		// Writes replace the cached value, once flushed too
+		if err := engine.Put([]byte("hot"), []byte("value2")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		if err := engine.flush(); err != nil {
+			t.Errorf("Failed to flush: %v", err)
+		}
+		if value, _, err := get("hot"); err != nil || value != "value2" {
+			t.Errorf("Expected value2 after overwriting, got %q (err %v)", value, err)
+		}
+		if value, blocks, err := get("hot"); err != nil || value != "value2" || blocks != 0 {
+			t.Errorf("Expected the new value to be cached, got %q from %d blocks (err %v)", value, blocks, err)
+		}
+		if err := engine.Delete([]byte("hot")); err != nil {
+			t.Errorf("Failed to delete: %v", err)
+		}
+		if err := engine.flush(); err != nil {
+			t.Errorf("Failed to flush: %v", err)
+		}
+		if _, _, err := get("hot"); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected ErrKeyNotFound after deleting, got %v", err)
+		}
+
+		// Reading more than fits evicts the least recently used values
+		for i := 0; i < 100; i++ {
+			if err := engine.Put([]byte(fmt.Sprintf("key-%03d", i)), make([]byte, 90)); err != nil {
+				t.Errorf("Failed to put: %v", err)
+			}
+		}
+		if err := engine.flush(); err != nil {
+			t.Errorf("Failed to flush: %v", err)
+		}
+		for i := 0; i < 100; i++ {
+			if _, _, err := get(fmt.Sprintf("key-%03d", i)); err != nil {
+				t.Errorf("Failed to get: %v", err)
+			}
+		}
+		if stats := engine.GetStats().ValueCache; stats.Size > opts.ValueCacheSize || stats.Entries != 10 {
+			t.Errorf("Expected the cache to hold the last 10 values within %d bytes, got %+v", opts.ValueCacheSize, stats)
+		}
+		if _, blocks, _ := get("key-099"); blocks != 0 {
+			t.Errorf("Expected the last value read to be cached, read %d blocks", blocks)
+		}
+		if _, blocks, _ := get("key-000"); blocks == 0 {
+			t.Errorf("Expected the first value read to be evicted")
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
@@ -0,0 +1,400 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestEngine_ValueLogDedup checks that a large value written under many
+// keys is stored once, in the value log, and read back through the
+// pointers from the memory table, the blocks and an iterator, also after
+// reopening the engine
+func TestEngine_ValueLogDedup(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-value-log-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+
+		opts := DefaultOptions()
+		opts.ValueLogThreshold = 1024
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			return
+		}
+
+		large := bytes.Repeat([]byte("0123456789abcdef"), 256) // 4KB
+		for i := 0; i < 1000; i++ {
+			if err := engine.Put([]byte(fmt.Sprintf("key-%04d", i)), large); err != nil {
+				t.Errorf("Failed to put: %v", err)
+			}
+		}
+		if err := engine.Put([]byte("small"), []byte("inline")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+
+		if stats := engine.GetStats().ValueLog; stats.Values != 1 || stats.Bytes != int64(len(large)) {
+			t.Errorf("Expected one value of %d bytes in the value log, got %+v", len(large), stats)
+		}
+		if value, err := engine.Get([]byte("key-0500")); err != nil || !bytes.Equal(value, large) {
+			t.Errorf("Expected the large value from the memory table, got %d bytes (err %v)", len(value), err)
+		}
+
+		if err := engine.flush(); err != nil {
+			t.Errorf("Failed to flush: %v", err)
+		}
+		if value, err := engine.Get([]byte("key-0999")); err != nil || !bytes.Equal(value, large) {
+			t.Errorf("Expected the large value from a block, got %d bytes (err %v)", len(value), err)
+		}
+		if value, err := engine.Get([]byte("small")); err != nil || string(value) != "inline" {
+			t.Errorf("Expected the small value inline, got %q (err %v)", value, err)
+		}
+
+		// The blocks hold pointers, not 1000 copies of the value
+		if size := engine.GetStats().LevelSizes[0]; size > int64(100*len(large)) {
+			t.Errorf("Expected the blocks to hold pointers, got %d bytes", size)
+		}
+		if err := engine.Close(); err != nil {
+			t.Errorf("Failed to close engine: %v", err)
+		}
+
+		// The value log is read without the option too
+		engine, err = NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to reopen engine: %v", err)
+			return
+		}
+		defer engine.Close()
+
+		if stats := engine.GetStats().ValueLog; stats.Values != 1 || stats.Segments != 1 {
+			t.Errorf("Expected one value in one segment after reopening, got %+v", stats)
+		}
+		it, err := engine.NewIterator(context.Background(), IteratorOptions{})
+		if err != nil {
+			t.Errorf("Failed to create iterator: %v", err)
+			return
+		}
+		count := 0
+		for it.Next() {
+			if bytes.HasPrefix(it.Key(), []byte("key-")) && !bytes.Equal(it.Value(), large) {
+				t.Errorf("Expected the large value for %s, got %d bytes", it.Key(), len(it.Value()))
+			}
+			count++
+		}
+		if err := it.Err(); err != nil {
+			t.Errorf("Iterator failed: %v", err)
+		}
+		it.Close()
+		if count != 1001 {
+			t.Errorf("Expected 1001 keys, got %d", count)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Test timed out")
+	}
+}
+
+// TestEngine_CollectValueLog checks that a value is kept while any key
+// references it, reclaimed once none does, and not reclaimed under an
+// iterator opened before it was unreferenced
+func TestEngine_CollectValueLog(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-value-log-collect-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+
+		opts := DefaultOptions()
+		opts.ValueLogThreshold = 64
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			return
+		}
+		defer engine.Close()
+
+		shared := bytes.Repeat([]byte("s"), 100)
+		other := bytes.Repeat([]byte("o"), 100)
+		for _, key := range []string{"a", "b", "c"} {
+			if err := engine.Put([]byte(key), shared); err != nil {
+				t.Errorf("Failed to put: %v", err)
+			}
+		}
+		if err := engine.Put([]byte("d"), other); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		if err := engine.flush(); err != nil {
+			t.Errorf("Failed to flush: %v", err)
+		}
+
+		collect := func() int {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			removed, err := engine.CollectValueLog(ctx)
+			if err != nil {
+				t.Errorf("Failed to collect value log: %v", err)
+			}
+			return removed
+		}
+
+		if removed := collect(); removed != 0 {
+			t.Errorf("Expected no value reclaimed while referenced, got %d", removed)
+		}
+
+		// Still referenced by c once a and b are overwritten or deleted
+		if err := engine.Put([]byte("a"), []byte("small")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		if err := engine.Delete([]byte("b")); err != nil {
+			t.Errorf("Failed to delete: %v", err)
+		}
+		if removed := collect(); removed != 0 {
+			t.Errorf("Expected the shared value kept for c, got %d reclaimed", removed)
+		}
+		if value, err := engine.Get([]byte("c")); err != nil || !bytes.Equal(value, shared) {
+			t.Errorf("Expected the shared value for c, got %q (err %v)", value, err)
+		}
+
+		// An iterator reading c keeps the value until it is closed
+		it, err := engine.NewIterator(context.Background(), IteratorOptions{Start: []byte("c"), End: []byte("d")})
+		if err != nil {
+			t.Errorf("Failed to create iterator: %v", err)
+			return
+		}
+		if err := engine.Delete([]byte("c")); err != nil {
+			t.Errorf("Failed to delete: %v", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		if _, err := engine.CollectValueLog(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected the collection to wait for the iterator, got %v", err)
+		}
+		cancel()
+		if !it.Next() || !bytes.Equal(it.Value(), shared) {
+			t.Errorf("Expected the iterator to read the shared value, got %q (err %v)", it.Value(), it.Err())
+		}
+		it.Close()
+
+		if removed := collect(); removed != 1 {
+			t.Errorf("Expected the shared value reclaimed, got %d", removed)
+		}
+		if stats := engine.GetStats().ValueLog; stats.Values != 1 || stats.Bytes != int64(len(other)) || stats.Segments != 1 {
+			t.Errorf("Expected only the other value in one segment, got %+v", stats)
+		}
+		if value, err := engine.Get([]byte("d")); err != nil || !bytes.Equal(value, other) {
+			t.Errorf("Expected the other value for d after the collection, got %q (err %v)", value, err)
+		}
+
+		// The rewritten segment holds the kept value only
+		segments, err := filepath.Glob(filepath.Join(tempDir, valueLogDir, "*.vlog"))
+		if err != nil || len(segments) != 1 {
+			t.Errorf("Expected one segment file, got %v (err %v)", segments, err)
+		} else if info, err := os.Stat(segments[0]); err != nil || info.Size() != int64(valueLogRecordHeaderSize+len(other)) {
+			t.Errorf("Expected the segment to hold one record, got %v (err %v)", info, err)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Test timed out")
+	}
+}
+
+// TestEngine_ValueLogPointerLikeValue checks that a value looking like a
+// value log pointer is stored in the value log, so it reads back as itself
+func TestEngine_ValueLogPointerLikeValue(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-value-log-pointer-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+
+		opts := DefaultOptions()
+		opts.ValueLogThreshold = 1024
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			return
+		}
+		defer engine.Close()
+
+		hash := sha256.Sum256([]byte("elsewhere"))
+		value := append(valueLogPointerMagic[:], hash[:]...)
+		if err := engine.Put([]byte("key"), value); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		if err := engine.flush(); err != nil {
+			t.Errorf("Failed to flush: %v", err)
+		}
+		if got, err := engine.Get([]byte("key")); err != nil || !bytes.Equal(got, value) {
+			t.Errorf("Expected the pointer-like value back, got %x (err %v)", got, err)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Test timed out")
+	}
+}
+
+// TestEngine_PutStream streams a value larger than the value log threshold,
+// in several chunks, and checks it reads back identically with Get and
+// GetStream, also after reopening the engine, that a stream ending early
+// stores nothing, and that a value being read by GetStream isn't reclaimed
+// until the reader is closed
+func TestEngine_PutStream(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-value-log-stream-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+
+		opts := DefaultOptions()
+		opts.ValueLogThreshold = 1024
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			return
+		}
+
+		large := make([]byte, 2*valueLogStreamChunkSize+12345)
+		rand.New(rand.NewSource(1)).Read(large)
+
+		// readStream reads the value of key through GetStream
+		readStream := func(key string) []byte {
+			r, err := engine.GetStream([]byte(key))
+			if err != nil {
+				t.Errorf("Failed to get stream of %s: %v", key, err)
+				return nil
+			}
+			defer r.Close()
+			value, err := io.ReadAll(r)
+			if err != nil {
+				t.Errorf("Failed to read stream of %s: %v", key, err)
+			}
+			return value
+		}
+
+		// Only a reader, so the value can't be taken whole from a buffer
+		if err := engine.PutStream([]byte("large"), io.MultiReader(bytes.NewReader(large)), int64(len(large))); err != nil {
+			t.Errorf("Failed to put stream: %v", err)
+		}
+		if err := engine.PutStream([]byte("small"), strings.NewReader("inline"), 6); err != nil {
+			t.Errorf("Failed to put stream: %v", err)
+		}
+		if stats := engine.GetStats().ValueLog; stats.Values != 1 || stats.Bytes != int64(len(large)) {
+			t.Errorf("Expected the large value in the value log, got %+v", stats)
+		}
+		if value, err := engine.Get([]byte("large")); err != nil || !bytes.Equal(value, large) {
+			t.Errorf("Expected the large value from Get, got %d bytes (err %v)", len(value), err)
+		}
+		if value := readStream("large"); !bytes.Equal(value, large) {
+			t.Errorf("Expected the large value from GetStream, got %d bytes", len(value))
+		}
+		if value := readStream("small"); string(value) != "inline" {
+			t.Errorf("Expected the small value from GetStream, got %q", value)
+		}
+		if _, err := engine.GetStream([]byte("missing")); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected ErrKeyNotFound for a missing key, got %v", err)
+		}
+
+		// A stream ending early stores nothing and leaves no file behind
+		if err := engine.PutStream([]byte("short"), bytes.NewReader(large[:5000]), int64(len(large))); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("Expected io.ErrUnexpectedEOF for a short stream, got %v", err)
+		}
+		if _, err := engine.Get([]byte("short")); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected ErrKeyNotFound for the short stream, got %v", err)
+		}
+		if files, _ := filepath.Glob(filepath.Join(tempDir, valueLogDir, "*"+valueLogStreamSuffix)); len(files) != 0 {
+			t.Errorf("Expected no stream files left, got %v", files)
+		}
+
+		// The same value streamed again is stored once
+		if err := engine.PutStream([]byte("copy"), bytes.NewReader(large), int64(len(large))); err != nil {
+			t.Errorf("Failed to put stream: %v", err)
+		}
+		if stats := engine.GetStats().ValueLog; stats.Values != 1 {
+			t.Errorf("Expected the streamed copy deduplicated, got %+v", stats)
+		}
+
+		if err := engine.flush(); err != nil {
+			t.Errorf("Failed to flush: %v", err)
+		}
+		if err := engine.Close(); err != nil {
+			t.Errorf("Failed to close engine: %v", err)
+		}
+		engine, err = NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to reopen engine: %v", err)
+			return
+		}
+		defer engine.Close()
+		if value := readStream("large"); !bytes.Equal(value, large) {
+			t.Errorf("Expected the large value after reopening, got %d bytes", len(value))
+		}
+
+		// An open stream keeps the value once its keys are deleted
+		r, err := engine.GetStream([]byte("large"))
+		if err != nil {
+			t.Errorf("Failed to get stream: %v", err)
+			return
+		}
+		for _, key := range []string{"large", "copy"} {
+			if err := engine.Delete([]byte(key)); err != nil {
+				t.Errorf("Failed to delete: %v", err)
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		if _, err := engine.CollectValueLog(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected the collection to wait for the stream, got %v", err)
+		}
+		cancel()
+		if value, err := io.ReadAll(r); err != nil || !bytes.Equal(value, large) {
+			t.Errorf("Expected the large value from the open stream, got %d bytes (err %v)", len(value), err)
+		}
+		r.Close()
+
+		ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if removed, err := engine.CollectValueLog(ctx); err != nil || removed != 1 {
+			t.Errorf("Expected the large value reclaimed once the stream is closed, got %d (err %v)", removed, err)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Test timed out")
+	}
+}
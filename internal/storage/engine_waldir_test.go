@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestEngine_WALDir writes with the WAL in its own directory and checks
+// recovery replays it from there, with and without the option
+func TestEngine_WALDir(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-waldir-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	baseDir := filepath.Join(tempDir, "base")
+	walDir := filepath.Join(tempDir, "fast-disk", "wal")
+
+	done := make(chan bool)
+	go func() {
+		opts := DefaultOptions()
+		opts.WALDir = walDir
+		engine, err := NewEngineWithOptions(baseDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+
+		const numKeys = 50
+		for i := 0; i < numKeys; i++ {
+			if err := engine.Put([]byte(fmt.Sprintf("key-%02d", i)), []byte("value")); err != nil {
+				t.Errorf("Failed to put: %v", err)
+			}
+		}
+
+		if files, _ := filepath.Glob(filepath.Join(walDir, "*.wal")); len(files) == 0 {
+			t.Errorf("Expected WAL segments in %s", walDir)
+		}
+		if _, err := os.Stat(filepath.Join(baseDir, "wal")); !os.IsNotExist(err) {
+			t.Errorf("Expected no WAL directory under the base directory (err %v)", err)
+		}
+
+		// checkRecovered checks an engine reopened as after a crash replayed
+		// the WAL from walDir
+		checkRecovered := func(name string, reopened *Engine) {
+			if replayed := reopened.RecoveryStats().WALEntriesReplayed; replayed < numKeys {
+				t.Errorf("%s: expected at least %d replayed entries, got %d", name, numKeys, replayed)
+			}
+			for i := 0; i < numKeys; i++ {
+				if _, err := reopened.Get([]byte(fmt.Sprintf("key-%02d", i))); err != nil {
+					t.Errorf("%s: failed to get key-%02d: %v", name, i, err)
+				}
+			}
+		}
+
+		// Reopen without closing, as after a crash
+		crash(engine)
+		reopened, err := NewEngineWithOptions(baseDir, opts)
+		if err != nil {
+			t.Errorf("Failed to reopen engine: %v", err)
+			done <- true
+			return
+		}
+		checkRecovered("configured", reopened)
+
+		// The manifest records the directory for opens without the option
+		readOnly, err := OpenReadOnly(baseDir)
+		if err != nil {
+			t.Errorf("Failed to open read-only: %v", err)
+		} else {
+			checkRecovered("read-only", readOnly)
+			readOnly.Close()
+		}
+		crash(reopened)
+		recorded, err := NewEngine(baseDir)
+		if err != nil {
+			t.Errorf("Failed to reopen engine without the option: %v", err)
+			done <- true
+			return
+		}
+		defer recorded.Close()
+		checkRecovered("recorded", recorded)
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestEngine_Watchdog holds the LSM tree lock so a Get of a flushed key
+// hangs, and checks the watchdog reports it with the goroutine stacks, and
+// again once the Get completes
+func TestEngine_Watchdog(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-watchdog-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		opts := DefaultOptions()
+		opts.WatchdogThreshold = 50 * time.Millisecond
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+		defer engine.Close()
+
+		// Collect the warnings
+		var mu sync.Mutex
+		var logged strings.Builder
+		engine.watchdog.mu.Lock()
+		engine.watchdog.logf = func(format string, args ...interface{}) {
+			mu.Lock()
+			defer mu.Unlock()
+			fmt.Fprintf(&logged, format, args...)
+		}
+		engine.watchdog.mu.Unlock()
+		output := func() string {
+			mu.Lock()
+			defer mu.Unlock()
+			return logged.String()
+		}
+
+		if err := engine.Put([]byte("key"), []byte("value")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		if err := engine.flush(); err != nil {
+			t.Errorf("Failed to flush: %v", err)
+		}
+		if out := output(); out != "" {
+			t.Errorf("Expected no warnings for quick operations, got %q", out)
+		}
+
+		// A Get waiting for the lock is reported
+		engine.lsm.mu.Lock()
+		got := make(chan error)
+		go func() {
+			_, err := engine.Get([]byte("key"))
+			got <- err
+		}()
+		for start := time.Now(); !strings.Contains(output(), "Goroutine stacks"); {
+			if time.Since(start) > 5*time.Second {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		engine.lsm.mu.Unlock()
+		if err := <-got; err != nil {
+			t.Errorf("Expected the Get to succeed once the lock is released, got %v", err)
+		}
+
+		out := output()
+		if !strings.Contains(out, "Warning: Get has been running for") {
+			t.Errorf("Expected a warning about the Get, got %q", out)
+		}
+		if !strings.Contains(out, "(*LSMTree).read") {
+			t.Errorf("Expected the stack of the waiting Get to be dumped, got %q", out)
+		}
+		if strings.Count(out, "has been running") != 1 {
+			t.Errorf("Expected the Get to be reported once, got %q", out)
+		}
+		if !strings.Contains(out, "Warning: Get completed after") {
+			t.Errorf("Expected the Get's completion to be reported, got %q", out)
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
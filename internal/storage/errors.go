@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"errors"
+	"math"
+
+	"github.com/0xReLogic/river/internal/data/block"
+)
+
+// MaxKeySize is the largest key, in bytes, accepted by the engine
+const MaxKeySize = 64 * 1024
+
+// MaxValueLogValueSize is the largest value, in bytes, the value log
+// stores: its records hold the length of values in 32 bits
+const MaxValueLogValueSize = math.MaxUint32
+
+// Errors returned by the storage engine. They are usually wrapped with
+// additional context, so callers should compare with errors.Is.
+var (
+	// ErrKeyNotFound is returned when a key does not exist
+	ErrKeyNotFound = block.ErrKeyNotFound
+
+	// ErrEngineClosed is returned when an operation is attempted on a closed engine
+	ErrEngineClosed = errors.New("engine is closed")
+
+	// ErrCorrupt is returned when on-disk data (WAL entries, blocks) fails validation
+	ErrCorrupt = block.ErrCorrupt
+
+	// ErrKeyTooLarge is returned when a key exceeds MaxKeySize
+	ErrKeyTooLarge = errors.New("key too large")
+
+	// ErrEmptyKey is returned when a write uses a zero-length key. Empty
+	// values are allowed, and are distinct from absent or deleted keys.
+	ErrEmptyKey = errors.New("empty key")
+
+	// ErrReadOnly is returned when a write is attempted on an engine opened with OpenReadOnly
+	ErrReadOnly = errors.New("engine is read-only")
+
+	// ErrColumnType is returned when column values don't match their data
+	// type, or a stored value is not a column
+	ErrColumnType = errors.New("column type mismatch")
+
+	// ErrUnknownSchema is returned when a schema is used before it is
+	// defined with Engine.DefineSchema
+	ErrUnknownSchema = errors.New("unknown schema")
+
+	// ErrUnknownIndex is returned when searching an index not configured
+	// in Options.Indexes
+	ErrUnknownIndex = errors.New("unknown index")
+
+	// ErrSchemaMismatch is returned when rows don't match their schema, a
+	// stored value is not rows of the schema read, or a schema is defined
+	// again with different columns
+	ErrSchemaMismatch = errors.New("schema mismatch")
+
+	// ErrCloseTimeout is returned by Close when background flushing or
+	// compaction doesn't complete within Options.CloseTimeout
+	ErrCloseTimeout = errors.New("timed out waiting for background work")
+
+	// ErrOpenTimeout is returned when opening an engine doesn't complete
+	// its recovery within Options.OpenTimeout
+	ErrOpenTimeout = errors.New("timed out recovering the engine")
+
+	// ErrLocked is returned when opening a directory for writing while
+	// another engine holds it. OpenReadOnly doesn't need the lock.
+	ErrLocked = errors.New("data directory is locked by another writer")
+
+	// ErrTooStale is returned by Engine.GetWithStaleness when a read-only
+	// engine lags its writer by more than the staleness allowed
+	ErrTooStale = errors.New("read-only engine is too stale")
+
+	// ErrEnginePoisoned is returned by every write after the WAL failed to
+	// sync, until the engine is reopened: the file may have lost entries the
+	// kernel dropped with the failed sync, so later syncs can't be trusted
+	ErrEnginePoisoned = errors.New("engine is poisoned by a failed WAL sync")
+
+	// ErrValueTooLarge is returned when a value stored in the value log
+	// exceeds MaxValueLogValueSize
+	ErrValueTooLarge = errors.New("value too large")
+
+	// ErrValueReclaimed is returned when reading a value stored in the
+	// value log that Engine.CollectValueLog reclaimed, e.g. an overwritten
+	// version read with GetFromLevel or History
+	ErrValueReclaimed = errors.New("value was reclaimed from the value log")
+)
@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/0xReLogic/river/internal/data/block"
+)
+
+// TestErrors_KeyNotFound checks that ErrKeyNotFound survives each read layer
+func TestErrors_KeyNotFound(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-errors-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Block layer
+	b := block.NewBlock()
+	if err := b.Add([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Failed to add pair: %v", err)
+	}
+	if _, err := b.Get([]byte("missing")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Block.Get: expected ErrKeyNotFound, got %v", err)
+	}
+
+	// LSM layer
+	tree, err := NewLSMTree(filepath.Join(tempDir, "lsm"))
+	if err != nil {
+		t.Fatalf("Failed to create LSM tree: %v", err)
+	}
+	if err := tree.Write(b); err != nil {
+		t.Fatalf("Failed to write block: %v", err)
+	}
+	if _, err := tree.Read([]byte("missing")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("LSMTree.Read: expected ErrKeyNotFound, got %v", err)
+	}
+
+	// Engine layer
+	done := make(chan bool)
+	go func() {
+		engine, err := NewEngine(filepath.Join(tempDir, "engine"))
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+		defer engine.Close()
+
+		if _, err := engine.Get([]byte("missing")); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Engine.Get: expected ErrKeyNotFound, got %v", err)
+		}
+
+		key := bytes.Repeat([]byte("k"), MaxKeySize+1)
+		if err := engine.Put(key, []byte("v")); !errors.Is(err, ErrKeyTooLarge) {
+			t.Errorf("Engine.Put: expected ErrKeyTooLarge, got %v", err)
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+// TestErrors_Corrupt checks that decode failures are reported as ErrCorrupt
+func TestErrors_Corrupt(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-errors-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Truncated block
+	b := block.NewBlock()
+	if err := b.Add([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("Failed to add pair: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := b.Encode(&buf); err != nil {
+		t.Fatalf("Failed to encode block: %v", err)
+	}
+	truncated := buf.Bytes()[:buf.Len()-3]
+	if err := block.NewBlock().Decode(bytes.NewReader(truncated)); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Block.Decode: expected ErrCorrupt, got %v", err)
+	}
+
+	// WAL entry with a bad checksum
+	wal, err := NewWAL(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	if err := wal.AppendPut([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("Failed to append to WAL: %v", err)
+	}
+	path := wal.file.Name()
+	if err := wal.Close(); err != nil {
+		t.Fatalf("Failed to close WAL: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read WAL file: %v", err)
+	}
+	data[len(data)-1] ^= 0xFF
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Failed to write WAL file: %v", err)
+	}
+
+	wal, err = NewWAL(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	}
+	defer wal.Close()
+
+	err = wal.Replay(func(entry WALEntry) error { return nil })
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("WAL.Replay: expected ErrCorrupt, got %v", err)
+	}
+}
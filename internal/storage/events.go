@@ -0,0 +1,188 @@
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType identifies an engine event
+type EventType uint8
+
+const (
+	// EventFlushStarted is emitted when a flush of a non-empty memory table
+	// starts, with the number of keys flushed
+	EventFlushStarted EventType = iota + 1
+
+	// EventFlushFinished is emitted when a flush completes, with the
+	// blocks and bytes written, or the error that failed it
+	EventFlushFinished
+
+	// EventCompactionStarted is emitted when a compaction of blocks of
+	// Level into TargetLevel starts, with the number of blocks moved
+	EventCompactionStarted
+
+	// EventCompactionFinished is emitted when a compaction completes, with
+	// the bytes written, or the error that failed it
+	EventCompactionFinished
+
+	// EventWALRotated is emitted when the WAL starts a new file, with its path
+	EventWALRotated
+
+	// EventCheckpointCreated is emitted when a checkpoint is saved, with
+	// its path and number of keys
+	EventCheckpointCreated
+)
+
+// String returns the name of the event type
+func (t EventType) String() string {
+	switch t {
+	case EventFlushStarted:
+		return "flush-started"
+	case EventFlushFinished:
+		return "flush-finished"
+	case EventCompactionStarted:
+		return "compaction-started"
+	case EventCompactionFinished:
+		return "compaction-finished"
+	case EventWALRotated:
+		return "wal-rotated"
+	case EventCheckpointCreated:
+		return "checkpoint-created"
+	default:
+		return "unknown"
+	}
+}
+
+// Event describes something the engine did. Fields that don't apply to
+// the event type are zero.
+type Event struct {
+	// What happened
+	Type EventType
+
+	// When the event was emitted
+	Time time.Time
+
+	// Level the blocks of a compaction are moved out of, and the level
+	// they are merged into
+	Level       int
+	TargetLevel int
+
+	// Number of keys flushed or checkpointed
+	Keys int
+
+	// Number of blocks written by a flush, or moved by a compaction
+	Blocks int
+
+	// Bytes of block files written by a flush or compaction
+	Bytes int64
+
+	// Duration of a finished flush or compaction
+	Duration time.Duration
+
+	// Path of the new WAL file or of the checkpoint
+	Path string
+
+	// Error that failed a flush or compaction
+	Err error
+}
+
+// EventListener receives the events of an engine (see Options.EventListener).
+// Writes never wait for flushes or compactions, so there are no write
+// stalls to report.
+type EventListener interface {
+	// HandleEvent is called for each event, in the order they occurred
+	HandleEvent(event Event)
+}
+
+// eventDispatcher delivers events to a listener from its own goroutine, so
+// a slow listener never holds up the engine. Events are queued without a
+// limit until delivered. A nil dispatcher drops every event.
+type eventDispatcher struct {
+	// Listener receiving the events
+	listener EventListener
+
+	// Mutex protecting the queue and the closed flag
+	mu sync.Mutex
+
+	// Signalled when an event is queued or the dispatcher is closed
+	cond *sync.Cond
+
+	// Events not yet delivered, oldest first
+	queue []Event
+
+	// Whether close was called; later events are dropped
+	closed bool
+
+	// Closed once the delivery goroutine exits
+	done chan struct{}
+}
+
+// newEventDispatcher starts delivering events to listener, or returns nil
+// if listener is nil
+func newEventDispatcher(listener EventListener) *eventDispatcher {
+	if listener == nil {
+		return nil
+	}
+
+	d := &eventDispatcher{
+		listener: listener,
+		done:     make(chan struct{}),
+	}
+	d.cond = sync.NewCond(&d.mu)
+	go d.run()
+	return d
+}
+
+// emit queues an event for delivery, stamping its time
+func (d *eventDispatcher) emit(event Event) {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return
+	}
+	event.Time = time.Now()
+	d.queue = append(d.queue, event)
+	d.cond.Signal()
+}
+
+// run delivers the queued events until the dispatcher is closed and the
+// queue drained
+func (d *eventDispatcher) run() {
+	defer close(d.done)
+
+	for {
+		d.mu.Lock()
+		for len(d.queue) == 0 && !d.closed {
+			d.cond.Wait()
+		}
+		events := d.queue
+		d.queue = nil
+		d.mu.Unlock()
+
+		if len(events) == 0 {
+			return // Closed and drained
+		}
+		for _, event := range events {
+			d.listener.HandleEvent(event)
+		}
+	}
+}
+
+// close stops accepting events and waits for the queued ones to be delivered
+func (d *eventDispatcher) close() {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	d.closed = true
+	d.cond.Signal()
+	d.mu.Unlock()
+
+	<-d.done
+}
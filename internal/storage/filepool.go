@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"bufio"
+	"container/list"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/0xReLogic/river/internal/data/block"
+)
+
+// filePool keeps block files open between reads, up to a limit. When the
+// limit is reached, the least recently used file that no read is using is
+// closed; if every open file is in use, readers wait for one to be released.
+type filePool struct {
+	// Mutex to protect the pool
+	mu sync.Mutex
+
+	// Signalled when a file is released or closed
+	cond *sync.Cond
+
+	// Maximum number of files open at once
+	limit int
+
+	// Open files by path, and their elements in lru
+	files map[string]*list.Element
+
+	// Open files, most recently used first
+	lru *list.List
+
+	// Number of open files, including removed files still in use
+	open int
+
+	// Highest number of files open at once
+	maxOpen int
+
+	// Number of blocks decoded by loadBlock
+	decoded atomic.Int64
+}
+
+// pooledFile is an open block file
+type pooledFile struct {
+	// Path of the block file
+	path string
+
+	// File handle
+	file *os.File
+
+	// Size of the file
+	size int64
+
+	// Number of reads using the file
+	refs int
+
+	// Whether the file was removed from the pool; it is closed once released
+	removed bool
+}
+
+// newFilePool creates a pool holding at most limit files open (at least one)
+func newFilePool(limit int) *filePool {
+	if limit < 1 {
+		limit = 1
+	}
+
+	p := &filePool{
+		limit: limit,
+		files: make(map[string]*list.Element),
+		lru:   list.New(),
+	}
+	p.cond = sync.NewCond(&p.mu)
+
+	return p
+}
+
+// acquire returns the open file at path, opening it if needed. The file
+// must be released after use.
+func (p *filePool) acquire(path string) (*pooledFile, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for {
+		if el, ok := p.files[path]; ok {
+			pf := el.Value.(*pooledFile)
+			pf.refs++
+			p.lru.MoveToFront(el)
+			return pf, nil
+		}
+		if p.open < p.limit || p.evict() {
+			break
+		}
+		p.cond.Wait()
+	}
+
+	// Open the block file
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open block file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to get block file info: %w", err)
+	}
+
+	pf := &pooledFile{path: path, file: f, size: info.Size(), refs: 1}
+	p.files[path] = p.lru.PushFront(pf)
+	p.open++
+	if p.open > p.maxOpen {
+		p.maxOpen = p.open
+	}
+
+	return pf, nil
+}
+
+// evict closes the least recently used file not in use, reporting whether
+// there was one. Callers must hold p.mu.
+func (p *filePool) evict() bool {
+	for el := p.lru.Back(); el != nil; el = el.Prev() {
+		pf := el.Value.(*pooledFile)
+		if pf.refs > 0 {
+			continue
+		}
+		p.lru.Remove(el)
+		delete(p.files, pf.path)
+		pf.file.Close()
+		p.open--
+		return true
+	}
+	return false
+}
+
+// release ends a read of a file returned by acquire
+func (p *filePool) release(pf *pooledFile) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pf.refs--
+	if pf.refs > 0 {
+		return
+	}
+	if pf.removed {
+		pf.file.Close()
+		p.open--
+	}
+	p.cond.Broadcast()
+}
+
+// remove closes the file at path, e.g. after compaction moved or deleted
+// it. A file still in use is closed once released.
+func (p *filePool) remove(path string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	el, ok := p.files[path]
+	if !ok {
+		return
+	}
+	pf := el.Value.(*pooledFile)
+	p.lru.Remove(el)
+	delete(p.files, path)
+	pf.removed = true
+	if pf.refs == 0 {
+		pf.file.Close()
+		p.open--
+		p.cond.Broadcast()
+	}
+}
+
+// close closes all files. Files still in use are closed once released.
+func (p *filePool) close() {
+	p.mu.Lock()
+	paths := make([]string, 0, len(p.files))
+	for path := range p.files {
+		paths = append(paths, path)
+	}
+	p.mu.Unlock()
+
+	for _, path := range paths {
+		p.remove(path)
+	}
+}
+
+// openFiles returns the number of files currently open
+func (p *filePool) openFiles() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.open
+}
+
+// loadBlock decodes the block file at path through the pool
+func (p *filePool) loadBlock(path string) (*block.Block, error) {
+	pf, err := p.acquire(path)
+	if err != nil {
+		return nil, err
+	}
+	defer p.release(pf)
+
+	// Reads share the handle, so they don't use its offset
+	b := block.NewBlock()
+	if err := b.Decode(bufio.NewReader(io.NewSectionReader(pf.file, 0, pf.size))); err != nil {
+		return nil, fmt.Errorf("failed to decode block: %w", err)
+	}
+	p.decoded.Add(1)
+
+	return b, nil
+}
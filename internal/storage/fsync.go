@@ -0,0 +1,11 @@
+package storage
+
+import "os"
+
+// fsyncDir syncs a directory so that renames and file creations inside it
+// survive a crash. It is a variable so tests can observe directory syncs.
+var fsyncDir = syncDir
+
+// fsyncFile syncs a WAL file. It is a variable so tests can inject sync
+// failures.
+var fsyncFile = (*os.File).Sync
@@ -0,0 +1,18 @@
+//go:build !windows
+
+package storage
+
+import "os"
+
+// syncDir fsyncs the directory at path
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	if err := dir.Sync(); err != nil {
+		dir.Close()
+		return err
+	}
+	return dir.Close()
+}
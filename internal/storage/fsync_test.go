@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/0xReLogic/river/internal/data/block"
+)
+
+// countDirSyncs replaces fsyncDir with a wrapper that counts syncs per directory
+func countDirSyncs(t *testing.T) map[string]int {
+	synced := make(map[string]int)
+	original := fsyncDir
+	fsyncDir = func(path string) error {
+		synced[filepath.Clean(path)]++
+		return original(path)
+	}
+	t.Cleanup(func() { fsyncDir = original })
+	return synced
+}
+
+func TestFsyncDir_AfterRename(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-fsync-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	synced := countDirSyncs(t)
+
+	checkpoint, err := NewCheckpoint(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to create checkpoint: %v", err)
+	}
+	if err := checkpoint.Save(map[string][]byte{"key": []byte("value")}, 8, 1); err != nil {
+		t.Fatalf("Failed to save checkpoint: %v", err)
+	}
+
+	manifest, err := NewManifest(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to create manifest: %v", err)
+	}
+	if err := manifest.Save(); err != nil {
+		t.Fatalf("Failed to save manifest: %v", err)
+	}
+
+	tree, err := NewLSMTree(filepath.Join(tempDir, "data"))
+	if err != nil {
+		t.Fatalf("Failed to create LSM tree: %v", err)
+	}
+	defer tree.Close()
+
+	b := block.NewBlock()
+	if err := b.Add([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("Failed to add pair: %v", err)
+	}
+	if err := tree.Write(b); err != nil {
+		t.Fatalf("Failed to write block: %v", err)
+	}
+
+	for _, dir := range []string{
+		filepath.Join(tempDir, "checkpoint"),
+		filepath.Join(tempDir, "manifest"),
+		filepath.Join(tempDir, "data", "L0"),
+	} {
+		if synced[dir] != 1 {
+			t.Errorf("Expected %s to be synced once after the rename, got %d", dir, synced[dir])
+		}
+	}
+
+	// No temporary block files are left behind
+	tmp, err := filepath.Glob(filepath.Join(tempDir, "data", "L0", "*.tmp"))
+	if err != nil || len(tmp) != 0 {
+		t.Errorf("Expected no temporary block files, got %v (err %v)", tmp, err)
+	}
+
+	// Directory syncs can be disabled
+	checkpoint.syncDirs = false
+	tree.syncDirs = false
+	if err := checkpoint.Save(map[string][]byte{}, 0, 2); err != nil {
+		t.Fatalf("Failed to save checkpoint: %v", err)
+	}
+	if err := tree.Write(b); err != nil {
+		t.Fatalf("Failed to write block: %v", err)
+	}
+	if synced[filepath.Join(tempDir, "checkpoint")] != 1 || synced[filepath.Join(tempDir, "data", "L0")] != 1 {
+		t.Errorf("Expected no directory syncs with syncDirs disabled, got %v", synced)
+	}
+}
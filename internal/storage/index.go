@@ -0,0 +1,451 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/0xReLogic/river/internal/data/bitmap"
+	"github.com/RoaringBitmap/roaring"
+)
+
+// IndexExtractor returns the term a secondary index files a pair under,
+// extracted from its value (see Options.Indexes), or false to leave the
+// pair out of the index. It is called on every write, under the lock of the
+// key's memory table shard, so it should be fast; it must not retain value.
+type IndexExtractor func(key, value []byte) ([]byte, bool)
+
+// secondaryIndex maps the terms extracted from values to the keys holding
+// them. Indexed keys are numbered, and the keys of each term are a roaring
+// bitmap of their IDs.
+type secondaryIndex struct {
+	// Extracts the term of a pair
+	extract IndexExtractor
+
+	// Mutex to protect the index
+	mu sync.RWMutex
+
+	// ID of each indexed key
+	ids map[string]uint32
+
+	// Key and term of each ID; the key is nil for a free ID
+	keys  [][]byte
+	terms []string
+
+	// IDs of keys that left the index, reused for new keys
+	free []uint32
+
+	// IDs of the keys of each term
+	postings map[string]*roaring.Bitmap
+
+	// Keys written during a bulk import, which its pairs don't override;
+	// nil outside an import
+	touched map[string]bool
+}
+
+// newSecondaryIndex returns an empty index
+func newSecondaryIndex(extract IndexExtractor) *secondaryIndex {
+	return &secondaryIndex{
+		extract:  extract,
+		ids:      make(map[string]uint32),
+		postings: make(map[string]*roaring.Bitmap),
+	}
+}
+
+// term returns the term of a pair, or nil if it isn't indexed. A nil value
+// is a tombstone, which is never indexed.
+func (x *secondaryIndex) term(key, value []byte) []byte {
+	if value == nil {
+		return nil
+	}
+	term, ok := x.extract(key, value)
+	if !ok {
+		return nil
+	}
+	if term == nil {
+		term = []byte{}
+	}
+	return term
+}
+
+// update indexes the value written to key, a nil value for a delete
+func (x *secondaryIndex) update(key, value []byte) {
+	term := x.term(key, value)
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if x.touched != nil {
+		x.touched[string(key)] = true
+	}
+	x.set(key, term)
+}
+
+// set files key under term, or removes it from the index if term is nil.
+// Callers must hold x.mu.
+func (x *secondaryIndex) set(key, term []byte) {
+	id, indexed := x.ids[string(key)]
+	if indexed {
+		if term != nil && x.terms[id] == string(term) {
+			return
+		}
+
+		// Remove the key from its current term
+		posting := x.postings[x.terms[id]]
+		posting.Remove(id)
+		if posting.IsEmpty() {
+			delete(x.postings, x.terms[id])
+		}
+		if term == nil {
+			delete(x.ids, string(key))
+			x.keys[id] = nil
+			x.terms[id] = ""
+			x.free = append(x.free, id)
+			return
+		}
+	} else {
+		if term == nil {
+			return
+		}
+
+		// Number the key, reusing a free ID if any
+		if n := len(x.free); n > 0 {
+			id = x.free[n-1]
+			x.free = x.free[:n-1]
+			x.keys[id] = append([]byte(nil), key...)
+		} else {
+			id = uint32(len(x.keys))
+			x.keys = append(x.keys, append([]byte(nil), key...))
+			x.terms = append(x.terms, "")
+		}
+		x.ids[string(key)] = id
+	}
+
+	x.terms[id] = string(term)
+	posting, ok := x.postings[string(term)]
+	if !ok {
+		posting = roaring.New()
+		x.postings[string(term)] = posting
+	}
+	posting.Add(id)
+}
+
+// search returns the keys filed under term, in key order
+func (x *secondaryIndex) search(term []byte) [][]byte {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	posting, ok := x.postings[string(term)]
+	if !ok {
+		return nil
+	}
+	keys := make([][]byte, 0, posting.GetCardinality())
+	for it := posting.Iterator(); it.HasNext(); {
+		keys = append(keys, append([]byte(nil), x.keys[it.Next()]...))
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+	return keys
+}
+
+// indexFile is the saved form of a secondary index
+type indexFile struct {
+	// Key of each ID, null for a free ID
+	Keys [][]byte `json:"keys"`
+
+	// IDs of the keys of each term
+	Postings []indexPosting `json:"postings"`
+}
+
+// indexPosting is a term of a saved index and its keys
+type indexPosting struct {
+	// Term the keys are filed under
+	Term []byte `json:"term"`
+
+	// IDs of the keys, a roaring bitmap serialized with bitmap.ToBytes
+	IDs []byte `json:"ids"`
+}
+
+// encode returns the saved form of the index
+func (x *secondaryIndex) encode() ([]byte, error) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	file := indexFile{Keys: x.keys, Postings: make([]indexPosting, 0, len(x.postings))}
+	for term, posting := range x.postings {
+		ids, err := bitmap.ToBytes(posting)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode posting list: %w", err)
+		}
+		file.Postings = append(file.Postings, indexPosting{Term: []byte(term), IDs: ids})
+	}
+	return json.Marshal(file)
+}
+
+// decodeSecondaryIndex returns the index saved as data by encode
+func decodeSecondaryIndex(data []byte, extract IndexExtractor) (*secondaryIndex, error) {
+	var file indexFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%w: failed to decode index file: %w", ErrCorrupt, err)
+	}
+
+	x := newSecondaryIndex(extract)
+	x.keys = file.Keys
+	x.terms = make([]string, len(file.Keys))
+	filed := make([]bool, len(file.Keys))
+	for _, p := range file.Postings {
+		posting, err := bitmap.FromBytes(p.IDs)
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to decode posting list: %w", ErrCorrupt, err)
+		}
+		for it := posting.Iterator(); it.HasNext(); {
+			id := it.Next()
+			if int(id) >= len(x.keys) || x.keys[id] == nil || filed[id] {
+				return nil, fmt.Errorf("%w: index file has an invalid key ID %d", ErrCorrupt, id)
+			}
+			filed[id] = true
+			x.terms[id] = string(p.Term)
+		}
+		x.postings[string(p.Term)] = posting
+	}
+
+	for id, key := range x.keys {
+		switch {
+		case key == nil:
+			x.free = append(x.free, uint32(id))
+		case !filed[id]:
+			return nil, fmt.Errorf("%w: index file has key ID %d without a term", ErrCorrupt, id)
+		default:
+			x.ids[string(key)] = uint32(id)
+		}
+	}
+	return x, nil
+}
+
+// indexSet holds the secondary indexes of an engine, saved in
+// <baseDir>/index/<name>.idx when the engine is closed. The saved indexes
+// are removed once loaded on open, so an engine that crashed, or was opened
+// without an index, rebuilds it on the next open rather than loading one
+// missing the writes made since. A nil set has no indexes.
+type indexSet struct {
+	// Directory the indexes are saved in
+	dir string
+
+	// Indexes by name
+	indexes map[string]*secondaryIndex
+
+	// Whether to fsync the index directory after saving the indexes, and
+	// the base directory after removing them
+	syncDirs bool
+}
+
+// openIndexes loads the indexes of the engine in baseDir with the given
+// extractors, and removes the saved indexes. It returns the indexes that
+// weren't saved, or failed to load, which must be built from the data.
+func openIndexes(baseDir string, extractors map[string]IndexExtractor, syncDirs bool) (*indexSet, []*secondaryIndex, error) {
+	dir := filepath.Join(baseDir, "index")
+
+	var set *indexSet
+	var unbuilt []*secondaryIndex
+	if len(extractors) > 0 {
+		set = &indexSet{dir: dir, indexes: make(map[string]*secondaryIndex), syncDirs: syncDirs}
+	}
+	for name, extract := range extractors {
+		if name == "" || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+			return nil, nil, fmt.Errorf("invalid index name %q", name)
+		}
+		if extract == nil {
+			return nil, nil, fmt.Errorf("index %q has no extractor", name)
+		}
+
+		var x *secondaryIndex
+		data, err := os.ReadFile(filepath.Join(dir, name+".idx"))
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return nil, nil, fmt.Errorf("failed to read index file: %w", err)
+		default:
+			if x, err = decodeSecondaryIndex(data, extract); err != nil {
+				fmt.Printf("Warning: rebuilding index %q: %v\n", name, err)
+			}
+		}
+		if x == nil {
+			x = newSecondaryIndex(extract)
+			unbuilt = append(unbuilt, x)
+		}
+		set.indexes[name] = x
+	}
+
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return set, unbuilt, nil
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, nil, fmt.Errorf("failed to remove index directory: %w", err)
+	}
+	if syncDirs {
+		if err := fsyncDir(baseDir); err != nil {
+			return nil, nil, fmt.Errorf("failed to sync base directory: %w", err)
+		}
+	}
+	return set, unbuilt, nil
+}
+
+// update indexes the value written to key, a nil value for a delete
+func (s *indexSet) update(key, value []byte) {
+	if s == nil {
+		return
+	}
+	for _, x := range s.indexes {
+		x.update(key, value)
+	}
+}
+
+// search returns the keys filed under term in the named index
+func (s *indexSet) search(name string, term []byte) ([][]byte, error) {
+	var x *secondaryIndex
+	if s != nil {
+		x = s.indexes[name]
+	}
+	if x == nil {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownIndex, name)
+	}
+	return x.search(term), nil
+}
+
+// importTerms are the terms of the pairs of a bulk import, by key and then
+// by index
+type importTerms map[string]map[*secondaryIndex][]byte
+
+// addImport records the terms of a pair written by a bulk import
+func (s *indexSet) addImport(terms importTerms, key, value []byte) {
+	if s == nil {
+		return
+	}
+	byIndex := make(map[*secondaryIndex][]byte, len(s.indexes))
+	for _, x := range s.indexes {
+		byIndex[x] = x.term(key, value)
+	}
+	terms[string(key)] = byIndex
+}
+
+// beginImport starts recording the keys written while a bulk import runs
+func (s *indexSet) beginImport() {
+	if s == nil {
+		return
+	}
+	for _, x := range s.indexes {
+		x.mu.Lock()
+		x.touched = make(map[string]bool)
+		x.mu.Unlock()
+	}
+}
+
+// endImport indexes the pairs of a committed bulk import, except the keys
+// written since it began, whose writes are ordered after it. A failed
+// import passes no terms.
+func (s *indexSet) endImport(terms importTerms) {
+	if s == nil {
+		return
+	}
+	for _, x := range s.indexes {
+		x.mu.Lock()
+		for key, byIndex := range terms {
+			if !x.touched[key] {
+				x.set([]byte(key), byIndex[x])
+			}
+		}
+		x.touched = nil
+		x.mu.Unlock()
+	}
+}
+
+// save writes every index to its file
+func (s *indexSet) save() error {
+	if s == nil {
+		return nil
+	}
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create index directory: %w", err)
+	}
+
+	for name, x := range s.indexes {
+		data, err := x.encode()
+		if err != nil {
+			return fmt.Errorf("failed to encode index %q: %w", name, err)
+		}
+		path := filepath.Join(s.dir, name+".idx")
+		tempPath := path + ".tmp"
+		if err := writeSyncedFile(tempPath, data); err != nil {
+			return fmt.Errorf("failed to write index %q: %w", name, err)
+		}
+		if err := os.Rename(tempPath, path); err != nil {
+			return fmt.Errorf("failed to rename index file: %w", err)
+		}
+	}
+
+	if s.syncDirs {
+		if err := fsyncDir(s.dir); err != nil {
+			return fmt.Errorf("failed to sync index directory: %w", err)
+		}
+	}
+	return nil
+}
+
+// writeSyncedFile writes data to a new file at path and syncs it
+func writeSyncedFile(path string, data []byte) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// buildIndexes files the live pairs of the engine in the given indexes
+func (e *Engine) buildIndexes(indexes []*secondaryIndex) error {
+	if len(indexes) == 0 {
+		return nil
+	}
+
+	it, err := e.NewIterator(context.Background(), IteratorOptions{})
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	for it.Next() {
+		for _, x := range indexes {
+			x.update(it.Key(), it.Value())
+		}
+	}
+	return it.Err()
+}
+
+// Search returns the keys whose values the named secondary index (see
+// Options.Indexes) extracts term from, in key order
+func (e *Engine) Search(index string, term []byte) ([][]byte, error) {
+	e.mu.RLock()
+	closed := e.closed
+	e.mu.RUnlock()
+	if closed {
+		return nil, ErrEngineClosed
+	}
+	if e.readOnly {
+		return nil, ErrReadOnly
+	}
+	return e.indexes.search(index, term)
+}
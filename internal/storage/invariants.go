@@ -0,0 +1,51 @@
+package storage
+
+import "fmt"
+
+// invariantsEnabled turns on internal consistency checks that are too
+// costly for production. Tests and builds with the river_invariants tag
+// enable them.
+var invariantsEnabled = invariantsBuild
+
+// checkInvariants panics if the tree violates an ordering invariant the
+// read path relies on: the blocks of each run in levels 1-6 are sorted by
+// min key and their key ranges don't overlap, so findBlockIndex can binary
+// search them. It does nothing unless invariantsEnabled. Callers must hold
+// t.mu.
+func (t *LSMTree) checkInvariants() {
+	if !invariantsEnabled {
+		return
+	}
+	if err := t.levelOverlap(); err != nil {
+		panic(fmt.Sprintf("LSM tree invariant violated: %v", err))
+	}
+}
+
+// levelOverlap returns an error describing the first pair of overlapping
+// or misordered blocks of a run in levels 1-6, or nil. Callers must hold
+// t.mu.
+func (t *LSMTree) levelOverlap() error {
+	for level := 1; level < len(t.levels); level++ {
+		for _, run := range t.levelRuns(level) {
+			if err := runOverlap(level, run); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// runOverlap returns an error describing the first pair of overlapping or
+// misordered blocks of a run of level, or nil
+func runOverlap(level int, blocks []blockInfo) error {
+	for i, info := range blocks {
+		if string(info.minKey) > string(info.maxKey) {
+			return fmt.Errorf("L%d block %s has min key %q after max key %q", level, info.path, info.minKey, info.maxKey)
+		}
+		if i > 0 && string(blocks[i-1].maxKey) >= string(info.minKey) {
+			return fmt.Errorf("L%d blocks %s [%q, %q] and %s [%q, %q] overlap", level,
+				blocks[i-1].path, blocks[i-1].minKey, blocks[i-1].maxKey, info.path, info.minKey, info.maxKey)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,6 @@
+//go:build !river_invariants
+
+package storage
+
+// invariantsBuild enables the internal consistency checks in builds with the river_invariants tag
+const invariantsBuild = false
@@ -0,0 +1,323 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+)
+
+func init() {
+	// Check the tree's internal invariants in all tests
+	invariantsEnabled = true
+}
+
+// TestCompaction_NoOverlap runs rounds of overwrites, deletes and
+// compactions cascading through the levels, and checks that no two blocks
+// in a level >= 1 overlap and that every key keeps its newest value
+func TestCompaction_NoOverlap(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-compaction-overlap-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		// Small output blocks, and levels that fill up after a few rounds
+		opts := DefaultOptions()
+		opts.L0CompactionTrigger = 2
+		opts.TargetBlockSize = 256
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+		defer engine.Close()
+
+		engine.lsm.mu.Lock()
+		for level := 1; level < 7; level++ {
+			engine.lsm.compactionThresholds[level] = 2048 << level
+		}
+		engine.lsm.mu.Unlock()
+
+		rng := rand.New(rand.NewSource(1))
+		model := make(map[string]string)
+		maxBlocks := 0
+		for round := 0; round < 20; round++ {
+			for i := 0; i < 40; i++ {
+				key := fmt.Sprintf("key-%03d", rng.Intn(200))
+				if rng.Intn(5) == 0 {
+					if err := engine.Delete([]byte(key)); err != nil {
+						t.Errorf("Failed to delete: %v", err)
+					}
+					delete(model, key)
+					continue
+				}
+				value := fmt.Sprintf("round-%d-%d", round, i)
+				if err := engine.Put([]byte(key), []byte(value)); err != nil {
+					t.Errorf("Failed to put: %v", err)
+				}
+				model[key] = value
+			}
+			if err := engine.flush(); err != nil {
+				t.Errorf("Failed to flush: %v", err)
+			}
+			engine.lsm.runCompaction()
+
+			engine.lsm.mu.RLock()
+			if err := engine.lsm.levelOverlap(); err != nil {
+				t.Errorf("Round %d: %v", round, err)
+			}
+			for level := 1; level < 7; level++ {
+				if n := len(engine.lsm.levels[level]); n > maxBlocks {
+					maxBlocks = n
+				}
+			}
+			engine.lsm.mu.RUnlock()
+
+			for i := 0; i < 200; i++ {
+				key := fmt.Sprintf("key-%03d", i)
+				value, err := engine.Get([]byte(key))
+				expected, ok := model[key]
+				switch {
+				case !ok && !errors.Is(err, ErrKeyNotFound):
+					t.Errorf("Round %d: expected %s to be absent, got %q (err %v)", round, key, value, err)
+				case ok && (err != nil || string(value) != expected):
+					t.Errorf("Round %d: expected %s=%s, got %q (err %v)", round, key, expected, value, err)
+				}
+			}
+		}
+
+		if maxBlocks < 2 {
+			t.Errorf("Expected compaction to write several blocks into a level, got at most %d", maxBlocks)
+		}
+		engine.lsm.mu.RLock()
+		for level := 0; level < 6; level++ {
+			if engine.lsm.shouldCompact(level) {
+				t.Errorf("Expected L%d to be compacted", level)
+			}
+		}
+		engine.lsm.mu.RUnlock()
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+// TestCompaction_TargetBlockSize compacts two flushes holding much more
+// than a target block into L1, and checks the merge rolls over to a new
+// output block at the target size, with consecutive, non-overlapping key
+// ranges that are still listed after reopening
+func TestCompaction_TargetBlockSize(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-compaction-output-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	const numKeys = 200
+
+	// checkLevel checks L1 holds every key, in order and with its newest
+	// value, in blocks of about the target size
+	checkLevel := func(engine *Engine, stage string) {
+		engine.lsm.mu.RLock()
+		blocks := append([]blockInfo(nil), engine.lsm.levels[1]...)
+		engine.lsm.mu.RUnlock()
+		if len(blocks) < 10 {
+			t.Errorf("%s: expected the compaction to write at least 10 blocks, got %d", stage, len(blocks))
+		}
+
+		count := 0
+		for i, info := range blocks {
+			b, err := loadBlock(info.path)
+			if err != nil {
+				t.Errorf("%s: failed to load block: %v", stage, err)
+				continue
+			}
+			if b.Size() > engine.opts.TargetBlockSize+200 {
+				t.Errorf("%s: block %d is %d bytes, far over the %d-byte target", stage, i, b.Size(), engine.opts.TargetBlockSize)
+			}
+			if b.MinKey() != string(info.minKey) || b.MaxKey() != string(info.maxKey) {
+				t.Errorf("%s: block %d bounds %s..%s differ from its header %s..%s", stage, i, info.minKey, info.maxKey, b.MinKey(), b.MaxKey())
+			}
+			if i > 0 && bytes.Compare(info.minKey, blocks[i-1].maxKey) <= 0 {
+				t.Errorf("%s: block %d starts at %s, not after the previous block's %s", stage, i, info.minKey, blocks[i-1].maxKey)
+			}
+			for j := 0; j < b.Count(); j++ {
+				key, value := b.Pair(j)
+				expected := "old"
+				if count%2 == 0 {
+					expected = "new"
+				}
+				if string(key) != fmt.Sprintf("key-%03d", count) || !bytes.HasPrefix(value, []byte(expected)) {
+					t.Errorf("%s: expected key-%03d=%s..., got %s=%.3s", stage, count, expected, key, value)
+				}
+				count++
+			}
+		}
+		if count != numKeys {
+			t.Errorf("%s: expected %d keys across the blocks, got %d", stage, numKeys, count)
+		}
+	}
+
+	done := make(chan bool)
+	go func() {
+		opts := DefaultOptions()
+		opts.TargetBlockSize = 1024
+		opts.L0CompactionTrigger = 0
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+
+		// Every key, then newer versions of the even keys: about 30KB
+		for i := 0; i < numKeys; i++ {
+			value := append([]byte("old"), bytes.Repeat([]byte("v"), 90)...)
+			if err := engine.Put([]byte(fmt.Sprintf("key-%03d", i)), value); err != nil {
+				t.Errorf("Failed to put: %v", err)
+			}
+		}
+		if err := engine.flush(); err != nil {
+			t.Errorf("Failed to flush: %v", err)
+		}
+		for i := 0; i < numKeys; i += 2 {
+			value := append([]byte("new"), bytes.Repeat([]byte("v"), 90)...)
+			if err := engine.Put([]byte(fmt.Sprintf("key-%03d", i)), value); err != nil {
+				t.Errorf("Failed to put: %v", err)
+			}
+		}
+		if err := engine.flush(); err != nil {
+			t.Errorf("Failed to flush: %v", err)
+		}
+
+		if err := engine.CompactRange(0, nil, nil); err != nil {
+			t.Errorf("Failed to compact L0: %v", err)
+		}
+		checkLevel(engine, "compacted")
+
+		if err := engine.Close(); err != nil {
+			t.Errorf("Failed to close engine: %v", err)
+		}
+		reopened, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to reopen engine: %v", err)
+			done <- true
+			return
+		}
+		defer reopened.Close()
+		checkLevel(reopened, "reopened")
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+// TestCompaction_OverlappingL0 compacts two overlapping level 0 blocks into
+// L1 with a task listing only the newer one, and checks the older one is
+// merged with it, so L1 doesn't overlap and the newer values win
+func TestCompaction_OverlappingL0(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-compaction-l0-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		opts := DefaultOptions()
+		opts.L0CompactionTrigger = 10
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+		defer engine.Close()
+
+		// L1 holds key-00 to key-19, the older L0 block key-05 to key-14
+		// and the newer one key-10 to key-24
+		putRange := func(from, to int, value string) {
+			for i := from; i < to; i++ {
+				if err := engine.Put([]byte(fmt.Sprintf("key-%02d", i)), []byte(value)); err != nil {
+					t.Errorf("Failed to put: %v", err)
+				}
+			}
+			if err := engine.flush(); err != nil {
+				t.Errorf("Failed to flush: %v", err)
+			}
+		}
+		putRange(0, 20, "l1")
+		engine.lsm.mergeMu.Lock()
+		engine.lsm.mu.Lock()
+		if err := engine.lsm.mergeBlocks(engine.lsm.levels[0], 1); err != nil {
+			t.Errorf("Failed to compact into L1: %v", err)
+		}
+		engine.lsm.mu.Unlock()
+		engine.lsm.mergeMu.Unlock()
+		putRange(5, 15, "old")
+		putRange(10, 25, "new")
+
+		// Small compaction outputs, so L1 holds several blocks
+		engine.lsm.mergeMu.Lock()
+		engine.lsm.mu.Lock()
+		engine.lsm.targetBlockSize = 128
+		if n := len(engine.lsm.levels[0]); n != 2 {
+			t.Errorf("Expected 2 L0 blocks, got %d", n)
+		} else {
+			newer := engine.lsm.levels[0][1]
+			if err := engine.lsm.runTask(compactionTask{sourceLevel: 0, targetLevel: 1, blocks: []blockInfo{newer}}); err != nil {
+				t.Errorf("Failed to compact L0: %v", err)
+			}
+		}
+		if n := len(engine.lsm.levels[0]); n != 0 {
+			t.Errorf("Expected the overlapping L0 blocks to be compacted together, %d left", n)
+		}
+		if n := len(engine.lsm.levels[1]); n < 2 {
+			t.Errorf("Expected several L1 blocks, got %d", n)
+		}
+		if err := engine.lsm.levelOverlap(); err != nil {
+			t.Errorf("L1 overlaps: %v", err)
+		}
+		engine.lsm.mu.Unlock()
+		engine.lsm.mergeMu.Unlock()
+
+		for i := 0; i < 25; i++ {
+			expected := "new"
+			switch {
+			case i < 5:
+				expected = "l1"
+			case i < 10:
+				expected = "old"
+			}
+			key := fmt.Sprintf("key-%02d", i)
+			if value, err := engine.Get([]byte(key)); err != nil || string(value) != expected {
+				t.Errorf("Expected %s=%s, got %q (err %v)", key, expected, value, err)
+			}
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
@@ -0,0 +1,717 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/0xReLogic/river/internal/data/block"
+)
+
+// IteratorOptions configures an engine iterator
+type IteratorOptions struct {
+	// First key to return (inclusive). Nil starts at the smallest key.
+	Start []byte
+
+	// Key to stop before (exclusive). Nil iterates up to the largest key.
+	End []byte
+
+	// Iterate over [Start, End) in descending key order
+	Reverse bool
+}
+
+// Iterator walks the live keys of the engine in key order, or in descending
+// order for reverse iterators.
+//
+// The iterator reads a snapshot taken when it was created: the memory tables
+// are copied and the block lists of every level are captured, so writes made
+// afterwards are not visible. Blocks are decoded one at a time as the
+// iterator reaches them. Tombstones and shadowed versions are skipped.
+//
+// Iterators must be closed. Typical use:
+//
+//	it, err := engine.NewIterator(ctx, IteratorOptions{Start: start})
+//	if err != nil { ... }
+//	defer it.Close()
+//	for it.Next() {
+//		use(it.Key(), it.Value())
+//	}
+//	if err := it.Err(); err != nil { ... }
+type Iterator struct {
+	// Context that stops the iteration when cancelled
+	ctx context.Context
+
+	// Engine the iterator belongs to
+	engine *Engine
+
+	// Key bounds of the iteration
+	opts IteratorOptions
+
+	// Sources ordered from newest to oldest; on equal keys the first wins
+	sources []iteratorSource
+
+	// Current key and value
+	key   []byte
+	value []byte
+
+	// First error encountered, which ends the iteration
+	err error
+
+	// Whether Close has been called
+	closed bool
+
+	// Block files pinned against deletion until Close
+	pinned []string
+
+	// Stops reading blocks ahead, and waits for the blocks being read
+	cancelReadAhead context.CancelFunc
+	readAhead       *sync.WaitGroup
+
+	// Predicate the returned values match (see ScanWhere), nil for all
+	pred Predicate
+
+	// Return the stored values, value log pointers included, rather than
+	// the values they point to
+	raw bool
+
+	// Generation of the iterator in the value log, which keeps the values
+	// of its snapshot until it is closed
+	valueLogGeneration uint64
+}
+
+// iteratorSource is a sorted stream of key-value pairs (nil value = tombstone)
+type iteratorSource interface {
+	// valid reports whether the source is positioned on a pair
+	valid() bool
+
+	// key and value return the current pair
+	key() []byte
+	value() []byte
+
+	// next advances to the following pair
+	next() error
+
+	// prev steps back to the preceding pair
+	prev() error
+
+	// seek positions the source on the first pair with a key >= key
+	// (the first pair when key is nil), backward or forward
+	seek(key []byte) error
+
+	// seekBefore positions the source on the last pair with a key < key
+	// (the last pair when key is nil), backward or forward
+	seekBefore(key []byte) error
+}
+
+// NewIterator returns an iterator over the keys in the range given by opts.
+// The iteration stops with the context's error once ctx is cancelled.
+func (e *Engine) NewIterator(ctx context.Context, opts IteratorOptions) (*Iterator, error) {
+	return e.newIterator(ctx, opts, nil, nil)
+}
+
+// newIterator implements NewIterator, returning only the values matching
+// pred unless it is nil, and skipping the blocks pred rules out (see
+// pruneBlocks). Unless it is nil, snapshot is called with the engine lock
+// held while the memory tables are copied, so no write lands between the
+// two.
+func (e *Engine) newIterator(ctx context.Context, opts IteratorOptions, pred Predicate, snapshot func()) (*Iterator, error) {
+	// Writers hold e.mu shared, so holding it exclusively copies the memory
+	// tables without a write landing in some shards and not others
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return nil, ErrEngineClosed
+	}
+
+	// Memory tables first: the active one is newer than the one being flushed
+	sources := []iteratorSource{
+		newMemTableSource(e.memTable, opts),
+		newMemTableSource(e.flushingMemTable, opts),
+	}
+	if snapshot != nil {
+		snapshot()
+	}
+	valueLogGeneration := e.values.openReader()
+	e.mu.Unlock()
+
+	// Then the runs of each level from newest to oldest: every level 0
+	// block is a run, and deeper levels hold one run each unless tiered
+	readAheadCtx, cancelReadAhead := context.WithCancel(ctx)
+	readAhead := &sync.WaitGroup{}
+	e.lsm.mu.RLock()
+	for level := range e.lsm.levels {
+		runs := e.lsm.levelRuns(level)
+		for i := len(runs) - 1; i >= 0; i-- {
+			sources = append(sources, &blockSource{
+				blocks:       append([]blockInfo(nil), runs[i]...),
+				opts:         opts,
+				files:        e.lsm.files,
+				readAhead:    e.opts.ScanReadAhead,
+				readAheadCtx: readAheadCtx,
+				readAheadWG:  readAhead,
+			})
+		}
+	}
+
+	if pred != nil {
+		pruneBlocks(sources, pred)
+	}
+
+	// Keep compaction from deleting the blocks while the iterator reads them
+	var pinned []string
+	for _, blocks := range e.lsm.levels {
+		for _, info := range blocks {
+			pinned = append(pinned, info.path)
+		}
+	}
+	e.lsm.pinBlocks(pinned)
+	e.lsm.mu.RUnlock()
+
+	it := &Iterator{
+		ctx:                ctx,
+		engine:             e,
+		opts:               opts,
+		sources:            sources,
+		pinned:             pinned,
+		cancelReadAhead:    cancelReadAhead,
+		readAhead:          readAhead,
+		pred:               pred,
+		valueLogGeneration: valueLogGeneration,
+	}
+
+	// Position the sources on their first pair in range
+	if opts.Reverse {
+		it.seekBefore(opts.End)
+	} else {
+		it.Seek(opts.Start)
+	}
+
+	e.openIterators.Add(1)
+	return it, nil
+}
+
+// ReverseScan returns an iterator over the keys in (start, end] in
+// descending key order. A nil start or end leaves that side unbounded.
+func (e *Engine) ReverseScan(start, end []byte) (*Iterator, error) {
+	return e.NewIterator(context.Background(), IteratorOptions{
+		Start:   successor(start),
+		End:     successor(end),
+		Reverse: true,
+	})
+}
+
+// ScanNamespace returns an iterator over the keys in the namespace given by
+// parts, in key order. Keys are namespaced by joining their parts with
+// Options.KeySeparator, e.g. tenant:table:pk. The namespace covers the keys
+// starting with the parts followed by the separator, so ScanNamespace("a",
+// "b") returns a:b:1 but not a:bc:1, nor the key a:b itself. Without parts
+// every key is returned.
+func (e *Engine) ScanNamespace(parts ...[]byte) (*Iterator, error) {
+	if len(parts) == 0 {
+		return e.NewIterator(context.Background(), IteratorOptions{})
+	}
+
+	sep := e.opts.KeySeparator
+	prefix := append(bytes.Join(parts, []byte{sep}), sep)
+	return e.NewIterator(context.Background(), IteratorOptions{
+		Start: prefix,
+		End:   prefixEnd(prefix),
+	})
+}
+
+// ValueIterator walks the values of the live keys of a range in key order,
+// without their keys (see Engine.ScanValues). Like an Iterator, it reads a
+// snapshot and must be closed.
+type ValueIterator interface {
+	// Next advances to the next value, returning false at the end of the
+	// range or on an error
+	Next() bool
+
+	// Value returns the current value. It is only valid after Next
+	// returned true.
+	Value() []byte
+
+	// Err returns the error that ended the iteration, if any
+	Err() error
+
+	// Close releases the iterator. It is safe to call Close more than once.
+	Close() error
+}
+
+// valueIterator is the ValueIterator of Engine.ScanValues
+type valueIterator struct {
+	*Iterator
+}
+
+// ScanValues returns an iterator over the values of the keys in
+// [start, end), in key order, for reads that aggregate values and have no
+// use for their keys. A nil start or end leaves that side unbounded. Keys
+// are still compared to merge the memory tables and levels, in place in the
+// blocks they are decoded from, but are never copied out or returned.
+func (e *Engine) ScanValues(start, end []byte) (ValueIterator, error) {
+	it, err := e.NewIterator(context.Background(), IteratorOptions{Start: start, End: end})
+	if err != nil {
+		return nil, err
+	}
+	return valueIterator{it}, nil
+}
+
+// prefixEnd returns the smallest key greater than every key starting with
+// prefix, or nil if there is none (the prefix is all 0xFF bytes)
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xFF {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// successor returns the smallest key greater than key, turning an inclusive
+// bound into an exclusive one and vice versa. Nil stays unbounded.
+func successor(key []byte) []byte {
+	if key == nil {
+		return nil
+	}
+	next := make([]byte, len(key)+1)
+	copy(next, key)
+	return next
+}
+
+// Seek repositions the iterator so that the next call to Next returns the
+// first live key >= key. Keys before the iterator's Start bound are clamped
+// to it. Seek can move backward as well as forward; only the blocks holding
+// the target key are decoded.
+//
+// On a reverse iterator, Seek positions on the last live key <= key instead,
+// clamped to the End bound.
+func (it *Iterator) Seek(key []byte) {
+	if it.opts.Reverse {
+		it.seekBefore(successor(key))
+		return
+	}
+
+	it.key, it.value = nil, nil
+	if it.closed || it.err != nil {
+		return
+	}
+
+	if it.opts.Start != nil && (key == nil || bytes.Compare(key, it.opts.Start) < 0) {
+		key = it.opts.Start
+	}
+	for _, src := range it.sources {
+		if err := src.seek(key); err != nil {
+			it.err = err
+			return
+		}
+	}
+}
+
+// seekBefore positions the sources of a reverse iterator on their last pair
+// with a key < key, clamped to the End bound
+func (it *Iterator) seekBefore(key []byte) {
+	it.key, it.value = nil, nil
+	if it.closed || it.err != nil {
+		return
+	}
+
+	if it.opts.End != nil && (key == nil || bytes.Compare(key, it.opts.End) > 0) {
+		key = it.opts.End
+	}
+	for _, src := range it.sources {
+		if err := src.seekBefore(key); err != nil {
+			it.err = err
+			return
+		}
+	}
+}
+
+// Next advances the iterator to the next live key. It returns false when the
+// range is exhausted, an error occurred, the context was cancelled or the
+// iterator was closed.
+func (it *Iterator) Next() bool {
+	it.key, it.value = nil, nil
+	if it.closed || it.err != nil {
+		return false
+	}
+
+	for {
+		if err := it.ctx.Err(); err != nil {
+			it.err = err
+			return false
+		}
+
+		// Find the smallest key (largest in reverse); the newest source
+		// holding it provides the value
+		var key, value []byte
+		found := false
+		for _, src := range it.sources {
+			if !src.valid() {
+				continue
+			}
+			if !found || it.before(src.key(), key) {
+				key, value = src.key(), src.value()
+				found = true
+			}
+		}
+		if !found || !it.inRange(key) {
+			return false
+		}
+
+		// Skip the older versions of the key
+		for _, src := range it.sources {
+			if !src.valid() || !bytes.Equal(src.key(), key) {
+				continue
+			}
+			var err error
+			if it.opts.Reverse {
+				err = src.prev()
+			} else {
+				err = src.next()
+			}
+			if err != nil {
+				it.err = err
+				return false
+			}
+		}
+
+		if value == nil {
+			continue // Deleted key
+		}
+		if !it.raw {
+			resolved, err := it.engine.values.resolve(value)
+			if err != nil {
+				it.err = err
+				return false
+			}
+			value = resolved
+		}
+		if it.pred != nil && !it.pred.Matches(value) {
+			continue
+		}
+
+		it.key, it.value = key, value
+		return true
+	}
+}
+
+// before reports whether a comes before b in the iteration order
+func (it *Iterator) before(a, b []byte) bool {
+	if it.opts.Reverse {
+		return bytes.Compare(a, b) > 0
+	}
+	return bytes.Compare(a, b) < 0
+}
+
+// inRange reports whether key has not gone past the bound the iteration moves towards
+func (it *Iterator) inRange(key []byte) bool {
+	if it.opts.Reverse {
+		return it.opts.Start == nil || bytes.Compare(key, it.opts.Start) >= 0
+	}
+	return it.opts.End == nil || bytes.Compare(key, it.opts.End) < 0
+}
+
+// Key returns the current key. It is only valid after Next returned true.
+func (it *Iterator) Key() []byte {
+	return it.key
+}
+
+// Value returns the current value. It is only valid after Next returned true.
+func (it *Iterator) Value() []byte {
+	return it.value
+}
+
+// Err returns the error that ended the iteration, if any
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close releases the iterator. It is safe to call Close more than once.
+func (it *Iterator) Close() error {
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+
+	// The blocks read ahead must be read before they are unpinned
+	it.cancelReadAhead()
+	it.readAhead.Wait()
+
+	it.sources = nil
+	it.key, it.value = nil, nil
+	it.engine.lsm.unpinBlocks(it.pinned)
+	it.engine.values.closeReader(it.valueLogGeneration)
+	it.engine.openIterators.Add(-1)
+	return nil
+}
+
+// memTableSource iterates over a sorted copy of a memory table
+type memTableSource struct {
+	keys   [][]byte
+	values [][]byte
+	pos    int
+}
+
+// newMemTableSource copies the entries of memTable (which may be nil) within
+// the bounds of opts. Callers must hold the engine lock.
+func newMemTableSource(memTable *memTable, opts IteratorOptions) *memTableSource {
+	src := &memTableSource{}
+	if memTable != nil {
+		src.keys, src.values = memTable.sorted(opts.Start, opts.End)
+	}
+	return src
+}
+
+func (s *memTableSource) valid() bool   { return s.pos >= 0 && s.pos < len(s.keys) }
+func (s *memTableSource) key() []byte   { return s.keys[s.pos] }
+func (s *memTableSource) value() []byte { return s.values[s.pos] }
+func (s *memTableSource) next() error   { s.pos++; return nil }
+func (s *memTableSource) prev() error   { s.pos--; return nil }
+
+func (s *memTableSource) seek(key []byte) error {
+	s.pos = sort.Search(len(s.keys), func(i int) bool {
+		return bytes.Compare(s.keys[i], key) >= 0
+	})
+	return nil
+}
+
+func (s *memTableSource) seekBefore(key []byte) error {
+	if key == nil {
+		s.pos = len(s.keys) - 1
+		return nil
+	}
+	s.pos = sort.Search(len(s.keys), func(i int) bool {
+		return bytes.Compare(s.keys[i], key) >= 0
+	}) - 1
+	return nil
+}
+
+// blockSource iterates over a run of non-overlapping blocks in key order,
+// decoding one block at a time
+type blockSource struct {
+	// Blocks of the run, sorted by min key (and so by max key)
+	blocks []blockInfo
+
+	// Key bounds of the iteration
+	opts IteratorOptions
+
+	// Pool through which block files are opened
+	files *filePool
+
+	// Index of the current block in blocks (len(blocks) or -1 when
+	// exhausted), its decoded contents and the position within it
+	idx     int
+	current *block.Block
+	pos     int
+
+	// Number of blocks read ahead of the current one moving forward
+	// (Options.ScanReadAhead), and the blocks being read, by index
+	readAhead  int
+	prefetched map[int]*prefetchedBlock
+
+	// Stops reading blocks ahead, and tracks the blocks being read
+	readAheadCtx context.Context
+	readAheadWG  *sync.WaitGroup
+
+	// Blocks that are not read, by index (see pruneBlocks); nil for none
+	skip []bool
+}
+
+// prefetchedBlock is a block read ahead of a forward scan
+type prefetchedBlock struct {
+	// Closed once the block is read
+	done chan struct{}
+
+	// Decoded block, or the error reading it
+	block *block.Block
+	err   error
+}
+
+// seek positions the source on the first pair with a key >= key
+func (s *blockSource) seek(key []byte) error {
+	// The first block that ends at or after key is the only one that can hold it
+	idx := sort.Search(len(s.blocks), func(i int) bool {
+		return bytes.Compare(s.blocks[i].maxKey, key) >= 0
+	})
+	if err := s.load(idx, 1); err != nil {
+		return err
+	}
+	if s.current == nil {
+		return nil
+	}
+
+	s.pos = sort.Search(s.current.Count(), func(i int) bool {
+		k, _ := s.current.Pair(i)
+		return bytes.Compare(k, key) >= 0
+	})
+	if s.pos == s.current.Count() {
+		return s.load(s.idx+1, 1)
+	}
+	return nil
+}
+
+// seekBefore positions the source on the last pair with a key < key
+func (s *blockSource) seekBefore(key []byte) error {
+	// The last block that starts before key is the only one that can hold it
+	idx := len(s.blocks) - 1
+	if key != nil {
+		idx = sort.Search(len(s.blocks), func(i int) bool {
+			return bytes.Compare(s.blocks[i].minKey, key) >= 0
+		}) - 1
+	}
+	if err := s.load(idx, -1); err != nil {
+		return err
+	}
+	if s.current == nil || key == nil {
+		return nil
+	}
+
+	s.pos = sort.Search(s.current.Count(), func(i int) bool {
+		k, _ := s.current.Pair(i)
+		return bytes.Compare(k, key) >= 0
+	}) - 1
+	if s.pos < 0 {
+		return s.load(s.idx-1, -1)
+	}
+	return nil
+}
+
+// load positions the source on the first non-empty block from idx on,
+// moving forward (step 1) or backward (step -1), at the start of the block
+// going forward and at its end going backward. Blocks past the bound the
+// source moves towards are not decoded. The current block is reused when it
+// is the one requested.
+func (s *blockSource) load(idx, step int) error {
+	if s.current != nil && idx == s.idx {
+		s.setPos(step)
+		return nil
+	}
+
+	s.current = nil
+	for s.idx = idx; s.idx >= 0 && s.idx < len(s.blocks); s.idx += step {
+		info := s.blocks[s.idx]
+		if step > 0 && s.opts.End != nil && bytes.Compare(info.minKey, s.opts.End) >= 0 {
+			break
+		}
+		if step < 0 && s.opts.Start != nil && bytes.Compare(info.maxKey, s.opts.Start) < 0 {
+			break
+		}
+
+		if s.skip != nil && s.skip[s.idx] {
+			continue
+		}
+
+		b, err := s.loadBlock(s.idx)
+		if err != nil {
+			return err
+		}
+		if b.Count() > 0 {
+			s.current = b
+			s.setPos(step)
+			if step > 0 {
+				s.prefetch()
+			}
+			return nil
+		}
+	}
+
+	if step > 0 {
+		s.idx = len(s.blocks)
+	} else {
+		s.idx = -1
+	}
+	return nil
+}
+
+// loadBlock returns the block at idx, read ahead or read now
+func (s *blockSource) loadBlock(idx int) (*block.Block, error) {
+	if p, ok := s.prefetched[idx]; ok {
+		delete(s.prefetched, idx)
+		<-p.done
+		if p.err == nil {
+			return p.block, nil
+		}
+		// A block that failed to be read ahead is read again, reporting the error
+	}
+	return s.files.loadBlock(s.blocks[idx].path)
+}
+
+// prefetch starts reading the blocks following the current one in the
+// background, up to s.readAhead blocks ahead and not past the End bound,
+// and forgets blocks read ahead that the scan has moved away from
+func (s *blockSource) prefetch() {
+	if s.readAhead <= 0 {
+		return
+	}
+	if s.prefetched == nil {
+		s.prefetched = make(map[int]*prefetchedBlock)
+	}
+
+	for idx := range s.prefetched {
+		if idx <= s.idx || idx > s.idx+s.readAhead {
+			delete(s.prefetched, idx)
+		}
+	}
+
+	for idx := s.idx + 1; idx <= s.idx+s.readAhead && idx < len(s.blocks); idx++ {
+		info := s.blocks[idx]
+		if s.opts.End != nil && bytes.Compare(info.minKey, s.opts.End) >= 0 {
+			break
+		}
+		if _, ok := s.prefetched[idx]; ok || (s.skip != nil && s.skip[idx]) {
+			continue
+		}
+
+		p := &prefetchedBlock{done: make(chan struct{})}
+		s.prefetched[idx] = p
+		s.readAheadWG.Add(1)
+		go func() {
+			defer s.readAheadWG.Done()
+			defer close(p.done)
+			if p.err = s.readAheadCtx.Err(); p.err != nil {
+				return
+			}
+			p.block, p.err = s.files.loadBlock(info.path)
+		}()
+	}
+}
+
+// setPos moves to the start of the current block going forward, or its end going backward
+func (s *blockSource) setPos(step int) {
+	if step > 0 {
+		s.pos = 0
+	} else {
+		s.pos = s.current.Count() - 1
+	}
+}
+
+func (s *blockSource) valid() bool { return s.current != nil }
+
+func (s *blockSource) key() []byte {
+	key, _ := s.current.Pair(s.pos)
+	return key
+}
+
+func (s *blockSource) value() []byte {
+	_, value := s.current.Pair(s.pos)
+	return value
+}
+
+func (s *blockSource) next() error {
+	s.pos++
+	if s.pos < s.current.Count() {
+		return nil
+	}
+	return s.load(s.idx+1, 1)
+}
+
+func (s *blockSource) prev() error {
+	s.pos--
+	if s.pos >= 0 {
+		return nil
+	}
+	return s.load(s.idx-1, -1)
+}
@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+	"time"
+)
+
+// expectedScan returns the live pairs of a reference model in the range
+// given by opts, in the order an iterator returns them, as "key=value"
+// strings
+func expectedScan(model map[string]string, opts IteratorOptions) []string {
+	keys := make([]string, 0, len(model))
+	for key := range model {
+		if opts.Start != nil && key < string(opts.Start) {
+			continue
+		}
+		if opts.End != nil && key >= string(opts.End) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if opts.Reverse {
+		for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+			keys[i], keys[j] = keys[j], keys[i]
+		}
+	}
+
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = fmt.Sprintf("%s=%s", key, model[key])
+	}
+	return pairs
+}
+
+// checkScan compares a scan of the engine over the range given by opts with
+// the reference model, and returns a description of the first difference
+func checkScan(t *testing.T, engine *Engine, model map[string]string, opts IteratorOptions) error {
+	it, err := engine.NewIterator(context.Background(), opts)
+	if err != nil {
+		return fmt.Errorf("failed to create iterator: %w", err)
+	}
+	got := collect(t, it)
+	if err := it.Close(); err != nil {
+		return fmt.Errorf("failed to close iterator: %w", err)
+	}
+
+	expected := expectedScan(model, opts)
+	for i := 0; i < len(got) || i < len(expected); i++ {
+		switch {
+		case i >= len(got):
+			return fmt.Errorf("scan [%q, %q) reverse=%v: missing %s after %d pairs", opts.Start, opts.End, opts.Reverse, expected[i], i)
+		case i >= len(expected):
+			return fmt.Errorf("scan [%q, %q) reverse=%v: unexpected %s after %d pairs", opts.Start, opts.End, opts.Reverse, got[i], i)
+		case got[i] != expected[i]:
+			return fmt.Errorf("scan [%q, %q) reverse=%v: expected %s at %d, got %s", opts.Start, opts.End, opts.Reverse, expected[i], i, got[i])
+		}
+	}
+	return nil
+}
+
+// TestIterator_MatchesModel applies random puts, overwrites, deletes,
+// flushes and compactions to the engine and to a reference map, and checks
+// full, reverse and partial scans return exactly the live entries of the
+// map, in order. Each seed is replayed identically, so a failure reports
+// the seed and operation to reproduce it.
+func TestIterator_MatchesModel(t *testing.T) {
+	strategies := []CompactionStrategy{CompactionLeveled, CompactionTiered}
+	for seed := int64(1); seed <= 4; seed++ {
+		strategy := strategies[seed%2]
+		t.Run(fmt.Sprintf("seed-%d", seed), func(t *testing.T) {
+			tempDir, err := os.MkdirTemp("", "river-iterator-model-test")
+			if err != nil {
+				t.Fatalf("Failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(tempDir)
+
+			done := make(chan bool)
+			go func() {
+				defer func() { done <- true }()
+
+				// Small blocks and levels, so the entries spread over
+				// many blocks and levels
+				opts := DefaultOptions()
+				opts.L0CompactionTrigger = 2
+				opts.TargetBlockSize = 256
+				opts.CompactionStrategy = strategy
+				engine, err := NewEngineWithOptions(tempDir, opts)
+				if err != nil {
+					t.Errorf("Failed to create engine: %v", err)
+					return
+				}
+				defer engine.Close()
+
+				engine.lsm.mu.Lock()
+				for level := 1; level < 7; level++ {
+					engine.lsm.compactionThresholds[level] = 1024 << level
+				}
+				engine.lsm.mu.Unlock()
+
+				// Keys of different lengths, so prefixes sort before
+				// their extensions (k1 < k10 < k2)
+				rng := rand.New(rand.NewSource(seed))
+				randomKey := func() []byte {
+					return []byte(fmt.Sprintf("k%d", rng.Intn(300)))
+				}
+				model := make(map[string]string)
+				check := func(engine *Engine, op int, opts IteratorOptions) bool {
+					if err := checkScan(t, engine, model, opts); err != nil {
+						t.Errorf("Seed %d, operation %d: %v", seed, op, err)
+						return false
+					}
+					return true
+				}
+
+				for op := 0; op < 600; op++ {
+					switch n := rng.Intn(100); {
+					case n < 55:
+						key := randomKey()
+						value := fmt.Sprintf("v%d", op)
+						if rng.Intn(20) == 0 {
+							value = ""
+						}
+						if err := engine.Put(key, []byte(value)); err != nil {
+							t.Errorf("Seed %d, operation %d: failed to put: %v", seed, op, err)
+						}
+						model[string(key)] = value
+					case n < 80:
+						key := randomKey()
+						if err := engine.Delete(key); err != nil {
+							t.Errorf("Seed %d, operation %d: failed to delete: %v", seed, op, err)
+						}
+						delete(model, string(key))
+					case n < 88:
+						if err := engine.flush(); err != nil {
+							t.Errorf("Seed %d, operation %d: failed to flush: %v", seed, op, err)
+						}
+					case n < 93:
+						engine.lsm.runCompaction()
+					case n < 95:
+						start, end := randomKey(), randomKey()
+						if string(start) > string(end) {
+							start, end = end, start
+						}
+						if err := engine.CompactRange(rng.Intn(3), start, end); err != nil {
+							t.Errorf("Seed %d, operation %d: failed to compact range: %v", seed, op, err)
+						}
+					default:
+						start, end := randomKey(), randomKey()
+						if string(start) > string(end) {
+							start, end = end, start
+						}
+						if !check(engine, op, IteratorOptions{}) ||
+							!check(engine, op, IteratorOptions{Reverse: true}) ||
+							!check(engine, op, IteratorOptions{Start: start, End: end}) ||
+							!check(engine, op, IteratorOptions{Start: start, End: end, Reverse: true}) {
+							return
+						}
+					}
+				}
+
+				if !check(engine, 600, IteratorOptions{}) || !check(engine, 600, IteratorOptions{Reverse: true}) {
+					return
+				}
+
+				// The same entries are read back after a crash and
+				// recovery
+				crash(engine)
+				reopened, err := NewEngineWithOptions(tempDir, opts)
+				if err != nil {
+					t.Errorf("Failed to reopen engine: %v", err)
+					return
+				}
+				defer reopened.Close()
+
+				if check(reopened, 600, IteratorOptions{}) {
+					check(reopened, 600, IteratorOptions{Reverse: true})
+				}
+			}()
+
+			select {
+			case <-done:
+			case <-time.After(10 * time.Second):
+				t.Fatalf("Test timed out after 10 seconds")
+			}
+		})
+	}
+}
@@ -0,0 +1,900 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/0xReLogic/river/internal/data/block"
+)
+
+// collect returns the pairs of an iterator as "key=value" strings
+func collect(t *testing.T, it *Iterator) []string {
+	var pairs []string
+	for it.Next() {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", it.Key(), it.Value()))
+	}
+	if err := it.Err(); err != nil {
+		t.Errorf("Iterator failed: %v", err)
+	}
+	return pairs
+}
+
+// TestIterator_MergesLevels iterates over keys spread across the memory
+// table and several flushed blocks, with overwrites and deletes
+func TestIterator_MergesLevels(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-iterator-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		engine, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+		defer engine.Close()
+
+		put := func(key, value string) {
+			if err := engine.Put([]byte(key), []byte(value)); err != nil {
+				t.Errorf("Failed to put: %v", err)
+			}
+		}
+		flush := func() {
+			if err := engine.flush(); err != nil {
+				t.Errorf("Failed to flush: %v", err)
+			}
+		}
+
+		// Oldest block
+		put("a", "1")
+		put("c", "1")
+		put("e", "1")
+		flush()
+
+		// Newer block overwrites c and deletes e
+		put("c", "2")
+		put("d", "2")
+		if err := engine.Delete([]byte("e")); err != nil {
+			t.Errorf("Failed to delete: %v", err)
+		}
+		flush()
+
+		// Memory table overwrites a and adds b
+		put("a", "3")
+		put("b", "3")
+
+		it, err := engine.NewIterator(context.Background(), IteratorOptions{})
+		if err != nil {
+			t.Errorf("Failed to create iterator: %v", err)
+			done <- true
+			return
+		}
+
+		// Writes after creation are not visible
+		put("z", "4")
+
+		got := fmt.Sprint(collect(t, it))
+		if expected := "[a=3 b=3 c=2 d=2]"; got != expected {
+			t.Errorf("Expected %s, got %s", expected, got)
+		}
+		it.Close()
+
+		// Bounded range
+		it, err = engine.NewIterator(context.Background(), IteratorOptions{
+			Start: []byte("b"),
+			End:   []byte("d"),
+		})
+		if err != nil {
+			t.Errorf("Failed to create iterator: %v", err)
+			done <- true
+			return
+		}
+		got = fmt.Sprint(collect(t, it))
+		if expected := "[b=3 c=2]"; got != expected {
+			t.Errorf("Expected %s, got %s", expected, got)
+		}
+		it.Close()
+
+		if open := engine.GetStats().OpenIterators; open != 0 {
+			t.Errorf("Expected no open iterators, got %d", open)
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+// TestIterator_ColdStart scans an engine whose data was only recovered
+// from the WAL into the memory table, before any block was flushed
+func TestIterator_ColdStart(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-iterator-cold-start-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		defer func() { done <- true }()
+
+		engine, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			return
+		}
+
+		// scan returns the pairs of a scan of the engine
+		scan := func(step string, opts IteratorOptions) string {
+			it, err := engine.NewIterator(context.Background(), opts)
+			if err != nil {
+				t.Errorf("%s: failed to create iterator: %v", step, err)
+				return ""
+			}
+			defer it.Close()
+			return fmt.Sprint(collect(t, it))
+		}
+
+		// An empty engine has nothing to scan
+		if got := scan("Empty", IteratorOptions{}); got != "[]" {
+			t.Errorf("Expected an empty scan of an empty engine, got %s", got)
+		}
+		if got := scan("Empty", IteratorOptions{Reverse: true}); got != "[]" {
+			t.Errorf("Expected an empty reverse scan of an empty engine, got %s", got)
+		}
+
+		// Written out of order, with an overwrite and a delete
+		for _, pair := range [][2]string{{"d", "1"}, {"a", "1"}, {"c", "1"}, {"e", "1"}, {"b", "1"}, {"c", "2"}} {
+			if err := engine.Put([]byte(pair[0]), []byte(pair[1])); err != nil {
+				t.Errorf("Failed to put: %v", err)
+			}
+		}
+		if err := engine.Delete([]byte("e")); err != nil {
+			t.Errorf("Failed to delete: %v", err)
+		}
+		crash(engine)
+
+		engine, err = NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to reopen engine: %v", err)
+			return
+		}
+		defer engine.Close()
+
+		for _, level := range engine.Levels() {
+			if len(level.Blocks) != 0 {
+				t.Errorf("Expected no blocks after recovery, got %d in L%d", len(level.Blocks), level.Level)
+			}
+		}
+
+		expected := map[string]IteratorOptions{
+			"[a=1 b=1 c=2 d=1]": {},
+			"[d=1 c=2 b=1 a=1]": {Reverse: true},
+			"[b=1 c=2]":         {Start: []byte("b"), End: []byte("d")},
+			"[c=2 b=1]":         {Start: []byte("b"), End: []byte("d"), Reverse: true},
+			"[]":                {Start: []byte("e")},
+		}
+		for pairs, opts := range expected {
+			if got := scan("Recovered", opts); got != pairs {
+				t.Errorf("Expected %s scanning %+v, got %s", pairs, opts, got)
+			}
+		}
+
+		// Seeking within the memory table
+		it, err := engine.NewIterator(context.Background(), IteratorOptions{})
+		if err != nil {
+			t.Errorf("Failed to create iterator: %v", err)
+			return
+		}
+		it.Seek([]byte("bb"))
+		if got, expected := fmt.Sprint(collect(t, it)), "[c=2 d=1]"; got != expected {
+			t.Errorf("Expected %s after seeking to bb, got %s", expected, got)
+		}
+		it.Close()
+
+		values, err := engine.ScanValues(nil, nil)
+		if err != nil {
+			t.Errorf("Failed to scan values: %v", err)
+			return
+		}
+		defer values.Close()
+		var got []string
+		for values.Next() {
+			got = append(got, string(values.Value()))
+		}
+		if err := values.Err(); err != nil || fmt.Sprint(got) != "[1 1 2 1]" {
+			t.Errorf("Expected values [1 1 2 1], got %v (err %v)", got, err)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+// TestIterator_ContextCancel checks the iterator stops once its context is cancelled
+func TestIterator_ContextCancel(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-iterator-cancel-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		engine, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+		defer engine.Close()
+
+		for i := 0; i < 100; i++ {
+			if err := engine.Put([]byte(fmt.Sprintf("key-%03d", i)), []byte("value")); err != nil {
+				t.Errorf("Failed to put: %v", err)
+			}
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		it, err := engine.NewIterator(ctx, IteratorOptions{})
+		if err != nil {
+			t.Errorf("Failed to create iterator: %v", err)
+			done <- true
+			return
+		}
+		defer it.Close()
+
+		if !it.Next() {
+			t.Errorf("Expected a first key, got error %v", it.Err())
+		}
+		cancel()
+		if it.Next() {
+			t.Errorf("Expected the iterator to stop after cancellation")
+		}
+		if !errors.Is(it.Err(), context.Canceled) {
+			t.Errorf("Expected context.Canceled, got %v", it.Err())
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+// TestIterator_Seek seeks forward and backward to existing and missing keys
+func TestIterator_Seek(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-iterator-seek-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		engine, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+		defer engine.Close()
+
+		put := func(i int, value string) {
+			if err := engine.Put([]byte(fmt.Sprintf("key-%02d", i)), []byte(value)); err != nil {
+				t.Errorf("Failed to put: %v", err)
+			}
+		}
+		flush := func() {
+			if err := engine.flush(); err != nil {
+				t.Errorf("Failed to flush: %v", err)
+			}
+		}
+
+		// Even keys in one block, multiples of three in another, the rest in memory
+		for i := 0; i < 30; i += 2 {
+			put(i, "even")
+		}
+		flush()
+		for i := 0; i < 30; i += 3 {
+			put(i, "three")
+		}
+		flush()
+		for i := 1; i < 30; i += 6 {
+			put(i, "mem")
+		}
+
+		it, err := engine.NewIterator(context.Background(), IteratorOptions{
+			Start: []byte("key-02"),
+			End:   []byte("key-20"),
+		})
+		if err != nil {
+			t.Errorf("Failed to create iterator: %v", err)
+			done <- true
+			return
+		}
+		defer it.Close()
+
+		// next3 returns the next three keys
+		next3 := func() string {
+			var keys []string
+			for len(keys) < 3 && it.Next() {
+				keys = append(keys, string(it.Key())+"="+string(it.Value()))
+			}
+			return fmt.Sprint(keys)
+		}
+
+		cases := []struct {
+			seek     string
+			expected string
+		}{
+			{"key-12", "[key-12=three key-13=mem key-14=even]"}, // Existing key
+			{"key-05", "[key-06=three key-07=mem key-08=even]"}, // Missing key, backward
+			{"key-15", "[key-15=three key-16=even key-18=three]"},
+			{"key-185", "[key-19=mem]"},                          // Up to the end bound
+			{"key-00", "[key-02=even key-03=three key-04=even]"}, // Clamped to the start bound
+			{"key-99", "[]"}, // Past the end
+			{"key-10", "[key-10=even key-12=three key-13=mem]"}, // Restart after exhaustion
+		}
+		for _, c := range cases {
+			it.Seek([]byte(c.seek))
+			if got := next3(); got != c.expected {
+				t.Errorf("After Seek(%q): expected %s, got %s", c.seek, c.expected, got)
+			}
+		}
+		if err := it.Err(); err != nil {
+			t.Errorf("Iterator failed: %v", err)
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+// TestEngine_ReverseScan compares reverse iteration with the reversed
+// forward iteration over keys in the memory table and several levels
+func TestEngine_ReverseScan(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-reverse-scan-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		engine, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+		defer engine.Close()
+
+		check := func(err error) {
+			if err != nil {
+				t.Errorf("Failed to write: %v", err)
+			}
+		}
+
+		// Oldest data in two L2 blocks
+		for _, keys := range [][2]int{{0, 20}, {20, 40}} {
+			b := block.NewBlock()
+			for i := keys[0]; i < keys[1]; i++ {
+				if err := b.Add([]byte(fmt.Sprintf("key-%02d", i)), []byte("l2")); err != nil {
+					t.Errorf("Failed to add pair: %v", err)
+				}
+			}
+			engine.lsm.mu.Lock()
+			if _, err := engine.lsm.writeBlock(2, b); err != nil {
+				t.Errorf("Failed to write block: %v", err)
+			}
+			engine.lsm.mu.Unlock()
+		}
+
+		// Two L0 blocks with overwrites and deletes, then the memory table
+		for i := 0; i < 40; i += 3 {
+			check(engine.Put([]byte(fmt.Sprintf("key-%02d", i)), []byte("l0")))
+		}
+		check(engine.flush())
+		for i := 0; i < 40; i += 5 {
+			check(engine.Delete([]byte(fmt.Sprintf("key-%02d", i))))
+		}
+		check(engine.flush())
+		for i := 1; i < 45; i += 7 {
+			check(engine.Put([]byte(fmt.Sprintf("key-%02d", i)), []byte("mem")))
+		}
+
+		ranges := [][2][]byte{
+			{nil, nil},
+			{[]byte("key-05"), []byte("key-30")},
+			{[]byte("key-10"), nil},
+			{nil, []byte("key-19")},
+			{[]byte("key-195"), []byte("key-205")},
+		}
+		for _, r := range ranges {
+			forward, err := engine.NewIterator(context.Background(), IteratorOptions{Start: r[0], End: r[1]})
+			if err != nil {
+				t.Errorf("Failed to create iterator: %v", err)
+				continue
+			}
+			expected := collect(t, forward)
+			forward.Close()
+			for i, j := 0, len(expected)-1; i < j; i, j = i+1, j-1 {
+				expected[i], expected[j] = expected[j], expected[i]
+			}
+
+			reverse, err := engine.NewIterator(context.Background(), IteratorOptions{Start: r[0], End: r[1], Reverse: true})
+			if err != nil {
+				t.Errorf("Failed to create iterator: %v", err)
+				continue
+			}
+			got := collect(t, reverse)
+			reverse.Close()
+
+			if fmt.Sprint(got) != fmt.Sprint(expected) {
+				t.Errorf("Range [%s, %s): expected %v, got %v", r[0], r[1], expected, got)
+			}
+		}
+
+		// ReverseScan covers (start, end]
+		it, err := engine.ReverseScan([]byte("key-21"), []byte("key-27"))
+		if err != nil {
+			t.Errorf("Failed to reverse scan: %v", err)
+			done <- true
+			return
+		}
+		got := fmt.Sprint(collect(t, it))
+		it.Close()
+		if expected := "[key-27=l0 key-26=l2 key-24=l0 key-23=l2 key-22=mem]"; got != expected {
+			t.Errorf("Expected %s, got %s", expected, got)
+		}
+
+		// Seek on a reverse iterator moves to the last key <= the target
+		it, err = engine.NewIterator(context.Background(), IteratorOptions{Reverse: true})
+		if err != nil {
+			t.Errorf("Failed to create iterator: %v", err)
+			done <- true
+			return
+		}
+		defer it.Close()
+		it.Seek([]byte("key-255"))
+		if !it.Next() || string(it.Key()) != "key-24" {
+			t.Errorf("Expected key-24 after Seek, got %s (err %v)", it.Key(), it.Err())
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+// TestEngine_ScanNamespace checks a namespace scan stops at the namespace
+// boundary, e.g. a:b doesn't include a:bc
+func TestEngine_ScanNamespace(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-namespace-scan-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		engine, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+		defer engine.Close()
+
+		keys := []string{"a", "a:b", "a:b:1", "a:b:2", "a:b:x:1", "a:bc", "a:bc:1", "a:c:1", "a;b:1", "ab:1", "b:b:1"}
+		for i, key := range keys {
+			if err := engine.Put([]byte(key), []byte(fmt.Sprint(i))); err != nil {
+				t.Errorf("Failed to put: %v", err)
+			}
+			// Spread the keys over the memory table and a block
+			if i == len(keys)/2 {
+				if err := engine.flush(); err != nil {
+					t.Errorf("Failed to flush: %v", err)
+				}
+			}
+		}
+
+		scans := []struct {
+			parts    []string
+			expected string
+		}{
+			{[]string{"a", "b"}, "[a:b:1=2 a:b:2=3 a:b:x:1=4]"},
+			{[]string{"a", "bc"}, "[a:bc:1=6]"},
+			{[]string{"a", "b", "x"}, "[a:b:x:1=4]"},
+			{[]string{"a"}, "[a:b=1 a:b:1=2 a:b:2=3 a:b:x:1=4 a:bc=5 a:bc:1=6 a:c:1=7]"},
+			{[]string{"a", "d"}, "[]"},
+		}
+		for _, scan := range scans {
+			var parts [][]byte
+			for _, part := range scan.parts {
+				parts = append(parts, []byte(part))
+			}
+			it, err := engine.ScanNamespace(parts...)
+			if err != nil {
+				t.Errorf("Failed to scan %v: %v", scan.parts, err)
+				continue
+			}
+			if got := fmt.Sprint(collect(t, it)); got != scan.expected {
+				t.Errorf("Namespace %v: expected %s, got %s", scan.parts, scan.expected, got)
+			}
+			it.Close()
+		}
+
+		// A 0xFF separator has no byte after it; the bound moves to the part
+		engine.opts.KeySeparator = 0xFF
+		if err := engine.Put([]byte("x\xff1"), []byte("ff")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		it, err := engine.ScanNamespace([]byte("x"))
+		if err != nil {
+			t.Errorf("Failed to scan: %v", err)
+		} else {
+			if got := collect(t, it); len(got) != 1 || got[0] != "x\xff1=ff" {
+				t.Errorf("Expected the single key under x, got %q", got)
+			}
+			it.Close()
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+// TestEngine_ScanValues scans the values of a range spread over the memory
+// table and blocks, with overwrites and deletes
+func TestEngine_ScanValues(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-values-scan-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		engine, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+		defer engine.Close()
+
+		check := func(err error) {
+			if err != nil {
+				t.Errorf("Failed to write: %v", err)
+			}
+		}
+		for i := 0; i < 10; i++ {
+			check(engine.Put([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("old-%d", i))))
+		}
+		check(engine.flush())
+		check(engine.Put([]byte("key-3"), []byte("new-3")))
+		check(engine.Delete([]byte("key-5")))
+
+		scans := []struct {
+			start, end []byte
+			expected   string
+		}{
+			{[]byte("key-2"), []byte("key-7"), "[old-2 new-3 old-4 old-6]"},
+			{nil, []byte("key-2"), "[old-0 old-1]"},
+			{[]byte("key-8"), nil, "[old-8 old-9]"},
+			{[]byte("x"), nil, "[]"},
+		}
+		for _, scan := range scans {
+			it, err := engine.ScanValues(scan.start, scan.end)
+			if err != nil {
+				t.Errorf("Failed to scan [%s, %s): %v", scan.start, scan.end, err)
+				continue
+			}
+			var values []string
+			for it.Next() {
+				values = append(values, string(it.Value()))
+			}
+			if err := it.Err(); err != nil {
+				t.Errorf("Iterator failed: %v", err)
+			}
+			if got := fmt.Sprint(values); got != scan.expected {
+				t.Errorf("Scan [%s, %s): expected %s, got %s", scan.start, scan.end, scan.expected, got)
+			}
+			it.Close()
+		}
+
+		if open := engine.GetStats().OpenIterators; open != 0 {
+			t.Errorf("Expected all iterators to be closed, %d still open", open)
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+// TestIterator_PinsBlocksDuringCompaction iterates while compactions keep
+// deleting the blocks the iterator was created over, and checks the
+// iterator still reads them all and they are deleted once it is closed
+func TestIterator_PinsBlocksDuringCompaction(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-iterator-pins-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		opts := DefaultOptions()
+		opts.MaxOpenFiles = 2 // Evicted files have to be reopened
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+		defer engine.Close()
+
+		// writeBlocks flushes one block of keys per round
+		const keysPerBlock = 50
+		writeBlocks := func(rounds int, value string) {
+			for round := 0; round < rounds; round++ {
+				for i := 0; i < keysPerBlock; i++ {
+					key := []byte(fmt.Sprintf("key-%02d-%02d", round, i))
+					if err := engine.Put(key, []byte(value)); err != nil {
+						t.Errorf("Failed to put: %v", err)
+					}
+				}
+				if err := engine.flush(); err != nil {
+					t.Errorf("Failed to flush: %v", err)
+				}
+			}
+		}
+		writeBlocks(8, "v0")
+
+		// Move them into many small L1 blocks, which an iterator reads one
+		// at a time rather than when it is created
+		engine.lsm.mergeMu.Lock()
+		engine.lsm.mu.Lock()
+		engine.lsm.targetBlockSize = 1024
+		engine.lsm.compactLevel(0)
+		engine.lsm.mu.Unlock()
+		engine.lsm.mergeMu.Unlock()
+		if blocks := engine.GetStats().LevelBlocks[1]; blocks < 8 {
+			t.Errorf("Expected at least 8 L1 blocks, got %d", blocks)
+		}
+
+		it, err := engine.NewIterator(context.Background(), IteratorOptions{})
+		if err != nil {
+			t.Errorf("Failed to create iterator: %v", err)
+			done <- true
+			return
+		}
+
+		// Compact over and over while the iterator reads, rewriting every L1
+		// block each time
+		stop := make(chan struct{})
+		compacted := make(chan int)
+		go func() {
+			compactions := 0
+			for {
+				select {
+				case <-stop:
+					compacted <- compactions
+					return
+				default:
+				}
+				for _, key := range []string{"key-00-00", "key-07-49"} {
+					if err := engine.Put([]byte(key), []byte(fmt.Sprintf("v%d", compactions+1))); err != nil {
+						t.Errorf("Failed to put: %v", err)
+					}
+				}
+				if err := engine.flush(); err != nil {
+					t.Errorf("Failed to flush: %v", err)
+				}
+				engine.lsm.mergeMu.Lock()
+				engine.lsm.mu.Lock()
+				engine.lsm.compactLevel(0)
+				engine.lsm.mu.Unlock()
+				engine.lsm.mergeMu.Unlock()
+				compactions++
+			}
+		}()
+
+		count := 0
+		for it.Next() {
+			if string(it.Value()) != "v0" {
+				t.Errorf("Expected the snapshot value v0 for %s, got %s", it.Key(), it.Value())
+			}
+			count++
+			if count%keysPerBlock == 0 {
+				time.Sleep(10 * time.Millisecond) // Let compactions run
+			}
+		}
+		if err := it.Err(); err != nil {
+			t.Errorf("Iterator failed during compaction: %v", err)
+		}
+		close(stop)
+		if compactions := <-compacted; compactions == 0 {
+			t.Errorf("Expected compactions during the iteration")
+		}
+		if count != 8*keysPerBlock {
+			t.Errorf("Expected %d keys, got %d", 8*keysPerBlock, count)
+		}
+
+		// The compacted blocks are deleted once the iterator is released
+		if engine.lsm.pendingDeletes() == 0 {
+			t.Errorf("Expected compacted blocks to wait for the iterator")
+		}
+		it.Close()
+		if pending := engine.lsm.pendingDeletes(); pending != 0 {
+			t.Errorf("Expected no pending deletes after closing the iterator, got %d", pending)
+		}
+		var live int
+		for _, blocks := range engine.Levels() {
+			live += len(blocks.Blocks)
+		}
+		files, _ := filepath.Glob(filepath.Join(tempDir, "data", "L*", "*"))
+		if len(files) != live {
+			t.Errorf("Expected only the %d live block files on disk, got %v", live, files)
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
+
+// TestIterator_ReadAhead scans a level of many blocks reading blocks ahead,
+// and checks every key is returned in order, that no more blocks than
+// configured are read ahead, nor past the End bound, and that closing a
+// scan stopped early waits for the blocks being read
+func TestIterator_ReadAhead(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-iterator-readahead-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	done := make(chan bool)
+	go func() {
+		opts := DefaultOptions()
+		opts.TargetBlockSize = 1024
+		opts.L0CompactionTrigger = 0
+		opts.ScanReadAhead = 3
+		engine, err := NewEngineWithOptions(tempDir, opts)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+		defer engine.Close()
+
+		// About 20 level 1 blocks
+		const numKeys = 200
+		for i := 0; i < numKeys; i++ {
+			if err := engine.Put([]byte(fmt.Sprintf("key-%03d", i)), make([]byte, 90)); err != nil {
+				t.Errorf("Failed to put: %v", err)
+			}
+		}
+		if err := engine.flush(); err != nil {
+			t.Errorf("Failed to flush: %v", err)
+		}
+		if err := engine.CompactRange(0, nil, nil); err != nil {
+			t.Errorf("Failed to compact: %v", err)
+		}
+
+		// level1 returns the source of the level 1 run
+		level1 := func(it *Iterator) *blockSource {
+			for _, src := range it.sources {
+				if bs, ok := src.(*blockSource); ok && len(bs.blocks) > 10 {
+					return bs
+				}
+			}
+			t.Errorf("Expected a level 1 run of many blocks")
+			return &blockSource{}
+		}
+
+		it, err := engine.NewIterator(context.Background(), IteratorOptions{})
+		if err != nil {
+			t.Errorf("Failed to create iterator: %v", err)
+			done <- true
+			return
+		}
+		src := level1(it)
+		count := 0
+		for it.Next() {
+			if expected := fmt.Sprintf("key-%03d", count); string(it.Key()) != expected {
+				t.Errorf("Expected %s, got %s", expected, it.Key())
+			}
+			if n := len(src.prefetched); n > opts.ScanReadAhead {
+				t.Errorf("Expected at most %d blocks read ahead, got %d", opts.ScanReadAhead, n)
+			}
+			count++
+		}
+		if err := it.Err(); err != nil || count != numKeys {
+			t.Errorf("Expected %d keys, got %d (err %v)", numKeys, count, err)
+		}
+		it.Close()
+
+		// Blocks past the End bound are not read ahead
+		it, err = engine.NewIterator(context.Background(), IteratorOptions{End: []byte("key-015")})
+		if err != nil {
+			t.Errorf("Failed to create iterator: %v", err)
+			done <- true
+			return
+		}
+		src = level1(it)
+		for idx := range src.prefetched {
+			if string(src.blocks[idx].minKey) >= "key-015" {
+				t.Errorf("Expected no block past the End bound to be read ahead, got block %d starting at %s", idx, src.blocks[idx].minKey)
+			}
+		}
+
+		// Closing the scan stopped early waits for the blocks read ahead
+		if !it.Next() {
+			t.Errorf("Expected a first key, got error %v", it.Err())
+		}
+		prefetched := src.prefetched
+		it.Close()
+		for idx, p := range prefetched {
+			select {
+			case <-p.done:
+			default:
+				t.Errorf("Expected block %d to be read once the iterator is closed", idx)
+			}
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
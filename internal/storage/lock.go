@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// lockFileName is the file in the base directory the writer locks
+const lockFileName = "LOCK"
+
+// errLockHeld is returned by lockFile when another process (or another
+// engine in this process) holds the lock
+var errLockHeld = errors.New("lock held")
+
+// dirLock is the exclusive lock a writing engine holds on its base
+// directory. The operating system releases it if the process dies.
+type dirLock struct {
+	// Locked file; nil once released
+	file *os.File
+}
+
+// lockDir acquires the exclusive lock on baseDir, failing with ErrLocked
+// without waiting if another writer holds it
+func lockDir(baseDir string) (*dirLock, error) {
+	file, err := os.OpenFile(filepath.Join(baseDir, lockFileName), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	if err := lockFile(file); err != nil {
+		file.Close()
+		if errors.Is(err, errLockHeld) {
+			return nil, fmt.Errorf("%w: %s", ErrLocked, baseDir)
+		}
+		return nil, fmt.Errorf("failed to lock %s: %w", baseDir, err)
+	}
+
+	return &dirLock{file: file}, nil
+}
+
+// release releases the lock. Releasing it again (or a nil lock) does nothing.
+func (l *dirLock) release() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
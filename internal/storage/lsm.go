@@ -1,16 +1,26 @@
 package storage
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/0xReLogic/river/internal/data/block"
 )
 
+// streamEncodeThreshold is the serialized block size above which blocks are
+// streamed to disk instead of being serialized in memory first
+const streamEncodeThreshold = 4 * 1024 * 1024 // 4MB
+
 // LSMTree implements a Log-Structured Merge Tree for efficient storage
 // with level-triggered compaction.
 type LSMTree struct {
@@ -25,6 +35,10 @@ type LSMTree struct {
 	// Mutex to protect concurrent access to the tree
 	mu sync.RWMutex
 
+	// Serializes merges, which release mu while they read and write blocks
+	// (see merge). Taken before mu.
+	mergeMu sync.Mutex
+
 	// Maximum size of each level (exponential growth)
 	// Level 0: 64MB, Level 1: 256MB, Level 2: 1GB, etc.
 	levelMaxSizes [7]int64
@@ -32,6 +46,95 @@ type LSMTree struct {
 	// Compaction thresholds (when to trigger compaction)
 	compactionThresholds [7]int64
 
+	// Number of level 0 blocks that triggers compaction regardless of size.
+	// Level 0 blocks may overlap, so every read has to check all of them.
+	l0CompactionTrigger int
+
+	// Fraction of its compaction threshold leveled compaction brings a level
+	// down to; zero (or 1 and more) brings it just below the threshold
+	compactionLowWatermark float64
+
+	// Kinds of compaction background cycles may run by time of day
+	compactionSchedule CompactionSchedule
+
+	// Levels leveled compaction started compacting and hasn't yet brought
+	// down to their low watermark
+	draining [7]bool
+
+	// Whether to fsync level directories after block files are renamed into them
+	syncDirs bool
+
+	// Whether the tree was opened read-only; blocks cannot be written
+	readOnly bool
+
+	// Block files kept open for reads
+	files *filePool
+
+	// Total bytes of block files written by flushes
+	bytesWritten atomic.Int64
+
+	// Total bytes of block files read and written by compactions
+	compactionBytesRead    atomic.Int64
+	compactionBytesWritten atomic.Int64
+
+	// Size of the serialized pairs at which compaction starts a new output block
+	targetBlockSize int
+
+	// Number of key ranges a large compaction is split into, whose output
+	// blocks are written in parallel; 1 or less writes them serially
+	subCompactions int
+
+	// Average size of the serialized pairs of a block below which a level
+	// is consolidated (see consolidationTasks); zero disables consolidation
+	minAverageBlockSize int
+
+	// Clock of tombstone expiry and compaction schedules; nil for the
+	// system clock
+	clock Clock
+
+	// Compression of the blocks compaction writes to each level, indexed by
+	// level; levels past the end keep the compression of their inputs
+	levelCompression []block.CompressionType
+
+	// Minimum age of a tombstone before compaction into the last level
+	// drops it; zero drops tombstones as soon as they get there
+	tombstoneGracePeriod time.Duration
+
+	// Limit of the bytes read and written by compactions, shared by the
+	// tree and all compaction workers; nil when unlimited
+	compactionLimiter *rateLimiter
+
+	// Limit of the block decodes of point reads in flight; nil when
+	// unlimited
+	readLimiter *readLimiter
+
+	// Index of the blocks by ID, for writing blocks with the contents of an
+	// existing block as references to it; nil when dedup is disabled
+	dedup *dedupIndex
+
+	// Block files read by live iterators, and those to delete once released
+	pins blockPins
+
+	// Compaction strategy, and the planner deciding which blocks compaction
+	// merges next under it
+	strategy CompactionStrategy
+	planner  compactionPlanner
+
+	// Levels 1-6 found with overlapping blocks when the tree was opened,
+	// e.g. written by tiered compaction and reopened with leveled
+	// compaction. They are read as several runs until they are emptied.
+	overlapped [7]bool
+
+	// Max key of the last blocks compacted out of each level; leveled
+	// compaction of the level continues after it
+	compactCursor [7][]byte
+
+	// Receives the compaction events; nil drops them
+	events *eventDispatcher
+
+	// Reports compactions running too long; nil without a threshold
+	watchdog *watchdog
+
 	// Background compaction status
 	compacting     bool
 	compactionChan chan struct{}
@@ -45,23 +148,96 @@ type blockInfo struct {
 	// Size of the block in bytes
 	size int64
 
+	// Size of the block's data before and after compression, from its header
+	rawSize, storedSize int64
+
 	// Min and max keys in the block (for range queries)
 	minKey, maxKey []byte
 
 	// Creation time of the block
 	createdAt time.Time
+
+	// Timestamp in the block's filename. The blocks written by one merge
+	// share it and form a sorted run.
+	run int64
+
+	// Range of the numeric values of the block in the encoding of
+	// NumericStat (empty when minValue > maxValue), known if valueStats is
+	// set (see setValueStats)
+	valueStats         bool
+	minValue, maxValue uint64
+
+	// Sequence number of the block (see block.Block.Sequence)
+	sequence int64
+}
+
+// newBlockInfo returns the blockInfo of the block b stored at path
+func newBlockInfo(path string, size int64, b *block.Block, createdAt time.Time, run int64) blockInfo {
+	return blockInfo{
+		path:       path,
+		size:       size,
+		rawSize:    int64(b.Header.RawSizeBytes),
+		storedSize: int64(b.Header.StoredSizeBytes),
+		minKey:     []byte(b.MinKey()),
+		maxKey:     []byte(b.MaxKey()),
+		createdAt:  createdAt,
+		run:        run,
+		valueStats: b.Header.Flags&block.FlagValueStats != 0,
+		minValue:   b.Stats.Min,
+		maxValue:   b.Stats.Max,
+		sequence:   b.Sequence(),
+	}
+}
+
+// LevelInfo describes the blocks of an LSM tree level
+type LevelInfo struct {
+	// Level number (0-6)
+	Level int `json:"level"`
+
+	// Blocks in the level: oldest first in level 0, by min key in the others
+	Blocks []BlockInfo `json:"blocks"`
+}
+
+// BlockInfo describes a block file
+type BlockInfo struct {
+	// Base name of the block file
+	Name string `json:"name"`
+
+	// Size of the block file in bytes
+	Size int64 `json:"size"`
+
+	// Min and max keys in the block
+	MinKey string `json:"min_key"`
+	MaxKey string `json:"max_key"`
+
+	// Creation time of the block
+	CreatedAt time.Time `json:"created_at"`
 }
 
 // NewLSMTree creates a new LSM tree with the given data directory
 func NewLSMTree(dataDir string) (*LSMTree, error) {
+	return openLSMTree(dataDir, false)
+}
+
+// openLSMTree opens the LSM tree in the given data directory. A read-only
+// tree doesn't create the directory and refuses to write blocks.
+func openLSMTree(dataDir string, readOnly bool) (*LSMTree, error) {
 	// Create data directory if it doesn't exist
-	if err := os.MkdirAll(dataDir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	if !readOnly {
+		if err := os.MkdirAll(dataDir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create data directory: %w", err)
+		}
 	}
 
 	tree := &LSMTree{
-		dataDir:        dataDir,
-		compactionChan: make(chan struct{}, 1),
+		dataDir:             dataDir,
+		l0CompactionTrigger: DefaultOptions().L0CompactionTrigger,
+		syncDirs:            DefaultOptions().SyncDirs,
+		targetBlockSize:     DefaultOptions().TargetBlockSize,
+		readOnly:            readOnly,
+		files:               newFilePool(DefaultOptions().MaxOpenFiles),
+		planner:             leveledPlanner{},
+		compactionChan:      make(chan struct{}, 1),
 	}
 
 	// Initialize level sizes (exponential growth)
@@ -105,144 +281,479 @@ func (t *LSMTree) loadExistingBlocks() error {
 
 		// Process each block file
 		for _, file := range files {
-			if file.IsDir() || filepath.Ext(file.Name()) != ".blk" {
-				continue // Skip directories and non-block files
+			path := filepath.Join(levelDir, file.Name())
+
+			// Finish deleting blocks compacted while iterators read them
+			if filepath.Ext(file.Name()) == deleteMarkerExt {
+				if !t.readOnly {
+					t.removeBlockFile(strings.TrimSuffix(path, deleteMarkerExt))
+				}
+				continue
 			}
 
-			path := filepath.Join(levelDir, file.Name())
-			info, err := file.Info()
-			if err != nil {
-				return fmt.Errorf("failed to get file info for %s: %w", path, err)
+			// Remove blocks a crash left half written; they were never
+			// added to a level
+			if strings.HasSuffix(file.Name(), ".blk.tmp") {
+				if !t.readOnly {
+					os.Remove(path)
+				}
+				continue
 			}
 
-			// Read block header to get min/max keys
-			f, err := os.Open(path)
+			if file.IsDir() || filepath.Ext(file.Name()) != ".blk" {
+				continue // Skip directories and non-block files
+			}
+			if _, err := os.Stat(path + deleteMarkerExt); err == nil {
+				continue // Marked for deletion
+			}
+			info, err := readBlockInfo(path)
 			if err != nil {
-				return fmt.Errorf("failed to open block file %s: %w", path, err)
+				if t.readOnly && errors.Is(err, os.ErrNotExist) {
+					continue // Removed by the writer since listed
+				}
+				return err
 			}
 
-			// TODO: Implement proper block header reading
-			// For now, use placeholder min/max keys
-			minKey := []byte(file.Name())
-			maxKey := []byte(file.Name())
-
-			f.Close()
-
 			// Add block info to the appropriate level
-			t.levels[level] = append(t.levels[level], blockInfo{
-				path:      path,
-				size:      info.Size(),
-				minKey:    minKey,
-				maxKey:    maxKey,
-				createdAt: info.ModTime(),
-			})
+			t.levels[level] = append(t.levels[level], info)
 		}
 
-		// Sort blocks by min key for faster lookups
-		sort.Slice(t.levels[level], func(i, j int) bool {
-			return string(t.levels[level][i].minKey) < string(t.levels[level][j].minKey)
-		})
+		// Restore the level's ordering (creation order for L0, min key otherwise)
+		t.sortLevel(level)
+
+		// Overlapping blocks can only be read as several runs
+		if level > 0 && runOverlap(level, t.levels[level]) != nil {
+			t.overlapped[level] = true
+			t.sortLevel(level)
+		}
 	}
 
 	return nil
 }
 
+// reload rescans the level directories of a read-only tree, picking up the
+// blocks its directory's writer wrote and dropping those it removed since
+// the tree was opened. The levels are left as they were on failure.
+func (t *LSMTree) reload() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	levels, overlapped := t.levels, t.overlapped
+	t.levels, t.overlapped = [7][]blockInfo{}, [7]bool{}
+	if err := t.loadExistingBlocks(); err != nil {
+		t.levels, t.overlapped = levels, overlapped
+		return err
+	}
+	return nil
+}
+
+// readBlockInfo reads the metadata of the block file at path from the file
+// and its header
+func readBlockInfo(path string) (blockInfo, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return blockInfo{}, fmt.Errorf("failed to get file info for %s: %w", path, err)
+	}
+
+	// Read block header to get min/max keys
+	f, err := os.Open(path)
+	if err != nil {
+		return blockInfo{}, fmt.Errorf("failed to open block file %s: %w", path, err)
+	}
+
+	b := block.NewBlock()
+	err = b.DecodeHeader(bufio.NewReader(f))
+	f.Close()
+	if err != nil {
+		return blockInfo{}, fmt.Errorf("failed to read block header %s: %w", path, err)
+	}
+
+	return newBlockInfo(path, info.Size(), b, info.ModTime(), blockTimestamp(path)), nil
+}
+
 // Write adds a new block to the LSM tree (level 0)
 func (t *LSMTree) Write(b *block.Block) error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
-	// Create level 0 directory if it doesn't exist
-	level0Dir := filepath.Join(t.dataDir, "L0")
-	if err := os.MkdirAll(level0Dir, 0755); err != nil {
-		return fmt.Errorf("failed to create L0 directory: %w", err)
+	info, err := t.writeBlock(0, b)
+	if err != nil {
+		return err
+	}
+	t.bytesWritten.Add(info.size)
+
+	// Check if level 0 needs compaction
+	if t.shouldCompact(0) {
+		// Trigger background compaction
+		t.triggerCompaction()
+	}
+
+	return nil
+}
+
+// writeBlock writes a block file into the given level and adds it to the
+// level's block list. Callers must hold t.mu.
+func (t *LSMTree) writeBlock(level int, b *block.Block) (blockInfo, error) {
+	return t.writeBlockAt(level, b, time.Now())
+}
+
+// writeBlockAt is writeBlock with the creation time encoded in the
+// filename, which the blocks of a run share. Callers must hold t.mu.
+func (t *LSMTree) writeBlockAt(level int, b *block.Block, createdAt time.Time) (blockInfo, error) {
+	path, err := t.writeBlockFile(level, b, createdAt)
+	if err != nil {
+		return blockInfo{}, err
+	}
+	return t.addBlock(level, path, b, createdAt)
+}
+
+// writeBlockFile writes a block to a new file of a level, without adding
+// it to the level (see addBlock), and returns its path. It can be called
+// concurrently for different blocks.
+func (t *LSMTree) writeBlockFile(level int, b *block.Block, createdAt time.Time) (string, error) {
+	if t.readOnly {
+		return "", ErrReadOnly
+	}
+
+	// Create level directory if it doesn't exist
+	levelDir := filepath.Join(t.dataDir, fmt.Sprintf("L%d", level))
+	if err := os.MkdirAll(levelDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create L%d directory: %w", level, err)
 	}
 
-	// Generate a unique filename based on timestamp and block ID
-	filename := fmt.Sprintf("%d_%s.blk", time.Now().UnixNano(), b.ID())
-	path := filepath.Join(level0Dir, filename)
+	setValueStats(b)
 
-	// Create the block file
-	f, err := os.Create(path)
+	// Compute the header (and block ID) before naming the file. Large
+	// uncompressed blocks are streamed to the file rather than serialized
+	// in memory first.
+	stream := b.Header.CompressionType == block.CompressionNone && b.DataSize() >= streamEncodeThreshold
+	if stream {
+		if err := b.FinalizeHeader(); err != nil {
+			return "", fmt.Errorf("failed to finalize block header: %w", err)
+		}
+	} else {
+		if err := b.Finalize(); err != nil {
+			return "", fmt.Errorf("failed to finalize block: %w", err)
+		}
+	}
+
+	// Generate a unique filename based on timestamp and block ID.
+	// The timestamp prefix orders level 0 blocks from oldest to newest.
+	filename := fmt.Sprintf("%d_%s.blk", createdAt.UnixNano(), b.ID())
+	path := filepath.Join(levelDir, filename)
+
+	// Reference an existing block with the same contents instead of writing
+	// it again. Without hard link support the block is written as usual.
+	// The link shares the preamble of the existing file, so its sequence
+	// number is raised to the block's first.
+	if src := t.dedup.lookup(b.ID()); src != "" {
+		if err := block.RaiseSequence(src, b.Sequence()); err == nil {
+			if err := os.Link(src, path); err == nil {
+				return path, nil
+			}
+		}
+	}
+
+	// Write to a temporary file first so a crash never leaves a partial block
+	tempPath := path + ".tmp"
+	f, err := os.Create(tempPath)
 	if err != nil {
-		return fmt.Errorf("failed to create block file: %w", err)
+		return "", fmt.Errorf("failed to create block file: %w", err)
 	}
-	defer f.Close()
+
+	// Don't leave a partial temporary file behind on failure (e.g. a full disk)
+	renamed := false
+	defer func() {
+		f.Close()
+		if !renamed {
+			os.Remove(tempPath)
+		}
+	}()
 
 	// Write the block to the file
-	if err := b.Encode(f); err != nil {
-		return fmt.Errorf("failed to encode block to file: %w", err)
+	w := bufio.NewWriter(f)
+	if stream {
+		err = b.EncodeStream(w)
+	} else {
+		err = b.Encode(w)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to encode block to file: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		return "", fmt.Errorf("failed to write block file: %w", err)
+	}
+
+	// Sync to disk and close the file before renaming
+	if err := f.Sync(); err != nil {
+		return "", fmt.Errorf("failed to sync block file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return "", fmt.Errorf("failed to close block file: %w", err)
+	}
+
+	// Rename temporary file to block file (atomic operation)
+	if err := os.Rename(tempPath, path); err != nil {
+		return "", fmt.Errorf("failed to rename block file: %w", err)
+	}
+	renamed = true
+
+	return path, nil
+}
+
+// addBlock adds the block file just created at path, written from b or
+// linked to an existing file, to the level and to the dedup index. Callers
+// must hold t.mu.
+func (t *LSMTree) addBlock(level int, path string, b *block.Block, createdAt time.Time) (blockInfo, error) {
+	// Make the rename (or link) itself durable
+	if t.syncDirs {
+		if err := fsyncDir(filepath.Dir(path)); err != nil {
+			return blockInfo{}, fmt.Errorf("failed to sync L%d directory: %w", level, err)
+		}
 	}
 
 	// Get file size
-	info, err := f.Stat()
+	info, err := os.Stat(path)
 	if err != nil {
-		return fmt.Errorf("failed to get file info: %w", err)
+		return blockInfo{}, fmt.Errorf("failed to get file info: %w", err)
 	}
+	t.dedup.add(b.ID(), path)
 
-	// Add block info to level 0
-	t.levels[0] = append(t.levels[0], blockInfo{
-		path:      path,
-		size:      info.Size(),
-		minKey:    []byte(b.MinKey()),
-		maxKey:    []byte(b.MaxKey()),
-		createdAt: time.Now(),
-	})
+	// Add block info to the level
+	bi := newBlockInfo(path, info.Size(), b, createdAt, createdAt.UnixNano())
+	t.levels[level] = append(t.levels[level], bi)
+	t.sortLevel(level)
 
-	// Check if level 0 needs compaction
-	if t.shouldCompact(0) {
-		// Trigger background compaction
-		t.triggerCompaction()
+	return bi, nil
+}
+
+// enableDedup turns on block dedup, loading or rebuilding the dedup index
+func (t *LSMTree) enableDedup() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	dedup, err := openDedupIndex(t.dataDir, t.levels)
+	if err != nil {
+		return err
 	}
+	t.dedup = dedup
 
 	return nil
 }
 
-// Read reads data from the LSM tree, searching through all levels
+// sortLevel restores the ordering invariant of a level. Callers must hold t.mu.
+//
+// Level 0 blocks may overlap, so they are kept from oldest to newest and Read
+// scans them newest first: a newer version of a key always shadows an older one.
+// Levels holding several runs (see multiRun) are kept the same way, run by
+// run, with the blocks of a run sorted by min key. Blocks in the other
+// levels don't overlap and are kept sorted by min key for binary search.
+func (t *LSMTree) sortLevel(level int) {
+	blocks := t.levels[level]
+	if t.multiRun(level) {
+		sort.SliceStable(blocks, func(i, j int) bool {
+			if blocks[i].run != blocks[j].run {
+				return blocks[i].run < blocks[j].run
+			}
+			return string(blocks[i].minKey) < string(blocks[j].minKey)
+		})
+		return
+	}
+
+	sort.Slice(blocks, func(i, j int) bool {
+		return string(blocks[i].minKey) < string(blocks[j].minKey)
+	})
+}
+
+// multiRun reports whether a level may hold several sorted runs whose
+// blocks overlap each other: level 0, whose blocks are each a run, levels
+// 1-5 under tiered compaction, and levels found overlapping on open. The
+// last level is always a single run. Callers must hold t.mu.
+func (t *LSMTree) multiRun(level int) bool {
+	return level == 0 || t.overlapped[level] || (t.strategy == CompactionTiered && level < 6)
+}
+
+// runStart returns the index of the first block of the run ending just
+// before index end of a level. Callers must hold t.mu.
+func (t *LSMTree) runStart(level, end int) int {
+	switch {
+	case !t.multiRun(level):
+		return 0
+	case level == 0:
+		return end - 1
+	}
+
+	blocks := t.levels[level]
+	start := end - 1
+	for start > 0 && blocks[start-1].run == blocks[start].run {
+		start--
+	}
+	return start
+}
+
+// maxSequence returns the highest sequence number of the blocks of the tree
+func (t *LSMTree) maxSequence() int64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var seq int64
+	for _, blocks := range t.levels {
+		for _, info := range blocks {
+			seq = max(seq, info.sequence)
+		}
+	}
+	return seq
+}
+
+// levelRuns returns the sorted runs of a level from oldest to newest, each
+// in min key order. Callers must hold t.mu.
+func (t *LSMTree) levelRuns(level int) [][]blockInfo {
+	var runs [][]blockInfo
+	blocks := t.levels[level]
+	for end := len(blocks); end > 0; {
+		start := t.runStart(level, end)
+		runs = append(runs, blocks[start:end])
+		end = start
+	}
+	slices.Reverse(runs)
+	return runs
+}
+
+// setCompactionStrategy selects the compaction strategy, reordering the
+// levels whose layout depends on it. Callers must hold t.mu, or own t
+// exclusively.
+func (t *LSMTree) setCompactionStrategy(strategy CompactionStrategy) {
+	t.strategy = strategy
+	t.planner = newCompactionPlanner(strategy)
+	for level := range t.levels {
+		t.sortLevel(level)
+	}
+}
+
+// blockTimestamp returns the creation timestamp encoded at the start of a block filename
+func blockTimestamp(path string) int64 {
+	var timestamp int64
+	fmt.Sscanf(filepath.Base(path), "%d", &timestamp)
+	return timestamp
+}
+
+// Levels returns a description of every level and its blocks
+func (t *LSMTree) Levels() []LevelInfo {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	levels := make([]LevelInfo, len(t.levels))
+	for level, blocks := range t.levels {
+		levels[level] = LevelInfo{
+			Level:  level,
+			Blocks: make([]BlockInfo, 0, len(blocks)),
+		}
+		for _, b := range blocks {
+			levels[level].Blocks = append(levels[level].Blocks, BlockInfo{
+				Name:      filepath.Base(b.path),
+				Size:      b.size,
+				MinKey:    string(b.minKey),
+				MaxKey:    string(b.maxKey),
+				CreatedAt: b.createdAt,
+			})
+		}
+	}
+
+	return levels
+}
+
+// Read reads data from the LSM tree, searching through all levels.
+// It returns ErrKeyNotFound if the key is absent or its newest version is
+// a tombstone; any other error indicates a real failure reading a block.
 func (t *LSMTree) Read(key []byte) ([]byte, error) {
+	value, _, _, err := t.read(context.Background(), key)
+	return value, err
+}
+
+// read is Read that also returns the sequence number of the block the
+// value was found in and the number of blocks it read. It gives up with
+// ctx's error once ctx is done while waiting to decode a block (see
+// readLimiter).
+func (t *LSMTree) read(ctx context.Context, key []byte) ([]byte, int64, int, error) {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
 
+	blocksRead := 0
+
 	// Search from newest to oldest (level 0 to 6)
 	for level := 0; level < 7; level++ {
-		// For level 0, we need to check all blocks (they may overlap)
-		if level == 0 {
-			// Search in reverse order (newest first)
-			for i := len(t.levels[0]) - 1; i >= 0; i-- {
-				block := t.levels[0][i]
-				if t.keyInRange(key, block.minKey, block.maxKey) {
-					value, err := t.readFromBlock(block.path, key)
-					if err == nil {
-						return value, nil
-					}
-					// If not found in this block, continue to the next one
-				}
-			}
-		} else {
-			// For levels 1-6, blocks don't overlap, so we can do binary search
-			idx := t.findBlockIndex(level, key)
-			if idx >= 0 {
-				block := t.levels[level][idx]
-				value, err := t.readFromBlock(block.path, key)
-				if err == nil {
-					return value, nil
-				}
-			}
+		done, value, seq, n, err := t.readLevel(ctx, level, key)
+		blocksRead += n
+		if done {
+			return value, seq, blocksRead, err
 		}
 	}
 
-	return nil, fmt.Errorf("key not found")
+	return nil, 0, blocksRead, ErrKeyNotFound
 }
 
-// keyInRange checks if a key is within the given range (inclusive)
-func (t *LSMTree) keyInRange(key, minKey, maxKey []byte) bool {
-	return string(key) >= string(minKey) && string(key) <= string(maxKey)
+// ReadLevel reads the newest version of key held by a single level,
+// ignoring every other level. It returns ErrKeyNotFound if the level's
+// blocks don't contain the key or its newest version there is a tombstone.
+func (t *LSMTree) ReadLevel(key []byte, level int) ([]byte, error) {
+	if level < 0 || level >= len(t.levels) {
+		return nil, fmt.Errorf("invalid level %d: must be 0-%d", level, len(t.levels)-1)
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if done, value, _, _, err := t.readLevel(context.Background(), level, key); done {
+		return value, err
+	}
+	return nil, ErrKeyNotFound
 }
 
-// findBlockIndex uses binary search to find the block that may contain the key
-func (t *LSMTree) findBlockIndex(level int, key []byte) int {
+// readLevel searches a level for key, reporting like blockResult whether
+// the search should stop, the sequence number of the block it stopped at,
+// and the number of blocks it read. Callers must hold t.mu.
+func (t *LSMTree) readLevel(ctx context.Context, level int, key []byte) (bool, []byte, int64, int, error) {
+	blocksRead := 0
+
+	// Search the runs of the level newest first. The blocks of a run
+	// don't overlap, so we can do binary search; in level 0 every block
+	// is a run of its own.
 	blocks := t.levels[level]
+	for end := len(blocks); end > 0; {
+		start := t.runStart(level, end)
+		if idx := findBlockIndex(blocks[start:end], key); idx >= 0 {
+			blocksRead++
+			value, err := t.readFromBlock(ctx, blocks[start+idx].path, key)
+			if done, value, err := blockResult(value, err); done {
+				return true, value, blocks[start+idx].sequence, blocksRead, err
+			}
+			// If not found in this run, continue to the next one
+		}
+		end = start
+	}
 
+	return false, nil, 0, blocksRead, nil
+}
+
+// blockResult interprets the result of a block lookup, reporting whether
+// the search should stop. A tombstone stops the search with ErrKeyNotFound,
+// a missing key lets it continue to older blocks, and any other error is returned.
+func blockResult(value []byte, err error) (bool, []byte, error) {
+	switch {
+	case err == nil:
+		return true, value, nil
+	case errors.Is(err, block.ErrKeyDeleted):
+		return true, nil, ErrKeyNotFound
+	case errors.Is(err, ErrKeyNotFound):
+		return false, nil, nil
+	default:
+		return true, nil, err
+	}
+}
+
+// findBlockIndex uses binary search to find the block of a sorted run that
+// may contain the key
+func findBlockIndex(blocks []blockInfo, key []byte) int {
 	// Binary search for the block
 	left, right := 0, len(blocks)-1
 	for left <= right {
@@ -259,8 +770,24 @@ func (t *LSMTree) findBlockIndex(level int, key []byte) int {
 	return -1 // Key not found in any block
 }
 
-// readFromBlock reads a value from a block file given a key
-func (t *LSMTree) readFromBlock(path string, key []byte) ([]byte, error) {
+// readFromBlock reads a value from a block file given a key, once the read
+// limiter lets it decode the block
+func (t *LSMTree) readFromBlock(ctx context.Context, path string, key []byte) ([]byte, error) {
+	if err := t.readLimiter.acquire(ctx); err != nil {
+		return nil, err
+	}
+	b, err := t.files.loadBlock(path)
+	t.readLimiter.release()
+	if err != nil {
+		return nil, err
+	}
+
+	// Get the value for the key
+	return b.Get(key)
+}
+
+// loadBlock opens and decodes the block file at path
+func loadBlock(path string) (*block.Block, error) {
 	// Open the block file
 	f, err := os.Open(path)
 	if err != nil {
@@ -276,19 +803,61 @@ func (t *LSMTree) readFromBlock(path string, key []byte) ([]byte, error) {
 		return nil, fmt.Errorf("failed to decode block: %w", err)
 	}
 
-	// Get the value for the key
-	return b.Get(key)
+	return b, nil
 }
 
 // shouldCompact checks if a level needs compaction
 func (t *LSMTree) shouldCompact(level int) bool {
-	// Calculate total size of blocks in this level
-	var totalSize int64
+	return t.compactionScore(level) >= 1
+}
+
+// compactionScore measures how urgently a level needs compaction: the
+// level's size relative to its compaction threshold. Level 0 blocks may
+// overlap, so its score is also at least its block count relative to the
+// L0 compaction trigger. A score of 1 or more means the level needs
+// compaction. Callers must hold t.mu.
+func (t *LSMTree) compactionScore(level int) float64 {
+	score := float64(t.levelSize(level)) / float64(t.compactionThresholds[level])
+
+	// Level 0 also compacts once it holds too many (possibly overlapping) blocks
+	if level == 0 && t.l0CompactionTrigger > 0 {
+		score = max(score, float64(len(t.levels[0]))/float64(t.l0CompactionTrigger))
+	}
+
+	return score
+}
+
+// levelSize returns the total size of the blocks of a level. Callers must
+// hold t.mu.
+func (t *LSMTree) levelSize(level int) int64 {
+	var size int64
 	for _, block := range t.levels[level] {
-		totalSize += block.size
+		size += block.size
 	}
+	return size
+}
 
-	return totalSize >= t.compactionThresholds[level]
+// lowWatermark returns the size leveled compaction brings a level down to
+// once the level crossed its compaction threshold. Callers must hold t.mu.
+func (t *LSMTree) lowWatermark(level int) int64 {
+	threshold := t.compactionThresholds[level]
+	if t.compactionLowWatermark <= 0 || t.compactionLowWatermark >= 1 {
+		return threshold
+	}
+	// At least a byte, so an empty level is never left to compact
+	return max(int64(float64(threshold)*t.compactionLowWatermark), 1)
+}
+
+// CompactionScores returns the compaction score of each level
+func (t *LSMTree) CompactionScores() [7]float64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var scores [7]float64
+	for level := range scores {
+		scores[level] = t.compactionScore(level)
+	}
+	return scores
 }
 
 // triggerCompaction triggers a background compaction if not already running
@@ -321,56 +890,488 @@ func (t *LSMTree) StartCompactionWorker() {
 
 // runCompaction performs the actual compaction process
 func (t *LSMTree) runCompaction() {
+	t.mergeMu.Lock()
+	defer t.mergeMu.Unlock()
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
-	// Start from level 0 and work down
-	for level := 0; level < 6; level++ {
-		if !t.shouldCompact(level) {
-			continue // This level doesn't need compaction
+	// Run the most urgent task until none is left. Each task moves blocks
+	// down a level or merges several blocks of a level into one, so this
+	// terminates.
+	for tasks := t.scheduledTasks(t.planner.plan(t)); len(tasks) > 0; tasks = t.scheduledTasks(t.planner.plan(t)) {
+		task := tasks[0]
+		if err := t.runTask(task); err != nil {
+			fmt.Printf("Failed to compact L%d into L%d: %v\n", task.sourceLevel, task.targetLevel, err)
+			return
 		}
+	}
+}
+
+// runTask performs a compaction task planned by t.planner. Blocks of the
+// source level overlapping the task's blocks are merged with them (see
+// overlappingBlocks). Callers must hold t.mergeMu and t.mu.
+func (t *LSMTree) runTask(task compactionTask) error {
+	// Consolidating blocks within their level leaves its compaction cursor
+	// and draining state alone
+	if task.consolidation() {
+		return t.merge(task.blocks, task.targetLevel, false)
+	}
+
+	var err error
+	blocks := task.blocks
+	if task.newRun {
+		err = t.mergeRun(blocks, task.targetLevel)
+	} else {
+		blocks = t.overlappingBlocks(task.sourceLevel, blocks)
+		err = t.mergeBlocks(blocks, task.targetLevel)
+	}
+	if err != nil {
+		return err
+	}
 
-		// Compact this level into the next level
-		t.compactLevel(level)
+	// Leveled compaction of the level continues after the blocks moved,
+	// until the level is below its low watermark
+	for _, info := range blocks {
+		if string(info.maxKey) > string(t.compactCursor[task.sourceLevel]) {
+			t.compactCursor[task.sourceLevel] = info.maxKey
+		}
 	}
+	if t.strategy == CompactionLeveled {
+		t.draining[task.sourceLevel] = t.levelSize(task.sourceLevel) >= t.lowWatermark(task.sourceLevel)
+	}
+
+	return nil
 }
 
-// compactLevel compacts a level into the next level
+// compactLevel compacts a level into the next level: its blocks are merged
+// with the overlapping blocks of the next level. Callers must hold
+// t.mergeMu and t.mu.
 func (t *LSMTree) compactLevel(level int) {
-	// TODO: Implement proper compaction
-	// For now, just move all blocks to the next level
 	nextLevel := level + 1
-	nextLevelDir := filepath.Join(t.dataDir, fmt.Sprintf("L%d", nextLevel))
-
-	// Create next level directory if it doesn't exist
-	if err := os.MkdirAll(nextLevelDir, 0755); err != nil {
-		fmt.Printf("Failed to create L%d directory: %v\n", nextLevel, err)
+	if err := t.mergeBlocks(t.levels[level], nextLevel); err != nil {
+		fmt.Printf("Failed to compact L%d into L%d: %v\n", level, nextLevel, err)
 		return
 	}
 
-	// Move all blocks from current level to next level
-	for _, block := range t.levels[level] {
-		// Generate a new filename for the next level
-		newPath := filepath.Join(nextLevelDir, filepath.Base(block.path))
+	// Check if the next level now needs compaction
+	if nextLevel < 6 && t.shouldCompact(nextLevel) {
+		t.compactLevel(nextLevel)
+	}
+}
+
+// CompactRange compacts the blocks of level overlapping [start, end] into
+// the next level, merging them with the overlapping blocks there. A nil
+// start or end leaves that side unbounded. The blocks of level 0 (and of
+// levels holding several runs) may overlap each other, so the blocks
+// overlapping the selected ones are compacted with them: otherwise an older
+// version of a key could stay in the level and shadow the newer one moved
+// down.
+func (t *LSMTree) CompactRange(level int, start, end []byte) error {
+	if level < 0 || level >= 6 {
+		return fmt.Errorf("invalid compaction level %d: must be 0-5", level)
+	}
+	if t.readOnly {
+		return ErrReadOnly
+	}
+
+	t.mergeMu.Lock()
+	defer t.mergeMu.Unlock()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	selected := t.overlappingBlocks(level, t.blocksInRange(level, start, end))
+	return t.mergeBlocks(selected, level+1)
+}
+
+// overlappingBlocks returns blocks together with the blocks of level whose
+// key ranges overlap theirs, transitively, in the level's order. In level 0
+// (or a level holding several runs) blocks may overlap each other, and
+// moving a key's newer version into the next level without its older ones
+// would let those shadow it; in other levels blocks is returned as is.
+// Callers must hold t.mu.
+func (t *LSMTree) overlappingBlocks(level int, blocks []blockInfo) []blockInfo {
+	if !t.multiRun(level) || len(blocks) == 0 {
+		return blocks
+	}
+
+	// Widen the range to the selected blocks until no more join
+	var start, end []byte
+	selected := blocks
+	for {
+		for _, info := range selected {
+			if start == nil || string(info.minKey) < string(start) {
+				start = info.minKey
+			}
+			if end == nil || string(info.maxKey) > string(end) {
+				end = info.maxKey
+			}
+		}
+		widened := t.blocksInRange(level, start, end)
+		if len(widened) == len(selected) {
+			return widened
+		}
+		selected = widened
+	}
+}
 
-		// Move the file
-		if err := os.Rename(block.path, newPath); err != nil {
-			fmt.Printf("Failed to move block from L%d to L%d: %v\n", level, nextLevel, err)
+// blocksInRange returns the blocks of level overlapping [start, end], in
+// the level's order. Callers must hold t.mu.
+func (t *LSMTree) blocksInRange(level int, start, end []byte) []blockInfo {
+	var blocks []blockInfo
+	for _, info := range t.levels[level] {
+		if start != nil && string(info.maxKey) < string(start) {
 			continue
 		}
+		if end != nil && string(info.minKey) > string(end) {
+			continue
+		}
+		blocks = append(blocks, info)
+	}
+	return blocks
+}
+
+// mergeBlocks merges blocks into targetLevel, together with the blocks of
+// targetLevel whose key ranges overlap theirs, and removes the inputs from
+// their levels and from disk. The blocks are newer than the target level,
+// and ordered like their level (oldest first in level 0). On a key present
+// in several inputs the newest version wins. Tombstones are dropped in the
+// last level, which has no older data to shadow, once they are older than
+// the tombstone grace period.
+//
+// The merged pairs are written in key order as blocks of about
+// targetBlockSize bytes, so the output blocks have non-overlapping ranges
+// computed from their contents. They form a new run of the target level.
+// Callers must hold t.mergeMu and t.mu, which the merge releases while it
+// reads and writes blocks (see merge).
+func (t *LSMTree) mergeBlocks(blocks []blockInfo, targetLevel int) error {
+	return t.merge(blocks, targetLevel, true)
+}
 
-		// Update the block info
-		block.path = newPath
-		t.levels[nextLevel] = append(t.levels[nextLevel], block)
+// mergeRun merges blocks into a new run of targetLevel like mergeBlocks,
+// but leaves the blocks already in targetLevel alone, so the new run may
+// overlap them. The target level must hold several runs (see multiRun).
+// Callers must hold t.mergeMu and t.mu.
+func (t *LSMTree) mergeRun(blocks []blockInfo, targetLevel int) error {
+	if !t.multiRun(targetLevel) {
+		return fmt.Errorf("L%d holds a single run", targetLevel)
 	}
+	return t.merge(blocks, targetLevel, false)
+}
 
-	// Clear the current level
-	t.levels[level] = nil
+// merge implements mergeBlocks and mergeRun, merging the blocks of the
+// target level that overlap the inputs when withTarget is set. Blocks
+// already in the target level are consolidated: they are replaced by the
+// outputs like the blocks of any other level.
+//
+// Callers must hold t.mergeMu and t.mu. The merge releases t.mu while it
+// reads the inputs and writes the outputs, which the compaction rate limit
+// may stretch, so reads and flushes go on meanwhile; t.mergeMu keeps other
+// merges out, so only flushes and imports add blocks, to level 0, until
+// the outputs replace the inputs.
+func (t *LSMTree) merge(blocks []blockInfo, targetLevel int, withTarget bool) (err error) {
+	if len(blocks) == 0 {
+		return nil
+	}
+	defer t.watchdog.track(fmt.Sprintf("compaction into L%d", targetLevel))()
 
-	// Check if the next level now needs compaction
-	if t.shouldCompact(nextLevel) {
-		t.compactLevel(nextLevel)
+	// Level the blocks come from: the target level itself when consolidating
+	sourceLevel := targetLevel - 1
+	moved := make(map[string]bool, len(blocks))
+	for _, info := range blocks {
+		moved[info.path] = true
+	}
+	for _, info := range t.levels[targetLevel] {
+		if moved[info.path] {
+			sourceLevel = targetLevel
+			break
+		}
+	}
+
+	start := time.Now()
+	written := t.compactionBytesWritten.Load()
+	t.events.emit(Event{
+		Type:        EventCompactionStarted,
+		Level:       sourceLevel,
+		TargetLevel: targetLevel,
+		Blocks:      len(blocks),
+	})
+	defer func() {
+		t.events.emit(Event{
+			Type:        EventCompactionFinished,
+			Level:       sourceLevel,
+			TargetLevel: targetLevel,
+			Blocks:      len(blocks),
+			Bytes:       t.compactionBytesWritten.Load() - written,
+			Duration:    time.Since(start),
+			Err:         err,
+		})
+	}()
+
+	// Key range of the blocks, and the target blocks overlapping it
+	minKey, maxKey := blocks[0].minKey, blocks[0].maxKey
+	for _, info := range blocks[1:] {
+		if string(info.minKey) < string(minKey) {
+			minKey = info.minKey
+		}
+		if string(info.maxKey) > string(maxKey) {
+			maxKey = info.maxKey
+		}
+	}
+	var overlapping []blockInfo
+	for _, info := range t.levels[targetLevel] {
+		if moved[info.path] || !withTarget {
+			continue
+		}
+		if string(info.maxKey) >= string(minKey) && string(info.minKey) <= string(maxKey) {
+			overlapping = append(overlapping, info)
+		}
+	}
+
+	// The outputs are older than the blocks flushed while the merge runs
+	createdAt := time.Now()
+
+	// Let reads and flushes in until the outputs are written
+	t.mu.Unlock()
+	relocked := false
+	defer func() {
+		if !relocked {
+			t.mu.Lock()
+		}
+	}()
+
+	// Read the inputs from oldest to newest, newer versions replacing older
+	inputs := append(overlapping, blocks...)
+	entries := make(map[string][]byte)
+	deletedAt := make(map[string]int64)
+	var header block.Header
+	for _, info := range inputs {
+		t.compactionLimiter.wait(info.size)
+		b, err := t.files.loadBlock(info.path)
+		if err != nil {
+			return fmt.Errorf("failed to read block %s: %w", info.path, err)
+		}
+		for i := 0; i < b.Count(); i++ {
+			key, value := b.Pair(i)
+			entries[string(key)] = value
+			if value == nil {
+				deletedAt[string(key)] = b.DeletedAt(i)
+			} else {
+				delete(deletedAt, string(key))
+			}
+		}
+		t.compactionBytesRead.Add(info.size)
+		header = b.Header // Output blocks keep the format of the newest input
+	}
+
+	// Output blocks are recompressed for the target level
+	if targetLevel < len(t.levelCompression) {
+		header.CompressionType = t.levelCompression[targetLevel]
+	}
+
+	// Tombstones kept for the grace period keep their creation time
+	if t.tombstoneGracePeriod > 0 {
+		header.Flags |= block.FlagTombstoneTimes
+	}
+	expired := clockNow(t.clock).Add(-t.tombstoneGracePeriod).UnixNano()
+
+	keys := make([]string, 0, len(entries))
+	for key, value := range entries {
+		if value == nil && targetLevel == 6 && deletedAt[key] <= expired {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// Write the merged pairs as blocks sharing the creation time that makes
+	// them a run. A large merge is split into sub-compactions of disjoint
+	// key ranges, which write their blocks in parallel.
+	out := subCompactionOutput{entries: entries, deletedAt: deletedAt, header: header, level: targetLevel, createdAt: createdAt}
+	for _, info := range inputs {
+		out.sequence = max(out.sequence, info.sequence)
+	}
+	ranges := t.subCompactionRanges(keys, entries)
+	results := make([][]writtenBlock, len(ranges))
+	errs := make([]error, len(ranges))
+	var wg sync.WaitGroup
+	for i, keys := range ranges {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = t.subCompaction(keys, out)
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		for _, result := range results {
+			for _, w := range result {
+				os.Remove(w.path)
+			}
+		}
+		return err
+	}
+
+	t.mu.Lock()
+	relocked = true
+
+	// Add the outputs to the target level in key order
+	var outputs []blockInfo
+	for _, result := range results {
+		for _, w := range result {
+			info, err := t.addBlock(targetLevel, w.path, w.block, createdAt)
+			if err != nil {
+				return err
+			}
+			outputs = append(outputs, info)
+			t.compactionBytesWritten.Add(info.size)
+		}
+	}
+
+	// Replace the inputs with the outputs, which addBlock added to the
+	// target level. Blocks flushed meanwhile stay in level 0.
+	removed := make(map[string]bool, len(inputs))
+	for _, info := range inputs {
+		removed[info.path] = true
 	}
+	for level := range t.levels {
+		var remaining []blockInfo
+		for _, info := range t.levels[level] {
+			if !removed[info.path] {
+				remaining = append(remaining, info)
+			}
+		}
+		t.levels[level] = remaining
+		if len(remaining) == 0 && level != targetLevel {
+			t.overlapped[level] = false
+		}
+	}
+	t.sortLevel(targetLevel)
+
+	// Inputs still read by iterators are deleted once released
+	for _, info := range inputs {
+		t.deleteBlock(info.path)
+	}
+
+	t.checkInvariants()
+
+	return nil
+}
+
+// writtenBlock is an output block of a sub-compaction, written to its file
+// but not yet added to its level
+type writtenBlock struct {
+	path  string
+	block *block.Block
+}
+
+// subCompactionOutput is what the sub-compactions of a merge share: the
+// merged pairs and the blocks to write them as
+type subCompactionOutput struct {
+	// Merged values by key, nil for a tombstone, and the deletion time of
+	// the tombstones
+	entries   map[string][]byte
+	deletedAt map[string]int64
+
+	// Header of the output blocks
+	header block.Header
+
+	// Level the outputs are written to, and their creation time
+	level     int
+	createdAt time.Time
+
+	// Sequence number of the output blocks, the highest of the inputs
+	sequence int64
+}
+
+// subCompactionRanges splits the sorted keys of a merge into contiguous
+// ranges of about the same size, written in parallel: up to subCompactions
+// ranges of at least targetBlockSize bytes each. A range holds whole keys,
+// so all the versions of a key end up in the same output block. Without a
+// target block size, the outputs are a single block.
+func (t *LSMTree) subCompactionRanges(keys []string, entries map[string][]byte) [][]string {
+	if t.subCompactions <= 1 || t.targetBlockSize <= 0 {
+		return [][]string{keys}
+	}
+
+	var total int64
+	for _, key := range keys {
+		total += int64(4 + len(key) + 4 + len(entries[key]))
+	}
+	n := min(t.subCompactions, int(total/int64(t.targetBlockSize)))
+	if n <= 1 {
+		return [][]string{keys}
+	}
+
+	ranges := make([][]string, 0, n)
+	start := 0
+	var size int64
+	for i, key := range keys {
+		size += int64(4 + len(key) + 4 + len(entries[key]))
+		if len(ranges) < n-1 && size >= total*int64(len(ranges)+1)/int64(n) {
+			ranges = append(ranges, keys[start:i+1])
+			start = i + 1
+		}
+	}
+	if start < len(keys) {
+		ranges = append(ranges, keys[start:])
+	}
+	return ranges
+}
+
+// subCompaction writes the merged pairs of keys, a range of the keys of a
+// merge, as blocks of about targetBlockSize bytes. It returns the blocks
+// written, also when it fails part way. Sub-compactions of disjoint ranges
+// run concurrently.
+func (t *LSMTree) subCompaction(keys []string, out subCompactionOutput) ([]writtenBlock, error) {
+	var written []writtenBlock
+	var b *block.Block
+	size := 0
+	writeOutput := func() error {
+		t.compactionLimiter.wait(int64(b.DataSize()))
+		path, err := t.writeBlockFile(out.level, b, out.createdAt)
+		if err != nil {
+			return err
+		}
+		written = append(written, writtenBlock{path: path, block: b})
+		b = nil
+		return nil
+	}
+	for _, key := range keys {
+		if b == nil {
+			b = block.NewBlock()
+			b.Header.CompressionType = out.header.CompressionType
+			b.Header.HashType = out.header.HashType
+			b.Header.Flags = out.header.Flags
+			b.SetSequence(out.sequence)
+			size = 4 // Pair count
+		}
+		value := out.entries[key]
+		var err error
+		if value == nil {
+			err = b.AddTombstone([]byte(key), out.deletedAt[key])
+		} else {
+			err = b.Add([]byte(key), value)
+		}
+		if err != nil {
+			return written, fmt.Errorf("failed to add key-value pair to block: %w", err)
+		}
+		size += 4 + len(key) + 4 + len(value)
+		if value == nil && out.header.Flags&block.FlagTombstoneTimes != 0 {
+			size += 8 // Tombstone time
+		}
+
+		if t.targetBlockSize > 0 && size >= t.targetBlockSize {
+			if err := writeOutput(); err != nil {
+				return written, err
+			}
+		}
+	}
+	if b != nil {
+		if err := writeOutput(); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
 }
 
 // Close closes the LSM tree and releases resources
@@ -379,8 +1380,15 @@ func (t *LSMTree) Close() error {
 	close(t.compactionChan)
 
 	// Wait for any ongoing compaction to finish
+	t.mergeMu.Lock()
+	defer t.mergeMu.Unlock()
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
+	t.files.close()
+
+	// Iterators can't read the tree once it is closed
+	t.deletePending()
+
 	return nil
 }
@@ -0,0 +1,217 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/0xReLogic/river/internal/data/block"
+)
+
+// TestLSMTree_L0FileCountTrigger checks that many tiny L0 blocks trigger
+// compaction long before the L0 size threshold is reached
+func TestLSMTree_L0FileCountTrigger(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-lsm-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	tree, err := NewLSMTree(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to create LSM tree: %v", err)
+	}
+	defer tree.Close()
+
+	trigger := tree.l0CompactionTrigger
+	if trigger <= 0 {
+		t.Fatalf("Expected a positive default L0 compaction trigger, got %d", trigger)
+	}
+
+	for i := 0; i < trigger; i++ {
+		if len(tree.compactionChan) != 0 {
+			t.Fatalf("Compaction triggered after only %d blocks", i)
+		}
+
+		b := block.NewBlock()
+		if err := b.Add([]byte(fmt.Sprintf("key-%d", i)), []byte("v")); err != nil {
+			t.Fatalf("Failed to add pair: %v", err)
+		}
+		if err := tree.Write(b); err != nil {
+			t.Fatalf("Failed to write block: %v", err)
+		}
+	}
+
+	var totalSize int64
+	for _, info := range tree.levels[0] {
+		totalSize += info.size
+	}
+	if totalSize >= tree.compactionThresholds[0] {
+		t.Fatalf("Test blocks are too large: %d bytes reaches the size threshold", totalSize)
+	}
+
+	if !tree.shouldCompact(0) {
+		t.Errorf("Expected shouldCompact(0) with %d blocks totalling %d bytes", trigger, totalSize)
+	}
+	if len(tree.compactionChan) != 1 {
+		t.Errorf("Expected a compaction to be triggered after %d blocks", trigger)
+	}
+
+	// A disabled count trigger falls back to the size threshold
+	tree.l0CompactionTrigger = 0
+	if tree.shouldCompact(0) {
+		t.Errorf("Expected no compaction with the count trigger disabled")
+	}
+}
+
+// TestCompaction_PicksHighestScore checks a level far over its threshold is
+// compacted before a shallower level slightly over its own
+func TestCompaction_PicksHighestScore(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-compaction-score-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	tree, err := NewLSMTree(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to create LSM tree: %v", err)
+	}
+	defer tree.Close()
+
+	// One block in L1 and ten in L3
+	tree.mu.Lock()
+	var blockSize int64
+	for _, level := range []int{1, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3} {
+		b := block.NewBlock()
+		if err := b.Add([]byte("key"), []byte("value")); err != nil {
+			t.Fatalf("Failed to add pair: %v", err)
+		}
+		info, err := tree.writeBlock(level, b)
+		if err != nil {
+			t.Fatalf("Failed to write block: %v", err)
+		}
+		blockSize = info.size
+	}
+
+	// L1 slightly over its threshold, L3 ten times over
+	tree.compactionThresholds[1] = blockSize * 9 / 10
+	tree.compactionThresholds[3] = blockSize
+	tree.mu.Unlock()
+
+	scores := tree.CompactionScores()
+	if scores[1] < 1 || scores[1] > 2 || scores[3] < 9 {
+		t.Fatalf("Unexpected compaction scores %v", scores)
+	}
+
+	compaction := NewCompactionManager(tree, tempDir, 1) // Not started: tasks stay queued
+	if err := compaction.RunCompaction(); err != nil {
+		t.Fatalf("Failed to run compaction: %v", err)
+	}
+	task := <-compaction.taskChan
+	if task.sourceLevel != 3 || len(task.blocks) != 10 {
+		t.Errorf("Expected the 10 blocks of L3 to be compacted first, got %d blocks of L%d", len(task.blocks), task.sourceLevel)
+	}
+
+	// The next cycle picks L1
+	if err := compaction.RunCompaction(); err != nil {
+		t.Fatalf("Failed to run compaction: %v", err)
+	}
+	task = <-compaction.taskChan
+	if task.sourceLevel != 1 {
+		t.Errorf("Expected L1 to be compacted next, got L%d", task.sourceLevel)
+	}
+}
+
+// TestLSMTree_AtomicBlockWrites writes and compacts blocks while readers
+// decode every block file they find, and checks they never see a partly
+// written one, and that a block left half written by a crash is removed
+func TestLSMTree_AtomicBlockWrites(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-lsm-atomic-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	tree, err := NewLSMTree(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to create LSM tree: %v", err)
+	}
+
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	var mu sync.Mutex
+	var decodeErrs []error
+	reads := 0
+	for r := 0; r < 2; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				paths, _ := filepath.Glob(filepath.Join(tempDir, "L*", "*.blk"))
+				for _, path := range paths {
+					_, err := loadBlock(path)
+					mu.Lock()
+					if err != nil && !errors.Is(err, os.ErrNotExist) {
+						decodeErrs = append(decodeErrs, err)
+					}
+					reads++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	value := make([]byte, 64)
+	for i := 0; i < 60; i++ {
+		b := block.NewBlock()
+		for j := 0; j < 500; j++ {
+			if err := b.Add([]byte(fmt.Sprintf("key-%03d-%03d", i, j)), value); err != nil {
+				t.Fatalf("Failed to add pair: %v", err)
+			}
+		}
+		if err := tree.Write(b); err != nil {
+			t.Fatalf("Failed to write block: %v", err)
+		}
+		if i%10 == 9 {
+			if err := tree.CompactRange(0, nil, nil); err != nil {
+				t.Fatalf("Failed to compact: %v", err)
+			}
+		}
+	}
+	close(stop)
+	readers.Wait()
+
+	if reads == 0 {
+		t.Errorf("Expected the readers to decode blocks")
+	}
+	for _, err := range decodeErrs {
+		t.Errorf("Reader decoded a partial block: %v", err)
+	}
+	if _, err := tree.Read([]byte("key-042-123")); err != nil {
+		t.Errorf("Failed to read key-042-123: %v", err)
+	}
+
+	// A block a crash left half written is never loaded, and removed
+	partial := filepath.Join(tempDir, "L0", "1_partial.blk.tmp")
+	if err := os.WriteFile(partial, []byte("RVBK"), 0644); err != nil {
+		t.Fatalf("Failed to write partial block: %v", err)
+	}
+	tree.Close()
+	tree, err = NewLSMTree(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to reopen LSM tree: %v", err)
+	}
+	defer tree.Close()
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Errorf("Expected the partial block to be removed, got err %v", err)
+	}
+}
@@ -19,6 +19,9 @@ type Manifest struct {
 
 	// Current manifest data
 	data ManifestData
+
+	// Whether to fsync the manifest directory after renaming the manifest file
+	syncDirs bool
 }
 
 // ManifestData represents the data stored in a manifest file
@@ -32,6 +35,10 @@ type ManifestData struct {
 	// Current WAL file
 	CurrentWAL string `json:"current_wal"`
 
+	// Absolute path of the WAL directory when it is not the default
+	// <baseDir>/wal
+	WALDir string `json:"wal_dir,omitempty"`
+
 	// Last checkpoint timestamp
 	LastCheckpoint int64 `json:"last_checkpoint"`
 }
@@ -75,7 +82,8 @@ func NewManifest(baseDir string) (*Manifest, error) {
 	}
 
 	manifest := &Manifest{
-		path: filepath.Join(manifestDir, "manifest.json"),
+		path:     filepath.Join(manifestDir, "manifest.json"),
+		syncDirs: true,
 		data: ManifestData{
 			Timestamp: time.Now().UnixNano(),
 			Levels:    make([]LevelData, 7), // 7 levels (0-6)
@@ -138,6 +146,13 @@ func (m *Manifest) Save() error {
 		return fmt.Errorf("failed to rename manifest file: %w", err)
 	}
 
+	// Make the rename itself durable
+	if m.syncDirs {
+		if err := fsyncDir(filepath.Dir(m.path)); err != nil {
+			return fmt.Errorf("failed to sync manifest directory: %w", err)
+		}
+	}
+
 	return nil
 }
 
@@ -193,6 +208,17 @@ func (m *Manifest) UpdateCurrentWAL(walFile string) error {
 	return nil
 }
 
+// UpdateWALDir updates the WAL directory
+func (m *Manifest) UpdateWALDir(walDir string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Update WAL directory
+	m.data.WALDir = walDir
+
+	return nil
+}
+
 // UpdateLastCheckpoint updates the last checkpoint timestamp
 func (m *Manifest) UpdateLastCheckpoint(timestamp int64) error {
 	m.mu.Lock()
@@ -228,6 +254,13 @@ func (m *Manifest) GetCurrentWAL() string {
 	return m.data.CurrentWAL
 }
 
+// GetWALDir returns the WAL directory, or "" for the default
+func (m *Manifest) GetWALDir() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data.WALDir
+}
+
 // GetLastCheckpoint returns the last checkpoint timestamp
 func (m *Manifest) GetLastCheckpoint() int64 {
 	m.mu.Lock()
@@ -0,0 +1,316 @@
+package storage
+
+import (
+	"hash/maphash"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// memTable holds recent writes in memory until they are flushed to the LSM
+// tree. It is partitioned into shards by a hash of the key, each with its own
+// lock, so that writes to different keys don't contend. A nil value is a
+// tombstone. With arenas, the values are copied into the slabs of a
+// valueArena per shard rather than kept as written.
+type memTable struct {
+	// Partitions of the table
+	shards []memTableShard
+
+	// Seed of the hash that assigns keys to shards
+	seed maphash.Seed
+
+	// Whether the shards copy values into arenas
+	arena bool
+
+	// Clock telling the time of the first write to each shard
+	clock Clock
+}
+
+// memTableShard is one partition of a memory table
+type memTableShard struct {
+	// Mutex to protect the entries
+	mu sync.RWMutex
+
+	// Values by key
+	entries map[string][]byte
+
+	// Sequence numbers of the last write to each key
+	seqs map[string]int64
+
+	// Highest sequence number written to the shard, readable without the lock
+	maxSeq atomic.Int64
+
+	// Size of the shard in bytes: each key once plus the length of its value
+	size atomic.Int64
+
+	// Number of keys in the shard, tombstones included, readable without
+	// the lock
+	count atomic.Int64
+
+	// Time of the first write to the shard in Unix nanoseconds, zero while empty
+	oldest atomic.Int64
+
+	// Clock telling that time
+	clock Clock
+
+	// Arena the values are copied into, nil if values are kept as written
+	arena *valueArena
+}
+
+// newMemTable creates an empty memory table with the given number of
+// shards, copying values into arenas if arena is set and timing the first
+// writes with clock
+func newMemTable(numShards int, arena bool, clock Clock) *memTable {
+	if numShards < 1 {
+		numShards = 1
+	}
+
+	m := &memTable{
+		shards: make([]memTableShard, numShards),
+		seed:   maphash.MakeSeed(),
+		arena:  arena,
+		clock:  clock,
+	}
+	for i := range m.shards {
+		m.shards[i].entries = make(map[string][]byte)
+		m.shards[i].seqs = make(map[string]int64)
+		m.shards[i].clock = clock
+		if arena {
+			m.shards[i].arena = &valueArena{}
+		}
+	}
+
+	return m
+}
+
+// empty returns a new empty memory table configured like m
+func (m *memTable) empty() *memTable {
+	return newMemTable(len(m.shards), m.arena, m.clock)
+}
+
+// shard returns the shard holding key
+func (m *memTable) shard(key []byte) *memTableShard {
+	return &m.shards[m.shardIndex(key)]
+}
+
+// shardIndex returns the index of the shard holding key
+func (m *memTable) shardIndex(key []byte) int {
+	if len(m.shards) == 1 {
+		return 0
+	}
+	return int(maphash.Bytes(m.seed, key) % uint64(len(m.shards)))
+}
+
+// get returns the value of key and whether the table holds it
+func (m *memTable) get(key []byte) ([]byte, bool) {
+	s := m.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	value, ok := s.entries[string(key)]
+	return value, ok
+}
+
+// getMeta returns the value of key, the sequence number of its last write,
+// and whether the table holds it
+func (m *memTable) getMeta(key []byte) ([]byte, int64, bool) {
+	s := m.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	value, ok := s.entries[string(key)]
+	return value, s.seqs[string(key)], ok
+}
+
+// put stores a value (nil for a tombstone) written with sequence number seq,
+// locking the key's shard
+func (m *memTable) put(key, value []byte, seq int64) {
+	s := m.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.put(key, value, seq)
+}
+
+// maxSequence returns the highest sequence number written to the table
+func (m *memTable) maxSequence() int64 {
+	var seq int64
+	for i := range m.shards {
+		seq = max(seq, m.shards[i].maxSeq.Load())
+	}
+	return seq
+}
+
+// size returns the size of the table in bytes, summed across shards
+func (m *memTable) size() int64 {
+	var size int64
+	for i := range m.shards {
+		size += m.shards[i].size.Load()
+	}
+	return size
+}
+
+// arenaSize returns the bytes copied into the arenas of the table,
+// overwritten values included, or zero without arenas
+func (m *memTable) arenaSize() int64 {
+	var size int64
+	for i := range m.shards {
+		if a := m.shards[i].arena; a != nil {
+			size += a.size.Load()
+		}
+	}
+	return size
+}
+
+// keys returns the number of keys in the table, tombstones included, summed
+// across shards without locking them
+func (m *memTable) keys() int64 {
+	var keys int64
+	for i := range m.shards {
+		keys += m.shards[i].count.Load()
+	}
+	return keys
+}
+
+// oldestEntry returns the time of the first write to the table, or the
+// zero time if it is empty
+func (m *memTable) oldestEntry() time.Time {
+	var oldest int64
+	for i := range m.shards {
+		if t := m.shards[i].oldest.Load(); t != 0 && (oldest == 0 || t < oldest) {
+			oldest = t
+		}
+	}
+	if oldest == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, oldest)
+}
+
+// len returns the number of keys in the table, including tombstones
+func (m *memTable) len() int {
+	n := 0
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.mu.RLock()
+		n += len(s.entries)
+		s.mu.RUnlock()
+	}
+	return n
+}
+
+// copy returns a copy of the entries of all shards
+func (m *memTable) copy() map[string][]byte {
+	entries := make(map[string][]byte)
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.mu.RLock()
+		for key, value := range s.entries {
+			entries[key] = value
+		}
+		s.mu.RUnlock()
+	}
+	return entries
+}
+
+// sorted returns the entries with keys in [start, end) in key order. A nil
+// bound is unbounded. Each shard is sorted separately, then the shards are
+// merged. Values are shared, not copied: the table replaces values rather
+// than modifying them.
+func (m *memTable) sorted(start, end []byte) (keys, values [][]byte) {
+	// Copy and sort the entries of each shard
+	shardKeys := make([][]string, len(m.shards))
+	shardValues := make([]map[string][]byte, len(m.shards))
+	total := 0
+	for i := range m.shards {
+		s := &m.shards[i]
+		shardValues[i] = make(map[string][]byte)
+		s.mu.RLock()
+		for key, value := range s.entries {
+			if start != nil && key < string(start) {
+				continue
+			}
+			if end != nil && key >= string(end) {
+				continue
+			}
+			shardKeys[i] = append(shardKeys[i], key)
+			shardValues[i][key] = value
+		}
+		s.mu.RUnlock()
+		sort.Strings(shardKeys[i])
+		total += len(shardKeys[i])
+	}
+
+	// Merge the shards, taking the smallest head each time. Shards hold
+	// disjoint keys, so there are no duplicates to resolve.
+	keys = make([][]byte, 0, total)
+	values = make([][]byte, 0, total)
+	heads := make([]int, len(m.shards))
+	for len(keys) < total {
+		next := -1
+		for i, pos := range heads {
+			if pos == len(shardKeys[i]) {
+				continue
+			}
+			if next < 0 || shardKeys[i][pos] < shardKeys[next][heads[next]] {
+				next = i
+			}
+		}
+		key := shardKeys[next][heads[next]]
+		keys = append(keys, []byte(key))
+		values = append(values, shardValues[next][key])
+		heads[next]++
+	}
+
+	return keys, values
+}
+
+// restore adds the entries of an older memory table that were not
+// overwritten since, e.g. after its flush failed. Callers must ensure no
+// writes are in progress.
+func (m *memTable) restore(older *memTable) {
+	for i := range older.shards {
+		for key, value := range older.shards[i].entries {
+			s := m.shard([]byte(key))
+			if _, ok := s.entries[key]; !ok {
+				s.put([]byte(key), value, older.shards[i].seqs[key])
+			}
+		}
+	}
+}
+
+// put stores a value (nil for a tombstone) written with sequence number seq
+// in the shard. Callers must hold s.mu.
+//
+// The size counts each key once plus the length of its current value, so
+// overwriting an existing entry (or tombstone) only adjusts by the value delta.
+// A tombstone's key still counts towards the size.
+func (s *memTableShard) put(key, value []byte, seq int64) {
+	if s.arena != nil {
+		value = s.arena.copy(value)
+	}
+	if oldValue, ok := s.entries[string(key)]; ok {
+		s.size.Add(int64(len(value)) - int64(len(oldValue)))
+	} else {
+		s.size.Add(int64(len(key) + len(value)))
+		s.count.Add(1)
+	}
+
+	// Both maps share one copy of the key
+	k := string(key)
+	s.entries[k] = value
+	s.seqs[k] = seq
+	if seq > s.maxSeq.Load() {
+		s.maxSeq.Store(seq)
+	}
+	if s.oldest.Load() == 0 {
+		s.oldest.Store(clockNow(s.clock).UnixNano())
+	}
+}
+
+// get returns the value of key in the shard. Callers must hold s.mu.
+func (s *memTableShard) get(key []byte) ([]byte, bool) {
+	value, ok := s.entries[string(key)]
+	return value, ok
+}
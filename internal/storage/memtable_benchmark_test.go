@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// BenchmarkMemTable_Arena writes small values to a memory table with and
+// without value arenas, then collects garbage with the table alive. It
+// reports the heap objects per write and the GC pause time (from
+// runtime.ReadMemStats) and total time of a collection: without arenas,
+// every value is an object the collector has to track.
+func BenchmarkMemTable_Arena(b *testing.B) {
+	for _, arena := range []bool{false, true} {
+		name := "map"
+		if arena {
+			name = "arena"
+		}
+		b.Run(name, func(b *testing.B) {
+			m := newMemTable(16, arena, nil)
+			runtime.GC()
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				// A new value per write, like the body of a request
+				value := make([]byte, 32)
+				m.put([]byte(fmt.Sprintf("key-%09d", i)), value, int64(i))
+			}
+
+			b.StopTimer()
+			const collections = 5
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			start := time.Now()
+			for i := 0; i < collections; i++ {
+				runtime.GC()
+			}
+			elapsed := time.Since(start)
+			runtime.ReadMemStats(&after)
+			runtime.KeepAlive(m)
+
+			b.ReportMetric(float64(after.HeapObjects)/float64(b.N), "heap-objects/write")
+			b.ReportMetric(float64(after.PauseTotalNs-before.PauseTotalNs)/collections, "gc-pause-ns")
+			b.ReportMetric(float64(elapsed.Nanoseconds())/collections, "gc-ns")
+		})
+	}
+}
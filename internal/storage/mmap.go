@@ -1,14 +1,23 @@
 package storage
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"sync"
-	"unsafe"
 
-	"golang.org/x/sys/windows"
+	"github.com/0xReLogic/river/internal/data/block"
 )
 
+// errMmapUnavailable is returned by NewMmapFile on platforms without mmap support
+var errMmapUnavailable = errors.New("mmap is not supported on this platform")
+
+// openMmapFile opens the memory mapping used by NewMmapBlock.
+// It is a variable so tests can force the file-backed fallback.
+var openMmapFile = NewMmapFile
+
 // MmapFile represents a memory-mapped file for zero-copy reads
 type MmapFile struct {
 	// File handle
@@ -23,8 +32,8 @@ type MmapFile struct {
 	// Mutex to protect concurrent access
 	mu sync.RWMutex
 
-	// Windows-specific handle for the mapping
-	mapHandle windows.Handle
+	// Platform-specific function releasing the mapping
+	unmap func() error
 }
 
 // NewMmapFile creates a new memory-mapped file
@@ -52,42 +61,18 @@ func NewMmapFile(path string) (*MmapFile, error) {
 		}, nil
 	}
 
-	// Create file mapping
-	mapHandle, err := windows.CreateFileMapping(
-		windows.Handle(file.Fd()),
-		nil,
-		windows.PAGE_READONLY,
-		0,
-		0,
-		nil,
-	)
+	// Map the file into memory
+	data, unmap, err := mapFile(file, size)
 	if err != nil {
 		file.Close()
-		return nil, fmt.Errorf("failed to create file mapping: %w", err)
+		return nil, err
 	}
 
-	// Map view of file
-	addr, err := windows.MapViewOfFile(
-		mapHandle,
-		windows.FILE_MAP_READ,
-		0,
-		0,
-		0,
-	)
-	if err != nil {
-		windows.CloseHandle(mapHandle)
-		file.Close()
-		return nil, fmt.Errorf("failed to map view of file: %w", err)
-	}
-
-	// Create slice backed by mapped memory
-	data := unsafe.Slice((*byte)(unsafe.Pointer(addr)), size)
-
 	return &MmapFile{
-		file:      file,
-		data:      data,
-		size:      size,
-		mapHandle: mapHandle,
+		file:  file,
+		data:  data,
+		size:  size,
+		unmap: unmap,
 	}, nil
 }
 
@@ -152,11 +137,11 @@ func (m *MmapFile) Close() error {
 		return nil
 	}
 
-	// Unmap the view
-	err := windows.UnmapViewOfFile(uintptr(unsafe.Pointer(&m.data[0])))
-
-	// Close the mapping handle
-	windows.CloseHandle(m.mapHandle)
+	// Release the mapping (empty files are not mapped)
+	var err error
+	if m.unmap != nil {
+		err = m.unmap()
+	}
 
 	// Close the file
 	m.file.Close()
@@ -188,10 +173,142 @@ func (m *MmapFile) Data() ([]byte, error) {
 	return m.data, nil
 }
 
+// blockFile is the read access to a block file used by MmapBlock
+type blockFile interface {
+	// Read returns length bytes at offset, truncated at the end of the file
+	Read(offset, length int64) ([]byte, error)
+
+	// ReadAt reads into p at offset, like io.ReaderAt but without io.EOF on short reads
+	ReadAt(p []byte, offset int64) (int, error)
+
+	// Size returns the size of the file
+	Size() int64
+
+	// Close releases the file
+	Close() error
+}
+
+// Block file backends reported by MmapBlock.Backend
+const (
+	// BackendMmap reads block files through a memory mapping
+	BackendMmap = "mmap"
+
+	// BackendFile reads block files with positioned reads, when mmap is unavailable
+	BackendFile = "file"
+)
+
+// fileBackedBlock reads a block file with os.File.ReadAt. It is the fallback
+// used by NewMmapBlock on platforms or filesystems where mmap fails. Unlike
+// MmapFile, every read copies the data out of the file.
+type fileBackedBlock struct {
+	// File handle
+	file *os.File
+
+	// File size
+	size int64
+
+	// Mutex to protect concurrent access
+	mu sync.RWMutex
+}
+
+// newFileBackedBlock opens a block file for positioned reads
+func newFileBackedBlock(path string) (*fileBackedBlock, error) {
+	// Open the file with read-only access
+	file, err := os.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+
+	// Get file size
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to get file info: %w", err)
+	}
+
+	return &fileBackedBlock{
+		file: file,
+		size: info.Size(),
+	}, nil
+}
+
+// Read reads length bytes at offset into a new slice
+func (f *fileBackedBlock) Read(offset, length int64) ([]byte, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	// Check if file is closed
+	if f.file == nil {
+		return nil, fmt.Errorf("file is closed")
+	}
+
+	// Check bounds
+	if offset < 0 || offset >= f.size {
+		return nil, fmt.Errorf("offset out of bounds")
+	}
+
+	// Adjust length if it would go past the end of the file
+	if offset+length > f.size {
+		length = f.size - offset
+	}
+
+	buf := make([]byte, length)
+	if _, err := f.file.ReadAt(buf, offset); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// ReadAt reads data from the file at a specific offset
+func (f *fileBackedBlock) ReadAt(p []byte, offset int64) (int, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	// Check if file is closed
+	if f.file == nil {
+		return 0, fmt.Errorf("file is closed")
+	}
+
+	// Check bounds
+	if offset < 0 || offset >= f.size {
+		return 0, fmt.Errorf("offset out of bounds")
+	}
+
+	// Short reads at the end of the file are not an error, as with MmapFile
+	n, err := f.file.ReadAt(p, offset)
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// Size returns the size of the file
+func (f *fileBackedBlock) Size() int64 {
+	return f.size
+}
+
+// Close closes the file
+func (f *fileBackedBlock) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Check if already closed
+	if f.file == nil {
+		return nil
+	}
+
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
 // MmapBlock represents a memory-mapped block file with index
 type MmapBlock struct {
-	// The memory-mapped file
-	file *MmapFile
+	// The block file, memory-mapped or file-backed
+	file blockFile
+
+	// Backend serving reads (BackendMmap or BackendFile)
+	backend string
 
 	// Block metadata
 	minKey, maxKey []byte
@@ -200,21 +317,34 @@ type MmapBlock struct {
 	// Maps keys to offsets in the file
 	index map[string]int64
 
+	// Format flags from the header; with block.FlagValueChecksums each
+	// value is followed by its CRC32C
+	flags block.FormatFlags
+
 	// Mutex to protect concurrent access to the index
 	mu sync.RWMutex
 }
 
 // NewMmapBlock creates a new memory-mapped block
 func NewMmapBlock(path string) (*MmapBlock, error) {
-	// Open the file with memory mapping
-	file, err := NewMmapFile(path)
-	if err != nil {
-		return nil, fmt.Errorf("failed to memory-map file: %w", err)
+	// Open the file with memory mapping, falling back to positioned reads
+	var file blockFile
+	backend := BackendMmap
+	mapped, err := openMmapFile(path)
+	if err == nil {
+		file = mapped
+	} else {
+		fallback, fallbackErr := newFileBackedBlock(path)
+		if fallbackErr != nil {
+			return nil, fmt.Errorf("failed to memory-map file (%v) or open it: %w", err, fallbackErr)
+		}
+		file, backend = fallback, BackendFile
 	}
 
 	block := &MmapBlock{
-		file:  file,
-		index: make(map[string]int64),
+		file:    file,
+		backend: backend,
+		index:   make(map[string]int64),
 	}
 
 	// Load the block header and index
@@ -231,16 +361,18 @@ func (b *MmapBlock) loadHeader() error {
 	// TODO: Implement proper header loading
 	// For now, use placeholder implementation
 
-	// Get the entire file data
-	data, err := b.file.Data()
-	if err != nil {
-		return err
+	// Placeholder: Assume first 8 bytes contain the number of entries,
+	// except for the first byte which holds the format flags
+	if b.file.Size() < 8 {
+		return fmt.Errorf("file too small to contain header")
 	}
 
-	// Placeholder: Assume first 8 bytes contain the number of entries
-	if len(data) < 8 {
-		return fmt.Errorf("file too small to contain header")
+	// Get the entire file data (zero-copy when memory-mapped)
+	data, err := b.file.Read(0, b.file.Size())
+	if err != nil {
+		return err
 	}
+	b.flags = block.FormatFlags(data[0])
 
 	// Placeholder: Build a simple index
 	// In a real implementation, this would parse the actual block format
@@ -251,6 +383,7 @@ func (b *MmapBlock) loadHeader() error {
 		// - N bytes: key
 		// - 4 bytes: value length
 		// - M bytes: value
+		// - 4 bytes: CRC32C of the value, with block.FlagValueChecksums
 
 		if offset+4 > b.file.Size() {
 			break // Not enough data for key length
@@ -281,8 +414,11 @@ func (b *MmapBlock) loadHeader() error {
 			int64(data[offset+2])<<16 | int64(data[offset+3])<<24
 		offset += 4
 
-		// Skip value
+		// Skip value and checksum
 		offset += valueLen
+		if b.flags&block.FlagValueChecksums != 0 {
+			offset += 4
+		}
 	}
 
 	return nil
@@ -295,7 +431,7 @@ func (b *MmapBlock) Get(key []byte) ([]byte, error) {
 	b.mu.RUnlock()
 
 	if !ok {
-		return nil, fmt.Errorf("key not found")
+		return nil, ErrKeyNotFound
 	}
 
 	// Read value length
@@ -313,6 +449,17 @@ func (b *MmapBlock) Get(key []byte) ([]byte, error) {
 		return nil, fmt.Errorf("failed to read value: %w", err)
 	}
 
+	// Verify the value against its checksum
+	if b.flags&block.FlagValueChecksums != 0 {
+		sumBuf, err := b.file.Read(offset+4+valueLen, 4)
+		if err != nil || len(sumBuf) < 4 {
+			return nil, fmt.Errorf("%w: missing checksum for the value of key %q", ErrCorrupt, key)
+		}
+		if block.ValueChecksum(value) != binary.LittleEndian.Uint32(sumBuf) {
+			return nil, fmt.Errorf("%w: checksum mismatch for the value of key %q", ErrCorrupt, key)
+		}
+	}
+
 	return value, nil
 }
 
@@ -335,3 +482,9 @@ func (b *MmapBlock) MaxKey() []byte {
 func (b *MmapBlock) Size() int64 {
 	return b.file.Size()
 }
+
+// Backend returns how the block file is read: BackendMmap, or BackendFile
+// when memory mapping failed
+func (b *MmapBlock) Backend() string {
+	return b.backend
+}
@@ -0,0 +1,10 @@
+//go:build !unix && !windows
+
+package storage
+
+import "os"
+
+// mapFile reports that memory mapping is unavailable on this platform
+func mapFile(file *os.File, size int64) ([]byte, func() error, error) {
+	return nil, nil, errMmapUnavailable
+}
@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/0xReLogic/river/internal/data/block"
+)
+
+// writeMmapBlockFile writes pairs in the layout indexed by MmapBlock:
+// an 8-byte header followed by length-prefixed keys and values
+func writeMmapBlockFile(t *testing.T, path string, keys []string) {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 8))
+	for _, key := range keys {
+		binary.Write(&buf, binary.LittleEndian, uint32(len(key)))
+		buf.WriteString(key)
+		value := "value-of-" + key
+		binary.Write(&buf, binary.LittleEndian, uint32(len(value)))
+		buf.WriteString(value)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write block file: %v", err)
+	}
+}
+
+func TestMmapBlock_FileBackedFallback(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-mmap-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	path := filepath.Join(tempDir, "block.blk")
+	var keys []string
+	for i := 0; i < 100; i++ {
+		keys = append(keys, fmt.Sprintf("key-%03d", i))
+	}
+	writeMmapBlockFile(t, path, keys)
+
+	mapped, err := NewMmapBlock(path)
+	if err != nil {
+		t.Fatalf("Failed to open block: %v", err)
+	}
+	defer mapped.Close()
+
+	// Force the fallback by making memory mapping fail
+	openMmapFile = func(string) (*MmapFile, error) { return nil, errMmapUnavailable }
+	defer func() { openMmapFile = NewMmapFile }()
+
+	fallback, err := NewMmapBlock(path)
+	if err != nil {
+		t.Fatalf("Failed to open block with the fallback: %v", err)
+	}
+	defer fallback.Close()
+
+	if fallback.Backend() != BackendFile {
+		t.Errorf("Expected backend %q, got %q", BackendFile, fallback.Backend())
+	}
+	if mapped.Backend() != BackendMmap {
+		t.Errorf("Expected backend %q, got %q", BackendMmap, mapped.Backend())
+	}
+	if mapped.Size() != fallback.Size() {
+		t.Errorf("Expected size %d, got %d", mapped.Size(), fallback.Size())
+	}
+
+	for _, key := range keys {
+		expected, err := mapped.Get([]byte(key))
+		if err != nil {
+			t.Fatalf("Failed to get %s: %v", key, err)
+		}
+		value, err := fallback.Get([]byte(key))
+		if err != nil {
+			t.Fatalf("Failed to get %s with the fallback: %v", key, err)
+		}
+		if !bytes.Equal(value, expected) || string(value) != "value-of-"+key {
+			t.Errorf("Expected %q for %s, got %q (mmap returned %q)", "value-of-"+key, key, value, expected)
+		}
+	}
+
+	if _, err := fallback.Get([]byte("missing")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+
+	// Short reads at the end of the file match the memory-mapped behaviour
+	buf := make([]byte, 16)
+	n, err := fallback.file.ReadAt(buf, fallback.Size()-4)
+	if err != nil || n != 4 {
+		t.Errorf("Expected a 4-byte read at the end of the file, got %d (err %v)", n, err)
+	}
+}
+
+func TestMmapBlock_ValueChecksums(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-mmap-checksum-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Values followed by their checksums, with the flag in the header
+	var buf bytes.Buffer
+	buf.WriteByte(byte(block.FlagValueChecksums))
+	buf.Write(make([]byte, 7))
+	for _, key := range []string{"a", "b", "c"} {
+		value := []byte("value-of-" + key)
+		binary.Write(&buf, binary.LittleEndian, uint32(len(key)))
+		buf.WriteString(key)
+		binary.Write(&buf, binary.LittleEndian, uint32(len(value)))
+		buf.Write(value)
+		binary.Write(&buf, binary.LittleEndian, block.ValueChecksum(value))
+	}
+	data := buf.Bytes()
+	data[bytes.Index(data, []byte("value-of-b"))] ^= 0xff
+
+	path := filepath.Join(tempDir, "block.blk")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Failed to write block file: %v", err)
+	}
+
+	mapped, err := NewMmapBlock(path)
+	if err != nil {
+		t.Fatalf("Failed to open block: %v", err)
+	}
+	defer mapped.Close()
+
+	if _, err := mapped.Get([]byte("b")); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Expected ErrCorrupt for the corrupt value, got %v", err)
+	}
+	for _, key := range []string{"a", "c"} {
+		if value, err := mapped.Get([]byte(key)); err != nil || string(value) != "value-of-"+key {
+			t.Errorf("Expected value-of-%s, got %q (err %v)", key, value, err)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+//go:build unix
+
+package storage
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// mapFile maps size bytes of file into memory for reading
+func mapFile(file *os.File, size int64) ([]byte, func() error, error) {
+	data, err := unix.Mmap(int(file.Fd()), 0, int(size), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to map file: %w", err)
+	}
+
+	unmap := func() error {
+		return unix.Munmap(data)
+	}
+
+	return data, unmap, nil
+}
@@ -0,0 +1,55 @@
+//go:build windows
+
+package storage
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// mapFile maps size bytes of file into memory for reading
+func mapFile(file *os.File, size int64) ([]byte, func() error, error) {
+	// Create file mapping
+	mapHandle, err := windows.CreateFileMapping(
+		windows.Handle(file.Fd()),
+		nil,
+		windows.PAGE_READONLY,
+		0,
+		0,
+		nil,
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create file mapping: %w", err)
+	}
+
+	// Map view of file
+	addr, err := windows.MapViewOfFile(
+		mapHandle,
+		windows.FILE_MAP_READ,
+		0,
+		0,
+		0,
+	)
+	if err != nil {
+		windows.CloseHandle(mapHandle)
+		return nil, nil, fmt.Errorf("failed to map view of file: %w", err)
+	}
+
+	// Create slice backed by mapped memory
+	data := unsafe.Slice((*byte)(unsafe.Pointer(addr)), size)
+
+	unmap := func() error {
+		// Unmap the view
+		err := windows.UnmapViewOfFile(addr)
+
+		// Close the mapping handle
+		windows.CloseHandle(mapHandle)
+
+		return err
+	}
+
+	return data, unmap, nil
+}
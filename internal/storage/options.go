@@ -0,0 +1,283 @@
+package storage
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/0xReLogic/river/internal/data/block"
+)
+
+// Options configures a storage engine
+type Options struct {
+	// Maximum size of the memory table before flushing to disk
+	MaxMemTableSize int64
+
+	// Maximum number of keys in the memory table before flushing to disk,
+	// tombstones included, whichever of it and MaxMemTableSize is reached
+	// first. It bounds the size of flushed blocks in keys when values are
+	// tiny. Zero flushes by size only.
+	MaxMemTableKeys int64
+
+	// Maximum age of the oldest write in the memory table. The memory table
+	// is flushed once it is older, even below MaxMemTableSize. Zero disables
+	// flushing by age.
+	MaxMemTableAge time.Duration
+
+	// Minimum size of a memory table flushed by age. A smaller memory table
+	// keeps accumulating writes past MaxMemTableAge, so bursts of few writes
+	// are coalesced into one larger level 0 block instead of many tiny ones.
+	// Flushes by size and explicit flushes are not affected. Zero flushes by
+	// age whatever the size.
+	MinFlushSize int64
+
+	// Number of partitions of the memory table, each with its own lock.
+	// Writes to keys in different partitions don't contend.
+	MemTableShards int
+
+	// Copy the values written to the memory table into large slabs, released
+	// together once the table is flushed, instead of keeping each value as
+	// its own allocation. With millions of small values in the memory table
+	// this leaves the garbage collector far fewer objects to track. Values
+	// overwritten in the memory table keep their space in the slabs until
+	// the flush, so the table is also flushed once the values copied reach
+	// MaxMemTableSize.
+	MemTableArena bool
+
+	// Number of level 0 blocks that triggers a compaction of level 0,
+	// independently of the level's total size. Zero disables the trigger.
+	// Under tiered compaction, the number of runs that triggers a
+	// compaction of any level.
+	L0CompactionTrigger int
+
+	// How compaction reorganizes the levels: leveled (the default) keeps
+	// each level below level 0 a single run, tiered lets runs accumulate
+	// and merges them with fewer, larger compactions
+	CompactionStrategy CompactionStrategy
+
+	// Fraction of a level's compaction threshold that leveled compaction
+	// brings the level down to once it crosses the threshold, e.g. 0.5 to
+	// compact a level reaching 75% of its max size down to below 37.5%.
+	// The level isn't compacted again until it crosses the threshold anew,
+	// so a level hovering around it isn't compacted over and over. Zero
+	// (or 1 and more) brings a level just below its threshold.
+	CompactionLowWatermark float64
+
+	// Time windows restricting the kinds of compaction background cycles
+	// run, e.g. only minor compactions (level 0 into level 1) during the
+	// day and major ones too at night. Manual compactions (CompactRange)
+	// aren't restricted. The zero value allows every compaction at any time.
+	CompactionSchedule CompactionSchedule
+
+	// Compression used for flushed blocks when no compression rule matches
+	Compression block.CompressionType
+
+	// Per key-prefix compression rules, consulted in order at flush time.
+	// Keys are grouped into blocks per compression type.
+	CompressionRules []CompressionRule
+
+	// Compression of the blocks of each level, indexed by level, e.g. fast
+	// LZ4 for the hot upper levels and high-ratio Zstd for the cold lower
+	// ones. Compaction recompresses its output with the compression of the
+	// target level; the entry for level 0 replaces Compression for flushed
+	// blocks, still after CompressionRules. Levels past the end keep the
+	// compression of their input blocks. Blocks record their compression,
+	// so it can be changed between runs.
+	LevelCompression []block.CompressionType
+
+	// Size of the serialized pairs at which a flush starts a new block, so
+	// a large memory table is written as several blocks. Zero writes one
+	// block per compression type.
+	TargetBlockSize int
+
+	// Number of key ranges a large compaction is split into, whose output
+	// blocks are written in parallel, each range on its own goroutine. A
+	// range covers at least TargetBlockSize bytes and whole keys, so the
+	// outputs are the same as those of a serial compaction, up to where
+	// blocks are cut. Zero or 1 writes the outputs serially.
+	SubCompactions int
+
+	// Average size of the serialized pairs of a block below which a level
+	// is consolidated: compaction merges the runs of small adjacent blocks
+	// of the level into blocks of about TargetBlockSize in the same level,
+	// undoing the fragmentation left by many small flushes and compactions.
+	// Only levels 1-6 holding a single run are consolidated. Zero disables
+	// consolidation.
+	MinAverageBlockSize int
+
+	// Hash function used to compute the IDs of flushed blocks. The hash type
+	// is recorded in each block header, so it can be changed between runs.
+	BlockHasher block.HashType
+
+	// Store a CRC32C of each value in flushed blocks, so a corrupt value is
+	// detected when it is read rather than returned. Blocks record whether
+	// they carry checksums, so it can be changed between runs.
+	ValueChecksums bool
+
+	// Write flushed blocks in the split layout (block.FlagSplitLayout):
+	// all keys, prefix-compressed, then all values, each region compressed
+	// on its own, which usually shrinks compressed blocks of structured
+	// data. Compaction keeps the layout of its input blocks, and blocks
+	// record their layout, so it can be changed between runs.
+	SplitBlockLayout bool
+
+	// Minimum time a tombstone is kept after a delete, so a lagging replica
+	// or an audit can still see it. Compaction only drops a tombstone once
+	// it has reached the last level and is older than the grace period.
+	// Flushed blocks then record the time of each delete; a tombstone
+	// written without a time is treated as expired. Zero drops tombstones
+	// as soon as they reach the last level.
+	TombstoneGracePeriod time.Duration
+
+	// Fsync the parent directory after atomically renaming checkpoint and
+	// block files, so the rename itself survives a crash
+	SyncDirs bool
+
+	// Preallocate each WAL file to its maximum size when it is created, so
+	// appends don't extend the file and trigger metadata updates on sync.
+	// Files are truncated to their written size when rotated or closed.
+	PreallocateWAL bool
+
+	// Checksum algorithm of WAL entries. The zero value is CRC32C. Each WAL
+	// file records its algorithm in its header, so it can be changed
+	// between runs.
+	WALChecksum WALChecksum
+
+	// Size from which PUT values are compressed with LZ4 in the WAL, when
+	// that makes them smaller. Each entry records whether it is compressed,
+	// so it can be changed between runs. Zero disables WAL compression.
+	WALCompressionThreshold int
+
+	// Buffered bytes at which PutAsync writes the pending WAL entries to
+	// the file without waiting for the background sync, so a crash of the
+	// process no longer loses them. Zero leaves them buffered until synced.
+	WALBufferFlushSize int
+
+	// Skip WAL files without a valid header, e.g. truncated to zero or not
+	// written by the engine, with a warning, instead of failing to open.
+	// Any entries in a skipped file are lost.
+	BestEffortWALRecovery bool
+
+	// Receives the progress of the WAL replay when the engine is opened:
+	// the number of WAL entries and bytes read so far, every million
+	// entries and every 64MB, and once at the end. Nil logs the progress of
+	// large replays.
+	RecoveryProgress func(entries, bytes int64)
+
+	// Maximum rate of bytes read and written by compactions, shared by all
+	// compaction workers, so background I/O doesn't starve reads and
+	// writes. Zero doesn't limit compactions.
+	CompactionMaxBytesPerSec int64
+
+	// Maximum total size in bytes of the values read from the LSM tree kept
+	// in memory, so repeated reads of hot keys don't decode their blocks
+	// again. The least recently used values are evicted first. Zero
+	// disables the cache.
+	ValueCacheSize int64
+
+	// Size in bytes from which values are stored once in the value log, in
+	// <baseDir>/vlog, under their hash, with the blocks and the WAL holding
+	// a pointer to them: keys sharing a large value share a single copy of
+	// it. Values no key references anymore are reclaimed by
+	// Engine.CollectValueLog. Zero stores every value inline; a value log
+	// created by an earlier open is still read.
+	ValueLogThreshold int
+
+	// Number of blocks an iterator reads ahead, in the background, of the
+	// block it is at in each sorted run while scanning forward. Zero reads
+	// each block only when the scan reaches it.
+	ScanReadAhead int
+
+	// Maximum number of block files kept open for reads. The least recently
+	// used file is closed when the limit is reached.
+	MaxOpenFiles int
+
+	// Maximum number of blocks point reads (Get and its variants) decode
+	// at once, bounding the memory and file descriptors a burst of
+	// concurrent reads uses. Reads beyond the limit wait for a slot, or
+	// until the context of GetContext is done. Zero doesn't limit reads.
+	MaxConcurrentReads int
+
+	// Maximum time Close waits for an in-flight background flush or
+	// compaction to complete. Zero waits without a limit.
+	CloseTimeout time.Duration
+
+	// Maximum time opening the engine spends recovering the memory table
+	// from the checkpoint and WAL. Past it, NewEngineWithOptions returns an
+	// error wrapping ErrOpenTimeout and leaves the directory as it was, so
+	// opening it again recovers from scratch. Zero waits without a limit.
+	OpenTimeout time.Duration
+
+	// Clock used by the time-based features of the engine (see Clock). Nil
+	// uses the system clock.
+	Clock Clock
+
+	// Write a block whose contents (block ID) match an existing block as a
+	// hard link to the existing file instead of a copy. A block's data is
+	// freed once no block file references it.
+	DedupBlocks bool
+
+	// Byte separating the parts of namespaced keys (e.g. tenant:table:pk),
+	// used by ScanNamespace
+	KeySeparator byte
+
+	// Directory of the WAL segments, e.g. on a separate, faster disk. The
+	// directory is recorded in the manifest, so later opens without it
+	// still find the WAL. Empty uses the recorded directory, or <baseDir>/wal.
+	WALDir string
+
+	// Duration after which a Put, PutAsync, Append, Delete, Get, flush,
+	// checkpoint or compaction still running is logged as a warning, with
+	// the stacks of all goroutines, to diagnose hangs. Operations are only
+	// observed, never interrupted. Zero disables the watchdog.
+	WatchdogThreshold time.Duration
+
+	// Secondary indexes by name, searched with Engine.Search. Each files
+	// the keys under the term its extractor returns for their values, and
+	// is kept up to date by every write. Indexes are saved when the engine
+	// is closed, and built from a scan of the data on open if they weren't
+	// saved. Names must be usable as file names.
+	Indexes map[string]IndexExtractor
+
+	// Receives flush, compaction, WAL rotation and checkpoint events, from
+	// a dedicated goroutine so a slow listener doesn't hold up the engine.
+	// Nil disables events.
+	EventListener EventListener
+}
+
+// CompressionRule selects the compression for keys starting with Prefix
+type CompressionRule struct {
+	Prefix      []byte
+	Compression block.CompressionType
+}
+
+// DefaultOptions returns the options used by NewEngine
+func DefaultOptions() Options {
+	return Options{
+		MaxMemTableSize:     32 * 1024 * 1024, // 32MB
+		MemTableShards:      16,
+		L0CompactionTrigger: 4,
+		Compression:         block.CompressionNone,
+		TargetBlockSize:     4 * 1024 * 1024, // 4MB
+		BlockHasher:         block.HashSHA256,
+		ValueChecksums:      true,
+		SyncDirs:            true,
+		MaxOpenFiles:        256,
+		CloseTimeout:        30 * time.Second,
+		KeySeparator:        ':',
+	}
+}
+
+// compressionFor returns the compression for a flushed key: the first rule
+// whose prefix matches the key, or the compression of level 0, or the
+// default compression
+func (o *Options) compressionFor(key []byte) block.CompressionType {
+	for _, rule := range o.CompressionRules {
+		if bytes.HasPrefix(key, rule.Prefix) {
+			return rule.Compression
+		}
+	}
+	if len(o.LevelCompression) > 0 {
+		return o.LevelCompression[0]
+	}
+	return o.Compression
+}
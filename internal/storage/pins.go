@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// deleteMarkerExt is appended to the path of a block file to mark it for
+// deletion while iterators still read it
+const deleteMarkerExt = ".del"
+
+// blockPins keeps the block files read by live iterators from being deleted
+// by compaction. Deleting a pinned block only marks it; the file is deleted
+// once the last iterator reading it is closed. A marker file next to the
+// block records the mark, so a crash before then doesn't bring the block
+// back when the tree is reopened.
+type blockPins struct {
+	// Mutex to protect the pins
+	mu sync.Mutex
+
+	// Number of iterators reading each block file
+	refs map[string]int
+
+	// Block files to delete once they are no longer pinned
+	pending map[string]bool
+}
+
+// pinBlocks keeps the block files at paths until unpinBlocks releases them
+func (t *LSMTree) pinBlocks(paths []string) {
+	t.pins.mu.Lock()
+	defer t.pins.mu.Unlock()
+
+	if t.pins.refs == nil {
+		t.pins.refs = make(map[string]int)
+	}
+	for _, path := range paths {
+		t.pins.refs[path]++
+	}
+}
+
+// unpinBlocks releases block files pinned by pinBlocks, deleting those
+// that were deleted by compaction meanwhile and are no longer pinned
+func (t *LSMTree) unpinBlocks(paths []string) {
+	var unpinned []string
+
+	t.pins.mu.Lock()
+	for _, path := range paths {
+		t.pins.refs[path]--
+		if t.pins.refs[path] > 0 {
+			continue
+		}
+		delete(t.pins.refs, path)
+		if t.pins.pending[path] {
+			delete(t.pins.pending, path)
+			unpinned = append(unpinned, path)
+		}
+	}
+	t.pins.mu.Unlock()
+
+	for _, path := range unpinned {
+		t.removeBlockFile(path)
+	}
+}
+
+// deleteBlock deletes a block file that is no longer part of the tree, or
+// marks it for deletion if an iterator still reads it
+func (t *LSMTree) deleteBlock(path string) {
+	t.files.remove(path)
+
+	t.pins.mu.Lock()
+	if t.pins.refs[path] > 0 {
+		if t.pins.pending == nil {
+			t.pins.pending = make(map[string]bool)
+		}
+		t.pins.pending[path] = true
+		if err := os.WriteFile(path+deleteMarkerExt, nil, 0644); err != nil {
+			fmt.Printf("Warning: Failed to mark block %s for deletion: %v\n", path, err)
+		}
+		t.pins.mu.Unlock()
+		return
+	}
+	t.pins.mu.Unlock()
+
+	t.removeBlockFile(path)
+}
+
+// removeBlockFile deletes a block file and its deletion marker, if any.
+// Removing a block file only frees its data once no other block file
+// references it (see dedupIndex).
+func (t *LSMTree) removeBlockFile(path string) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Warning: Failed to delete compacted block %s: %v\n", path, err)
+	}
+	if err := os.Remove(path + deleteMarkerExt); err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Warning: Failed to delete marker of block %s: %v\n", path, err)
+	}
+	t.dedup.remove(path)
+}
+
+// deletePending deletes the block files marked for deletion, whether or not
+// iterators still read them. It is used when the tree is closed.
+func (t *LSMTree) deletePending() {
+	t.pins.mu.Lock()
+	pending := t.pins.pending
+	t.pins.pending = nil
+	t.pins.mu.Unlock()
+
+	for path := range pending {
+		t.removeBlockFile(path)
+	}
+}
+
+// pendingDeletes returns the number of block files marked for deletion
+func (t *LSMTree) pendingDeletes() int {
+	t.pins.mu.Lock()
+	defer t.pins.mu.Unlock()
+	return len(t.pins.pending)
+}
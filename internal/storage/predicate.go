@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"sort"
+)
+
+// Predicate selects the values returned by Engine.ScanWhere
+type Predicate interface {
+	// Matches reports whether a value is returned
+	Matches(value []byte) bool
+
+	// Bounds returns the range [lo, hi] of numeric values Matches accepts,
+	// in the encoding of NumericStat, so blocks whose integer column values
+	// all fall outside it are skipped without being read. ok must be false
+	// if Matches may accept a value that isn't an integer column (see
+	// PutColumn) holding a value in the range; nothing is skipped then.
+	Bounds() (lo, hi uint64, ok bool)
+}
+
+// IntRange returns a predicate matching the integer columns (block.Int32
+// or block.Int64, see PutColumn) holding at least one value in [lo, hi]
+func IntRange(lo, hi int64) Predicate {
+	return intRange{lo: lo, hi: hi}
+}
+
+// intRange is the Predicate of IntRange
+type intRange struct {
+	lo, hi int64
+}
+
+// Matches implements Predicate
+func (r intRange) Matches(value []byte) bool {
+	matched := false
+	columnInts(value, func(v int64) bool {
+		matched = v >= r.lo && v <= r.hi
+		return !matched
+	})
+	return matched
+}
+
+// Bounds implements Predicate
+func (r intRange) Bounds() (uint64, uint64, bool) {
+	return NumericStat(r.lo), NumericStat(r.hi), true
+}
+
+// ScanWhere returns an iterator over the keys in [start, end) whose values
+// match pred, in key order. A nil start or end leaves that side unbounded.
+//
+// When pred has bounds, blocks whose integer column values all fall outside
+// them (per the value stats written with each block) are skipped without
+// being read, unless an older block overlaps their key range: skipping a
+// block also skips its newer versions and deletes of the keys it holds,
+// which would let older matching versions through. Blocks written before
+// value stats were recorded are always read.
+func (e *Engine) ScanWhere(start, end []byte, pred Predicate) (*Iterator, error) {
+	return e.newIterator(context.Background(), IteratorOptions{Start: start, End: end}, pred, nil)
+}
+
+// pruneBlocks marks the blocks of the block sources (newest first) that an
+// iterator can skip under pred: blocks with value stats outside pred's
+// bounds, whose key ranges no block of an older source overlaps
+func pruneBlocks(sources []iteratorSource, pred Predicate) {
+	lo, hi, ok := pred.Bounds()
+	if !ok {
+		return
+	}
+
+	var runs []*blockSource
+	for _, src := range sources {
+		if s, ok := src.(*blockSource); ok {
+			runs = append(runs, s)
+		}
+	}
+
+	for i, s := range runs {
+		for j, info := range s.blocks {
+			if !info.valueStats {
+				continue
+			}
+			if info.minValue <= info.maxValue && info.minValue <= hi && info.maxValue >= lo {
+				continue // Some values may match
+			}
+			if overlapsRuns(runs[i+1:], info) {
+				continue
+			}
+			if s.skip == nil {
+				s.skip = make([]bool, len(s.blocks))
+			}
+			s.skip[j] = true
+		}
+	}
+}
+
+// overlapsRuns reports whether a block of runs overlaps the key range of info
+func overlapsRuns(runs []*blockSource, info blockInfo) bool {
+	for _, s := range runs {
+		// The first block ending at or after the range is the only one
+		// that can overlap it
+		idx := sort.Search(len(s.blocks), func(i int) bool {
+			return bytes.Compare(s.blocks[i].maxKey, info.minKey) >= 0
+		})
+		if idx < len(s.blocks) && bytes.Compare(s.blocks[idx].minKey, info.maxKey) <= 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket limiting a byte rate. Tokens accumulate at
+// rate bytes per second, up to one second's worth. A caller taking more
+// bytes than are available leaves the bucket in debt and sleeps until it
+// is repaid, so large requests are allowed but the long-run rate holds.
+// A nil limiter doesn't limit.
+type rateLimiter struct {
+	// Mutex to protect the bucket
+	mu sync.Mutex
+
+	// Bytes per second
+	rate float64
+
+	// Available bytes; negative while in debt
+	tokens float64
+
+	// Time tokens were last added
+	last time.Time
+}
+
+// newRateLimiter creates a limiter of bytesPerSec, or returns nil (no
+// limit) if bytesPerSec is not positive
+func newRateLimiter(bytesPerSec int64) *rateLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		rate:   float64(bytesPerSec),
+		tokens: float64(bytesPerSec),
+		last:   time.Now(),
+	}
+}
+
+// wait takes n bytes from the bucket, sleeping as long as needed to stay
+// within the rate
+func (l *rateLimiter) wait(n int64) {
+	if l == nil || n <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
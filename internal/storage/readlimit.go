@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// readLimiter is a semaphore bounding the number of block decodes of point
+// reads in flight, so a burst of concurrent reads can't exhaust memory and
+// file descriptors. A read finding every slot taken waits for one to be
+// released. A nil limiter doesn't limit.
+type readLimiter struct {
+	// Slots of the decodes in flight
+	slots chan struct{}
+
+	// Number of decodes in flight, and the most there ever were at once
+	inFlight, peak atomic.Int64
+}
+
+// newReadLimiter creates a limiter of n concurrent decodes, or returns nil
+// (no limit) if n is not positive
+func newReadLimiter(n int) *readLimiter {
+	if n <= 0 {
+		return nil
+	}
+	return &readLimiter{slots: make(chan struct{}, n)}
+}
+
+// acquire takes a slot, waiting until one is free. It gives up with ctx's
+// error once ctx is done.
+func (l *readLimiter) acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	n := l.inFlight.Add(1)
+	for {
+		peak := l.peak.Load()
+		if n <= peak || l.peak.CompareAndSwap(peak, n) {
+			return nil
+		}
+	}
+}
+
+// release frees a slot taken by acquire
+func (l *readLimiter) release() {
+	if l == nil {
+		return
+	}
+	l.inFlight.Add(-1)
+	<-l.slots
+}
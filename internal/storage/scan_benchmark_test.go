@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+)
+
+// BenchmarkScan_ReadAhead benchmarks a full forward scan of a level of many
+// blocks, reading each block when the scan reaches it and reading blocks
+// ahead in the background
+func BenchmarkScan_ReadAhead(b *testing.B) {
+	for _, readAhead := range []int{0, 4} {
+		b.Run(fmt.Sprintf("ReadAhead=%d", readAhead), func(b *testing.B) {
+			tempDir, err := os.MkdirTemp("", "river-scan-bench")
+			if err != nil {
+				b.Fatalf("Failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(tempDir)
+
+			opts := DefaultOptions()
+			opts.TargetBlockSize = 64 * 1024
+			opts.L0CompactionTrigger = 0
+			opts.ScanReadAhead = readAhead
+			engine, err := NewEngineWithOptions(tempDir, opts)
+			if err != nil {
+				b.Fatalf("Failed to create engine: %v", err)
+			}
+			defer engine.Close()
+
+			// About 10MB in a single run of level 1 blocks
+			const numKeys = 100000
+			value := make([]byte, 100)
+			err = engine.BulkImport(func(w BulkWriter) error {
+				for i := 0; i < numKeys; i++ {
+					if err := w.Put([]byte(fmt.Sprintf("key-%06d", i)), value); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				b.Fatalf("Failed to import: %v", err)
+			}
+			if err := engine.CompactRange(0, nil, nil); err != nil {
+				b.Fatalf("Failed to compact: %v", err)
+			}
+
+			b.SetBytes(numKeys * int64(len("key-000000")+len(value)))
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				it, err := engine.NewIterator(context.Background(), IteratorOptions{})
+				if err != nil {
+					b.Fatalf("Failed to create iterator: %v", err)
+				}
+				count := 0
+				for it.Next() {
+					count++
+				}
+				if err := it.Err(); err != nil || count != numKeys {
+					b.Fatalf("Expected %d keys, got %d (err %v)", numKeys, count, err)
+				}
+				it.Close()
+			}
+		})
+	}
+}
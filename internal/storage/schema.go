@@ -0,0 +1,420 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/0xReLogic/river/internal/data/block"
+	"github.com/0xReLogic/river/internal/data/compress"
+)
+
+// ColumnDef describes a column of a schema
+type ColumnDef struct {
+	// Name of the column, unique within its schema
+	Name string `json:"name"`
+
+	// Type of the column's values
+	DataType block.DataType `json:"data_type"`
+
+	// Compression of the column's encoded values
+	Compression block.CompressionType `json:"compression"`
+}
+
+// schemaRegistry holds the schemas defined with Engine.DefineSchema,
+// persisted as JSON in <baseDir>/schema/schemas.json
+type schemaRegistry struct {
+	// Path to the schemas file
+	path string
+
+	// Mutex to protect the schemas
+	mu sync.Mutex
+
+	// Columns of each schema by name
+	schemas map[string][]ColumnDef
+
+	// Whether to fsync the schema directory after renaming the schemas file
+	syncDirs bool
+
+	// Whether schemas can only be loaded; a schema defined by the writer
+	// after the registry was loaded is picked up on first use
+	readOnly bool
+}
+
+// newSchemaRegistry loads the schemas of the engine in baseDir. The schema
+// directory is only created once a schema is defined.
+func newSchemaRegistry(baseDir string, readOnly bool) (*schemaRegistry, error) {
+	r := &schemaRegistry{
+		path:     filepath.Join(baseDir, "schema", "schemas.json"),
+		schemas:  make(map[string][]ColumnDef),
+		syncDirs: true,
+		readOnly: readOnly,
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// load reads the schemas file, if any. Callers must hold r.mu, or own r
+// exclusively.
+func (r *schemaRegistry) load() error {
+	data, err := os.ReadFile(r.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read schemas file: %w", err)
+	}
+
+	schemas := make(map[string][]ColumnDef)
+	if err := json.Unmarshal(data, &schemas); err != nil {
+		return fmt.Errorf("%w: failed to decode schemas file: %w", ErrCorrupt, err)
+	}
+	r.schemas = schemas
+	return nil
+}
+
+// save writes the schemas file atomically. Callers must hold r.mu.
+func (r *schemaRegistry) save(schemas map[string][]ColumnDef) error {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return fmt.Errorf("failed to create schema directory: %w", err)
+	}
+
+	data, err := json.Marshal(schemas)
+	if err != nil {
+		return fmt.Errorf("failed to encode schemas: %w", err)
+	}
+
+	tempPath := r.path + ".tmp"
+	file, err := os.Create(tempPath)
+	if err != nil {
+		return fmt.Errorf("failed to create schemas file: %w", err)
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write schemas file: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync schemas file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close schemas file: %w", err)
+	}
+
+	if err := os.Rename(tempPath, r.path); err != nil {
+		return fmt.Errorf("failed to rename schemas file: %w", err)
+	}
+	if r.syncDirs {
+		if err := fsyncDir(filepath.Dir(r.path)); err != nil {
+			return fmt.Errorf("failed to sync schema directory: %w", err)
+		}
+	}
+	return nil
+}
+
+// define validates and persists a schema. Defining a schema again with the
+// same columns does nothing.
+func (r *schemaRegistry) define(name string, columns []ColumnDef) error {
+	if name == "" {
+		return fmt.Errorf("%w: empty schema name", ErrSchemaMismatch)
+	}
+	if len(columns) == 0 {
+		return fmt.Errorf("%w: schema %q has no columns", ErrSchemaMismatch, name)
+	}
+	seen := make(map[string]bool, len(columns))
+	for _, column := range columns {
+		if column.Name == "" || seen[column.Name] {
+			return fmt.Errorf("%w: schema %q has an empty or duplicate column name %q", ErrSchemaMismatch, name, column.Name)
+		}
+		seen[column.Name] = true
+		if _, _, err := columnCodec(column.DataType); err != nil {
+			return err
+		}
+		if column.Compression != block.CompressionNone && column.Compression != block.CompressionLZ4 {
+			return fmt.Errorf("unsupported compression type %d for column %q", column.Compression, column.Name)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if existing, ok := r.schemas[name]; ok {
+		if slices.Equal(existing, columns) {
+			return nil
+		}
+		return fmt.Errorf("%w: schema %q is already defined with other columns", ErrSchemaMismatch, name)
+	}
+
+	schemas := make(map[string][]ColumnDef, len(r.schemas)+1)
+	for n, c := range r.schemas {
+		schemas[n] = c
+	}
+	schemas[name] = slices.Clone(columns)
+	if err := r.save(schemas); err != nil {
+		return err
+	}
+	r.schemas = schemas
+	return nil
+}
+
+// lookup returns the columns of a schema
+func (r *schemaRegistry) lookup(name string) ([]ColumnDef, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	columns, ok := r.schemas[name]
+	if !ok && r.readOnly {
+		if err := r.load(); err != nil {
+			return nil, err
+		}
+		columns, ok = r.schemas[name]
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownSchema, name)
+	}
+	return columns, nil
+}
+
+// DefineSchema defines a schema of typed, named columns, used by PutRows
+// and GetRows. Schemas are persisted with the engine and can't be changed
+// once defined: defining one again with different columns returns
+// ErrSchemaMismatch.
+func (e *Engine) DefineSchema(name string, columns []ColumnDef) error {
+	if e.readOnly {
+		return ErrReadOnly
+	}
+	return e.schemas.define(name, columns)
+}
+
+// Schema returns the columns of a schema, or ErrUnknownSchema
+func (e *Engine) Schema(name string) ([]ColumnDef, error) {
+	columns, err := e.schemas.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return slices.Clone(columns), nil
+}
+
+// PutRows stores rows of a schema under key. Each row holds one value per
+// column, of the Go type matching the column's data type (int64 for
+// block.Int64, string for block.String, ...); otherwise ErrSchemaMismatch is
+// returned. The rows are stored column by column, each column encoded and
+// compressed as its definition says, and read back with GetRows.
+func (e *Engine) PutRows(schema string, key []byte, rows [][]interface{}) error {
+	columns, err := e.schemas.lookup(schema)
+	if err != nil {
+		return err
+	}
+	for i, row := range rows {
+		if len(row) != len(columns) {
+			return fmt.Errorf("%w: row %d has %d values for the %d columns of schema %q", ErrSchemaMismatch, i, len(row), len(columns), schema)
+		}
+	}
+
+	// Layout:
+	// - 2 bytes: Schema name length
+	// - N bytes: Schema name
+	// - 4 bytes: Number of rows
+	// - 2 bytes: Number of columns
+	// - Each column: data type (1 byte), compression (1 byte), encoded
+	//   size (4 bytes), stored size (4 bytes), stored values
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, uint16(len(schema)))
+	buf.WriteString(schema)
+	binary.Write(&buf, binary.LittleEndian, uint32(len(rows)))
+	binary.Write(&buf, binary.LittleEndian, uint16(len(columns)))
+
+	for c, column := range columns {
+		values, err := columnValues(rows, c, column)
+		if err != nil {
+			return err
+		}
+		encoder, _, err := columnCodec(column.DataType)
+		if err != nil {
+			return err
+		}
+		var encoded bytes.Buffer
+		if err := encoder.Encode(&encoded, values); err != nil {
+			return fmt.Errorf("failed to encode column %q: %w", column.Name, err)
+		}
+
+		stored, compression, err := compressColumn(column.Compression, encoded.Bytes())
+		if err != nil {
+			return fmt.Errorf("failed to compress column %q: %w", column.Name, err)
+		}
+		buf.WriteByte(byte(column.DataType))
+		buf.WriteByte(byte(compression))
+		binary.Write(&buf, binary.LittleEndian, uint32(encoded.Len()))
+		binary.Write(&buf, binary.LittleEndian, uint32(len(stored)))
+		buf.Write(stored)
+	}
+
+	return e.Put(key, buf.Bytes())
+}
+
+// GetRows returns the rows of a schema stored under key with PutRows, each
+// value of the Go type matching its column's data type. The values are
+// decoded with the decoders of the schema's data types. ErrSchemaMismatch
+// is returned if the value of key is not rows of the schema.
+func (e *Engine) GetRows(schema string, key []byte) ([][]interface{}, error) {
+	columns, err := e.schemas.lookup(schema)
+	if err != nil {
+		return nil, err
+	}
+	value, err := e.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	r := bytes.NewReader(value)
+	var nameLen uint16
+	if err := binary.Read(r, binary.LittleEndian, &nameLen); err != nil || int(nameLen) > r.Len() {
+		return nil, fmt.Errorf("%w: value of %q is not rows", ErrSchemaMismatch, key)
+	}
+	name := make([]byte, nameLen)
+	io.ReadFull(r, name)
+	if string(name) != schema {
+		return nil, fmt.Errorf("%w: value of %q holds rows of schema %q, not %q", ErrSchemaMismatch, key, name, schema)
+	}
+	var numRows uint32
+	var numColumns uint16
+	if binary.Read(r, binary.LittleEndian, &numRows) != nil || binary.Read(r, binary.LittleEndian, &numColumns) != nil {
+		return nil, fmt.Errorf("%w: truncated rows of schema %q", ErrCorrupt, schema)
+	}
+	if int(numColumns) != len(columns) {
+		return nil, fmt.Errorf("%w: value of %q has %d columns, schema %q has %d", ErrSchemaMismatch, key, numColumns, schema, len(columns))
+	}
+
+	rows := make([][]interface{}, numRows)
+	for i := range rows {
+		rows[i] = make([]interface{}, len(columns))
+	}
+	for c, column := range columns {
+		// - 1 byte:  Data type
+		// - 1 byte:  Compression
+		// - 4 bytes: Encoded size
+		// - 4 bytes: Stored size
+		header := make([]byte, 10)
+		if _, err := io.ReadFull(r, header); err != nil || r.Len() < int(binary.LittleEndian.Uint32(header[6:])) {
+			return nil, fmt.Errorf("%w: truncated column %q of schema %q", ErrCorrupt, column.Name, schema)
+		}
+		if block.DataType(header[0]) != column.DataType {
+			return nil, fmt.Errorf("%w: column %q of %q has data type %d, schema %q has %d", ErrSchemaMismatch, column.Name, key, header[0], schema, column.DataType)
+		}
+		stored := make([]byte, binary.LittleEndian.Uint32(header[6:]))
+		io.ReadFull(r, stored)
+
+		encoded, err := decompressColumn(block.CompressionType(header[1]), stored, int(binary.LittleEndian.Uint32(header[2:])))
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to decompress column %q: %w", ErrCorrupt, column.Name, err)
+		}
+		_, decoder, err := columnCodec(column.DataType)
+		if err != nil {
+			return nil, err
+		}
+		values, err := decodeColumn(decoder, column.DataType, encoded, int(numRows))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode column %q: %w", column.Name, err)
+		}
+		setColumnValues(rows, c, values)
+	}
+	return rows, nil
+}
+
+// columnValues returns the values of column c of rows as a slice of the Go
+// type matching the column's data type
+func columnValues(rows [][]interface{}, c int, column ColumnDef) (interface{}, error) {
+	switch column.DataType {
+	case block.Int32:
+		return collectColumn[int32](rows, c, column)
+	case block.Int64:
+		return collectColumn[int64](rows, c, column)
+	case block.Float32:
+		return collectColumn[float32](rows, c, column)
+	case block.Float64:
+		return collectColumn[float64](rows, c, column)
+	case block.String:
+		return collectColumn[string](rows, c, column)
+	case block.Bool:
+		return collectColumn[bool](rows, c, column)
+	default:
+		return nil, fmt.Errorf("%w: unknown data type %d", ErrColumnType, column.DataType)
+	}
+}
+
+// collectColumn returns the values of column c of rows, which must all be
+// of type T
+func collectColumn[T any](rows [][]interface{}, c int, column ColumnDef) ([]T, error) {
+	values := make([]T, len(rows))
+	for i, row := range rows {
+		v, ok := row[c].(T)
+		if !ok {
+			return nil, fmt.Errorf("%w: row %d has a %T value for column %q of type %T", ErrSchemaMismatch, i, row[c], column.Name, v)
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+// setColumnValues stores the values of a decoded column, a slice returned
+// by decodeColumn, as column c of rows
+func setColumnValues(rows [][]interface{}, c int, values interface{}) {
+	switch v := values.(type) {
+	case []int32:
+		spreadColumn(rows, c, v)
+	case []int64:
+		spreadColumn(rows, c, v)
+	case []float32:
+		spreadColumn(rows, c, v)
+	case []float64:
+		spreadColumn(rows, c, v)
+	case []string:
+		spreadColumn(rows, c, v)
+	case []bool:
+		spreadColumn(rows, c, v)
+	}
+}
+
+// spreadColumn stores values as column c of rows
+func spreadColumn[T any](rows [][]interface{}, c int, values []T) {
+	for i, v := range values {
+		rows[i][c] = v
+	}
+}
+
+// compressColumn compresses encoded column values, returning the bytes to
+// store and the compression used, which falls back to CompressionNone when
+// compression doesn't reduce the size
+func compressColumn(compression block.CompressionType, encoded []byte) ([]byte, block.CompressionType, error) {
+	if compression != block.CompressionLZ4 {
+		return encoded, block.CompressionNone, nil
+	}
+	compressed, err := compress.NewLZ4().Compress(encoded)
+	if err != nil {
+		return nil, compression, err
+	}
+	if len(compressed) >= len(encoded) {
+		return encoded, block.CompressionNone, nil
+	}
+	return compressed, block.CompressionLZ4, nil
+}
+
+// decompressColumn restores encoded column values of the given size
+func decompressColumn(compression block.CompressionType, stored []byte, size int) ([]byte, error) {
+	switch compression {
+	case block.CompressionNone:
+		return stored, nil
+	case block.CompressionLZ4:
+		return compress.NewLZ4().DecompressSize(stored, size)
+	default:
+		return nil, fmt.Errorf("unsupported compression type: %d", compression)
+	}
+}
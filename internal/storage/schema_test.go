@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/0xReLogic/river/internal/data/block"
+)
+
+// TestEngine_Schemas defines a two-column schema, writes rows and reads
+// them back typed, from the memory table, a block and after reopening, and
+// checks rows that don't match the schema are rejected
+func TestEngine_Schemas(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-schema-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	columns := []ColumnDef{
+		{Name: "symbol", DataType: block.String, Compression: block.CompressionLZ4},
+		{Name: "price", DataType: block.Float64},
+	}
+	var rows [][]interface{}
+	for i := 0; i < 1000; i++ {
+		rows = append(rows, []interface{}{"RIVR", float64(i) / 4})
+	}
+
+	// checkRows reads the rows back and checks their values and types
+	checkRows := func(engine *Engine, stage string) {
+		got, err := engine.GetRows("trades", []byte("trades-1"))
+		if err != nil {
+			t.Errorf("%s: failed to get rows: %v", stage, err)
+			return
+		}
+		if len(got) != len(rows) {
+			t.Errorf("%s: expected %d rows, got %d", stage, len(rows), len(got))
+			return
+		}
+		for i, row := range got {
+			symbol, ok := row[0].(string)
+			price, ok2 := row[1].(float64)
+			if !ok || !ok2 || symbol != "RIVR" || price != float64(i)/4 {
+				t.Errorf("%s: expected row %d to be [RIVR %v], got %#v", stage, i, float64(i)/4, row)
+				return
+			}
+		}
+	}
+
+	done := make(chan bool)
+	go func() {
+		engine, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to create engine: %v", err)
+			done <- true
+			return
+		}
+
+		if err := engine.PutRows("trades", []byte("trades-1"), rows); !errors.Is(err, ErrUnknownSchema) {
+			t.Errorf("Expected ErrUnknownSchema before the schema is defined, got %v", err)
+		}
+		if err := engine.DefineSchema("trades", columns); err != nil {
+			t.Errorf("Failed to define schema: %v", err)
+		}
+		if err := engine.DefineSchema("trades", columns); err != nil {
+			t.Errorf("Expected defining the same schema again to succeed, got %v", err)
+		}
+		if err := engine.DefineSchema("trades", columns[:1]); !errors.Is(err, ErrSchemaMismatch) {
+			t.Errorf("Expected ErrSchemaMismatch redefining the schema, got %v", err)
+		}
+		if err := engine.DefineSchema("counts", []ColumnDef{{Name: "n", DataType: block.Int64}}); err != nil {
+			t.Errorf("Failed to define schema: %v", err)
+		}
+
+		if err := engine.PutRows("trades", []byte("trades-1"), rows); err != nil {
+			t.Errorf("Failed to put rows: %v", err)
+		}
+		checkRows(engine, "memory table")
+		if err := engine.flush(); err != nil {
+			t.Errorf("Failed to flush: %v", err)
+		}
+		checkRows(engine, "block")
+
+		// Rows that don't match the schema are rejected
+		mismatched := [][][]interface{}{
+			{{"RIVR", 1.5}, {"RIVR", 2}}, // An int for a float64 column
+			{{1.5, "RIVR"}},              // Values in the wrong order
+			{{"RIVR"}},                   // A missing column
+			{{"RIVR", 1.5, int64(1)}},    // An extra value
+		}
+		for _, r := range mismatched {
+			if err := engine.PutRows("trades", []byte("bad"), r); !errors.Is(err, ErrSchemaMismatch) {
+				t.Errorf("Expected ErrSchemaMismatch for %v, got %v", r, err)
+			}
+		}
+
+		// Rows read with another schema, or a value that isn't rows
+		if _, err := engine.GetRows("counts", []byte("trades-1")); !errors.Is(err, ErrSchemaMismatch) {
+			t.Errorf("Expected ErrSchemaMismatch reading with another schema, got %v", err)
+		}
+		if err := engine.Put([]byte("raw"), []byte("x")); err != nil {
+			t.Errorf("Failed to put: %v", err)
+		}
+		if _, err := engine.GetRows("trades", []byte("raw")); !errors.Is(err, ErrSchemaMismatch) {
+			t.Errorf("Expected ErrSchemaMismatch for a value that isn't rows, got %v", err)
+		}
+
+		if err := engine.Close(); err != nil {
+			t.Errorf("Failed to close engine: %v", err)
+		}
+
+		// The schemas are persisted
+		reopened, err := NewEngine(tempDir)
+		if err != nil {
+			t.Errorf("Failed to reopen engine: %v", err)
+			done <- true
+			return
+		}
+		defer reopened.Close()
+
+		if got, err := reopened.Schema("trades"); err != nil || fmt.Sprint(got) != fmt.Sprint(columns) {
+			t.Errorf("Expected schema %v after reopening, got %v (err %v)", columns, got, err)
+		}
+		checkRows(reopened, "reopened")
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Test timed out after 10 seconds")
+	}
+}
@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"container/list"
+	"hash/maphash"
+	"sync"
+)
+
+// valueCacheStripes is the number of stripes keys are hashed into to track
+// invalidations
+const valueCacheStripes = 64
+
+// valueCache holds values read from the LSM tree, up to a total size, so
+// repeated reads of hot keys don't decode their blocks again. When full,
+// the least recently used values are evicted. Writes invalidate the values
+// of their keys.
+//
+// A read races the writes to its key: it may read a value from the LSM tree
+// just before a write invalidates the key. Each stripe of keys counts its
+// invalidations, and a value is only added if none happened in its stripe
+// since the read started.
+type valueCache struct {
+	// Mutex to protect the cache
+	mu sync.Mutex
+
+	// Maximum total size of the cached keys and values in bytes
+	capacity int64
+
+	// Total size of the cached keys and values in bytes
+	size int64
+
+	// Cached values by key, and their elements in lru
+	entries map[string]*list.Element
+
+	// Cached values, most recently used first
+	lru *list.List
+
+	// Number of invalidations of each stripe of keys
+	generations [valueCacheStripes]uint64
+
+	// Seed of the hash that assigns keys to stripes
+	seed maphash.Seed
+
+	// Number of lookups that found a value, and that didn't
+	hits, misses int64
+}
+
+// valueCacheEntry is a cached value
+type valueCacheEntry struct {
+	key   string
+	value []byte
+}
+
+// newValueCache creates a cache of at most capacity bytes, or returns nil
+// if capacity is not positive. A nil cache holds nothing.
+func newValueCache(capacity int64) *valueCache {
+	if capacity <= 0 {
+		return nil
+	}
+
+	return &valueCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		seed:     maphash.MakeSeed(),
+	}
+}
+
+// stripe returns the stripe of key
+func (c *valueCache) stripe(key []byte) int {
+	return int(maphash.Bytes(c.seed, key) % valueCacheStripes)
+}
+
+// get returns the cached value of key, counting a hit or a miss
+func (c *valueCache) get(key []byte) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[string(key)]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(el)
+	return el.Value.(*valueCacheEntry).value, true
+}
+
+// generation returns the invalidation generation of the stripe of key, to
+// be passed to add once the value is read
+func (c *valueCache) generation(key []byte) uint64 {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generations[c.stripe(key)]
+}
+
+// add caches the value of key read since generation was returned, unless
+// the stripe of key was invalidated meanwhile or the value doesn't fit
+func (c *valueCache) add(key, value []byte, generation uint64) {
+	if c == nil {
+		return
+	}
+	size := int64(len(key) + len(value))
+	if size > c.capacity {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.generations[c.stripe(key)] != generation {
+		return
+	}
+	if el, ok := c.entries[string(key)]; ok {
+		c.remove(el)
+	}
+	c.entries[string(key)] = c.lru.PushFront(&valueCacheEntry{key: string(key), value: value})
+	c.size += size
+
+	// Evict the least recently used values
+	for c.size > c.capacity {
+		c.remove(c.lru.Back())
+	}
+}
+
+// invalidate drops the value of key, and keeps values of its stripe read
+// before from being added
+func (c *valueCache) invalidate(key []byte) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generations[c.stripe(key)]++
+	if el, ok := c.entries[string(key)]; ok {
+		c.remove(el)
+	}
+}
+
+// clear drops every value, and keeps values read before from being added
+func (c *valueCache) clear() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := range c.generations {
+		c.generations[i]++
+	}
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	c.size = 0
+}
+
+// remove drops a cached value. Callers must hold c.mu.
+func (c *valueCache) remove(el *list.Element) {
+	entry := c.lru.Remove(el).(*valueCacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.key) + len(entry.value))
+}
+
+// stats returns the statistics of the cache
+func (c *valueCache) stats() ValueCacheStats {
+	if c == nil {
+		return ValueCacheStats{}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return ValueCacheStats{
+		Hits:    c.hits,
+		Misses:  c.misses,
+		Size:    c.size,
+		Entries: len(c.entries),
+	}
+}
+
+// ValueCacheStats describes the value cache (see Options.ValueCacheSize)
+type ValueCacheStats struct {
+	// Number of Get calls served by the cache, and that read the LSM tree
+	// instead. Reads served by the memory table are not counted.
+	Hits   int64
+	Misses int64
+
+	// Total size of the cached keys and values in bytes, and their number
+	Size    int64
+	Entries int
+}
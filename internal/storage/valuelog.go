@@ -0,0 +1,753 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// valueLogDir is the name of the value log directory in the base directory
+const valueLogDir = "vlog"
+
+// valueLogSegmentSize is the size past which the value log starts a new
+// segment file
+const valueLogSegmentSize = 64 * 1024 * 1024 // 64MB
+
+// valueLogRecordHeaderSize is the size of the header of a value log record:
+// a CRC32C of the rest of the record, the length of the value and its hash
+const valueLogRecordHeaderSize = 4 + 4 + sha256.Size
+
+// valueLogPointerMagic starts the pointers the value log stores in place of
+// values. It is followed by the SHA-256 of the value.
+var valueLogPointerMagic = [8]byte{0x00, 'R', 'V', 'L', 'O', 'G', 0x00, 0x01}
+
+// valueLogPointerSize is the size of a value log pointer
+const valueLogPointerSize = len(valueLogPointerMagic) + sha256.Size
+
+// valueHash identifies a value in the value log
+type valueHash [sha256.Size]byte
+
+// valueLogLocation is where a value is stored in the value log
+type valueLogLocation struct {
+	// Number of the segment holding the record
+	segment int
+
+	// Offset of the record in the segment
+	offset int64
+
+	// Length of the value
+	size int
+}
+
+// recordSize returns the number of bytes of the value's record
+func (l valueLogLocation) recordSize() int64 {
+	return int64(valueLogRecordHeaderSize + l.size)
+}
+
+// valueLog stores large values once, under their hash (see
+// Options.ValueLogThreshold). The WAL, the memory table and the blocks hold
+// a pointer to the value instead, so keys sharing a value share a single
+// copy of it.
+//
+// The values are appended as records to segment files (<n>.vlog), each
+// synced before the pointer is written to the WAL. Every record is a
+// CRC32C, the length of the value and its hash, then the value, in little
+// endian. The index of the records is rebuilt from the segments on open; a
+// record torn by a crash is cut off.
+//
+// A value stays in the log until Engine.CollectValueLog finds no key
+// referencing it. Writes made while a collection runs mark their values as
+// touched, which keeps them, and the values are only removed once the
+// iterators opened before the collection are closed.
+type valueLog struct {
+	// Directory of the segment files
+	dir string
+
+	// Size from which values are stored in the log; values looking like
+	// pointers are stored in it whatever their size
+	threshold int
+
+	// Whether the log is only read, following the writer of the directory
+	readOnly bool
+
+	// Whether to sync the directory when segment files are created or removed
+	syncDirs bool
+
+	// Mutex to protect the fields below
+	mu sync.RWMutex
+
+	// Whether the directory exists; a read-only log of a directory without
+	// one resolves nothing
+	present bool
+
+	// Whether the log has been closed
+	closed bool
+
+	// Location of each value
+	index map[valueHash]valueLogLocation
+
+	// Open segment files and their sizes, by number
+	files map[int]*os.File
+	sizes map[int]int64
+
+	// Number of the segment values are appended to
+	active int
+
+	// Total size of the values in the index
+	bytes int64
+
+	// Values written since the running collection started, if any
+	touched map[valueHash]bool
+
+	// Generation of the iterators opened from now on, and the number of
+	// open iterators of each generation. A collection starts a generation.
+	generation uint64
+	readers    map[uint64]int
+
+	// Held shared by point reads from the moment they read a pointer until
+	// they resolve it, and exclusively by a collection removing values
+	reclaim sync.RWMutex
+
+	// Held shared by bulk imports and streamed writes, whose pointers are
+	// not visible to a collection until written, and exclusively by a
+	// collection
+	imports sync.RWMutex
+}
+
+// ValueLogStats describes the values stored in the value log
+type ValueLogStats struct {
+	// Number of distinct values in the log
+	Values int
+
+	// Total size of the values in bytes
+	Bytes int64
+
+	// Number of segment files
+	Segments int
+}
+
+// openValueLog opens the value log in baseDir, creating it if threshold is
+// positive. It returns nil for a writable engine without a threshold or an
+// existing log, which stores every value inline.
+func openValueLog(baseDir string, threshold int, readOnly, syncDirs bool) (*valueLog, error) {
+	dir := filepath.Join(baseDir, valueLogDir)
+	if !readOnly && threshold <= 0 {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			return nil, nil
+		}
+	}
+
+	l := &valueLog{
+		dir:       dir,
+		threshold: threshold,
+		readOnly:  readOnly,
+		syncDirs:  syncDirs,
+		readers:   make(map[uint64]int),
+	}
+	if !readOnly {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create value log directory: %w", err)
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.loadLocked(); err != nil {
+		l.closeFilesLocked()
+		return nil, err
+	}
+	return l, nil
+}
+
+// loadLocked opens the segment files and rebuilds the index from their
+// records. Callers must hold l.mu.
+func (l *valueLog) loadLocked() error {
+	l.closeFilesLocked()
+	l.index = make(map[valueHash]valueLogLocation)
+	l.files = make(map[int]*os.File)
+	l.sizes = make(map[int]int64)
+	l.bytes = 0
+	l.active = 0
+
+	entries, err := os.ReadDir(l.dir)
+	if os.IsNotExist(err) && l.readOnly {
+		l.present = false
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read value log directory: %w", err)
+	}
+	l.present = true
+
+	var segments []int
+	for _, entry := range entries {
+		// A value being streamed when the writer stopped
+		if strings.HasSuffix(entry.Name(), valueLogStreamSuffix) && !l.readOnly {
+			os.Remove(filepath.Join(l.dir, entry.Name()))
+			continue
+		}
+
+		n, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), ".vlog"))
+		if err != nil || filepath.Ext(entry.Name()) != ".vlog" {
+			continue
+		}
+		segments = append(segments, n)
+	}
+	sort.Ints(segments)
+
+	for _, n := range segments {
+		flag := os.O_RDWR
+		if l.readOnly {
+			flag = os.O_RDONLY
+		}
+		f, err := os.OpenFile(l.segmentPath(n), flag, 0)
+		if err != nil {
+			return fmt.Errorf("failed to open value log segment: %w", err)
+		}
+		l.files[n] = f
+
+		size, err := l.scanSegment(n, f)
+		if err != nil {
+			return err
+		}
+		l.sizes[n] = size
+		l.active = n
+	}
+
+	if l.readOnly || l.active > 0 {
+		return nil
+	}
+	return l.createSegmentLocked(1)
+}
+
+// scanSegment indexes the records of a segment and returns the size of its
+// valid part. A writable log truncates the segment after its last valid
+// record.
+func (l *valueLog) scanSegment(n int, f *os.File) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat value log segment: %w", err)
+	}
+
+	var offset int64
+	header := make([]byte, valueLogRecordHeaderSize)
+	for offset < info.Size() {
+		if _, err := f.ReadAt(header, offset); err != nil {
+			break
+		}
+		size := int(binary.LittleEndian.Uint32(header[4:8]))
+		if offset+int64(valueLogRecordHeaderSize+size) > info.Size() {
+			break
+		}
+		value := make([]byte, size)
+		if _, err := f.ReadAt(value, offset+valueLogRecordHeaderSize); err != nil {
+			break
+		}
+		if binary.LittleEndian.Uint32(header[0:4]) != valueLogChecksum(header[4:], value) {
+			break
+		}
+
+		var hash valueHash
+		copy(hash[:], header[8:])
+		if _, ok := l.index[hash]; !ok {
+			l.index[hash] = valueLogLocation{segment: n, offset: offset, size: size}
+			l.bytes += int64(size)
+		}
+		offset += int64(valueLogRecordHeaderSize + size)
+	}
+
+	// The rest was torn by a crash, or is still being written by the writer
+	// a read-only log follows
+	if offset < info.Size() && !l.readOnly {
+		fmt.Printf("Warning: truncating value log segment %d after %d bytes of %d\n", n, offset, info.Size())
+		if err := f.Truncate(offset); err != nil {
+			return 0, fmt.Errorf("failed to truncate value log segment: %w", err)
+		}
+	}
+	return offset, nil
+}
+
+// valueLogChecksum returns the CRC32C of a record's length, hash and value
+func valueLogChecksum(header, value []byte) uint32 {
+	crc := crc32.Update(0, castagnoliTable, header)
+	return crc32.Update(crc, castagnoliTable, value)
+}
+
+// segmentPath returns the path of segment n
+func (l *valueLog) segmentPath(n int) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%06d.vlog", n))
+}
+
+// createSegmentLocked creates segment n and makes it the active segment.
+// Callers must hold l.mu.
+func (l *valueLog) createSegmentLocked(n int) error {
+	f, err := os.OpenFile(l.segmentPath(n), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create value log segment: %w", err)
+	}
+	if l.syncDirs {
+		if err := fsyncDir(l.dir); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to sync value log directory: %w", err)
+		}
+	}
+	l.files[n] = f
+	l.sizes[n] = 0
+	l.active = n
+	return nil
+}
+
+// closeFilesLocked closes the open segment files. Callers must hold l.mu.
+func (l *valueLog) closeFilesLocked() {
+	for _, f := range l.files {
+		f.Close()
+	}
+	l.files = nil
+}
+
+// close closes the value log
+func (l *valueLog) close() error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.closed = true
+	l.closeFilesLocked()
+	return nil
+}
+
+// isValuePointer reports whether a stored value is a value log pointer
+func isValuePointer(value []byte) bool {
+	return len(value) == valueLogPointerSize && [8]byte(value[:8]) == valueLogPointerMagic
+}
+
+// pointerHash returns the hash of the value a pointer points to
+func pointerHash(pointer []byte) valueHash {
+	return valueHash(pointer[len(valueLogPointerMagic):])
+}
+
+// store returns what to store in place of value: a pointer to it once it
+// is in the log, or value itself. Values looking like pointers always go to
+// the log, so they aren't taken for one.
+func (l *valueLog) store(value []byte) ([]byte, error) {
+	if l == nil {
+		return value, nil
+	}
+	if (l.threshold <= 0 || len(value) < max(l.threshold, valueLogPointerSize)) && !isValuePointer(value) {
+		return value, nil
+	}
+
+	hash := valueHash(sha256.Sum256(value))
+	if err := l.add(hash, value); err != nil {
+		return nil, err
+	}
+	return valuePointer(hash), nil
+}
+
+// valuePointer returns the pointer to the value with the given hash
+func valuePointer(hash valueHash) []byte {
+	pointer := make([]byte, 0, valueLogPointerSize)
+	pointer = append(pointer, valueLogPointerMagic[:]...)
+	return append(pointer, hash[:]...)
+}
+
+// add appends a value to the active segment and syncs it, unless the log
+// holds it already
+func (l *valueLog) add(hash valueHash, value []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return ErrEngineClosed
+	}
+	if l.touched != nil {
+		l.touched[hash] = true
+	}
+	if _, ok := l.index[hash]; ok {
+		return nil
+	}
+
+	if err := l.appendLocked(hash, value); err != nil {
+		return err
+	}
+	if err := l.files[l.active].Sync(); err != nil {
+		return fmt.Errorf("failed to sync value log segment: %w", err)
+	}
+	return nil
+}
+
+// appendLocked appends a value to the active segment, without syncing it,
+// and indexes it. The segment is synced and a new one started once it is
+// full. Callers must hold l.mu.
+func (l *valueLog) appendLocked(hash valueHash, value []byte) error {
+	if int64(len(value)) > MaxValueLogValueSize {
+		return fmt.Errorf("%w: %d bytes", ErrValueTooLarge, len(value))
+	}
+
+	size := int64(valueLogRecordHeaderSize + len(value))
+	if l.sizes[l.active] > 0 && l.sizes[l.active]+size > valueLogSegmentSize {
+		if err := l.rotateLocked(); err != nil {
+			return err
+		}
+	}
+
+	record := make([]byte, size)
+	binary.LittleEndian.PutUint32(record[4:8], uint32(len(value)))
+	copy(record[8:], hash[:])
+	copy(record[valueLogRecordHeaderSize:], value)
+	binary.LittleEndian.PutUint32(record[0:4], valueLogChecksum(record[4:valueLogRecordHeaderSize], value))
+
+	offset := l.sizes[l.active]
+	if _, err := l.files[l.active].WriteAt(record, offset); err != nil {
+		return fmt.Errorf("failed to write value log record: %w", err)
+	}
+	l.sizes[l.active] += size
+	l.index[hash] = valueLogLocation{segment: l.active, offset: offset, size: len(value)}
+	l.bytes += int64(len(value))
+	return nil
+}
+
+// rotateLocked syncs the active segment and starts a new one. Callers must
+// hold l.mu.
+func (l *valueLog) rotateLocked() error {
+	if err := l.files[l.active].Sync(); err != nil {
+		return fmt.Errorf("failed to sync value log segment: %w", err)
+	}
+	return l.createSegmentLocked(l.active + 1)
+}
+
+// resolve returns the value a stored value stands for: the value a pointer
+// points to, or the stored value itself. A read-only log reloads its index
+// once when a pointer is not in it, to find the values written since.
+func (l *valueLog) resolve(stored []byte) ([]byte, error) {
+	if l == nil || !isValuePointer(stored) {
+		return stored, nil
+	}
+
+	hash := pointerHash(stored)
+	value, ok, err := l.read(hash)
+	if err != nil || ok {
+		return value, err
+	}
+
+	if l.readOnly {
+		present, err := l.reload()
+		if err != nil {
+			return nil, err
+		}
+		if !present {
+			// The writer never stored values in a log
+			return stored, nil
+		}
+		if value, ok, err = l.read(hash); err != nil || ok {
+			return value, err
+		}
+	}
+	return nil, fmt.Errorf("%w: %x", ErrValueReclaimed, hash[:8])
+}
+
+// reload reloads the index of a read-only log from the segments, reporting
+// whether the directory exists
+func (l *valueLog) reload() (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.loadLocked(); err != nil {
+		return false, err
+	}
+	return l.present, nil
+}
+
+// read reads the value with the given hash, reporting whether the log holds it
+func (l *valueLog) read(hash valueHash) ([]byte, bool, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.closed {
+		return nil, false, ErrEngineClosed
+	}
+	loc, ok := l.index[hash]
+	if !ok {
+		return nil, false, nil
+	}
+
+	record := make([]byte, loc.recordSize())
+	if _, err := l.files[loc.segment].ReadAt(record, loc.offset); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, false, fmt.Errorf("%w: value log record past the end of segment %d", ErrCorrupt, loc.segment)
+		}
+		return nil, false, fmt.Errorf("failed to read value log record: %w", err)
+	}
+	value := record[valueLogRecordHeaderSize:]
+	if binary.LittleEndian.Uint32(record[0:4]) != valueLogChecksum(record[4:valueLogRecordHeaderSize], value) {
+		return nil, false, fmt.Errorf("%w: value log record checksum mismatch in segment %d", ErrCorrupt, loc.segment)
+	}
+	return value, true, nil
+}
+
+// readLock keeps a collection from removing values until the returned
+// function is called, so a pointer just read can be resolved
+func (l *valueLog) readLock() func() {
+	if l == nil {
+		return func() {}
+	}
+	l.reclaim.RLock()
+	return l.reclaim.RUnlock
+}
+
+// importLock keeps collections out of a bulk import or a streamed write
+// until the returned function is called
+func (l *valueLog) importLock() func() {
+	if l == nil {
+		return func() {}
+	}
+	l.imports.RLock()
+	return l.imports.RUnlock
+}
+
+// openReader registers a reader, an iterator or a value stream, returning
+// its generation. Callers must hold the engine lock exclusively while taking the snapshot of the
+// iterator, or register before reading the pointers they resolve.
+func (l *valueLog) openReader() uint64 {
+	if l == nil {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.readers[l.generation]++
+	return l.generation
+}
+
+// closeReader unregisters a reader of the given generation
+func (l *valueLog) closeReader(generation uint64) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.readers[generation]--; l.readers[generation] == 0 {
+		delete(l.readers, generation)
+	}
+}
+
+// beginCollect starts tracking the values written, and a new generation of
+// iterators, returning it. Callers must hold the engine lock exclusively,
+// so no write is in flight, and take the snapshot the references are
+// counted over under the same lock.
+func (l *valueLog) beginCollect() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.touched = make(map[valueHash]bool)
+	l.generation++
+	return l.generation
+}
+
+// endCollect stops tracking the values written
+func (l *valueLog) endCollect() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.touched = nil
+}
+
+// waitReaders waits for the iterators opened before the given generation
+// to be closed, or ctx to be done
+func (l *valueLog) waitReaders(ctx context.Context, generation uint64) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		l.mu.RLock()
+		waiting := false
+		for g := range l.readers {
+			waiting = waiting || g < generation
+		}
+		l.mu.RUnlock()
+		if !waiting {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// sweep removes the values that are neither referenced nor touched since
+// the collection started, and rewrites the segments that held them with
+// only their other values. It returns the number of values removed.
+func (l *valueLog) sweep(referenced map[valueHash]int) (int, error) {
+	l.reclaim.Lock()
+	defer l.reclaim.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return 0, ErrEngineClosed
+	}
+
+	removed := 0
+	for hash, loc := range l.index {
+		if referenced[hash] > 0 || l.touched[hash] {
+			continue
+		}
+		delete(l.index, hash)
+		l.bytes -= int64(loc.size)
+		removed++
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+
+	// Segments holding bytes no value accounts for anymore
+	live := make(map[int]int64)
+	for _, loc := range l.index {
+		live[loc.segment] += loc.recordSize()
+	}
+	var rewrite []int
+	for n, size := range l.sizes {
+		if live[n] < size {
+			rewrite = append(rewrite, n)
+		}
+	}
+	sort.Ints(rewrite)
+
+	// The values kept are copied to the active segment, or to a new one if
+	// the active segment is rewritten
+	if len(rewrite) > 0 && rewrite[len(rewrite)-1] == l.active {
+		if err := l.rotateLocked(); err != nil {
+			return removed, err
+		}
+	}
+	for _, n := range rewrite {
+		for hash, loc := range l.index {
+			if loc.segment != n {
+				continue
+			}
+			record := make([]byte, loc.recordSize())
+			if _, err := l.files[n].ReadAt(record, loc.offset); err != nil {
+				return removed, fmt.Errorf("failed to read value log record: %w", err)
+			}
+			if err := l.appendLocked(hash, record[valueLogRecordHeaderSize:]); err != nil {
+				return removed, err
+			}
+			l.bytes -= int64(loc.size)
+		}
+	}
+	if err := l.files[l.active].Sync(); err != nil {
+		return removed, fmt.Errorf("failed to sync value log segment: %w", err)
+	}
+
+	// Only then are the old segments removed
+	for _, n := range rewrite {
+		l.files[n].Close()
+		delete(l.files, n)
+		delete(l.sizes, n)
+		if err := os.Remove(l.segmentPath(n)); err != nil {
+			return removed, fmt.Errorf("failed to remove value log segment: %w", err)
+		}
+	}
+	if l.syncDirs {
+		if err := fsyncDir(l.dir); err != nil {
+			return removed, fmt.Errorf("failed to sync value log directory: %w", err)
+		}
+	}
+	return removed, nil
+}
+
+// stats returns the stats of the log
+func (l *valueLog) stats() ValueLogStats {
+	if l == nil {
+		return ValueLogStats{}
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return ValueLogStats{Values: len(l.index), Bytes: l.bytes, Segments: len(l.sizes)}
+}
+
+// CollectValueLog reclaims the values of the value log that no live key
+// references anymore, e.g. after the keys sharing a value were all
+// overwritten or deleted, and returns how many it removed. The references
+// are counted over a snapshot of the keys; values written while the count
+// runs are kept. The values are removed once the iterators opened before
+// CollectValueLog are closed, which it waits for until ctx is done. The
+// segment files that held them are rewritten with the values kept.
+//
+// Overwritten versions of keys, such as those GetFromLevel and History
+// return, don't count as references: their values fail with
+// ErrValueReclaimed once reclaimed. Without a value log, CollectValueLog
+// does nothing.
+func (e *Engine) CollectValueLog(ctx context.Context) (int, error) {
+	e.mu.RLock()
+	closed, readOnly := e.closed, e.readOnly
+	e.mu.RUnlock()
+	if closed {
+		return 0, ErrEngineClosed
+	}
+	if readOnly {
+		return 0, ErrReadOnly
+	}
+	if e.values == nil {
+		return 0, nil
+	}
+
+	// Bulk imports stage pointers where the count doesn't see them
+	e.values.imports.Lock()
+	defer e.values.imports.Unlock()
+
+	// The collection starts at the snapshot the references are counted
+	// over: each write from then on touches its value, and each iterator
+	// opened since reads values that are referenced or touched
+	var generation uint64
+	defer e.values.endCollect()
+	referenced, err := e.countValueReferences(ctx, func() { generation = e.values.beginCollect() })
+	if err != nil {
+		return 0, err
+	}
+
+	if err := e.values.waitReaders(ctx, generation); err != nil {
+		return 0, err
+	}
+	return e.values.sweep(referenced)
+}
+
+// countValueReferences counts the live keys referencing each value of the
+// value log, over the snapshot of an iterator, calling snapshot when it is
+// taken
+func (e *Engine) countValueReferences(ctx context.Context, snapshot func()) (map[valueHash]int, error) {
+	it, err := e.newIterator(ctx, IteratorOptions{}, nil, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	it.raw = true
+
+	referenced := make(map[valueHash]int)
+	for it.Next() {
+		if isValuePointer(it.Value()) {
+			referenced[pointerHash(it.Value())]++
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, fmt.Errorf("failed to count value references: %w", err)
+	}
+	return referenced, nil
+}
@@ -0,0 +1,390 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// valueLogStreamChunkSize is the size of the chunks streamed values are
+// copied in
+const valueLogStreamChunkSize = 1024 * 1024 // 1MB
+
+// valueLogStreamSuffix ends the names of the files values are streamed to
+// before they become segments
+const valueLogStreamSuffix = ".stream"
+
+// streams reports whether a value of the given length is streamed to the
+// log rather than read whole
+func (l *valueLog) streams(length int64) bool {
+	return l != nil && l.threshold > 0 && length >= int64(max(l.threshold, valueLogPointerSize))
+}
+
+// storeStream copies the length bytes read from r to the log in chunks and
+// returns the pointer to store in place of the value. The value is written
+// to a file of its own, hashed as it is read and checksummed reading it
+// back, so it is never held in memory whole. The file becomes the active
+// segment once complete.
+func (l *valueLog) storeStream(r io.Reader, length int64) ([]byte, error) {
+	if length > MaxValueLogValueSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrValueTooLarge, length)
+	}
+
+	f, err := os.CreateTemp(l.dir, "*"+valueLogStreamSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create value log segment: %w", err)
+	}
+	defer f.Close()
+
+	// Left behind only if the value isn't installed
+	defer os.Remove(f.Name())
+
+	// The value goes after the header, written once the hash is known
+	hasher := sha256.New()
+	chunk := make([]byte, min(length, valueLogStreamChunkSize))
+	end := int64(valueLogRecordHeaderSize)
+	for end < valueLogRecordHeaderSize+length {
+		buf := chunk[:min(valueLogRecordHeaderSize+length-end, int64(len(chunk)))]
+		if _, err := io.ReadFull(r, buf); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, fmt.Errorf("failed to read value: %w", err)
+		}
+		hasher.Write(buf)
+		if _, err := f.WriteAt(buf, end); err != nil {
+			return nil, fmt.Errorf("failed to write value log record: %w", err)
+		}
+		end += int64(len(buf))
+	}
+
+	hash := valueHash(hasher.Sum(nil))
+	header := make([]byte, valueLogRecordHeaderSize)
+	binary.LittleEndian.PutUint32(header[4:8], uint32(length))
+	copy(header[8:], hash[:])
+
+	// The checksum covers the header before the value
+	crc := crc32.Update(0, castagnoliTable, header[4:])
+	for offset := int64(valueLogRecordHeaderSize); offset < end; {
+		buf := chunk[:min(end-offset, int64(len(chunk)))]
+		if _, err := f.ReadAt(buf, offset); err != nil {
+			return nil, fmt.Errorf("failed to read value log record: %w", err)
+		}
+		crc = crc32.Update(crc, castagnoliTable, buf)
+		offset += int64(len(buf))
+	}
+	binary.LittleEndian.PutUint32(header[0:4], crc)
+
+	if _, err := f.WriteAt(header, 0); err != nil {
+		return nil, fmt.Errorf("failed to write value log record: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return nil, fmt.Errorf("failed to sync value log segment: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close value log segment: %w", err)
+	}
+
+	if err := l.install(f.Name(), hash, end); err != nil {
+		return nil, err
+	}
+	return valuePointer(hash), nil
+}
+
+// install makes the file at path, holding the record of the value with the
+// given hash and size bytes long, the active segment, unless the log holds
+// the value already
+func (l *valueLog) install(path string, hash valueHash, size int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return ErrEngineClosed
+	}
+	if l.touched != nil {
+		l.touched[hash] = true
+	}
+	if _, ok := l.index[hash]; ok {
+		return nil
+	}
+
+	n := l.active + 1
+	if err := os.Rename(path, l.segmentPath(n)); err != nil {
+		return fmt.Errorf("failed to create value log segment: %w", err)
+	}
+	if l.syncDirs {
+		if err := fsyncDir(l.dir); err != nil {
+			return fmt.Errorf("failed to sync value log directory: %w", err)
+		}
+	}
+	f, err := os.OpenFile(l.segmentPath(n), os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open value log segment: %w", err)
+	}
+
+	l.files[n] = f
+	l.sizes[n] = size
+	l.active = n
+	l.index[hash] = valueLogLocation{segment: n, size: int(size - valueLogRecordHeaderSize)}
+	l.bytes += size - valueLogRecordHeaderSize
+	return nil
+}
+
+// valueLogReader reads a value of the log in chunks (see Engine.GetStream).
+// The value is looked up again for every chunk, so it can be read while a
+// collection moves it to another segment; the reader is registered like an
+// iterator, so no collection removes it until the reader is closed.
+type valueLogReader struct {
+	log *valueLog
+
+	// Hash of the value
+	hash valueHash
+
+	// Generation the reader is registered in
+	generation uint64
+
+	// Number of bytes of the value read, and its size
+	offset, size int64
+
+	// Checksum of the record up to the bytes read, and the one of the
+	// whole record
+	crc, checksum uint32
+
+	// Whether the reader has been closed
+	closed bool
+}
+
+// stream returns a reader of the value a stored value stands for, taking
+// over the registration of the reader in the given generation: a reader
+// of the log for a pointer, or of the stored value itself. A read-only log
+// reloads its index once when a pointer is not in it, like resolve.
+func (l *valueLog) stream(stored []byte, generation uint64) (io.ReadCloser, error) {
+	if l == nil || !isValuePointer(stored) {
+		l.closeReader(generation)
+		return io.NopCloser(bytes.NewReader(stored)), nil
+	}
+
+	hash := pointerHash(stored)
+	r, ok, err := l.openStream(hash, generation)
+	if err == nil && !ok && l.readOnly {
+		var present bool
+		if present, err = l.reload(); err == nil && !present {
+			// The writer never stored values in a log
+			l.closeReader(generation)
+			return io.NopCloser(bytes.NewReader(stored)), nil
+		}
+		if err == nil {
+			r, ok, err = l.openStream(hash, generation)
+		}
+	}
+	if err == nil && !ok {
+		err = fmt.Errorf("%w: %x", ErrValueReclaimed, hash[:8])
+	}
+	if err != nil {
+		l.closeReader(generation)
+		return nil, err
+	}
+	return r, nil
+}
+
+// openStream returns a reader of the value with the given hash, reporting
+// whether the log holds it
+func (l *valueLog) openStream(hash valueHash, generation uint64) (*valueLogReader, bool, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.closed {
+		return nil, false, ErrEngineClosed
+	}
+	loc, ok := l.index[hash]
+	if !ok {
+		return nil, false, nil
+	}
+
+	header := make([]byte, valueLogRecordHeaderSize)
+	if _, err := l.files[loc.segment].ReadAt(header, loc.offset); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, false, fmt.Errorf("%w: value log record past the end of segment %d", ErrCorrupt, loc.segment)
+		}
+		return nil, false, fmt.Errorf("failed to read value log record: %w", err)
+	}
+	return &valueLogReader{
+		log:        l,
+		hash:       hash,
+		generation: generation,
+		size:       int64(loc.size),
+		crc:        crc32.Update(0, castagnoliTable, header[4:]),
+		checksum:   binary.LittleEndian.Uint32(header[0:4]),
+	}, true, nil
+}
+
+// readAt reads len(p) bytes of the value with the given hash from offset
+func (l *valueLog) readAt(hash valueHash, p []byte, offset int64) (int, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.closed {
+		return 0, ErrEngineClosed
+	}
+	loc, ok := l.index[hash]
+	if !ok {
+		return 0, fmt.Errorf("%w: %x", ErrValueReclaimed, hash[:8])
+	}
+	n, err := l.files[loc.segment].ReadAt(p, loc.offset+valueLogRecordHeaderSize+offset)
+	if errors.Is(err, io.EOF) {
+		return n, fmt.Errorf("%w: value log record past the end of segment %d", ErrCorrupt, loc.segment)
+	}
+	if err != nil {
+		return n, fmt.Errorf("failed to read value log record: %w", err)
+	}
+	return n, nil
+}
+
+// Read reads the next bytes of the value, failing with ErrCorrupt at its
+// end if the record doesn't match its checksum
+func (r *valueLogReader) Read(p []byte) (int, error) {
+	if r.closed {
+		return 0, os.ErrClosed
+	}
+	if r.offset == r.size {
+		if r.crc != r.checksum {
+			return 0, fmt.Errorf("%w: value log record checksum mismatch", ErrCorrupt)
+		}
+		return 0, io.EOF
+	}
+
+	p = p[:min(int64(len(p)), r.size-r.offset)]
+	n, err := r.log.readAt(r.hash, p, r.offset)
+	r.crc = crc32.Update(r.crc, castagnoliTable, p[:n])
+	r.offset += int64(n)
+	return n, err
+}
+
+// Close unregisters the reader, letting collections remove the value
+func (r *valueLogReader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	r.log.closeReader(r.generation)
+	return nil
+}
+
+// PutStream stores the length bytes read from r as the value of key, like
+// Put, e.g. for a value too large to hold in memory. With a value log (see
+// Options.ValueLogThreshold), a value of at least the threshold is copied
+// to the log in chunks as it is read, up to MaxValueLogValueSize bytes,
+// and only the pointer to it goes through the WAL and the memory table.
+// Other values are read whole and stored like Put, as is every value when
+// secondary indexes are configured, since their extractors take whole
+// values. If r ends before length bytes, PutStream fails with
+// io.ErrUnexpectedEOF and stores nothing.
+func (e *Engine) PutStream(key []byte, r io.Reader, length int64) error {
+	if length < 0 {
+		return fmt.Errorf("invalid value length %d", length)
+	}
+
+	// Checked before the value is read
+	e.mu.RLock()
+	closed := e.closed
+	e.mu.RUnlock()
+	if closed {
+		return ErrEngineClosed
+	}
+	if e.readOnly {
+		return ErrReadOnly
+	}
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	if !e.values.streams(length) || e.indexes != nil {
+		value := make([]byte, length)
+		if _, err := io.ReadFull(r, value); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return fmt.Errorf("failed to read value: %w", err)
+		}
+		return e.Put(key, value)
+	}
+
+	// Keep collections out until the pointer is written
+	defer e.values.importLock()()
+
+	// Streamed without the engine lock: the value is invisible until then
+	stored, err := e.values.storeStream(r, length)
+	if err != nil {
+		return fmt.Errorf("failed to write to value log: %w", err)
+	}
+
+	defer e.watchdog.track("PutStream")()
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.closed {
+		return ErrEngineClosed
+	}
+
+	shard := e.memTable.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if err := e.putStoredLocked(shard, key, stored); err != nil {
+		return err
+	}
+
+	e.userBytesWritten.Add(int64(len(key)) + length)
+	return nil
+}
+
+// GetStream returns a reader of the value of key, like Get, e.g. to send a
+// value too large to hold in memory. A value stored in the value log is
+// read from it in chunks as the reader is read, and stays readable until
+// the reader is closed, even if the key is overwritten and the value
+// collected meanwhile; the reader fails with ErrCorrupt at the end of a
+// value not matching its checksum. Other values are read whole. The reader
+// must be closed.
+func (e *Engine) GetStream(key []byte) (io.ReadCloser, error) {
+	defer e.watchdog.track("GetStream")()
+
+	return e.getStream(context.Background(), key, e.readOnly)
+}
+
+// GetStreamContext returns a reader of the value of key like GetStream,
+// giving up with ctx's error like GetContext
+func (e *Engine) GetStreamContext(ctx context.Context, key []byte) (io.ReadCloser, error) {
+	defer e.watchdog.track("GetStream")()
+
+	return e.getStream(ctx, key, e.readOnly)
+}
+
+// getStream implements GetStream like get
+func (e *Engine) getStream(ctx context.Context, key []byte, refresh bool) (io.ReadCloser, error) {
+	// Registered before the pointer is read: a collection starting later
+	// waits for the reader, and one started before counted the pointer or
+	// saw it written
+	generation := e.values.openReader()
+
+	stored, err := e.getStored(ctx, key, refresh)
+	if err != nil {
+		e.values.closeReader(generation)
+		return nil, err
+	}
+	r, err := e.values.stream(stored, generation)
+	if refresh && errors.Is(err, ErrValueReclaimed) {
+		// The writer overwrote the key and reclaimed its value since
+		if err := e.refresh(); err != nil {
+			return nil, err
+		}
+		return e.getStream(ctx, key, false)
+	}
+	return r, err
+}
@@ -2,14 +2,19 @@ package storage
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"hash/crc32"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/0xReLogic/river/internal/data/compress"
 )
 
 // WAL (Write-Ahead Log) provides durability guarantees by logging
@@ -27,14 +32,85 @@ type WAL struct {
 	// Mutex to protect concurrent access
 	mu sync.Mutex
 
-	// Current WAL file size
+	// Logical size of the current WAL file: the bytes of entries written.
+	// A preallocated file is larger on disk.
 	size int64
 
+	// Bytes of the current WAL file known to be synced to disk. Entries
+	// appended asynchronously lie between synced and size until synced.
+	synced int64
+
+	// Futures of asynchronously appended entries not yet synced, in order
+	pending []chan error
+
+	// Whether the background syncer is syncing the file without holding mu
+	syncing bool
+
+	// Signalled when the background syncer finishes a sync
+	syncDone *sync.Cond
+
+	// Wakes the background syncer when entries are pending
+	syncCh chan struct{}
+
+	// Closed to stop the background syncer
+	quit chan struct{}
+
+	// Whether to preallocate WAL files to maxSize
+	preallocate bool
+
+	// Size from which PUT values are compressed; zero disables compression
+	compressionThreshold int
+
+	// Buffered bytes at which asynchronously appended entries are written
+	// to the file ahead of their sync; zero leaves them to the syncer
+	bufferFlushSize int
+
+	// Whether the current file was preallocated beyond its logical size
+	preallocated bool
+
+	// Total bytes of entries written to all WAL files
+	bytesWritten atomic.Int64
+
 	// Maximum size of a WAL file before rotation
 	maxSize int64
 
-	// CRC32 table for checksums
+	// Index of the WAL segments, oldest first; nil until loaded
+	segments []walSegment
+
+	// Number of times a WAL segment was opened to be replayed or indexed
+	segmentOpens atomic.Int64
+
+	// CRC32 table for the checksum of the segment index
 	crc32Table *crc32.Table
+
+	// Checksum algorithm of the entries of new WAL files, and of the
+	// entries of the current file, recorded in its header
+	checksum     WALChecksum
+	fileChecksum WALChecksum
+
+	// Whether WAL files without a valid header are skipped rather than
+	// failing the WAL, and the ones skipped so far
+	bestEffort bool
+	skipped    map[string]bool
+
+	// Reports the corrupt entries replays skip (see SkipCorruptEntries);
+	// nil fails the replay on the first one
+	skipCorrupt func(segment string, err error)
+
+	// Receives the rotation events; nil drops them
+	events *eventDispatcher
+
+	// Clock of the entry timestamps; nil for the system clock
+	clock Clock
+
+	// Timestamp of the last entry written, or replayed before the first
+	// write. Entries get strictly increasing timestamps even if the clock
+	// stands still or goes back, which replays from a timestamp rely on.
+	lastTimestamp int64
+
+	// Error of the first failed sync, wrapping ErrEnginePoisoned; once set,
+	// every append fails with it
+	poisoned error
 }
 
 // WALEntry represents a single entry in the WAL
@@ -49,14 +125,36 @@ type WALEntry struct {
 	Key, Value []byte
 }
 
+// encodedSize returns the number of bytes the entry occupies in a WAL file
+func (e WALEntry) encodedSize() int64 {
+	// CRC32 + entry size + timestamp + op type + key length + key + value length + value
+	return int64(4 + 4 + 8 + 1 + 4 + len(e.Key) + 4 + len(e.Value))
+}
+
 // WAL operation types
 const (
 	OpTypePut    byte = 1
 	OpTypeDelete byte = 2
+
+	// OpTypeImport marks a committed bulk import: the key is the name of
+	// its staging directory, the value the time its initial flush moved the
+	// memory table aside (see Engine.BulkImport)
+	OpTypeImport byte = 3
+
+	// opFlagCompressed is set in the operation type of an entry whose value
+	// is compressed with LZ4. The stored value starts with the uncompressed
+	// length (4 bytes).
+	opFlagCompressed byte = 0x80
 )
 
 // NewWAL creates a new WAL with the given directory
 func NewWAL(walDir string) (*WAL, error) {
+	return newWAL(walDir, false)
+}
+
+// newWAL creates a new WAL with the given directory, skipping WAL files
+// without a valid header in best-effort mode
+func newWAL(walDir string, bestEffort bool) (*WAL, error) {
 	// Create WAL directory if it doesn't exist
 	if err := os.MkdirAll(walDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create WAL directory: %w", err)
@@ -66,18 +164,78 @@ func NewWAL(walDir string) (*WAL, error) {
 		walDir:     walDir,
 		maxSize:    64 * 1024 * 1024, // 64MB
 		crc32Table: crc32.MakeTable(crc32.Castagnoli),
+		syncCh:     make(chan struct{}, 1),
+		quit:       make(chan struct{}),
+		bestEffort: bestEffort,
 	}
+	wal.syncDone = sync.NewCond(&wal.mu)
 
 	// Create or open the current WAL file
 	if err := wal.openCurrentFile(); err != nil {
 		return nil, err
 	}
 
+	// Load the segment index, rebuilding it if needed
+	if err := wal.loadIndex(); err != nil {
+		wal.file.Close()
+		return nil, fmt.Errorf("failed to load WAL index: %w", err)
+	}
+
+	// Sync asynchronously appended entries in the background
+	go wal.syncLoop()
+
 	return wal, nil
 }
 
+// openWALReadOnly opens the WAL in the given directory for replay only. It
+// doesn't create the directory or open a file for writing, and appends fail.
+func openWALReadOnly(walDir string) *WAL {
+	return &WAL{
+		walDir:     walDir,
+		maxSize:    64 * 1024 * 1024, // 64MB
+		crc32Table: crc32.MakeTable(crc32.Castagnoli),
+	}
+}
+
+// OpenWALReadOnly opens the WAL in the given directory for replay only, e.g.
+// to recover its entries with a tool. Unlike NewWAL, it never modifies the
+// directory: no file is created, removed or opened for writing, and
+// appends fail.
+func OpenWALReadOnly(walDir string) (*WAL, error) {
+	info, err := os.Stat(walDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open WAL directory: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("failed to open WAL directory: %s is not a directory", walDir)
+	}
+	return openWALReadOnly(walDir), nil
+}
+
+// SkipCorruptEntries makes replays skip corrupt entries rather than fail,
+// reporting each one with the base name of its segment. An entry failing
+// its checksum is skipped using its size field; an entry that can't be
+// read whole ends the replay of its segment, which continues with the next
+// segment, and a segment without a valid header is skipped whole. A
+// corrupt size field makes the entries after it unreadable.
+func (w *WAL) SkipCorruptEntries(report func(segment string, err error)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.skipCorrupt = report
+}
+
 // openCurrentFile opens the current WAL file or creates a new one
 func (w *WAL) openCurrentFile() error {
+	// An empty latest file is replaced by a new one rather than continuing
+	// an older file, so the current file stays the one created last
+	latestEmpty, err := w.removeEmptySegments()
+	if err != nil {
+		return err
+	}
+	if latestEmpty {
+		return w.createFile()
+	}
+
 	// Find the latest WAL file or create a new one
 	files, err := os.ReadDir(w.walDir)
 	if err != nil {
@@ -105,58 +263,460 @@ func (w *WAL) openCurrentFile() error {
 		}
 	}
 
-	var path string
 	if latestFile == "" {
-		// Create a new WAL file
-		path = filepath.Join(w.walDir, fmt.Sprintf("%d.wal", time.Now().UnixNano()))
-		w.size = 0
-	} else {
-		// Open the latest WAL file
-		path = filepath.Join(w.walDir, latestFile)
+		return w.createFile()
+	}
+
+	// Continue the latest WAL file after its last entry, unless it is in
+	// another byte order than the entries written
+	path := filepath.Join(w.walDir, latestFile)
+	size, header, err := walLogicalSize(path)
+	if w.skipSegment(path, err) {
+		return w.createFile()
+	}
+	if err != nil {
+		return err
+	}
+	if header.byteOrder() != binary.LittleEndian {
+		return w.createFile()
+	}
+
+	return w.openFile(path, size, header.checksum)
+}
+
+// removeEmptySegments removes the zero-length WAL files, e.g. left by a
+// crash of an older version after a file was created and before anything
+// was written to it. They hold no entries, but would be rejected for their
+// missing header. It reports whether the latest file was empty.
+func (w *WAL) removeEmptySegments() (bool, error) {
+	ids, err := listWALSegments(w.walDir)
+	if err != nil {
+		return false, fmt.Errorf("failed to read WAL directory: %w", err)
+	}
+
+	removed, latestEmpty := false, false
+	for i, id := range ids {
+		path := w.segmentPath(id)
 		info, err := os.Stat(path)
 		if err != nil {
-			return fmt.Errorf("failed to stat WAL file: %w", err)
+			return false, fmt.Errorf("failed to stat WAL file: %w", err)
 		}
-		w.size = info.Size()
+		if info.Size() > 0 {
+			continue
+		}
+
+		fmt.Printf("Warning: removing empty WAL file %s\n", filepath.Base(path))
+		if err := os.Remove(path); err != nil {
+			return false, fmt.Errorf("failed to remove empty WAL file: %w", err)
+		}
+		removed = true
+		latestEmpty = i == len(ids)-1
+	}
+
+	if removed {
+		if err := fsyncDir(w.walDir); err != nil {
+			return false, fmt.Errorf("failed to sync WAL directory: %w", err)
+		}
+	}
+	return latestEmpty, nil
+}
+
+// createFile starts a new WAL file, with just a header recording the
+// configured checksum algorithm
+func (w *WAL) createFile() error {
+	id := time.Now().UnixNano()
+	path := w.segmentPath(id)
+	if err := createWALSegment(path, id, w.checksum); err != nil {
+		return err
+	}
+	if err := w.openFile(path, walHeaderSize, w.checksum); err != nil {
+		return err
 	}
 
-	// Open the file for appending
-	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if w.segments != nil {
+		w.segments = append(w.segments, walSegment{id: id})
+	}
+
+	return nil
+}
+
+// openFile opens the WAL file at path for writing at the logical offset
+// size, appending entries with the file's checksum algorithm
+func (w *WAL) openFile(path string, size int64, checksum WALChecksum) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return fmt.Errorf("failed to open WAL file: %w", err)
 	}
 
+	if _, err := file.Seek(size, io.SeekStart); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to seek WAL file: %w", err)
+	}
+
+	// A file left larger than its entries was preallocated before
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat WAL file: %w", err)
+	}
+
 	w.file = file
-	w.writer = bufio.NewWriter(file)
+	w.writer = w.newWriter(file)
+	w.size = size
+	w.synced = size
+	w.preallocated = info.Size() > size
+	w.fileChecksum = checksum
+
+	if w.preallocate {
+		w.preallocateFile()
+	}
 
 	return nil
 }
 
+// newWriter returns the buffered writer of a WAL file, large enough to
+// hold bufferFlushSize bytes so it doesn't write them out any earlier
+func (w *WAL) newWriter(file *os.File) *bufio.Writer {
+	return bufio.NewWriterSize(file, max(w.bufferFlushSize, defaultWALBufferSize))
+}
+
+// defaultWALBufferSize is the size of the buffered writer of a WAL file
+const defaultWALBufferSize = 4096
+
+// preallocateFile reserves maxSize bytes for the current file, so appends
+// don't have to extend it. Preallocation is best effort: when the platform
+// or filesystem doesn't support it, the file simply grows as it is written.
+func (w *WAL) preallocateFile() {
+	if err := preallocate(w.file, w.maxSize); err == nil {
+		w.preallocated = true
+	}
+}
+
+// setChecksum sets the checksum algorithm of new WAL files, rotating to a
+// new file if the current one uses another algorithm
+func (w *WAL) setChecksum(checksum WALChecksum) error {
+	if !checksum.valid() {
+		return fmt.Errorf("unknown WAL checksum algorithm %d", uint8(checksum))
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.checksum = checksum
+	if w.fileChecksum == checksum {
+		return nil
+	}
+	return w.rotate()
+}
+
+// setCompressionThreshold sets the size from which PUT values are
+// compressed, zero disabling compression
+func (w *WAL) setCompressionThreshold(threshold int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.compressionThreshold = threshold
+}
+
+// compressWALValue compresses a value as stored in a WAL entry flagged
+// with opFlagCompressed, or returns false if compression doesn't make it
+// smaller
+func compressWALValue(value []byte) ([]byte, bool) {
+	compressed, err := compress.NewLZ4().Compress(value)
+	if err != nil || 4+len(compressed) >= len(value) {
+		return nil, false
+	}
+	stored := make([]byte, 4+len(compressed))
+	binary.LittleEndian.PutUint32(stored, uint32(len(value)))
+	copy(stored[4:], compressed)
+	return stored, true
+}
+
+// decompressWALValue restores a value stored by compressWALValue, whose
+// length prefix is in the byte order of its segment
+func decompressWALValue(stored []byte, order binary.ByteOrder) ([]byte, error) {
+	if len(stored) < 4 {
+		return nil, fmt.Errorf("%w: compressed WAL value of %d bytes", ErrCorrupt, len(stored))
+	}
+	value, err := compress.NewLZ4().DecompressSize(stored[4:], int(order.Uint32(stored)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decompress WAL value: %v", ErrCorrupt, err)
+	}
+	return value, nil
+}
+
+// setBufferFlushSize sets the buffered bytes at which asynchronously
+// appended entries are written to the file before they are synced, zero
+// leaving them to the syncer
+func (w *WAL) setBufferFlushSize(size int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.writer.Flush(); err != nil {
+		return fmt.Errorf("failed to flush WAL: %w", err)
+	}
+	w.bufferFlushSize = size
+	w.writer = w.newWriter(w.file)
+	return nil
+}
+
+// setPreallocate enables or disables preallocation, preallocating the
+// current file right away when enabled
+func (w *WAL) setPreallocate(enabled bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.preallocate = enabled
+	if enabled && !w.preallocated {
+		w.preallocateFile()
+	}
+}
+
+// trimFile truncates a preallocated file to its logical size
+func (w *WAL) trimFile() error {
+	if !w.preallocated {
+		return nil
+	}
+
+	if err := w.file.Truncate(w.size); err != nil {
+		return fmt.Errorf("failed to truncate WAL file: %w", err)
+	}
+	if err := fsyncFile(w.file); err != nil {
+		return w.poison(err)
+	}
+	w.preallocated = false
+
+	return nil
+}
+
+// walLogicalSize returns the offset just past the last complete entry of a
+// WAL file, ignoring a zero-filled preallocated tail, and its header
+func walLogicalSize(path string) (int64, walHeader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, walHeader{}, fmt.Errorf("failed to open WAL file: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, walHeader{}, fmt.Errorf("failed to stat WAL file: %w", err)
+	}
+
+	walHeader, err := readWALHeader(file)
+	if err != nil {
+		return 0, walHeader, err
+	}
+	size := walHeader.size
+	if _, err := file.Seek(size, io.SeekStart); err != nil {
+		return 0, walHeader, fmt.Errorf("failed to seek WAL file: %w", err)
+	}
+
+	reader := bufio.NewReader(file)
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return size, walHeader, nil // End of file, possibly after a partial header
+		}
+
+		// An entry is never empty, so a zero size starts the preallocated tail
+		entrySize := int64(walHeader.byteOrder().Uint32(header[4:]))
+		if entrySize == 0 || size+8+entrySize > info.Size() {
+			return size, walHeader, nil
+		}
+
+		if _, err := reader.Discard(int(entrySize)); err != nil {
+			return 0, walHeader, fmt.Errorf("failed to read WAL file: %w", err)
+		}
+		size += 8 + entrySize
+	}
+}
+
 // AppendPut appends a PUT operation to the WAL
 func (w *WAL) AppendPut(key, value []byte) error {
-	return w.append(OpTypePut, key, value)
+	_, err := w.append(OpTypePut, key, value)
+	return err
 }
 
 // AppendDelete appends a DELETE operation to the WAL
 func (w *WAL) AppendDelete(key []byte) error {
-	return w.append(OpTypeDelete, key, nil)
+	_, err := w.append(OpTypeDelete, key, nil)
+	return err
+}
+
+// AppendImport appends the marker committing the bulk import staged in the
+// directory with the given name, whose initial flush moved the memory table
+// aside at the WAL timestamp flushed
+func (w *WAL) AppendImport(name string, flushed int64) error {
+	_, err := w.append(OpTypeImport, []byte(name), binary.LittleEndian.AppendUint64(nil, uint64(flushed)))
+	return err
 }
 
-// append appends an operation to the WAL
-func (w *WAL) append(opType byte, key, value []byte) error {
+// append appends an operation to the WAL and waits for it to be synced. It
+// returns the timestamp of the entry, which the engine uses as the sequence
+// number of the write.
+func (w *WAL) append(opType byte, key, value []byte) (int64, error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	// Check if we need to rotate the WAL file
-	if w.size >= w.maxSize {
-		if err := w.rotate(); err != nil {
-			return err
+	if w.writer == nil {
+		return 0, ErrReadOnly
+	}
+	if w.poisoned != nil {
+		return 0, w.poisoned
+	}
+
+	timestamp, err := w.writeEntry(opType, key, value)
+	if err != nil {
+		return 0, err
+	}
+
+	return timestamp, w.syncLocked()
+}
+
+// appendDeletes appends DELETE operations for keys to the WAL and waits for
+// them to be synced together, returning the timestamps of the entries. The
+// entries are written to one file, rotating it before rather than between
+// them, so if writing or syncing any of them fails, the unsynced entries are
+// discarded and none of them is replayed.
+func (w *WAL) appendDeletes(keys [][]byte) ([]int64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.writer == nil {
+		return nil, ErrReadOnly
+	}
+	if w.poisoned != nil {
+		return nil, w.poisoned
+	}
+
+	if err := w.rotateIfFull(); err != nil {
+		return nil, err
+	}
+	timestamps := make([]int64, len(keys))
+	for i, key := range keys {
+		timestamp, err := w.bufferEntry(OpTypeDelete, key, nil)
+		if err != nil {
+			return nil, err
+		}
+		timestamps[i] = timestamp
+	}
+
+	if err := w.syncLocked(); err != nil {
+		return nil, err
+	}
+	return timestamps, nil
+}
+
+// AppendPutAsync appends a PUT operation to the WAL without waiting for it
+// to reach disk. The entry is synced by the background syncer together with
+// the other entries appended meanwhile (or by an earlier synchronous append),
+// and the returned channel receives nil once it is durable, or the error
+// that prevented it. The error returned directly means the entry could not
+// be written at all.
+func (w *WAL) AppendPutAsync(key, value []byte) (<-chan error, error) {
+	_, done, err := w.appendPutAsync(key, value)
+	return done, err
+}
+
+// appendPutAsync is AppendPutAsync, also returning the timestamp of the entry
+func (w *WAL) appendPutAsync(key, value []byte) (int64, <-chan error, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.writer == nil {
+		return 0, nil, ErrReadOnly
+	}
+	if w.poisoned != nil {
+		return 0, nil, w.poisoned
+	}
+
+	timestamp, err := w.writeEntry(OpTypePut, key, value)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// Hand the buffered entries to the OS once there are enough of them,
+	// without waiting for the sync: a crash of the process no longer loses
+	// them, though a crash of the machine still may until they are synced
+	if w.bufferFlushSize > 0 && w.writer.Buffered() >= w.bufferFlushSize {
+		if err := w.writer.Flush(); err != nil {
+			return 0, nil, w.rollback(fmt.Errorf("failed to flush WAL: %w", err))
+		}
+	}
+
+	done := make(chan error, 1)
+	w.pending = append(w.pending, done)
+
+	// Wake the syncer, unless it is already due to run
+	select {
+	case w.syncCh <- struct{}{}:
+	default:
+	}
+
+	return timestamp, done, nil
+}
+
+// advanceTimestamp makes the timestamps of the entries written next greater
+// than timestamp, e.g. the last one replayed
+func (w *WAL) advanceTimestamp(timestamp int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lastTimestamp = max(w.lastTimestamp, timestamp)
+}
+
+// reserveTimestamp returns a timestamp greater than those of the entries
+// written so far and less than those of the entries written next, without
+// writing an entry, e.g. for the sequence number of imported blocks
+func (w *WAL) reserveTimestamp() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.nextTimestamp()
+}
+
+// nextTimestamp returns the timestamp of the next entry: the time of the
+// clock, or one past the last timestamp if the clock hasn't moved past it.
+// Callers must hold w.mu.
+func (w *WAL) nextTimestamp() int64 {
+	timestamp := clockNow(w.clock).UnixNano()
+	if timestamp <= w.lastTimestamp {
+		timestamp = w.lastTimestamp + 1
+	}
+	w.lastTimestamp = timestamp
+	return timestamp
+}
+
+// writeEntry encodes an operation and writes it to the WAL buffer, rotating
+// the file first if it is full, and returns the timestamp of the entry.
+// Callers must hold w.mu.
+func (w *WAL) writeEntry(opType byte, key, value []byte) (int64, error) {
+	if err := w.rotateIfFull(); err != nil {
+		return 0, err
+	}
+	return w.bufferEntry(opType, key, value)
+}
+
+// rotateIfFull rotates the WAL file once it reaches the maximum size; a
+// file with no entries past its header is never full. Callers must hold w.mu.
+func (w *WAL) rotateIfFull() error {
+	if w.size >= w.maxSize && w.size > walHeaderSize {
+		return w.rotate()
+	}
+	return nil
+}
+
+// bufferEntry is writeEntry without the rotation. Callers must hold w.mu.
+func (w *WAL) bufferEntry(opType byte, key, value []byte) (int64, error) {
+	// Compress a large value, flagging it in the operation type
+	if w.compressionThreshold > 0 && opType == OpTypePut && len(value) >= w.compressionThreshold {
+		if compressed, ok := compressWALValue(value); ok {
+			opType |= opFlagCompressed
+			value = compressed
 		}
 	}
 
 	// Create WAL entry
 	entry := WALEntry{
-		Timestamp: time.Now().UnixNano(),
+		Timestamp: w.nextTimestamp(),
 		OpType:    opType,
 		Key:       key,
 		Value:     value,
@@ -172,11 +732,11 @@ func (w *WAL) append(opType byte, key, value []byte) error {
 	// - 4 bytes: CRC32 (calculated later)
 	// - 4 bytes: Entry size
 	// - 8 bytes: Timestamp
-	// - 1 byte:  Operation type
+	// - 1 byte:  Operation type, with opFlagCompressed if the value is compressed
 	// - 4 bytes: Key length
 	// - N bytes: Key
-	// - 4 bytes: Value length (if PUT)
-	// - M bytes: Value (if PUT)
+	// - 4 bytes: Value length (if not DELETE)
+	// - M bytes: Value (if not DELETE)
 
 	// Prepare buffer for the entry
 	buf := make([]byte, entrySize+8) // +8 for CRC32 and entry size
@@ -204,8 +764,8 @@ func (w *WAL) append(opType byte, key, value []byte) error {
 	copy(buf[offset:], entry.Key)
 	offset += len(entry.Key)
 
-	// Value length and value (if PUT)
-	if entry.OpType == OpTypePut {
+	// Value length and value (if not DELETE)
+	if entry.OpType != OpTypeDelete {
 		binary.LittleEndian.PutUint32(buf[offset:], uint32(len(entry.Value)))
 		offset += 4
 
@@ -217,45 +777,210 @@ func (w *WAL) append(opType byte, key, value []byte) error {
 		offset += 4
 	}
 
-	// Calculate CRC32 (excluding the CRC32 field itself)
-	crc := crc32.Checksum(buf[4:offset], w.crc32Table)
+	// Calculate the checksum (excluding the checksum field itself)
+	crc := w.fileChecksum.sum(buf[4:offset])
 	binary.LittleEndian.PutUint32(buf[0:], crc)
 
-	// Write the entry to the WAL file
+	// Write the entry to the WAL buffer. On failure (e.g. a full disk) the
+	// partially written entry is discarded, so the file stays replayable.
 	n, err := w.writer.Write(buf[:offset])
 	if err != nil {
-		return fmt.Errorf("failed to write WAL entry: %w", err)
+		return 0, w.rollback(fmt.Errorf("failed to write WAL entry: %w", err))
 	}
 
 	// Update WAL file size
+	w.indexEntry(entry.Timestamp, w.size)
 	w.size += int64(n)
+	w.bytesWritten.Add(int64(n))
+
+	return entry.Timestamp, nil
+}
+
+// Sync flushes the WAL buffer and syncs the file, making every entry
+// appended so far durable, including the entries appended asynchronously
+// that the background syncer hasn't synced yet
+func (w *WAL) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.writer == nil {
+		return ErrReadOnly
+	}
+
+	// A batch the background syncer is syncing is only durable if its sync
+	// succeeds, which poisons the WAL otherwise
+	w.waitSync()
+	if w.poisoned != nil {
+		return w.poisoned
+	}
+
+	if w.synced < w.size {
+		return w.syncLocked()
+	}
+	return nil
+}
 
+// syncLocked flushes the WAL buffer and syncs the file, completing the
+// futures of pending entries. Callers must hold w.mu.
+func (w *WAL) syncLocked() error {
 	// Flush to disk
 	if err := w.writer.Flush(); err != nil {
-		return fmt.Errorf("failed to flush WAL: %w", err)
+		return w.rollback(fmt.Errorf("failed to flush WAL: %w", err))
 	}
 
 	// Sync to disk for durability
-	if err := w.file.Sync(); err != nil {
-		return fmt.Errorf("failed to sync WAL: %w", err)
+	if err := fsyncFile(w.file); err != nil {
+		return w.rollback(w.poison(err))
 	}
 
+	w.synced = w.size
+	completeFutures(w.pending, nil)
+	w.pending = nil
+
 	return nil
 }
 
+// syncLoop syncs asynchronously appended entries in batches until the WAL
+// is closed. The file is synced without holding w.mu, so appends continue
+// meanwhile and join the next batch.
+func (w *WAL) syncLoop() {
+	for {
+		select {
+		case <-w.quit:
+			return
+		case <-w.syncCh:
+		}
+
+		w.mu.Lock()
+		if len(w.pending) == 0 {
+			w.mu.Unlock()
+			continue
+		}
+		if err := w.writer.Flush(); err != nil {
+			w.rollback(fmt.Errorf("failed to flush WAL: %w", err))
+			w.mu.Unlock()
+			continue
+		}
+
+		// Take the batch and sync it outside the lock
+		batch, target, file := w.pending, w.size, w.file
+		w.pending = nil
+		w.syncing = true
+		w.mu.Unlock()
+
+		err := fsyncFile(file)
+
+		w.mu.Lock()
+		w.syncing = false
+		w.syncDone.Broadcast()
+		switch {
+		case err == nil || w.synced >= target:
+			// Synced here, or by a synchronous append meanwhile
+			if target > w.synced {
+				w.synced = target
+			}
+			completeFutures(batch, nil)
+		default:
+			err = w.poison(err)
+			completeFutures(batch, err)
+			w.rollback(err)
+		}
+		w.mu.Unlock()
+	}
+}
+
+// poison records a failed sync of the WAL file, returning the error that
+// every later append fails with. Callers must hold w.mu.
+func (w *WAL) poison(err error) error {
+	if w.poisoned == nil {
+		w.poisoned = fmt.Errorf("%w: failed to sync WAL: %w", ErrEnginePoisoned, err)
+		fmt.Printf("Warning: WAL sync failed, refusing writes until the engine is reopened: %v\n", err)
+	}
+	return w.poisoned
+}
+
+// poisonErr returns the error of the first failed sync of the WAL, or nil
+func (w *WAL) poisonErr() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.poisoned
+}
+
+// waitSync waits until the background syncer is not syncing the file.
+// Callers must hold w.mu.
+func (w *WAL) waitSync() {
+	for w.syncing {
+		w.syncDone.Wait()
+	}
+}
+
+// completeFutures sends the result of a sync to the futures of its entries
+func completeFutures(futures []chan error, err error) {
+	for _, done := range futures {
+		done <- err
+		close(done)
+	}
+}
+
+// rollback discards the entries that are not synced yet after a write or
+// sync failed with err: the file is truncated back to the end of the last
+// synced entry, the writer restarts there, and the futures of pending
+// entries receive err. It returns err, annotated if the rollback itself fails.
+func (w *WAL) rollback(err error) error {
+	w.waitSync()
+	completeFutures(w.pending, err)
+	w.pending = nil
+	w.size = w.synced
+	w.unindexFrom(w.size)
+
+	if truncErr := w.file.Truncate(w.size); truncErr != nil {
+		return fmt.Errorf("%w (failed to truncate unsynced entries: %v)", err, truncErr)
+	}
+	if _, seekErr := w.file.Seek(w.size, io.SeekStart); seekErr != nil {
+		return fmt.Errorf("%w (failed to seek WAL file: %v)", err, seekErr)
+	}
+	w.writer.Reset(w.file)
+
+	// Truncating dropped any preallocated space
+	w.preallocated = false
+	if w.preallocate {
+		w.preallocateFile()
+	}
+
+	return err
+}
+
 // rotate rotates the WAL file
 func (w *WAL) rotate() error {
-	// Close current file
+	// Sync pending entries before the file is closed
+	w.waitSync()
+	if w.synced < w.size {
+		if err := w.syncLocked(); err != nil {
+			return err
+		}
+	}
+
+	// Close current file, dropping its unused preallocated space
 	if err := w.writer.Flush(); err != nil {
 		return fmt.Errorf("failed to flush WAL: %w", err)
 	}
 
+	if err := w.trimFile(); err != nil {
+		return err
+	}
+
 	if err := w.file.Close(); err != nil {
 		return fmt.Errorf("failed to close WAL file: %w", err)
 	}
 
-	// Open a new WAL file
-	return w.openCurrentFile()
+	// Start a new WAL file
+	if err := w.createFile(); err != nil {
+		return err
+	}
+	w.saveIndex()
+	w.events.emit(Event{Type: EventWALRotated, Path: w.file.Name()})
+
+	return nil
 }
 
 // Replay replays the WAL entries and applies them to the given callback function
@@ -265,83 +990,193 @@ func (w *WAL) Replay(callback func(entry WALEntry) error) error {
 
 // ReplayFrom replays the WAL entries from the given timestamp and applies them to the given callback function
 func (w *WAL) ReplayFrom(fromTimestamp int64, callback func(entry WALEntry) error) error {
-	w.mu.Lock()
-	defer w.mu.Unlock()
+	return w.ReplayFromWithProgress(fromTimestamp, callback, ReplayProgress{})
+}
 
-	// Flush any pending writes
-	if err := w.writer.Flush(); err != nil {
-		return fmt.Errorf("failed to flush WAL: %w", err)
+// ReplayProgress configures the progress reports of a WAL replay
+type ReplayProgress struct {
+	// Callback is invoked with the number of entries and bytes read so far,
+	// including entries skipped as older than the replay timestamp. It is
+	// invoked every Entries entries and every Bytes bytes, and once more at
+	// the end if anything was read since. A nil callback reports nothing.
+	Callback func(entries, bytes int64)
+
+	// Number of entries between reports (0: not by entries)
+	Entries int64
+
+	// Number of bytes between reports (0: not by bytes)
+	Bytes int64
+}
+
+// replayCounter counts the entries and bytes read by a replay and reports
+// them as configured by a ReplayProgress
+type replayCounter struct {
+	// Progress reports to make
+	progress ReplayProgress
+
+	// Entries and bytes read so far
+	entries, bytes int64
+
+	// Entries and bytes at which the next report is due
+	nextEntries, nextBytes int64
+
+	// Entries and bytes at the last report
+	reportedEntries, reportedBytes int64
+}
+
+// newReplayCounter returns a counter reporting as configured by progress
+func newReplayCounter(progress ReplayProgress) *replayCounter {
+	return &replayCounter{
+		progress:    progress,
+		nextEntries: progress.Entries,
+		nextBytes:   progress.Bytes,
 	}
+}
 
-	// List all WAL files
-	files, err := os.ReadDir(w.walDir)
-	if err != nil {
-		return fmt.Errorf("failed to read WAL directory: %w", err)
+// add counts an entry of size bytes, reporting the progress when due
+func (c *replayCounter) add(size int64) {
+	c.entries++
+	c.bytes += size
+	if c.progress.Callback == nil {
+		return
 	}
 
-	// Sort WAL files by timestamp
-	type walFile struct {
-		path      string
-		timestamp int64
+	due := false
+	if c.progress.Entries > 0 && c.entries >= c.nextEntries {
+		due = true
+		c.nextEntries = c.entries + c.progress.Entries
+	}
+	if c.progress.Bytes > 0 && c.bytes >= c.nextBytes {
+		due = true
+		c.nextBytes = c.bytes + c.progress.Bytes
+	}
+	if due {
+		c.report()
 	}
+}
 
-	var walFiles []walFile
-	for _, file := range files {
-		if file.IsDir() || filepath.Ext(file.Name()) != ".wal" {
-			continue
-		}
+// finish reports the final counts if they haven't been reported
+func (c *replayCounter) finish() {
+	if c.progress.Callback != nil && (c.entries != c.reportedEntries || c.bytes != c.reportedBytes) {
+		c.report()
+	}
+}
 
-		// Parse timestamp from filename
-		var timestamp int64
-		_, err := fmt.Sscanf(file.Name(), "%d.wal", &timestamp)
-		if err != nil {
-			continue
-		}
+// report invokes the progress callback with the current counts
+func (c *replayCounter) report() {
+	c.reportedEntries, c.reportedBytes = c.entries, c.bytes
+	c.progress.Callback(c.entries, c.bytes)
+}
 
-		// Skip files that are older than the checkpoint
-		if timestamp < fromTimestamp {
-			continue
-		}
+// ReplayFromWithProgress replays the WAL entries from the given timestamp
+// like ReplayFrom, reporting its progress as configured by progress
+func (w *WAL) ReplayFromWithProgress(fromTimestamp int64, callback func(entry WALEntry) error, progress ReplayProgress) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
-		walFiles = append(walFiles, walFile{
-			path:      filepath.Join(w.walDir, file.Name()),
-			timestamp: timestamp,
-		})
+	// Flush any pending writes (a read-only WAL has no writer)
+	if w.writer != nil {
+		if err := w.writer.Flush(); err != nil {
+			return fmt.Errorf("failed to flush WAL: %w", err)
+		}
 	}
 
-	// Sort by timestamp (oldest first)
-	for i := 0; i < len(walFiles); i++ {
-		for j := i + 1; j < len(walFiles); j++ {
-			if walFiles[i].timestamp > walFiles[j].timestamp {
-				walFiles[i], walFiles[j] = walFiles[j], walFiles[i]
-			}
-		}
+	// Find the segment and offset to start at from the index
+	err := w.loadIndex()
+	if os.IsNotExist(err) && w.writer == nil {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read WAL directory: %w", err)
 	}
+	start, offset := w.replayStart(fromTimestamp)
+	counter := newReplayCounter(progress)
 
-	// Replay each WAL file
-	for _, file := range walFiles {
-		if err := w.replayFileFrom(file.path, fromTimestamp, callback); err != nil {
+	// Replay each WAL file from there, skipping files without entries
+	for i := start; i < len(w.segments); i++ {
+		seg := w.segments[i]
+		if len(seg.points) == 0 {
+			continue
+		}
+		if i > start {
+			offset = 0
+		}
+		path := w.segmentPath(seg.id)
+		if err := w.replayFileFrom(path, offset, fromTimestamp, callback, counter); err != nil && !w.skipSegment(path, err) {
 			return err
 		}
 	}
+	counter.finish()
 
 	return nil
 }
 
+// HistoryOf returns every put and delete of key in the WAL, in timestamp
+// order. The history only reaches back as far as the WAL files still on
+// disk: writes in segments that have been removed are not included.
+func (w *WAL) HistoryOf(key []byte) ([]WALEntry, error) {
+	var history []WALEntry
+	err := w.Replay(func(entry WALEntry) error {
+		if entry.OpType != OpTypeImport && bytes.Equal(entry.Key, key) {
+			history = append(history, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read WAL history: %w", err)
+	}
+
+	// Entries are appended in order, but the wall clock may step backwards
+	sort.SliceStable(history, func(i, j int) bool {
+		return history[i].Timestamp < history[j].Timestamp
+	})
+
+	return history, nil
+}
+
 // replayFile replays a single WAL file
 func (w *WAL) replayFile(path string, callback func(entry WALEntry) error) error {
-	return w.replayFileFrom(path, 0, callback)
+	return w.replayFileFrom(path, 0, 0, callback, nil)
 }
 
-// replayFileFrom replays a single WAL file from the given timestamp
-func (w *WAL) replayFileFrom(path string, fromTimestamp int64, callback func(entry WALEntry) error) error {
+// replayFileFrom replays a single WAL file from the given timestamp,
+// starting at the entry at offset. The entries read are counted by counter,
+// if not nil.
+func (w *WAL) replayFileFrom(path string, offset, fromTimestamp int64, callback func(entry WALEntry) error, counter *replayCounter) error {
 	// Open the WAL file for reading
+	w.segmentOpens.Add(1)
 	file, err := os.Open(path)
 	if err != nil {
 		return fmt.Errorf("failed to open WAL file: %w", err)
 	}
 	defer file.Close()
 
+	// Entries start after the header, and are verified with its algorithm
+	// and parsed in its byte order
+	walHeader, err := readWALHeader(file)
+	if err != nil {
+		return err
+	}
+	checksum, order := walHeader.checksum, walHeader.byteOrder()
+	pos := max(offset, walHeader.size)
+	if _, err := file.Seek(pos, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek WAL file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat WAL file: %w", err)
+	}
+
+	// corrupt reports a corrupt entry when skipping them, returning nil to
+	// continue the replay, and err otherwise
+	corrupt := func(err error) error {
+		if w.skipCorrupt == nil {
+			return err
+		}
+		w.skipCorrupt(filepath.Base(path), err)
+		return nil
+	}
+
 	reader := bufio.NewReader(file)
 
 	for {
@@ -354,24 +1189,42 @@ func (w *WAL) replayFileFrom(path string, fromTimestamp int64, callback func(ent
 			break
 		}
 		if err != nil {
-			return fmt.Errorf("failed to read WAL entry header: %w", err)
+			return corrupt(fmt.Errorf("failed to read WAL entry header: %w", err))
 		}
 
 		// Parse header
-		crc := binary.LittleEndian.Uint32(header[0:])
-		entrySize := binary.LittleEndian.Uint32(header[4:])
+		crc := order.Uint32(header[0:])
+		entrySize := order.Uint32(header[4:])
+
+		// A zero header starts the preallocated tail of the file
+		if crc == 0 && entrySize == 0 {
+			break
+		}
+
+		// A corrupt size field mustn't make us allocate past the file
+		pos += int64(len(header)) + int64(entrySize)
+		if pos > info.Size() {
+			return corrupt(fmt.Errorf("%w: WAL entry of %d bytes runs past the end of %s", ErrCorrupt, entrySize, filepath.Base(path)))
+		}
 
-		// Read entry data
-		data := make([]byte, entrySize)
+		// Read entry data, after its size field
+		checked := make([]byte, 4+entrySize)
+		copy(checked, header[4:])
+		data := checked[4:]
 		_, err = io.ReadFull(reader, data)
 		if err != nil {
-			return fmt.Errorf("failed to read WAL entry data: %w", err)
+			return corrupt(fmt.Errorf("failed to read WAL entry data: %w", err))
 		}
 
-		// Verify CRC32
-		computedCRC := crc32.Checksum(data, w.crc32Table)
-		if computedCRC != crc {
-			return fmt.Errorf("WAL entry corrupted: CRC mismatch")
+		// Verify the checksum (it covers the entry size field and the entry data)
+		if checksum.sum(checked) != crc {
+			if err := corrupt(fmt.Errorf("%w: WAL entry checksum mismatch in %s", ErrCorrupt, filepath.Base(path))); err != nil {
+				return err
+			}
+			continue
+		}
+		if counter != nil {
+			counter.add(int64(len(header) + len(data)))
 		}
 
 		// Parse entry
@@ -379,7 +1232,7 @@ func (w *WAL) replayFileFrom(path string, fromTimestamp int64, callback func(ent
 		offset := 0
 
 		// Timestamp
-		entry.Timestamp = int64(binary.LittleEndian.Uint64(data[offset:]))
+		entry.Timestamp = int64(order.Uint64(data[offset:]))
 		offset += 8
 
 		// Skip entries that are older than the checkpoint
@@ -388,12 +1241,13 @@ func (w *WAL) replayFileFrom(path string, fromTimestamp int64, callback func(ent
 			continue
 		}
 
-		// Operation type
-		entry.OpType = data[offset]
+		// Operation type, and whether the value is compressed
+		entry.OpType = data[offset] &^ opFlagCompressed
+		compressed := data[offset]&opFlagCompressed != 0
 		offset++
 
 		// Key length
-		keyLen := binary.LittleEndian.Uint32(data[offset:])
+		keyLen := order.Uint32(data[offset:])
 		offset += 4
 
 		// Key
@@ -402,7 +1256,7 @@ func (w *WAL) replayFileFrom(path string, fromTimestamp int64, callback func(ent
 		offset += int(keyLen)
 
 		// Value length
-		valueLen := binary.LittleEndian.Uint32(data[offset:])
+		valueLen := order.Uint32(data[offset:])
 		offset += 4
 
 		// Value (if present)
@@ -410,6 +1264,19 @@ func (w *WAL) replayFileFrom(path string, fromTimestamp int64, callback func(ent
 			entry.Value = make([]byte, valueLen)
 			copy(entry.Value, data[offset:offset+int(valueLen)])
 		}
+		if compressed {
+			if entry.Value, err = decompressWALValue(entry.Value, order); err != nil {
+				if err := corrupt(fmt.Errorf("%w in %s", err, filepath.Base(path))); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		// The flushed timestamp of an import is passed on as appended
+		if entry.OpType == OpTypeImport && order != binary.LittleEndian && len(entry.Value) == 8 {
+			entry.Value = binary.LittleEndian.AppendUint64(nil, order.Uint64(entry.Value))
+		}
 
 		// Apply the entry
 		if err := callback(entry); err != nil {
@@ -425,13 +1292,36 @@ func (w *WAL) Close() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
+	// Stop the background syncer and sync what it left pending
+	if w.quit != nil {
+		select {
+		case <-w.quit:
+		default:
+			close(w.quit)
+		}
+	}
+	w.waitSync()
+	if w.writer != nil && w.synced < w.size {
+		if err := w.syncLocked(); err != nil {
+			return err
+		}
+	}
+
 	if w.writer != nil {
 		if err := w.writer.Flush(); err != nil {
 			return fmt.Errorf("failed to flush WAL: %w", err)
 		}
 	}
 
+	if w.writer != nil {
+		w.saveIndex()
+	}
+
 	if w.file != nil {
+		if err := w.trimFile(); err != nil {
+			return err
+		}
+
 		if err := w.file.Close(); err != nil {
 			return fmt.Errorf("failed to close WAL file: %w", err)
 		}
@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"fmt"
+	"hash/crc32"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// WALChecksum selects the checksum algorithm of WAL entries
+type WALChecksum uint8
+
+const (
+	// WALChecksumCRC32C checksums entries with CRC32 (Castagnoli), the
+	// algorithm of WAL segments written before segments had a header
+	WALChecksumCRC32C WALChecksum = iota
+
+	// WALChecksumXXHash checksums entries with the low 32 bits of xxHash64,
+	// cheaper than CRC32C at high write rates without hardware CRC support
+	WALChecksumXXHash
+)
+
+// castagnoliTable is the CRC32 table of WALChecksumCRC32C
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// valid reports whether c is a known algorithm
+func (c WALChecksum) valid() bool {
+	return c <= WALChecksumXXHash
+}
+
+// sum returns the checksum of data under the algorithm
+func (c WALChecksum) sum(data []byte) uint32 {
+	if c == WALChecksumXXHash {
+		return uint32(xxhash.Sum64(data))
+	}
+	return crc32.Checksum(data, castagnoliTable)
+}
+
+// String returns the name of the algorithm
+func (c WALChecksum) String() string {
+	switch c {
+	case WALChecksumCRC32C:
+		return "crc32c"
+	case WALChecksumXXHash:
+		return "xxhash"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(c))
+	}
+}
@@ -0,0 +1,218 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// walMagic starts the header of every WAL segment
+var walMagic = []byte("RVWL")
+
+// walFormatVersion is the format version of the WAL segments written.
+// Segments written before segments had a header are version 0.
+const walFormatVersion = 1
+
+// walHeaderSize is the size of a WAL segment header:
+// - 4 bytes: Magic
+// - 1 byte:  Format version
+// - 1 byte:  Checksum algorithm
+// - 1 byte:  Byte order of the creation timestamp and entries
+// - 1 byte:  Reserved (zero)
+// - 8 bytes: Creation timestamp
+const walHeaderSize = 16
+
+// Byte orders recorded in the WAL segment header. Segments are written
+// little-endian; segments written before the byte order was recorded have
+// a zero byte, so they read as little-endian.
+const (
+	walByteOrderLittle byte = iota
+	walByteOrderBig
+)
+
+// errBadWALHeader is returned, wrapped, for a WAL file without a valid
+// header, which is rejected rather than replayed as empty
+var errBadWALHeader = fmt.Errorf("%w: invalid WAL file header", ErrCorrupt)
+
+// walHeader is the header of a WAL segment
+type walHeader struct {
+	// Format version of the segment
+	version uint8
+
+	// Checksum algorithm of the entries
+	checksum WALChecksum
+
+	// Byte order of the creation timestamp and entries; nil for
+	// little-endian
+	order binary.ByteOrder
+
+	// Time the segment was created; zero for version 0
+	created int64
+
+	// Offset of the first entry
+	size int64
+}
+
+// byteOrder returns the byte order of the creation timestamp and entries
+func (h walHeader) byteOrder() binary.ByteOrder {
+	if h.order == nil {
+		return binary.LittleEndian
+	}
+	return h.order
+}
+
+// encode returns the header as written at the start of the segment
+func (h walHeader) encode() []byte {
+	buf := make([]byte, walHeaderSize)
+	copy(buf, walMagic)
+	buf[4] = h.version
+	buf[5] = byte(h.checksum)
+	if h.byteOrder() == binary.BigEndian {
+		buf[6] = walByteOrderBig
+	}
+	h.byteOrder().PutUint64(buf[8:], uint64(h.created))
+	return buf
+}
+
+// createWALSegment creates the WAL segment at path, created at the given
+// time, with a header recording the checksum algorithm of its entries. The
+// header is written and synced under a temporary name first, so a crash
+// never leaves a segment without its header.
+func createWALSegment(path string, created int64, checksum WALChecksum) error {
+	header := walHeader{version: walFormatVersion, checksum: checksum, created: created}
+
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create WAL file: %w", err)
+	}
+
+	if _, err := file.Write(header.encode()); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write WAL header: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to sync WAL file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to close WAL file: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to rename WAL file: %w", err)
+	}
+	return nil
+}
+
+// readWALHeader reads and validates the header of the WAL segment open in
+// file. A segment without a header is only accepted if it starts with a
+// valid CRC32C entry, as written before segments had a header; an empty or
+// foreign file is rejected with errBadWALHeader. The file is left at an
+// unspecified offset.
+func readWALHeader(file *os.File) (walHeader, error) {
+	name := filepath.Base(file.Name())
+
+	buf := make([]byte, walHeaderSize)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return walHeader{}, fmt.Errorf("failed to read WAL header: %w", err)
+	}
+
+	if n < len(walMagic) || !bytes.Equal(buf[:len(walMagic)], walMagic) {
+		if err := checkLegacyWALSegment(file); err != nil {
+			return walHeader{}, err
+		}
+		return walHeader{checksum: WALChecksumCRC32C, order: binary.LittleEndian}, nil
+	}
+	if n < walHeaderSize {
+		return walHeader{}, fmt.Errorf("%w in %s: truncated header", errBadWALHeader, name)
+	}
+
+	header := walHeader{
+		version:  buf[4],
+		checksum: WALChecksum(buf[5]),
+		size:     walHeaderSize,
+	}
+	if header.version != walFormatVersion {
+		return walHeader{}, fmt.Errorf("%w in %s: unsupported format version %d", errBadWALHeader, name, header.version)
+	}
+	switch buf[6] {
+	case walByteOrderLittle:
+		header.order = binary.LittleEndian
+	case walByteOrderBig:
+		header.order = binary.BigEndian
+	default:
+		return walHeader{}, fmt.Errorf("%w in %s: unknown byte order %d", errBadWALHeader, name, buf[6])
+	}
+	header.created = int64(header.order.Uint64(buf[8:]))
+	if !header.checksum.valid() {
+		return walHeader{}, fmt.Errorf("%w in %s: unknown checksum algorithm %d", errBadWALHeader, name, buf[5])
+	}
+	return header, nil
+}
+
+// checkLegacyWALSegment checks the WAL segment open in file, which has no
+// header, starts with a complete entry with a valid CRC32C
+func checkLegacyWALSegment(file *os.File) error {
+	name := filepath.Base(file.Name())
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat WAL file: %w", err)
+	}
+	if info.Size() == 0 {
+		return fmt.Errorf("%w in %s: empty file", errBadWALHeader, name)
+	}
+
+	// - 4 bytes: CRC32
+	// - 4 bytes: Entry size
+	header := make([]byte, 8)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		return fmt.Errorf("%w in %s: bad magic", errBadWALHeader, name)
+	}
+	entrySize := int64(binary.LittleEndian.Uint32(header[4:]))
+	if entrySize == 0 || 8+entrySize > info.Size() {
+		return fmt.Errorf("%w in %s: bad magic", errBadWALHeader, name)
+	}
+
+	checked := make([]byte, 4+entrySize)
+	if _, err := file.ReadAt(checked, 4); err != nil {
+		return fmt.Errorf("failed to read WAL file: %w", err)
+	}
+	if WALChecksumCRC32C.sum(checked) != binary.LittleEndian.Uint32(header) {
+		return fmt.Errorf("%w in %s: bad magic", errBadWALHeader, name)
+	}
+	return nil
+}
+
+// skipSegment reports whether the WAL segment at path, which failed to be
+// read with err, is skipped: in best-effort mode a segment without a valid
+// header is skipped with a warning, once, instead of failing the WAL. When
+// skipping corrupt entries, it is reported like them instead.
+func (w *WAL) skipSegment(path string, err error) bool {
+	if !w.bestEffort && w.skipCorrupt == nil || !errors.Is(err, errBadWALHeader) {
+		return false
+	}
+
+	if !w.skipped[path] {
+		if w.skipCorrupt != nil {
+			w.skipCorrupt(filepath.Base(path), err)
+		} else {
+			fmt.Printf("Warning: skipping WAL file %s: %v\n", filepath.Base(path), err)
+		}
+		if w.skipped == nil {
+			w.skipped = make(map[string]bool)
+		}
+		w.skipped[path] = true
+	}
+	return true
+}
@@ -0,0 +1,317 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// walIndexFile is the name of the segment index in the WAL directory
+const walIndexFile = "segments.idx"
+
+// walIndexInterval is the minimum distance in bytes between the index
+// points of a segment
+const walIndexInterval = 64 * 1024
+
+// walIndexPoint locates an entry in a WAL segment
+type walIndexPoint struct {
+	// Timestamp of the entry
+	timestamp int64
+
+	// Offset of the entry in the segment
+	offset int64
+}
+
+// walSegment is the index of one WAL segment (file)
+type walSegment struct {
+	// Timestamp in the segment's file name, which orders the segments
+	id int64
+
+	// Index points in offset order, the first one for the segment's first
+	// entry. A segment without points has no entries.
+	points []walIndexPoint
+}
+
+// segmentPath returns the path of the WAL segment with the given id
+func (w *WAL) segmentPath(id int64) string {
+	return filepath.Join(w.walDir, fmt.Sprintf("%d.wal", id))
+}
+
+// listWALSegments returns the ids of the WAL segments in walDir, oldest first
+func listWALSegments(walDir string) ([]int64, error) {
+	files, err := os.ReadDir(walDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []int64
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".wal" {
+			continue
+		}
+
+		// Parse timestamp from filename
+		var id int64
+		if _, err := fmt.Sscanf(file.Name(), "%d.wal", &id); err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	return ids, nil
+}
+
+// loadIndex brings the segment index in line with the segments on disk.
+// The index is kept in memory once loaded; before that it is read from the
+// index file. Segments the index doesn't cover, e.g. because the index file
+// is missing or corrupt, are scanned, and a writable WAL then saves the
+// rebuilt index. Callers must hold w.mu.
+func (w *WAL) loadIndex() error {
+	ids, err := listWALSegments(w.walDir)
+	if err != nil {
+		return err
+	}
+
+	known := make(map[int64]walSegment)
+	trusted := w.segments != nil
+	if trusted {
+		for _, seg := range w.segments {
+			known[seg.id] = seg
+		}
+	} else if saved, err := readWALIndex(filepath.Join(w.walDir, walIndexFile)); err == nil {
+		for _, seg := range saved {
+			known[seg.id] = seg
+		}
+	}
+
+	segments := make([]walSegment, 0, len(ids))
+	rebuilt := false
+	for _, id := range ids {
+		seg, ok := known[id]
+
+		// A saved segment without points may have been written to since
+		if !ok || (!trusted && len(seg.points) == 0) {
+			path := w.segmentPath(id)
+			points, err := w.scanSegment(path)
+			if w.skipSegment(path, err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			seg = walSegment{id: id, points: points}
+			rebuilt = true
+		}
+		segments = append(segments, seg)
+	}
+	w.segments = segments
+
+	if rebuilt && w.writer != nil {
+		w.saveIndex()
+	}
+
+	return nil
+}
+
+// scanSegment reads the index points of the WAL segment at path
+func (w *WAL) scanSegment(path string) ([]walIndexPoint, error) {
+	w.segmentOpens.Add(1)
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open WAL file: %w", err)
+	}
+	defer file.Close()
+
+	// An empty file has no entries (a writable WAL removes it on open)
+	if info, err := file.Stat(); err == nil && info.Size() == 0 {
+		return nil, nil
+	}
+
+	// Entries start after the header
+	walHeader, err := readWALHeader(file)
+	if err != nil {
+		return nil, err
+	}
+	offset := walHeader.size
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to seek WAL file: %w", err)
+	}
+
+	reader := bufio.NewReader(file)
+	header := make([]byte, 16)
+	var points []walIndexPoint
+	for {
+		// Entry header and timestamp; a short or zero header ends the entries
+		if _, err := io.ReadFull(reader, header); err != nil {
+			break
+		}
+		entrySize := int64(walHeader.byteOrder().Uint32(header[4:]))
+		if entrySize < 8 {
+			break
+		}
+
+		timestamp := int64(walHeader.byteOrder().Uint64(header[8:]))
+		points = addIndexPoint(points, timestamp, offset)
+
+		if _, err := reader.Discard(int(entrySize - 8)); err != nil {
+			break
+		}
+		offset += 8 + entrySize
+	}
+
+	return points, nil
+}
+
+// addIndexPoint records the entry at offset if it is the segment's first
+// entry or far enough past the last point
+func addIndexPoint(points []walIndexPoint, timestamp, offset int64) []walIndexPoint {
+	if n := len(points); n > 0 && offset-points[n-1].offset < walIndexInterval {
+		return points
+	}
+	return append(points, walIndexPoint{timestamp: timestamp, offset: offset})
+}
+
+// indexEntry records an entry written to the current segment at offset.
+// Callers must hold w.mu.
+func (w *WAL) indexEntry(timestamp, offset int64) {
+	if n := len(w.segments); n > 0 {
+		seg := &w.segments[n-1]
+		seg.points = addIndexPoint(seg.points, timestamp, offset)
+	}
+}
+
+// unindexFrom forgets the index points of the current segment at or past
+// offset, after the entries there were discarded. Callers must hold w.mu.
+func (w *WAL) unindexFrom(offset int64) {
+	if n := len(w.segments); n > 0 {
+		seg := &w.segments[n-1]
+		for len(seg.points) > 0 && seg.points[len(seg.points)-1].offset >= offset {
+			seg.points = seg.points[:len(seg.points)-1]
+		}
+	}
+}
+
+// replayStart returns the position of the segment where a replay from
+// fromTimestamp starts, and the offset in it. Every entry before that is no
+// newer than fromTimestamp, given that timestamps increase through the WAL.
+// Callers must hold w.mu.
+func (w *WAL) replayStart(fromTimestamp int64) (int, int64) {
+	// Segments without entries don't take part in the search
+	var nonEmpty []int
+	for i, seg := range w.segments {
+		if len(seg.points) > 0 {
+			nonEmpty = append(nonEmpty, i)
+		}
+	}
+
+	// The last segment starting at or before fromTimestamp
+	k := sort.Search(len(nonEmpty), func(k int) bool {
+		return w.segments[nonEmpty[k]].points[0].timestamp > fromTimestamp
+	})
+	if k == 0 {
+		return 0, 0
+	}
+	start := nonEmpty[k-1]
+
+	// The last point in it at or before fromTimestamp
+	points := w.segments[start].points
+	j := sort.Search(len(points), func(j int) bool {
+		return points[j].timestamp > fromTimestamp
+	})
+
+	return start, points[j-1].offset
+}
+
+// saveIndex writes the segment index to the index file. The index only
+// speeds up replay and is rebuilt when the file is missing or corrupt, so a
+// failure to write it is not an error. Callers must hold w.mu.
+func (w *WAL) saveIndex() {
+	// Count of segments, then for each: id, count of points, and the points
+	size := 4
+	for _, seg := range w.segments {
+		size += 8 + 4 + 16*len(seg.points)
+	}
+	buf := make([]byte, size, size+4)
+
+	binary.LittleEndian.PutUint32(buf, uint32(len(w.segments)))
+	offset := 4
+	for _, seg := range w.segments {
+		binary.LittleEndian.PutUint64(buf[offset:], uint64(seg.id))
+		binary.LittleEndian.PutUint32(buf[offset+8:], uint32(len(seg.points)))
+		offset += 12
+		for _, p := range seg.points {
+			binary.LittleEndian.PutUint64(buf[offset:], uint64(p.timestamp))
+			binary.LittleEndian.PutUint64(buf[offset+8:], uint64(p.offset))
+			offset += 16
+		}
+	}
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.Checksum(buf, w.crc32Table))
+
+	// Replace the index file atomically
+	path := filepath.Join(w.walDir, walIndexFile)
+	tempPath := path + ".tmp"
+	if err := os.WriteFile(tempPath, buf, 0644); err != nil {
+		os.Remove(tempPath)
+		return
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		os.Remove(tempPath)
+	}
+}
+
+// readWALIndex reads a segment index written by saveIndex
+func readWALIndex(path string) ([]walSegment, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(buf) < 8 {
+		return nil, fmt.Errorf("%w: WAL index too short", ErrCorrupt)
+	}
+	body := buf[:len(buf)-4]
+	if crc32.Checksum(body, crc32.MakeTable(crc32.Castagnoli)) != binary.LittleEndian.Uint32(buf[len(body):]) {
+		return nil, fmt.Errorf("%w: WAL index CRC mismatch", ErrCorrupt)
+	}
+
+	count := int(binary.LittleEndian.Uint32(body))
+	offset := 4
+	segments := make([]walSegment, 0, count)
+	for i := 0; i < count; i++ {
+		if len(body)-offset < 12 {
+			return nil, fmt.Errorf("%w: WAL index truncated", ErrCorrupt)
+		}
+		seg := walSegment{id: int64(binary.LittleEndian.Uint64(body[offset:]))}
+		n := int(binary.LittleEndian.Uint32(body[offset+8:]))
+		offset += 12
+
+		if (len(body)-offset)/16 < n {
+			return nil, fmt.Errorf("%w: WAL index truncated", ErrCorrupt)
+		}
+		for j := 0; j < n; j++ {
+			seg.points = append(seg.points, walIndexPoint{
+				timestamp: int64(binary.LittleEndian.Uint64(body[offset:])),
+				offset:    int64(binary.LittleEndian.Uint64(body[offset+8:])),
+			})
+			offset += 16
+		}
+		segments = append(segments, seg)
+	}
+
+	return segments, nil
+}
+
+// forgetIndex drops the segment index kept in memory, so the next replay
+// reads it from disk again. A read-only WAL forgets it to see what its
+// directory's writer appended since.
+func (w *WAL) forgetIndex() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.segments = nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !windows
+
+package storage
+
+import (
+	"errors"
+	"os"
+)
+
+// preallocate is not supported on this platform; WAL files grow as they are written
+func preallocate(file *os.File, size int64) error {
+	return errors.New("WAL preallocation is not supported on this platform")
+}
@@ -0,0 +1,901 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestWAL_PreallocatedRotation checks the logical size of preallocated WAL
+// files across a rotation and a reopen
+func TestWAL_PreallocatedRotation(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-wal-prealloc-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	wal, err := NewWAL(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	wal.maxSize = 4096
+	wal.setPreallocate(true)
+
+	// walFiles returns the WAL files, oldest first
+	walFiles := func() []string {
+		files, err := filepath.Glob(filepath.Join(tempDir, "*.wal"))
+		if err != nil {
+			t.Fatalf("Failed to list WAL files: %v", err)
+		}
+		return files
+	}
+	fileSize := func(path string) int64 {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("Failed to stat %s: %v", path, err)
+		}
+		return info.Size()
+	}
+
+	// Append until just before the first rotation
+	var total int64
+	written := int64(walHeaderSize)
+	appended := 0
+	for written < wal.maxSize {
+		key := []byte(fmt.Sprintf("key-%03d", appended))
+		value := make([]byte, 100)
+		if err := wal.AppendPut(key, value); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+		size := WALEntry{Key: key, Value: value}.encodedSize()
+		written += size
+		total += size
+		appended++
+	}
+	if wal.size != written {
+		t.Errorf("Expected logical size %d, got %d", written, wal.size)
+	}
+	first := walFiles()[0]
+	if wal.preallocated && fileSize(first) < wal.size {
+		t.Errorf("Expected a preallocated file of at least %d bytes, got %d", wal.size, fileSize(first))
+	}
+
+	// The next append rotates to a new file
+	if err := wal.AppendDelete([]byte("deleted")); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+	appended++
+	deleteSize := WALEntry{Key: []byte("deleted")}.encodedSize()
+	total += deleteSize
+
+	if files := walFiles(); len(files) != 2 {
+		t.Fatalf("Expected 2 WAL files after rotation, got %d", len(files))
+	}
+	if got := fileSize(first); got != written {
+		t.Errorf("Expected the rotated file to be truncated to %d bytes, got %d", written, got)
+	}
+	if wal.size != walHeaderSize+deleteSize {
+		t.Errorf("Expected logical size %d after rotation, got %d", walHeaderSize+deleteSize, wal.size)
+	}
+
+	// Reopen without closing, as after a crash: the zero-filled tail is ignored
+	reopened, err := NewWAL(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	}
+	if reopened.size != walHeaderSize+deleteSize {
+		t.Errorf("Expected logical size %d after reopening, got %d", walHeaderSize+deleteSize, reopened.size)
+	}
+	if err := reopened.AppendPut([]byte("after"), []byte("reopen")); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+	appended++
+	total += WALEntry{Key: []byte("after"), Value: []byte("reopen")}.encodedSize()
+
+	var replayed, replayedBytes int64
+	if err := reopened.Replay(func(entry WALEntry) error {
+		replayed++
+		replayedBytes += entry.encodedSize()
+		return nil
+	}); err != nil {
+		t.Fatalf("Failed to replay: %v", err)
+	}
+	if replayed != int64(appended) || replayedBytes != total {
+		t.Errorf("Expected %d entries (%d bytes), replayed %d (%d bytes)", appended, total, replayed, replayedBytes)
+	}
+
+	wal.file.Close()
+	if err := reopened.Close(); err != nil {
+		t.Fatalf("Failed to close WAL: %v", err)
+	}
+	last := walFiles()[1]
+	if got := fileSize(last); got != reopened.size {
+		t.Errorf("Expected the closed file to be truncated to %d bytes, got %d", reopened.size, got)
+	}
+}
+
+// TestWAL_HistoryOf writes several versions of a key across WAL segments
+// and checks its full history is returned in order
+func TestWAL_HistoryOf(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-wal-history-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	wal, err := NewWAL(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer wal.Close()
+	wal.maxSize = 16 // Rotate before every entry
+
+	writes := []struct {
+		opType     byte
+		key, value string
+	}{
+		{OpTypePut, "key", "v1"},
+		{OpTypePut, "other", "x"},
+		{OpTypePut, "key", "v2"},
+		{OpTypeDelete, "key", ""},
+		{OpTypePut, "other", "y"},
+		{OpTypePut, "key", "v3"},
+	}
+	for _, w := range writes {
+		if w.opType == OpTypeDelete {
+			err = wal.AppendDelete([]byte(w.key))
+		} else {
+			err = wal.AppendPut([]byte(w.key), []byte(w.value))
+		}
+		if err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+	}
+
+	if files, _ := filepath.Glob(filepath.Join(tempDir, "*.wal")); len(files) < 3 {
+		t.Fatalf("Expected the writes to span several WAL files, got %d", len(files))
+	}
+
+	history, err := wal.HistoryOf([]byte("key"))
+	if err != nil {
+		t.Fatalf("Failed to read history: %v", err)
+	}
+
+	var got []string
+	for i, entry := range history {
+		got = append(got, fmt.Sprintf("%d:%s", entry.OpType, entry.Value))
+		if i > 0 && entry.Timestamp < history[i-1].Timestamp {
+			t.Errorf("Entry %d is older than the entry before it", i)
+		}
+	}
+	if expected := "[1:v1 1:v2 2: 1:v3]"; fmt.Sprint(got) != expected {
+		t.Errorf("Expected history %s, got %v", expected, got)
+	}
+
+	// A key that was never written has no history
+	if history, err := wal.HistoryOf([]byte("missing")); err != nil || len(history) != 0 {
+		t.Errorf("Expected no history, got %v (err %v)", history, err)
+	}
+}
+
+// TestWAL_SegmentIndex checks that a replay from a late timestamp only opens
+// the segments it needs, and that a missing or corrupt index is rebuilt
+func TestWAL_SegmentIndex(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-wal-index-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	wal, err := NewWAL(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	wal.maxSize = 16 // Rotate before every entry
+
+	const segments = 50
+	for i := 0; i < segments; i++ {
+		if err := wal.AppendPut([]byte(fmt.Sprintf("key-%02d", i)), []byte("value")); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+	}
+	var timestamps []int64
+	if err := wal.Replay(func(entry WALEntry) error {
+		timestamps = append(timestamps, entry.Timestamp)
+		return nil
+	}); err != nil {
+		t.Fatalf("Failed to replay: %v", err)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatalf("Failed to close WAL: %v", err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(tempDir, "*.wal")); len(files) != segments {
+		t.Fatalf("Expected %d WAL files, got %d", segments, len(files))
+	}
+
+	// replayTail reopens the WAL and replays the entries after entry 45,
+	// returning their keys and the number of segments opened
+	replayTail := func() ([]string, int64, int64) {
+		wal, err := NewWAL(tempDir)
+		if err != nil {
+			t.Fatalf("Failed to reopen WAL: %v", err)
+		}
+		defer wal.Close()
+		wal.maxSize = 16
+
+		opened := wal.segmentOpens.Load()
+		var keys []string
+		if err := wal.ReplayFrom(timestamps[45], func(entry WALEntry) error {
+			keys = append(keys, string(entry.Key))
+			return nil
+		}); err != nil {
+			t.Fatalf("Failed to replay: %v", err)
+		}
+		return keys, opened, wal.segmentOpens.Load() - opened
+	}
+
+	// The saved index is used as is, and the replay opens the segment of
+	// entry 45 and the ones after it
+	keys, scanned, replayed := replayTail()
+	if expected := "[key-46 key-47 key-48 key-49]"; fmt.Sprint(keys) != expected {
+		t.Errorf("Expected keys %s, got %v", expected, keys)
+	}
+	if scanned != 0 {
+		t.Errorf("Expected no segments to be scanned on open, got %d", scanned)
+	}
+	if replayed != 5 {
+		t.Errorf("Expected 5 segments to be opened by the replay, got %d", replayed)
+	}
+
+	// A corrupt index is rebuilt by scanning every segment, then saved again
+	indexPath := filepath.Join(tempDir, walIndexFile)
+	data, err := os.ReadFile(indexPath)
+	if err != nil {
+		t.Fatalf("Failed to read index: %v", err)
+	}
+	data[len(data)/2] ^= 0xFF
+	if err := os.WriteFile(indexPath, data, 0644); err != nil {
+		t.Fatalf("Failed to corrupt index: %v", err)
+	}
+	keys, scanned, replayed = replayTail()
+	if len(keys) != 4 || scanned != segments || replayed != 5 {
+		t.Errorf("Expected 4 keys, %d scans and 5 replays with a corrupt index, got %v, %d and %d", segments, keys, scanned, replayed)
+	}
+	if _, scanned, _ = replayTail(); scanned != 0 {
+		t.Errorf("Expected the rebuilt index to be saved, but %d segments were scanned", scanned)
+	}
+
+	// So is a missing one
+	if err := os.Remove(indexPath); err != nil {
+		t.Fatalf("Failed to remove index: %v", err)
+	}
+	keys, scanned, replayed = replayTail()
+	if len(keys) != 4 || scanned != segments || replayed != 5 {
+		t.Errorf("Expected 4 keys, %d scans and 5 replays without an index, got %v, %d and %d", segments, keys, scanned, replayed)
+	}
+}
+
+// TestWAL_SegmentIndexOffset checks that a replay starts at an indexed entry
+// within a large segment rather than at its beginning
+func TestWAL_SegmentIndexOffset(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-wal-index-offset-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	wal, err := NewWAL(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer wal.Close()
+
+	const entries = 300
+	value := make([]byte, 1024)
+	for i := 0; i < entries; i++ {
+		if err := wal.AppendPut([]byte(fmt.Sprintf("key-%03d", i)), value); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+	}
+	var timestamps []int64
+	if err := wal.Replay(func(entry WALEntry) error {
+		timestamps = append(timestamps, entry.Timestamp)
+		return nil
+	}); err != nil {
+		t.Fatalf("Failed to replay: %v", err)
+	}
+
+	wal.mu.Lock()
+	points := len(wal.segments[0].points)
+	_, offset := wal.replayStart(timestamps[entries-10])
+	wal.mu.Unlock()
+	if points < 4 {
+		t.Errorf("Expected at least 4 index points in the segment, got %d", points)
+	}
+	if offset < 3*walIndexInterval {
+		t.Errorf("Expected the replay to start past offset %d, got %d", 3*walIndexInterval, offset)
+	}
+
+	var keys []string
+	if err := wal.ReplayFrom(timestamps[entries-10], func(entry WALEntry) error {
+		keys = append(keys, string(entry.Key))
+		return nil
+	}); err != nil {
+		t.Fatalf("Failed to replay: %v", err)
+	}
+	if len(keys) != 9 || keys[0] != fmt.Sprintf("key-%03d", entries-9) {
+		t.Errorf("Expected the last 9 keys, got %v", keys)
+	}
+}
+
+// TestWAL_Checksum writes entries checksummed with xxHash, then with CRC32C
+// after reopening, and checks every entry replays, along with a segment
+// written before segments had a header
+func TestWAL_Checksum(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-wal-checksum-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// A legacy segment: a CRC32C segment without its header
+	legacy, err := NewWAL(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	if err := legacy.AppendPut([]byte("legacy"), []byte("value")); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+	path := legacy.file.Name()
+	if err := legacy.Close(); err != nil {
+		t.Fatalf("Failed to close WAL: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read WAL file: %v", err)
+	}
+	if err := os.WriteFile(path, data[walHeaderSize:], 0644); err != nil {
+		t.Fatalf("Failed to write WAL file: %v", err)
+	}
+
+	// Switching to xxHash starts a new segment recording it
+	wal, err := NewWAL(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	}
+	if err := wal.setChecksum(WALChecksumXXHash); err != nil {
+		t.Fatalf("Failed to set checksum: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := wal.AppendPut([]byte(fmt.Sprintf("xxhash-%d", i)), []byte("value")); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+	}
+	path = wal.file.Name()
+	if err := wal.Close(); err != nil {
+		t.Fatalf("Failed to close WAL: %v", err)
+	}
+	data, err = os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read WAL file: %v", err)
+	}
+	if string(data[:len(walMagic)]) != string(walMagic) || WALChecksum(data[5]) != WALChecksumXXHash {
+		t.Errorf("Expected a header recording xxhash, got %v", data[:walHeaderSize])
+	}
+
+	// Entries are verified with the algorithm of their segment
+	wal, err = NewWAL(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	}
+	defer wal.Close()
+	if err := wal.setChecksum(WALChecksumCRC32C); err != nil {
+		t.Fatalf("Failed to set checksum: %v", err)
+	}
+	if err := wal.AppendPut([]byte("crc32c"), []byte("value")); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+
+	var keys []string
+	if err := wal.Replay(func(entry WALEntry) error {
+		keys = append(keys, string(entry.Key))
+		return nil
+	}); err != nil {
+		t.Fatalf("Failed to replay: %v", err)
+	}
+	if len(keys) != 12 || keys[0] != "legacy" || keys[1] != "xxhash-0" || keys[11] != "crc32c" {
+		t.Errorf("Expected the legacy, xxhash and crc32c entries, got %v", keys)
+	}
+
+	// A corrupt xxHash entry is detected
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Failed to write WAL file: %v", err)
+	}
+	if err := wal.Replay(func(entry WALEntry) error { return nil }); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Expected a corrupt entry to be detected, got %v", err)
+	}
+}
+
+// TestWAL_UnknownChecksum checks a segment recording an unknown checksum
+// algorithm is rejected rather than replayed
+func TestWAL_UnknownChecksum(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-wal-unknown-checksum-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	wal, err := NewWAL(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	if err := wal.AppendPut([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatalf("Failed to close WAL: %v", err)
+	}
+
+	// Add an older segment recording algorithm 99
+	header := walHeader{version: walFormatVersion, checksum: 99, created: 1}
+	if err := os.WriteFile(filepath.Join(tempDir, "1.wal"), header.encode(), 0644); err != nil {
+		t.Fatalf("Failed to write WAL file: %v", err)
+	}
+	os.Remove(filepath.Join(tempDir, walIndexFile))
+
+	if _, err := NewWAL(tempDir); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Expected the unknown algorithm to be rejected, got %v", err)
+	}
+
+	// Nor can it be configured
+	if err := wal.setChecksum(WALChecksum(99)); err == nil {
+		t.Errorf("Expected an unknown algorithm to be refused")
+	}
+}
+
+// TestWAL_SegmentHeader checks a WAL file with a valid header replays, and
+// that a file with a bad magic is rejected, or skipped in best-effort mode
+func TestWAL_SegmentHeader(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-wal-header-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	wal, err := NewWAL(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := wal.AppendPut([]byte(fmt.Sprintf("key-%d", i)), []byte("value")); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+	}
+	path := wal.file.Name()
+	if err := wal.Close(); err != nil {
+		t.Fatalf("Failed to close WAL: %v", err)
+	}
+
+	// The header records the format version, checksum and creation time
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open WAL file: %v", err)
+	}
+	header, err := readWALHeader(file)
+	file.Close()
+	if err != nil {
+		t.Fatalf("Failed to read header: %v", err)
+	}
+	var id int64
+	fmt.Sscanf(filepath.Base(path), "%d.wal", &id)
+	if header.version != walFormatVersion || header.checksum != WALChecksumCRC32C || header.created != id {
+		t.Errorf("Expected version %d, crc32c and creation time %d, got %+v", walFormatVersion, id, header)
+	}
+
+	// countEntries reopens the WAL and counts the entries it replays
+	countEntries := func(bestEffort bool) (int, error) {
+		wal, err := newWAL(tempDir, bestEffort)
+		if err != nil {
+			return 0, err
+		}
+		defer wal.Close()
+
+		entries := 0
+		err = wal.Replay(func(entry WALEntry) error {
+			entries++
+			return nil
+		})
+		return entries, err
+	}
+	if entries, err := countEntries(false); err != nil || entries != 10 {
+		t.Errorf("Expected 10 entries, got %d (err %v)", entries, err)
+	}
+
+	// A foreign file with a bad magic
+	if err := os.WriteFile(filepath.Join(tempDir, "1.wal"), []byte("not a WAL file at all"), 0644); err != nil {
+		t.Fatalf("Failed to write WAL file: %v", err)
+	}
+	if _, err := countEntries(false); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Expected a file with a bad magic to be rejected, got %v", err)
+	}
+
+	// Best-effort mode skips it, keeping the valid file's entries
+	if entries, err := countEntries(true); err != nil || entries != 10 {
+		t.Errorf("Expected the 10 valid entries in best-effort mode, got %d (err %v)", entries, err)
+	}
+}
+
+// TestWAL_ReplayProgress replays a WAL of several segments with progress
+// reports every few entries, and checks the counts increase up to the
+// entries and bytes replayed
+func TestWAL_ReplayProgress(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-wal-progress-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	wal, err := NewWAL(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	defer wal.Close()
+	wal.maxSize = 256 // A few entries per segment
+
+	const numEntries = 100
+	for i := 0; i < numEntries; i++ {
+		if err := wal.AppendPut([]byte(fmt.Sprintf("key-%03d", i)), []byte("value")); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+	}
+	if files, _ := filepath.Glob(filepath.Join(tempDir, "*.wal")); len(files) < 10 {
+		t.Fatalf("Expected at least 10 WAL files, got %d", len(files))
+	}
+
+	var entries, bytes []int64
+	var replayedBytes int64
+	err = wal.ReplayFromWithProgress(0, func(entry WALEntry) error {
+		replayedBytes += entry.encodedSize()
+		return nil
+	}, ReplayProgress{
+		Callback: func(e, b int64) {
+			entries = append(entries, e)
+			bytes = append(bytes, b)
+		},
+		Entries: 7,
+	})
+	if err != nil {
+		t.Fatalf("Failed to replay: %v", err)
+	}
+
+	// Every 7 entries, and once more for the last 2
+	if len(entries) != numEntries/7+1 {
+		t.Errorf("Expected %d reports, got %d: %v", numEntries/7+1, len(entries), entries)
+	}
+	for i := range entries {
+		if i > 0 && (entries[i] <= entries[i-1] || bytes[i] <= bytes[i-1]) {
+			t.Errorf("Expected increasing counts, got %d entries (%d bytes) after %d (%d bytes)", entries[i], bytes[i], entries[i-1], bytes[i-1])
+		}
+		if i < len(entries)-1 && entries[i] != int64(7*(i+1)) {
+			t.Errorf("Expected report %d at %d entries, got %d", i, 7*(i+1), entries[i])
+		}
+	}
+	if n := len(entries); n == 0 || entries[n-1] != numEntries || bytes[n-1] != replayedBytes {
+		t.Errorf("Expected the last report at %d entries (%d bytes), got %v and %v", numEntries, replayedBytes, entries, bytes)
+	}
+
+	// Reports by bytes
+	var reports int
+	if err := wal.ReplayFromWithProgress(0, func(WALEntry) error { return nil }, ReplayProgress{
+		Callback: func(int64, int64) { reports++ },
+		Bytes:    replayedBytes / 4,
+	}); err != nil {
+		t.Fatalf("Failed to replay: %v", err)
+	}
+	if reports < 4 || reports > 5 {
+		t.Errorf("Expected 4 or 5 reports every quarter of the bytes, got %d", reports)
+	}
+}
+
+// TestWAL_Compression appends a large compressible value, a small one and a
+// delete with compression enabled, and checks the WAL file is smaller than
+// the large value alone while replay restores every entry exactly
+func TestWAL_Compression(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-wal-compression-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	wal, err := NewWAL(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	wal.setCompressionThreshold(1024)
+
+	large := bytes.Repeat([]byte("river compresses large WAL values "), 32*1024)
+	small := bytes.Repeat([]byte("a"), 512)
+	if err := wal.AppendPut([]byte("large"), large); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+
+	// A value below the threshold is stored as is
+	before := wal.size
+	if err := wal.AppendPut([]byte("small"), small); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+	if size := (WALEntry{Key: []byte("small"), Value: small}).encodedSize(); wal.size-before != size {
+		t.Errorf("Expected the small value to take %d bytes uncompressed, got %d", size, wal.size-before)
+	}
+	if err := wal.AppendDelete([]byte("large")); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatalf("Failed to close WAL: %v", err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(tempDir, "*.wal"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expected one WAL file, got %v (err %v)", files, err)
+	}
+	info, err := os.Stat(files[0])
+	if err != nil {
+		t.Fatalf("Failed to stat WAL file: %v", err)
+	}
+	if info.Size() >= int64(len(large))/10 {
+		t.Errorf("Expected the WAL file to be much smaller than the %d byte value, got %d bytes", len(large), info.Size())
+	}
+
+	// Replay decompresses the value, without the compression flag
+	reopened, err := NewWAL(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	}
+	defer reopened.Close()
+
+	var entries []WALEntry
+	if err := reopened.Replay(func(entry WALEntry) error {
+		entries = append(entries, entry)
+		return nil
+	}); err != nil {
+		t.Fatalf("Failed to replay: %v", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(entries))
+	}
+	if entries[0].OpType != OpTypePut || string(entries[0].Key) != "large" || !bytes.Equal(entries[0].Value, large) {
+		t.Errorf("Expected the large value to be replayed exactly, got op %d key %q and %d bytes", entries[0].OpType, entries[0].Key, len(entries[0].Value))
+	}
+	if entries[1].OpType != OpTypePut || !bytes.Equal(entries[1].Value, small) {
+		t.Errorf("Expected the small value to be replayed exactly, got op %d and %d bytes", entries[1].OpType, len(entries[1].Value))
+	}
+	if entries[2].OpType != OpTypeDelete || string(entries[2].Key) != "large" {
+		t.Errorf("Expected the delete of large, got op %d key %q", entries[2].OpType, entries[2].Key)
+	}
+}
+
+// TestWAL_BufferFlushSize checks asynchronous appends are written to the
+// file once the buffer holds the flush size, without waiting for a sync
+func TestWAL_BufferFlushSize(t *testing.T) {
+	// Hold the background sync, so appends only reach the file by a flush
+	var fsyncs atomic.Int32
+	var started, release chan struct{}
+	original := fsyncFile
+	fsyncFile = func(f *os.File) error {
+		fsyncs.Add(1)
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		return original(f)
+	}
+	defer func() { fsyncFile = original }()
+
+	// fileSize returns the bytes of the WAL file on disk
+	fileSize := func(wal *WAL) int64 {
+		info, err := wal.file.Stat()
+		if err != nil {
+			t.Fatalf("Failed to stat WAL file: %v", err)
+		}
+		return info.Size()
+	}
+
+	for _, flushSize := range []int{1000, 0} {
+		started, release = make(chan struct{}, 1), make(chan struct{})
+		tempDir, err := os.MkdirTemp("", "river-wal-buffer-flush-test")
+		if err != nil {
+			t.Fatalf("Failed to create temp dir: %v", err)
+		}
+		defer os.RemoveAll(tempDir)
+
+		wal, err := NewWAL(tempDir)
+		if err != nil {
+			t.Fatalf("Failed to create WAL: %v", err)
+		}
+		if err := wal.setBufferFlushSize(flushSize); err != nil {
+			t.Fatalf("Failed to set buffer flush size: %v", err)
+		}
+
+		// The first append is flushed by the syncer, which then waits
+		value := bytes.Repeat([]byte("v"), 80)
+		if _, err := wal.AppendPutAsync([]byte("key-00"), value); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for the WAL sync")
+		}
+		synced := fsyncs.Load()
+		base := fileSize(wal)
+
+		entry := (WALEntry{Key: []byte("key-01"), Value: value}).encodedSize()
+		below := 0
+		if flushSize > 0 {
+			below = (flushSize - 1) / int(entry)
+		}
+		for i := 1; i <= below; i++ {
+			if _, err := wal.AppendPutAsync([]byte(fmt.Sprintf("key-%02d", i)), value); err != nil {
+				t.Fatalf("Failed to append: %v", err)
+			}
+		}
+		if size := fileSize(wal); size != base {
+			t.Errorf("Flush size %d: expected %d bytes on disk below the threshold, got %d", flushSize, base, size)
+		}
+
+		// Reaching the threshold writes the buffer out, without a sync
+		if _, err := wal.AppendPutAsync([]byte(fmt.Sprintf("key-%02d", below+1)), value); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+		expected := base
+		if flushSize > 0 {
+			expected += int64(below+1) * entry
+		}
+		if size := fileSize(wal); size != expected {
+			t.Errorf("Flush size %d: expected %d bytes on disk, got %d", flushSize, expected, size)
+		}
+		if n := fsyncs.Load(); n != synced {
+			t.Errorf("Flush size %d: expected no sync from the flush, got %d", flushSize, n-synced)
+		}
+
+		close(release)
+		if err := wal.Close(); err != nil {
+			t.Fatalf("Failed to close WAL: %v", err)
+		}
+	}
+}
+
+// TestWAL_BigEndian converts a WAL segment to big-endian, as another
+// implementation might write it, and checks its entries, including a
+// compressed value and an import, replay as written, and that the writer
+// starts a new segment rather than appending to it
+func TestWAL_BigEndian(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "river-wal-big-endian-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	wal, err := NewWAL(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+	wal.setCompressionThreshold(1024)
+	large := bytes.Repeat([]byte("river compresses large WAL values "), 1024)
+	if err := wal.AppendPut([]byte("large"), large); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+	if err := wal.AppendPut([]byte("small"), []byte("value")); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+	if err := wal.AppendDelete([]byte("large")); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+	if err := wal.AppendImport("import-1", 12345); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+	path := wal.file.Name()
+	if err := wal.Close(); err != nil {
+		t.Fatalf("Failed to close WAL: %v", err)
+	}
+
+	// Rewrite every multi-byte field of the header and entries big-endian,
+	// with checksums over the converted bytes
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read WAL file: %v", err)
+	}
+	header := walHeader{
+		version:  walFormatVersion,
+		checksum: WALChecksumCRC32C,
+		order:    binary.BigEndian,
+		created:  int64(binary.LittleEndian.Uint64(data[8:])),
+	}
+	converted := header.encode()
+	var timestamps []int64
+	for offset := walHeaderSize; offset < len(data); {
+		size := int(binary.LittleEndian.Uint32(data[offset+4:]))
+		entry := bytes.Clone(data[offset : offset+8+size])
+		offset += 8 + size
+
+		swap32 := func(at int) { binary.BigEndian.PutUint32(entry[at:], binary.LittleEndian.Uint32(entry[at:])) }
+		swap64 := func(at int) { binary.BigEndian.PutUint64(entry[at:], binary.LittleEndian.Uint64(entry[at:])) }
+		timestamps = append(timestamps, int64(binary.LittleEndian.Uint64(entry[8:])))
+		swap32(4)
+		swap64(8)
+		opType := entry[16]
+		keyLen := int(binary.LittleEndian.Uint32(entry[17:]))
+		swap32(17)
+		valueAt := 21 + keyLen
+		swap32(valueAt)
+		if opType&opFlagCompressed != 0 {
+			swap32(valueAt + 4)
+		}
+		if opType == OpTypeImport {
+			swap64(valueAt + 4)
+		}
+		binary.BigEndian.PutUint32(entry, WALChecksumCRC32C.sum(entry[4:]))
+		converted = append(converted, entry...)
+	}
+	if len(timestamps) != 4 {
+		t.Fatalf("Expected 4 entries in the WAL file, got %d", len(timestamps))
+	}
+	if err := os.WriteFile(path, converted, 0644); err != nil {
+		t.Fatalf("Failed to write WAL file: %v", err)
+	}
+	os.Remove(filepath.Join(tempDir, walIndexFile))
+
+	// The writer doesn't append little-endian entries to the segment
+	wal, err = NewWAL(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	}
+	defer wal.Close()
+	if wal.file.Name() == path {
+		t.Errorf("Expected a new segment after a big-endian one")
+	}
+	if err := wal.AppendPut([]byte("after"), []byte("reopen")); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+
+	var replayed []string
+	if err := wal.ReplayFrom(timestamps[0], func(entry WALEntry) error {
+		switch entry.OpType {
+		case OpTypeImport:
+			replayed = append(replayed, fmt.Sprintf("import %s@%d", entry.Key, binary.LittleEndian.Uint64(entry.Value)))
+		case OpTypeDelete:
+			replayed = append(replayed, fmt.Sprintf("delete %s", entry.Key))
+		default:
+			replayed = append(replayed, fmt.Sprintf("put %s=%s", entry.Key, entry.Value))
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("Failed to replay: %v", err)
+	}
+	expected := "[put small=value delete large import import-1@12345 put after=reopen]"
+	if fmt.Sprint(replayed) != expected {
+		t.Errorf("Expected %s, got %s", expected, replayed)
+	}
+
+	var value []byte
+	if err := wal.Replay(func(entry WALEntry) error {
+		if string(entry.Key) == "large" && entry.OpType == OpTypePut {
+			value = entry.Value
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("Failed to replay: %v", err)
+	}
+	if !bytes.Equal(value, large) {
+		t.Errorf("Expected the compressed value to replay exactly, got %d bytes", len(value))
+	}
+}
@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// watchdog reports engine operations running longer than a threshold, such
+// as a Put waiting on a lock held by a stuck flush, with a warning and a
+// dump of every goroutine's stack, so hangs can be diagnosed. It only
+// observes operations: they are never interrupted.
+type watchdog struct {
+	// Duration after which a running operation is reported
+	threshold time.Duration
+
+	// Mutex to protect the operations and the log function
+	mu sync.Mutex
+
+	// Running operations by ID, and the ID of the next one
+	ops    map[uint64]*watchedOp
+	nextID uint64
+
+	// Writes the warnings, fmt.Printf by default
+	logf func(format string, args ...interface{})
+
+	// Closed to stop the checks, and once they stopped
+	stop chan struct{}
+	done chan struct{}
+}
+
+// watchedOp is an operation tracked by a watchdog
+type watchedOp struct {
+	// Name of the operation, e.g. "Put"
+	name string
+
+	// Time the operation started
+	start time.Time
+
+	// Whether the operation was reported
+	reported bool
+}
+
+// newWatchdog starts a watchdog reporting operations running longer than
+// threshold, or returns nil if threshold is not positive. A nil watchdog
+// tracks nothing.
+func newWatchdog(threshold time.Duration) *watchdog {
+	if threshold <= 0 {
+		return nil
+	}
+
+	w := &watchdog{
+		threshold: threshold,
+		ops:       make(map[uint64]*watchedOp),
+		logf: func(format string, args ...interface{}) {
+			fmt.Printf(format, args...)
+		},
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// track starts tracking an operation, returning the function that ends it
+func (w *watchdog) track(name string) func() {
+	if w == nil {
+		return func() {}
+	}
+
+	w.mu.Lock()
+	id := w.nextID
+	w.nextID++
+	op := &watchedOp{name: name, start: time.Now()}
+	w.ops[id] = op
+	w.mu.Unlock()
+
+	return func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+
+		delete(w.ops, id)
+		if op.reported {
+			w.logf("Warning: %s completed after %v\n", op.name, time.Since(op.start))
+		}
+	}
+}
+
+// run checks the running operations several times per threshold until the
+// watchdog is closed
+func (w *watchdog) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(max(w.threshold/4, time.Millisecond))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.check()
+		}
+	}
+}
+
+// check reports, once each, the operations running longer than the
+// threshold, followed by the stacks of all goroutines
+func (w *watchdog) check() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	reported := false
+	for _, op := range w.ops {
+		if op.reported || time.Since(op.start) < w.threshold {
+			continue
+		}
+		op.reported = true
+		reported = true
+		w.logf("Warning: %s has been running for %v (watchdog threshold %v)\n", op.name, time.Since(op.start).Round(time.Millisecond), w.threshold)
+	}
+	if reported {
+		w.logf("Goroutine stacks:\n%s\n", stacks())
+	}
+}
+
+// close stops the watchdog
+func (w *watchdog) close() {
+	if w == nil {
+		return
+	}
+	close(w.stop)
+	<-w.done
+}
+
+// stacks returns the stack traces of all goroutines
+func stacks() []byte {
+	buf := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}